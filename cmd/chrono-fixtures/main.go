@@ -0,0 +1,84 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// chrono-fixtures writes the benchmark fixture sets.
+//
+// Synthetic (what `make fixtures` runs):
+//
+//	go run ./cmd/chrono-fixtures -out proxy/testdata/bench
+//
+// Recorded from a real Prometheus, for when synthetic data isn't telling the
+// whole story:
+//
+//	go run ./cmd/chrono-fixtures -out proxy/testdata/bench \
+//	    -record http://prometheus:9090 -query 'up' -name range_up
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func main() {
+	out := flag.String("out", "proxy/testdata/bench", "directory to write fixture sets into")
+	record := flag.String("record", "", "Prometheus base URL to record from instead of generating")
+	query := flag.String("query", "up", "PromQL to record (with -record)")
+	name := flag.String("name", "recorded", "fixture set name (with -record)")
+	points := flag.Int("points", 30, "samples per series (with -record)")
+	step := flag.Int64("step", 60, "seconds between samples (with -record)")
+	instant := flag.Bool("instant", false, "record an instant query instead of a range (with -record)")
+	flag.Parse()
+
+	if *record == "" {
+		for _, spec := range fixtures.StandardSpecs() {
+			set, err := fixtures.Generate(spec)
+			if err != nil {
+				log.Fatalf("generating %s: %v", spec.Name, err)
+			}
+			if err := set.Write(*out); err != nil {
+				log.Fatalf("writing %s: %v", spec.Name, err)
+			}
+			log.Printf("wrote %s/%s (%d series)", *out, spec.Name, spec.Series)
+		}
+		return
+	}
+
+	spec := fixtures.Spec{
+		Name:    *name,
+		Points:  *points,
+		Step:    *step,
+		End:     time.Now().Unix(),
+		Instant: *instant,
+	}
+	if spec.Instant {
+		spec.Points = 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	set, err := fixtures.Record(ctx, http.DefaultClient, *record, *query, spec)
+	if err != nil {
+		log.Fatalf("recording: %v", err)
+	}
+	if err := set.Write(*out); err != nil {
+		log.Fatalf("writing %s: %v", spec.Name, err)
+	}
+	log.Printf("recorded %s/%s from %s", *out, spec.Name, *record)
+}
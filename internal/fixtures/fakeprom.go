@@ -0,0 +1,123 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// internal/fixtures/fakeprom.go
+package fixtures
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// FakePrometheus is a stunt double for a real Prometheus!
+// It's an httptest server that answers with canned bodies, chosen by path
+// and by the evaluation time being asked for ("time" for instant queries,
+// "end" for ranges) - which is exactly how Chronotheus tells its windows
+// apart. Anything it doesn't have a canned answer for gets an empty, but
+// perfectly valid, success response.
+//
+// Every request is remembered, so tests can check what actually made it
+// upstream (no chrono_timeframe leaking through, please).
+type FakePrometheus struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses map[string]map[int64][]byte // path -> time/end -> body (0 = any time)
+	requests  []Request
+}
+
+// Request is what the fake saw from the proxy.
+type Request struct {
+	Method string
+	Path   string
+	Params url.Values
+	Header http.Header
+}
+
+// NewFakePrometheus starts the server. Close it when done.
+func NewFakePrometheus() *FakePrometheus {
+	f := &FakePrometheus{responses: map[string]map[int64][]byte{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+// Serve registers body for path at evaluation time at. at == 0 matches any
+// time, handy for /api/v1/labels and friends.
+func (f *FakePrometheus) Serve(path string, at int64, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.responses[path] == nil {
+		f.responses[path] = map[int64][]byte{}
+	}
+	f.responses[path][at] = body
+}
+
+// ServeSet registers every window of a fixture set at the time the proxy
+// will ask for it.
+func (f *FakePrometheus) ServeSet(set *Set) {
+	spec := set.Manifest.Spec
+	path := "/api/v1/query_range"
+	if spec.Instant {
+		path = "/api/v1/query"
+	}
+	for _, w := range spec.windows() {
+		f.Serve(path, spec.End-w.Offset, set.Bodies[w.Name])
+	}
+}
+
+// Requests returns a copy of everything received so far.
+func (f *FakePrometheus) Requests() []Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Request(nil), f.requests...)
+}
+
+func (f *FakePrometheus) serve(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	at := r.Form.Get("time")
+	if r.URL.Path == "/api/v1/query_range" {
+		at = r.Form.Get("end")
+	}
+	ts, _ := strconv.ParseFloat(at, 64)
+
+	f.mu.Lock()
+	f.requests = append(f.requests, Request{Method: r.Method, Path: r.URL.Path, Params: r.Form, Header: r.Header})
+	body, ok := f.responses[r.URL.Path][int64(ts)]
+	if !ok {
+		body, ok = f.responses[r.URL.Path][0]
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		body = emptyResponse(r.URL.Path)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func emptyResponse(path string) []byte {
+	switch path {
+	case "/api/v1/query":
+		return []byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	case "/api/v1/query_range":
+		return []byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+	default:
+		return []byte(`{"status":"success","data":[]}`)
+	}
+}
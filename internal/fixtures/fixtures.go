@@ -0,0 +1,268 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// internal/fixtures/fixtures.go
+
+// Package fixtures is our fake-Prometheus printing press!
+//
+// Benchmarks are only useful if every run chews on exactly the same data, so
+// this package produces Prometheus API responses (one per chrono window)
+// either synthetically - seeded, so byte-for-byte reproducible - or by
+// recording them from a real Prometheus. Either way they land on disk as a
+// "fixture set": a directory with a manifest plus one JSON body per window.
+//
+// Pro tip: `make fixtures` writes the standard sets to proxy/testdata/bench.
+package fixtures
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ManifestFile is the name of the index file inside a fixture set directory.
+const ManifestFile = "manifest.json"
+
+// Window is one chrono timeframe the fixture has a response for.
+type Window struct {
+	Name   string `json:"name"`   // chrono_timeframe label, e.g. "7days"
+	Offset int64  `json:"offset"` // seconds back from "now"
+}
+
+// DefaultWindows mirrors the proxy's raw timeframes.
+var DefaultWindows = []Window{
+	{"current", 0},
+	{"7days", 7 * 24 * 3600},
+	{"14days", 14 * 24 * 3600},
+	{"21days", 21 * 24 * 3600},
+	{"28days", 28 * 24 * 3600},
+}
+
+// Spec describes a synthetic fixture set.
+type Spec struct {
+	Name    string   `json:"name"`    // Directory name for the set, e.g. "range_1000"
+	Series  int      `json:"series"`  // Series per window
+	Points  int      `json:"points"`  // Samples per series (1 for instant queries)
+	Step    int64    `json:"step"`    // Seconds between samples
+	End     int64    `json:"end"`     // Unix time of the last "current" sample
+	Seed    int64    `json:"seed"`    // Random seed, so the same Spec gives the same bytes
+	Instant bool     `json:"instant"` // Vector instead of matrix responses
+	Windows []Window `json:"windows"` // Defaults to DefaultWindows when empty
+}
+
+// Manifest is what ends up in manifest.json.
+type Manifest struct {
+	Spec    Spec              `json:"spec"`
+	Files   map[string]string `json:"files"`             // window name -> body file
+	Source  string            `json:"source,omitempty"`  // "synthetic" or the upstream URL it was recorded from
+	Query   string            `json:"query,omitempty"`   // PromQL used when recording
+	Created string            `json:"created,omitempty"` // RFC3339, informational only
+}
+
+// Set is a fixture set loaded into memory.
+type Set struct {
+	Manifest Manifest
+	Bodies   map[string][]byte // window name -> raw response body
+}
+
+// StandardSpecs are the sets the benchmarks look for: 100, 1k and 10k series,
+// both range (30 x 1m samples) and instant.
+func StandardSpecs() []Spec {
+	var specs []Spec
+	for _, n := range []int{100, 1000, 10000} {
+		specs = append(specs,
+			Spec{Name: fmt.Sprintf("range_%d", n), Series: n, Points: 30, Step: 60, End: 1700000000, Seed: 42},
+			Spec{Name: fmt.Sprintf("instant_%d", n), Series: n, Points: 1, Step: 60, End: 1700000000, Seed: 42, Instant: true},
+		)
+	}
+	return specs
+}
+
+func (s Spec) windows() []Window {
+	if len(s.Windows) == 0 {
+		return DefaultWindows
+	}
+	return s.Windows
+}
+
+// Generate builds a synthetic fixture set in memory.
+// Each series gets a stable label set and a gently wobbling value, and each
+// older window is a little lower than the one after it - enough texture for
+// averages and comparisons to do real work.
+func Generate(spec Spec) (*Set, error) {
+	if spec.Series < 0 || spec.Points < 1 || spec.Step < 1 {
+		return nil, fmt.Errorf("fixture %q: need series >= 0, points >= 1 and step >= 1", spec.Name)
+	}
+	set := &Set{
+		Manifest: Manifest{Spec: spec, Files: map[string]string{}, Source: "synthetic"},
+		Bodies:   map[string][]byte{},
+	}
+	for wi, w := range spec.windows() {
+		rng := rand.New(rand.NewSource(spec.Seed + int64(wi)))
+		body, err := json.Marshal(response(spec, w, wi, rng))
+		if err != nil {
+			return nil, err
+		}
+		set.Bodies[w.Name] = body
+		set.Manifest.Files[w.Name] = w.Name + ".json"
+	}
+	return set, nil
+}
+
+func response(spec Spec, w Window, wi int, rng *rand.Rand) map[string]interface{} {
+	end := spec.End - w.Offset
+	start := end - int64(spec.Points-1)*spec.Step
+	result := make([]map[string]interface{}, 0, spec.Series)
+	for i := 0; i < spec.Series; i++ {
+		metric := map[string]string{
+			"__name__": "http_requests_total",
+			"job":      "bench",
+			"instance": fmt.Sprintf("host-%05d:9100", i),
+			"code":     []string{"200", "404", "500"}[i%3],
+		}
+		base := 100 + float64(i%50)*10 - float64(wi)*5
+		series := map[string]interface{}{"metric": metric}
+		if spec.Instant {
+			series["value"] = []interface{}{end, sample(base, 0, rng)}
+		} else {
+			values := make([][]interface{}, spec.Points)
+			for j := range values {
+				values[j] = []interface{}{start + int64(j)*spec.Step, sample(base, j, rng)}
+			}
+			series["values"] = values
+		}
+		result = append(result, series)
+	}
+	rt := "matrix"
+	if spec.Instant {
+		rt = "vector"
+	}
+	return map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"resultType": rt, "result": result},
+	}
+}
+
+func sample(base float64, j int, rng *rand.Rand) string {
+	v := base + 10*math.Sin(float64(j)/5) + rng.Float64()
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+// Write saves a set to dir/<spec name>, replacing whatever was there.
+func (s *Set) Write(dir string) error {
+	out := filepath.Join(dir, s.Manifest.Spec.Name)
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return err
+	}
+	for name, file := range s.Manifest.Files {
+		if err := os.WriteFile(filepath.Join(out, file), s.Bodies[name], 0o644); err != nil {
+			return err
+		}
+	}
+	m, err := json.MarshalIndent(s.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(out, ManifestFile), append(m, '\n'), 0o644)
+}
+
+// Load reads a set previously written by Write.
+func Load(dir string) (*Set, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	set := &Set{Bodies: map[string][]byte{}}
+	if err := json.Unmarshal(raw, &set.Manifest); err != nil {
+		return nil, fmt.Errorf("fixture %s: bad manifest: %w", dir, err)
+	}
+	for name, file := range set.Manifest.Files {
+		body, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return nil, err
+		}
+		set.Bodies[name] = body
+	}
+	return set, nil
+}
+
+// LoadOrGenerate loads dir/<spec name> if it's there and otherwise builds the
+// set in memory, so benchmarks still run before anyone has run `make fixtures`.
+func LoadOrGenerate(dir string, spec Spec) (*Set, error) {
+	if set, err := Load(filepath.Join(dir, spec.Name)); err == nil {
+		return set, nil
+	}
+	return Generate(spec)
+}
+
+// Record captures real responses from a Prometheus server, one request per
+// window, shifted back by the window's offset exactly like the proxy does.
+// spec.End, spec.Points and spec.Step define the range; spec.Instant switches
+// to /api/v1/query.
+func Record(ctx context.Context, client *http.Client, base, query string, spec Spec) (*Set, error) {
+	set := &Set{
+		Manifest: Manifest{
+			Spec:    spec,
+			Files:   map[string]string{},
+			Source:  base,
+			Query:   query,
+			Created: time.Now().UTC().Format(time.RFC3339),
+		},
+		Bodies: map[string][]byte{},
+	}
+	for _, w := range spec.windows() {
+		end := spec.End - w.Offset
+		params := url.Values{"query": {query}}
+		endpoint := base + "/api/v1/query_range"
+		if spec.Instant {
+			endpoint = base + "/api/v1/query"
+			params.Set("time", strconv.FormatInt(end, 10))
+		} else {
+			params.Set("start", strconv.FormatInt(end-int64(spec.Points-1)*spec.Step, 10))
+			params.Set("end", strconv.FormatInt(end, 10))
+			params.Set("step", strconv.FormatInt(spec.Step, 10))
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("recording %s: %w", w.Name, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("recording %s: %w", w.Name, err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("recording %s: upstream returned %s", w.Name, resp.Status)
+		}
+		set.Bodies[w.Name] = body
+		set.Manifest.Files[w.Name] = w.Name + ".json"
+	}
+	return set, nil
+}
@@ -0,0 +1,107 @@
+package fixtures
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	spec := Spec{Name: "range_10", Series: 10, Points: 5, Step: 60, End: 1700000000, Seed: 7}
+	a, err := Generate(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := Generate(spec)
+	for name := range a.Bodies {
+		if !bytes.Equal(a.Bodies[name], b.Bodies[name]) {
+			t.Errorf("window %s differs between runs", name)
+		}
+	}
+
+	var resp struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Values [][2]interface{} `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(a.Bodies["7days"], &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.ResultType != "matrix" || len(resp.Data.Result) != 10 || len(resp.Data.Result[0].Values) != 5 {
+		t.Fatalf("unexpected shape: %+v", resp.Data.ResultType)
+	}
+	if last := resp.Data.Result[0].Values[4][0].(float64); int64(last) != spec.End-7*24*3600 {
+		t.Errorf("7days window ends at %v; want %d", last, spec.End-7*24*3600)
+	}
+}
+
+func TestWriteLoadRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	set, _ := Generate(Spec{Name: "instant_3", Series: 3, Points: 1, Step: 60, End: 1700000000, Instant: true})
+	if err := set.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(dir + "/instant_3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Manifest.Spec.Instant || len(got.Bodies) != len(DefaultWindows) {
+		t.Fatalf("round trip lost data: %+v", got.Manifest)
+	}
+	if !bytes.Equal(got.Bodies["current"], set.Bodies["current"]) {
+		t.Error("body changed on disk")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" || r.URL.Query().Get("query") != "up" {
+			http.Error(w, "unexpected", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer srv.Close()
+
+	set, err := Record(context.Background(), srv.Client(), srv.URL, "up", Spec{Name: "rec", Points: 3, Step: 60, End: 1700000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Bodies) != len(DefaultWindows) || set.Manifest.Source != srv.URL {
+		t.Errorf("recorded %d windows from %q", len(set.Bodies), set.Manifest.Source)
+	}
+}
+
+func TestFakePrometheusPicksWindowByTime(t *testing.T) {
+	set, _ := Generate(Spec{Name: "instant_1", Series: 1, Points: 1, Step: 60, End: 1700000000, Instant: true})
+	fake := NewFakePrometheus()
+	defer fake.Close()
+	fake.ServeSet(set)
+
+	get := func(q string) []byte {
+		resp, err := http.Get(fake.URL + "/api/v1/query?" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var buf bytes.Buffer
+		buf.ReadFrom(resp.Body)
+		return buf.Bytes()
+	}
+
+	if got := get("query=up&time=1699395200"); !bytes.Equal(got, set.Bodies["7days"]) {
+		t.Errorf("7days window: got %s", got)
+	}
+	if got := get("query=up&time=42"); !bytes.Contains(got, []byte(`"result":[]`)) {
+		t.Errorf("unknown time should be empty, got %s", got)
+	}
+	if reqs := fake.Requests(); len(reqs) != 2 || reqs[0].Params.Get("query") != "up" {
+		t.Errorf("requests not recorded: %+v", reqs)
+	}
+}
@@ -0,0 +1,99 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// internal/model/merge.go
+package model
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Merging sorted samples - the zip, not the pile 🤐
+//
+// Every answer from Prometheus is already in time order per series, so
+// putting several of them together is a k-way merge: keep one cursor per
+// list in a heap, take the earliest, advance that cursor. The extra memory
+// is one cursor per list, not a set of every timestamp seen, and nothing
+// gets sorted a second time.
+
+// MergePoints merges lists of points into one in time order. Where two
+// lists have a point at the same timestamp, the earlier list wins and the
+// other is dropped. A list that isn't sorted (it shouldn't happen, but
+// upstreams are upstreams) is sorted first.
+func MergePoints(lists ...[]Point) []Point {
+	h := make(cursorHeap, 0, len(lists))
+	total := 0
+	for i, pts := range lists {
+		if len(pts) == 0 {
+			continue
+		}
+		if !sort.SliceIsSorted(pts, func(a, b int) bool { return pts[a].T < pts[b].T }) {
+			pts = append([]Point(nil), pts...)
+			sort.SliceStable(pts, func(a, b int) bool { return pts[a].T < pts[b].T })
+		}
+		h = append(h, cursor{pts: pts, list: i})
+		total += len(pts)
+	}
+	if len(h) == 0 {
+		return nil
+	}
+	if len(h) == 1 {
+		return h[0].pts
+	}
+	heap.Init(&h)
+
+	out := make([]Point, 0, total)
+	for len(h) > 0 {
+		c := &h[0]
+		pt := c.pts[0]
+		if n := len(out); n == 0 || out[n-1].T != pt.T {
+			out = append(out, pt)
+		}
+		if c.pts = c.pts[1:]; len(c.pts) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return out
+}
+
+// cursor is the unread rest of one list.
+type cursor struct {
+	pts  []Point
+	list int
+}
+
+// cursorHeap orders cursors by their next timestamp, then by which list
+// they came from, so the earliest list's point comes out first on a tie.
+type cursorHeap []cursor
+
+func (h cursorHeap) Len() int { return len(h) }
+func (h cursorHeap) Less(i, j int) bool {
+	if h[i].pts[0].T != h[j].pts[0].T {
+		return h[i].pts[0].T < h[j].pts[0].T
+	}
+	return h[i].list < h[j].list
+}
+func (h cursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x interface{}) { *h = append(*h, x.(cursor)) }
+func (h *cursorHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
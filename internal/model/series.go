@@ -0,0 +1,306 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// internal/model/series.go
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Welcome to the one true shape of a time series!
+// Prometheus speaks JSON with string-formatted floats and timestamps that
+// might be ints or floats depending on who's asking. We used to carry that
+// around as map[string]interface{} all the way through the proxy, which
+// meant a type switch (and a potential panic) at every step.
+//
+// Now the JSON only exists at the edges: decode once when it arrives,
+// encode once on the way out, and everything in between - averages,
+// comparisons, plugins - works with plain Go types.
+
+// Point is a single sample: Unix milliseconds and a value. Milliseconds,
+// like Prometheus itself - a 500ms scrape interval survives the trip.
+type Point struct {
+	T int64 // Unix milliseconds
+	V float64
+}
+
+// Series is a label set and its samples. Instant (vector) results carry
+// exactly one point; range (matrix) results carry as many as they like.
+type Series struct {
+	Labels map[string]string
+	Points []Point
+}
+
+// Clone deep-copies the series so the copy can be changed freely.
+// Pro tip: maps and slices are shared by reference - this prevents accidents!
+func (s Series) Clone() Series {
+	out := Series{Labels: make(map[string]string, len(s.Labels))}
+	for k, v := range s.Labels {
+		out.Labels[k] = v
+	}
+	if s.Points != nil {
+		out.Points = append([]Point(nil), s.Points...)
+	}
+	return out
+}
+
+// Last returns the newest point, which for an instant series is the only one.
+func (s Series) Last() (Point, bool) {
+	if len(s.Points) == 0 {
+		return Point{}, false
+	}
+	return s.Points[len(s.Points)-1], true
+}
+
+// FormatValue writes a sample value the way Prometheus does, specials and all.
+func FormatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// RoundSignificant rounds v to the given number of significant digits, so
+// FormatValue prints 0.1235 rather than 0.12345678901234. digits <= 0
+// leaves v alone - full round-trip precision. Specials pass through.
+func RoundSignificant(v float64, digits int) float64 {
+	if digits <= 0 || v == 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return v
+	}
+	r, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	if err != nil {
+		return v
+	}
+	return r
+}
+
+// FormatTimestamp writes Unix milliseconds as Prometheus does: seconds,
+// with a fraction only when there is one (1700000000, 1700000000.25).
+func FormatTimestamp(ms int64) string {
+	return string(appendTimestamp(nil, ms))
+}
+
+func appendTimestamp(b []byte, ms int64) []byte {
+	return strconv.AppendFloat(b, float64(ms)/1000, 'f', -1, 64)
+}
+
+// ParseTimestamp turns Unix seconds (fractions welcome) into milliseconds,
+// rounding away float noise - 1700000000.123 is 1700000000123, not ...122.
+func ParseTimestamp(secs float64) int64 {
+	return int64(math.Round(secs * 1000))
+}
+
+// ParseTimestampNumber is ParseTimestamp straight from the JSON text, so
+// not even float noise gets a look in. Digits beyond milliseconds round.
+func ParseTimestampNumber(n json.Number) (int64, bool) {
+	s := string(n)
+	if s == "" || strings.ContainsAny(s, "eE") {
+		f, err := n.Float64()
+		return ParseTimestamp(f), err == nil
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	neg := strings.HasPrefix(whole, "-")
+	secs, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || secs > math.MaxInt64/1000 || secs < math.MinInt64/1000 {
+		return 0, false
+	}
+	frac = (frac + "0000")[:4]
+	parts, err := strconv.ParseInt(frac, 10, 64) // tenths of a millisecond
+	if err != nil || parts < 0 {
+		return 0, false
+	}
+	ms := (parts + 5) / 10
+	if neg {
+		ms = -ms
+	}
+	return secs*1000 + ms, true
+}
+
+// Number is the one place a decoded JSON number becomes a float64: a
+// json.Number (see DecodeJSON), a string (sample values, as Prometheus
+// sends them) or a float64 (plain json.Unmarshal) all work, "NaN" and
+// "+Inf" included. Anything else is not ok.
+func Number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// DecodeJSON is json.Unmarshal, except numbers decoded into an interface{}
+// stay json.Number - their exact text - rather than float64. Passing an
+// upstream's JSON through untouched then really is untouched: a counter
+// past 2^53 or a timestamp's last millisecond come out as they went in.
+func DecodeJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("model: trailing data after JSON value")
+	}
+	return nil
+}
+
+// MarshalJSON writes the Prometheus [<ts>, "<value>"] pair.
+func (p Point) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, 32)
+	b = append(b, '[')
+	b = appendTimestamp(b, p.T)
+	b = append(b, ',', '"')
+	b = append(b, FormatValue(p.V)...)
+	b = append(b, '"', ']')
+	return b, nil
+}
+
+// UnmarshalJSON reads a [<ts>, "<value>"] pair, keeping milliseconds.
+func (p *Point) UnmarshalJSON(data []byte) error {
+	var pair [2]interface{}
+	if err := DecodeJSON(data, &pair); err != nil {
+		return err
+	}
+	pt, ok := ParsePoint(pair)
+	if !ok {
+		return errors.New("model: malformed sample")
+	}
+	*p = pt
+	return nil
+}
+
+// ParsePoint makes a Point out of an already-decoded [<ts>, <value>] pair.
+// The timestamp must be a number - a json.Number is read exactly - and the
+// value may be a string (as Prometheus sends it) or a bare number (see
+// Number). Anything else is reported as not ok rather than guessed at.
+func ParsePoint(pair [2]interface{}) (Point, bool) {
+	var t int64
+	switch ts := pair[0].(type) {
+	case json.Number:
+		var ok bool
+		if t, ok = ParseTimestampNumber(ts); !ok {
+			return Point{}, false
+		}
+	case float64:
+		t = ParseTimestamp(ts)
+	default:
+		return Point{}, false
+	}
+	v, ok := Number(pair[1])
+	if !ok {
+		return Point{}, false
+	}
+	return Point{T: t, V: v}, true
+}
+
+// Vector encodes series as a Prometheus instant result:
+// [{"metric": {...}, "value": [ts, "v"]}, ...]
+type Vector []Series
+
+// Matrix encodes series as a Prometheus range result:
+// [{"metric": {...}, "values": [[ts, "v"], ...]}, ...]
+type Matrix []Series
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  Point             `json:"value"`
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values []Point           `json:"values"`
+}
+
+// MarshalJSON writes the vector. Series without a point have nothing to
+// say and are left out.
+func (v Vector) MarshalJSON() ([]byte, error) {
+	if v == nil {
+		return []byte("null"), nil
+	}
+	out := make([]vectorSample, 0, len(v))
+	for _, s := range v {
+		if pt, ok := s.Last(); ok {
+			out = append(out, vectorSample{Metric: s.Labels, Value: pt})
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads a vector result.
+func (v *Vector) UnmarshalJSON(data []byte) error {
+	var in []vectorSample
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in == nil {
+		*v = nil
+		return nil
+	}
+	out := make(Vector, len(in))
+	for i, s := range in {
+		out[i] = Series{Labels: s.Metric, Points: []Point{s.Value}}
+	}
+	*v = out
+	return nil
+}
+
+// MarshalJSON writes the matrix.
+func (m Matrix) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	out := make([]matrixSeries, len(m))
+	for i, s := range m {
+		out[i] = matrixSeries{Metric: s.Labels, Values: s.Points}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads a matrix result.
+func (m *Matrix) UnmarshalJSON(data []byte) error {
+	var in []matrixSeries
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in == nil {
+		*m = nil
+		return nil
+	}
+	out := make(Matrix, len(in))
+	for i, s := range in {
+		out[i] = Series{Labels: s.Metric, Points: s.Values}
+	}
+	*m = out
+	return nil
+}
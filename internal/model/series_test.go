@@ -0,0 +1,159 @@
+package model
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestFormatValue(t *testing.T) {
+	for v, want := range map[float64]string{
+		25:           "25",
+		90.72:        "90.72",
+		1e6:          "1000000",
+		-0.000125:    "-0.000125",
+		math.Inf(1):  "+Inf",
+		math.Inf(-1): "-Inf",
+	} {
+		if got := FormatValue(v); got != want {
+			t.Errorf("FormatValue(%v) = %q; want %q", v, got, want)
+		}
+	}
+	if got := FormatValue(math.NaN()); got != "NaN" {
+		t.Errorf("FormatValue(NaN) = %q", got)
+	}
+}
+
+func TestRoundSignificant(t *testing.T) {
+	for _, tc := range []struct {
+		v      float64
+		digits int
+		want   string
+	}{
+		{0.123456789, 4, "0.1235"},
+		{123456789, 3, "123000000"},
+		{2.0 / 3, 0, "0.6666666666666666"},
+		{-0.000987654, 2, "-0.00099"},
+		{math.Inf(1), 3, "+Inf"},
+	} {
+		if got := FormatValue(RoundSignificant(tc.v, tc.digits)); got != tc.want {
+			t.Errorf("RoundSignificant(%v, %d) = %s; want %s", tc.v, tc.digits, got, tc.want)
+		}
+	}
+}
+
+func TestVectorAndMatrixRoundTrip(t *testing.T) {
+	in := []Series{{Labels: map[string]string{"job": "api"}, Points: []Point{{T: 60000, V: 1.5}, {T: 120500, V: 2}}}}
+
+	b, _ := json.Marshal(Vector(in))
+	if want := `[{"metric":{"job":"api"},"value":[120.5,"2"]}]`; string(b) != want {
+		t.Errorf("vector = %s; want %s", b, want)
+	}
+	b, _ = json.Marshal(Matrix(in))
+	if want := `[{"metric":{"job":"api"},"values":[[60,"1.5"],[120.5,"2"]]}]`; string(b) != want {
+		t.Errorf("matrix = %s; want %s", b, want)
+	}
+
+	var m Matrix
+	if err := json.Unmarshal(b, &m); err != nil || !reflect.DeepEqual([]Series(m), in) {
+		t.Errorf("matrix round trip = %+v, %v", m, err)
+	}
+	if err := json.Unmarshal([]byte(`[{"metric":{},"values":[[60,"nope"]]}]`), &m); err == nil {
+		t.Error("expected a malformed sample to be rejected")
+	}
+}
+
+func TestParsePoint(t *testing.T) {
+	cases := []struct {
+		pair [2]interface{}
+		want Point
+		ok   bool
+	}{
+		{[2]interface{}{1700000000.123, "4.2"}, Point{T: 1700000000123, V: 4.2}, true},
+		{[2]interface{}{float64(60), float64(3)}, Point{T: 60000, V: 3}, true},
+		{[2]interface{}{"60", "3"}, Point{}, false},
+		{[2]interface{}{float64(60), nil}, Point{}, false},
+		{[2]interface{}{json.Number("1700000000.123"), json.Number("9007199254740993")}, Point{T: 1700000000123, V: 9007199254740993}, true},
+		{[2]interface{}{json.Number("1700000000.0005"), "NaN"}, Point{T: 1700000000001, V: math.NaN()}, true},
+		{[2]interface{}{json.Number("60"), true}, Point{}, false},
+	}
+	for _, tc := range cases {
+		got, ok := ParsePoint(tc.pair)
+		same := got.T == tc.want.T && (got.V == tc.want.V || math.IsNaN(got.V) && math.IsNaN(tc.want.V))
+		if !same || ok != tc.ok {
+			t.Errorf("ParsePoint(%v) = %v, %v; want %v, %v", tc.pair, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	for ms, want := range map[int64]string{
+		1700000000000: "1700000000",
+		1700000000123: "1700000000.123",
+		1700000000500: "1700000000.5",
+		-1500:         "-1.5",
+	} {
+		if got := FormatTimestamp(ms); got != want {
+			t.Errorf("FormatTimestamp(%d) = %s; want %s", ms, got, want)
+		}
+		if back := ParseTimestamp(mustFloat(t, want)); back != ms {
+			t.Errorf("ParseTimestamp(%s) = %d; want %d", want, back, ms)
+		}
+		if back, ok := ParseTimestampNumber(json.Number(want)); !ok || back != ms {
+			t.Errorf("ParseTimestampNumber(%s) = %d, %v; want %d", want, back, ok, ms)
+		}
+	}
+	if ms, ok := ParseTimestampNumber("1.7e9"); !ok || ms != 1700000000000 {
+		t.Errorf("ParseTimestampNumber(1.7e9) = %d, %v", ms, ok)
+	}
+}
+
+func TestDecodeJSONKeepsNumbers(t *testing.T) {
+	var v map[string]interface{}
+	if err := DecodeJSON([]byte(`{"n": 9007199254740993}`), &v); err != nil || v["n"] != json.Number("9007199254740993") {
+		t.Errorf("DecodeJSON = %#v, %v", v, err)
+	}
+	if err := DecodeJSON([]byte(`{} {}`), &v); err == nil {
+		t.Error("expected trailing data to be an error, like json.Unmarshal")
+	}
+}
+
+func mustFloat(t *testing.T, s string) float64 {
+	t.Helper()
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCloneIsDeep(t *testing.T) {
+	s := Series{Labels: map[string]string{"a": "1"}, Points: []Point{{T: 1, V: 1}}}
+	c := s.Clone()
+	c.Labels["a"] = "2"
+	c.Points[0].V = 2
+	if s.Labels["a"] != "1" || s.Points[0].V != 1 {
+		t.Errorf("clone shares state with the original: %+v", s)
+	}
+}
+
+func TestMergePoints(t *testing.T) {
+	a := []Point{{T: 1, V: 1}, {T: 3, V: 1}, {T: 5, V: 1}}
+	b := []Point{{T: 2, V: 2}, {T: 3, V: 2}, {T: 6, V: 2}}
+	c := []Point{{T: 4, V: 3}, {T: 0, V: 3}}
+	want := []Point{{T: 0, V: 3}, {T: 1, V: 1}, {T: 2, V: 2}, {T: 3, V: 1}, {T: 4, V: 3}, {T: 5, V: 1}, {T: 6, V: 2}}
+	if got := MergePoints(a, nil, b, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergePoints = %v; want %v", got, want)
+	}
+	if c[0].T != 4 {
+		t.Error("MergePoints sorted its input in place")
+	}
+	if got := MergePoints(nil, a); !reflect.DeepEqual(got, a) {
+		t.Errorf("MergePoints(one list) = %v", got)
+	}
+	if got := MergePoints(); got != nil {
+		t.Errorf("MergePoints() = %v", got)
+	}
+}
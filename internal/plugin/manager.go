@@ -1,45 +1,103 @@
+// Package plugin is Chronotheus' one and only plugin system.
+//
+// A plugin is a Go plugin (.so built with -buildmode=plugin) exporting a
+// symbol called Plugin that implements the Plugin interface below. Clients
+// pick one per query with a {_plugin="name"} selector and the merged series
+// are run through it before they go back to Grafana.
+//
+// There are deliberately no package-level globals here: whoever builds the
+// proxy creates a Manager and hands it over.
 package plugin
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"os"
+	"path/filepath"
 	"plugin"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+	"github.com/fsnotify/fsnotify"
 )
 
-// Plugin interface that all plugins must implement
+// ErrNotFound is returned (wrapped) when a query asks for a plugin that
+// isn't loaded.
+var ErrNotFound = errors.New("not found")
+
+// Plugin interface that all plugins must implement.
+// Handle gets the typed series (see internal/model) - no more guessing
+// whether a timestamp is a float64, an int64 or a json.Number. Point.T is
+// Unix milliseconds.
 type Plugin interface {
     Init() error
     GetIdentifier() string
-    Handle(merged []map[string]interface{}) ([]map[string]interface{}, error)
+    Handle(merged []model.Series) ([]model.Series, error)
+}
+
+// ArgsPlugin is a Plugin that can be tuned per query. A query's
+// _plugin_args="horizon=30m,model=linear" arrives as args; plugins that
+// only implement Plugin never see them.
+type ArgsPlugin interface {
+    Plugin
+    HandleWithArgs(merged []model.Series, args map[string]string) ([]model.Series, error)
 }
 
 // Manager handles plugin lifecycle
 type Manager struct {
-    plugins     map[string]Plugin
-    pluginPath  string
-    mu          sync.RWMutex
+    plugins      map[string]Plugin
+    files        map[string]string    // .so path -> identifier, so removals unload the right plugin
+    stamps       map[string]fileStamp // .so path -> what it looked like when loaded
+    pluginPath   string
+    mu           sync.RWMutex
+    stopWatching context.CancelFunc // nil until Watch, and again after Close
+    watching     sync.WaitGroup
+    health       WatcherHealth                     // See Health
+    newWatcher   func() (*fsnotify.Watcher, error) // fsnotify.NewWatcher, or a fake in tests
+    open         func(path string) (Plugin, error) // openSO, or a fake in tests
 }
 
-// Global variables exported for use in other packages
-var (
-    GlobalPluginManager *Manager
-    LoadedPlugins []string
-)
+// fileStamp tells a rewritten plugin file from one that was only touched
+// or chmodded.
+type fileStamp struct {
+    mod  time.Time
+    size int64
+}
 
-// NewManager creates a new plugin manager
+// NewManager creates a new plugin manager watching pluginPath (see Watch).
 func NewManager(pluginPath string) *Manager {
-    manager := &Manager{
+    return &Manager{
         plugins:    make(map[string]Plugin),
+        files:      make(map[string]string),
+        stamps:     make(map[string]fileStamp),
         pluginPath: pluginPath,
+        newWatcher: fsnotify.NewWatcher,
+        open:       openSO,
     }
-    GlobalPluginManager = manager
-    return manager
 }
 
 // ProcessPlugins runs a specific plugin on the data
-func (m *Manager) ProcessPlugins(merged []map[string]interface{}, requestedPlugin string) ([]map[string]interface{}, error) {
-    if requestedPlugin == "" {
+func (m *Manager) ProcessPlugins(merged []model.Series, requestedPlugin string) ([]model.Series, error) {
+    return m.ProcessPluginsWithArgs(merged, requestedPlugin, nil)
+}
+
+// ProcessPluginsWithArgs is ProcessPlugins with per-query arguments, handed
+// to plugins that implement ArgsPlugin and ignored by the rest.
+func (m *Manager) ProcessPluginsWithArgs(merged []model.Series, requestedPlugin string, args map[string]string) ([]model.Series, error) {
+    return m.ProcessPluginsWithWindows(merged, requestedPlugin, args, nil)
+}
+
+// ProcessPluginsWithWindows is ProcessPluginsWithArgs saying which
+// chrono_timeframes are past windows and how far back each one is, so
+// plugins that implement WindowsPlugin get them split up (see windows.go).
+func (m *Manager) ProcessPluginsWithWindows(merged []model.Series, requestedPlugin string, args map[string]string, offsets map[string]time.Duration) ([]model.Series, error) {
+    if m == nil || requestedPlugin == "" {
         return merged, nil  // No plugin requested, return unmodified data
     }
 
@@ -48,10 +106,10 @@ func (m *Manager) ProcessPlugins(merged []map[string]interface{}, requestedPlugi
 
     plugin, exists := m.plugins[requestedPlugin]
     if !exists {
-        return merged, fmt.Errorf("plugin %s not found", requestedPlugin)
+        return merged, fmt.Errorf("plugin %s %w", requestedPlugin, ErrNotFound)
     }
 
-    processed, err := plugin.Handle(merged)
+    processed, err := handle(plugin, merged, args, offsets)
     if err != nil {
         return merged, fmt.Errorf("plugin %s error: %w", requestedPlugin, err)
     }
@@ -59,51 +117,185 @@ func (m *Manager) ProcessPlugins(merged []map[string]interface{}, requestedPlugi
     return processed, nil
 }
 
+// handle runs p, turning a panic into an error so one bad plugin can't take
+// every query in flight down with it. (It can still corrupt memory or hang -
+// see process.go for plugins that can't.)
+func handle(p Plugin, merged []model.Series, args map[string]string, offsets map[string]time.Duration) (out []model.Series, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("panic: %v", r)
+        }
+    }()
+    if wp, ok := p.(WindowsPlugin); ok && offsets != nil {
+        return wp.HandleWindows(SplitWindows(merged, offsets), args)
+    }
+    if ap, ok := p.(ArgsPlugin); ok {
+        return ap.HandleWithArgs(merged, args)
+    }
+    return p.Handle(merged)
+}
+
+// Loaded lists the identifiers of every loaded plugin, sorted.
+func (m *Manager) Loaded() []string {
+    if m == nil {
+        return []string{}
+    }
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    ids := make([]string, 0, len(m.plugins))
+    for id := range m.plugins {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+    return ids
+}
+
 // LoadPlugin loads a plugin from the given path
 func (m *Manager) LoadPlugin(path string) error {
+    info, err := os.Stat(path)
+    if err != nil {
+        return fmt.Errorf("failed to open plugin: %w", err)
+    }
+    chronoPlugin, err := m.open(path)
+    if err != nil {
+        return err
+    }
+
+    if err := m.Register(chronoPlugin); err != nil {
+        return err
+    }
+
+    identifier := chronoPlugin.GetIdentifier()
     m.mu.Lock()
     defer m.mu.Unlock()
+    for other, id := range m.files {
+        if id == identifier && other != path {
+            // The newer file wins the name; the older one no longer owns it,
+            // so removing it later mustn't unload this one.
+            log.Printf("Plugin %s from %s replaces the one from %s", identifier, path, other)
+            delete(m.files, other)
+            delete(m.stamps, other)
+        }
+    }
+    m.files[path] = identifier
+    m.stamps[path] = fileStamp{mod: info.ModTime(), size: info.Size()}
+    return nil
+}
 
+// openSO opens a Go plugin and finds its Plugin symbol.
+func openSO(path string) (Plugin, error) {
     p, err := plugin.Open(path)
     if err != nil {
-        return fmt.Errorf("failed to open plugin: %w", err)
+        return nil, fmt.Errorf("failed to open plugin: %w", err)
     }
 
     symPlugin, err := p.Lookup("Plugin")
     if err != nil {
-        return fmt.Errorf("plugin does not export 'Plugin' symbol: %w", err)
+        return nil, fmt.Errorf("plugin does not export 'Plugin' symbol: %w", err)
     }
 
     chronoPlugin, ok := symPlugin.(Plugin)
     if !ok {
-        return fmt.Errorf("plugin does not implement Plugin interface")
+        return nil, fmt.Errorf("plugin does not implement Plugin interface")
     }
+    return chronoPlugin, nil
+}
+
+// LoadAll loads every .so already sitting in the plugin directory, or any
+// directory under it - Watch only notices files that arrive after it starts,
+// so call Watch first and nothing dropped in between is missed (a file both
+// see is only loaded once).
+//
+// One plugin that won't load doesn't stop the rest: the error lists every
+// file that failed, and why.
+func (m *Manager) LoadAll() error {
+    var failed []error
+    err := filepath.WalkDir(m.pluginPath, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if errors.Is(err, fs.ErrNotExist) {
+                return nil // no plugin directory, no plugins
+            }
+            failed = append(failed, err)
+            return nil
+        }
+        if d.Type().IsRegular() && isPluginFile(path) {
+            if err := m.loadOnce(path); err != nil {
+                failed = append(failed, fmt.Errorf("%s: %w", path, err))
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        failed = append(failed, err)
+    }
+    return errors.Join(failed...)
+}
+
+// loadOnce loads path unless the same file is already loaded from it.
+func (m *Manager) loadOnce(path string) error {
+    info, err := os.Stat(path)
+    if err != nil {
+        return err
+    }
+    if m.unchanged(path, info) {
+        return nil
+    }
+    return m.LoadPlugin(path)
+}
+
+// unchanged reports whether path is loaded and still looks like it did then.
+func (m *Manager) unchanged(path string, info os.FileInfo) bool {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    stamp, loaded := m.stamps[path]
+    return loaded && stamp == fileStamp{mod: info.ModTime(), size: info.Size()}
+}
 
-    if err := chronoPlugin.Init(); err != nil {
+func isPluginFile(path string) bool {
+    return filepath.Ext(path) == ".so"
+}
+
+// Register adds an already-constructed plugin, e.g. one compiled into the
+// binary (or a fake one in tests), without going through plugin.Open.
+func (m *Manager) Register(p Plugin) error {
+    if err := p.Init(); err != nil {
         return fmt.Errorf("failed to initialize plugin: %w", err)
     }
 
-    identifier := chronoPlugin.GetIdentifier()
-    m.plugins[identifier] = chronoPlugin
-    LoadedPlugins = append(LoadedPlugins, identifier)
-    
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    identifier := p.GetIdentifier()
+    m.plugins[identifier] = p
+
     log.Printf("Loaded plugin: %s", identifier)
     return nil
 }
 
-// UnloadPlugin removes a plugin by its identifier
+// UnloadPlugin removes a plugin by its identifier, stopping it if it runs
+// out of process.
 func (m *Manager) UnloadPlugin(identifier string) {
     m.mu.Lock()
     defer m.mu.Unlock()
 
-    delete(m.plugins, identifier)
-
-    for i, name := range LoadedPlugins {
-        if name == identifier {
-            LoadedPlugins = append(LoadedPlugins[:i], LoadedPlugins[i+1:]...)
-            break
-        }
+    if closer, ok := m.plugins[identifier].(io.Closer); ok {
+        closer.Close()
     }
+    delete(m.plugins, identifier)
 
     log.Printf("Unloaded plugin: %s", identifier)
-}
\ No newline at end of file
+}
+
+// unloadFile unloads whatever plugin was loaded from path.
+func (m *Manager) unloadFile(path string) {
+    m.mu.Lock()
+    identifier, ok := m.files[path]
+    delete(m.files, path)
+    delete(m.stamps, path)
+    m.mu.Unlock()
+
+    if ok {
+        m.UnloadPlugin(identifier)
+    }
+}
@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+	"github.com/fsnotify/fsnotify"
+)
+
+type fakePlugin struct {
+	id  string
+	err error
+}
+
+func (f fakePlugin) Init() error           { return nil }
+func (f fakePlugin) GetIdentifier() string { return f.id }
+func (f fakePlugin) Handle(merged []model.Series) ([]model.Series, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return append(merged, model.Series{Labels: map[string]string{"by": f.id}}), nil
+}
+
+func TestManagerLifecycle(t *testing.T) {
+	m := NewManager(t.TempDir())
+	m.Register(fakePlugin{id: "b"})
+	m.Register(fakePlugin{id: "a"})
+	m.Register(fakePlugin{id: "broken", err: errors.New("nope")})
+	m.files["/plugins/a.so"] = "a"
+
+	if got := m.Loaded(); !reflect.DeepEqual(got, []string{"a", "b", "broken"}) {
+		t.Errorf("Loaded() = %v", got)
+	}
+
+	out, err := m.ProcessPlugins(nil, "b")
+	if err != nil || len(out) != 1 || out[0].Labels["by"] != "b" {
+		t.Errorf("ProcessPlugins(b) = %v, %v", out, err)
+	}
+	if out, err := m.ProcessPlugins(nil, "broken"); err == nil || out != nil {
+		t.Errorf("expected plugin error to surface with the input untouched, got %v, %v", out, err)
+	}
+	if _, err := m.ProcessPlugins(nil, "missing"); err == nil {
+		t.Error("expected an error for an unknown plugin")
+	}
+
+	m.unloadFile("/plugins/a.so")
+	if got := m.Loaded(); !reflect.DeepEqual(got, []string{"b", "broken"}) {
+		t.Errorf("after unload Loaded() = %v", got)
+	}
+}
+
+func TestNilManagerIsHarmless(t *testing.T) {
+	var m *Manager
+	in := []model.Series{{Labels: map[string]string{"x": "1"}}}
+	if out, err := m.ProcessPlugins(in, "anything"); err != nil || len(out) != 1 {
+		t.Errorf("nil manager changed data: %v, %v", out, err)
+	}
+	if got := m.Loaded(); len(got) != 0 {
+		t.Errorf("nil manager Loaded() = %v", got)
+	}
+}
+
+func TestCloseStopsWatcher(t *testing.T) {
+	m := NewManager(t.TempDir())
+	if err := m.Watch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+	if err := (*Manager)(nil).Close(); err != nil {
+		t.Errorf("nil Close() = %v", err)
+	}
+}
+
+func TestWatchRestartsAfterErrors(t *testing.T) {
+	defer func(b time.Duration) { watchBackoff = b }(watchBackoff)
+	watchBackoff = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	m := NewManager(dir)
+	m.open = func(path string) (Plugin, error) {
+		id, err := os.ReadFile(path)
+		return fakePlugin{id: string(id)}, err
+	}
+	started := make(chan *fsnotify.Watcher, 4)
+	calls := 0
+	m.newWatcher = func() (*fsnotify.Watcher, error) {
+		if calls++; calls == 2 {
+			return nil, errors.New("too many open files")
+		}
+		w, err := fsnotify.NewWatcher()
+		if err == nil {
+			started <- w
+		}
+		return w, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := m.Watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// A plugin arriving while nobody is watching is found on restart
+	(<-started).Errors <- fsnotify.ErrEventOverflow
+	os.WriteFile(filepath.Join(dir, "a.so"), []byte("alpha"), 0o644)
+	deadline := time.Now().Add(5 * time.Second)
+	for h := m.Health(); !h.Watching || h.Restarts != 1 || len(m.Loaded()) != 1; h = m.Health() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no restart: %+v, loaded %v", h, m.Loaded())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h := m.Health(); h.Errors != 2 || h.LastError != "too many open files" || h.Path != dir {
+		t.Errorf("health = %+v", h)
+	}
+
+	cancel()
+	m.watching.Wait()
+	if m.Health().Watching {
+		t.Error("still watching after ctx was cancelled")
+	}
+	if h := (*Manager)(nil).Health(); h.Watching {
+		t.Errorf("nil manager health = %+v", h)
+	}
+}
+
+func TestWatchFollowsRenamesRewritesAndSubdirectories(t *testing.T) {
+	dir := t.TempDir()
+	m := NewManager(dir)
+	m.open = func(path string) (Plugin, error) {
+		id, err := os.ReadFile(path)
+		return fakePlugin{id: string(id)}, err
+	}
+	if err := m.Watch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	waitFor := func(step string, want ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !reflect.DeepEqual(m.Loaded(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: Loaded() = %v, want %v", step, m.Loaded(), want)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	write := func(path, id string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(id), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(dir, "a.so.tmp"), "alpha")
+	os.Rename(filepath.Join(dir, "a.so.tmp"), filepath.Join(dir, "a.so"))
+	waitFor("renamed into place", "alpha")
+
+	os.Mkdir(filepath.Join(dir, "nested"), 0o755)
+	write(filepath.Join(dir, "nested", "b.so"), "beta")
+	waitFor("subdirectory", "alpha", "beta")
+
+	write(filepath.Join(dir, "a.so"), "gamma-ray")
+	waitFor("rewritten", "beta", "gamma-ray")
+
+	os.RemoveAll(filepath.Join(dir, "nested"))
+	waitFor("directory removed", "gamma-ray")
+
+	os.Rename(filepath.Join(dir, "a.so"), filepath.Join(dir, "a.so.bak"))
+	waitFor("renamed away", []string{}...)
+}
+
+func TestLoadAllReportsEachFailure(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "nested"), 0o755)
+	for path, id := range map[string]string{"a.so": "alpha", "nested/b.so": "", "c.so": "gamma", "notes.txt": "ignored"} {
+		os.WriteFile(filepath.Join(dir, path), []byte(id), 0o644)
+	}
+	m := NewManager(dir)
+	m.open = func(path string) (Plugin, error) {
+		id, _ := os.ReadFile(path)
+		if len(id) == 0 {
+			return nil, errors.New("not a plugin")
+		}
+		return fakePlugin{id: string(id)}, nil
+	}
+
+	err := m.LoadAll()
+	if err == nil || !strings.Contains(err.Error(), "b.so: not a plugin") {
+		t.Errorf("LoadAll() = %v, want b.so's failure reported", err)
+	}
+	if got := m.Loaded(); !reflect.DeepEqual(got, []string{"alpha", "gamma"}) {
+		t.Errorf("one bad plugin shouldn't stop the rest: Loaded() = %v", got)
+	}
+	if err := NewManager(filepath.Join(dir, "missing")).LoadAll(); err != nil {
+		t.Errorf("no plugin directory should mean no plugins, got %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+package plugin
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "os/exec"
+    "sync"
+    "time"
+
+    "github.com/andydixon/chronotheus/internal/model"
+)
+
+// Out-of-process plugins - a plugin that falls over takes itself down, not
+// the proxy.
+//
+// A .so plugin runs inside the proxy: if it panics on a nil map, every query
+// in flight goes down with it, and Go can't ever really unload one. A
+// process plugin is an ordinary program instead. The proxy starts it, and
+// for every query that asks for it writes one line of JSON to its stdin:
+//
+//   {"id": 1, "series": [{"metric": {...}, "values": [[1700000000, "1"], ...]}]}
+//
+// ("args" is there too when the query had _plugin_args, and "windows" -
+// {"7days": 604800, ...} - saying which chrono_timeframes are past windows
+// and how many seconds back each is) and reads one line
+// back from its stdout:
+//
+//   {"id": 1, "series": [...]}      or      {"id": 1, "error": "what went wrong"}
+//
+// Series use the Prometheus matrix shape whether the query was instant or
+// range - instant results just have one point each. Anything the program
+// writes to stderr ends up in our log. ServeProcess does all of this for
+// plugins written in Go (ServeProcessWindows for ones that want the
+// windows apart).
+//
+// If the program exits, or takes longer than its timeout to answer, that
+// query gets an error and the program is killed. The next query that asks
+// for it starts a fresh one - at most once a second, so a plugin that dies
+// on startup doesn't get forked in a tight loop.
+
+const (
+    defaultProcessTimeout = 30 * time.Second
+    minRestartInterval    = time.Second
+    maxProcessMessageSize = 64 << 20
+)
+
+// ProcessConfig describes one out-of-process plugin (process_plugins in the
+// config file).
+type ProcessConfig struct {
+    Name    string        `yaml:"name"`    // What queries ask for with {_plugin="name"}
+    Command []string      `yaml:"command"` // Program and arguments
+    Timeout time.Duration `yaml:"timeout"` // Longest one query may take (0 = 30s)
+}
+
+// Validate checks the things that would otherwise only fail on first use.
+func (c ProcessConfig) Validate() error {
+    if c.Name == "" {
+        return errors.New("name is required")
+    }
+    if len(c.Command) == 0 || c.Command[0] == "" {
+        return fmt.Errorf("plugin %q: command is required", c.Name)
+    }
+    if c.Timeout < 0 {
+        return fmt.Errorf("plugin %q: timeout can't be negative", c.Name)
+    }
+    return nil
+}
+
+type processRequest struct {
+    ID      uint64            `json:"id"`
+    Series  model.Matrix      `json:"series"`
+    Args    map[string]string `json:"args,omitempty"`
+    Windows map[string]int64  `json:"windows,omitempty"` // past windows' offsets in seconds
+}
+
+type processReply struct {
+    ID     uint64       `json:"id"`
+    Series model.Matrix `json:"series"`
+    Error  string       `json:"error,omitempty"`
+}
+
+// processPlugin is the Plugin side of a subprocess.
+type processPlugin struct {
+    config ProcessConfig
+
+    mu       sync.Mutex // one query at a time per program
+    child    *child     // nil when not running
+    started  time.Time
+    nextID   uint64
+    restarts int
+}
+
+// child is one run of the program.
+type child struct {
+    cmd     *exec.Cmd
+    stdin   io.WriteCloser
+    replies chan processReply // closed when stdout ends
+}
+
+// NewProcess returns a Plugin that runs config.Command. Nothing is started
+// until Init.
+func NewProcess(config ProcessConfig) Plugin {
+    if config.Timeout <= 0 {
+        config.Timeout = defaultProcessTimeout
+    }
+    return &processPlugin{config: config}
+}
+
+// Init starts the program, so a command that doesn't exist is reported
+// when the plugin is registered rather than on its first query.
+func (p *processPlugin) Init() error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.start()
+}
+
+func (p *processPlugin) GetIdentifier() string {
+    return p.config.Name
+}
+
+// Handle sends merged to the program and waits for its answer.
+func (p *processPlugin) Handle(merged []model.Series) ([]model.Series, error) {
+    return p.HandleWithArgs(merged, nil)
+}
+
+// HandleWithArgs is Handle with the query's _plugin_args passed along.
+func (p *processPlugin) HandleWithArgs(merged []model.Series, args map[string]string) ([]model.Series, error) {
+    return p.send(merged, args, nil)
+}
+
+// HandleWindows sends the windows back as one slice, with their offsets
+// alongside so the program can tell them apart.
+func (p *processPlugin) HandleWindows(w Windows, args map[string]string) ([]model.Series, error) {
+    offsets := make(map[string]int64, len(w.Offsets))
+    for name, d := range w.Offsets {
+        offsets[name] = int64(d / time.Second)
+    }
+    return p.send(w.All(), args, offsets)
+}
+
+func (p *processPlugin) send(merged []model.Series, args map[string]string, offsets map[string]int64) ([]model.Series, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if p.child == nil {
+        if wait := minRestartInterval - time.Since(p.started); wait > 0 {
+            return nil, fmt.Errorf("process exited, restarting in %s", wait.Round(time.Millisecond))
+        }
+        p.restarts++
+        log.Printf("Restarting plugin %s (restart #%d)", p.config.Name, p.restarts)
+        if err := p.start(); err != nil {
+            return nil, err
+        }
+    }
+
+    p.nextID++
+    line, err := json.Marshal(processRequest{ID: p.nextID, Series: model.Matrix(merged), Args: args, Windows: offsets})
+    if err != nil {
+        return nil, err
+    }
+    if _, err := p.child.stdin.Write(append(line, '\n')); err != nil {
+        p.stop()
+        return nil, fmt.Errorf("process exited: %w", err)
+    }
+
+    timer := time.NewTimer(p.config.Timeout)
+    defer timer.Stop()
+    select {
+    case reply, ok := <-p.child.replies:
+        if !ok {
+            p.stop()
+            return nil, errors.New("process exited before answering")
+        }
+        if reply.ID != p.nextID {
+            p.stop()
+            return nil, fmt.Errorf("process answered request %d, expected %d", reply.ID, p.nextID)
+        }
+        if reply.Error != "" {
+            return nil, errors.New(reply.Error)
+        }
+        if reply.Series == nil {
+            return []model.Series{}, nil
+        }
+        return reply.Series, nil
+    case <-timer.C:
+        p.stop()
+        return nil, fmt.Errorf("no answer within %s, process killed", p.config.Timeout)
+    }
+}
+
+// Close stops the program. The plugin starts it again if asked to Handle.
+func (p *processPlugin) Close() error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.stop()
+    return nil
+}
+
+// start runs the program. Caller holds p.mu.
+func (p *processPlugin) start() error {
+    p.started = time.Now()
+    cmd := exec.Command(p.config.Command[0], p.config.Command[1:]...)
+    cmd.Stderr = os.Stderr
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return err
+    }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    if err := cmd.Start(); err != nil {
+        return fmt.Errorf("failed to start plugin process: %w", err)
+    }
+
+    c := &child{cmd: cmd, stdin: stdin, replies: make(chan processReply, 1)}
+    go func() {
+        defer close(c.replies)
+        scanner := bufio.NewScanner(stdout)
+        scanner.Buffer(nil, maxProcessMessageSize)
+        for scanner.Scan() {
+            var reply processReply
+            if err := json.Unmarshal(scanner.Bytes(), &reply); err != nil {
+                log.Printf("Plugin %s wrote something that isn't a reply: %v", p.config.Name, err)
+                return
+            }
+            c.replies <- reply
+        }
+    }()
+    p.child = c
+    return nil
+}
+
+// stop kills the program, if it's running. Caller holds p.mu.
+func (p *processPlugin) stop() {
+    if p.child == nil {
+        return
+    }
+    c := p.child
+    p.child = nil
+    c.stdin.Close()
+    c.cmd.Process.Kill()
+    go func() {
+        for range c.replies {
+            // drain anything written before it died so the reader can finish
+        }
+        c.cmd.Wait()
+    }()
+}
+
+// ServeProcess is the other end: call it from a process plugin's main and
+// it answers requests on stdin with handle until stdin is closed. args is
+// nil unless the query had _plugin_args. An error from handle goes back to
+// the proxy for that one query; a panic is turned into one too, rather than
+// ending the process.
+func ServeProcess(handle ProcessHandler) error {
+    return serveProcess(func(req processRequest) ([]model.Series, error) {
+        return handle(req.Series, req.Args)
+    })
+}
+
+// ServeProcessWindows is ServeProcess for plugins that want the windows
+// apart (see windows.go). A request without "windows" is split with no
+// past windows at all, so everything but current is in Synthetic.
+func ServeProcessWindows(handle WindowsHandler) error {
+    return serveProcess(func(req processRequest) ([]model.Series, error) {
+        offsets := make(map[string]time.Duration, len(req.Windows))
+        for name, secs := range req.Windows {
+            offsets[name] = time.Duration(secs) * time.Second
+        }
+        return handle(SplitWindows(req.Series, offsets), req.Args)
+    })
+}
+
+func serveProcess(handle func(processRequest) ([]model.Series, error)) error {
+    scanner := bufio.NewScanner(os.Stdin)
+    scanner.Buffer(nil, maxProcessMessageSize)
+    out := bufio.NewWriter(os.Stdout)
+    enc := json.NewEncoder(out)
+    for scanner.Scan() {
+        var req processRequest
+        if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+            return fmt.Errorf("bad request: %w", err)
+        }
+        reply := processReply{ID: req.ID}
+        series, err := safeHandle(handle, req)
+        if err != nil {
+            reply.Error = err.Error()
+        } else {
+            reply.Series = model.Matrix(series)
+        }
+        if err := enc.Encode(reply); err != nil {
+            return err
+        }
+        if err := out.Flush(); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+// ProcessHandler is what a process plugin does with each request.
+type ProcessHandler func(series []model.Series, args map[string]string) ([]model.Series, error)
+
+// WindowsHandler is ProcessHandler with the series split by window.
+type WindowsHandler func(w Windows, args map[string]string) ([]model.Series, error)
+
+func safeHandle(handle func(processRequest) ([]model.Series, error), req processRequest) (out []model.Series, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("plugin panicked: %v", r)
+        }
+    }()
+    return handle(req)
+}
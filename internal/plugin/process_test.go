@@ -0,0 +1,137 @@
+package plugin
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// The test binary doubles as a process plugin: with CHRONO_TEST_PLUGIN set
+// it serves requests instead of running tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("CHRONO_TEST_PLUGIN") == "1" {
+		ServeProcess(func(in []model.Series, args map[string]string) ([]model.Series, error) {
+			switch in[0].Labels["do"] {
+			case "fail":
+				return nil, errors.New("no thanks")
+			case "panic":
+				panic("boom")
+			case "crash":
+				os.Exit(3)
+			case "hang":
+				time.Sleep(time.Hour)
+			}
+			in[0].Labels["seen_by"] = "child"
+			if v, ok := args["tag"]; ok {
+				in[0].Labels["tag"] = v
+			}
+			return in, nil
+		})
+		os.Exit(0)
+	}
+	if os.Getenv("CHRONO_TEST_PLUGIN") == "windows" {
+		ServeProcessWindows(func(w Windows, args map[string]string) ([]model.Series, error) {
+			for _, name := range w.PastNames() {
+				for _, s := range w.Past[name] {
+					s.Labels["offset"] = w.Offsets[name].String()
+				}
+			}
+			return w.All(), nil
+		})
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func testProcess(t *testing.T) *processPlugin {
+	t.Helper()
+	t.Setenv("CHRONO_TEST_PLUGIN", "1")
+	p := NewProcess(ProcessConfig{Name: "child", Command: []string{os.Args[0]}, Timeout: time.Second}).(*processPlugin)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func ask(p *processPlugin, do string) ([]model.Series, error) {
+	return p.Handle([]model.Series{{
+		Labels: map[string]string{"do": do},
+		Points: []model.Point{{T: 1700000000500, V: 1.5}, {T: 1700000060000, V: 2}},
+	}})
+}
+
+func TestProcessPluginRoundTrip(t *testing.T) {
+	p := testProcess(t)
+
+	out, err := ask(p, "")
+	if err != nil || len(out) != 1 || out[0].Labels["seen_by"] != "child" {
+		t.Fatalf("Handle = %v, %v", out, err)
+	}
+	if len(out[0].Points) != 2 || out[0].Points[0] != (model.Point{T: 1700000000500, V: 1.5}) {
+		t.Errorf("points didn't survive the trip: %v", out[0].Points)
+	}
+	out, err = p.HandleWithArgs([]model.Series{{Labels: map[string]string{}}}, map[string]string{"tag": "v1"})
+	if err != nil || len(out) != 1 || out[0].Labels["tag"] != "v1" {
+		t.Errorf("args didn't arrive: %v, %v", out, err)
+	}
+
+	for _, do := range []string{"fail", "panic"} {
+		if _, err := ask(p, do); err == nil {
+			t.Errorf("%s: expected an error", do)
+		}
+	}
+	if _, err := ask(p, ""); err != nil {
+		t.Errorf("an error or panic shouldn't end the process: %v", err)
+	}
+}
+
+func TestProcessPluginRestartsAfterCrash(t *testing.T) {
+	p := testProcess(t)
+
+	if _, err := ask(p, "crash"); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("crash: err = %v", err)
+	}
+	if _, err := ask(p, ""); err == nil || !strings.Contains(err.Error(), "restarting") {
+		t.Errorf("straight after a crash: err = %v, want a restart backoff", err)
+	}
+	p.started = time.Now().Add(-minRestartInterval)
+	if out, err := ask(p, ""); err != nil || len(out) != 1 {
+		t.Fatalf("after restart: %v, %v", out, err)
+	}
+	if p.restarts != 1 {
+		t.Errorf("restarts = %d", p.restarts)
+	}
+}
+
+func TestProcessPluginTimeout(t *testing.T) {
+	p := testProcess(t)
+	p.config.Timeout = 50 * time.Millisecond
+
+	if _, err := ask(p, "hang"); err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Fatalf("hang: err = %v", err)
+	}
+	if p.child != nil {
+		t.Error("a hung process should have been killed")
+	}
+}
+
+func TestManagerRecoversPanics(t *testing.T) {
+	m := NewManager(t.TempDir())
+	m.Register(panicky{})
+	if _, err := m.ProcessPlugins(nil, "panicky"); err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+type panicky struct{}
+
+func (panicky) Init() error           { return nil }
+func (panicky) GetIdentifier() string { return "panicky" }
+func (panicky) Handle([]model.Series) ([]model.Series, error) {
+	panic("oops")
+}
@@ -1,48 +1,278 @@
 package plugin
 
 import (
+    "context"
+    "errors"
     "github.com/fsnotify/fsnotify"
+    "io"
+    "io/fs"
     "log"
+    "os"
     "path/filepath"
+    "strings"
+    "time"
 )
 
-func WatchPlugins(manager *Manager) error {
-    watcher, err := fsnotify.NewWatcher()
+// watchSettle is how long a plugin file has to stay quiet before we look at
+// it. Copying a .so in is a Create and a burst of Writes; loading it at the
+// Create would open half a file.
+const watchSettle = 250 * time.Millisecond
+
+// How long to wait before starting a failed watcher again, at first and at
+// most. Variables so tests don't have to wait.
+var (
+    watchBackoff    = time.Second
+    watchMaxBackoff = time.Minute
+)
+
+// Watch loads, reloads and unloads plugins as .so files come and go in the
+// plugin directory and the directories under it, until ctx is done or Close.
+//
+// Every event on a .so - create, write, rename, chmod, remove - just marks
+// the file for a look once things settle, and the look decides: a file
+// that's gone is unloaded, a new or rewritten one is (re)loaded, and one
+// that was only touched is left alone. So `mv smooth.so.tmp smooth.so`, an
+// editor's save dance and `rm -r plugins/old` all end up right.
+//
+// Go can't unload code, and opening a path it has opened before gives back
+// the old plugin, so to ship a new version of a plugin give it a new file
+// name (smooth-v2.so) and remove the old one.
+//
+// If fsnotify reports an error (its event queue overflowed, a directory
+// went away under it, ...) events may have been missed, so the watcher is
+// thrown away and a new one started after watchBackoff, doubling up to
+// watchMaxBackoff while starting keeps failing. The new one looks at every
+// file once, catching up on anything that changed in between. Health says
+// how that's going.
+func (m *Manager) Watch(ctx context.Context) error {
+    watcher, err := m.startWatcher(nil)
     if err != nil {
         return err
     }
+    ctx, stop := context.WithCancel(ctx)
+    m.mu.Lock()
+    m.stopWatching = stop
+    m.mu.Unlock()
 
+    m.watching.Add(1)
     go func() {
+        defer m.watching.Done()
+        backoff := watchBackoff
         for {
-            select {
-            case event, ok := <-watcher.Events:
-                if !ok {
+            started := time.Now()
+            err := m.watch(ctx, watcher)
+            watcher.Close()
+            m.noteWatcher(false, err)
+            if err == nil {
+                return // ctx done
+            }
+            if time.Since(started) > watchMaxBackoff {
+                backoff = watchBackoff // it was fine for a good while
+            }
+            for {
+                log.Printf("Plugin watcher failed, restarting in %s: %v", backoff, err)
+                select {
+                case <-ctx.Done():
                     return
+                case <-time.After(backoff):
                 }
-
-                if filepath.Ext(event.Name) != ".so" {
-                    continue
+                backoff = min(2*backoff, watchMaxBackoff)
+                pending := make(map[string]bool)
+                if watcher, err = m.startWatcher(pending); err == nil {
+                    m.mu.Lock()
+                    m.health.Restarts++
+                    m.mu.Unlock()
+                    m.catchUp(pending)
+                    break
                 }
+                m.noteWatcher(false, err)
+            }
+        }
+    }()
+    return nil
+}
 
-                switch {
-                case event.Op&fsnotify.Create == fsnotify.Create:
-                    if err := manager.LoadPlugin(event.Name); err != nil {
-                        log.Printf("Error loading plugin %s: %v", event.Name, err)
-                    }
+// startWatcher watches the plugin directory tree, adding the .so files in
+// it to pending (when there is one).
+func (m *Manager) startWatcher(pending map[string]bool) (*fsnotify.Watcher, error) {
+    watcher, err := m.newWatcher()
+    if err != nil {
+        return nil, err
+    }
+    if err := watchTree(watcher, m.pluginPath, pending); err != nil {
+        watcher.Close()
+        return nil, err
+    }
+    m.noteWatcher(true, nil)
+    return watcher, nil
+}
 
-                case event.Op&fsnotify.Remove == fsnotify.Remove:
-                    identifier := filepath.Base(event.Name)
-                    manager.UnloadPlugin(identifier)
-                }
+// watch handles watcher's events until ctx is done (nil) or it reports an
+// error (which it returns).
+func (m *Manager) watch(ctx context.Context, watcher *fsnotify.Watcher) error {
+    pending := make(map[string]bool)
+    var settled <-chan time.Time
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
 
-            case err, ok := <-watcher.Errors:
-                if !ok {
-                    return
-                }
-                log.Printf("Plugin watcher error: %v", err)
+        case event, ok := <-watcher.Events:
+            if !ok {
+                return errors.New("event channel closed")
+            }
+            if m.noteEvent(watcher, event, pending) {
+                settled = time.After(watchSettle)
+            }
+
+        case <-settled:
+            settled = nil
+            for path := range pending {
+                m.syncFile(path)
             }
+            pending = make(map[string]bool)
+
+        case err, ok := <-watcher.Errors:
+            if !ok {
+                return errors.New("error channel closed")
+            }
+            return err
         }
-    }()
+    }
+}
+
+// catchUp syncs everything a restarted watcher found, plus everything
+// loaded, in case it went while nobody was watching.
+func (m *Manager) catchUp(pending map[string]bool) {
+    m.mu.RLock()
+    for path := range m.files {
+        pending[path] = true
+    }
+    m.mu.RUnlock()
+    for path := range pending {
+        m.syncFile(path)
+    }
+}
+
+// WatcherHealth is how the plugin watcher is getting on.
+type WatcherHealth struct {
+    Path        string    `json:"path"`
+    Watching    bool      `json:"watching"`      // A watcher is running right now
+    Since       time.Time `json:"since"`         // When it last started or stopped
+    Restarts    int       `json:"restarts"`      // Watchers started again after an error
+    Errors      int       `json:"errors"`        // Errors from fsnotify, or from starting a watcher
+    LastError   string    `json:"last_error"`    // The most recent of them
+    LastErrorAt time.Time `json:"last_error_at"` // And when it happened
+}
 
-    return watcher.Add(manager.pluginPath)
-}
\ No newline at end of file
+// Health says how the watcher is doing. Safe on a nil Manager.
+func (m *Manager) Health() WatcherHealth {
+    if m == nil {
+        return WatcherHealth{}
+    }
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    h := m.health
+    h.Path = m.pluginPath
+    return h
+}
+
+// noteWatcher records a watcher starting or stopping, and why it stopped.
+func (m *Manager) noteWatcher(watching bool, err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.health.Watching, m.health.Since = watching, time.Now()
+    if err != nil {
+        m.health.Errors++
+        m.health.LastError, m.health.LastErrorAt = err.Error(), time.Now()
+    }
+}
+
+// watchTree watches dir and every directory under it, adding any .so files
+// it finds to pending (when there is one).
+func watchTree(watcher *fsnotify.Watcher, dir string, pending map[string]bool) error {
+    return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if d.IsDir() {
+            return watcher.Add(path)
+        }
+        if pending != nil && isPluginFile(path) {
+            pending[path] = true
+        }
+        return nil
+    })
+}
+
+// noteEvent marks whatever event touched for a look, and reports whether
+// there was anything.
+func (m *Manager) noteEvent(watcher *fsnotify.Watcher, event fsnotify.Event, pending map[string]bool) bool {
+    before := len(pending)
+    if isPluginFile(event.Name) {
+        pending[event.Name] = true
+    }
+
+    switch {
+    case event.Op&fsnotify.Create == fsnotify.Create:
+        // A new (or moved-in) directory: watch it, and pick up whatever
+        // arrived with it before we were watching.
+        if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+            if err := watchTree(watcher, event.Name, pending); err != nil {
+                log.Printf("Error watching plugin directory %s: %v", event.Name, err)
+            }
+        }
+
+    case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+        // A directory moved or removed takes its plugins with it.
+        prefix := event.Name + string(filepath.Separator)
+        m.mu.RLock()
+        for path := range m.files {
+            if strings.HasPrefix(path, prefix) {
+                pending[path] = true
+            }
+        }
+        m.mu.RUnlock()
+    }
+    return len(pending) > before
+}
+
+// syncFile makes what's loaded from path match what's on disk.
+func (m *Manager) syncFile(path string) {
+    info, err := os.Stat(path)
+    if err != nil || !info.Mode().IsRegular() {
+        m.unloadFile(path)
+        return
+    }
+    if m.unchanged(path, info) {
+        return // touched or chmodded, nothing new to load
+    }
+    m.unloadFile(path)
+    if err := m.LoadPlugin(path); err != nil {
+        log.Printf("Error loading plugin %s: %v", path, err)
+    }
+}
+
+// Close stops the watcher (as does cancelling Watch's ctx), waiting for it to finish whatever load or unload
+// it was in the middle of, and stops any out-of-process plugins. Safe to
+// call more than once, without Watch, or on a nil Manager.
+func (m *Manager) Close() error {
+    if m == nil {
+        return nil
+    }
+    m.mu.Lock()
+    stop := m.stopWatching
+    m.stopWatching = nil
+    for _, p := range m.plugins {
+        if closer, ok := p.(io.Closer); ok {
+            closer.Close()
+        }
+    }
+    m.mu.Unlock()
+
+    if stop != nil {
+        stop()
+        m.watching.Wait()
+    }
+    return nil
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+    "sort"
+    "time"
+
+    "github.com/andydixon/chronotheus/internal/model"
+)
+
+// Windows - for plugins that care which week is which.
+//
+// Handle gets everything in one slice, and a forecast or anomaly plugin
+// that wants "the same minute over the last four weeks" has to sort it out
+// again from chrono_timeframe labels, and guess which of them are weeks and
+// which are averages. A plugin that implements WindowsPlugin gets the query
+// already split up instead:
+//
+//   Current     chrono_timeframe="current"
+//   Past        every past window by name ("7days", "14days", ...), its
+//               timestamps already moved forward onto today's
+//   Offsets     how far back each past window was fetched from, including
+//               ones that came back empty
+//   Synthetic   everything else - averages, compares, bands, earlier
+//               plugins' output
+//
+// Whatever it returns replaces the whole result, as with Handle, so
+// Windows.All is there to put things back together. Process plugins get
+// the same offsets as "windows" (in seconds) on each request.
+
+// Windows is one query's series, split by the window they came from.
+type Windows struct {
+    Current   []model.Series
+    Past      map[string][]model.Series // chrono_timeframe -> its series
+    Offsets   map[string]time.Duration  // chrono_timeframe -> how far back
+    Synthetic []model.Series
+}
+
+// WindowsPlugin is a Plugin that wants the windows apart. It's only called
+// this way when the proxy says which windows there are; otherwise Handle
+// (or HandleWithArgs) is, as for any other plugin.
+type WindowsPlugin interface {
+    Plugin
+    HandleWindows(w Windows, args map[string]string) ([]model.Series, error)
+}
+
+// SplitWindows sorts merged into Windows; offsets names the past windows.
+func SplitWindows(merged []model.Series, offsets map[string]time.Duration) Windows {
+    w := Windows{Past: make(map[string][]model.Series, len(offsets)), Offsets: offsets}
+    for _, s := range merged {
+        tf := s.Labels["chrono_timeframe"]
+        if _, past := offsets[tf]; past {
+            w.Past[tf] = append(w.Past[tf], s)
+        } else if tf == "current" {
+            w.Current = append(w.Current, s)
+        } else {
+            w.Synthetic = append(w.Synthetic, s)
+        }
+    }
+    return w
+}
+
+// PastNames is the past windows' names, nearest first.
+func (w Windows) PastNames() []string {
+    names := make([]string, 0, len(w.Offsets))
+    for name := range w.Offsets {
+        names = append(names, name)
+    }
+    sort.Slice(names, func(i, j int) bool {
+        if w.Offsets[names[i]] != w.Offsets[names[j]] {
+            return w.Offsets[names[i]] < w.Offsets[names[j]]
+        }
+        return names[i] < names[j]
+    })
+    return names
+}
+
+// All is every series back in one slice: current, the past windows
+// nearest first, then the synthetics.
+func (w Windows) All() []model.Series {
+    out := append([]model.Series(nil), w.Current...)
+    for _, name := range w.PastNames() {
+        out = append(out, w.Past[name]...)
+    }
+    return append(out, w.Synthetic...)
+}
@@ -0,0 +1,79 @@
+package plugin
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func timeframes(series []model.Series) []string {
+	var out []string
+	for _, s := range series {
+		out = append(out, s.Labels["chrono_timeframe"])
+	}
+	return out
+}
+
+func windowSeries(tfs ...string) []model.Series {
+	var out []model.Series
+	for _, tf := range tfs {
+		out = append(out, model.Series{Labels: map[string]string{"chrono_timeframe": tf}})
+	}
+	return out
+}
+
+var testOffsets = map[string]time.Duration{"7days": 7 * 24 * time.Hour, "14days": 14 * 24 * time.Hour, "21days": 21 * 24 * time.Hour}
+
+func TestSplitWindows(t *testing.T) {
+	w := SplitWindows(windowSeries("lastMonthAverage", "14days", "current", "7days", "14days"), testOffsets)
+	if len(w.Current) != 1 || len(w.Past["7days"]) != 1 || len(w.Past["14days"]) != 2 || len(w.Synthetic) != 1 {
+		t.Errorf("split = %+v", w)
+	}
+	if _, ok := w.Past["21days"]; ok || w.Offsets["21days"] == 0 {
+		t.Error("an empty window has an offset but no series")
+	}
+	if got := timeframes(w.All()); !reflect.DeepEqual(got, []string{"current", "7days", "14days", "14days", "lastMonthAverage"}) {
+		t.Errorf("All() = %v", got)
+	}
+}
+
+// windowsFake says how it was called.
+type windowsFake struct{ fakePlugin }
+
+func (windowsFake) HandleWindows(w Windows, args map[string]string) ([]model.Series, error) {
+	return w.Past["7days"], nil
+}
+
+func TestManagerHandsOutWindows(t *testing.T) {
+	m := NewManager(t.TempDir())
+	m.Register(windowsFake{fakePlugin{id: "weeks"}})
+	in := windowSeries("current", "7days", "lastMonthAverage")
+
+	if out, err := m.ProcessPluginsWithWindows(in, "weeks", nil, testOffsets); err != nil || !reflect.DeepEqual(timeframes(out), []string{"7days"}) {
+		t.Errorf("with windows = %v, %v", timeframes(out), err)
+	}
+	// Without them it's a plain plugin
+	if out, err := m.ProcessPluginsWithArgs(in, "weeks", nil); err != nil || len(out) != 4 || out[3].Labels["by"] != "weeks" {
+		t.Errorf("without windows = %v, %v", out, err)
+	}
+}
+
+func TestProcessPluginWindows(t *testing.T) {
+	t.Setenv("CHRONO_TEST_PLUGIN", "windows")
+	p := NewProcess(ProcessConfig{Name: "weeks", Command: []string{os.Args[0]}, Timeout: time.Second}).(*processPlugin)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	out, err := p.HandleWindows(SplitWindows(windowSeries("lastMonthAverage", "7days", "current"), testOffsets), nil)
+	if err != nil || !reflect.DeepEqual(timeframes(out), []string{"current", "7days", "lastMonthAverage"}) {
+		t.Fatalf("HandleWindows = %v, %v", timeframes(out), err)
+	}
+	if out[1].Labels["offset"] != "168h0m0s" || out[0].Labels["offset"] != "" {
+		t.Errorf("offsets didn't arrive: %v", out)
+	}
+}
@@ -0,0 +1,374 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// internal/remoteread/remoteread.go
+
+// Package remoteread speaks Prometheus' remote read protocol: snappy
+// compressed protobuf, ReadRequest in, ReadResponse out.
+//
+// Pulling in protobuf and snappy libraries for six small messages felt
+// like a lot, so this is the wire format by hand (same spirit as the OTLP
+// tracing in the proxy). Only what remote read needs is here - the
+// SAMPLES response type, which every Prometheus accepts; a client asking
+// for streamed chunks falls back to it. Fields we don't know are skipped,
+// as protobuf intends.
+package remoteread
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MatchType is how a Matcher compares, in prompb's numbering.
+type MatchType int32
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+// String is the PromQL spelling.
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return fmt.Sprintf("MatchType(%d)", int32(t))
+}
+
+// Matcher is one label matcher of a Query.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+// Hints are what the reading Prometheus is going to do with the data; we
+// only care about the step.
+type Hints struct {
+	StepMs  int64
+	Func    string
+	StartMs int64
+	EndMs   int64
+}
+
+// Query is one selector over a time range.
+type Query struct {
+	StartMs  int64
+	EndMs    int64
+	Matchers []Matcher
+	Hints    Hints
+}
+
+// ReadRequest is what a remote-reading Prometheus POSTs.
+type ReadRequest struct {
+	Queries               []Query
+	AcceptedResponseTypes []int32
+}
+
+// Label is a name/value pair.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value at a Unix millisecond timestamp.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is labels (sorted by name) and samples (in time order).
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// QueryResult answers one Query.
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+// ReadResponse answers a ReadRequest, one result per query, in order.
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+// ─── DECODING ─────────────────────────────────────────────────────────────────
+
+var errTruncated = errors.New("remoteread: truncated message")
+
+// fields walks a message, calling fn with each field's number, wire type,
+// and either its varint/fixed value or its bytes.
+func fields(b []byte, fn func(num int, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+		num, wire := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wire {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("remoteread: unsupported wire type %d", wire)
+		}
+		if err := fn(num, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalReadRequest decodes a (decompressed) ReadRequest.
+func UnmarshalReadRequest(b []byte) (*ReadRequest, error) {
+	req := &ReadRequest{}
+	err := fields(b, func(num, wire int, v uint64, data []byte) error {
+		switch {
+		case num == 1 && wire == 2:
+			q, err := unmarshalQuery(data)
+			if err != nil {
+				return err
+			}
+			req.Queries = append(req.Queries, q)
+		case num == 2 && wire == 0:
+			req.AcceptedResponseTypes = append(req.AcceptedResponseTypes, int32(v))
+		case num == 2 && wire == 2: // packed
+			for len(data) > 0 {
+				t, n := binary.Uvarint(data)
+				if n <= 0 {
+					return errTruncated
+				}
+				req.AcceptedResponseTypes = append(req.AcceptedResponseTypes, int32(t))
+				data = data[n:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func unmarshalQuery(b []byte) (Query, error) {
+	var q Query
+	err := fields(b, func(num, wire int, v uint64, data []byte) error {
+		switch {
+		case num == 1 && wire == 0:
+			q.StartMs = int64(v)
+		case num == 2 && wire == 0:
+			q.EndMs = int64(v)
+		case num == 3 && wire == 2:
+			var m Matcher
+			err := fields(data, func(num, wire int, v uint64, data []byte) error {
+				switch {
+				case num == 1 && wire == 0:
+					m.Type = MatchType(v)
+				case num == 2 && wire == 2:
+					m.Name = string(data)
+				case num == 3 && wire == 2:
+					m.Value = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			q.Matchers = append(q.Matchers, m)
+		case num == 4 && wire == 2:
+			return fields(data, func(num, wire int, v uint64, data []byte) error {
+				switch {
+				case num == 1 && wire == 0:
+					q.Hints.StepMs = int64(v)
+				case num == 2 && wire == 2:
+					q.Hints.Func = string(data)
+				case num == 3 && wire == 0:
+					q.Hints.StartMs = int64(v)
+				case num == 4 && wire == 0:
+					q.Hints.EndMs = int64(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return q, err
+}
+
+// UnmarshalReadResponse decodes a (decompressed) ReadResponse.
+func UnmarshalReadResponse(b []byte) (*ReadResponse, error) {
+	resp := &ReadResponse{}
+	err := fields(b, func(num, wire int, v uint64, data []byte) error {
+		if num != 1 || wire != 2 {
+			return nil
+		}
+		var result QueryResult
+		err := fields(data, func(num, wire int, v uint64, data []byte) error {
+			if num != 1 || wire != 2 {
+				return nil
+			}
+			var ts TimeSeries
+			err := fields(data, func(num, wire int, v uint64, data []byte) error {
+				switch {
+				case num == 1 && wire == 2:
+					var l Label
+					err := fields(data, func(num, wire int, v uint64, data []byte) error {
+						switch {
+						case num == 1 && wire == 2:
+							l.Name = string(data)
+						case num == 2 && wire == 2:
+							l.Value = string(data)
+						}
+						return nil
+					})
+					ts.Labels = append(ts.Labels, l)
+					return err
+				case num == 2 && wire == 2:
+					var s Sample
+					err := fields(data, func(num, wire int, v uint64, data []byte) error {
+						switch {
+						case num == 1 && wire == 1:
+							s.Value = math.Float64frombits(v)
+						case num == 2 && wire == 0:
+							s.Timestamp = int64(v)
+						}
+						return nil
+					})
+					ts.Samples = append(ts.Samples, s)
+					return err
+				}
+				return nil
+			})
+			result.Timeseries = append(result.Timeseries, ts)
+			return err
+		})
+		resp.Results = append(resp.Results, result)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ─── ENCODING ─────────────────────────────────────────────────────────────────
+
+func appendKey(b []byte, num, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(wire))
+}
+
+func appendVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b // proto3 leaves defaults out
+	}
+	return binary.AppendUvarint(appendKey(b, num, 0), v)
+}
+
+func appendBytes(b []byte, num int, data []byte) []byte {
+	b = binary.AppendUvarint(appendKey(b, num, 2), uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendBytes(b, num, []byte(s))
+}
+
+// Marshal encodes the response, ready for snappy.
+func (r *ReadResponse) Marshal() []byte {
+	var out, result, series, sub []byte
+	for _, res := range r.Results {
+		result = result[:0]
+		for _, ts := range res.Timeseries {
+			series = series[:0]
+			for _, l := range ts.Labels {
+				sub = appendString(appendString(sub[:0], 1, l.Name), 2, l.Value)
+				series = appendBytes(series, 1, sub)
+			}
+			for _, s := range ts.Samples {
+				sub = sub[:0]
+				if bits := math.Float64bits(s.Value); bits != 0 {
+					sub = binary.LittleEndian.AppendUint64(appendKey(sub, 1, 1), bits)
+				}
+				sub = appendVarint(sub, 2, uint64(s.Timestamp))
+				series = appendBytes(series, 2, sub)
+			}
+			result = appendBytes(result, 1, series)
+		}
+		out = appendBytes(out, 1, result)
+	}
+	return out
+}
+
+// Marshal encodes the request, ready for snappy.
+func (r *ReadRequest) Marshal() []byte {
+	var out, query, sub []byte
+	for _, q := range r.Queries {
+		query = appendVarint(appendVarint(query[:0], 1, uint64(q.StartMs)), 2, uint64(q.EndMs))
+		for _, m := range q.Matchers {
+			sub = appendVarint(sub[:0], 1, uint64(m.Type))
+			sub = appendString(appendString(sub, 2, m.Name), 3, m.Value)
+			query = appendBytes(query, 3, sub)
+		}
+		if q.Hints != (Hints{}) {
+			sub = appendVarint(sub[:0], 1, uint64(q.Hints.StepMs))
+			sub = appendString(sub, 2, q.Hints.Func)
+			sub = appendVarint(appendVarint(sub, 3, uint64(q.Hints.StartMs)), 4, uint64(q.Hints.EndMs))
+			query = appendBytes(query, 4, sub)
+		}
+		out = appendBytes(out, 1, query)
+	}
+	for _, t := range r.AcceptedResponseTypes {
+		out = binary.AppendUvarint(appendKey(out, 2, 0), uint64(t)) // repeated, so zeros count
+	}
+	return out
+}
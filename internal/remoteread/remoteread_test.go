@@ -0,0 +1,81 @@
+package remoteread
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnappyRoundTrip(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	repetitive := []byte(strings.Repeat(`{__name__="up",job="api",chrono_timeframe="7days"}`, 2000))
+	for name, in := range map[string][]byte{
+		"empty":      {},
+		"short":      []byte("abc"),
+		"random":     random,
+		"repetitive": repetitive,
+		"long runs":  bytes.Repeat([]byte{'x'}, 70000),
+	} {
+		enc := Encode(in)
+		out, err := Decode(enc, len(in))
+		if err != nil || !bytes.Equal(out, in) {
+			t.Errorf("%s: round trip failed: %v", name, err)
+		}
+	}
+	if enc := Encode(repetitive); len(enc) > len(repetitive)/10 {
+		t.Errorf("repetitive input only compressed to %d of %d bytes", len(enc), len(repetitive))
+	}
+	if _, err := Decode(Encode(repetitive), 100); err == nil {
+		t.Error("expected the size limit to be enforced")
+	}
+}
+
+func TestSnappyDecodesEveryElement(t *testing.T) {
+	// "abcd" as a literal, then 1-byte-offset, 4-byte-offset and
+	// overlapping copies, then a 61-byte literal with its length in a byte.
+	block := []byte{78, 3 << 2, 'a', 'b', 'c', 'd'}
+	block = append(block, 0<<5|(5-4)<<2|1, 4)     // copy 5 from 4 back: "abcda"
+	block = append(block, (3-1)<<2|3, 9, 0, 0, 0) // copy 3 from 9 back: "abc"
+	block = append(block, (5-1)<<2|2, 1, 0)       // copy 5 from 1 back: "ccccc"
+	block = append(block, 60<<2, 60)
+	block = append(block, bytes.Repeat([]byte{'z'}, 61)...)
+	want := "abcd" + "abcda" + "abc" + "ccccc" + strings.Repeat("z", 61)
+	if got, err := Decode(block, 1000); err != nil || string(got) != want {
+		t.Errorf("Decode = %q, %v; want %q", got, err, want)
+	}
+	for _, bad := range [][]byte{{}, {5, 0}, {4, 3 << 2, 'a'}, {4, (4-1)<<2 | 2, 1, 0}} {
+		if _, err := Decode(bad, 1000); err == nil {
+			t.Errorf("Decode(%v) should fail", bad)
+		}
+	}
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	req := &ReadRequest{
+		Queries: []Query{{
+			StartMs:  1700000000000,
+			EndMs:    1700003600000,
+			Matchers: []Matcher{{MatchEqual, "__name__", "up"}, {MatchNotRegexp, "job", "batch|cron"}},
+			Hints:    Hints{StepMs: 15000, Func: "rate", StartMs: 1700000000000, EndMs: 1700003600000},
+		}},
+		AcceptedResponseTypes: []int32{0, 1},
+	}
+	if got, err := UnmarshalReadRequest(req.Marshal()); err != nil || !reflect.DeepEqual(got, req) {
+		t.Errorf("request: got %+v, %v", got, err)
+	}
+
+	resp := &ReadResponse{Results: []QueryResult{{Timeseries: []TimeSeries{{
+		Labels:  []Label{{"__name__", "up"}, {"chrono_timeframe", "7days"}},
+		Samples: []Sample{{1, 1700000000000}, {0, 1700000060000}, {-2.5, 1700000120000}},
+	}}}, {}}}
+	if got, err := UnmarshalReadResponse(resp.Marshal()); err != nil || !reflect.DeepEqual(got, resp) {
+		t.Errorf("response: got %+v, %v", got, err)
+	}
+
+	if _, err := UnmarshalReadRequest([]byte{0x0a, 0x05, 0x08}); err == nil {
+		t.Error("a truncated message should be an error")
+	}
+}
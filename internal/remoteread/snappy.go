@@ -0,0 +1,176 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// internal/remoteread/snappy.go
+package remoteread
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Snappy, block format - the framing-less flavour remote read uses.
+//
+// A block is the decoded length as a uvarint, then a run of elements, each
+// either a literal (copy these bytes) or a copy (repeat length bytes from
+// offset back). The low two bits of an element's tag byte say which:
+//
+//   00  literal, length-1 in the upper six bits (60-63: in the next 1-4 bytes)
+//   01  copy, length 4-11, offset up to 2047
+//   10  copy, length 1-64, 2-byte offset
+//   11  copy, length 1-64, 4-byte offset
+//
+// Decode understands all of it. Encode is the simple greedy matcher:
+// nowhere near as clever as the real thing, but remote read bodies are
+// label sets repeated over and over, and it catches those.
+
+var errCorrupt = errors.New("snappy: corrupt input")
+
+// Decode decompresses a snappy block, refusing anything that claims to
+// decode to more than maxLen bytes.
+func Decode(src []byte, maxLen int) ([]byte, error) {
+	n, used := binary.Uvarint(src)
+	if used <= 0 {
+		return nil, errCorrupt
+	}
+	if n > uint64(maxLen) {
+		return nil, fmt.Errorf("snappy: decoded length %d is over the %d byte limit", n, maxLen)
+	}
+	dst := make([]byte, 0, n)
+	s := used
+	for s < len(src) {
+		tag := src[s]
+		s++
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag>>2) + 1
+			if extra := int(tag>>2) - 59; extra > 0 {
+				if s+extra > len(src) {
+					return nil, errCorrupt
+				}
+				x := 0
+				for i := extra - 1; i >= 0; i-- {
+					x = x<<8 | int(src[s+i])
+				}
+				length, s = x+1, s+extra
+			}
+			if length <= 0 || s+length > len(src) || len(dst)+length > int(n) {
+				return nil, errCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case 1:
+			if s >= len(src) {
+				return nil, errCorrupt
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag>>5)<<8 | int(src[s])
+			s++
+		case 2:
+			if s+2 > len(src) {
+				return nil, errCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s:]))
+			s += 2
+		case 3:
+			if s+4 > len(src) {
+				return nil, errCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s:]))
+			s += 4
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, errCorrupt
+		}
+		// Byte at a time: a copy may overlap what it's writing
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
+
+// Encode compresses src into a snappy block.
+func Encode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	const minMatch, tableBits = 4, 14
+	var table [1 << tableBits]int // position+1 of the last time each hash was seen
+	hash := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(src[i:]) * 0x1e35a7bd >> (32 - tableBits)
+	}
+
+	literalFrom := 0
+	for i := 0; i+minMatch <= len(src); {
+		h := hash(i)
+		candidate := table[h] - 1
+		table[h] = i + 1
+		if candidate < 0 || i-candidate > 0xffff || binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+		length := minMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = appendLiteral(dst, src[literalFrom:i])
+		dst = appendCopy(dst, i-candidate, length)
+		i += length
+		literalFrom = i
+	}
+	return appendLiteral(dst, src[literalFrom:])
+}
+
+func appendLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	switch n := len(lit) - 1; {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// appendCopy writes a copy of length bytes from offset back, in pieces of
+// at most 64 (offset fits two bytes, Encode makes sure of that).
+func appendCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
@@ -0,0 +1,282 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// internal/replay/replay.go
+
+// Package replay is yesterday's traffic, on demand!
+//
+// It plays recorded requests back at a Chronotheus, for load testing config
+// changes (cache sizes, concurrency limits, timeouts) with
+// the queries people actually run rather than a synthetic guess.
+//
+// It reads access logs in Common/Combined Log Format - what nginx, Apache
+// or Traefik in front of Chronotheus write - or JSON lines with "time",
+// "method" and "uri" (or "path") fields. Only GETs are replayed: a log line
+// doesn't carry a POST body, so there's nothing faithful to send.
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one recorded request.
+type Entry struct {
+	Time   time.Time
+	Method string
+	URI    string // Path plus query string, e.g. /prod/api/v1/query?query=up
+}
+
+// clfRegex picks the timestamp and request line out of a CLF line:
+// 10.0.0.1 - - [10/Oct/2025:13:55:36 +0000] "GET /prod/api/v1/query?query=up HTTP/1.1" 200 512 ...
+var clfRegex = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*"`)
+
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// Parse reads a whole log. Lines that aren't replayable GETs (other
+// methods, garbage, blank lines) are counted in skipped rather than
+// failing the lot - real logs are messy.
+func Parse(r io.Reader) (entries []Entry, skipped int, err error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		e, ok := parseLine(line)
+		if !ok || e.Method != http.MethodGet {
+			skipped++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, skipped, err
+	}
+	// Logs from several instances may be concatenated; replay in time order.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries, skipped, nil
+}
+
+func parseLine(line string) (Entry, bool) {
+	if strings.HasPrefix(line, "{") {
+		var j struct {
+			Time   time.Time `json:"time"`
+			Method string    `json:"method"`
+			URI    string    `json:"uri"`
+			Path   string    `json:"path"`
+		}
+		if json.Unmarshal([]byte(line), &j) != nil {
+			return Entry{}, false
+		}
+		if j.URI == "" {
+			j.URI = j.Path
+		}
+		if j.Method == "" {
+			j.Method = http.MethodGet
+		}
+		return Entry{Time: j.Time, Method: j.Method, URI: j.URI}, j.URI != "" && !j.Time.IsZero()
+	}
+
+	m := clfRegex.FindStringSubmatch(line)
+	if m == nil {
+		return Entry{}, false
+	}
+	t, err := time.Parse(clfTime, m[1])
+	if err != nil {
+		return Entry{}, false
+	}
+	return Entry{Time: t, Method: m[2], URI: m[3]}, strings.HasPrefix(m[3], "/")
+}
+
+// Options controls a replay.
+type Options struct {
+	Target      string       // Base URL of the instance under test, e.g. http://localhost:8080
+	Speed       float64      // 1 = original pacing, 10 = ten times faster, 0 = as fast as possible
+	Concurrency int          // Requests in flight at once (0 = 16)
+	ShiftTime   bool         // Move time/start/end forward so queries ask about "now", not the day they were logged
+	Client      *http.Client // nil = a client with a 2 minute timeout
+}
+
+// Result is what happened.
+type Result struct {
+	Sent      int
+	Failed    int         // Transport errors - no status at all
+	Status    map[int]int // Responses by status code
+	Latencies []time.Duration
+	MaxLag    time.Duration // Worst delay between when a request was due and when it went out
+	Elapsed   time.Duration
+}
+
+// Run replays entries against opts.Target, keeping the recorded gaps
+// between requests (divided by Speed). If the target can't keep up and all
+// slots are busy, requests wait for one - that shows up as lag rather than
+// being silently dropped.
+func Run(ctx context.Context, entries []Entry, opts Options) Result {
+	res := Result{Status: map[int]int{}}
+	if len(entries) == 0 {
+		return res
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Minute}
+	}
+	slots := opts.Concurrency
+	if slots <= 0 {
+		slots = 16
+	}
+	sem := make(chan struct{}, slots)
+	target := strings.TrimSuffix(opts.Target, "/")
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	first := entries[0].Time
+	// Whole seconds, so integer timestamps stay integers.
+	shift := start.Sub(first).Truncate(time.Second)
+
+	for _, e := range entries {
+		due := start
+		if opts.Speed > 0 {
+			due = start.Add(time.Duration(float64(e.Time.Sub(first)) / opts.Speed))
+		}
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				res.Elapsed = time.Since(start)
+				return res
+			case <-time.After(wait):
+			}
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			res.Elapsed = time.Since(start)
+			return res
+		case sem <- struct{}{}:
+		}
+
+		uri := e.URI
+		if opts.ShiftTime {
+			uri = shiftTimes(uri, shift)
+		}
+		lag := time.Since(due)
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			sent := time.Now()
+			status, err := get(ctx, client, u)
+			took := time.Since(sent)
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.Sent++
+			if lag > res.MaxLag {
+				res.MaxLag = lag
+			}
+			if err != nil {
+				res.Failed++
+				return
+			}
+			res.Status[status]++
+			res.Latencies = append(res.Latencies, took)
+		}(target + uri)
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	return res
+}
+
+func get(ctx context.Context, client *http.Client, u string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "chronotheus-replay")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Read it all - a load test that skips the body skips half the work.
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// shiftTimes moves the time, start and end parameters forward by d, so a
+// dashboard refresh logged last Tuesday asks about now again. Values that
+// aren't Unix seconds or RFC3339 are left alone.
+func shiftTimes(uri string, d time.Duration) string {
+	path, rawQuery, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return uri
+	}
+	for _, key := range []string{"time", "start", "end"} {
+		v := q.Get(key)
+		if v == "" {
+			continue
+		}
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			q.Set(key, strconv.FormatFloat(secs+d.Seconds(), 'f', -1, 64))
+		} else if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			q.Set(key, t.Add(d).Format(time.RFC3339Nano))
+		}
+	}
+	return path + "?" + q.Encode()
+}
+
+// Summary writes a short human-readable report.
+func (r Result) Summary(w io.Writer) {
+	fmt.Fprintf(w, "sent %d requests in %s (%.1f req/s), %d transport errors\n",
+		r.Sent, r.Elapsed.Round(time.Millisecond), float64(r.Sent)/r.Elapsed.Seconds(), r.Failed)
+
+	codes := make([]int, 0, len(r.Status))
+	for code := range r.Status {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d: %d\n", code, r.Status[code])
+	}
+
+	if len(r.Latencies) > 0 {
+		lat := append([]time.Duration(nil), r.Latencies...)
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		pct := func(q float64) time.Duration { return lat[int(q*float64(len(lat)-1))] }
+		fmt.Fprintf(w, "latency p50 %s  p90 %s  p99 %s  max %s\n",
+			pct(.5).Round(time.Millisecond), pct(.9).Round(time.Millisecond),
+			pct(.99).Round(time.Millisecond), lat[len(lat)-1].Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "worst pacing lag %s\n", r.MaxLag.Round(time.Millisecond))
+}
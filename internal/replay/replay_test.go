@@ -0,0 +1,76 @@
+package replay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const accessLog = `10.0.0.1 - - [10/Oct/2025:13:55:37 +0000] "GET /prod/api/v1/query?query=up&time=1760104537 HTTP/1.1" 200 512 "-" "Grafana/11.0"
+10.0.0.2 - - [10/Oct/2025:13:55:36 +0000] "GET /prod/api/v1/labels HTTP/1.1" 200 80
+10.0.0.1 - - [10/Oct/2025:13:55:38 +0000] "POST /prod/api/v1/query HTTP/1.1" 200 512
+this is not a log line
+{"time":"2025-10-10T13:55:39Z","method":"GET","uri":"/prod/api/v1/query_range?query=up&start=1760100000&end=1760104539&step=60"}
+`
+
+func TestParse(t *testing.T) {
+	entries, skipped, err := Parse(strings.NewReader(accessLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 2 {
+		t.Errorf("skipped %d lines; want 2 (the POST and the junk)", skipped)
+	}
+	want := []string{"/prod/api/v1/labels", "/prod/api/v1/query?query=up&time=1760104537", "/prod/api/v1/query_range?query=up&start=1760100000&end=1760104539&step=60"}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries: %+v", len(entries), entries)
+	}
+	for i := range want {
+		if entries[i].URI != want[i] {
+			t.Errorf("entry %d = %s; want %s (in time order)", i, entries[i].URI, want[i])
+		}
+	}
+}
+
+func TestRunKeepsPacing(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Path == "/prod/api/v1/labels" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer target.Close()
+
+	entries, _, _ := Parse(strings.NewReader(accessLog))
+	start := time.Now()
+	res := Run(context.Background(), entries, Options{Target: target.URL + "/", Speed: 10})
+	// 3 seconds of recorded traffic at 10x should take about 300ms.
+	if took := time.Since(start); took < 250*time.Millisecond || took > 2*time.Second {
+		t.Errorf("replay took %s; want roughly 300ms", took)
+	}
+	if res.Sent != 3 || res.Failed != 0 || res.Status[200] != 2 || res.Status[429] != 1 || len(res.Latencies) != 3 {
+		t.Errorf("result = %+v", res)
+	}
+	var out strings.Builder
+	res.Summary(&out)
+	if !strings.Contains(out.String(), "429: 1") {
+		t.Errorf("summary:\n%s", out.String())
+	}
+}
+
+func TestShiftTimes(t *testing.T) {
+	got := shiftTimes("/p/api/v1/query_range?query=up&start=100&end=2025-10-10T00:00:00Z&step=60", time.Hour)
+	for _, want := range []string{"start=3700", "end=2025-10-10T01%3A00%3A00Z", "step=60", "query=up"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s missing %s", got, want)
+		}
+	}
+}
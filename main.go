@@ -37,12 +37,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
 
 	"github.com/andydixon/chronotheus/internal/plugin"
+	"github.com/andydixon/chronotheus/internal/replay"
 	"github.com/andydixon/chronotheus/proxy"
 )
 
@@ -53,9 +60,6 @@ var (
 	BuildTime = "unknown"
 )
 
-// Global plugin manager instance
-var GlobalPluginManager *plugin.Manager
-
 // main is our entrypoint
 //
 // 1. Check if we're in debug mode (like checking instruments)
@@ -69,32 +73,219 @@ var GlobalPluginManager *plugin.Manager
 // Pro tip: Run with -debug flag for verbose logging:
 //   ./chronotheus -debug
 func main() {
-	debug := flag.Bool("debug", false, "enable debug logging")
-	listen := flag.String("listen", "0.0.0.0:8080", "address to listen on (ip:port)")
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayCommand(os.Args[2:]))
+	}
 
-	flag.Parse()
+	config, err := resolveConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Config failed: %v", err)
+	}
 
 	fmt.Println("-={[ C h r o n e t h e u s ]}=-");
 	fmt.Printf("Version: %s\nGit Commit: %s\nBuild Time: %s\n", Version, CommitSHA, BuildTime)
 	
-	if *debug {
+	if config.Debug {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 		log.Println("Debug logging enabled")
 	}
 
-	proxy.DebugMode = *debug
+	proxy.DebugMode.Store(config.Debug)
+	proxy.Version = Version
 
-	pluginPath := "./plugins"
-	GlobalPluginManager = plugin.NewManager(pluginPath)
-	
-	if err := plugin.WatchPlugins(GlobalPluginManager); err != nil {
+	// Stop cleanly on Ctrl-C / SIGTERM so the last bit of state gets saved.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	plugins := plugin.NewManager(config.PluginPath)
+	if err := plugins.Watch(ctx); err != nil {
 		log.Printf("Failed to initialize plugin watcher: %v", err)
 	}
+	if err := plugins.LoadAll(); err != nil {
+		log.Printf("Some plugins failed to load:\n%v", err)
+	}
+	log.Printf("Plugins loaded from %s: %v", config.PluginPath, plugins.Loaded())
+	for _, pc := range config.ProcessPlugins {
+		if err := plugins.Register(plugin.NewProcess(pc)); err != nil {
+			log.Printf("Failed to start plugin %s: %v", pc.Name, err)
+		}
+	}
+
+	if len(config.Upstreams) > 0 {
+		log.Printf("📜 %d upstreams registered", len(config.Upstreams))
+	}
+
+	p := proxy.NewChronoProxyWithPlugins(config, plugins)
+	if err := p.LoadState(); err != nil {
+		log.Printf("Warm start skipped: %v", err)
+	}
+
+	// SIGHUP (or POST /-/reload) reads the config again, the same way as
+	// above, and swaps in a proxy built from it.
+	reloader := proxy.NewReloader(p, func() (proxy.Config, error) {
+		return resolveConfig(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:])
+	})
+	go reloader.Run(ctx)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Printf("Got SIGHUP, reloading config")
+			reloader.Reload()
+		}
+	}()
+
+	server := &http.Server{Addr: config.Listen, Handler: reloader}
+	if config.ListenTLS.Enabled() {
+		server.TLSConfig, err = proxy.ServerTLSConfig(config.ListenTLS)
+		if err != nil {
+			log.Fatalf("listen_tls: %v", err)
+		}
+	}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		// Stop taking new requests and give in-flight ones (and background
+		// jobs) until drain_timeout to finish, but don't wait on them forever.
+		log.Printf("🛬 Shutting down, draining for up to %s", config.DrainTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Drain timed out, closing remaining connections: %v", err)
+			server.Close()
+		}
+		reloader.Proxy().Drain(shutdownCtx)
+		if err := plugins.Close(); err != nil {
+			log.Printf("Stopping plugin watcher: %v", err)
+		}
+	}()
 
-	p := proxy.NewChronoProxy()
 	log.Printf("🚀 Chronotheus v%s (commit %s) launching!\n", Version, CommitSHA)
-	log.Printf("👂 Listening on %s", *listen)
-	if err := http.ListenAndServe(*listen, p); err != nil {
+	log.Printf("👂 Listening on %s", config.Listen)
+	serve := server.ListenAndServe
+	if server.TLSConfig != nil {
+		serve = func() error { return server.ListenAndServeTLS("", "") }
+	}
+	if err := serve(); !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("Server failed: %v", err)
 	}
+	<-drained // Serve returns as soon as Shutdown starts, not when it's done
+	if err := reloader.Proxy().SaveState(); err != nil {
+		log.Printf("Saving state failed: %v", err)
+	}
+	log.Printf("👋 Chronotheus landed safely")
+}
+
+// resolveConfig works out the effective configuration, each layer
+// overriding the one before: built-in defaults, the -config file,
+// CHRONOTHEUS_* environment variables, and finally any flags that were
+// actually given on the command line.
+func resolveConfig(fs *flag.FlagSet, args []string) (proxy.Config, error) {
+	debug := fs.Bool("debug", false, "enable debug logging")
+	listen := fs.String("listen", proxy.DefaultConfig.Listen, "address to listen on (ip:port)")
+	configPath := fs.String("config", "", "path to a YAML config file (upstreams, timeouts, limits...)")
+	if err := fs.Parse(args); err != nil {
+		return proxy.Config{}, err
+	}
+
+	config := proxy.DefaultConfig
+	if *configPath != "" {
+		var err error
+		if config, err = proxy.LoadConfig(*configPath); err != nil {
+			return config, err
+		}
+	}
+	if err := proxy.ApplyEnv(&config, os.Environ()); err != nil {
+		return config, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "debug":
+			config.Debug = *debug
+		case "listen":
+			config.Listen = *listen
+		}
+	})
+	return config, config.Validate()
+}
+
+// configCommand handles `chronotheus config <subcommand>`.
+//
+//   chronotheus config print-defaults [-config file] [flags]
+//
+// prints the fully-resolved configuration as YAML - handy for seeding a
+// config file, or for checking what an env var actually did.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print-defaults" {
+		fmt.Fprintln(os.Stderr, "usage: chronotheus config print-defaults [-config file] [-listen addr] [-debug]")
+		return 2
+	}
+	config, err := resolveConfig(flag.NewFlagSet("config print-defaults", flag.ContinueOnError), args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 1
+	}
+	out, err := config.YAML()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(out)
+	return 0
+}
+
+// replayCommand handles `chronotheus replay`.
+//
+//   chronotheus replay -target http://localhost:8080 [-speed 10] [-concurrency 32] [-shift-time] access.log...
+//
+// plays recorded GETs back at a running instance, keeping their original
+// spacing (sped up by -speed), and prints status counts and latencies.
+// Point it at a staging Chronotheus, change a setting, replay again, compare.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8080", "Chronotheus instance to replay against")
+	speed := fs.Float64("speed", 1, "pacing multiplier: 1 = as recorded, 10 = ten times faster, 0 = flat out")
+	concurrency := fs.Int("concurrency", 16, "maximum requests in flight")
+	shiftTime := fs.Bool("shift-time", false, "move time/start/end forward so queries ask about now")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: chronotheus replay [-target url] [-speed n] [-concurrency n] [-shift-time] access.log...")
+		return 2
+	}
+
+	var entries []replay.Entry
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+		got, skipped, err := replay.Parse(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %s: %v\n", path, err)
+			return 1
+		}
+		fmt.Printf("%s: %d requests (%d lines skipped)\n", path, len(got), skipped)
+		entries = append(entries, got...)
+	}
+	// Several files may interleave in time.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	replay.Run(ctx, entries, replay.Options{
+		Target:      *target,
+		Speed:       *speed,
+		Concurrency: *concurrency,
+		ShiftTime:   *shiftTime,
+	}).Summary(os.Stdout)
+	return 0
 }
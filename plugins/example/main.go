@@ -1,31 +1,31 @@
 package main
 
 import (
-	"fmt"
 	"log"
+	"math"
+
+	"github.com/andydixon/chronotheus/internal/model"
 )
 
 /*
 ExamplePlugin demonstrates how to create a Chronotheus plugin.
 
 Data Format:
-    Input/Output data is a slice of maps representing Prometheus metrics:
-    []map[string]interface{} where each map contains:
-    {
-        "metric": map[string]string{        // Labels map
+    Input/Output data is a slice of typed series (internal/model):
+    []model.Series where each series contains:
+    model.Series{
+        Labels: map[string]string{           // Labels map
             "label1": "value1",
-            "label2": "value2"
+            "label2": "value2",
+        },
+        Points: []model.Point{               // Samples, oldest first
+            {T: 1700000000000, V: 1234.5},   // Unix milliseconds + value
+            {T: 1700000060000, V: 5678.9},
         },
-        "value": []interface{}{            // For instant queries (vector)
-            float64(timestamp),            // Unix timestamp
-            "1234.5"                       // String value
-        }
-        // OR for range queries (matrix)
-        "values": [][]interface{}{         // Array of [timestamp, value] pairs
-            {float64(timestamp), "1234.5"},
-            {float64(timestamp), "5678.9"}
-        }
     }
+    Instant queries (vector) carry exactly one point per series, range
+    queries (matrix) as many as the step gives. The proxy turns it all back
+    into Prometheus JSON afterwards - no string-formatted floats in here.
 
 Plugin Lifecycle:
     1. Plugin is loaded when .so file is dropped into plugins directory
@@ -58,41 +58,18 @@ func (p ExamplePlugin) GetIdentifier() string {
 }
 
 // Handle processes the metrics data
-func (p ExamplePlugin) Handle(data []map[string]interface{}) ([]map[string]interface{}, error) {
-    // Process each metric in the dataset
-    for _, metric := range data {
-        // Access the metric labels
-        if labels, ok := metric["metric"].(map[string]string); ok {
-            // Add our custom label
-            labels["example_plugin"] = "processed"
-        }
-
-        // Handle instant query values (vector)
-        if val, ok := metric["value"].([]interface{}); ok {
-            if len(val) == 2 {
-                // val[0] is timestamp (float64)
-                // val[1] is value (string)
-                if strVal, ok := val[1].(string); ok {
-                    // Modify the value if needed
-                    metric["value"].([]interface{})[1] = fmt.Sprintf("modified_%s", strVal)
-                }
-            }
-        }
+func (p ExamplePlugin) Handle(data []model.Series) ([]model.Series, error) {
+    // Process each series in the dataset
+    for _, series := range data {
+        // Add our custom label
+        series.Labels["example_plugin"] = "processed"
 
-        // Handle range query values (matrix)
-        if vals, ok := metric["values"].([][]interface{}); ok {
-            for i, pair := range vals {
-                if len(pair) == 2 {
-                    // pair[0] is timestamp (float64)
-                    // pair[1] is value (string)
-                    if strVal, ok := pair[1].(string); ok {
-                        // Modify each value if needed
-                        vals[i][1] = fmt.Sprintf("modified_%s", strVal)
-                    }
-                }
-            }
+        // Modify the values if needed - here we round to 2 decimal places.
+        // Works the same for instant (one point) and range (many points).
+        for i, pt := range series.Points {
+            series.Points[i].V = math.Round(pt.V*100) / 100
         }
     }
 
     return data, nil
-}
\ No newline at end of file
+}
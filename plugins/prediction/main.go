@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"math"
-	"strconv"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
 )
 
 /*
@@ -24,6 +26,14 @@ Usage in Prometheus:
     # Multiple metrics forecast
     {__name__=~"node_.*", _plugin="prediction"}
 
+    # Tuned: forecast 2 hours ahead, holding the last value instead of the trend
+    node_load1{_plugin="prediction", _plugin_args="horizon=2h,model=flat"}
+
+Arguments (_plugin_args):
+    horizon  How far ahead to forecast, as a Go duration. Range queries
+             default to as long again as the input, instant ones to 1m.
+    model    linear (default) follows the trend, flat holds the last value.
+
 Build:
     go build -buildmode=plugin -o ..\prediction.so main.go
 */
@@ -32,6 +42,34 @@ var Plugin PredictionPlugin
 
 type PredictionPlugin struct{}
 
+// predictionOptions is what _plugin_args can change.
+type predictionOptions struct {
+    horizon time.Duration // 0 = the default for the query type
+    model   string
+}
+
+func parseOptions(args map[string]string) (predictionOptions, error) {
+    opts := predictionOptions{model: "linear"}
+    for k, v := range args {
+        switch k {
+        case "horizon":
+            d, err := time.ParseDuration(v)
+            if err != nil || d <= 0 {
+                return opts, fmt.Errorf("horizon must be a positive duration, got %q", v)
+            }
+            opts.horizon = d
+        case "model":
+            if v != "linear" && v != "flat" {
+                return opts, fmt.Errorf("model must be linear or flat, got %q", v)
+            }
+            opts.model = v
+        default:
+            return opts, fmt.Errorf("unknown argument %q (horizon and model are supported)", k)
+        }
+    }
+    return opts, nil
+}
+
 func (p PredictionPlugin) Init() error {
     log.Printf("Prediction Plugin initialised - Ready to peek into the future!")
     return nil
@@ -41,15 +79,24 @@ func (p PredictionPlugin) GetIdentifier() string {
     return "prediction"
 }
 
-func (p PredictionPlugin) Handle(data []map[string]interface{}) ([]map[string]interface{}, error) {
-    result := make([]map[string]interface{}, 0, len(data)*2) // Pre-allocate for efficiency
+func (p PredictionPlugin) Handle(data []model.Series) ([]model.Series, error) {
+    return p.HandleWithArgs(data, nil)
+}
 
-    for _, metric := range data {
+// HandleWithArgs is Handle tuned by the query's _plugin_args.
+func (p PredictionPlugin) HandleWithArgs(data []model.Series, args map[string]string) ([]model.Series, error) {
+    opts, err := parseOptions(args)
+    if err != nil {
+        return nil, err
+    }
+    result := make([]model.Series, 0, len(data)*2) // Pre-allocate for efficiency
+
+    for _, series := range data {
         // Keep original data
-        result = append(result, metric)
+        result = append(result, series)
 
         // Create prediction metrics
-        predicted, err := p.predictMetric(metric)
+        predicted, err := p.predictMetric(series, opts)
         if err != nil {
             log.Printf("Warning: Failed to predict metric: %v", err)
             continue
@@ -60,44 +107,38 @@ func (p PredictionPlugin) Handle(data []map[string]interface{}) ([]map[string]in
     return result, nil
 }
 
-func (p PredictionPlugin) predictMetric(metric map[string]interface{}) (map[string]interface{}, error) {
-    prediction := make(map[string]interface{})
-
+func (p PredictionPlugin) predictMetric(series model.Series, opts predictionOptions) (model.Series, error) {
     // Copy metric labels
-    if metricLabels, ok := metric["metric"].(map[string]string); ok {
-        newLabels := make(map[string]string, len(metricLabels)+1)
-        for k, v := range metricLabels {
-            newLabels[k] = v
-        }
-        newLabels["prediction_source"] = "forecast"
-        prediction["metric"] = newLabels
+    prediction := model.Series{Labels: make(map[string]string, len(series.Labels)+1)}
+    for k, v := range series.Labels {
+        prediction.Labels[k] = v
     }
+    prediction.Labels["prediction_source"] = "forecast"
 
     // Handle different query types
-    if values, ok := metric["values"].([][]interface{}); ok {
-        // Range query (matrix)
-        return p.handleRangeQuery(prediction, values)
-    } else if value, ok := metric["value"].([]interface{}); ok {
+    switch len(series.Points) {
+    case 0:
+        return model.Series{}, fmt.Errorf("no data points to predict from")
+    case 1:
         // Instant query (vector)
-        return p.handleInstantQuery(prediction, value)
+        return p.handleInstantQuery(prediction, series.Points[0], opts)
+    default:
+        // Range query (matrix)
+        return p.handleRangeQuery(prediction, series.Points, opts)
     }
-
-    return nil, fmt.Errorf("unsupported metric format")
 }
 
-func (p PredictionPlugin) handleRangeQuery(prediction map[string]interface{}, values [][]interface{}) (map[string]interface{}, error) {
+func (p PredictionPlugin) handleRangeQuery(prediction model.Series, values []model.Point, opts predictionOptions) (model.Series, error) {
     if len(values) < 2 {
-        return nil, fmt.Errorf("insufficient data points for prediction")
+        return model.Series{}, fmt.Errorf("insufficient data points for prediction")
     }
 
     // Extract timestamps and values
     timestamps := make([]float64, len(values))
     datapoints := make([]float64, len(values))
-    for i, pair := range values {
-        timestamps[i] = pair[0].(float64)
-        if val, err := strconv.ParseFloat(pair[1].(string), 64); err == nil {
-            datapoints[i] = val
-        }
+    for i, pt := range values {
+        timestamps[i] = float64(pt.T)
+        datapoints[i] = pt.V
     }
 
     // Calculate interval between data points
@@ -106,7 +147,10 @@ func (p PredictionPlugin) handleRangeQuery(prediction map[string]interface{}, va
     // Calculate future timestamps
     lastTimestamp := timestamps[len(timestamps)-1]
     futurePoints := len(timestamps)
-    futureValues := make([][]interface{}, futurePoints)
+    if opts.horizon > 0 && interval > 0 {
+        futurePoints = int(math.Ceil(float64(opts.horizon.Milliseconds()) / interval))
+    }
+    futureValues := make([]model.Point, futurePoints)
 
     // Perform linear regression
     slope, intercept := linearRegression(timestamps, datapoints)
@@ -114,41 +158,42 @@ func (p PredictionPlugin) handleRangeQuery(prediction map[string]interface{}, va
     // Generate predictions
     for i := 0; i < futurePoints; i++ {
         futureTimestamp := lastTimestamp + (interval * float64(i+1))
+        if opts.model == "flat" {
+            futureValues[i] = model.Point{T: int64(futureTimestamp), V: datapoints[len(datapoints)-1]}
+            continue
+        }
         predictedValue := slope*futureTimestamp + intercept
         
         // Add some variance based on historical volatility
         volatility := calculateVolatility(datapoints)
         adjustedValue := addRandomVariance(predictedValue, volatility)
         
-        futureValues[i] = []interface{}{
-            futureTimestamp,
-            fmt.Sprintf("%.4f", adjustedValue),
+        futureValues[i] = model.Point{
+            T: int64(futureTimestamp),
+            V: math.Round(adjustedValue*10000) / 10000,
         }
     }
 
-    prediction["values"] = futureValues
+    prediction.Points = futureValues
     return prediction, nil
 }
 
-func (p PredictionPlugin) handleInstantQuery(prediction map[string]interface{}, value []interface{}) (map[string]interface{}, error) {
-    if len(value) != 2 {
-        return nil, fmt.Errorf("invalid instant query format")
+func (p PredictionPlugin) handleInstantQuery(prediction model.Series, value model.Point, opts predictionOptions) (model.Series, error) {
+    // For instant queries, project one step into the future
+    horizon := opts.horizon
+    if horizon == 0 {
+        horizon = time.Minute // Default to 1-minute projection
     }
-
-    timestamp := value[0].(float64)
-    currentVal, err := strconv.ParseFloat(value[1].(string), 64)
-    if err != nil {
-        return nil, err
+    futureTimestamp := value.T + horizon.Milliseconds() // timestamps are in ms
+    predictedValue := value.V * 1.1 // Simple 10% increase prediction
+    if opts.model == "flat" {
+        predictedValue = value.V
     }
 
-    // For instant queries, project one step into the future
-    futureTimestamp := timestamp + 60 // Default to 1-minute projection
-    predictedValue := currentVal * 1.1 // Simple 10% increase prediction
-
-    prediction["value"] = []interface{}{
-        futureTimestamp,
-        fmt.Sprintf("%.4f", predictedValue),
-    }
+    prediction.Points = []model.Point{{
+        T: futureTimestamp,
+        V: math.Round(predictedValue*10000) / 10000,
+    }}
 
     return prediction, nil
 }
@@ -0,0 +1,144 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/admin.go
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The admin corner - endpoints about Chronotheus itself rather than about
+// anybody's metrics. They live under /api/v1/chrono/admin/ with no upstream
+// prefix (see chronoapi.go), which is why "api" can't be used as an upstream
+// name. The original /admin/ paths still answer, deprecated, so "admin"
+// stays reserved too.
+//
+//   - config: the effective configuration, secrets redacted
+//   - mirror: recent mismatches between upstreams and their mirrors
+//   - quotas: usage against each quota this hour and today
+//   - capabilities: what each upstream turned out to be (see capabilities.go)
+//   - chaos: fault injection settings, changeable with PUT (see chaos.go)
+//   - timeframes: past windows switched off for now (see disabled.go)
+//   - plugins: what's loaded, and whether the plugin directory is still watched
+//
+// These endpoints, like /-/debug/, /metrics and /-/reload, belong to no
+// tenant, so with tenants set up they'd show every tenant the others'
+// quotas, mirrors and config. admin_identities names who may use them
+// (the identities listen_auth settles on: user:ops, cert:prometheus,
+// token:sha256:...); with tenants it's required, and until it's set
+// nobody gets in. Without tenants anyone listen_auth lets in may, unless
+// admin_identities narrows it down.
+//
+// Reading is fine for anyone allowed in. Changing things (PUT,
+// DELETE, ...) is refused with a 403 unless admin_writes is on, and that in
+// turn needs listen_auth - out of the box nobody can flip chaos on or switch
+// a timeframe off.
+
+const adminPrefix = "admin"
+
+// handleAdmin routes the admin endpoint called name, whichever path it came in on.
+func (p *ChronoProxy) handleAdmin(w http.ResponseWriter, r *http.Request, name string) {
+	if DebugMode.Load() {
+		log.Printf("[DEBUG] handleAdmin: %s %s", r.Method, r.URL.Path)
+	}
+	if !p.adminWritable(r.Method) {
+		writeJSONError(w, http.StatusForbidden, "bad_data", "admin endpoints are read-only; set admin_writes (and listen_auth) to change things at runtime")
+		return
+	}
+
+	if rest, ok := strings.CutPrefix(name, "timeframes"); ok && (rest == "" || rest[0] == '/') {
+		p.handleAdminTimeframes(w, r, strings.TrimPrefix(rest, "/"))
+		return
+	}
+	switch name {
+	case "config":
+		p.handleAdminConfig(w, r)
+	case "mirror":
+		p.handleAdminMirror(w, r)
+	case "quotas":
+		p.handleAdminQuotas(w, r)
+	case "capabilities":
+		p.handleAdminCapabilities(w, r)
+	case "chaos":
+		p.handleAdminChaos(w, r)
+	case "plugins":
+		p.handleAdminPlugins(w, r)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not_found", "unknown admin endpoint")
+	}
+}
+
+// checkAdminIdentity is a 403 for an identity that may not use our own
+// endpoints (see isOwnPath).
+func (p *ChronoProxy) checkAdminIdentity(identity string) error {
+	if len(p.config.AdminIdentities) > 0 {
+		if slices.Contains(p.config.AdminIdentities, identity) {
+			return nil
+		}
+		return &deniedError{reason: "not one of admin_identities"}
+	}
+	if len(p.config.Tenants) > 0 {
+		return &deniedError{reason: "with tenants configured, Chronotheus' own endpoints need admin_identities"}
+	}
+	return nil
+}
+
+// adminWritable says whether an admin request with this method may go
+// ahead. Reads always may; anything else needs admin_writes and somebody
+// keeping strangers out, even if Validate was skipped.
+func (p *ChronoProxy) adminWritable(method string) bool {
+	if method == http.MethodGet || method == http.MethodHead {
+		return true
+	}
+	return p.config.AdminWrites && !p.config.ListenAuth.isZero()
+}
+
+// handleAdminConfig answers "what is this thing actually running with?" -
+// the same YAML `chronotheus config print-defaults` prints, minus secrets.
+func (p *ChronoProxy) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	out, err := p.config.Redacted().YAML()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
+
+// handleAdminPlugins lists the loaded plugins and how the watcher is doing -
+// a watcher that keeps restarting (or has stopped) means new .so files may
+// not be picked up.
+func (p *ChronoProxy) handleAdminPlugins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"loaded":  p.plugins.Loaded(),
+			"watcher": p.plugins.Health(),
+		},
+	})
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminWritesOffByDefault(t *testing.T) {
+	config := DefaultConfig
+	config.Chaos = true
+	admin := func(p *ChronoProxy, method, path, body string) int {
+		r := httptest.NewRequest(method, chronoAdminPrefix+path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	p := NewChronoProxyWithConfig(config)
+	for _, tc := range []struct{ method, path, body string }{
+		{"PUT", "chaos", `{"error_percent": 100}`},
+		{"PUT", "timeframes/14days", `{"reason":"backfill"}`},
+		{"DELETE", "timeframes/14days", ""},
+	} {
+		if code := admin(p, tc.method, tc.path, tc.body); code != http.StatusForbidden {
+			t.Errorf("%s %s without admin_writes: %d, want 403", tc.method, tc.path, code)
+		}
+	}
+	if s := p.chaos.get(); s.ErrorPercent != 0 {
+		t.Errorf("chaos changed anyway: %+v", s)
+	}
+	if len(p.disabled.list()) != 0 {
+		t.Error("timeframe disabled anyway")
+	}
+	if code := admin(p, "GET", "chaos", ""); code != http.StatusOK {
+		t.Errorf("GET chaos: %d", code)
+	}
+
+	// admin_writes without listen_auth would let anybody in, so it's refused twice over
+	config.AdminWrites = true
+	if err := config.Validate(); err == nil {
+		t.Error("expected admin_writes without listen_auth to be refused")
+	}
+	if code := admin(NewChronoProxyWithConfig(config), "PUT", "chaos", `{}`); code != http.StatusForbidden {
+		t.Errorf("admin_writes without listen_auth: %d, want 403", code)
+	}
+
+	config.ListenAuth.BearerTokens = []string{"admin"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if code := admin(NewChronoProxyWithConfig(config), "PUT", "chaos", `{}`); code != http.StatusOK {
+		t.Errorf("admin_writes with listen_auth: %d, want 200", code)
+	}
+}
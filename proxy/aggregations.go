@@ -0,0 +1,296 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/aggregations.go
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Synthetic aggregations - the average is a fine "usual", but sometimes you
+// want the worst week, the best week, or "is this above the p95 of the
+// last month?". Each of these is computed step by step from the same
+// four past windows the average uses:
+//
+//   lastMonthMin / lastMonthMax   - lowest / highest of the past weeks
+//   lastMonthMedian               - the middle of them
+//   lastMonthP90 / lastMonthP95   - quantiles, linearly interpolated (like quantile_over_time)
+//   lastMonthStddev               - population standard deviation (like stddev_over_time)
+//   bandUpper / bandLower         - mean ± band_stddevs standard deviations (see bands.go)
+//
+// Ask for one with chrono_timeframe="lastMonthP95", or list their short
+// names under synthetic_aggregations to get them alongside everything else
+// in plain queries:
+//
+//   synthetic_aggregations: [min, max, p95, band]
+
+// aggregation reduces one bucket's worth of past-window values to a number.
+type aggregation struct {
+	key    string // Short name for the config file, e.g. "p95"
+	name   string // The chrono_timeframe it appears as, e.g. "lastMonthP95"
+	reduce func(vals []float64) float64
+}
+
+// averageAggregation is the original. It divides by the number of past
+// windows rather than the number of values, so a missing week counts as
+// zero - that's how it has always behaved, and the compares rely on it.
+var averageAggregation = averageOver(len(proxyTimeframes()) - 1)
+
+// averageOver is lastMonthAverage for a different number of past windows,
+// for queries that bring their own (see offsets.go).
+func averageOver(windows int) aggregation {
+	return aggregation{key: "average", name: "lastMonthAverage", reduce: func(vals []float64) float64 {
+		sum := 0.0
+		for _, v := range vals {
+			sum += v
+		}
+		return sum / float64(windows)
+	}}
+}
+
+// standardErrorName is the baseline's standard error, which comes with
+// compareAgainstLast28 so a "deviation" from weeks that disagree wildly
+// can be told apart from one that means something.
+const standardErrorName = "lastMonthStandardError"
+
+// standardErrorAggregation goes with averageAggregation.
+var standardErrorAggregation = standardErrorOver(len(proxyTimeframes()) - 1)
+
+// standardErrorOver is the standard error of lastMonthAverage over that
+// many past windows: the sample standard deviation of the same numbers the
+// average averages - a missing week still counts as zero - over √n. NaN
+// with fewer than two windows, when there's no spread to speak of.
+func standardErrorOver(windows int) aggregation {
+	return aggregation{key: "stderr", name: standardErrorName, reduce: func(vals []float64) float64 {
+		n := len(vals)
+		if windows > n {
+			n = windows
+		}
+		if n < 2 {
+			return math.NaN()
+		}
+		sum := 0.0
+		for _, v := range vals {
+			sum += v
+		}
+		mean := sum / float64(n)
+		variance := float64(n-len(vals)) * mean * mean // the missing zeros
+		for _, v := range vals {
+			variance += (v - mean) * (v - mean)
+		}
+		return math.Sqrt(variance/float64(n-1)) / math.Sqrt(float64(n))
+	}}
+}
+
+// extraAggregations are the optional ones, in the order they're listed.
+var extraAggregations = []aggregation{
+	{key: "min", name: "lastMonthMin", reduce: func(vals []float64) float64 {
+		m := vals[0]
+		for _, v := range vals[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	}},
+	{key: "max", name: "lastMonthMax", reduce: func(vals []float64) float64 {
+		m := vals[0]
+		for _, v := range vals[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	}},
+	{key: "median", name: "lastMonthMedian", reduce: func(vals []float64) float64 { return quantile(0.5, vals) }},
+	{key: "p90", name: "lastMonthP90", reduce: func(vals []float64) float64 { return quantile(0.9, vals) }},
+	{key: "p95", name: "lastMonthP95", reduce: func(vals []float64) float64 { return quantile(0.95, vals) }},
+	{key: "stddev", name: "lastMonthStddev", reduce: func(vals []float64) float64 {
+		_, sd := meanStddev(vals)
+		return sd
+	}},
+}
+
+// quantile interpolates between the closest ranks, the same way
+// Prometheus' quantile_over_time does. vals gets sorted in place.
+func quantile(q float64, vals []float64) float64 {
+	sort.Float64s(vals)
+	rank := q * float64(len(vals)-1)
+	lower := math.Floor(rank)
+	upper := math.Ceil(rank)
+	weight := rank - lower
+	return vals[int(lower)]*(1-weight) + vals[int(upper)]*weight
+}
+
+// aggregationByName finds an optional aggregation by its chrono_timeframe.
+func aggregationByName(name string) (aggregation, bool) {
+	for _, a := range extraAggregations {
+		if a.name == name {
+			return a, true
+		}
+	}
+	return aggregation{}, false
+}
+
+// aggregationsByKey resolves synthetic_aggregations from the config.
+// "band" brings both bands, bandStddevs wide.
+func aggregationsByKey(keys []string, bandStddevs float64) ([]aggregation, error) {
+	out := make([]aggregation, 0, len(keys))
+	for _, key := range keys {
+		if key == bandKey {
+			out = append(out, bandAggregations(bandStddevs)...)
+			continue
+		}
+		found := false
+		for _, a := range extraAggregations {
+			if a.key == key {
+				out = append(out, a)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown synthetic aggregation %q (want min, max, median, p90, p95, stddev or band)", key)
+		}
+	}
+	return out, nil
+}
+
+// syntheticTimeframes lists every timeframe we make up rather than fetch,
+// in the order they're sorted into responses.
+func syntheticTimeframes() []string {
+	out := []string{averageAggregation.name}
+	for _, a := range extraAggregations {
+		out = append(out, a.name)
+	}
+	return append(out, bandUpperName, bandLowerName, seasonalBaselineName, forecastNextWeekName, dataGapsName, "compareAgainstLast28", "percentCompareAgainstLast28", standardErrorName)
+}
+
+// isSyntheticTimeframe reports whether tf is one of ours, including the
+// quantile baselines (see histograms.go).
+func isSyntheticTimeframe(tf string) bool {
+	for _, s := range syntheticTimeframes() {
+		if s == tf {
+			return true
+		}
+	}
+	_, ok := histogramQuantileFor(tf)
+	return ok
+}
+
+// synthGrid is how synthetics bucket points in time: stepMs wide, lined up
+// on originMs.
+type synthGrid struct {
+	originMs int64
+	stepMs   int64
+}
+
+// minuteGrid is the grid with no step to go by: range queries that somehow
+// lost theirs.
+var minuteGrid = synthGrid{stepMs: 60000}
+
+// queryGrid is the grid a query's synthetics use. For a range it's the
+// query's own step, starting at its start - where Prometheus puts every
+// window's points once they're shifted - so a 15s or 5m graph doesn't get
+// averaged onto minutes and come out jagged. An instant query's minutes
+// are lined up on its time, so the answer lands at that time to the
+// millisecond rather than at the top of the minute.
+func queryGrid(params url.Values, isRange bool, now time.Time) synthGrid {
+	if !isRange {
+		return synthGrid{originMs: parseTimeMs(params.Get("time"), now), stepMs: minuteGrid.stepMs}
+	}
+	d, err := parsePromDuration(params.Get("step"))
+	if err != nil || d < time.Millisecond {
+		return minuteGrid
+	}
+	return synthGrid{originMs: parseTimeMs(params.Get("start"), now), stepMs: d.Milliseconds()}
+}
+
+// bucket is the start of the grid cell t (Unix ms) falls in.
+func (g synthGrid) bucket(t int64) int64 {
+	step := g.stepMs
+	if step <= 0 {
+		step = minuteGrid.stepMs
+	}
+	off := (t - g.originMs) % step
+	if off < 0 {
+		off += step
+	}
+	return t - off
+}
+
+// buildLastMonthAggregate groups the past windows by label set and reduces
+// the values in each cell of grid with agg - buildLastMonthAverage,
+// generalised.
+func buildLastMonthAggregate(seriesList []model.Series, isRange bool, grid synthGrid, agg aggregation) []model.Series {
+	if DebugMode.Load() {
+		log.Printf("buildLastMonthAggregate(%s)", agg.name)
+	}
+	if len(proxyTimeframes()) < 2 {
+		return nil
+	}
+
+	groups := make(map[string][]model.Series)
+	for _, s := range seriesList {
+		if s.Labels["chrono_timeframe"] == "current" {
+			continue
+		}
+		sig := signature(s.Labels)
+		groups[sig] = append(groups[sig], s)
+	}
+
+	var out []model.Series
+	for _, grp := range groups {
+		byStep := make(map[int64][]float64)
+		latest := make(map[int64]int64) // Newest sample in each cell, for instant answers
+		for _, s := range grp {
+			for _, pt := range s.Points {
+				at := grid.bucket(pt.T)
+				byStep[at] = append(byStep[at], pt.V)
+				if t, ok := latest[at]; !ok || pt.T > t {
+					latest[at] = pt.T
+				}
+			}
+		}
+		if len(byStep) == 0 {
+			// Nothing parseable in any window - nothing to offer.
+			continue
+		}
+		pts := make([]model.Point, 0, len(byStep))
+		for m, vals := range byStep {
+			pts = append(pts, model.Point{T: m, V: agg.reduce(vals)})
+		}
+		sort.Slice(pts, func(i, j int) bool { return pts[i].T < pts[j].T })
+		if !isRange {
+			// One point, at the time the windows were actually sampled
+			pts = pts[len(pts)-1:]
+			pts[0].T = latest[pts[0].T]
+		}
+
+		metric := copyMetric(grp[0].Labels)
+		delete(metric, "_command")
+		metric["chrono_timeframe"] = agg.name
+		out = append(out, model.Series{Labels: metric, Points: pts})
+	}
+	if DebugMode.Load() {
+		log.Printf("buildLastMonthAggregate(%s): %d series", agg.name, len(out))
+	}
+	return out
+}
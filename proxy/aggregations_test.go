@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestExtraAggregations(t *testing.T) {
+	var in []model.Series
+	for i, tf := range []string{"current", "7days", "14days", "21days", "28days"} {
+		in = append(in, model.Series{
+			Labels: map[string]string{"__name__": "up", "chrono_timeframe": tf},
+			Points: []model.Point{{T: 120, V: float64(i * 10)}}, // current=0, then 10, 20, 30, 40
+		})
+	}
+	want := map[string]float64{
+		"lastMonthMin":    10,
+		"lastMonthMax":    40,
+		"lastMonthMedian": 25,
+		"lastMonthP90":    37,
+		"lastMonthP95":    38.5,
+		"lastMonthStddev": math.Sqrt(125),
+	}
+	for name, v := range want {
+		agg, ok := aggregationByName(name)
+		if !ok {
+			t.Fatalf("%s: not found", name)
+		}
+		out := buildLastMonthAggregate(in, false, minuteGrid, agg)
+		if len(out) != 1 || out[0].Labels["chrono_timeframe"] != name || math.Abs(out[0].Points[0].V-v) > 1e-9 {
+			t.Errorf("%s = %+v; want %v", name, out, v)
+		}
+	}
+}
+
+func TestStandardError(t *testing.T) {
+	// 10, 20, 30, 40: sample sd √(500/3), over √4
+	if got, want := standardErrorOver(4).reduce([]float64{10, 20, 30, 40}), math.Sqrt(500.0/3)/2; math.Abs(got-want) > 1e-9 {
+		t.Errorf("stderr = %v; want %v", got, want)
+	}
+	// A missing week counts as zero, as it does for the average
+	if got, want := standardErrorOver(4).reduce([]float64{20, 20, 20}), math.Sqrt(100)/2; math.Abs(got-want) > 1e-9 {
+		t.Errorf("stderr with a gap = %v; want %v", got, want)
+	}
+	if got := standardErrorOver(1).reduce([]float64{5}); !math.IsNaN(got) {
+		t.Errorf("stderr of one window = %v; want NaN", got)
+	}
+}
+
+func TestSyntheticsFollowStep(t *testing.T) {
+	grid := queryGrid(url.Values{"start": {"1700000005"}, "step": {"15s"}}, true, time.Now())
+	if grid.originMs != 1700000005000 || grid.stepMs != 15000 {
+		t.Fatalf("grid = %+v", grid)
+	}
+	if g := queryGrid(url.Values{"step": {"15"}, "time": {"1700000012.345"}}, false, time.Now()); g != (synthGrid{originMs: 1700000012345, stepMs: 60000}) {
+		t.Errorf("instant queries should be on minutes from their time, got %+v", g)
+	}
+	for at, want := range map[int64]int64{1700000005000: 1700000005000, 1700000019999: 1700000005000, 1700000020000: 1700000020000, 1699999999000: 1699999990000} {
+		if got := grid.bucket(at); got != want {
+			t.Errorf("bucket(%d) = %d, want %d", at, got, want)
+		}
+	}
+
+	// Two past weeks at 15s: averaged onto minutes they'd collapse into
+	// one point, on the step they stay four
+	var in []model.Series
+	for _, tf := range []string{"7days", "14days"} {
+		s := model.Series{Labels: map[string]string{"__name__": "up", "chrono_timeframe": tf}}
+		for i := int64(0); i < 4; i++ {
+			s.Points = append(s.Points, model.Point{T: 1700000005000 + i*15000, V: float64(i)})
+		}
+		in = append(in, s)
+	}
+	out := buildLastMonthAggregate(in, true, grid, averageOver(2))
+	if len(out) != 1 || len(out[0].Points) != 4 || out[0].Points[3] != (model.Point{T: 1700000050000, V: 3}) {
+		t.Errorf("got %+v", out)
+	}
+}
+
+func TestAggregationsByKey(t *testing.T) {
+	aggs, err := aggregationsByKey([]string{"p95", "min"}, 2)
+	if err != nil || len(aggs) != 2 || aggs[0].name != "lastMonthP95" || aggs[1].name != "lastMonthMin" {
+		t.Errorf("got %+v, %v", aggs, err)
+	}
+	config := DefaultConfig
+	config.SyntheticAggregations = []string{"p99"}
+	if err := config.Validate(); err == nil {
+		t.Error("expected unknown aggregations to fail validation")
+	}
+}
+
+func TestAggregationsViaLabelAndConfig(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for i, at := range []int64{1700000000, 1700000000 - 7*86400, 1700000000 - 14*86400} {
+		fake.Serve("/api/v1/query", at, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[`+
+			model.FormatValue(float64(at))+`,"`+model.FormatValue(float64(i+1))+`"]}]}}`))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	query := func(p *ChronoProxy, q string) string {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+q, nil))
+		return w.Body.String()
+	}
+
+	body := query(NewChronoProxy(), `up{chrono_timeframe="lastMonthMax"}`)
+	if !strings.Contains(body, `"chrono_timeframe":"lastMonthMax"`) || !strings.Contains(body, `"3"`) || strings.Contains(body, "lastMonthAverage") {
+		t.Errorf("label selection: %s", body)
+	}
+	if body := query(NewChronoProxy(), "up"); strings.Contains(body, "lastMonthMax") {
+		t.Errorf("extras should be opt-in for plain queries: %s", body)
+	}
+
+	config := DefaultConfig
+	config.SyntheticAggregations = []string{"max"}
+	if body := query(NewChronoProxyWithConfig(config), "up"); !strings.Contains(body, "lastMonthMax") || !strings.Contains(body, "lastMonthAverage") {
+		t.Errorf("configured extras missing: %s", body)
+	}
+}
@@ -0,0 +1,208 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/alertrules.go
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// GET .../api/v1/chrono/rules - alerting on baselines without the homework 🔔
+//
+// Give it a selector and it writes the Prometheus rule file that alerts
+// when the metric strays from its usual self:
+//
+//   GET /prod/api/v1/chrono/rules?selector=http_requests:rate5m{job="api"}&zscore=3&percent=50&for=10m
+//
+// Chronotheus strips chrono_timeframe from the whole query before it goes
+// upstream and builds synthetics from what comes back, so a rule can't
+// do arithmetic across timeframes, or put a threshold on one, in a single
+// expression. The file has two groups to get around that:
+//
+//   chrono:<metric>:record   recording rules for the bare synthetics -
+//                            compareAgainstLast28, lastMonthStddev and
+//                            percentCompareAgainstLast28. Evaluate these
+//                            against Chronotheus (vmalert's
+//                            -datasource.url, Thanos ruler's --query, ...)
+//   chrono:<metric>:alert    the alerts, on the recorded series, wherever
+//                            they're written to
+//
+// The z-score is compare/stddev, ignoring chrono_timeframe since each
+// recorded series keeps its own; weeks without any spread don't fire.
+// zscore=0 or percent=0 leaves that alert out.
+
+const chronoRulesPath = "/api/v1/chrono/rules"
+
+// promRuleFile is a Prometheus rule file.
+type promRuleFile struct {
+	Groups []promRuleGroup `yaml:"groups"`
+}
+
+type promRuleGroup struct {
+	Name  string     `yaml:"name"`
+	Rules []promRule `yaml:"rules"`
+}
+
+type promRule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// baselineRuleSpec is what a rules request asked for.
+type baselineRuleSpec struct {
+	metric, selector string
+	zscore, percent  float64
+	forDuration      string
+	severity         string
+}
+
+// handleChronoRules answers .../api/v1/chrono/rules.
+func (p *ChronoProxy) handleChronoRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	params := parseClientParams(r)
+	spec := baselineRuleSpec{zscore: 3, percent: 50, forDuration: "10m", severity: "warning"}
+	m := bareSelectorRegex.FindStringSubmatch(params.Get("selector"))
+	if m == nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "selector must be a metric name, optionally with {matchers}, e.g. http_requests:rate5m{job=\"api\"}")
+		return
+	}
+	spec.metric, spec.selector = m[1], strings.TrimSpace(params.Get("selector"))
+	pq, err := parseQuery(spec.selector)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "selector: "+err.Error())
+		return
+	}
+	for _, vs := range pq.selectors() {
+		for _, matcher := range vs.LabelMatchers {
+			if strings.HasPrefix(matcher.Name, "chrono_") || matcher.Name == "_command" || matcher.Name == pluginLabelName {
+				writeJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("selector: leave %s out, the rules pick their own timeframes", matcher.Name))
+				return
+			}
+		}
+	}
+	for name, dst := range map[string]*float64{"zscore": &spec.zscore, "percent": &spec.percent} {
+		if raw := params.Get(name); raw != "" {
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil || v < 0 {
+				writeJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("%s should be a number, 0 or more, got %q", name, raw))
+				return
+			}
+			*dst = v
+		}
+	}
+	if raw := params.Get("for"); raw != "" {
+		if _, err := parsePromDuration(raw); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("for should be a duration like 10m, got %q", raw))
+			return
+		}
+		spec.forDuration = raw
+	}
+	if raw := params.Get("severity"); raw != "" {
+		spec.severity = raw
+	}
+
+	out, err := yaml.Marshal(baselineRules(spec))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
+
+// baselineRules builds the rule file for spec.
+func baselineRules(spec baselineRuleSpec) promRuleFile {
+	recorded := func(what string) string { return "chrono:" + spec.metric + ":" + what }
+	record := promRuleGroup{Name: recorded("record")}
+	for _, tf := range []struct{ what, timeframe string }{
+		{"compare", "compareAgainstLast28"},
+		{"stddev", "lastMonthStddev"},
+		{"percent_compare", "percentCompareAgainstLast28"},
+	} {
+		record.Rules = append(record.Rules, promRule{Record: recorded(tf.what), Expr: withTimeframe(spec.selector, tf.timeframe)})
+	}
+
+	alert := promRuleGroup{Name: recorded("alert")}
+	name := alertName(spec.metric)
+	labels := map[string]string{"severity": spec.severity}
+	num := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	if spec.zscore > 0 {
+		alert.Rules = append(alert.Rules, promRule{
+			Alert:  name + "BaselineZScore",
+			Expr:   fmt.Sprintf("abs(%s / ignoring(chrono_timeframe) (%s > 0)) > %s", recorded("compare"), recorded("stddev"), num(spec.zscore)),
+			For:    spec.forDuration,
+			Labels: labels,
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is more than %s standard deviations from the last 4 weeks", spec.metric, num(spec.zscore)),
+				"description": "{{ $value | printf \"%.2f\" }} standard deviations from lastMonthAverage.",
+			},
+		})
+	}
+	if spec.percent > 0 {
+		alert.Rules = append(alert.Rules, promRule{
+			Alert:  name + "BaselinePercentChange",
+			Expr:   fmt.Sprintf("abs(%s) > %s", recorded("percent_compare"), num(spec.percent)),
+			For:    spec.forDuration,
+			Labels: labels,
+			Annotations: map[string]string{
+				"summary":     fmt.Sprintf("%s is more than %s%% off the last 4 weeks' average", spec.metric, num(spec.percent)),
+				"description": "{{ $value | printf \"%.1f\" }}% away from lastMonthAverage.",
+			},
+		})
+	}
+
+	file := promRuleFile{Groups: []promRuleGroup{record}}
+	if len(alert.Rules) > 0 {
+		file.Groups = append(file.Groups, alert)
+	}
+	return file
+}
+
+// withTimeframe adds chrono_timeframe="tf" to a bare selector.
+func withTimeframe(selector, tf string) string {
+	matcher := fmt.Sprintf("chrono_timeframe=%q", tf)
+	open := strings.IndexByte(selector, '{')
+	if open < 0 {
+		return selector + "{" + matcher + "}"
+	}
+	close := strings.LastIndexByte(selector, '}')
+	if strings.TrimSpace(selector[open+1:close]) == "" {
+		return selector[:open+1] + matcher + selector[close:]
+	}
+	return selector[:close] + "," + matcher + selector[close:]
+}
+
+// alertName turns http_requests:rate5m into HttpRequestsRate5m.
+func alertName(metric string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(metric, func(c rune) bool { return c == '_' || c == ':' }) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestChronoRules(t *testing.T) {
+	p := NewChronoProxy()
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/localhost_9090/api/v1/chrono/rules?"+query, nil))
+		return w
+	}
+
+	w := get("zscore=2.5&for=15m&selector=" + url.QueryEscape(`http_requests:rate5m{job="api"}`))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/yaml" {
+		t.Fatalf("status %d, %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	var file promRuleFile
+	if err := yaml.Unmarshal(w.Body.Bytes(), &file); err != nil || len(file.Groups) != 2 {
+		t.Fatalf("bad rule file %q: %v", w.Body.String(), err)
+	}
+	record, alert := file.Groups[0], file.Groups[1]
+	if record.Name != "chrono:http_requests:rate5m:record" || len(record.Rules) != 3 ||
+		record.Rules[0].Record != "chrono:http_requests:rate5m:compare" ||
+		record.Rules[0].Expr != `http_requests:rate5m{job="api",chrono_timeframe="compareAgainstLast28"}` {
+		t.Errorf("record group = %+v", record)
+	}
+	if len(alert.Rules) != 2 || alert.Rules[0].Alert != "HttpRequestsRate5mBaselineZScore" || alert.Rules[0].For != "15m" ||
+		alert.Rules[0].Expr != `abs(chrono:http_requests:rate5m:compare / ignoring(chrono_timeframe) (chrono:http_requests:rate5m:stddev > 0)) > 2.5` ||
+		alert.Rules[1].Expr != `abs(chrono:http_requests:rate5m:percent_compare) > 50` {
+		t.Errorf("alert group = %+v", alert)
+	}
+
+	if w := get("percent=0&zscore=0&selector=up"); !strings.Contains(w.Body.String(), `up{chrono_timeframe="lastMonthStddev"}`) || strings.Contains(w.Body.String(), "alert") {
+		t.Errorf("both alerts off should leave only recording rules: %s", w.Body.String())
+	}
+	for _, bad := range []string{
+		"selector=" + url.QueryEscape(`rate(x[5m])`),
+		"selector=" + url.QueryEscape(`up{chrono_timeframe="7days"}`),
+		"selector=up&zscore=-1",
+		"selector=up&for=soon",
+	} {
+		if w := get(bad); w.Code != 400 {
+			t.Errorf("%s: status %d; want 400", bad, w.Code)
+		}
+	}
+}
+
+func TestWithTimeframe(t *testing.T) {
+	for in, want := range map[string]string{
+		`up`:          `up{chrono_timeframe="current"}`,
+		`up{}`:        `up{chrono_timeframe="current"}`,
+		`up{ a="1" }`: `up{ a="1" ,chrono_timeframe="current"}`,
+		`up{a="}"}`:   `up{a="}",chrono_timeframe="current"}`,
+	} {
+		if got := withTimeframe(in, "current"); got != want {
+			t.Errorf("withTimeframe(%s) = %s; want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/amplification.go
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Amplification - one dashboard refresh, how many upstream requests? 📢
+//
+// Every client query turns into several upstream ones: a window per
+// timeframe, more for extra offsets, retries, a fan-out per member of a
+// virtual upstream. Switching on another timeframe or a plugin that wants
+// more history quietly multiplies what the upstreams see. So each request
+// counts the upstream requests made on its behalf (retries included), and
+//
+//   - chronotheus_request_amplification{endpoint} is a histogram of that
+//     count per client request. Its _sum and _count are plain counters, so
+//       rate(chronotheus_request_amplification_sum[5m])
+//         / rate(chronotheus_request_amplification_count[5m]) > 10
+//     alerts on the average and a bucket alerts on the worst of them
+//   - the request span gets chrono.upstream_requests
+//   - with amplification_log_threshold set (or -debug), requests that reach
+//     it are logged with an upstream_requests= field
+//
+// endpoint is the route rather than the raw path, so label values stay few.
+// Async jobs run after their request has answered and aren't counted.
+
+// amplificationBuckets suit "how many upstream requests for one of ours".
+var amplificationBuckets = []float64{0, 1, 2, 5, 10, 20, 50, 100, 250, 500}
+
+// amplification counts upstream requests made for one client request.
+type amplification struct {
+	n int64
+}
+
+// add counts one upstream request. Nil-safe, for requests nobody counts.
+func (a *amplification) add() {
+	if a != nil {
+		atomic.AddInt64(&a.n, 1)
+	}
+}
+
+func (a *amplification) count() int64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&a.n)
+}
+
+type amplificationKey struct{}
+
+// withAmplification counts upstream requests made under ctx into a.
+func withAmplification(ctx context.Context, a *amplification) context.Context {
+	return context.WithValue(ctx, amplificationKey{}, a)
+}
+
+// amplificationFrom returns the counter set by withAmplification, or nil.
+func amplificationFrom(ctx context.Context) *amplification {
+	a, _ := ctx.Value(amplificationKey{}).(*amplification)
+	return a
+}
+
+// recordAmplification reports how many upstream requests r cost.
+func (p *ChronoProxy) recordAmplification(r *http.Request, sp *span, upstream, suffix string, a *amplification) {
+	n := a.count()
+	endpoint := endpointLabel(suffix)
+	p.amplification.observe(float64(n), endpoint)
+	sp.set("chrono.upstream_requests", strconv.FormatInt(n, 10))
+	if threshold := p.config.AmplificationLogThreshold; DebugMode.Load() || (threshold > 0 && n >= int64(threshold)) {
+		log.Printf("[AMPLIFICATION] %s %s upstream=%s endpoint=%s upstream_requests=%d", r.Method, r.URL.Path, upstream, endpoint, n)
+	}
+}
+
+// endpointLabel is the route suffix takes, for the endpoint label here and
+// on chronotheus_request_duration_seconds.
+func endpointLabel(suffix string) string {
+	switch suffix {
+	case "/api/v1/query", "/api/v1/query_range", "/api/v1/labels", metadataPath, targetsMetadataPath,
+		exemplarsPath, tsdbStatusPath, flagsStatusPath, runtimeStatusPath, remoteReadPath:
+		return suffix
+	}
+	if valuesRegex.MatchString(suffix) {
+		return "/api/v1/label/:name/values"
+	}
+	if m := chronoPathRegex.FindString(suffix); m != "" {
+		// Just the first segment, so job IDs don't turn into labels
+		name, _, _ := strings.Cut(strings.TrimPrefix(suffix, m), "/")
+		return strings.TrimSuffix(m, "/") + "/" + name
+	}
+	return "other"
+}
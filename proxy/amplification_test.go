@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestAmplification(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 1700000000, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	prevDebug := DebugMode.Load()
+	DebugMode.Store(false)
+	defer func() { DebugMode.Store(prevDebug) }()
+	var logs bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&logs)
+	defer log.SetOutput(prev)
+
+	config := DefaultConfig
+	config.AmplificationLogThreshold = 5
+	p := NewChronoProxyWithConfig(config)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query=up", nil))
+	if w.Code != 200 {
+		t.Fatalf("query: %d %s", w.Code, w.Body)
+	}
+	// Just the one window, and under the threshold
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000&query=up{chrono_timeframe="current"}`, nil))
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`chronotheus_request_amplification_sum{endpoint="/api/v1/query"} 6`,
+		`chronotheus_request_amplification_count{endpoint="/api/v1/query"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+	if n := strings.Count(logs.String(), "[AMPLIFICATION]"); n != 1 || !strings.Contains(logs.String(), "upstream_requests=5") {
+		t.Errorf("want one logged request, got %d: %s", n, logs.String())
+	}
+}
+
+func TestAmplificationEndpoint(t *testing.T) {
+	for suffix, want := range map[string]string{
+		"/api/v1/query_range":        "/api/v1/query_range",
+		"/api/v1/label/job/values":   "/api/v1/label/:name/values",
+		"/api/v1/chrono/jobs/abc123": "/api/v1/chrono/jobs",
+		"/api/v1/chrono/heatmap":     "/api/v1/chrono/heatmap",
+		"/api/v1/targets":            "other",
+		"/api/v1/series":             "other",
+	} {
+		if got := endpointLabel(suffix); got != want {
+			t.Errorf("endpointLabel(%q) = %q, want %q", suffix, got, want)
+		}
+	}
+}
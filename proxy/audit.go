@@ -0,0 +1,340 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/audit.go
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Audit log - who asked what, and when, for the people who have to know 📋
+//
+// Regulated shops need to show who looked at which data. With audit_log
+// set, every authenticated request is appended to that file as one JSON
+// line once it has been answered:
+//
+//   {"time":"2025-03-04T10:45:00Z","identity":"alice","tenant":"payments","client_ip":"10.0.0.7",
+//    "method":"GET","path":"/prod/api/v1/query","upstream":"prod",
+//    "queries":[{"query":"up{chrono_timeframe=\"7days\"}","timeframe":"7days"}],
+//    "status":200,"duration_ms":41.7,"series":3}
+//
+// queries has the query as the client wrote it plus the timeframe, command
+// and plugin picked out of it, one per evaluation (remote read can run
+// several). series is how many came back. Requests that never got as far
+// as a query (labels, metadata, a 429) still get a line, without them.
+//
+// audit_webhook POSTs the same records, as a JSON array, in batches. The
+// file is written before the response finishes, so nothing is lost; the
+// webhook is best effort - if it can't keep up records are dropped and
+// counted in chronotheus_audit_records_dropped_total. Use the file if every
+// line matters. Credentials are never recorded: the identity is the name
+// authentication settled on, not the key or password.
+
+const (
+	auditQueueSize  = 4096
+	auditBatchSize  = 256
+	auditFlushEvery = 5 * time.Second
+)
+
+// auditQuery is one evaluation within a request.
+type auditQuery struct {
+	Query     string `json:"query"`
+	Timeframe string `json:"timeframe,omitempty"`
+	Command   string `json:"command,omitempty"`
+	Plugin    string `json:"plugin,omitempty"`
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time       time.Time    `json:"time"`
+	Identity   string       `json:"identity,omitempty"`
+	Tenant     string       `json:"tenant,omitempty"`
+	ClientIP   string       `json:"client_ip"`
+	Method     string       `json:"method"`
+	Path       string       `json:"path"`
+	Upstream   string       `json:"upstream,omitempty"`
+	Queries    []auditQuery `json:"queries,omitempty"`
+	Status     int          `json:"status"`
+	DurationMs float64      `json:"duration_ms"`
+	Series     *int         `json:"series,omitempty"`
+}
+
+// auditEntry is a record being filled in while its request runs. A nil
+// *auditEntry is a request nobody audits - every method is safe on it.
+type auditEntry struct {
+	mu  sync.Mutex
+	rec auditRecord
+}
+
+// query notes one evaluation and what it asked for.
+func (e *auditEntry) query(q auditQuery) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rec.Queries = append(e.rec.Queries, q)
+}
+
+// series adds n to the series handed back.
+func (e *auditEntry) series(n int) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.rec.Series == nil {
+		e.rec.Series = new(int)
+	}
+	*e.rec.Series += n
+}
+
+// set fills in the request's own fields.
+func (e *auditEntry) set(fill func(*auditRecord)) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	fill(&e.rec)
+}
+
+type auditKey struct{}
+
+func withAudit(ctx context.Context, e *auditEntry) context.Context {
+	return context.WithValue(ctx, auditKey{}, e)
+}
+
+// auditFrom returns the entry set by withAudit, or nil.
+func auditFrom(ctx context.Context) *auditEntry {
+	e, _ := ctx.Value(auditKey{}).(*auditEntry)
+	return e
+}
+
+// auditor writes finished records to the file and queues them for the
+// webhook.
+type auditor struct {
+	mu      sync.Mutex
+	file    *os.File // nil = no audit_log
+	webhook string   // "" = no audit_webhook
+	client  *http.Client
+	queue   chan auditRecord
+	dropped uint64 // webhook records thrown away because the queue was full
+}
+
+// validateAudit checks audit_webhook is somewhere we can POST to.
+func validateAudit(c Config) error {
+	if c.AuditWebhook == "" {
+		return nil
+	}
+	u, err := url.Parse(c.AuditWebhook)
+	if err != nil {
+		return fmt.Errorf("audit_webhook: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("audit_webhook must be an http or https URL, got %q", c.AuditWebhook)
+	}
+	return nil
+}
+
+// newAuditor returns nil when auditing is off.
+func newAuditor(config Config) (*auditor, error) {
+	if config.AuditLog == "" && config.AuditWebhook == "" {
+		return nil, nil
+	}
+	if err := validateAudit(config); err != nil {
+		return nil, err
+	}
+	a := &auditor{webhook: config.AuditWebhook}
+	if config.AuditLog != "" {
+		f, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("audit_log: %w", err)
+		}
+		a.file = f
+	}
+	if a.webhook != "" {
+		a.client = &http.Client{Timeout: 10 * time.Second}
+		a.queue = make(chan auditRecord, auditQueueSize)
+	}
+	return a, nil
+}
+
+// record writes rec out.
+func (a *auditor) record(rec auditRecord) {
+	if a.file != nil {
+		line, err := json.Marshal(rec)
+		if err == nil {
+			a.mu.Lock()
+			_, err = a.file.Write(append(line, '\n'))
+			a.mu.Unlock()
+		}
+		if err != nil {
+			log.Printf("[ERROR] writing audit log: %v", err)
+		}
+	}
+	if a.queue != nil {
+		select {
+		case a.queue <- rec:
+		default:
+			atomic.AddUint64(&a.dropped, 1)
+		}
+	}
+}
+
+// close closes the audit_log file. Safe on a nil auditor.
+func (a *auditor) close() {
+	if a != nil && a.file != nil {
+		a.file.Close()
+	}
+}
+
+// droppedRecords is safe to call on a nil auditor.
+func (a *auditor) droppedRecords() uint64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// startAudit sets up r's entry, when auditing is on. The returned func
+// finishes and writes it; call it once the response is done.
+func (p *ChronoProxy) startAudit(w http.ResponseWriter, r *http.Request, identity string) (http.ResponseWriter, *http.Request, func()) {
+	if p.audit == nil {
+		return w, r, func() {}
+	}
+	start := p.clock.Now()
+	e := &auditEntry{rec: auditRecord{
+		Time:     start.UTC(),
+		Identity: identity,
+		ClientIP: p.clientAddress(r),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+	}}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	return sw, r.WithContext(withAudit(r.Context(), e)), func() {
+		e.set(func(rec *auditRecord) {
+			rec.Status = sw.status
+			rec.DurationMs = millis(p.since(start))
+		})
+		e.mu.Lock()
+		rec := e.rec
+		e.mu.Unlock()
+		p.audit.record(rec)
+	}
+}
+
+// ExportAudit POSTs queued records to audit_webhook until ctx is done, then
+// sends whatever is left. Run it in its own goroutine; it returns straight
+// away when there's no webhook.
+func (p *ChronoProxy) ExportAudit(ctx context.Context) {
+	a := p.audit
+	if a == nil || a.queue == nil {
+		return
+	}
+	ticker := time.NewTicker(auditFlushEvery)
+	defer ticker.Stop()
+
+	var batch []auditRecord
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.post(batch); err != nil {
+			log.Printf("[ERROR] sending %d audit records: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case rec := <-a.queue:
+			batch = append(batch, rec)
+			if len(batch) >= auditBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case <-ctx.Done():
+			for {
+				select {
+				case rec := <-a.queue:
+					batch = append(batch, rec)
+				default:
+					send()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *auditor) post(batch []auditRecord) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// statusWriter remembers the status code a response went out with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wrote {
+		w.status, w.wrote = code, true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming endpoints (job progress) streaming.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController find the real writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
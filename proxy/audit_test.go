@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestAuditLog(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 1700000000-7*86400, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	var posted []auditRecord
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []auditRecord
+		json.NewDecoder(r.Body).Decode(&batch)
+		posted = append(posted, batch...)
+	}))
+	defer hook.Close()
+
+	config := DefaultConfig
+	config.AuditLog = filepath.Join(t.TempDir(), "audit.jsonl")
+	config.AuditWebhook = hook.URL
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewChronoProxyWithConfig(config)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000&query=up{chrono_timeframe="7days",_plugin="nope"}`, nil)
+	r.RemoteAddr = "10.0.0.7:5555"
+	p.ServeHTTP(w, r)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?query=up&chrono_pad_lookbehind=maybe", nil))
+
+	data, err := os.ReadFile(config.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines, got %q", data)
+	}
+	var rec auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.ClientIP != "10.0.0.7" || rec.Method != "GET" || rec.Upstream == "" || len(rec.Queries) != 1 {
+		t.Errorf("record = %+v", rec)
+	}
+	if q := rec.Queries[0]; q.Query != `up{chrono_timeframe="7days",_plugin="nope"}` || q.Timeframe != "7days" || q.Plugin != "nope" {
+		t.Errorf("query = %+v", q)
+	}
+	if rec.Status != 200 || rec.Series == nil || *rec.Series != 1 {
+		t.Errorf("status %d, series %v", rec.Status, rec.Series)
+	}
+
+	rec = auditRecord{}
+	json.Unmarshal([]byte(lines[1]), &rec)
+	if rec.Status != 400 || rec.Series != nil {
+		t.Errorf("failed query: %s", lines[1])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.ExportAudit(ctx) // sends what's queued and returns
+	if len(posted) != 2 || posted[0].ClientIP != "10.0.0.7" {
+		t.Errorf("webhook got %+v", posted)
+	}
+}
+
+func TestValidateAudit(t *testing.T) {
+	config := DefaultConfig
+	config.AuditWebhook = "ftp://audit.example.com"
+	if err := config.Validate(); err == nil {
+		t.Error("ftp audit_webhook should be rejected")
+	}
+}
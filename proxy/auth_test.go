@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+// authQuery runs one query through a proxy with a single named upstream
+// and returns the Authorization headers the windows arrived with.
+func authQuery(t *testing.T, auth UpstreamAuthConfig, clientAuth string) []string {
+	t.Helper()
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "secure", URL: fake.URL, Auth: auth}}
+	p := NewChronoProxyWithConfig(config)
+	r := httptest.NewRequest("GET", "/secure/api/v1/query?query=up", nil)
+	if clientAuth != "" {
+		r.Header.Set("Authorization", clientAuth)
+	}
+	p.ServeHTTP(httptest.NewRecorder(), r)
+
+	var got []string
+	for _, req := range fake.Requests() {
+		got = append(got, req.Header.Get("Authorization"))
+	}
+	if len(got) == 0 {
+		t.Fatal("no upstream requests")
+	}
+	return got
+}
+
+func TestUpstreamAuthSentOnEveryWindow(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("from-file\n"), 0o600)
+
+	cases := []struct {
+		name       string
+		auth       UpstreamAuthConfig
+		clientAuth string
+		want       string
+	}{
+		{"none", UpstreamAuthConfig{}, "Bearer client", ""},
+		{"basic", UpstreamAuthConfig{Username: "chrono", Password: "s3cret"}, "", "Basic Y2hyb25vOnMzY3JldA=="},
+		{"bearer", UpstreamAuthConfig{BearerToken: "abc"}, "", "Bearer abc"},
+		{"bearer file", UpstreamAuthConfig{BearerTokenFile: tokenFile}, "", "Bearer from-file"},
+		{"passthrough", UpstreamAuthConfig{PassAuthorization: true}, "Bearer client", "Bearer client"},
+		{"configured wins", UpstreamAuthConfig{BearerToken: "abc", PassAuthorization: true}, "Bearer client", "Bearer abc"},
+	}
+	for _, tc := range cases {
+		for i, got := range authQuery(t, tc.auth, tc.clientAuth) {
+			if got != tc.want {
+				t.Errorf("%s: request %d Authorization = %q, want %q", tc.name, i, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestUpstreamAuthHeaders(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "thanos", URL: fake.URL, Auth: UpstreamAuthConfig{
+		Headers: map[string]string{"X-Scope-OrgID": "team-a"},
+	}}}
+	p := NewChronoProxyWithConfig(config)
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/thanos/api/v1/labels", nil))
+
+	reqs := fake.Requests()
+	if len(reqs) != 1 || reqs[0].Header.Get("X-Scope-OrgID") != "team-a" {
+		t.Errorf("requests = %+v, want one with X-Scope-OrgID: team-a", reqs)
+	}
+}
+
+func TestUpstreamAuthRetired(t *testing.T) {
+	config := DefaultConfig
+	config.UpstreamAuth = UpstreamAuthConfig{BearerToken: "default"}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "auth block") {
+		t.Errorf("err = %v, want upstream_auth refused with a pointer to per-upstream auth", err)
+	}
+
+	// Nor does it leak into registered upstreams if Validate was skipped
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	config.Upstreams = []UpstreamConfig{{Name: "prod", URL: fake.URL}}
+	p := NewChronoProxyWithConfig(config)
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", `/prod/api/v1/query?query=up{chrono_timeframe="current"}`, nil))
+	reqs := fake.Requests()
+	if len(reqs) != 1 || reqs[0].Header.Get("Authorization") != "" {
+		t.Errorf("requests = %+v, want one without credentials", reqs)
+	}
+}
+
+func TestUpstreamAuthNotSentToLegacyHosts(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.UpstreamAuth = UpstreamAuthConfig{
+		BearerToken: "s3cret",
+		Headers:     map[string]string{"X-Scope-OrgID": "team-a"},
+	}
+	p := NewChronoProxyWithConfig(config)
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", prefix+`/api/v1/query?query=up{chrono_timeframe="current"}`, nil))
+
+	reqs := fake.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d upstream requests, want 1", len(reqs))
+	}
+	if got := reqs[0].Header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization = %q sent to a host the client picked, want none", got)
+	}
+	if got := reqs[0].Header.Get("X-Scope-OrgID"); got != "" {
+		t.Errorf("X-Scope-OrgID = %q sent to a host the client picked, want none", got)
+	}
+}
+
+func TestUpstreamAuthValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		auth UpstreamAuthConfig
+		ok   bool
+	}{
+		{"empty", UpstreamAuthConfig{}, true},
+		{"basic", UpstreamAuthConfig{Username: "u", PasswordFile: "/p"}, true},
+		{"basic and bearer", UpstreamAuthConfig{Username: "u", BearerToken: "t"}, false},
+		{"password without user", UpstreamAuthConfig{Password: "p"}, false},
+		{"two tokens", UpstreamAuthConfig{BearerToken: "t", BearerTokenFile: "/t"}, false},
+		{"bad header", UpstreamAuthConfig{Headers: map[string]string{"X Bad": "v"}}, false},
+	}
+	for _, tc := range cases {
+		if err := tc.auth.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestRedactedHidesUpstreamAuth(t *testing.T) {
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "prod", URL: "http://prom:9090", Auth: UpstreamAuthConfig{
+		Username: "chrono", Password: "s3cret", Headers: map[string]string{"X-Api-Key": "k3y"},
+	}}}
+	config.UpstreamAuth = UpstreamAuthConfig{BearerToken: "t0ken"}
+	out, err := config.Redacted().YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"s3cret", "k3y", "t0ken"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("redacted config still contains %q", secret)
+		}
+	}
+	if config.Upstreams[0].Auth.Password != "s3cret" {
+		t.Error("Redacted changed the original config")
+	}
+}
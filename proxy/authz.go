@@ -0,0 +1,339 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/authz.go
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	goplugin "plugin"
+	"strings"
+	"sync/atomic"
+)
+
+// Authorization hook - your rules, without forking the handlers 🛂
+//
+// listen_auth says who someone is and tenants say which upstreams and
+// timeframes they get, but "team A may not query namespace B" is a policy
+// only you can write. An Authorizer is asked before anything is fetched:
+//
+//   - once per request, right after listen_auth (kind "request"), with the
+//     upstream and route it's for and the query and match[] selectors it
+//     carries. Chronotheus' own endpoints - admin, /-/debug/, /-/reload,
+//     /metrics, the aggregated rules and alerts - are asked about too,
+//     with no upstream and the path as the endpoint
+//   - once per query evaluated (kind "query") - the same query again for
+//     /api/v1/query, but also the ones only the pipeline sees: remote read
+//     matchers, background jobs, templated queries with $variables filled
+//
+// Each time it gets who's asking (the listen_auth identity and the
+// tenant), the upstream, the route, the query as written and every
+// selector in it, chrono labels and all, plus the chrono_timeframe,
+// _command and _plugin picked out of it. A "no" is a 403 with the reason
+// the hook gave; a hook that fails or doesn't answer is a 503 - it never
+// lets a request through by default.
+//
+// There are two ways to plug one in:
+//
+//   authorization_plugin: /etc/chronotheus/authz.so
+//       a Go plugin exporting a variable named Authorizer that implements
+//       proxy.Authorizer, built against the same Chronotheus as the proxy
+//   authorization_webhook: http://policy:8181/chronotheus
+//       POSTed each AuthorizationRequest as JSON, answers with an
+//       AuthorizationDecision - {"allow": false, "reason": "..."} - so the
+//       policy can live in whatever language (or policy engine) you like
+//
+// Programs embedding the proxy can call SetAuthorizer instead.
+// chronotheus_authorization_decisions_total{decision} counts allow, deny
+// and error.
+
+// AuthorizationRequest is what an Authorizer is asked about.
+type AuthorizationRequest struct {
+	Kind      string   `json:"kind"`                // "request" or "query"
+	Identity  string   `json:"identity,omitempty"`  // Who listen_auth let in, e.g. user:alice
+	Tenant    string   `json:"tenant,omitempty"`    // The tenant it's for, if tenants are set up
+	Upstream  string   `json:"upstream"`            // Upstream name (or host_port prefix), "" for our own endpoints
+	Method    string   `json:"method,omitempty"`    // HTTP method, for requests
+	Endpoint  string   `json:"endpoint"`            // The route, e.g. /api/v1/query_range
+	Query     string   `json:"query,omitempty"`     // As the client wrote it
+	Selectors []string `json:"selectors,omitempty"` // Every selector in query and match[], as written
+	Timeframe string   `json:"timeframe,omitempty"` // chrono_timeframe, for queries
+	Command   string   `json:"command,omitempty"`   // _command, for queries
+	Plugin    string   `json:"plugin,omitempty"`    // _plugin, for queries
+}
+
+// AuthorizationDecision is an Authorizer's answer.
+type AuthorizationDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"` // Sent back with a 403
+}
+
+// Authorizer decides whether requests and queries may go ahead. An error
+// means it couldn't decide, and the request is refused with a 503.
+type Authorizer interface {
+	Authorize(ctx context.Context, req AuthorizationRequest) (AuthorizationDecision, error)
+}
+
+// deniedError is an Authorizer saying no.
+type deniedError struct {
+	reason string
+}
+
+func (e *deniedError) Error() string {
+	if e.reason == "" {
+		return "not authorized"
+	}
+	return "not authorized: " + e.reason
+}
+
+// SetAuthorizer has a decide on every request and query, replacing any
+// authorization_plugin or authorization_webhook. nil turns it off.
+func (p *ChronoProxy) SetAuthorizer(a Authorizer) {
+	p.authorizer.set(a)
+}
+
+// authorizerSlot holds the current Authorizer. Requests read it while
+// SetAuthorizer may be swapping it.
+type authorizerSlot struct {
+	a atomic.Pointer[Authorizer]
+}
+
+func (s *authorizerSlot) set(a Authorizer) {
+	if a == nil {
+		s.a.Store(nil)
+		return
+	}
+	s.a.Store(&a)
+}
+
+// get is the current Authorizer, nil for none.
+func (s *authorizerSlot) get() Authorizer {
+	if a := s.a.Load(); a != nil {
+		return *a
+	}
+	return nil
+}
+
+// newAuthorizer builds what the config asks for, nil for nothing. One that
+// can't be loaded refuses everything rather than quietly allowing it.
+func newAuthorizer(config Config) Authorizer {
+	switch {
+	case config.AuthorizationPlugin != "":
+		a, err := loadAuthorizerPlugin(config.AuthorizationPlugin)
+		if err != nil {
+			return brokenAuthorizer{err: fmt.Errorf("authorization_plugin: %w", err)}
+		}
+		return a
+	case config.AuthorizationWebhook != "":
+		return &webhookAuthorizer{url: config.AuthorizationWebhook, client: &http.Client{Timeout: config.AuthorizationTimeout}}
+	}
+	return nil
+}
+
+func validateAuthorization(c Config) error {
+	if c.AuthorizationPlugin != "" && c.AuthorizationWebhook != "" {
+		return fmt.Errorf("authorization_plugin and authorization_webhook can't both be set")
+	}
+	if c.AuthorizationWebhook != "" {
+		u, err := url.Parse(c.AuthorizationWebhook)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("authorization_webhook must be an http or https URL, got %q", c.AuthorizationWebhook)
+		}
+	}
+	if c.AuthorizationTimeout <= 0 {
+		return fmt.Errorf("authorization_timeout must be positive, got %v", c.AuthorizationTimeout)
+	}
+	return nil
+}
+
+// loadAuthorizerPlugin opens a Go plugin and finds its Authorizer.
+func loadAuthorizerPlugin(path string) (Authorizer, error) {
+	so, err := goplugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := so.Lookup("Authorizer")
+	if err != nil {
+		return nil, fmt.Errorf("plugin does not export 'Authorizer': %w", err)
+	}
+	a, ok := sym.(Authorizer)
+	if !ok {
+		return nil, fmt.Errorf("plugin's Authorizer (%T) doesn't implement proxy.Authorizer", sym)
+	}
+	return a, nil
+}
+
+// brokenAuthorizer stands in for one that failed to load.
+type brokenAuthorizer struct {
+	err error
+}
+
+func (b brokenAuthorizer) Authorize(context.Context, AuthorizationRequest) (AuthorizationDecision, error) {
+	return AuthorizationDecision{}, b.err
+}
+
+// webhookAuthorizer asks authorization_webhook.
+type webhookAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+func (a *webhookAuthorizer) Authorize(ctx context.Context, req AuthorizationRequest) (AuthorizationDecision, error) {
+	var decision AuthorizationDecision
+	body, err := json.Marshal(req)
+	if err != nil {
+		return decision, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(hreq)
+	if err != nil {
+		return decision, fmt.Errorf("authorization_webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decision, fmt.Errorf("authorization_webhook answered %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("authorization_webhook: %w", err)
+	}
+	return decision, nil
+}
+
+// authorize asks the Authorizer about req: nil to go ahead, a *deniedError
+// for no, anything else when it couldn't say.
+func (p *ChronoProxy) authorize(ctx context.Context, req AuthorizationRequest) error {
+	authorizer := p.authorizer.get()
+	if authorizer == nil {
+		return nil
+	}
+	req.Identity = identityFrom(ctx)
+	if t := tenantFrom(ctx); t != nil {
+		req.Tenant = t.config.Name
+	}
+	if u := upstreamFrom(ctx); u != nil && req.Upstream == "" {
+		req.Upstream = u.name
+	}
+	decision, err := authorizer.Authorize(ctx, req)
+	switch {
+	case err != nil:
+		p.authzDecisions.inc("error")
+		return fmt.Errorf("authorization failed: %w", err)
+	case !decision.Allow:
+		p.authzDecisions.inc("deny")
+		return &deniedError{reason: decision.Reason}
+	}
+	p.authzDecisions.inc("allow")
+	return nil
+}
+
+// authorizeRequest asks about r as it arrives, before it's routed anywhere.
+// The body is read for its parameters and put back for whoever handles r
+// next.
+func (p *ChronoProxy) authorizeRequest(r *http.Request) error {
+	if p.authorizer.get() == nil {
+		return nil
+	}
+	req := AuthorizationRequest{Kind: "request", Method: r.Method}
+	req.Tenant, req.Upstream, req.Endpoint = p.requestRoute(r)
+	params := peekClientParams(r)
+	req.Query = params.Get("query")
+	for _, q := range append([]string{req.Query}, params["match[]"]...) {
+		req.Selectors = append(req.Selectors, selectorStrings(q)...)
+	}
+	return p.authorize(r.Context(), req)
+}
+
+// requestRoute works out the tenant, upstream and endpoint r is for, the
+// way ServeHTTP will route it. Our own endpoints have no upstream and use
+// their path. Anything ServeHTTP will turn away anyway just gets its path.
+func (p *ChronoProxy) requestRoute(r *http.Request) (tenant, upstream, endpoint string) {
+	path := r.URL.Path
+	if isOwnPath(path) {
+		return "", "", path
+	}
+	t, path, err := p.tenants.forRequest(r)
+	if err != nil {
+		return "", "", r.URL.Path
+	}
+	if t != nil {
+		tenant = t.config.Name
+	}
+	if path == rulesPath || path == alertsPath {
+		return tenant, "", path
+	}
+	u, suffix, err := p.resolveUpstream(path)
+	if err != nil {
+		return tenant, "", path
+	}
+	return tenant, u.name, endpointLabel(suffix)
+}
+
+// isOwnPath is whether path is one of the endpoints ServeHTTP answers
+// itself before looking for a tenant or upstream.
+func isOwnPath(path string) bool {
+	return path == reloadPath || path == metricsPath ||
+		strings.HasPrefix(path, chronoAdminPrefix) ||
+		strings.HasPrefix(path, "/"+adminPrefix+"/") ||
+		strings.HasPrefix(path, debugPathPrefix)
+}
+
+// authorizeQuery asks about one query evaluate is about to run against
+// endpoint (a full upstream URL).
+func (p *ChronoProxy) authorizeQuery(ctx context.Context, endpoint, query, tf, command, plugin string) error {
+	if p.authorizer.get() == nil {
+		return nil
+	}
+	_, route, _ := strings.Cut(endpoint, "/api/v1/")
+	return p.authorize(ctx, AuthorizationRequest{
+		Kind:      "query",
+		Endpoint:  endpointLabel("/api/v1/" + route),
+		Query:     query,
+		Selectors: selectorStrings(query),
+		Timeframe: tf,
+		Command:   command,
+		Plugin:    plugin,
+	})
+}
+
+// peekClientParams is parseClientParams without using up r's body.
+func peekClientParams(r *http.Request) url.Values {
+	if r.Method != http.MethodPost || r.Body == nil {
+		return parseClientParams(r)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 10*1024*1024))
+	// Whatever's past the limit was never read; keep it behind what was
+	rest := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), rest), rest}
+	if err != nil {
+		return url.Values{}
+	}
+	peek := r.Clone(r.Context())
+	peek.Body = io.NopCloser(bytes.NewReader(body))
+	return parseClientParams(peek)
+}
@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestAuthorizationWebhook(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/series", 0, []byte(`{"status":"success","data":[]}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	var mu sync.Mutex
+	var asked []AuthorizationRequest
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AuthorizationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		asked = append(asked, req)
+		mu.Unlock()
+		for _, sel := range req.Selectors {
+			if strings.Contains(sel, `namespace="b"`) {
+				json.NewEncoder(w).Encode(AuthorizationDecision{Reason: "team A can't see namespace b"})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(AuthorizationDecision{Allow: true})
+	}))
+	defer hook.Close()
+
+	config := DefaultConfig
+	config.AuthorizationWebhook = hook.URL
+	p := NewChronoProxyWithConfig(config)
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		mu.Lock()
+		asked = nil
+		mu.Unlock()
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(`up{namespace="a",chrono_timeframe="7days"}`), nil))
+	if w.Code != 200 {
+		t.Fatalf("allowed query: %d %s", w.Code, w.Body)
+	}
+	if len(asked) != 2 || asked[0].Kind != "request" || asked[1].Kind != "query" {
+		t.Fatalf("asked %+v", asked)
+	}
+	if q := asked[1]; q.Endpoint != "/api/v1/query" || q.Timeframe != "7days" || len(q.Selectors) != 1 || q.Selectors[0] != `up{namespace="a",chrono_timeframe="7days"}` {
+		t.Errorf("query asked about as %+v", q)
+	}
+
+	w = serve(httptest.NewRequest("GET", prefix+"/api/v1/query?query="+url.QueryEscape(`up{namespace="b"}`), nil))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "team A can't see namespace b") {
+		t.Errorf("denied query: %d %s", w.Code, w.Body)
+	}
+
+	// A passthrough POST is judged on its body, which still reaches the upstream
+	form := url.Values{"match[]": {`up{namespace="b"}`}}.Encode()
+	req := httptest.NewRequest("POST", prefix+"/api/v1/series", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serve(req); w.Code != http.StatusForbidden {
+		t.Errorf("denied series: %d %s", w.Code, w.Body)
+	}
+	form = url.Values{"match[]": {`up{namespace="a"}`}}.Encode()
+	req = httptest.NewRequest("POST", prefix+"/api/v1/series", strings.NewReader(form))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if w := serve(req); w.Code != 200 {
+		t.Errorf("allowed series: %d %s", w.Code, w.Body)
+	}
+	reqs := fake.Requests()
+	if last := reqs[len(reqs)-1]; last.Path != "/api/v1/series" || last.Params.Get("match[]") != `up{namespace="a"}` {
+		t.Errorf("upstream got %+v", last)
+	}
+
+	hook.Close()
+	if w := serve(httptest.NewRequest("GET", prefix+"/api/v1/query?query=up", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unreachable hook: %d; want 503", w.Code)
+	}
+	if w := serve(httptest.NewRequest("GET", "/metrics", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("metrics with an unreachable hook: %d; want 503", w.Code)
+	}
+	p.SetAuthorizer(nil)
+	body := serve(httptest.NewRequest("GET", "/metrics", nil)).Body.String()
+	for _, want := range []string{`chronotheus_authorization_decisions_total{decision="deny"} 2`, `chronotheus_authorization_decisions_total{decision="error"} 2`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+}
+
+type authorizerFunc func(context.Context, AuthorizationRequest) (AuthorizationDecision, error)
+
+func (f authorizerFunc) Authorize(ctx context.Context, req AuthorizationRequest) (AuthorizationDecision, error) {
+	return f(ctx, req)
+}
+
+func TestSetAuthorizerSurvivesReload(t *testing.T) {
+	p := NewChronoProxy()
+	p.SetAuthorizer(authorizerFunc(func(context.Context, AuthorizationRequest) (AuthorizationDecision, error) {
+		return AuthorizationDecision{}, errors.New("policy engine down")
+	}))
+	rl := NewReloader(p, func() (Config, error) { return DefaultConfig, nil })
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, httptest.NewRequest("GET", "/localhost_9090/api/v1/query?query=up", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "policy engine down") {
+		t.Errorf("after reload: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestValidateAuthorization(t *testing.T) {
+	c := DefaultConfig
+	c.AuthorizationPlugin, c.AuthorizationWebhook = "/authz.so", "http://policy"
+	if err := c.Validate(); err == nil {
+		t.Error("expected plugin and webhook together to be refused")
+	}
+	c.AuthorizationPlugin, c.AuthorizationWebhook = "", "policy:8181"
+	if err := c.Validate(); err == nil {
+		t.Error("expected a webhook without a scheme to be refused")
+	}
+	c.AuthorizationPlugin, c.AuthorizationWebhook = "/no/such/authz.so", ""
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// A plugin that won't load refuses everything
+	if _, err := newAuthorizer(c).Authorize(context.Background(), AuthorizationRequest{}); err == nil {
+		t.Error("expected a broken plugin to fail closed")
+	}
+}
+
+func TestAuthorizerAskedAboutOwnEndpoints(t *testing.T) {
+	var mu sync.Mutex
+	var asked []AuthorizationRequest
+	p := NewChronoProxy()
+	p.SetAuthorizer(authorizerFunc(func(_ context.Context, req AuthorizationRequest) (AuthorizationDecision, error) {
+		mu.Lock()
+		asked = append(asked, req)
+		mu.Unlock()
+		return AuthorizationDecision{Reason: "nope"}, nil
+	}))
+	rl := NewReloader(p, func() (Config, error) { return DefaultConfig, nil })
+
+	for _, tc := range []struct{ method, path string }{
+		{"PUT", chronoAdminPrefix + "chaos"},
+		{"GET", "/" + adminPrefix + "/config"},
+		{"GET", debugPathPrefix + "state"},
+		{"GET", metricsPath},
+		{"GET", rulesPath},
+		{"GET", alertsPath},
+		{"POST", reloadPath},
+	} {
+		mu.Lock()
+		asked = nil
+		mu.Unlock()
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: %d %s, want 403", tc.method, tc.path, w.Code, w.Body)
+		}
+		if len(asked) != 1 || asked[0].Kind != "request" || asked[0].Upstream != "" || asked[0].Endpoint != tc.path || asked[0].Method != tc.method {
+			t.Errorf("%s %s: asked %+v", tc.method, tc.path, asked)
+		}
+	}
+}
+
+func TestSetAuthorizerWhileServing(t *testing.T) {
+	p := NewChronoProxy()
+	allow := authorizerFunc(func(context.Context, AuthorizationRequest) (AuthorizationDecision, error) {
+		return AuthorizationDecision{Allow: true}, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nowhere", nil))
+			}
+		}()
+	}
+	for j := 0; j < 50; j++ {
+		p.SetAuthorizer(allow)
+		p.SetAuthorizer(nil)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,129 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/backpressure.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Backpressure - the "sorry, we're full" sign on the door!
+//
+// When every slot in a priority pool is busy we used to queue the request
+// until something gave up - usually Grafana's own timeout, long after the
+// answer stopped being useful. Now we queue for at most Config.QueueWait
+// and then answer 429 Too Many Requests with a Retry-After header and a
+// machine-readable reason, so clients can back off and come back later
+// instead of piling on.
+//
+// Background jobs are the exception: they've already been handed a ticket,
+// so they wait their turn for as long as the job is allowed to live.
+
+// Reasons reported in the "reason" field of a 429 body.
+const (
+	reasonConcurrencyLimit = "concurrency_limit" // the request's priority pool is full
+	reasonJobLimit         = "job_limit"         // too many background jobs running
+	reasonQuotaExceeded    = "quota_exceeded"    // the caller's quota is used up (see quota.go)
+)
+
+// saturatedError means "we're too busy right now, try again shortly".
+type saturatedError struct {
+	reason     string
+	msg        string
+	retryAfter time.Duration // 0 = use Config.RetryAfter
+	status     int           // 0 = 429 Too Many Requests
+}
+
+func (e *saturatedError) Error() string { return e.msg }
+
+// queueWaitKey overrides Config.QueueWait for one evaluation.
+type queueWaitKey struct{}
+
+// withQueueWait sets how long evaluations under ctx may queue for a slot.
+// 0 means "as long as ctx lives".
+func withQueueWait(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, queueWaitKey{}, d)
+}
+
+func queueWaitFrom(ctx context.Context, fallback time.Duration) time.Duration {
+	if d, ok := ctx.Value(queueWaitKey{}).(time.Duration); ok {
+		return d
+	}
+	return fallback
+}
+
+// writeEvalError answers a failed evaluation: 429 with Retry-After when we
+// were too busy (or the caller is over quota or rate limit), 400 when the
+// query itself is wrong, 502 when a strict query lost a window, 503 for
+// everything else - with Retry-After too if it was the upstreams that were
+// too busy.
+func (p *ChronoProxy) writeEvalError(w http.ResponseWriter, err error) {
+	var bad *badQueryError
+	if errors.As(err, &bad) {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", bad.msg)
+		return
+	}
+	var denied *deniedError
+	if errors.As(err, &denied) {
+		writeJSONError(w, http.StatusForbidden, "bad_data", denied.Error())
+		return
+	}
+	var limit *limitError
+	if errors.As(err, &limit) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "execution", limit.Error())
+		return
+	}
+	var failed *windowsFailedError
+	if errors.As(err, &failed) {
+		writeJSONError(w, http.StatusBadGateway, "unavailable", failed.Error())
+		return
+	}
+	var sat *saturatedError
+	if !errors.As(err, &sat) {
+		writeJSONError(w, http.StatusServiceUnavailable, "unavailable", err.Error())
+		return
+	}
+
+	p.rejections.inc(sat.reason)
+
+	retryAfter := sat.retryAfter
+	if retryAfter <= 0 {
+		retryAfter = p.config.RetryAfter
+	}
+	// Retry-After is whole seconds, and 0 would just invite a stampede.
+	secs := int(math.Max(1, math.Ceil(retryAfter.Seconds())))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	status := sat.status
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "error",
+		"errorType": "unavailable",
+		"error":     sat.msg,
+		"reason":    sat.reason,
+	})
+}
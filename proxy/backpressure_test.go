@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSchedulerGivesUpAfterQueueWait(t *testing.T) {
+	config := DefaultConfig
+	config.InteractiveConcurrency = 1
+	config.QueueWait = 10 * time.Millisecond
+	s := newScheduler(config)
+
+	release, err := s.acquire(context.Background(), priorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	var sat *saturatedError
+	if _, err := s.acquire(context.Background(), priorityInteractive); !errors.As(err, &sat) || sat.reason != reasonConcurrencyLimit {
+		t.Fatalf("got %v; want a concurrency_limit saturatedError", err)
+	}
+
+	// Background jobs opt out of the queue wait and stick around until
+	// their own deadline.
+	ctx, cancel := context.WithTimeout(withQueueWait(context.Background(), 0), 30*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, priorityInteractive); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v; want the context deadline", err)
+	}
+}
+
+func TestSaturatedQueryGets429(t *testing.T) {
+	config := DefaultConfig
+	config.InteractiveConcurrency = 1
+	config.QueueWait = 10 * time.Millisecond
+	config.RetryAfter = 1500 * time.Millisecond
+	p := NewChronoProxyWithConfig(config)
+
+	release, err := p.scheduler.acquire(context.Background(), priorityInteractive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/prometheus_9090/api/v1/query?query=up", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d; want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q; want 2 (rounded up)", got)
+	}
+	var body struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Status != "error" || body.Reason != reasonConcurrencyLimit {
+		t.Errorf("body = %s", w.Body.String())
+	}
+}
+
+func TestJobLimitGets429(t *testing.T) {
+	config := DefaultConfig
+	config.MaxRunningJobs = 1
+	p := NewChronoProxyWithConfig(config)
+	p.jobs.add(&chronoJob{id: "busy", state: jobRunning})
+
+	w := httptest.NewRecorder()
+	p.handleJobs(w, httptest.NewRequest("POST", "/?query=up", nil), "http://unused", jobsPath)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("got %d with Retry-After %q; want 429 with 5", w.Code, w.Header().Get("Retry-After"))
+	}
+}
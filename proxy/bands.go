@@ -0,0 +1,66 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/bands.go
+package proxy
+
+import "math"
+
+// Bands - the "normal range" envelope to shade behind the current line.
+//
+// bandUpper and bandLower are mean ± band_stddevs standard deviations of
+// the past windows, step by step. In Grafana, query both and set a
+// "Fill below to" override from bandUpper to bandLower - anything poking
+// out of the shaded area is having an unusual day.
+//
+// Unlike lastMonthAverage, the mean here only counts the weeks that have a
+// value, so a missing week widens nothing and drags nothing towards zero.
+// Ask for them by name, or add "band" to synthetic_aggregations to get both
+// in plain queries.
+
+const (
+	bandUpperName = "bandUpper"
+	bandLowerName = "bandLower"
+	bandKey       = "band"
+)
+
+// meanStddev returns the mean and population standard deviation of vals.
+func meanStddev(vals []float64) (mean, stddev float64) {
+	for _, v := range vals {
+		mean += v
+	}
+	mean /= float64(len(vals))
+	variance := 0.0
+	for _, v := range vals {
+		variance += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(vals)))
+}
+
+// bandAggregations builds the upper and lower band for a width in standard
+// deviations.
+func bandAggregations(stddevs float64) []aggregation {
+	return []aggregation{
+		{key: bandKey, name: bandUpperName, reduce: func(vals []float64) float64 {
+			mean, sd := meanStddev(vals)
+			return mean + stddevs*sd
+		}},
+		{key: bandKey, name: bandLowerName, reduce: func(vals []float64) float64 {
+			mean, sd := meanStddev(vals)
+			return mean - stddevs*sd
+		}},
+	}
+}
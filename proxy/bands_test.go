@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"math"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestBands(t *testing.T) {
+	var in []model.Series
+	// Past weeks 2, 4, 4, 6: mean 4, population stddev sqrt(2).
+	for i, v := range []float64{100, 2, 4, 4, 6} {
+		in = append(in, model.Series{
+			Labels: map[string]string{"__name__": "up", "chrono_timeframe": proxyTimeframes()[i]},
+			Points: []model.Point{{T: 120, V: v}},
+		})
+	}
+	aggs, err := aggregationsByKey([]string{"band"}, 1.5)
+	if err != nil || len(aggs) != 2 {
+		t.Fatalf("got %+v, %v", aggs, err)
+	}
+	want := map[string]float64{bandUpperName: 4 + 1.5*math.Sqrt(2), bandLowerName: 4 - 1.5*math.Sqrt(2)}
+	for _, agg := range aggs {
+		out := buildLastMonthAggregate(in, true, minuteGrid, agg)
+		if len(out) != 1 || out[0].Labels["chrono_timeframe"] != agg.name || math.Abs(out[0].Points[0].V-want[agg.name]) > 1e-9 {
+			t.Errorf("%s = %+v; want %v", agg.name, out, want[agg.name])
+		}
+	}
+
+	config := DefaultConfig
+	config.BandStddevs = 0
+	if err := config.Validate(); err == nil {
+		t.Error("expected band_stddevs 0 to fail validation")
+	}
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Benchmarks for the synthetic pipeline, run with `make bench`.
+// They read the fixture sets written by `make fixtures` (falling back to
+// generating them in memory) so numbers are comparable between runs.
+
+var benchFixtures = flag.String("fixtures", "testdata/bench", "directory holding benchmark fixture sets")
+
+var benchSizes = []int{100, 1000, 10000}
+
+// fixtureServer serves a fixture set from a fake Prometheus.
+func fixtureServer(b *testing.B, set *fixtures.Set) *fixtures.FakePrometheus {
+	b.Helper()
+	fake := fixtures.NewFakePrometheus()
+	fake.ServeSet(set)
+	b.Cleanup(fake.Close)
+	return fake
+}
+
+func loadBenchSet(b *testing.B, kind string, n int) *fixtures.Set {
+	b.Helper()
+	for _, spec := range fixtures.StandardSpecs() {
+		if spec.Name == fmt.Sprintf("%s_%d", kind, n) {
+			set, err := fixtures.LoadOrGenerate(*benchFixtures, spec)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return set
+		}
+	}
+	b.Fatalf("no standard fixture %s_%d", kind, n)
+	return nil
+}
+
+func benchParams(spec fixtures.Spec) url.Values {
+	params := url.Values{"query": {"http_requests_total"}}
+	if spec.Instant {
+		params.Set("time", fmt.Sprint(spec.End))
+	} else {
+		params.Set("start", fmt.Sprint(spec.End-int64(spec.Points-1)*spec.Step))
+		params.Set("end", fmt.Sprint(spec.End))
+		params.Set("step", fmt.Sprint(spec.Step))
+	}
+	return params
+}
+
+// decodedSeries runs the fetch stage once and caches the result, so the
+// later stages are benchmarked on exactly what they'd see in production.
+var (
+	decodedMu    sync.Mutex
+	decodedCache = map[string][]model.Series{}
+)
+
+func decodedSeries(b *testing.B, n int) []model.Series {
+	b.Helper()
+	key := fmt.Sprint(n)
+	decodedMu.Lock()
+	defer decodedMu.Unlock()
+	if all, ok := decodedCache[key]; ok {
+		return all
+	}
+	set := loadBenchSet(b, "range", n)
+	srv := fixtureServer(b, set)
+	p := NewChronoProxy()
+	all, _ := fetchWindowsRange(context.Background(), p, p.windows(), benchParams(set.Manifest.Spec), srv.URL+"/api/v1/query_range", "")
+	decodedCache[key] = all
+	return all
+}
+
+func BenchmarkFetchDecode(b *testing.B) {
+	for _, kind := range []string{"instant", "range"} {
+		for _, n := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%d", kind, n), func(b *testing.B) {
+				set := loadBenchSet(b, kind, n)
+				srv := fixtureServer(b, set)
+				p := NewChronoProxy()
+				spec := set.Manifest.Spec
+				fetch, path := fetchWindowsRange, "/api/v1/query_range"
+				if spec.Instant {
+					fetch, path = fetchWindowsInstant, "/api/v1/query"
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					fetch(context.Background(), p, p.windows(), benchParams(spec), srv.URL+path, "")
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkIndexBySignature(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			all := decodedSeries(b, n)
+			avg := buildLastMonthAverage(all, true)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				indexBySignature(all, avg)
+			}
+		})
+	}
+}
+
+func BenchmarkLastMonthAverage(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			all := decodedSeries(b, n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buildLastMonthAverage(all, true)
+			}
+		})
+	}
+}
+
+func BenchmarkCompare(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			all := decodedSeries(b, n)
+			curMap, avgMap := indexBySignature(all, buildLastMonthAverage(all, true))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				appendCompare(nil, curMap, avgMap, "", true)
+				appendPercent(nil, curMap, avgMap, "", true)
+			}
+		})
+	}
+}
+
+// discardWriter is a ResponseWriter that throws the body away, so we time
+// encoding rather than buffer growth.
+type discardWriter struct{ h http.Header }
+
+func (d *discardWriter) Header() http.Header         { return d.h }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+func BenchmarkSerialize(b *testing.B) {
+	for _, n := range benchSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			all := decodedSeries(b, n)
+			w := &discardWriter{h: http.Header{}}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writeJSON(w, "matrix", all)
+			}
+		})
+	}
+}
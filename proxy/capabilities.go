@@ -0,0 +1,332 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/capabilities.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capability probing - who are we actually talking to? 🔎
+//
+// "Prometheus-compatible" covers a lot of ground. Thanos and VictoriaMetrics
+// both answer the query API, but each has parameters the others don't know
+// and endpoints the others don't have. With probe_upstreams on, the first
+// request to each upstream asks it a few questions first:
+//
+//   - /api/v1/stores answers?               → Thanos
+//   - /api/v1/status/active_queries answers? → VictoriaMetrics
+//   - /api/v1/status/buildinfo answers?     → Prometheus, and which version
+//
+// and works out whether it does native histograms and exemplars. We then:
+//
+//   - drop query parameters meant for one flavour before they reach another
+//     (dedup and partial_response are Thanos', nocache and extra_label are
+//     VictoriaMetrics')
+//   - answer /api/v1/query_exemplars with an empty list ourselves when the
+//     upstream has no exemplar API, instead of passing on its 404 (see
+//     exemplars.go)
+//
+// The answers are kept for probe_interval; an upstream we couldn't make
+// sense of is asked again after a minute, and meanwhile is treated like
+// it always was - everything passed through untouched. What we found is at
+// /api/v1/chrono/admin/capabilities.
+//
+// Probing can't tell a Mimir from a Prometheus, and some backends won't
+// answer the questions at all, so a registered upstream can just say what
+// it is, and which parameters every window fetch should carry:
+//
+//   upstreams:
+//     - name: global
+//       url: http://thanos-query:9090
+//       flavor: thanos              # prometheus, thanos, mimir, victoriametrics
+//       params: {partial_response: "false"}
+//
+// A configured flavour is never probed. On top of the params, each flavour
+// brings its own defaults (flavorDefaults) - Thanos only serves raw data
+// unless told otherwise, and four weeks back that's often been downsampled
+// away, so it gets max_source_resolution=auto. Whatever the client sent
+// itself always wins.
+
+const (
+	flavorPrometheus      = "prometheus"
+	flavorThanos          = "thanos"
+	flavorVictoriaMetrics = "victoriametrics"
+	flavorMimir           = "mimir"
+	flavorUnknown         = "unknown"
+
+	probeTimeout       = 5 * time.Second // for all of one upstream's probes together
+	probeRetryInterval = time.Minute     // before asking an unknown upstream again
+)
+
+// flavorParams are the query parameters only one flavour understands.
+var flavorParams = map[string][]string{
+	flavorThanos:          {"dedup", "partial_response", "max_source_resolution", "replicaLabels[]", "engine", "analyze"},
+	flavorVictoriaMetrics: {"nocache", "extra_label", "extra_filters[]", "latency_offset", "round_digits"},
+}
+
+// flavorDefaults are the parameters each flavour's window fetches get
+// unless the client or the upstream's params say otherwise.
+var flavorDefaults = map[string]url.Values{
+	flavorThanos: {"max_source_resolution": {"auto"}},
+}
+
+// configuredCapabilities is what an upstream that says it's flavor can do.
+var configuredCapabilities = map[string]capabilities{
+	flavorPrometheus:      {Flavor: flavorPrometheus, NativeHistograms: true, Exemplars: true},
+	flavorThanos:          {Flavor: flavorThanos, NativeHistograms: true, Exemplars: true},
+	flavorMimir:           {Flavor: flavorMimir, NativeHistograms: true, Exemplars: true},
+	flavorVictoriaMetrics: {Flavor: flavorVictoriaMetrics},
+}
+
+// capabilities is what probing found out about one upstream.
+type capabilities struct {
+	Flavor           string    `json:"flavor"`
+	Version          string    `json:"version,omitempty"`
+	NativeHistograms bool      `json:"native_histograms"`
+	Exemplars        bool      `json:"exemplars"`
+	Configured       bool      `json:"configured,omitempty"` // from the upstream's flavor, not probed
+	ProbedAt         time.Time `json:"probed_at"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// known is whether we can adapt to it at all.
+func (c *capabilities) known() bool {
+	return c != nil && c.Flavor != flavorUnknown
+}
+
+// adaptParams drops the parameters meant for some other flavour. Does
+// nothing for an unknown upstream.
+func (c *capabilities) adaptParams(params url.Values) {
+	if !c.known() {
+		return
+	}
+	for flavor, names := range flavorParams {
+		if flavor == c.Flavor {
+			continue
+		}
+		for _, name := range names {
+			params.Del(name)
+		}
+	}
+}
+
+// capabilityCache remembers each upstream's capabilities by name.
+type capabilityCache struct {
+	mu      sync.Mutex
+	entries map[string]*capabilityEntry
+}
+
+type capabilityEntry struct {
+	mu   sync.Mutex // held while probing, so one request probes and the rest wait
+	caps *capabilities
+}
+
+func newCapabilityCache() *capabilityCache {
+	return &capabilityCache{entries: make(map[string]*capabilityEntry)}
+}
+
+func (c *capabilityCache) entry(name string) *capabilityEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		e = &capabilityEntry{}
+		c.entries[name] = e
+	}
+	return e
+}
+
+// snapshot is every upstream probed so far, by name.
+func (c *capabilityCache) snapshot() map[string]capabilities {
+	c.mu.Lock()
+	entries := make(map[string]*capabilityEntry, len(c.entries))
+	for name, e := range c.entries {
+		entries[name] = e
+	}
+	c.mu.Unlock()
+
+	out := make(map[string]capabilities, len(entries))
+	for name, e := range entries {
+		e.mu.Lock()
+		if e.caps != nil {
+			out[name] = *e.caps
+		}
+		e.mu.Unlock()
+	}
+	return out
+}
+
+// capabilitiesFor returns what the request's upstream can do, probing it
+// first if we haven't lately. nil when probing is off, unless the upstream
+// has a configured flavor. ctx must carry the upstream (see withUpstream)
+// so probes go out with its credentials.
+func (p *ChronoProxy) capabilitiesFor(ctx context.Context, name, base string) *capabilities {
+	u := upstreamFrom(ctx)
+	configured := u != nil && u.flavor != ""
+	if !p.config.ProbeUpstreams && !configured {
+		return nil
+	}
+	e := p.caps.entry(name)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := p.clock.Now()
+	if configured {
+		if e.caps == nil {
+			caps := configuredCapabilities[u.flavor]
+			caps.Configured, caps.ProbedAt = true, now
+			e.caps = &caps
+		}
+		return e.caps
+	}
+	if e.caps != nil {
+		ttl := p.config.ProbeInterval
+		if !e.caps.known() {
+			ttl = probeRetryInterval
+		}
+		if ttl <= 0 || now.Sub(e.caps.ProbedAt) < ttl {
+			return e.caps
+		}
+	}
+
+	// The client hanging up shouldn't leave us with a half-finished probe.
+	probeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), probeTimeout)
+	defer cancel()
+	caps := p.probeCapabilities(probeCtx, base)
+	caps.ProbedAt = now
+	e.caps = &caps
+	log.Printf("🔎 Upstream %s is %s %s (native histograms: %t, exemplars: %t)", name, caps.Flavor, caps.Version, caps.NativeHistograms, caps.Exemplars)
+	return e.caps
+}
+
+// withParams adds u's params, and its flavour's defaults, to the window
+// fetch at raw - each only where the query doesn't set it already.
+func (u *upstream) withParams(raw string) string {
+	if u == nil || (len(u.params) == 0 && flavorDefaults[u.flavor] == nil) {
+		return raw
+	}
+	path, query, _ := strings.Cut(raw, "?")
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return raw
+	}
+	for _, extra := range []url.Values{u.params, flavorDefaults[u.flavor]} {
+		for name, values := range extra {
+			if _, set := q[name]; !set {
+				q[name] = values
+			}
+		}
+	}
+	return path + "?" + buildQueryString(q)
+}
+
+// probeCapabilities asks base what it is.
+func (p *ChronoProxy) probeCapabilities(ctx context.Context, base string) capabilities {
+	var build struct {
+		Data struct {
+			Version string `json:"version"`
+		} `json:"data"`
+	}
+	buildErr := p.probeJSON(ctx, base+"/api/v1/status/buildinfo", &build)
+	version := build.Data.Version
+
+	if p.probeJSON(ctx, base+"/api/v1/stores", nil) == nil {
+		// Thanos 0.32 learnt native histograms; its exemplar API is older than that.
+		return capabilities{Flavor: flavorThanos, Version: version, NativeHistograms: versionAtLeast(version, 0, 32), Exemplars: true}
+	}
+	if p.probeJSON(ctx, base+"/api/v1/status/active_queries", nil) == nil {
+		// VictoriaMetrics reports a made-up Prometheus version, so don't repeat it.
+		return capabilities{Flavor: flavorVictoriaMetrics}
+	}
+	if buildErr == nil && version != "" {
+		return capabilities{
+			Flavor:           flavorPrometheus,
+			Version:          version,
+			NativeHistograms: versionAtLeast(version, 2, 40),
+			Exemplars:        versionAtLeast(version, 2, 26),
+		}
+	}
+	caps := capabilities{Flavor: flavorUnknown}
+	if buildErr != nil {
+		caps.Error = buildErr.Error()
+	}
+	return caps
+}
+
+// probeJSON GETs u and decodes a 200 answer into v (nil = just check it's
+// JSON). Anything else is an error.
+func (p *ChronoProxy) probeJSON(ctx context.Context, u string, v interface{}) error {
+	resp, err := p.getUpstream(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		return fmt.Errorf("%s answered %s", u, resp.Status)
+	}
+	if v == nil {
+		var discard json.RawMessage
+		v = &discard
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(v)
+}
+
+// versionAtLeast compares a "2.45.0"-style version. Unparseable versions
+// are assumed to be old.
+func versionAtLeast(version string, major, minor int) bool {
+	var gotMajor, gotMinor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &gotMajor, &gotMinor); err != nil {
+		return false
+	}
+	return gotMajor > major || (gotMajor == major && gotMinor >= minor)
+}
+
+// capabilitiesKey carries the request's upstream capabilities.
+type capabilitiesKey struct{}
+
+func withCapabilities(ctx context.Context, c *capabilities) context.Context {
+	return context.WithValue(ctx, capabilitiesKey{}, c)
+}
+
+// capabilitiesFrom is nil when probing is off or nothing was probed.
+func capabilitiesFrom(ctx context.Context) *capabilities {
+	c, _ := ctx.Value(capabilitiesKey{}).(*capabilities)
+	return c
+}
+
+// handleAdminCapabilities lists what each upstream turned out to be.
+func (p *ChronoProxy) handleAdminCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data":   p.caps.snapshot(),
+	})
+}
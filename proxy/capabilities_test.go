@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeFlavor answers like a Prometheus, Thanos or VictoriaMetrics would,
+// and remembers what it was asked.
+type fakeFlavor struct {
+	mu       sync.Mutex
+	flavor   string
+	version  string
+	requests []*http.Request
+}
+
+func (f *fakeFlavor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/api/v1/status/buildinfo":
+		w.Write([]byte(`{"status":"success","data":{"version":"` + f.version + `"}}`))
+	case r.URL.Path == "/api/v1/stores" && f.flavor == flavorThanos:
+		w.Write([]byte(`{"status":"success","data":{}}`))
+	case r.URL.Path == "/api/v1/status/active_queries" && f.flavor == flavorVictoriaMetrics:
+		w.Write([]byte(`{"status":"ok","data":[]}`))
+	case r.URL.Path == "/api/v1/query":
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeFlavor) asked(path string) []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []*http.Request
+	for _, r := range f.requests {
+		if r.URL.Path == path {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func TestCapabilityProbing(t *testing.T) {
+	cases := []struct {
+		flavor, version  string
+		want             capabilities
+		keeps, drops     string // query params that should / shouldn't reach the upstream
+		answersExemplars bool   // we answer query_exemplars ourselves
+	}{
+		{flavorPrometheus, "2.45.0", capabilities{Flavor: flavorPrometheus, Version: "2.45.0", NativeHistograms: true, Exemplars: true}, "", "dedup", false},
+		{flavorPrometheus, "2.20.1", capabilities{Flavor: flavorPrometheus, Version: "2.20.1"}, "", "nocache", true},
+		{flavorThanos, "0.34.1", capabilities{Flavor: flavorThanos, Version: "0.34.1", NativeHistograms: true, Exemplars: true}, "dedup", "nocache", false},
+		{flavorVictoriaMetrics, "2.24.0", capabilities{Flavor: flavorVictoriaMetrics}, "nocache", "dedup", true},
+		{"", "", capabilities{Flavor: flavorUnknown}, "dedup", "", false},
+	}
+	for _, tc := range cases {
+		fake := &fakeFlavor{flavor: tc.flavor, version: tc.version}
+		srv := httptest.NewServer(fake)
+		prefix := "/" + strings.Replace(strings.TrimPrefix(srv.URL, "http://"), ":", "_", 1)
+
+		config := DefaultConfig
+		config.ProbeUpstreams = true
+		p := NewChronoProxyWithConfig(config)
+		for i := 0; i < 2; i++ {
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", prefix+"/api/v1/query?query=up&dedup=true&nocache=1", nil))
+		}
+
+		got := p.caps.snapshot()[strings.TrimPrefix(prefix, "/")]
+		got.ProbedAt, got.Error = tc.want.ProbedAt, ""
+		if got != tc.want {
+			t.Errorf("%s %s: capabilities = %+v, want %+v", tc.flavor, tc.version, got, tc.want)
+		}
+		if n := len(fake.asked("/api/v1/status/buildinfo")); n != 1 {
+			t.Errorf("%s: probed %d times, want once", tc.flavor, n)
+		}
+		for _, r := range fake.asked("/api/v1/query") {
+			if tc.keeps != "" && r.Form.Get(tc.keeps) == "" {
+				t.Errorf("%s: %s should have been passed on", tc.flavor, tc.keeps)
+			}
+			if tc.drops != "" && r.Form.Get(tc.drops) != "" {
+				t.Errorf("%s: %s should have been dropped", tc.flavor, tc.drops)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query_exemplars?query=up", nil))
+		answered := len(fake.asked("/api/v1/query_exemplars")) == 0
+		if answered != tc.answersExemplars {
+			t.Errorf("%s %s: answered query_exemplars ourselves = %v", tc.flavor, tc.version, answered)
+		}
+		if answered && strings.TrimSpace(w.Body.String()) != `{"data":[],"status":"success"}` {
+			t.Errorf("%s: query_exemplars = %s", tc.flavor, w.Body.String())
+		}
+		srv.Close()
+	}
+}
+
+func TestAdminCapabilities(t *testing.T) {
+	fake := &fakeFlavor{flavor: flavorThanos, version: "0.30.0"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	config := DefaultConfig
+	config.ProbeUpstreams = true
+	config.Upstreams = []UpstreamConfig{{Name: "global", URL: srv.URL}}
+	p := NewChronoProxyWithConfig(config)
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/global/api/v1/query?query=up", nil))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/chrono/admin/capabilities", nil))
+	var resp struct {
+		Data map[string]capabilities `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	if got := resp.Data["global"]; got.Flavor != flavorThanos || got.NativeHistograms {
+		t.Errorf("global = %+v", got)
+	}
+}
+
+func TestProbingOffByDefault(t *testing.T) {
+	fake := &fakeFlavor{flavor: flavorPrometheus, version: "2.45.0"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(srv.URL, "http://"), ":", "_", 1)
+
+	p := NewChronoProxyWithConfig(DefaultConfig)
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", prefix+"/api/v1/query?query=up", nil))
+	if n := len(fake.asked("/api/v1/status/buildinfo")); n != 0 {
+		t.Errorf("probed %d times with probe_upstreams off", n)
+	}
+}
+
+func TestConfiguredFlavorAndParams(t *testing.T) {
+	thanos := &fakeFlavor{flavor: flavorThanos, version: "0.34.1"}
+	srv := httptest.NewServer(thanos)
+	defer srv.Close()
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "global", URL: srv.URL, Flavor: flavorMimir, Params: map[string]string{"dedup": "false", "engine": "thanos"}}}
+	p := NewChronoProxyWithConfig(config)
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", `/global/api/v1/query?query=up{chrono_timeframe="current"}&nocache=1&dedup=true`, nil))
+
+	if n := len(thanos.asked("/api/v1/status/buildinfo")); n != 0 {
+		t.Errorf("a configured flavor shouldn't be probed, asked %d times", n)
+	}
+	asked := thanos.asked("/api/v1/query")
+	if len(asked) != 1 {
+		t.Fatalf("%d queries upstream", len(asked))
+	}
+	// Mimir knows neither nocache nor dedup, so the client's are dropped -
+	// but params from the config go out regardless
+	if got := asked[0].Form; got.Get("nocache") != "" || got.Get("dedup") != "false" || got.Get("engine") != "thanos" {
+		t.Errorf("upstream got %v", got)
+	}
+	if got := p.caps.snapshot()["global"]; got.Flavor != flavorMimir || !got.Configured {
+		t.Errorf("capabilities = %+v", got)
+	}
+
+	config.Upstreams = []UpstreamConfig{{Name: "global", URL: srv.URL, Flavor: flavorThanos}}
+	p = NewChronoProxyWithConfig(config)
+	for _, q := range []string{"", "&max_source_resolution=5m"} {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", `/global/api/v1/query?query=up{chrono_timeframe="current"}`+q, nil))
+	}
+	asked = thanos.asked("/api/v1/query")[1:]
+	if len(asked) != 2 || asked[0].Form.Get("max_source_resolution") != "auto" || asked[1].Form.Get("max_source_resolution") != "5m" {
+		t.Errorf("thanos should default to max_source_resolution=auto, unless the client picks one")
+	}
+}
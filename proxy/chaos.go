@@ -0,0 +1,191 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/chaos.go
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Chaos mode - breaking things on purpose, so they break properly later 🐒
+//
+// Stale failover, partial windows, "warnings" and 503s are all written for
+// bad days, which means they hardly ever run. With chaos: true, a share of
+// upstream fetches can be made to misbehave on demand:
+//
+//   - latency: the fetch waits chaos_latency first (timeouts still apply,
+//     so a big enough delay is a timeout)
+//   - error: the fetch fails as if the connection was refused
+//   - truncate: the upstream's answer is cut off halfway
+//
+// Each is a percentage of fetches, rolled separately. The percentages can
+// be changed while running with PUT /api/v1/chrono/admin/chaos, but only
+// when chaos is on in the config - a production proxy can't be talked into
+// it. Faults are counted in chronotheus_chaos_faults_total.
+
+// ChaosSettings is what the admin endpoint shows and accepts.
+type ChaosSettings struct {
+	Latency         time.Duration `json:"latency"`          // Nanoseconds, like any Go duration in JSON
+	LatencyPercent  float64       `json:"latency_percent"`  // Fetches delayed
+	ErrorPercent    float64       `json:"error_percent"`    // Fetches failed outright
+	TruncatePercent float64       `json:"truncate_percent"` // Fetches whose body is cut short
+}
+
+func (s ChaosSettings) validate() error {
+	for name, pct := range map[string]float64{"latency": s.LatencyPercent, "error": s.ErrorPercent, "truncate": s.TruncatePercent} {
+		if pct < 0 || pct > 100 {
+			return fmt.Errorf("chaos %s percent must be between 0 and 100, got %v", name, pct)
+		}
+	}
+	if s.Latency < 0 {
+		return fmt.Errorf("chaos latency can't be negative, got %v", s.Latency)
+	}
+	return nil
+}
+
+// errChaos is the injected failure, so nobody mistakes it for a real one.
+var errChaos = errors.New("chaos: injected upstream failure")
+
+// chaos holds the live settings. A nil *chaos injects nothing.
+type chaos struct {
+	mu       sync.Mutex
+	settings ChaosSettings
+	faults   *counterVec
+}
+
+// newChaos returns nil unless chaos is switched on.
+func newChaos(config Config) *chaos {
+	if !config.Chaos {
+		return nil
+	}
+	log.Printf("🐒 chaos mode is on - upstream fetches will fail on purpose")
+	return &chaos{
+		settings: ChaosSettings{
+			Latency:         config.ChaosLatency,
+			LatencyPercent:  config.ChaosLatencyPercent,
+			ErrorPercent:    config.ChaosErrorPercent,
+			TruncatePercent: config.ChaosTruncatePercent,
+		},
+		faults: newCounterVec("kind"),
+	}
+}
+
+func (c *chaos) get() ChaosSettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings
+}
+
+func (c *chaos) set(s ChaosSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settings = s
+}
+
+// snapshot is the fault counters, for /metrics. Safe on nil.
+func (c *chaos) snapshot() []CounterSnapshot {
+	if c == nil {
+		return nil
+	}
+	return c.faults.snapshot()
+}
+
+// do is client.Do with whatever faults the dice call for.
+func (c *chaos) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if c == nil {
+		return client.Do(req)
+	}
+	s := c.get()
+	if s.Latency > 0 && roll(s.LatencyPercent) {
+		c.faults.inc("latency")
+		if err := sleepCtx(req.Context(), s.Latency); err != nil {
+			return nil, err
+		}
+	}
+	if roll(s.ErrorPercent) {
+		c.faults.inc("error")
+		return nil, errChaos
+	}
+	resp, err := client.Do(req)
+	if err != nil || !roll(s.TruncatePercent) {
+		return resp, err
+	}
+	c.faults.inc("truncate")
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body[:len(body)/2]))
+	resp.ContentLength = -1
+	return resp, nil
+}
+
+func roll(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleAdminChaos shows the chaos settings (GET) or replaces them (PUT).
+func (p *ChronoProxy) handleAdminChaos(w http.ResponseWriter, r *http.Request) {
+	if p.chaos == nil {
+		writeJSONError(w, http.StatusForbidden, "bad_data", "chaos mode is off; set chaos: true in the config to use it")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var s ChaosSettings
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_data", "invalid settings: "+err.Error())
+			return
+		}
+		if err := s.validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		p.chaos.set(s)
+		log.Printf("🐒 chaos settings now %+v", s)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data":   p.chaos.get(),
+	})
+}
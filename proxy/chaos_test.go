@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestChaosInjectsFaults(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.Chaos = true
+	config.ChaosErrorPercent = 100
+	config.AdminWrites = true
+	config.ListenAuth.BearerTokens = []string{"admin"}
+	p := NewChronoProxyWithConfig(config)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer admin")
+		p.ServeHTTP(w, r)
+	}
+
+	query := func() string {
+		w := httptest.NewRecorder()
+		q := url.QueryEscape(`up{chrono_timeframe="current"}`)
+		serve(w, httptest.NewRequest("GET", prefix+"/api/v1/query?query="+q, nil))
+		return w.Body.String()
+	}
+	admin := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serve(w, httptest.NewRequest(method, chronoAdminPrefix+"chaos", strings.NewReader(body)))
+		return w
+	}
+
+	if body := query(); strings.Contains(body, `"up"`) {
+		t.Errorf("every fetch should fail, got %s", body)
+	}
+	if calls := len(fake.Requests()); calls != 0 {
+		t.Errorf("an injected error shouldn't reach the upstream, %d calls", calls)
+	}
+
+	if w := admin("PUT", `{"truncate_percent": 100}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body.String())
+	}
+	if body := query(); strings.Contains(body, `"up"`) || len(fake.Requests()) == 0 {
+		t.Errorf("a truncated answer should be dropped, got %s", body)
+	}
+	if w := admin("PUT", `{"error_percent": 150}`); w.Code != http.StatusBadRequest {
+		t.Errorf("150%%: status %d", w.Code)
+	}
+	if w := admin("PUT", `{}`); w.Code != http.StatusOK || !strings.Contains(query(), `"up"`) {
+		t.Error("with everything at 0 the fetch should go through")
+	}
+
+	w := httptest.NewRecorder()
+	serve(w, httptest.NewRequest("GET", metricsPath, nil))
+	for _, kind := range []string{"error", "truncate"} {
+		if !strings.Contains(w.Body.String(), `chronotheus_chaos_faults_total{kind="`+kind+`"} 1`) {
+			t.Errorf("no %s fault counted:\n%s", kind, w.Body.String())
+		}
+	}
+
+	config.Chaos = false
+	p = NewChronoProxyWithConfig(config)
+	if w := admin("PUT", `{"error_percent": 100}`); w.Code != http.StatusForbidden {
+		t.Errorf("chaos off: status %d, want 403", w.Code)
+	}
+}
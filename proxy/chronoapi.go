@@ -0,0 +1,182 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/chronoapi.go
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// The chrono API - everything that's ours rather than Prometheus' lives
+// under /api/<version>/chrono/, so it can change without treading on
+// Prometheus-compatible paths (and Prometheus can grow new ones without
+// treading on us).
+//
+//   /<upstream>/api/v1/chrono/timeframes   what windows and synthetics exist
+//   /<upstream>/api/v1/chrono/label-values many labels' values in one call
+//   /<upstream>/api/v1/chrono/heatmap      deviation from the baseline, counted into a grid
+//   /<upstream>/api/v1/chrono/template/... query and query_range with Grafana $variables
+//   /<upstream>/api/v1/chrono/lint         common mistakes in a query, without running it
+//   /<upstream>/api/v1/chrono/rules        alerting rules on a metric's baseline, as YAML
+//   /<upstream>/api/v1/chrono/jobs/...     background evaluation
+//   /api/v1/chrono/admin/...               about Chronotheus itself, no upstream
+//
+// Anything under /api/*/chrono/ is answered here and never forwarded, so a
+// typo gets a 404 from us instead of a confusing one from Prometheus. The
+// old /admin/... paths still work but carry a Deprecation header pointing
+// at their new home.
+//
+// Versions live in the path. Clients that want to be sure what they're
+// getting can also say so in Accept:
+//
+//   Accept: application/vnd.chronotheus.v1+json
+//
+// gets the same JSON back labelled with that media type; asking only for a
+// version we don't speak is a 406. Every response says which version
+// answered in Chronotheus-Api-Version.
+
+const (
+	chronoAPIVersion   = "v1"
+	chronoAPIPrefix    = "/api/" + chronoAPIVersion + "/chrono"
+	chronoAdminPrefix  = chronoAPIPrefix + "/" + adminPrefix + "/"
+	chronoVersionHdr   = "Chronotheus-Api-Version"
+	chronoMediaPattern = "application/vnd.chronotheus.%s+json"
+)
+
+// chronoPathRegex spots the namespace whatever the version.
+var chronoPathRegex = regexp.MustCompile(`^/api/(v[0-9]+)/chrono(/|$)`)
+
+// chronoMediaRegex picks the version out of a vendor media type.
+var chronoMediaRegex = regexp.MustCompile(`^application/vnd\.chronotheus\.(v[0-9]+)\+json$`)
+
+// isChronoPath says whether path belongs to the chrono API.
+func isChronoPath(path string) bool {
+	return chronoPathRegex.MatchString(path)
+}
+
+// negotiateChrono checks the path version and Accept header. It answers the
+// request itself (and returns nil) when we can't serve it; otherwise it
+// returns the writer to respond through.
+func negotiateChrono(w http.ResponseWriter, r *http.Request, path string) http.ResponseWriter {
+	if m := chronoPathRegex.FindStringSubmatch(path); m != nil && m[1] != chronoAPIVersion {
+		writeJSONError(w, http.StatusNotFound, "not_found",
+			fmt.Sprintf("chrono API %s doesn't exist, this proxy speaks %s", m[1], chronoAPIVersion))
+		return nil
+	}
+	vendor, other := false, false
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if m := chronoMediaRegex.FindStringSubmatch(mediaType); m != nil {
+			vendor = vendor || m[1] == chronoAPIVersion
+			continue
+		}
+		other = true // plain JSON, */*, or something we'll answer anyway
+	}
+	if strings.TrimSpace(r.Header.Get("Accept")) != "" && !vendor && !other {
+		writeJSONError(w, http.StatusNotAcceptable, "not_acceptable",
+			fmt.Sprintf("this proxy speaks "+chronoMediaPattern, chronoAPIVersion))
+		return nil
+	}
+	w.Header().Set(chronoVersionHdr, chronoAPIVersion)
+	if vendor {
+		return &vendorTypeWriter{ResponseWriter: w}
+	}
+	return w
+}
+
+// vendorTypeWriter relabels plain JSON responses with our versioned media
+// type, so handlers don't need to know who asked.
+type vendorTypeWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *vendorTypeWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.Header().Get("Content-Type") == "application/json" {
+			w.Header().Set("Content-Type", fmt.Sprintf(chronoMediaPattern, chronoAPIVersion))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *vendorTypeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming endpoints (job progress) streaming.
+func (w *vendorTypeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController find the real writer.
+func (w *vendorTypeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// handleChronoAPI routes the per-upstream part of the namespace.
+func (p *ChronoProxy) handleChronoAPI(w http.ResponseWriter, r *http.Request, upstream, suffix string) {
+	if w = negotiateChrono(w, r, suffix); w == nil {
+		return
+	}
+	switch {
+	case suffix == timeframesPath:
+		p.handleTimeframes(w, r)
+	case suffix == labelValuesPath:
+		p.handleBulkLabelValues(w, r, upstream)
+	case suffix == heatmapPath:
+		p.handleHeatmap(w, r, upstream)
+	case suffix == lintPath:
+		p.handleLint(w, r)
+	case suffix == chronoRulesPath:
+		p.handleChronoRules(w, r)
+	case strings.HasPrefix(suffix, templatePath):
+		p.handleTemplate(w, r, upstream, suffix)
+	case strings.HasPrefix(suffix, jobsPath):
+		p.handleJobs(w, r, upstream, suffix)
+	case strings.HasPrefix(suffix, chronoAdminPrefix):
+		writeJSONError(w, http.StatusNotFound, "not_found", "admin endpoints live at "+chronoAdminPrefix+" with no upstream prefix")
+	default:
+		writeJSONError(w, http.StatusNotFound, "not_found", "unknown chrono API endpoint")
+	}
+}
+
+// handleChronoAdmin serves /api/v1/chrono/admin/...
+func (p *ChronoProxy) handleChronoAdmin(w http.ResponseWriter, r *http.Request) {
+	if w = negotiateChrono(w, r, r.URL.Path); w == nil {
+		return
+	}
+	p.handleAdmin(w, r, strings.TrimPrefix(r.URL.Path, chronoAdminPrefix))
+}
+
+// handleLegacyAdmin serves the old /admin/... paths, pointing at the new ones.
+func (p *ChronoProxy) handleLegacyAdmin(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/"+adminPrefix+"/")
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", "<"+chronoAdminPrefix+name+`>; rel="successor-version"`)
+	p.handleAdmin(w, r, name)
+}
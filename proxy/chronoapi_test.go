@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestChronoAdminPaths(t *testing.T) {
+	p := NewChronoProxyWithConfig(DefaultConfig)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/chrono/admin/config", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Chronotheus-Api-Version") != "v1" {
+		t.Errorf("new path: code=%d headers=%v", w.Code, w.Header())
+	}
+	if w.Header().Get("Deprecation") != "" {
+		t.Error("the new path shouldn't be deprecated")
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/admin/config", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" {
+		t.Errorf("legacy path: code=%d headers=%v", w.Code, w.Header())
+	}
+	if link := w.Header().Get("Link"); link != `</api/v1/chrono/admin/config>; rel="successor-version"` {
+		t.Errorf("Link = %q", link)
+	}
+
+	if _, err := newUpstream(UpstreamConfig{Name: "api", URL: "http://x:9090"}); err == nil {
+		t.Error("expected the api upstream name to be reserved")
+	}
+}
+
+func TestChronoContentNegotiation(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxyWithConfig(DefaultConfig)
+
+	cases := []struct {
+		path, accept string
+		code         int
+		contentType  string
+	}{
+		{"/api/v1/chrono/timeframes", "", http.StatusOK, "application/json"},
+		{"/api/v1/chrono/timeframes", "application/json", http.StatusOK, "application/json"},
+		{"/api/v1/chrono/timeframes", "application/vnd.chronotheus.v1+json", http.StatusOK, "application/vnd.chronotheus.v1+json"},
+		{"/api/v1/chrono/timeframes", "application/vnd.chronotheus.v2+json, application/vnd.chronotheus.v1+json;q=0.5", http.StatusOK, "application/vnd.chronotheus.v1+json"},
+		{"/api/v1/chrono/timeframes", "application/vnd.chronotheus.v2+json", http.StatusNotAcceptable, "application/json"},
+		{"/api/v2/chrono/timeframes", "", http.StatusNotFound, "application/json"},
+		{"/api/v1/chrono/nonsense", "", http.StatusNotFound, "application/json"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", prefix+tc.path, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != tc.code || w.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("%s Accept %q: code=%d type=%q, want %d %q", tc.path, tc.accept, w.Code, w.Header().Get("Content-Type"), tc.code, tc.contentType)
+		}
+	}
+	if reqs := fake.Requests(); len(reqs) != 0 {
+		t.Errorf("chrono API paths reached the upstream: %+v", reqs)
+	}
+}
@@ -0,0 +1,60 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/clock.go
+package proxy
+
+import "time"
+
+// For a time machine we were awfully casual about what time it is.
+// Everything that needs "now" - default query times, cache and job TTLs,
+// request metrics - asks the proxy's Clock instead of calling time.Now()
+// directly. In production that's just the wall clock; in tests it can be
+// frozen at 23:59:59 on the night the clocks go back, and a frozen clock is
+// also how a query can be evaluated "as of" some fixed instant.
+
+// Clock tells the proxy what time it is.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real, ticking wall clock.
+type SystemClock struct{}
+
+// Now returns time.Now().
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// FixedClock is stuck at one instant forever. Handy for tests and for
+// evaluating queries as of a point in time.
+type FixedClock time.Time
+
+// Now returns the fixed instant.
+func (c FixedClock) Now() time.Time { return time.Time(c) }
+
+// SetClock swaps the proxy's clock. Call it before the proxy starts serving.
+func (p *ChronoProxy) SetClock(c Clock) {
+	if c == nil {
+		c = SystemClock{}
+	}
+	p.clock = c
+	p.jobs.now = c.Now
+	p.quotas.now = c.Now
+}
+
+// since is time.Since on the proxy's clock.
+func (p *ChronoProxy) since(t time.Time) time.Duration {
+	return p.clock.Now().Sub(t)
+}
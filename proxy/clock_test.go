@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+// upstreamTimes runs an instant query with no time= through a proxy frozen
+// at now, and returns the evaluation times it asked upstream for, newest
+// first.
+func upstreamTimes(t *testing.T, now time.Time) []time.Time {
+	t.Helper()
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	p := NewChronoProxy()
+	p.SetClock(FixedClock(now))
+	params := url.Values{"query": {"up"}}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?"+params.Encode(), nil))
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	var out []time.Time
+	for _, req := range fake.Requests() {
+		ts, err := strconv.ParseInt(req.Params.Get("time"), 10, 64)
+		if err != nil {
+			t.Fatalf("bad upstream time %q", req.Params.Get("time"))
+		}
+		out = append(out, time.Unix(ts, 0).In(now.Location()))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].After(out[j]) })
+	return out
+}
+
+func TestWindowsFollowTheClock(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows are whole multiples of 24h, not calendar days: across a DST
+	// change the wall-clock hour of the older windows shifts by one.
+	cases := []struct {
+		name string
+		now  time.Time
+		want []string
+	}{
+		{"new year midnight", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), []string{
+			"2024-01-01 00:00", "2023-12-25 00:00", "2023-12-18 00:00", "2023-12-11 00:00", "2023-12-04 00:00",
+		}},
+		{"just before midnight", time.Date(2024, 2, 29, 23, 59, 59, 0, time.UTC), []string{
+			"2024-02-29 23:59", "2024-02-22 23:59", "2024-02-15 23:59", "2024-02-08 23:59", "2024-02-01 23:59",
+		}},
+		{"morning after clocks go back", time.Date(2024, 10, 27, 9, 0, 0, 0, london), []string{
+			"2024-10-27 09:00", "2024-10-20 10:00", "2024-10-13 10:00", "2024-10-06 10:00", "2024-09-29 10:00",
+		}},
+		{"morning after clocks go forward", time.Date(2024, 3, 31, 9, 0, 0, 0, london), []string{
+			"2024-03-31 09:00", "2024-03-24 08:00", "2024-03-17 08:00", "2024-03-10 08:00", "2024-03-03 08:00",
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := upstreamTimes(t, tc.now)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d upstream requests; want %d", len(got), len(tc.want))
+			}
+			for i, at := range got {
+				if s := at.Format("2006-01-02 15:04"); s != tc.want[i] {
+					t.Errorf("window %d at %s; want %s", i, s, tc.want[i])
+				}
+				if d := tc.now.Sub(at); d != time.Duration(i)*7*24*time.Hour {
+					t.Errorf("window %d is %v back; want %dw", i, d, i)
+				}
+			}
+		})
+	}
+}
+
+func TestJobStoreUsesClock(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewChronoProxy()
+	p.SetClock(FixedClock(now))
+	if got := p.since(now.Add(-time.Minute)); got != time.Minute {
+		t.Errorf("since = %v; want 1m", got)
+	}
+	if got := p.jobs.now(); !got.Equal(now) {
+		t.Errorf("job store time = %v; want %v", got, now)
+	}
+}
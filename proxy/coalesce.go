@@ -0,0 +1,196 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/coalesce.go
+package proxy
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Request coalescing - twenty panels, one trip to Prometheus 🚌
+//
+// A dashboard with a templated query repeated across twenty panels asks
+// the same thing twenty times at once, and each of those would fetch every
+// window - a hundred upstream requests for five answers. With
+// coalesce_fetches on (the default), a window fetch that is identical to
+// one already in flight waits for that one instead of making its own.
+//
+// Identical means the same upstream URL with its parameters in any order,
+// the same upstream, the same tenant, the same forwarded client
+// credentials, and the same window and command - everything that decides
+// what comes back, how it's decoded and who may see it. Only fetches running at the same moment are shared; once
+// one finishes, the next identical fetch goes to the upstream again.
+//
+// The shared fetch doesn't belong to any one client: if the request that
+// started it gives up, the others still get their answer. Nor does it run
+// on what that request has left of its response limits (see limits.go) -
+// it gets the same limits with nothing spent, and every request that
+// waited on it is then charged its series, samples and bytes against its
+// own. Warnings it
+// raised (a failed member of a virtual upstream, malformed samples) go to
+// every request that waited on it. chronotheus_coalesced_fetches_total
+// counts the fetches that were saved.
+//
+// Within one request it goes further. Two windows can come down to the
+// very same upstream request - with window_mode: offset, a query with no
+// selectors to put offsets on (vector(1), time()) is the same query for
+// every window - and then only the first is fetched. The others get a copy
+// of its answer, labelled with their own chrono_timeframe. That part is
+// always on, and shows as "reuse" stages in _command="TRACE".
+
+// coalescer shares identical in-flight window fetches. A nil *coalescer
+// (coalesce_fetches off) just fetches.
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+	shared  uint64 // Fetches that waited on someone else's
+}
+
+// flight is one fetch and everyone waiting on it.
+type flight struct {
+	done     chan struct{}
+	series   []model.Series
+	err      error
+	warnings *warningList
+	budget   *responseBudget // The fetch's own, so each waiter can be charged what it read
+	waiters  int             // Besides the one that started it; final once done is closed
+}
+
+func newCoalescer(config Config) *coalescer {
+	if !config.CoalesceFetches {
+		return nil
+	}
+	return &coalescer{flights: make(map[string]*flight)}
+}
+
+// do returns fetch's answer, sharing it with every other call for the same
+// key while it runs. Callers that share get their own copy of the series,
+// so they can change them freely.
+func (c *coalescer) do(ctx context.Context, key string, fetch func(context.Context) ([]model.Series, error)) ([]model.Series, error) {
+	if c == nil {
+		return fetch(ctx)
+	}
+	c.mu.Lock()
+	f, ok := c.flights[key]
+	if ok {
+		f.waiters++
+		c.mu.Unlock()
+		atomic.AddUint64(&c.shared, 1)
+	} else {
+		f = &flight{done: make(chan struct{}), warnings: &warningList{}, budget: budgetFrom(ctx).fresh()}
+		c.flights[key] = f
+		c.mu.Unlock()
+		shared := withBudget(withWarnings(context.WithoutCancel(ctx), f.warnings), f.budget)
+		go c.run(shared, key, f, fetch)
+	}
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	for _, msg := range f.warnings.list() {
+		warningsFrom(ctx).add(msg)
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if err := budgetFrom(ctx).chargeBytes(f.budget.spentBytes()); err != nil {
+		return nil, err
+	}
+	if f.waiters == 0 {
+		return f.series, nil
+	}
+	out := make([]model.Series, len(f.series))
+	for i, s := range f.series {
+		out[i] = s.Clone()
+	}
+	return out, nil
+}
+
+func (c *coalescer) run(ctx context.Context, key string, f *flight, fetch func(context.Context) ([]model.Series, error)) {
+	series, err := fetch(ctx)
+	c.mu.Lock()
+	delete(c.flights, key)
+	f.series, f.err = series, err
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// sharedFetches is safe to call on a nil coalescer.
+func (c *coalescer) sharedFetches() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.shared)
+}
+
+// fetchKey says which window fetches are the same fetch: u with its query
+// parameters sorted, plus whatever else changes the answer or its decoding.
+func fetchKey(ctx context.Context, u string, win window, command string) string {
+	if base, query, ok := strings.Cut(u, "?"); ok {
+		if q, err := url.ParseQuery(query); err == nil {
+			u = base + "?" + q.Encode()
+		}
+	}
+	var b strings.Builder
+	if up := upstreamFrom(ctx); up != nil {
+		b.WriteString(up.name)
+	}
+	for _, part := range []string{tenantFrom(ctx).name(), clientAuthorizationFrom(ctx), win.name, strconv.FormatInt(win.offset, 10), strconv.FormatBool(win.viaOffset), command, u} {
+		b.WriteByte(0)
+		b.WriteString(part)
+	}
+	if win.loc != nil {
+		b.WriteByte(0)
+		b.WriteString(win.loc.String())
+	}
+	return b.String()
+}
+
+// windowAnswers is what each distinct fetch within one request came back
+// with, keyed by sameFetch.
+type windowAnswers map[string][]model.Series
+
+// sameFetch is fetchKey without the window's name, which only labels the
+// answer: windows with equal keys make identical upstream requests.
+func sameFetch(ctx context.Context, u string, as window, command string) string {
+	as.name = ""
+	return fetchKey(ctx, u, as, command)
+}
+
+// reuse returns a copy of an earlier window's answer to the same fetch,
+// labelled as tf.
+func (a windowAnswers) reuse(key, tf string) ([]model.Series, bool) {
+	earlier, ok := a[key]
+	if !ok {
+		return nil, false
+	}
+	out := make([]model.Series, len(earlier))
+	for i, s := range earlier {
+		out[i] = s.Clone()
+		out[i].Labels["chrono_timeframe"] = tf
+	}
+	return out, true
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestCoalescerSharesOneFetch(t *testing.T) {
+	c := newCoalescer(Config{CoalesceFetches: true})
+	gate := make(chan struct{})
+	var fetches int32
+	fetch := func(ctx context.Context) ([]model.Series, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-gate
+		warningsFrom(ctx).add("member b failed")
+		return []model.Series{{Labels: map[string]string{"job": "api"}}}, nil
+	}
+
+	const callers = 5
+	got := make([][]model.Series, callers)
+	warnings := make([]*warningList, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		warnings[i] = &warningList{}
+		go func(i int) {
+			defer wg.Done()
+			got[i], _ = c.do(withWarnings(context.Background(), warnings[i]), "k", fetch)
+		}(i)
+	}
+	for c.sharedFetches() != callers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("%d fetches, want 1", fetches)
+	}
+	got[0][0].Labels["job"] = "changed"
+	for i := 1; i < callers; i++ {
+		if len(got[i]) != 1 || got[i][0].Labels["job"] != "api" {
+			t.Errorf("caller %d got %v", i, got[i])
+		}
+		if w := warnings[i].list(); len(w) != 1 {
+			t.Errorf("caller %d warnings %v", i, w)
+		}
+	}
+
+	// Finished fetches aren't remembered
+	if _, err := c.do(context.Background(), "k", func(context.Context) ([]model.Series, error) { return nil, errors.New("down") }); err == nil {
+		t.Error("expected a fresh fetch after the first finished")
+	}
+}
+
+func TestCoalescerCallerGivesUp(t *testing.T) {
+	c := newCoalescer(Config{CoalesceFetches: true})
+	gate := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := c.do(ctx, "k", func(ctx context.Context) ([]model.Series, error) {
+			<-gate
+			return nil, ctx.Err()
+		})
+		done <- err
+	}()
+	for {
+		c.mu.Lock()
+		n := len(c.flights)
+		c.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v", err)
+	}
+	// The fetch itself carries on for anyone else who joins
+	joined := make(chan error)
+	go func() {
+		_, err := c.do(context.Background(), "k", nil)
+		joined <- err
+	}()
+	for c.sharedFetches() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	if err := <-joined; err != nil {
+		t.Errorf("shared fetch saw the first caller's cancellation: %v", err)
+	}
+}
+
+func TestCoalescerChargesEachCaller(t *testing.T) {
+	config := DefaultConfig
+	config.MaxResponseSeries, config.MaxResponseBytes = 1, 100
+	p := NewChronoProxyWithConfig(config)
+	c := newCoalescer(config)
+	gate := make(chan struct{})
+	fetch := func(ctx context.Context) ([]model.Series, error) {
+		<-gate
+		if _, err := io.ReadAll(budgetFrom(ctx).reader(strings.NewReader(strings.Repeat("x", 60)))); err != nil {
+			return nil, err
+		}
+		if err := budgetFrom(ctx).fits(1, 1); err != nil {
+			return nil, err
+		}
+		return []model.Series{{Labels: map[string]string{"job": "api"}, Points: []model.Point{{T: 1, V: 1}}}}, nil
+	}
+
+	// The one that starts the fetch has already used up its series...
+	starter := p.newBudget()
+	if err := starter.charge([]model.Series{{}}); err != nil {
+		t.Fatal(err)
+	}
+	// ...one joining has read most of its bytes, another has spent nothing
+	heavy, light := p.newBudget(), p.newBudget()
+	if err := heavy.chargeBytes(50); err != nil {
+		t.Fatal(err)
+	}
+	errs := make([]error, 3)
+	var wg sync.WaitGroup
+	call := func(i int, b *responseBudget) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = c.do(withBudget(context.Background(), b), "k", fetch)
+		}()
+	}
+	call(0, starter)
+	for {
+		c.mu.Lock()
+		n := len(c.flights)
+		c.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	call(1, heavy)
+	call(2, light)
+	for c.sharedFetches() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("the fetch was held to the starter's spent budget: %v, %v", errs[0], errs[2])
+	}
+	var limit *limitError
+	if !errors.As(errs[1], &limit) || limit.limit != "max_response_bytes" {
+		t.Errorf("heavy caller: %v, want max_response_bytes", errs[1])
+	}
+	if n := light.spentBytes(); n != 60 {
+		t.Errorf("light caller charged %d bytes, want 60", n)
+	}
+}
+
+func TestFetchKey(t *testing.T) {
+	ctx := context.Background()
+	win := window{name: "7days", offset: 604800}
+	a := fetchKey(ctx, "http://prom/api/v1/query?query=up&time=1", win, "")
+	if b := fetchKey(ctx, "http://prom/api/v1/query?time=1&query=up", win, ""); a != b {
+		t.Error("parameter order changed the key")
+	}
+	for name, other := range map[string]string{
+		"command":     fetchKey(ctx, "http://prom/api/v1/query?query=up&time=1", win, "DONT_REMOVE_UNUSED_HISTORICS"),
+		"window":      fetchKey(ctx, "http://prom/api/v1/query?query=up&time=1", window{name: "14days", offset: 604800}, ""),
+		"credentials": fetchKey(withClientAuthorization(ctx, "Bearer x"), "http://prom/api/v1/query?query=up&time=1", win, ""),
+		"tenant":      fetchKey(withTenant(ctx, newTenant(TenantConfig{Name: "payments"}, 1)), "http://prom/api/v1/query?query=up&time=1", win, ""),
+	} {
+		if other == a {
+			t.Errorf("a different %s gave the same key", name)
+		}
+	}
+}
+
+func TestConcurrentIdenticalQueriesShareFetches(t *testing.T) {
+	gate := make(chan struct{})
+	var fetches int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-gate
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	}))
+	defer upstream.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(upstream.URL, "http://"), ":", "_", 1)
+
+	p := NewChronoProxyWithConfig(DefaultConfig)
+	const panels = 5
+	codes := make([]int, panels)
+	var wg sync.WaitGroup
+	for i := 0; i < panels; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000&query=up{chrono_timeframe="current"}`, nil))
+			codes[i] = w.Code
+		}(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.coalescer.sharedFetches() != panels-1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("%d upstream fetches for %d identical queries, want 1", fetches, panels)
+	}
+	for i, code := range codes {
+		if code != 200 {
+			t.Errorf("query %d: %d", i, code)
+		}
+	}
+}
+
+func TestIdenticalWindowsFetchOnce(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 1700000000, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+
+	p := NewChronoProxyWithConfig(DefaultConfig)
+	wins := []window{{name: "current"}, {name: "0days"}, {name: "7days", offset: 7 * 86400}}
+	params := url.Values{"query": {"up"}, "time": {"1700000000"}}
+	tr := &evalTrace{}
+	tr.on()
+	got, err := fetchWindowsInstant(withTrace(context.Background(), tr), p, wins, params, fake.URL+"/api/v1/query", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fake.Requests()); n != 2 {
+		t.Errorf("%d upstream requests, want 2", n)
+	}
+	var tfs []string
+	for _, s := range got {
+		tfs = append(tfs, s.Labels["chrono_timeframe"])
+	}
+	if strings.Join(tfs, ",") != "current,0days" {
+		t.Errorf("timeframes = %v", tfs)
+	}
+	if got[0].Labels["chrono_timeframe"] != "current" {
+		t.Error("reusing current's answer relabelled it")
+	}
+	if st := tr.report().Stages; len(st) != 3 || st[1].Stage != "reuse" || st[1].Window != "0days" {
+		t.Errorf("trace = %+v", st)
+	}
+}
@@ -0,0 +1,108 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/compare.go
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Window against window - "was last week worse than the week before?"
+//
+// compareAgainstLast28 always pits current against the average. For
+// hunting a week-over-week regression you want two specific windows:
+//
+//   up{chrono_compare="7days-14days"}
+//
+// fetches just those two and answers with their difference, A minus B, as
+// chrono_timeframe="7days-14days". Either side can be any window the query
+// would otherwise have - current, the standard weeks, one of your
+// chrono_offsets, or an ad-hoc one like 3days. Points are paired the same
+// way as the other compares: on timestamp, with a missing B counting as zero.
+
+const compareLabel = "chrono_compare"
+
+var compareRegex = regexp.MustCompile(`chrono_compare="([^"]*)"`)
+
+// resolveWindow finds the window called name among wins, or reads it as an
+// ad-hoc one.
+func (p *ChronoProxy) resolveWindow(name string, wins []window) (window, bool) {
+	for _, win := range wins {
+		if win.name == name {
+			return win, true
+		}
+	}
+	win, ok := adHocWindow(name)
+	win.loc = p.location
+	return win, ok
+}
+
+// comparePair splits "A-B" into its two windows.
+func (p *ChronoProxy) comparePair(spec string, wins []window) ([]window, error) {
+	a, b, ok := strings.Cut(spec, "-")
+	if !ok || a == "" || b == "" {
+		return nil, fmt.Errorf("%s wants two windows like \"7days-14days\", got %q", compareLabel, spec)
+	}
+	winA, okA := p.resolveWindow(a, wins)
+	winB, okB := p.resolveWindow(b, wins)
+	switch {
+	case !okA:
+		return nil, fmt.Errorf("%s: unknown window %q", compareLabel, a)
+	case !okB:
+		return nil, fmt.Errorf("%s: unknown window %q", compareLabel, b)
+	case winA.offset == winB.offset:
+		return nil, fmt.Errorf("%s: %q and %q are the same window", compareLabel, a, b)
+	}
+	return []window{winA, winB}, nil
+}
+
+// extractCompare finds chrono_compare in the query and strips it out,
+// returning the two windows to diff (nil when there's no label).
+func (p *ChronoProxy) extractCompare(params url.Values, wins []window) ([]window, error) {
+	m := compareRegex.FindStringSubmatch(params.Get("query"))
+	stripLabelFromParam(params, "query", compareLabel)
+	if m == nil {
+		return nil, nil
+	}
+	pair, err := p.comparePair(m[1], wins)
+	if err != nil {
+		return nil, &badQueryError{msg: err.Error()}
+	}
+	return pair, nil
+}
+
+// buildWindowDiff is A minus B for every series both windows have.
+func buildWindowDiff(series []model.Series, a, b, command string, isRange bool) []model.Series {
+	aMap := make(map[string]model.Series)
+	bMap := make(map[string]model.Series)
+	for _, s := range series {
+		switch s.Labels["chrono_timeframe"] {
+		case a:
+			aMap[signature(s.Labels)] = s
+		case b:
+			bMap[signature(s.Labels)] = s
+		}
+	}
+	return appendSynthetic(nil, aMap, bMap, a+"-"+b, command, isRange, func(x, y float64) float64 {
+		return x - y
+	})
+}
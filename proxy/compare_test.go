@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestBuildWindowDiff(t *testing.T) {
+	series := func(tf string, pts ...model.Point) model.Series {
+		return model.Series{Labels: map[string]string{"__name__": "up", "chrono_timeframe": tf}, Points: pts}
+	}
+	in := []model.Series{
+		series("current", model.Point{T: 60000, V: 100}),
+		series("7days", model.Point{T: 60000, V: 10}, model.Point{T: 120000, V: 4}),
+		series("14days", model.Point{T: 60000, V: 3}),
+	}
+	out := buildWindowDiff(in, "7days", "14days", "", true)
+	if len(out) != 1 || out[0].Labels["chrono_timeframe"] != "7days-14days" {
+		t.Fatalf("got %+v", out)
+	}
+	want := []model.Point{{T: 60000, V: 7}, {T: 120000, V: 4}}
+	if len(out[0].Points) != 2 || out[0].Points[0] != want[0] || out[0].Points[1] != want[1] {
+		t.Errorf("points = %+v; want %+v", out[0].Points, want)
+	}
+}
+
+func TestComparePair(t *testing.T) {
+	p := NewChronoProxy()
+	if pair, err := p.comparePair("current-3days", p.windows()); err != nil || pair[1].offset != 3*86400 {
+		t.Errorf("ad-hoc side: %+v, %v", pair, err)
+	}
+	for _, bad := range []string{"7days", "7days-", "7days-yesterday", "7days-7days", "7days-1w"} {
+		if _, err := p.comparePair(bad, p.windows()); err == nil {
+			t.Errorf("comparePair(%q) should fail", bad)
+		}
+	}
+}
+
+func TestChronoCompareQuery(t *testing.T) {
+	const now = 1700000000
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	body := func(at int64, v string) []byte {
+		return []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[` +
+			model.FormatTimestamp(at*1000) + `,"` + v + `"]}]}}`)
+	}
+	fake.Serve("/api/v1/query", now-7*86400, body(now-7*86400, "5"))
+	fake.Serve("/api/v1/query", now-14*86400, body(now-14*86400, "8"))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	query := func(q string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		NewChronoProxy().ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(q), nil))
+		return w
+	}
+
+	w := query(`up{chrono_compare="7days-14days"}`)
+	if got := w.Body.String(); !strings.Contains(got, `"chrono_timeframe":"7days-14days"`) || !strings.Contains(got, `[1700000000,"-3"]`) {
+		t.Errorf("body = %s", got)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 2 {
+		t.Errorf("fetched %d windows; want just the two", len(reqs))
+	}
+	for _, r := range reqs {
+		if strings.Contains(r.Params.Get("query"), compareLabel) {
+			t.Errorf("%s leaked upstream: %s", compareLabel, r.Params.Get("query"))
+		}
+	}
+
+	for _, q := range []string{`up{chrono_compare="7days-nope"}`, `up{chrono_compare="7days-14days",chrono_timeframe="current"}`} {
+		if w := query(q); w.Code != 400 {
+			t.Errorf("%s: status %d; want 400", q, w.Code)
+		}
+	}
+}
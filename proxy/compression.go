@@ -0,0 +1,212 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/compression.go
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Response compression - five windows of JSON is a lot of JSON 🗜️
+//
+// A month-long matrix with every window and synthetic can run to megabytes
+// of very repetitive JSON, which gzip shrinks by ten times or more. When
+// the client says Accept-Encoding: gzip (Grafana and every browser do),
+// responses of compression_min_bytes or more go back gzipped at
+// compression_level. Smaller ones aren't worth the CPU and go back as
+// they are.
+//
+// Anything that already has a Content-Encoding - remote read's snappy, or
+// an upstream answer passed through already compressed - is left alone.
+// Streams (job progress) that flush before reaching the minimum go out
+// uncompressed, so every line still arrives when it's written.
+//
+// gzip is the only encoding for now; zstd would need a library we don't
+// otherwise depend on.
+
+const (
+	compressionGzip = "gzip"
+	compressionOff  = "off"
+)
+
+// validateCompression checks the compression settings.
+func validateCompression(c Config) error {
+	switch c.Compression {
+	case compressionGzip, compressionOff:
+	default:
+		return fmt.Errorf("compression must be gzip or off, got %q", c.Compression)
+	}
+	if c.CompressionMinBytes < 0 {
+		return fmt.Errorf("compression_min_bytes can't be negative, got %d", c.CompressionMinBytes)
+	}
+	if c.CompressionLevel != 0 && (c.CompressionLevel < gzip.BestSpeed || c.CompressionLevel > gzip.BestCompression) {
+		return fmt.Errorf("compression_level must be between %d and %d (0 = gzip's default), got %d", gzip.BestSpeed, gzip.BestCompression, c.CompressionLevel)
+	}
+	return nil
+}
+
+// gzipWriters recycles compressors per level - they're not cheap to make.
+var gzipWriters sync.Map // level → *sync.Pool
+
+func gzipPool(level int) *sync.Pool {
+	if pool, ok := gzipWriters.Load(level); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := gzipWriters.LoadOrStore(level, &sync.Pool{New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(nil, level)
+		return gz
+	}})
+	return pool.(*sync.Pool)
+}
+
+// compressWriter for r, or w as it is when the client doesn't take gzip
+// or compression is off. Close the writer once the handler is done.
+func (p *ChronoProxy) compressWriter(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if p.config.Compression != compressionGzip || r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return w, func() {}
+	}
+	level := p.config.CompressionLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	cw := &compressWriter{ResponseWriter: w, min: p.config.CompressionMinBytes, pool: gzipPool(level)}
+	return cw, cw.close
+}
+
+// acceptsGzip reads Accept-Encoding: gzip or *, without q=0.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if _, q, ok := strings.Cut(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressWriter holds the first min bytes back, then decides: gzip if
+// there's more, as-is if that was everything.
+type compressWriter struct {
+	http.ResponseWriter
+	min  int
+	pool *sync.Pool
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	// Nothing to compress, or somebody already did
+	if code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified || w.Header().Get("Content-Encoding") != "" {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		if w.buf.Len()+len(b) < w.min {
+			return w.buf.Write(b)
+		}
+		w.decide(true)
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the headers, compressed or not, and anything held back.
+func (w *compressWriter) decide(compress bool) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if compress {
+		h.Set("Content-Encoding", compressionGzip)
+		h.Del("Content-Length")
+		w.gz = w.pool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() > 0 {
+		if w.gz != nil {
+			w.gz.Write(w.buf.Bytes())
+		} else {
+			w.ResponseWriter.Write(w.buf.Bytes())
+		}
+		w.buf.Reset()
+	}
+}
+
+// Flush keeps streaming endpoints (job progress) streaming.
+func (w *compressWriter) Flush() {
+	w.decide(false)
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController find the real writer.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close finishes the response: whatever's held back goes out as it is, or
+// the gzip stream is ended.
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 && w.buf.Len() == 0 {
+			return // the handler never wrote anything; net/http sends its 200
+		}
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		w.gz.Reset(nil)
+		w.pool.Put(w.gz)
+		w.gz = nil
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestCompression(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	var result []string
+	for i := 0; i < 50; i++ {
+		result = append(result, `{"metric":{"__name__":"up","instance":"host-`+strings.Repeat("x", i)+`"},"value":[1700000000,"1"]}`)
+	}
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[`+strings.Join(result, ",")+`]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxy()
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", prefix+path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	plain := get("/api/v1/query?time=1700000000&query=up", "")
+	w := get("/api/v1/query?time=1700000000&query=up", "br, gzip;q=0.8")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Body.Len() >= plain.Body.Len() {
+		t.Fatalf("want a smaller gzipped body, got %q, %d vs %d bytes", w.Header().Get("Content-Encoding"), w.Body.Len(), plain.Body.Len())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(gz); string(body) != plain.Body.String() {
+		t.Error("gzipped body doesn't match the plain one")
+	}
+
+	if w := get("/api/v1/query?time=1700000000&query=up", "gzip;q=0"); w.Header().Get("Content-Encoding") != "" {
+		t.Error("q=0 means no gzip")
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", prefix+"/api/v1/chrono/lint", strings.NewReader(`{"query":"up"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept-Encoding", "gzip")
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "" || !strings.Contains(w.Body.String(), `"findings":[]`) {
+		t.Errorf("small responses go back as they are: %d %q %s", w.Code, w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+
+	config := DefaultConfig
+	config.Compression = compressionOff
+	p = NewChronoProxyWithConfig(config)
+	if w := get("/api/v1/query?time=1700000000&query=up", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Error("compression: off")
+	}
+	config.Compression = "zstd"
+	if config.Validate() == nil {
+		t.Error("unknown compression should fail validation")
+	}
+}
+
+func TestCompressWriterSmallAndStreaming(t *testing.T) {
+	p := NewChronoProxy()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	rec := httptest.NewRecorder()
+	w, finish := p.compressWriter(rec, r)
+	w.WriteHeader(http.StatusTeapot)
+	w.Write([]byte("short"))
+	finish()
+	if rec.Code != http.StatusTeapot || rec.Body.String() != "short" || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("small: %d %q %q", rec.Code, rec.Body.String(), rec.Header().Get("Content-Encoding"))
+	}
+
+	rec = httptest.NewRecorder()
+	w, finish = p.compressWriter(rec, r)
+	w.Write([]byte("line 1\n"))
+	w.(http.Flusher).Flush()
+	if rec.Body.String() != "line 1\n" || !rec.Flushed {
+		t.Errorf("a flush should send what's there straight away: %q", rec.Body.String())
+	}
+	w.Write([]byte(strings.Repeat("x", 2048)))
+	finish()
+	if rec.Body.Len() != 7+2048 {
+		t.Errorf("streams stay uncompressed once flushed, got %d bytes", rec.Body.Len())
+	}
+}
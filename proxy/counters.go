@@ -0,0 +1,123 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/counters.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Counters - comparing odometers is pointless, compare speeds 🏎️
+//
+// A counter only ever goes up (until a restart knocks it back to zero), so
+// the average of last month's raw values is just "a smaller number than
+// now", and compareAgainstLast28 grows forever. What people mean is the
+// rate. With counter_transform set (or per query, chrono_counter="..."),
+// a plain selector for a counter is turned into a rate before anything is
+// fetched:
+//
+//   http_requests_total{job="api"}  ->  rate(http_requests_total{job="api"}[5m])
+//
+// Every window and every synthetic is then built from rates. What counts as
+// a counter is what the upstream's /api/v1/metadata says; when it doesn't
+// know, a _total suffix will do. Only a bare selector is rewritten - once a
+// query has functions or operators in it, it's the author's business.
+//
+//   chrono_counter="rate"        rate over counter_range (default 5m)
+//   chrono_counter="irate:2m"    irate, over 2m
+//   chrono_counter="off"         leave this query alone
+//
+// The types come from metrictypes.go, which remembers them for a while.
+
+const counterLabel = "chrono_counter"
+
+var (
+	counterRegex        = regexp.MustCompile(`chrono_counter="([^"]*)"`)
+	bareSelectorRegex   = regexp.MustCompile(`^\s*([a-zA-Z_:][a-zA-Z0-9_:]*)\s*(\{[^{}]*\})?\s*$`)
+	counterTransformSet = map[string]bool{"": true, "off": true, "rate": true, "irate": true}
+)
+
+// counterMode is which transform, if any, a query's counters get.
+type counterMode struct {
+	fn  string        // "rate" or "irate", "" = none
+	rng time.Duration // the [range] it's taken over
+}
+
+// parseCounterMode reads "rate", "irate:2m" or "off".
+func parseCounterMode(spec string, defaultRange time.Duration) (counterMode, error) {
+	fn, rng, hasRange := strings.Cut(spec, ":")
+	if !counterTransformSet[fn] || (hasRange && (fn == "" || fn == "off")) {
+		return counterMode{}, fmt.Errorf("want rate, irate or off, optionally with a range like rate:5m, got %q", spec)
+	}
+	mode := counterMode{rng: defaultRange}
+	if fn != "off" {
+		mode.fn = fn
+	}
+	if hasRange {
+		d, err := parsePromDuration(rng)
+		if err != nil || d < time.Second {
+			return counterMode{}, fmt.Errorf("bad range %q: want a duration like 5m", rng)
+		}
+		mode.rng = d
+	}
+	return mode, nil
+}
+
+// extractCounterMode finds chrono_counter in the query (stripping it out),
+// falling back to counter_transform.
+func (p *ChronoProxy) extractCounterMode(params url.Values) (counterMode, error) {
+	m := counterRegex.FindStringSubmatch(params.Get("query"))
+	stripLabelFromParam(params, "query", counterLabel)
+	spec := p.config.CounterTransform
+	if m != nil {
+		spec = m[1]
+	}
+	mode, err := parseCounterMode(spec, p.config.CounterRange)
+	if err != nil {
+		return counterMode{}, &badQueryError{msg: counterLabel + ": " + err.Error()}
+	}
+	return mode, nil
+}
+
+// applyCounterMode rewrites params' query into a rate when it's a bare
+// selector for a counter, and says whether it did. base is the upstream to
+// ask about metadata.
+func (p *ChronoProxy) applyCounterMode(ctx context.Context, params url.Values, base string, mode counterMode) bool {
+	if mode.fn == "" {
+		return false
+	}
+	query := params.Get("query")
+	m := bareSelectorRegex.FindStringSubmatch(query)
+	if m == nil || !p.isCounter(ctx, base, m[1]) {
+		return false
+	}
+	params.Set("query", fmt.Sprintf("%s(%s[%ds])", mode.fn, strings.TrimSpace(query), int64(mode.rng/time.Second)))
+	return true
+}
+
+// isCounter says whether name only ever goes up on the upstream at base.
+func (p *ChronoProxy) isCounter(ctx context.Context, base, name string) bool {
+	if typ := p.metricType(ctx, base, name); typ != "" {
+		return isMonotonic(name, typ)
+	}
+	return strings.HasSuffix(name, "_total")
+}
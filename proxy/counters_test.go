@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestCountersAreRatedBeforeAveraging(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve(metadataPath, 0, []byte(`{"status":"success","data":{"http_requests":[{"type":"counter","help":"","unit":""}],"queue_total":[{"type":"gauge","help":"","unit":""}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.CounterTransform = "rate"
+	p := NewChronoProxyWithConfig(config)
+
+	// upstreamQuery runs q and returns the query the upstream was asked.
+	upstreamQuery := func(q string) (int, string) {
+		t.Helper()
+		before := len(fake.Requests())
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(q), nil))
+		for _, r := range fake.Requests()[before:] {
+			if r.Path == "/api/v1/query" {
+				return w.Code, r.Params.Get("query")
+			}
+		}
+		return w.Code, ""
+	}
+
+	for q, want := range map[string]string{
+		`http_requests{job="api",chrono_timeframe="current"}`:                 `rate(http_requests{job="api"}[300s])`,
+		`http_requests{chrono_timeframe="current",chrono_counter="irate:1m"}`: `irate(http_requests[60s])`,
+		`http_requests{chrono_timeframe="current",chrono_counter="off"}`:      `http_requests`,
+		`queue_total{chrono_timeframe="current"}`:                             `queue_total`,
+		`sum(http_requests{chrono_timeframe="current"})`:                      `sum(http_requests)`,
+		`unknown_total{chrono_timeframe="current"}`:                           `rate(unknown_total[300s])`,
+	} {
+		if _, got := upstreamQuery(q); got != want {
+			t.Errorf("%s: upstream got %q, want %q", q, got, want)
+		}
+	}
+
+	calls := len(fake.Requests())
+	upstreamQuery(`http_requests{chrono_timeframe="current"}`)
+	for _, r := range fake.Requests()[calls:] {
+		if r.Path == metadataPath {
+			t.Error("metric types should be remembered, metadata was asked again")
+		}
+	}
+
+	if code, _ := upstreamQuery(`http_requests{chrono_counter="deriv"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown transform: status %d, want 400", code)
+	}
+}
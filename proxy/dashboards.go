@@ -0,0 +1,156 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/dashboards.go
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Per-dashboard accounting - "who is hammering the proxy?" answered by
+// name. Grafana tags its datasource requests with the dashboard and panel
+// they're for, so whenever those headers turn up we record, per
+// (dashboard, panel):
+//
+//   - chronotheus_dashboard_requests_total
+//   - chronotheus_dashboard_request_duration_seconds
+//   - chronotheus_dashboard_response_bytes
+//   - chronotheus_dashboard_response_series (queries only)
+//
+// Newer Grafanas send X-Dashboard-Uid, older ones X-Dashboard-Id; we take
+// either. Header values come from clients, so after max_dashboard_series
+// distinct pairs everything new is lumped in as "other" - a runaway script
+// shouldn't be able to blow up our /metrics.
+
+var (
+	dashboardHeaders = []string{"X-Dashboard-Uid", "X-Dashboard-Id"}
+	panelHeader      = "X-Panel-Id"
+
+	// sizeBuckets go from "a label list" to "someone asked for a year at 15s".
+	sizeBuckets = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+	// seriesBuckets count series in a response.
+	seriesBuckets = []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000, 50000}
+)
+
+const otherDashboard = "other"
+
+// dashboardMetrics holds the per-dashboard families and the cardinality cap.
+type dashboardMetrics struct {
+	requests *counterVec
+	duration *histogramVec
+	bytes    *histogramVec
+	series   *histogramVec
+
+	mu   sync.Mutex
+	max  int
+	seen map[[2]string]bool
+}
+
+func newDashboardMetrics(max int) *dashboardMetrics {
+	return &dashboardMetrics{
+		requests: newCounterVec("dashboard", "panel"),
+		duration: newHistogramVec(latencyBuckets, "dashboard", "panel"),
+		bytes:    newHistogramVec(sizeBuckets, "dashboard", "panel"),
+		series:   newHistogramVec(seriesBuckets, "dashboard", "panel"),
+		max:      max,
+		seen:     make(map[[2]string]bool),
+	}
+}
+
+// labels returns the label values to record under, folding newcomers into
+// "other" once the cap is reached.
+func (d *dashboardMetrics) labels(dashboard, panel string) (string, string) {
+	key := [2]string{dashboard, panel}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen[key] {
+		return dashboard, panel
+	}
+	if d.max > 0 && len(d.seen) >= d.max {
+		return otherDashboard, otherDashboard
+	}
+	d.seen[key] = true
+	return dashboard, panel
+}
+
+// dashboardRequest rides along in the context so handlers can say how many
+// series they sent back.
+type dashboardRequest struct {
+	dashboard, panel string
+	series           int // -1 until a query handler sets it
+}
+
+type dashboardKey struct{}
+
+func withDashboard(ctx context.Context, d *dashboardRequest) context.Context {
+	return context.WithValue(ctx, dashboardKey{}, d)
+}
+
+// reportSeries records how many series a query returned, if anybody's counting.
+func reportSeries(ctx context.Context, n int) {
+	if d, ok := ctx.Value(dashboardKey{}).(*dashboardRequest); ok {
+		d.series = n
+	}
+}
+
+// dashboardFromHeaders pulls the dashboard/panel pair off a request, or nil
+// if it didn't come from a Grafana panel.
+func dashboardFromHeaders(r *http.Request) *dashboardRequest {
+	for _, h := range dashboardHeaders {
+		if v := r.Header.Get(h); v != "" {
+			return &dashboardRequest{dashboard: v, panel: r.Header.Get(panelHeader), series: -1}
+		}
+	}
+	return nil
+}
+
+// observe records one finished request.
+func (d *dashboardMetrics) observe(req *dashboardRequest, seconds float64, bytes int64) {
+	dash, panel := d.labels(req.dashboard, req.panel)
+	d.requests.inc(dash, panel)
+	d.duration.observe(seconds, dash, panel)
+	d.bytes.observe(float64(bytes), dash, panel)
+	if req.series >= 0 {
+		d.series.observe(float64(req.series), dash, panel)
+	}
+}
+
+// countingWriter counts the bytes that go back to the client.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming endpoints (job progress) streaming.
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController find the real writer.
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
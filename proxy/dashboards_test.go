@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestDashboardMetrics(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 1700000000, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.MaxDashboardSeries = 1
+	p := NewChronoProxyWithConfig(config)
+	query := func(dashboard, panel string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query=up", nil)
+		if dashboard != "" {
+			r.Header.Set("X-Dashboard-Uid", dashboard)
+			r.Header.Set("X-Panel-Id", panel)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	w := query("abc123", "4")
+	query("abc123", "4")
+	query("", "")         // not from a dashboard - not counted
+	query("other99", "1") // over the cap
+
+	got := map[string]uint64{}
+	for _, s := range p.dashboards.requests.snapshot() {
+		got[s.Labels["dashboard"]+"/"+s.Labels["panel"]] = s.Value
+	}
+	if len(got) != 2 || got["abc123/4"] != 2 || got["other/other"] != 1 {
+		t.Errorf("requests = %v", got)
+	}
+
+	for _, s := range p.dashboards.bytes.snapshot() {
+		if s.Labels["dashboard"] == "abc123" && s.Sum != float64(2*w.Body.Len()) {
+			t.Errorf("bytes sum = %v; want %d", s.Sum, 2*w.Body.Len())
+		}
+	}
+	for _, s := range p.dashboards.series.snapshot() {
+		// Only the current window has data, so one series per answer.
+		if s.Labels["dashboard"] == "abc123" && (s.Count != 2 || s.Sum != 2) {
+			t.Errorf("series = count %d sum %v", s.Count, s.Sum)
+		}
+	}
+
+	var out strings.Builder
+	p.writeMetrics(&out)
+	if !strings.Contains(out.String(), `chronotheus_dashboard_requests_total{dashboard="abc123",panel="4"} 2`) {
+		t.Errorf("exposition missing dashboard counters:\n%s", out.String())
+	}
+}
@@ -17,9 +17,12 @@
 // proxy/debug.go
 package proxy
 
-// DebugMode will be set once, in main(), then read by any util or handler.
+import "sync/atomic"
+
+// DebugMode is set in main() and again on every config reload, and read by
+// any util or handler while requests are in flight - hence the atomic.
 // Like a lighthouse in a storm, it guides us through the darkness of debugging.
-var DebugMode bool
+var DebugMode atomic.Bool
 
 // In the vast expanse of our codebase, a lone sentinel stands...
 //
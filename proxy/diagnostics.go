@@ -0,0 +1,186 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/diagnostics.go
+package proxy
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Diagnostics - opening the hood while it's running 🩺
+//
+// With debug_endpoints on, two things appear under /-/debug/ (no upstream
+// prefix, and listen_auth applies like it does everywhere else):
+//
+//   /-/debug/pprof/   Go's profiles - heap, goroutine, a 30s CPU profile,
+//                     execution traces - for `go tool pprof` to read
+//   /-/debug/state    one JSON snapshot: the config (secrets redacted),
+//                     plugins and the plugin watcher, cache sizes and hit
+//                     counts, and every request being answered right now
+//
+// Both are off by default: profiles cost CPU while they're taken and the
+// state shows who's asking what. Turn them on, ideally with listen_auth,
+// when something's wrong in production and the logs aren't saying why.
+
+const debugPathPrefix = "/-/debug/"
+
+// handleDebug serves everything under /-/debug/.
+func (p *ChronoProxy) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if !p.config.DebugEndpoints {
+		writeJSONError(w, http.StatusNotFound, "not_found", "debug endpoints are off (see debug_endpoints)")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, debugPathPrefix)
+	switch {
+	case name == "state":
+		p.handleDebugState(w, r)
+	case name == "pprof":
+		http.Redirect(w, r, debugPathPrefix+"pprof/", http.StatusMovedPermanently)
+	case strings.HasPrefix(name, "pprof/"):
+		servePprof(w, r, strings.TrimPrefix(name, "pprof/"))
+	default:
+		writeJSONError(w, http.StatusNotFound, "not_found", "unknown debug endpoint")
+	}
+}
+
+// servePprof is net/http/pprof, moved from /debug/pprof/ to ours.
+func servePprof(w http.ResponseWriter, r *http.Request, name string) {
+	switch name {
+	case "":
+		pprof.Index(w, r)
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
+
+// debugCaches is how full each cache is and how often it's been useful.
+type debugCaches struct {
+	StaleWindows     int               `json:"stale_windows"`
+	Jobs             int               `json:"jobs"`
+	Capabilities     int               `json:"capabilities"`
+	MetricTypes      int               `json:"metric_types"`
+	CoalescedFetches uint64            `json:"coalesced_fetches"`
+	Lookups          []CounterSnapshot `json:"lookups"`
+}
+
+// handleDebugState answers "what is it doing right now?".
+func (p *ChronoProxy) handleDebugState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	config, err := p.config.Redacted().YAML()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "internal", err.Error())
+		return
+	}
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"version":    Version,
+			"goroutines": runtime.NumGoroutine(),
+			"config":     string(config),
+			"plugins": map[string]interface{}{
+				"loaded":  p.plugins.Loaded(),
+				"watcher": p.plugins.Health(),
+			},
+			"caches": debugCaches{
+				StaleWindows:     p.stale.len(),
+				Jobs:             p.jobs.len(),
+				Capabilities:     len(p.caps.snapshot()),
+				MetricTypes:      p.mtypes.len(),
+				CoalescedFetches: p.coalescer.sharedFetches(),
+				Lookups:          p.cacheLookups.snapshot(),
+			},
+			"in_flight": p.inflight.list(p.clock.Now()),
+		},
+	})
+}
+
+// inflightRequests keeps track of the requests being answered, for
+// /-/debug/state. Safe to use on nil, which tracks nothing.
+type inflightRequests struct {
+	mu   sync.Mutex
+	next uint64
+	reqs map[uint64]inflightRequest
+}
+
+// inflightRequest is one request still being answered. The URL is
+// scrubbed the way the upstream request log scrubs it.
+type inflightRequest struct {
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Identity  string    `json:"identity,omitempty"`
+	Started   time.Time `json:"started"`
+	RunningMs float64   `json:"running_ms"`
+}
+
+func newInflightRequests(config Config) *inflightRequests {
+	if !config.DebugEndpoints {
+		return nil
+	}
+	return &inflightRequests{reqs: make(map[uint64]inflightRequest)}
+}
+
+// trackInflight records r as in flight until the returned func is called.
+func (p *ChronoProxy) trackInflight(r *http.Request, identity string) func() {
+	f := p.inflight
+	if f == nil {
+		return func() {}
+	}
+	req := inflightRequest{Method: r.Method, URL: p.scrubURL(r.URL.RequestURI()), Identity: identity, Started: p.clock.Now()}
+	f.mu.Lock()
+	f.next++
+	id := f.next
+	f.reqs[id] = req
+	f.mu.Unlock()
+	return func() {
+		f.mu.Lock()
+		delete(f.reqs, id)
+		f.mu.Unlock()
+	}
+}
+
+// list is every request in flight, oldest first.
+func (f *inflightRequests) list(now time.Time) []inflightRequest {
+	out := []inflightRequest{}
+	if f == nil {
+		return out
+	}
+	f.mu.Lock()
+	for _, req := range f.reqs {
+		req.RunningMs = millis(now.Sub(req.Started))
+		out = append(out, req)
+	}
+	f.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	get := func(p *ChronoProxy, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	if w := get(NewChronoProxy(), "/-/debug/state"); w.Code != 404 {
+		t.Errorf("off by default: status %d", w.Code)
+	}
+
+	config := DefaultConfig
+	config.DebugEndpoints = true
+	p := NewChronoProxyWithConfig(config)
+
+	w := get(p, "/-/debug/state?token=hunter2")
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			Config   string            `json:"config"`
+			Caches   debugCaches       `json:"caches"`
+			InFlight []inflightRequest `json:"in_flight"`
+			Plugins  struct {
+				Loaded []string `json:"loaded"`
+			} `json:"plugins"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status != "success" {
+		t.Fatalf("state: %d %s %v", w.Code, w.Body, err)
+	}
+	if !strings.Contains(resp.Data.Config, "debug_endpoints: true") {
+		t.Errorf("config missing from state:\n%s", resp.Data.Config)
+	}
+	// The request asking is itself in flight, with its token scrubbed
+	if len(resp.Data.InFlight) != 1 || resp.Data.InFlight[0].URL != "/-/debug/state?token="+scrubbedValue {
+		t.Errorf("in_flight = %+v", resp.Data.InFlight)
+	}
+	if len(p.inflight.list(p.clock.Now())) != 0 {
+		t.Error("finished request still listed as in flight")
+	}
+
+	if w := get(p, "/-/debug/pprof/"); w.Code != 200 || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("pprof index: %d", w.Code)
+	}
+	if w := get(p, "/-/debug/pprof/goroutine?debug=1"); w.Code != 200 || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Errorf("goroutine profile: %d %.100s", w.Code, w.Body)
+	}
+	if w := get(p, "/-/debug/pprof"); w.Code != 301 {
+		t.Errorf("pprof without a slash: status %d", w.Code)
+	}
+	if w := get(p, "/-/debug/nope"); w.Code != 404 {
+		t.Errorf("unknown endpoint: status %d", w.Code)
+	}
+}
@@ -0,0 +1,161 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/disabled.go
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disabled timeframes - "closed for backfilling, please use the other door" 🚧
+//
+// While long-term storage is being backfilled, a week of it can be full of
+// holes, and lastMonthAverage would happily count every hole as a zero. So
+// a past window can be switched off while the proxy runs:
+//
+//   PUT    /api/v1/chrono/admin/timeframes/14days   {"reason": "backfill"}
+//   DELETE /api/v1/chrono/admin/timeframes/14days
+//   GET    /api/v1/chrono/admin/timeframes
+//
+// A disabled window isn't fetched at all. Averages and the other synthetics
+// are worked out over the windows that are left, the answer gets a warning
+// saying which were left out, and asking for it by name gets an empty
+// result (with the same warning). "current" can't be disabled, and nothing
+// here survives a restart - it's a switch for an afternoon, not config.
+
+// disabledTimeframe is one switched-off window, as the admin endpoint shows it.
+type disabledTimeframe struct {
+	Name   string    `json:"name"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type disabledWindows struct {
+	mu     sync.RWMutex
+	byName map[string]disabledTimeframe
+}
+
+func newDisabledWindows() *disabledWindows {
+	return &disabledWindows{byName: make(map[string]disabledTimeframe)}
+}
+
+func (d *disabledWindows) get(name string) (disabledTimeframe, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	tf, ok := d.byName[name]
+	return tf, ok
+}
+
+func (d *disabledWindows) set(tf disabledTimeframe) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byName[tf.Name] = tf
+}
+
+func (d *disabledWindows) remove(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.byName[name]
+	delete(d.byName, name)
+	return ok
+}
+
+// list is every disabled window, by name.
+func (d *disabledWindows) list() []disabledTimeframe {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	out := make([]disabledTimeframe, 0, len(d.byName))
+	for _, tf := range d.byName {
+		out = append(out, tf)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// warning is what queries that lost this window are told.
+func (tf disabledTimeframe) warning() string {
+	msg := fmt.Sprintf("timeframe %s is disabled", tf.Name)
+	if tf.Reason != "" {
+		msg += " (" + tf.Reason + ")"
+	}
+	return msg + " and was left out, averages are over the remaining windows"
+}
+
+// enabledWindows splits wins into the ones still on and the ones disabled.
+func (p *ChronoProxy) enabledWindows(wins []window) ([]window, []disabledTimeframe) {
+	var out []window
+	var off []disabledTimeframe
+	for _, win := range wins {
+		if tf, disabled := p.disabled.get(win.name); disabled {
+			off = append(off, tf)
+			continue
+		}
+		out = append(out, win)
+	}
+	return out, off
+}
+
+// handleAdminTimeframes serves /api/v1/chrono/admin/timeframes[/<name>].
+func (p *ChronoProxy) handleAdminTimeframes(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+			return
+		}
+		writeJSONRaw(w, map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"disabled": p.disabled.list()},
+		})
+		return
+	}
+
+	if name == p.timeframes[0] || !isRawTf(name, p.timeframes) {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("%q isn't a past timeframe that can be disabled (one of %s)", name, strings.Join(p.timeframes[1:], ", ")))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&body); err != nil && err != io.EOF {
+			writeJSONError(w, http.StatusBadRequest, "bad_data", "invalid body: "+err.Error())
+			return
+		}
+		p.disabled.set(disabledTimeframe{Name: name, Since: p.clock.Now(), Reason: body.Reason})
+		log.Printf("🚧 timeframe %s disabled (%s)", name, body.Reason)
+	case http.MethodDelete:
+		if p.disabled.remove(name) {
+			log.Printf("🚧 timeframe %s enabled again", name)
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"disabled": p.disabled.list()},
+	})
+}
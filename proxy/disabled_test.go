@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestDisabledTimeframesLeftOut(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for _, days := range []int64{0, 7, 14, 21, 28} {
+		at := 1700000000 - days*86400
+		fake.Serve("/api/v1/query", at, []byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[%d,"1"]}]}}`, at)))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	config := DefaultConfig
+	config.AdminWrites = true
+	config.ListenAuth.BearerTokens = []string{"admin"}
+	p := NewChronoProxyWithConfig(config)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer admin")
+		p.ServeHTTP(w, r)
+	}
+
+	type response struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []interface{}     `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	query := func(q string) response {
+		t.Helper()
+		w := httptest.NewRecorder()
+		serve(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(q), nil))
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%q: %v: %s", q, err, w.Body.String())
+		}
+		return resp
+	}
+	admin := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		serve(w, httptest.NewRequest(method, chronoAdminPrefix+path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := admin("PUT", "timeframes/14days", `{"reason":"backfill"}`); code != http.StatusOK {
+		t.Fatalf("disable: %d", code)
+	}
+	calls := len(fake.Requests())
+	resp := query(`up{chrono_timeframe="lastMonthAverage"}`)
+	if n := len(fake.Requests()) - calls; n != 4 {
+		t.Errorf("fetched %d windows, want 4 with 14days off", n)
+	}
+	if len(resp.Data.Result) != 1 || resp.Data.Result[0].Value[1] != "1" {
+		t.Errorf("average should be over the 3 windows left: %+v", resp.Data.Result)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "14days is disabled (backfill)") {
+		t.Errorf("warnings = %q", resp.Warnings)
+	}
+
+	if resp := query(`up{chrono_timeframe="14days"}`); len(resp.Data.Result) != 0 || len(resp.Warnings) != 1 {
+		t.Errorf("asking for a disabled window by name: %+v", resp)
+	}
+	if resp := query(`up{chrono_timeframe="current"}`); len(resp.Data.Result) != 1 || resp.Warnings != nil {
+		t.Errorf("current doesn't need 14days, shouldn't be warned: %+v", resp)
+	}
+
+	if code := admin("PUT", "timeframes/current", ""); code != http.StatusBadRequest {
+		t.Errorf("disabling current: %d, want 400", code)
+	}
+	if code := admin("DELETE", "timeframes/14days", ""); code != http.StatusOK {
+		t.Errorf("enable: %d", code)
+	}
+	if resp := query(`up{chrono_timeframe="14days"}`); len(resp.Data.Result) != 1 || resp.Warnings != nil {
+		t.Errorf("enabled again: %+v", resp)
+	}
+}
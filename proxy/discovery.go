@@ -0,0 +1,121 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/discovery.go
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upstream discovery - for when the address book changes faster than
+// anybody wants to edit a config file.
+//
+// A discoverer is polled every so often for the upstreams it can see, and
+// the registry is synced to match. Discovered names never override ones
+// from the config file, and a failed refresh keeps the last good set - an
+// API server hiccup shouldn't make every dashboard 404.
+
+// discoverer finds upstreams somewhere (Kubernetes, DNS, ...).
+type discoverer interface {
+	// source names the discoverer in logs and in the registry, e.g. "kubernetes_sd[0]".
+	source() string
+	// interval is how long to wait between refreshes.
+	interval() time.Duration
+	// discover returns everything it can currently see.
+	discover(ctx context.Context) ([]UpstreamConfig, error)
+	// client is the HTTP client for discovered upstreams, nil for the shared one.
+	client() *http.Client
+}
+
+// discoverers builds one discoverer per configured discovery block.
+// Blocks that can't be set up are logged and skipped, like bad upstreams.
+func (p *ChronoProxy) discoverers() []discoverer {
+	var out []discoverer
+	for i, c := range p.config.KubernetesSD {
+		d, err := newKubernetesDiscoverer(p.config, c, i)
+		if err != nil {
+			log.Printf("Skipping kubernetes_sd[%d]: %v", i, err)
+			continue
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// RunDiscovery keeps discovered upstreams (and dnssrv+ pools) up to date
+// until ctx is done.
+// Every source is refreshed once straight away, so call it before serving
+// traffic if discovered names should work from the first request.
+func (p *ChronoProxy) RunDiscovery(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.runSRVRefresh(ctx)
+	}()
+	for _, d := range p.discoverers() {
+		wg.Add(1)
+		go func(d discoverer) {
+			defer wg.Done()
+			p.refreshLoop(ctx, d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (p *ChronoProxy) refreshLoop(ctx context.Context, d discoverer) {
+	ticker := time.NewTicker(d.interval())
+	defer ticker.Stop()
+	for {
+		p.refresh(ctx, d)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh asks d what it sees and syncs the registry to match.
+func (p *ChronoProxy) refresh(ctx context.Context, d discoverer) {
+	found, err := d.discover(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[ERROR] %s: %v (keeping the last known upstreams)", d.source(), err)
+		}
+		return
+	}
+
+	ups := make([]*upstream, 0, len(found))
+	for _, uc := range found {
+		u, err := newUpstream(uc)
+		if err != nil {
+			log.Printf("[ERROR] %s: %v", d.source(), err)
+			continue
+		}
+		u.client = d.client()
+		ups = append(ups, u)
+	}
+	added, removed := p.upstreams.sync(d.source(), ups)
+	if len(added) > 0 || len(removed) > 0 {
+		log.Printf("🔭 %s: +%v -%v", d.source(), added, removed)
+	}
+}
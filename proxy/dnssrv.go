@@ -0,0 +1,199 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/dnssrv.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNS SRV upstreams - the Thanos way of finding your friends.
+//
+//   upstreams:
+//     - name: prom
+//       url: dnssrv+_web._tcp.prometheus.monitoring.svc
+//
+// The SRV record is looked up every dns_refresh_interval and every target
+// it lists joins a pool behind the one name. Each request picks the next
+// target round-robin (all of its time windows go to the same replica, so
+// the comparison is apples to apples). When the pool changes, idle
+// connections are dropped so traffic spreads over the new set instead of
+// sticking to whoever we happened to be connected to.
+//
+// Like Thanos, we use every target and ignore SRV priority and weight.
+// Use dnssrv+https://... for TLS upstreams.
+
+const srvMarker = "dnssrv+"
+
+// lookupSRV resolves a full SRV name; swapped out in tests.
+var lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return addrs, err
+}
+
+// srvPool is the set of base URLs behind one dnssrv+ upstream.
+type srvPool struct {
+	record string // e.g. _web._tcp.prometheus.monitoring.svc
+	scheme string
+
+	mu      sync.RWMutex
+	targets []string // sorted base URLs
+	next    atomic.Uint64
+}
+
+// newSRVPool parses "dnssrv+[scheme://]record".
+func newSRVPool(spec string) (*srvPool, error) {
+	rest := strings.TrimPrefix(spec, srvMarker)
+	scheme := "http"
+	if s, record, ok := strings.Cut(rest, "://"); ok {
+		scheme, rest = s, record
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("url scheme must be http or https, got %q", scheme)
+	}
+	if rest == "" || strings.ContainsAny(rest, "/:?#") {
+		return nil, fmt.Errorf("%q is not a DNS name to look up", rest)
+	}
+	return &srvPool{record: rest, scheme: scheme}, nil
+}
+
+// refresh re-resolves the record. An empty or failed answer keeps the old
+// targets - a DNS blip shouldn't take the upstream away.
+func (s *srvPool) refresh(ctx context.Context) (changed bool, err error) {
+	addrs, err := lookupSRV(ctx, s.record)
+	if err != nil {
+		return false, fmt.Errorf("resolving %s: %w", s.record, err)
+	}
+	if len(addrs) == 0 {
+		return false, fmt.Errorf("resolving %s: no targets", s.record)
+	}
+
+	seen := make(map[string]bool, len(addrs))
+	targets := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		host := strings.TrimSuffix(a.Target, ".")
+		base := s.scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(a.Port)))
+		if !seen[base] {
+			seen[base] = true
+			targets = append(targets, base)
+		}
+	}
+	sort.Strings(targets)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reflect.DeepEqual(targets, s.targets) {
+		return false, nil
+	}
+	s.targets = targets
+	return true, nil
+}
+
+// pick hands out the next target. If we've never resolved successfully,
+// it has one go right now rather than failing the request outright.
+func (s *srvPool) pick(ctx context.Context) (string, error) {
+	s.mu.RLock()
+	n := len(s.targets)
+	s.mu.RUnlock()
+	if n == 0 {
+		if _, err := s.refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.next.Add(1) - 1
+	return s.targets[i%uint64(len(s.targets))], nil
+}
+
+// snapshot returns the current targets, for logs and tests.
+func (s *srvPool) snapshot() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.targets...)
+}
+
+// target is where this request should go: the fixed base URL, or the next
+// target in the pool for dnssrv+ upstreams. A virtual upstream answers with
+// its first member; only queries fan out (see fanout.go).
+func (u *upstream) target(ctx context.Context) (string, error) {
+	if len(u.members) > 0 {
+		return u.members[0].target(ctx)
+	}
+	if u.pool == nil {
+		return u.base, nil
+	}
+	return u.pool.pick(ctx)
+}
+
+// runSRVRefresh re-resolves every dnssrv+ upstream until ctx is done.
+func (p *ChronoProxy) runSRVRefresh(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams.all() {
+		if u.pool == nil {
+			continue
+		}
+		client := u.client
+		if client == nil {
+			client = p.client
+		}
+		wg.Add(1)
+		go func(u *upstream, client *http.Client) {
+			defer wg.Done()
+			p.srvRefreshLoop(ctx, u, client)
+		}(u, client)
+	}
+	wg.Wait()
+}
+
+func (p *ChronoProxy) srvRefreshLoop(ctx context.Context, u *upstream, client *http.Client) {
+	interval := p.config.DNSRefreshInterval
+	if interval <= 0 {
+		interval = DefaultConfig.DNSRefreshInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changed, err := u.pool.refresh(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("[ERROR] upstream %q: %v (keeping %v)", u.name, err, u.pool.snapshot())
+		case changed:
+			log.Printf("🔭 upstream %q now %v", u.name, u.pool.snapshot())
+			// Rebalance: kept-alive connections would otherwise pin us to
+			// the old targets for as long as they stay busy.
+			client.CloseIdleConnections()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func stubSRV(t *testing.T, fn func(name string) ([]*net.SRV, error)) {
+	old := lookupSRV
+	lookupSRV = func(_ context.Context, name string) ([]*net.SRV, error) { return fn(name) }
+	t.Cleanup(func() { lookupSRV = old })
+}
+
+func TestSRVUpstreamRoundRobins(t *testing.T) {
+	var hits []string
+	backend := func(id string) (*httptest.Server, uint16) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, id)
+			w.Write([]byte(`{"status":"success","data":[]}`))
+		}))
+		_, port, _ := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+		n, _ := strconv.Atoi(port)
+		return s, uint16(n)
+	}
+	a, portA := backend("a")
+	defer a.Close()
+	b, portB := backend("b")
+	defer b.Close()
+
+	var asked string
+	stubSRV(t, func(name string) ([]*net.SRV, error) {
+		asked = name
+		return []*net.SRV{{Target: "127.0.0.1.", Port: portB}, {Target: "127.0.0.1.", Port: portA}}, nil
+	})
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "prom", URL: "dnssrv+_web._tcp.prometheus.monitoring.svc"}}
+	p := NewChronoProxyWithConfig(config)
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/prom/api/v1/status/buildinfo", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: %d %s", i, w.Code, w.Body)
+		}
+	}
+	if asked != "_web._tcp.prometheus.monitoring.svc" {
+		t.Errorf("looked up %q", asked)
+	}
+	if len(hits) != 4 || hits[0] == hits[1] || hits[0] != hits[2] || hits[1] != hits[3] {
+		t.Errorf("requests should alternate between targets, got %v", hits)
+	}
+}
+
+func TestSRVPoolKeepsTargetsOnFailure(t *testing.T) {
+	answer := []*net.SRV{{Target: "prom-0.prom.", Port: 9090}, {Target: "prom-1.prom.", Port: 9090}}
+	var fail error
+	stubSRV(t, func(string) ([]*net.SRV, error) { return answer, fail })
+
+	pool, err := newSRVPool("dnssrv+https://_web._tcp.prom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := pool.refresh(context.Background()); !changed || err != nil {
+		t.Fatalf("first refresh: %v, %v", changed, err)
+	}
+	want := []string{"https://prom-0.prom:9090", "https://prom-1.prom:9090"}
+	if got := pool.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("targets = %v; want %v", got, want)
+	}
+	if changed, _ := pool.refresh(context.Background()); changed {
+		t.Error("same answer should not count as a change")
+	}
+
+	fail = errors.New("SERVFAIL")
+	if _, err := pool.refresh(context.Background()); err == nil {
+		t.Error("expected the lookup error")
+	}
+	fail, answer = nil, nil
+	if _, err := pool.refresh(context.Background()); err == nil {
+		t.Error("an empty answer should be an error, not an empty pool")
+	}
+	if got := pool.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("failed refreshes should keep %v, got %v", want, got)
+	}
+}
+
+func TestSRVUpstreamValidation(t *testing.T) {
+	for _, spec := range []string{"dnssrv+", "dnssrv+ftp://_x._tcp.prom", "dnssrv+prom:9090"} {
+		if err := validateUpstreams([]UpstreamConfig{{Name: "x", URL: spec}}); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestSRVUpstreamWithNoTargets(t *testing.T) {
+	stubSRV(t, func(string) ([]*net.SRV, error) { return nil, errors.New("NXDOMAIN") })
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "prom", URL: "dnssrv+_web._tcp.gone"}}
+	w := httptest.NewRecorder()
+	NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", "/prom/api/v1/query?query=up", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d; want 503", w.Code)
+	}
+}
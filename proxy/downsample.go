@@ -0,0 +1,185 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/downsample.go
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Downsampling - 30 days at 60s, five times over, is too many points 📉
+//
+// Grafana asking for a month at a one-minute step gets 43,200 points per
+// series per window, and then the synthetics on top. Browsers choke long
+// before the proxy does. Range queries can ask for fewer:
+//
+//   up{chrono_downsample="5m"}       average every 5m of points into one
+//   up{chrono_downsample="1h:max"}   or take the min or max instead
+//   up{chrono_downsample="off"}      leave this query alone
+//
+// Or set max_points_per_series and any range query that would return more
+// points per series than that is downsampled automatically, to the
+// smallest whole number of steps that fits, with downsample_function (avg
+// by default). The response's warnings say when that's happened.
+//
+// Downsampling is the very last thing: windows and synthetics are built at
+// full resolution, then every series is bucketed on the query's start, one
+// point per bucket, at the bucket's start. NaN points are skipped unless a
+// bucket has nothing else.
+
+const downsampleLabel = "chrono_downsample"
+
+var (
+	downsampleRegex     = regexp.MustCompile(`chrono_downsample="([^"]*)"`)
+	downsampleFunctions = map[string]bool{"avg": true, "min": true, "max": true}
+)
+
+// downsampleMode is how a query's points get thinned out.
+type downsampleMode struct {
+	off      bool          // chrono_downsample="off": not even automatically
+	interval time.Duration // 0 = only if max_points_per_series says so
+	fn       string        // avg, min or max
+}
+
+// parseDownsample reads "5m", "5m:max" or "off".
+func parseDownsample(spec, defaultFn string) (downsampleMode, error) {
+	if spec == "off" {
+		return downsampleMode{off: true}, nil
+	}
+	rng, fn, hasFn := strings.Cut(spec, ":")
+	mode := downsampleMode{fn: defaultFn}
+	if hasFn {
+		if !downsampleFunctions[fn] {
+			return downsampleMode{}, fmt.Errorf("want avg, min or max after the interval, got %q", fn)
+		}
+		mode.fn = fn
+	}
+	d, err := parsePromDuration(rng)
+	if err != nil || d < time.Second {
+		return downsampleMode{}, fmt.Errorf("want an interval like 5m (optionally 5m:max) or off, got %q", spec)
+	}
+	mode.interval = d
+	return mode, nil
+}
+
+// extractDownsample finds chrono_downsample in the query, stripping it out.
+func (p *ChronoProxy) extractDownsample(params url.Values) (downsampleMode, error) {
+	m := downsampleRegex.FindStringSubmatch(params.Get("query"))
+	stripLabelFromParam(params, "query", downsampleLabel)
+	if m == nil {
+		return downsampleMode{fn: p.downsampleFunction()}, nil
+	}
+	mode, err := parseDownsample(m[1], p.downsampleFunction())
+	if err != nil {
+		return downsampleMode{}, &badQueryError{msg: downsampleLabel + ": " + err.Error()}
+	}
+	return mode, nil
+}
+
+// downsampleFunction is downsample_function, avg when it isn't set.
+func (p *ChronoProxy) downsampleFunction() string {
+	if p.config.DownsampleFunction == "" {
+		return "avg"
+	}
+	return p.config.DownsampleFunction
+}
+
+// downsampleInterval is the bucket width for a range query, 0 for none:
+// the one asked for, or with max_points_per_series the fewest whole steps
+// that keep every series under it. auto says which.
+func (p *ChronoProxy) downsampleInterval(mode downsampleMode, params url.Values) (interval time.Duration, auto bool) {
+	if mode.off {
+		return 0, false
+	}
+	step, err := parsePromDuration(params.Get("step"))
+	if err != nil || step <= 0 {
+		return 0, false
+	}
+	if mode.interval > 0 {
+		if mode.interval <= step {
+			return 0, false
+		}
+		return mode.interval, false
+	}
+	max := p.config.MaxPointsPerSeries
+	if max <= 0 {
+		return 0, false
+	}
+	now := p.clock.Now()
+	span := time.Duration(parseTimeMs(params.Get("end"), now)-parseTimeMs(params.Get("start"), now)) * time.Millisecond
+	points := int64(span/step) + 1
+	if points <= int64(max) {
+		return 0, false
+	}
+	steps := (points + int64(max) - 1) / int64(max)
+	return time.Duration(steps) * step, true
+}
+
+// downsample buckets every series' points into intervals from grid's
+// origin and reduces each bucket with fn.
+func downsample(series []model.Series, grid synthGrid, fn string) {
+	for i := range series {
+		pts := series[i].Points
+		if len(pts) == 0 {
+			continue
+		}
+		out := pts[:0:0]
+		start := 0
+		for j := 1; j <= len(pts); j++ {
+			if j < len(pts) && grid.bucket(pts[j].T) == grid.bucket(pts[start].T) {
+				continue
+			}
+			out = append(out, model.Point{T: grid.bucket(pts[start].T), V: reducePoints(pts[start:j], fn)})
+			start = j
+		}
+		series[i].Points = out
+	}
+}
+
+// reducePoints is the avg, min or max of pts, ignoring NaN unless that's
+// all there is.
+func reducePoints(pts []model.Point, fn string) float64 {
+	var sum float64
+	n := 0
+	result := math.NaN()
+	for _, pt := range pts {
+		if math.IsNaN(pt.V) {
+			continue
+		}
+		switch {
+		case n == 0:
+			result = pt.V
+		case fn == "min":
+			result = math.Min(result, pt.V)
+		case fn == "max":
+			result = math.Max(result, pt.V)
+		}
+		sum += pt.V
+		n++
+	}
+	if fn == "avg" && n > 0 {
+		return sum / float64(n)
+	}
+	return result
+}
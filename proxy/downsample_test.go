@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestDownsample(t *testing.T) {
+	s := []model.Series{{Points: []model.Point{{T: 0, V: 1}, {T: 60000, V: 3}, {T: 120000, V: math.NaN()}, {T: 300000, V: 5}, {T: 360000, V: 7}}}}
+	downsample(s, synthGrid{stepMs: 300000}, "avg")
+	if len(s[0].Points) != 2 || s[0].Points[0] != (model.Point{T: 0, V: 2}) || s[0].Points[1] != (model.Point{T: 300000, V: 6}) {
+		t.Errorf("avg: %+v", s[0].Points)
+	}
+	if v := reducePoints([]model.Point{{V: math.NaN()}}, "max"); !math.IsNaN(v) {
+		t.Errorf("all NaN should stay NaN, got %v", v)
+	}
+	for _, bad := range []string{"5x", "5m:sum", "0s"} {
+		if _, err := parseDownsample(bad, "avg"); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestDownsampleQueries(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	var values []string
+	for i := 0; i < 10; i++ {
+		values = append(values, `[`+model.FormatValue(float64(1700000000+i*60))+`,"`+model.FormatValue(float64(i))+`"]`)
+	}
+	fake.Serve("/api/v1/query_range", 0, []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[`+strings.Join(values, ",")+`]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	type response struct {
+		Data struct {
+			Result []struct {
+				Values [][2]interface{} `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	query := func(p *ChronoProxy, q string) response {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query_range?start=1700000000&end=1700000540&step=60&query="+url.QueryEscape(q), nil))
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("bad response %q: %v", w.Body.String(), err)
+		}
+		return resp
+	}
+
+	resp := query(NewChronoProxy(), `up{chrono_timeframe="current",chrono_downsample="5m:max"}`)
+	if len(resp.Data.Result) != 1 || len(resp.Data.Result[0].Values) != 2 || resp.Data.Result[0].Values[0][1] != "4" || resp.Data.Result[0].Values[1][1] != "9" {
+		t.Errorf("5m:max: %+v", resp.Data.Result)
+	}
+
+	config := DefaultConfig
+	config.MaxPointsPerSeries = 4
+	p := NewChronoProxyWithConfig(config)
+	resp = query(p, `up{chrono_timeframe="current"}`)
+	if len(resp.Data.Result) != 1 || len(resp.Data.Result[0].Values) != 4 || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "downsampled to 3m0s (avg)") {
+		t.Errorf("automatic: %+v", resp)
+	}
+	if resp := query(p, `up{chrono_timeframe="current",chrono_downsample="off"}`); len(resp.Data.Result[0].Values) != 10 || resp.Warnings != nil {
+		t.Errorf("off: %+v", resp)
+	}
+}
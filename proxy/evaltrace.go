@@ -0,0 +1,188 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/evaltrace.go
+package proxy
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Evaluation trace - "what did it actually DO with my query?" 🧭
+//
+// _command="TRACE" answers as usual, plus a chrono_trace object next to
+// resultType/result listing what evaluate did, in order:
+//
+//   queued       waiting for a slot in the priority class's pool
+//   params       what was read off the request, and the query sent upstream
+//   selectors    every selector in the query as written, chrono labels and all
+//   fetch        one per window: the upstream URL, series back, how long
+//   reuse        instead of fetch, for a window that would have fetched the
+//                same URL as an earlier one (see coalesce.go)
+//   synthesize   building the synthetics, and how many series came out
+//   plugin       one per _plugin stage, with its series and duration
+//
+// It's the DebugMode log for one request, without needing to be the one
+// with access to the logs. Upstream URLs are scrubbed the way the upstream
+// request log scrubs them (see upstreamlog.go), but otherwise show the
+// query as Prometheus saw it. Nothing is recorded for requests that don't
+// ask.
+
+const traceCommand = "TRACE"
+
+// traceStage is one step of an evaluation.
+type traceStage struct {
+	Stage      string            `json:"stage"`
+	Window     string            `json:"window,omitempty"`
+	Plugin     string            `json:"plugin,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	Selectors  []string          `json:"selectors,omitempty"`
+	Series     *int              `json:"series,omitempty"`
+	DurationMs float64           `json:"duration_ms"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// traceReport is what goes out as chrono_trace.
+type traceReport struct {
+	Stages  []traceStage `json:"stages"`
+	TotalMs float64      `json:"total_ms"`
+}
+
+// evalTrace collects one request's stages. Everything on it is safe to
+// call on nil, and does nothing until on is called.
+type evalTrace struct {
+	mu     sync.Mutex
+	active bool
+	stages []traceStage
+	total  time.Duration
+}
+
+func (t *evalTrace) on() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active = true
+}
+
+func (t *evalTrace) enabled() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+// add records a stage that took d.
+func (t *evalTrace) add(st traceStage, d time.Duration) {
+	if !t.enabled() {
+		return
+	}
+	st.DurationMs = millis(d)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stages = append(t.stages, st)
+}
+
+// finish records how long the whole evaluation took.
+func (t *evalTrace) finish(d time.Duration) {
+	if !t.enabled() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total = d
+}
+
+// report is the chrono_trace to send, nil when nobody asked.
+func (t *evalTrace) report() *traceReport {
+	if !t.enabled() {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &traceReport{Stages: append([]traceStage{}, t.stages...), TotalMs: millis(t.total)}
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, t *evalTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+func traceFrom(ctx context.Context) *evalTrace {
+	t, _ := ctx.Value(traceKey{}).(*evalTrace)
+	return t
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func seriesCount(n int) *int {
+	return &n
+}
+
+// traceSelectors lists the selectors in query as written, metric name
+// included. A query the parser can't read is the error.
+func traceSelectors(query string) traceStage {
+	st := traceStage{Stage: "selectors"}
+	if _, err := parseQuery(query); err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	st.Selectors = selectorStrings(query)
+	return st
+}
+
+// traceParams is what evaluate made of the request: the non-empty entries
+// of parsed, and the upstream params (query, time, start, ...) as they'll
+// be sent.
+func traceParams(params url.Values, parsed map[string]string) traceStage {
+	st := traceStage{Stage: "params", Params: make(map[string]string)}
+	for k, v := range parsed {
+		if v != "" {
+			st.Params[k] = v
+		}
+	}
+	for k, vs := range params {
+		st.Params["upstream."+k] = strings.Join(vs, ",")
+	}
+	return st
+}
+
+// traceFetch records one window's fetch from u, already scrubbed.
+func traceFetch(ctx context.Context, tf, u string, series []model.Series, err error, d time.Duration) {
+	st := traceStage{Stage: "fetch", Window: tf, URL: u, Series: seriesCount(len(series))}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	traceFrom(ctx).add(st, d)
+}
+
+// traceReuse records a window answered from an earlier window's fetch of u.
+func traceReuse(ctx context.Context, tf, u string, series []model.Series) {
+	traceFrom(ctx).add(traceStage{Stage: "reuse", Window: tf, URL: u, Series: seriesCount(len(series))}, 0)
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestTraceCommand(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxy()
+
+	query := func(q string) (int, map[string]json.RawMessage) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(q), nil))
+		var resp struct {
+			Data map[string]json.RawMessage `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data
+	}
+
+	code, data := query(`sum(up{job="a",_command="TRACE"})`)
+	if code != 200 {
+		t.Fatalf("status %d", code)
+	}
+	var trace traceReport
+	if err := json.Unmarshal(data["chrono_trace"], &trace); err != nil {
+		t.Fatalf("no chrono_trace: %v", err)
+	}
+	byStage := map[string][]traceStage{}
+	for _, st := range trace.Stages {
+		byStage[st.Stage] = append(byStage[st.Stage], st)
+	}
+	if sels := byStage["selectors"]; len(sels) != 1 || strings.Join(sels[0].Selectors, " ") != `up{job="a",_command="TRACE"}` {
+		t.Errorf("selectors = %+v", sels)
+	}
+	if params := byStage["params"]; len(params) != 1 || params[0].Params["command"] != traceCommand || params[0].Params["upstream.query"] != `sum(up{job="a"})` {
+		t.Errorf("params = %+v", params)
+	}
+	fetches := byStage["fetch"]
+	if len(fetches) != len(p.windows()) {
+		t.Fatalf("%d fetch stages; want one per window", len(fetches))
+	}
+	for _, f := range fetches {
+		if f.Series == nil || *f.Series != 1 || !strings.HasPrefix(f.URL, fake.URL+"/api/v1/query?") || f.Window == "" {
+			t.Errorf("fetch = %+v", f)
+		}
+	}
+	if synth := byStage["synthesize"]; len(synth) != 1 || synth[0].Series == nil || *synth[0].Series == 0 {
+		t.Errorf("synthesize = %+v", synth)
+	}
+	if len(byStage["queued"]) != 1 {
+		t.Errorf("queued = %+v", byStage["queued"])
+	}
+
+	if _, data := query(`sum(up{job="a"})`); data["chrono_trace"] != nil {
+		t.Error("chrono_trace without _command=\"TRACE\"")
+	}
+}
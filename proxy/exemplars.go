@@ -0,0 +1,167 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/exemplars.go
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Exemplars - the trace IDs hiding behind the dots on a graph 🔗
+//
+// Grafana asks /api/v1/query_exemplars alongside a query so it can draw
+// "jump to trace" markers. Passed straight through, the chrono labels in
+// the query confuse the upstream and the answer doesn't line up with our
+// series, so we handle it ourselves:
+//
+//   - by default it's the current window: the query is cleaned up, and the
+//     series come back labelled chrono_timeframe="current" so Grafana can
+//     match them to the current line
+//   - with chrono_timeframe="7days" (or any other raw or ad-hoc window) we
+//     ask for that stretch of the past instead and move the exemplars
+//     forward, so last week's traces sit on last week's line
+//
+// Synthetic timeframes have no traces behind them and get an empty answer,
+// as do upstreams that turned out not to have an exemplar API (see
+// capabilities.go). Anything else the upstream says goes back as it came.
+
+const exemplarsPath = "/api/v1/query_exemplars"
+
+// exemplarSeries is one series' worth of exemplars, as Prometheus sends it.
+type exemplarSeries struct {
+	SeriesLabels map[string]string `json:"seriesLabels"`
+	Exemplars    []exemplar        `json:"exemplars"`
+}
+
+type exemplar struct {
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp json.Number       `json:"timestamp"` // Unix seconds, fractions welcome
+}
+
+// exemplarsUnsupported is whether probing found no exemplar API upstream.
+func exemplarsUnsupported(caps *capabilities) bool {
+	return caps.known() && !caps.Exemplars
+}
+
+// handleExemplars serves /api/v1/query_exemplars for one window.
+func (p *ChronoProxy) handleExemplars(w http.ResponseWriter, r *http.Request, upstream, suffix string) {
+	if DebugMode.Load() {
+		log.Printf("[DEBUG] handleExemplars: %s %s", r.Method, r.URL.Path)
+	}
+	empty := map[string]interface{}{"status": "success", "data": []exemplarSeries{}}
+	if exemplarsUnsupported(capabilitiesFrom(r.Context())) {
+		writeJSONRaw(w, empty)
+		return
+	}
+
+	params := parseClientParams(r)
+	tf, _ := extractSelectors(params)
+	win, ok := p.exemplarWindow(tf)
+	if !ok {
+		writeJSONRaw(w, empty)
+		return
+	}
+	stripLabelFromParam(params, "query", "chrono_timeframe")
+	stripLabelFromParam(params, "query", "_command")
+	stripLabelFromParam(params, "query", pluginLabelName)
+	stripLabelFromParam(params, "query", pluginArgsLabelName)
+
+	q := maps.Clone(params)
+	now := p.clock.Now()
+	for _, k := range []string{"start", "end"} {
+		if v := params.Get(k); v != "" {
+			q.Set(k, model.FormatTimestamp(win.back(parseTimeMs(v, now))))
+		}
+	}
+
+	resp, err := p.getUpstream(r.Context(), upstream+suffix+"?"+buildQueryString(q))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "unavailable", "upstream request failed: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "unavailable", "upstream request failed: "+err.Error())
+		return
+	}
+
+	var out struct {
+		Status string           `json:"status"`
+		Data   []exemplarSeries `json:"data"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if resp.StatusCode != http.StatusOK || dec.Decode(&out) != nil || out.Status != "success" {
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+
+	for i := range out.Data {
+		s := &out.Data[i]
+		if s.SeriesLabels == nil {
+			s.SeriesLabels = map[string]string{}
+		}
+		s.SeriesLabels["chrono_timeframe"] = win.name
+		if win.offset == 0 {
+			continue
+		}
+		for j := range s.Exemplars {
+			secs, err := s.Exemplars[j].Timestamp.Float64()
+			if err != nil {
+				continue
+			}
+			s.Exemplars[j].Timestamp = json.Number(model.FormatTimestamp(win.forward(model.ParseTimestamp(secs))))
+		}
+	}
+	if out.Data == nil {
+		out.Data = []exemplarSeries{}
+	}
+	writeJSONRaw(w, out)
+}
+
+// exemplarWindow picks the window a chrono_timeframe asks for: current
+// when there isn't one, nothing for synthetics or disabled windows.
+func (p *ChronoProxy) exemplarWindow(tf string) (window, bool) {
+	if tf == "" {
+		tf = p.timeframes[0]
+	}
+	if _, off := p.disabled.get(tf); off {
+		return window{}, false
+	}
+	for _, win := range p.windows() {
+		if win.name == tf {
+			return win, true
+		}
+	}
+	if isSyntheticTimeframe(tf) {
+		return window{}, false
+	}
+	win, ok := adHocWindow(tf)
+	win.loc = p.location
+	return win, ok
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestExemplarsShiftedPerWindow(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve(exemplarsPath, 0, []byte(`{"status":"success","data":[{"seriesLabels":{"__name__":"rpc_seconds_bucket"},"exemplars":[{"labels":{"trace_id":"abc"},"value":"0.25","timestamp":1699395200.479}]}]}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxyWithConfig(DefaultConfig)
+
+	type response struct {
+		Status string           `json:"status"`
+		Data   []exemplarSeries `json:"data"`
+	}
+	ask := func(query string) response {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+exemplarsPath+"?query="+url.QueryEscape(query)+"&start=1700000000&end=1700003600", nil))
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%q: %v: %s", query, err, w.Body.String())
+		}
+		return resp
+	}
+
+	resp := ask(`rpc_seconds_bucket`)
+	if len(resp.Data) != 1 || resp.Data[0].SeriesLabels["chrono_timeframe"] != "current" {
+		t.Fatalf("current: %+v", resp)
+	}
+	if ts := resp.Data[0].Exemplars[0].Timestamp; ts != "1699395200.479" {
+		t.Errorf("current window timestamps shouldn't move, got %s", ts)
+	}
+
+	resp = ask(`rpc_seconds_bucket{chrono_timeframe="7days"}`)
+	if len(resp.Data) != 1 || resp.Data[0].SeriesLabels["chrono_timeframe"] != "7days" {
+		t.Fatalf("7days: %+v", resp)
+	}
+	if ts := resp.Data[0].Exemplars[0].Timestamp; ts != "1700000000.479" {
+		t.Errorf("7days exemplar should move forward a week, got %s", ts)
+	}
+	last := fake.Requests()[len(fake.Requests())-1]
+	if last.Params.Get("start") != "1699395200" || last.Params.Get("end") != "1699398800" {
+		t.Errorf("7days asked for %s..%s, want a week back", last.Params.Get("start"), last.Params.Get("end"))
+	}
+	if q := last.Params.Get("query"); strings.Contains(q, "chrono_timeframe") {
+		t.Errorf("chrono_timeframe reached the upstream: %s", q)
+	}
+
+	calls := len(fake.Requests())
+	if resp := ask(`rpc_seconds_bucket{chrono_timeframe="lastMonthAverage"}`); resp.Status != "success" || len(resp.Data) != 0 {
+		t.Errorf("synthetic: %+v", resp)
+	}
+	if len(fake.Requests()) != calls {
+		t.Error("a synthetic timeframe shouldn't ask the upstream anything")
+	}
+}
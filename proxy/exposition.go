@@ -0,0 +1,170 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/exposition.go
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// /metrics - Chronotheus, as seen by Prometheus!
+// Point a scrape job at http://<chronotheus>:8080/metrics and you get the
+// proxy's own vital signs in the plain-text exposition format:
+//
+//   - chronotheus_requests_total / _request_errors_total / _requests_in_flight
+//   - chronotheus_request_duration_seconds{endpoint}: whole requests, per route (see amplification.go)
+//   - chronotheus_window_fetch_duration_seconds{timeframe}: fetch+decode per window
+//   - chronotheus_window_response_bytes{timeframe} / _window_series{timeframe}: how big each window's answer was
+//   - chronotheus_upstream_errors_total{upstream,kind}: transport, status_4xx, status_5xx, response
+//   - chronotheus_upstream_phase_duration_seconds{upstream,phase}: see upstream_trace.go
+//   - chronotheus_cache_requests_total{cache,result}: hits and misses, for hit ratios
+//   - chronotheus_plugin_duration_seconds{plugin}: time spent inside plugins
+//   - chronotheus_plugin_errors_total{plugin}: plugin runs that failed
+//   - chronotheus_rejected_requests_total{reason}: 429s handed out (see backpressure.go), plus upstream_busy 503s (see ratelimit.go)
+//   - chronotheus_timeframe_requests_total{timeframe}: queries per requested chrono_timeframe (see usage.go)
+//   - chronotheus_request_amplification{endpoint}: upstream requests per client request (see amplification.go)
+//   - chronotheus_coalesced_fetches_total: window fetches that shared an identical one already in flight (see coalesce.go)
+//   - chronotheus_response_limit_hits_total{limit}: queries stopped by max_response_* (see limits.go)
+//   - chronotheus_mirror_comparisons_total{upstream,result}: mirror match/mismatch/error/skipped (see mirror.go)
+//   - chronotheus_dashboard_*{dashboard,panel}: requests, latency, bytes and series per Grafana panel (see dashboards.go)
+//   - chronotheus_trace_spans_dropped_total: spans the exporter couldn't keep up with (see tracing.go)
+//   - chronotheus_audit_records_dropped_total: audit records the webhook couldn't keep up with (see audit.go)
+//   - chronotheus_authorization_decisions_total{decision}: allow, deny or error from the authorization hook (see authz.go)
+//
+// Like the admin endpoints, it lives outside the upstream prefixes, so "metrics" can't be
+// an upstream name.
+
+const metricsPath = "/metrics"
+
+// handleMetrics writes everything we know in exposition format 0.0.4.
+func (p *ChronoProxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.writeMetrics(w)
+}
+
+func (p *ChronoProxy) writeMetrics(out io.Writer) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	m := p.GetMetrics()
+	writeScalar(w, "chronotheus_requests_total", "counter", "Requests handled.", float64(m.RequestCount))
+	writeScalar(w, "chronotheus_request_errors_total", "counter", "Requests that failed before reaching a handler.", float64(m.ErrorCount))
+	writeScalar(w, "chronotheus_requests_in_flight", "gauge", "Requests being handled right now.", float64(atomic.LoadInt64(&p.metrics.RequestsInFlight)))
+	writeScalar(w, "chronotheus_request_duration_average_seconds", "gauge", "Running average request duration.", m.AverageLatency)
+
+	writeHistograms(w, "chronotheus_request_duration_seconds", "Request duration by endpoint.", m.RequestDurations)
+
+	writeHistograms(w, "chronotheus_window_fetch_duration_seconds", "Time to fetch and decode one timeframe window.", m.WindowFetches)
+	writeHistograms(w, "chronotheus_window_response_bytes", "Upstream response size for one timeframe window.", m.WindowBytes)
+	writeHistograms(w, "chronotheus_window_series", "Series fetched for one timeframe window.", m.WindowSeries)
+	writeCounters(w, "chronotheus_upstream_errors_total", "Failed upstream fetches by kind.", p.upstreamErrors.snapshot())
+	writeHistograms(w, "chronotheus_upstream_phase_duration_seconds", "Upstream request time by phase.", p.upstreamPhases.snapshot())
+	writeCounters(w, "chronotheus_cache_requests_total", "Cache lookups by result (hit or miss).", p.cacheLookups.snapshot())
+	writeHistograms(w, "chronotheus_plugin_duration_seconds", "Time spent running plugins.", p.pluginRuns.snapshot())
+	writeCounters(w, "chronotheus_plugin_errors_total", "Plugin runs that returned an error.", p.pluginErrors.snapshot())
+	writeCounters(w, "chronotheus_rejected_requests_total", "Requests turned away with 429 (or 503 when upstreams are busy) by reason.", p.rejections.snapshot())
+	writeCounters(w, "chronotheus_timeframe_requests_total", "Queries by requested chrono_timeframe (all = none given).", p.timeframeRequests.snapshot())
+	writeHistograms(w, "chronotheus_request_amplification", "Upstream requests made per client request.", p.amplification.snapshot())
+	writeCounters(w, "chronotheus_response_limit_hits_total", "Queries stopped for going over a max_response_* limit, by limit.", p.responseLimits.snapshot())
+	writeScalar(w, "chronotheus_coalesced_fetches_total", "counter", "Window fetches that waited on an identical fetch already in flight instead of making their own.", float64(p.coalescer.sharedFetches()))
+	writeCounters(w, "chronotheus_chaos_faults_total", "Faults injected into upstream fetches by chaos mode, by kind.", p.chaos.snapshot())
+	writeCounters(w, "chronotheus_mirror_comparisons_total", "Mirrored window fetches by outcome.", p.mirrorComparisons.snapshot())
+	writeScalar(w, "chronotheus_trace_spans_dropped_total", "counter", "Trace spans dropped because the export queue was full.", float64(p.tracer.droppedSpans()))
+	writeCounters(w, "chronotheus_authorization_decisions_total", "Answers from the authorization hook: allow, deny or error.", p.authzDecisions.snapshot())
+	writeScalar(w, "chronotheus_audit_records_dropped_total", "counter", "Audit records not sent to audit_webhook because its queue was full.", float64(p.audit.droppedRecords()))
+	writeCounters(w, "chronotheus_dashboard_requests_total", "Requests per Grafana dashboard and panel.", p.dashboards.requests.snapshot())
+	writeHistograms(w, "chronotheus_dashboard_request_duration_seconds", "Request duration per Grafana dashboard and panel.", p.dashboards.duration.snapshot())
+	writeHistograms(w, "chronotheus_dashboard_response_bytes", "Response size per Grafana dashboard and panel.", p.dashboards.bytes.snapshot())
+	writeHistograms(w, "chronotheus_dashboard_response_series", "Series per query response per Grafana dashboard and panel.", p.dashboards.series.snapshot())
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeScalar(w io.Writer, name, typ, help string, v float64) {
+	writeHeader(w, name, typ, help)
+	fmt.Fprintf(w, "%s %s\n", name, model.FormatValue(v))
+}
+
+func writeCounters(w io.Writer, name, help string, snaps []CounterSnapshot) {
+	writeHeader(w, name, "counter", help)
+	for _, s := range snaps {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(s.Labels), s.Value)
+	}
+}
+
+func writeHistograms(w io.Writer, name, help string, snaps []HistogramSnapshot) {
+	writeHeader(w, name, "histogram", help)
+	for _, s := range snaps {
+		for i, le := range s.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(s.Labels, "le", model.FormatValue(le)), s.Counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(s.Labels, "le", "+Inf"), s.Count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(s.Labels), model.FormatValue(s.Sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(s.Labels), s.Count)
+	}
+}
+
+// labelValueEscaper handles the only three escapes the text format knows.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders {a="1",b="2"} with keys sorted and values escaped;
+// extra is appended as name/value pairs (for "le").
+func formatLabels(labels map[string]string, extra ...string) string {
+	if len(labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	pair := func(k, v string) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteByte('"')
+		labelValueEscaper.WriteString(&b, v)
+		b.WriteByte('"')
+	}
+	for _, k := range keys {
+		pair(k, labels[k])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pair(extra[i], extra[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
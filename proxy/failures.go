@@ -0,0 +1,169 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/failures.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Failed windows - say so, don't just shrug 🚨
+//
+// A window that can't be fetched (the upstream is down, times out, sends
+// back something that isn't Prometheus JSON, or answers with a Prometheus
+// error) is left out of the answer, and the rest still comes back - one
+// slow week shouldn't blank a dashboard. But the response's warnings say
+// which window went missing and why, so a lastMonthAverage over three
+// weeks instead of four doesn't pass for the real thing. Grafana shows
+// them on the panel.
+//
+// Strict mode turns any failed window into a failed query instead (502),
+// for alerting and reports where a partial answer is worse than none. Set
+// strict_windows: true for everything, or chrono_strict=true (or false) on
+// one request. A window served from the stale cache (see stale.go) hasn't
+// failed - that's what stale_on_error was asked for.
+
+const strictParam = "chrono_strict"
+
+// upstreamError is a proper Prometheus error answer, {"status": "error"}.
+// The upstream is up, it just said no, so there's no stale copy to serve.
+type upstreamError struct {
+	errType string
+	msg     string
+}
+
+func (e *upstreamError) Error() string {
+	if e.errType == "" {
+		return e.msg
+	}
+	return e.errType + ": " + e.msg
+}
+
+// windowFailure is one window that came back with nothing.
+type windowFailure struct {
+	tf  string
+	err error
+}
+
+// windowFailures collects the windows of one evaluation that failed.
+type windowFailures struct {
+	mu   sync.Mutex
+	list []windowFailure
+}
+
+// add is safe to call on nil.
+func (f *windowFailures) add(tf string, err error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.list = append(f.list, windowFailure{tf, err})
+}
+
+// take returns what's been collected so far and starts over.
+func (f *windowFailures) take() []windowFailure {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.list
+	f.list = nil
+	return out
+}
+
+type windowFailuresKey struct{}
+
+func withWindowFailures(ctx context.Context, f *windowFailures) context.Context {
+	return context.WithValue(ctx, windowFailuresKey{}, f)
+}
+
+func windowFailuresFrom(ctx context.Context) *windowFailures {
+	f, _ := ctx.Value(windowFailuresKey{}).(*windowFailures)
+	return f
+}
+
+// windowFailed records that tf came back with nothing, and says so in the
+// response's warnings.
+func windowFailed(ctx context.Context, tf string, err error) {
+	warningsFrom(ctx).add(fmt.Sprintf("window %s left out: %v", tf, err))
+	windowFailuresFrom(ctx).add(tf, err)
+}
+
+// windowsFailedError is a strict query's answer to failed windows.
+type windowsFailedError struct {
+	failures []windowFailure
+}
+
+func (e *windowsFailedError) Error() string {
+	sort.Slice(e.failures, func(i, j int) bool { return e.failures[i].tf < e.failures[j].tf })
+	parts := make([]string, len(e.failures))
+	for i, f := range e.failures {
+		parts[i] = fmt.Sprintf("%s (%v)", f.tf, f.err)
+	}
+	return "strict mode: windows failed: " + strings.Join(parts, ", ")
+}
+
+// strictMode says whether this query fails on a failed window, taking
+// chrono_strict out of params.
+func (p *ChronoProxy) strictMode(params url.Values) (bool, error) {
+	raw := params.Get(strictParam)
+	params.Del(strictParam)
+	if raw == "" {
+		return p.config.StrictWindows, nil
+	}
+	strict, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, &badQueryError{msg: fmt.Sprintf("%s should be true or false, got %q", strictParam, raw)}
+	}
+	return strict, nil
+}
+
+// windowFetcher is fetchWindowsInstant or fetchWindowsRange.
+type windowFetcher func(ctx context.Context, p *ChronoProxy, wins []window, params url.Values, endpoint, command string) ([]model.Series, error)
+
+// strictly wraps fetch so that any window failing fails the lot.
+func strictly(fetch windowFetcher) windowFetcher {
+	return func(ctx context.Context, p *ChronoProxy, wins []window, params url.Values, endpoint, command string) ([]model.Series, error) {
+		failures := &windowFailures{}
+		all, err := fetch(withWindowFailures(ctx, failures), p, wins, params, endpoint, command)
+		if err != nil {
+			return nil, err
+		}
+		if failed := failures.take(); len(failed) > 0 {
+			return nil, &windowsFailedError{failures: failed}
+		}
+		return all, nil
+	}
+}
+
+// isUpstreamError says whether err is the upstream answering with an error,
+// as opposed to not answering properly at all.
+func isUpstreamError(err error) bool {
+	var ue *upstreamError
+	return errors.As(err, &ue)
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestFailedWindowsAreReported(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	const at = 1700000000
+	ok := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[1700000000,"1"]]}]}}`
+	fake.Serve("/api/v1/query_range", at, []byte(ok))
+	fake.Serve("/api/v1/query_range", at-7*86400, []byte(`not json`))
+	fake.Serve("/api/v1/query_range", at-14*86400, []byte(`{"status":"error","errorType":"execution","error":"query timed out"}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	query := func(config Config, extra string) (*httptest.ResponseRecorder, []string) {
+		w := httptest.NewRecorder()
+		NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query_range?query=up&start=1700000000&end=1700000000&step=60"+extra, nil))
+		var resp struct {
+			Warnings []string `json:"warnings"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp.Warnings
+	}
+
+	w, warnings := query(DefaultConfig, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	joined := strings.Join(warnings, "\n")
+	if len(warnings) != 2 || !strings.Contains(joined, "window 7days left out") || !strings.Contains(joined, "window 14days left out: execution: query timed out") {
+		t.Errorf("warnings = %q", warnings)
+	}
+
+	if w, _ := query(DefaultConfig, "&chrono_strict=true"); w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "14days (execution: query timed out)") {
+		t.Errorf("chrono_strict=true: status %d %s", w.Code, w.Body.String())
+	}
+	strict := DefaultConfig
+	strict.StrictWindows = true
+	if w, _ := query(strict, ""); w.Code != http.StatusBadGateway {
+		t.Errorf("strict_windows: status %d", w.Code)
+	}
+	if w, _ := query(strict, "&chrono_strict=false"); w.Code != http.StatusOK {
+		t.Errorf("chrono_strict=false should win over the config: status %d", w.Code)
+	}
+	if w, _ := query(DefaultConfig, "&chrono_strict=maybe"); w.Code != http.StatusBadRequest {
+		t.Errorf("chrono_strict=maybe: status %d", w.Code)
+	}
+}
@@ -0,0 +1,181 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/fanout.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Virtual upstreams - one name, several Prometheus servers 🐙
+//
+// An HA pair scrapes the same targets twice, and a fleet split by region
+// has a different slice of the world in each. Either way, the question you
+// want answered is about all of them. A virtual upstream lists other
+// upstreams instead of a URL:
+//
+//   upstreams:
+//     - name: eu-a
+//       url: http://prom-eu-a:9090
+//     - name: eu-b
+//       url: http://prom-eu-b:9090
+//     - name: eu
+//       members: [eu-a, eu-b]
+//
+// /eu/api/v1/query and /eu/api/v1/query_range ask every member for every
+// window, then merge what comes back: series with the same signature become
+// one, and where both sides have a point at the same timestamp the earlier
+// member in the list wins. So a gap in eu-a (a restart, a scrape miss) is
+// filled in from eu-b, and regions simply add up. Only after that do the
+// averages and comparisons happen, so they see one clean fleet.
+//
+// A member that fails is a warning, not an error - that's the point of a
+// pair. Everything else (labels, metadata, ...) goes to the first member.
+// Members have to be plain upstreams from the config file.
+
+// fetchSeries fetches u and decodes it, with the upstream's params added
+// (see capabilities.go) and blips retried (see retry.go). For a virtual
+// upstream it's done once per member and the answers merged; only when
+// every member fails is there an error.
+func (p *ChronoProxy) fetchSeries(ctx context.Context, u string, timeout time.Duration, limit int64, decode func(context.Context, io.Reader) ([]model.Series, error)) ([]model.Series, error) {
+	fetch := func(ctx context.Context, u string) (series []model.Series, err error) {
+		err = p.withRetries(ctx, func() error {
+			return p.fetchStream(ctx, u, timeout, limit, func(r io.Reader) (err error) {
+				series, err = decode(ctx, r)
+				return err
+			})
+		})
+		return series, err
+	}
+	virtual := upstreamFrom(ctx)
+	if virtual == nil || len(virtual.members) == 0 {
+		return fetch(ctx, virtual.withParams(u)) // not virtual after all
+	}
+
+	_, rest, _ := strings.Cut(u, "/api/v1/")
+	results := make([][]model.Series, len(virtual.members))
+	errs := make([]error, len(virtual.members))
+	var wg sync.WaitGroup
+	for i, member := range virtual.members {
+		wg.Add(1)
+		go func(i int, member *upstream) {
+			defer wg.Done()
+			base, err := member.target(ctx)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i], errs[i] = fetch(withUpstream(ctx, member), member.withParams(base+"/api/v1/"+rest))
+		}(i, member)
+	}
+	wg.Wait()
+
+	var answered [][]model.Series
+	var firstErr error
+	for i, err := range errs {
+		if err != nil {
+			warningsFrom(ctx).add(fmt.Sprintf("upstream %s (part of %s) failed: %v", virtual.members[i].name, virtual.name, err))
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		answered = append(answered, results[i])
+	}
+	if answered == nil {
+		return nil, firstErr
+	}
+	return mergeSeries(answered), nil
+}
+
+// mergeSeries folds several answers to the same question into one: a
+// series per signature, its points the union of everyone's, earlier
+// answers winning where two have the same timestamp. Each answer's points
+// are already in time order, so they're zipped together with
+// model.MergePoints rather than pooled and sorted again.
+func mergeSeries(answers [][]model.Series) []model.Series {
+	var out []model.Series
+	var points [][][]model.Point
+	index := make(map[string]int)
+	for _, answer := range answers {
+		for _, s := range answer {
+			key := signature(s.Labels)
+			i, seen := index[key]
+			if !seen {
+				index[key] = len(out)
+				out = append(out, s)
+				points = append(points, [][]model.Point{s.Points})
+				continue
+			}
+			points[i] = append(points[i], s.Points)
+		}
+	}
+	for i := range out {
+		if len(points[i]) > 1 {
+			out[i].Points = model.MergePoints(points[i]...)
+		}
+	}
+	return out
+}
+
+// newVirtualUpstream builds a virtual upstream from c, whose members must
+// already be in r.
+func newVirtualUpstream(c UpstreamConfig, r *upstreamRegistry) (*upstream, error) {
+	u, err := newUpstream(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range c.Members {
+		member, ok := r.get(name)
+		if !ok || len(member.members) > 0 {
+			return nil, fmt.Errorf("upstream %q: member %q isn't a plain upstream from the config file", c.Name, name)
+		}
+		u.members = append(u.members, member)
+	}
+	return u, nil
+}
+
+// validateMembers checks a virtual upstream only names plain upstreams
+// defined alongside it.
+func validateMembers(cfgs []UpstreamConfig) error {
+	plain := make(map[string]bool, len(cfgs))
+	for _, c := range cfgs {
+		if len(c.Members) == 0 {
+			plain[c.Name] = true
+		}
+	}
+	for _, c := range cfgs {
+		seen := make(map[string]bool, len(c.Members))
+		for _, name := range c.Members {
+			if !plain[name] {
+				return fmt.Errorf("upstream %q: member %q isn't a plain upstream from the config file", c.Name, name)
+			}
+			if seen[name] {
+				return fmt.Errorf("upstream %q: member %q listed twice", c.Name, name)
+			}
+			seen[name] = true
+		}
+	}
+	return nil
+}
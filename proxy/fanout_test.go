@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestVirtualUpstreamMergesMembers(t *testing.T) {
+	a, b := fixtures.NewFakePrometheus(), fixtures.NewFakePrometheus()
+	defer a.Close()
+	a.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","instance":"x"},"value":[1700000000,"1"]}]}}`))
+	b.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","instance":"x"},"value":[1700000000,"2"]},{"metric":{"__name__":"up","instance":"y"},"value":[1700000000,"3"]}]}}`))
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{
+		{Name: "a", URL: a.URL},
+		{Name: "b", URL: b.URL},
+		{Name: "both", Members: []string{"a", "b"}},
+	}
+	p := NewChronoProxyWithConfig(config)
+
+	type response struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []interface{}     `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	query := func() response {
+		t.Helper()
+		w := httptest.NewRecorder()
+		q := url.QueryEscape(`up{chrono_timeframe="current"}`)
+		p.ServeHTTP(w, httptest.NewRequest("GET", "/both/api/v1/query?time=1700000000&query="+q, nil))
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%v: %s", err, w.Body.String())
+		}
+		return resp
+	}
+
+	resp := query()
+	got := map[string]interface{}{}
+	for _, s := range resp.Data.Result {
+		got[s.Metric["instance"]] = s.Value[1]
+	}
+	if len(resp.Data.Result) != 2 || got["x"] != "1" || got["y"] != "3" {
+		t.Errorf("want x from a (the first member) and y from b, got %+v", resp.Data.Result)
+	}
+	if len(a.Requests()) != 1 || len(b.Requests()) != 1 {
+		t.Errorf("each member should be asked once, a=%d b=%d", len(a.Requests()), len(b.Requests()))
+	}
+
+	b.Close()
+	resp = query()
+	if len(resp.Data.Result) != 1 || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "upstream b (part of both)") {
+		t.Errorf("with b down: %+v", resp)
+	}
+}
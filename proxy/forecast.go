@@ -0,0 +1,105 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/forecast.go
+package proxy
+
+import (
+	"sort"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// forecastNextWeek - "next Tuesday will look like last Tuesday" 🔮
+//
+// The seasonal naive forecast: the value at any moment is whatever was
+// recorded at the same weekday and time of day most recently. It's the
+// baseline every fancier forecast has to beat, and it often doesn't, for
+// the price of a lookup - no plugin needed.
+//
+// Only past windows a whole number of weeks back take part, nearest first:
+// each point comes from 7days if 7days has one there, else 14days, and so
+// on. A range query reaching into the coming week gets its forecast from
+// the week before, which has happened; for times already gone it's the
+// forecast that would have been made a week ago, to hold up against
+// current. Timestamps no weekly window has a value for are left out.
+
+const forecastNextWeekName = "forecastNextWeek"
+
+const secondsPerWeek = 7 * 24 * 60 * 60
+
+// weeklyWindows is wins whole weeks back, nearest first.
+func weeklyWindows(wins []window) []window {
+	var out []window
+	for _, win := range wins {
+		if win.offset > 0 && win.offset%secondsPerWeek == 0 {
+			out = append(out, win)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].offset < out[j].offset })
+	return out
+}
+
+// buildForecastNextWeek builds forecastNextWeek series from the weekly
+// windows in seriesList.
+func buildForecastNextWeek(seriesList []model.Series, wins []window, isRange bool, grid synthGrid) []model.Series {
+	weekly := weeklyWindows(wins)
+	rank := make(map[string]int, len(weekly))
+	for i, win := range weekly {
+		rank[win.name] = i
+	}
+
+	type pick struct {
+		v    float64
+		rank int
+	}
+	groups := make(map[string]map[int64]pick)
+	labels := make(map[string]map[string]string)
+	for _, s := range seriesList {
+		r, ok := rank[s.Labels["chrono_timeframe"]]
+		if !ok {
+			continue
+		}
+		sig := signature(s.Labels)
+		if groups[sig] == nil {
+			groups[sig] = make(map[int64]pick)
+			labels[sig] = s.Labels
+		}
+		for _, pt := range s.Points {
+			at := grid.bucket(pt.T)
+			if have, ok := groups[sig][at]; !ok || r < have.rank {
+				groups[sig][at] = pick{v: pt.V, rank: r}
+			}
+		}
+	}
+
+	var out []model.Series
+	for sig, picks := range groups {
+		pts := make([]model.Point, 0, len(picks))
+		for at, pk := range picks {
+			pts = append(pts, model.Point{T: at, V: pk.v})
+		}
+		sort.Slice(pts, func(i, j int) bool { return pts[i].T < pts[j].T })
+		if !isRange {
+			pts = pts[len(pts)-1:]
+		}
+		metric := copyMetric(labels[sig])
+		delete(metric, "_command")
+		metric["chrono_timeframe"] = forecastNextWeekName
+		out = append(out, model.Series{Labels: metric, Points: pts})
+	}
+	return out
+}
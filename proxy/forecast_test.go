@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestForecastNextWeek(t *testing.T) {
+	const day = 86400
+	series := func(tf string, pts ...model.Point) model.Series {
+		return model.Series{Labels: map[string]string{"__name__": "up", "chrono_timeframe": tf}, Points: pts}
+	}
+	wins := []window{{name: "current"}, {name: "14days", offset: 14 * day}, {name: "10days", offset: 10 * day}, {name: "7days", offset: 7 * day}}
+	in := []model.Series{
+		series("current", model.Point{T: 60000, V: 1}, model.Point{T: 120000, V: 1}),
+		// Next week hasn't happened in 7days yet past the first minute
+		series("7days", model.Point{T: 60000, V: 7}),
+		series("10days", model.Point{T: 60000, V: 10}, model.Point{T: 120000, V: 10}, model.Point{T: 180000, V: 10}),
+		series("14days", model.Point{T: 60000, V: 14}, model.Point{T: 120000, V: 14}),
+	}
+
+	out := buildForecastNextWeek(in, wins, true, minuteGrid)
+	if len(out) != 1 || out[0].Labels["chrono_timeframe"] != forecastNextWeekName {
+		t.Fatalf("got %+v", out)
+	}
+	// Nearest weekly window first; 10days isn't a whole number of weeks
+	want := []model.Point{{T: 60000, V: 7}, {T: 120000, V: 14}}
+	if len(out[0].Points) != len(want) || out[0].Points[0] != want[0] || out[0].Points[1] != want[1] {
+		t.Errorf("points = %+v; want %+v", out[0].Points, want)
+	}
+
+	if inst := buildForecastNextWeek(in, wins, false, minuteGrid); len(inst) != 1 || len(inst[0].Points) != 1 || inst[0].Points[0] != want[1] {
+		t.Errorf("instant = %+v", inst)
+	}
+	if out := buildForecastNextWeek(in, []window{{name: "current"}, {name: "10days", offset: 10 * day}}, true, minuteGrid); len(out) != 0 {
+		t.Errorf("no weekly windows: %+v", out)
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Fuzz targets for everything that chews on untrusted input - selectors
+// from clients and response bodies from upstreams. Run them with
+// `make fuzz` (or `go test ./proxy -fuzz FuzzXxx`); the seeds below also run
+// as plain tests on every `go test`.
+
+var selectorSeeds = []string{
+	`up`,
+	`rate(http_requests_total{job="api",chrono_timeframe="7days"}[5m])`,
+	`{chrono_timeframe="current",_command="DONT_REMOVE_UNUSED_HISTORICS"}`,
+	`{,chrono_timeframe="7days",a="1"}`,
+	`{a="1",b="2",chrono_timeframe="7days",}`,
+	`chrono_timeframechrono_timeframe="x"="y"`,
+	`{chrono_timeframe="`,
+	`{_command=""}`,
+}
+
+func FuzzDetectSelectors(f *testing.F) {
+	for _, s := range selectorSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, query string) {
+		tf, cmd := detectSelectors(url.Values{"query": {query}})
+		// Escapes are unquoted, so only plain values must appear as they are
+		if tf != "" && !strings.Contains(query, tf) && !strings.Contains(query, "\\") {
+			t.Errorf("timeframe %q not present in %q", tf, query)
+		}
+		if cmd != "" && !strings.Contains(query, cmd) && !strings.Contains(query, "\\") {
+			t.Errorf("command %q not present in %q", cmd, query)
+		}
+	})
+}
+
+func FuzzExtractSelectors(f *testing.F) {
+	for _, s := range selectorSeeds {
+		f.Add(s, `chrono_timeframe="7days"`, `_command="x"`)
+	}
+	f.Fuzz(func(t *testing.T, query, m1, m2 string) {
+		vals := url.Values{"query": {query}, "match[]": {m1, m2, m1}}
+		extractSelectors(vals)
+	})
+}
+
+func FuzzStripLabelFromParam(f *testing.F) {
+	for _, s := range selectorSeeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, query string) {
+		for _, label := range []string{"chrono_timeframe", "_command"} {
+			vals := url.Values{"query": {query}}
+			stripLabelFromParam(vals, "query", label)
+			got := vals.Get("query")
+			leftover := regexp.MustCompile(regexp.QuoteMeta(label) + `="[^"]*"`)
+			if leftover.MatchString(got) {
+				t.Errorf("strip %s from %q left %q", label, query, got)
+			}
+		}
+	})
+}
+
+var bodySeeds = []string{
+	`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"a":"1"},"value":[1700000000,"1.5"]}]}}`,
+	`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"a":"1"},"values":[[1700000000,"1"],[1700000060,"2"]]}]}}`,
+	`{"data":{"result":[{"metric":null,"value":[]}]}}`,
+	`{"data":{"result":[{"value":["oops",1]}]}}`,
+	`{"data":{"result":[{"values":[[null,"x"],["1","NaN"]]}]}}`,
+	`{"data":{"result":[{"metric":{"__name__":5},"value":[1,"abc"]}]}}`,
+	`{"data":null}`,
+	`[]`,
+}
+
+// FuzzDecodeAndSynthesize feeds the same upstream body to every window and
+// runs the whole synthetic pipeline over it.
+func FuzzDecodeAndSynthesize(f *testing.F) {
+	for _, s := range bodySeeds {
+		f.Add([]byte(s), false)
+		f.Add([]byte(s), true)
+	}
+	f.Fuzz(func(t *testing.T, body []byte, isRange bool) {
+		decode := decodeInstant
+		if isRange {
+			decode = decodeRange
+		}
+		var all []model.Series
+		for _, tf := range proxyTimeframes() {
+			series, _, err := decode(body, window{name: tf}, "")
+			if err != nil {
+				return
+			}
+			all = append(all, series...)
+		}
+		avg := buildLastMonthAverage(all, isRange)
+		curMap, avgMap := indexBySignature(all, avg)
+		out := appendCompare(nil, curMap, avgMap, "", isRange)
+		out = appendPercent(out, curMap, avgMap, "", isRange)
+		dedupeSeries(append(all, out...))
+	})
+}
@@ -0,0 +1,96 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/gaps.go
+package proxy
+
+import (
+	"sort"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// dataGaps - "was that dip real, or was the scraper down?" 🕳️
+//
+// lastMonthAverage counts a window with no sample at a step as zero, so a
+// collection outage three weeks ago turns up today as a dip in the
+// baseline - and a compare against it as a spike that never happened.
+//
+// chrono_timeframe="dataGaps" shows where that happened: for each series,
+// a point at every step where at least one past window had data and at
+// least one other didn't, valued at how many were missing. Steps where
+// every past window agrees - all there, or all missing - are left out, so
+// no series at all means the baseline was built from complete history.
+// It's only built on request; plain queries don't get it.
+
+const dataGapsName = "dataGaps"
+
+// buildDataGaps counts, per series and step of grid, the past windows in
+// wins missing from seriesList where others aren't.
+func buildDataGaps(seriesList []model.Series, wins []window, isRange bool, grid synthGrid) []model.Series {
+	past := make(map[string]bool, len(wins))
+	for _, win := range wins {
+		if win.name != "current" {
+			past[win.name] = true
+		}
+	}
+	if len(past) < 2 {
+		return nil // nothing for a lone window to disagree with
+	}
+
+	present := make(map[string]map[int64]map[string]bool)
+	labels := make(map[string]map[string]string)
+	for _, s := range seriesList {
+		tf := s.Labels["chrono_timeframe"]
+		if !past[tf] {
+			continue
+		}
+		sig := signature(s.Labels)
+		if present[sig] == nil {
+			present[sig] = make(map[int64]map[string]bool)
+			labels[sig] = s.Labels
+		}
+		for _, pt := range s.Points {
+			at := grid.bucket(pt.T)
+			if present[sig][at] == nil {
+				present[sig][at] = make(map[string]bool, len(past))
+			}
+			present[sig][at][tf] = true
+		}
+	}
+
+	var out []model.Series
+	for sig, steps := range present {
+		var pts []model.Point
+		for at, tfs := range steps {
+			if missing := len(past) - len(tfs); missing > 0 {
+				pts = append(pts, model.Point{T: at, V: float64(missing)})
+			}
+		}
+		if len(pts) == 0 {
+			continue
+		}
+		sort.Slice(pts, func(i, j int) bool { return pts[i].T < pts[j].T })
+		if !isRange {
+			pts = pts[len(pts)-1:]
+		}
+		metric := copyMetric(labels[sig])
+		delete(metric, "_command")
+		metric["chrono_timeframe"] = dataGapsName
+		out = append(out, model.Series{Labels: metric, Points: pts})
+	}
+	return out
+}
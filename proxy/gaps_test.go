@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestDataGaps(t *testing.T) {
+	series := func(tf string, pts ...model.Point) model.Series {
+		return model.Series{Labels: map[string]string{"__name__": "up", "chrono_timeframe": tf}, Points: pts}
+	}
+	wins := []window{{name: "current"}, {name: "7days", offset: 7 * 86400}, {name: "14days", offset: 14 * 86400}, {name: "21days", offset: 21 * 86400}}
+	in := []model.Series{
+		// current being empty doesn't count
+		series("current", model.Point{T: 180000, V: 1}),
+		series("7days", model.Point{T: 60000, V: 1}, model.Point{T: 120000, V: 1}, model.Point{T: 180000, V: 1}),
+		series("14days", model.Point{T: 60000, V: 1}, model.Point{T: 180000, V: 1}),
+		series("21days", model.Point{T: 60000, V: 1}),
+	}
+
+	out := buildDataGaps(in, wins, true, minuteGrid)
+	if len(out) != 1 || out[0].Labels["chrono_timeframe"] != dataGapsName || out[0].Labels["__name__"] != "up" {
+		t.Fatalf("got %+v", out)
+	}
+	want := []model.Point{{T: 120000, V: 2}, {T: 180000, V: 1}}
+	if !reflect.DeepEqual(out[0].Points, want) {
+		t.Errorf("points = %+v; want %+v", out[0].Points, want)
+	}
+
+	if inst := buildDataGaps(in, wins, false, minuteGrid); len(inst) != 1 || !reflect.DeepEqual(inst[0].Points, want[1:]) {
+		t.Errorf("instant = %+v", inst)
+	}
+	if out := buildDataGaps(in[:2], wins[:2], true, minuteGrid); len(out) != 0 {
+		t.Errorf("one past window has nothing to disagree with: %+v", out)
+	}
+	complete := []model.Series{series("7days", model.Point{T: 60000, V: 1}), series("14days", model.Point{T: 60000, V: 2})}
+	if out := buildDataGaps(complete, wins[:3], true, minuteGrid); len(out) != 0 {
+		t.Errorf("no gaps, no series: %+v", out)
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+// Golden-file tests: exact response bytes for every timeframe/command
+// combination, served from a fake Prometheus. If you meant to change the
+// output, regenerate with
+//
+//	go test ./proxy -run TestGolden -update
+//
+// and review the diff in testdata/golden like any other code change.
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata/golden")
+
+var goldenTimeframes = []string{
+	"", "current", "7days", "14days", "21days", "28days",
+	"lastMonthAverage", "compareAgainstLast28", "percentCompareAgainstLast28",
+}
+
+var goldenCommands = []string{"", "DONT_REMOVE_UNUSED_HISTORICS"}
+
+func goldenQuery(tf, cmd string) string {
+	var sel []string
+	if tf != "" {
+		sel = append(sel, fmt.Sprintf(`chrono_timeframe=%q`, tf))
+	}
+	if cmd != "" {
+		sel = append(sel, fmt.Sprintf(`_command=%q`, cmd))
+	}
+	sel = append(sel, `job="bench"`)
+	return "http_requests_total{" + strings.Join(sel, ",") + "}"
+}
+
+func TestGolden(t *testing.T) {
+	for _, instant := range []bool{true, false} {
+		kind := "range"
+		if instant {
+			kind = "instant"
+		}
+		spec := fixtures.Spec{Name: kind, Series: 2, Points: 3, Step: 60, End: 1700000000, Seed: 1, Instant: instant}
+		set, err := fixtures.Generate(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake := fixtures.NewFakePrometheus()
+		defer fake.Close()
+		fake.ServeSet(set)
+		prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+		for _, tf := range goldenTimeframes {
+			for _, cmd := range goldenCommands {
+				name := kind + "_" + nonEmpty(tf, "all") + "_" + nonEmpty(cmd, "nocmd")
+				t.Run(name, func(t *testing.T) {
+					params := url.Values{"query": {goldenQuery(tf, cmd)}}
+					path := "/api/v1/query_range"
+					if instant {
+						path = "/api/v1/query"
+						params.Set("time", fmt.Sprint(spec.End))
+					} else {
+						params.Set("start", fmt.Sprint(spec.End-120))
+						params.Set("end", fmt.Sprint(spec.End))
+						params.Set("step", "60")
+					}
+
+					p := NewChronoProxy()
+					w := httptest.NewRecorder()
+					p.ServeHTTP(w, httptest.NewRequest("GET", prefix+path+"?"+params.Encode(), nil))
+					if w.Code != 200 {
+						t.Fatalf("status %d: %s", w.Code, w.Body.String())
+					}
+					checkGolden(t, name, w.Body.Bytes())
+				})
+			}
+		}
+
+		for _, req := range fake.Requests() {
+			q := req.Params.Get("query")
+			for _, label := range []string{"chrono_timeframe", "_command"} {
+				if strings.Contains(q, label) {
+					t.Errorf("%s leaked upstream in %q", label, q)
+				}
+			}
+		}
+	}
+}
+
+func nonEmpty(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name+".json")
+	if *updateGolden {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden file (run with -update): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("response differs from %s\n got: %s\nwant: %s", path, got, want)
+	}
+}
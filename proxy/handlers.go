@@ -18,15 +18,24 @@
 package proxy
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/andydixon/chronotheus/internal/plugin" // Add this import
+	"github.com/andydixon/chronotheus/internal/model"
+	"github.com/andydixon/chronotheus/internal/plugin"
 )
 
 // Welcome to the handler functions!! WOOOOOOO
@@ -41,6 +50,8 @@ import (
 //   - Raw timeframes: current, 7days, 14days, etc
 //   - Synthetic timeframes: averages and comparisons we calculate
 //   - Magic command DONT_REMOVE_UNUSED_HISTORICS to see ALL THE THINGS!
+//   - And AUDIT_TIME_SHIFT to see where they came from (see shiftaudit.go)
+//   - Or TRACE to see what we did to get them (see evaltrace.go)
 
 // handleQuery implements /api/v1/query endpoint for instant queries.
 // Think of it as taking a snapshot of your metrics RIGHT NOW! 📸
@@ -55,98 +66,23 @@ import (
 // 3. Filters out anything you don't want
 // 4. Sends it back as JSON
 func (p *ChronoProxy) handleQuery(w http.ResponseWriter, r *http.Request, upstream, path string) {
-    if DebugMode {
+    if DebugMode.Load() {
         log.Printf("[DEBUG] handleQuery: %s %s", r.Method, r.URL.Path)
     }
 
     params := parseClientParams(r)
-    remapMatch(params)
-
-    // Extract _plugin label value from params
-    requestedPlugin := params.Get("query")
-    if matches := pluginLabelRegex.FindStringSubmatch(requestedPlugin); len(matches) > 1 {
-        requestedPlugin = matches[1]
-    }
-
-    requestedTf, command := extractSelectors(params)
-    stripLabelFromParam(params, "query", "chrono_timeframe")
-    stripLabelFromParam(params, "query", "command")
-
-    // Pre-allocate merged slice with reasonable capacity
-    initialCap := 100
-    if command == "DONT_REMOVE_UNUSED_HISTORICS" {
-        initialCap *= len(p.timeframes)
-    }
-    var merged []map[string]interface{}
-
-    // Optimize for specific timeframe request
-    if requestedTf != "" && requestedTf != "lastMonthAverage" && 
-       requestedTf != "compareAgainstLast28" && requestedTf != "percentCompareAgainstLast28" {
-        // Handle single timeframe request efficiently
-        for i, tf := range p.timeframes {
-            if tf == requestedTf {
-                effProxy := &ChronoProxy{
-                    offsets:    []int64{p.offsets[i]},
-                    timeframes: []string{tf},
-                    client:     p.client,
-                }
-                merged = fetchWindowsInstant(effProxy, params, upstream+path, command)
-                break
-            }
-        }
-    } else {
-        // Handle full data fetch cases
-        all := fetchWindowsInstant(p, params, upstream+path, command)
-        if command == "DONT_REMOVE_UNUSED_HISTORICS" {
-            merged = dedupeSeries(all)
-        } else if requestedTf == "" {
-            // Case 1: No timeframe specified - return everything with synthetics
-            merged = dedupeSeries(all)
-            avg := buildLastMonthAverage(merged, false)
-            curM, avgM := indexBySignature(merged, avg)
-            
-            // Pre-allocate final slice
-            finalCap := len(merged) + len(avg) + len(curM)*2
-            result := make([]map[string]interface{}, len(merged), finalCap)
-            copy(result, merged)
-            
-            result = append(result, avg...)
-            result = append(result, appendCompare(nil, curM, avgM, "", false)...)
-            result = append(result, appendPercent(nil, curM, avgM, "", false)...)
-            merged = result
-        } else {
-            // Case 3: Synthetic timeframes
-            merged = dedupeSeries(all)
-            avg := buildLastMonthAverage(merged, false)
-            curM, avgM := indexBySignature(merged, avg)
-            
-            switch requestedTf {
-            case "lastMonthAverage":
-                merged = avg
-            case "compareAgainstLast28":
-                merged = appendCompare(nil, curM, avgM, "", false)
-            case "percentCompareAgainstLast28":
-                merged = appendPercent(nil, curM, avgM, "", false)
-            }
-        }
-    }
-
-    // Filter by requested timeframe if specified
-    if requestedTf != "" && command != "DONT_REMOVE_UNUSED_HISTORICS" {
-        merged = filterByTimeframe(merged, requestedTf)
-    }
-
-    // Process through plugins before writing
-    if plugin.GlobalPluginManager != nil {
-        var err error
-        merged, err = plugin.GlobalPluginManager.ProcessPlugins(merged, requestedPlugin)
-        if err != nil {
-            log.Printf("[ERROR] Plugin processing error in handleQuery: %v", err)
-        }
+    provenance := p.provenanceMode(params)
+    warnings, trace := &warningList{}, &evalTrace{}
+    ctx := withTrace(withWarnings(withPriority(r.Context(), p.requestPriority(r)), warnings), trace)
+    merged, err := p.evaluate(ctx, params, upstream+path, false)
+    if err != nil {
+        p.writeEvalError(w, err)
+        return
     }
 
-    writeJSON(w, "vector", merged)
-    if DebugMode {
+    reportSeries(ctx, len(merged))
+    p.writeResult(w, "vector", merged, provenance, warnings.list(), trace.report())
+    if DebugMode.Load() {
         log.Printf("[DEBUG] handleQuery written to requester: %d series returned", len(merged))
     }
 }
@@ -160,110 +96,486 @@ func (p *ChronoProxy) handleQuery(w http.ResponseWriter, r *http.Request, upstre
 // 3. Does all the same magic as handleQuery but with sequences instead of points
 // 4. Returns a beautiful matrix of data points
 func (p *ChronoProxy) handleQueryRange(w http.ResponseWriter, r *http.Request, upstream, path string) {
-    if DebugMode {
+    if DebugMode.Load() {
         log.Printf("[DEBUG] handleQueryRange: %s %s", r.Method, r.URL.Path)
     }
 
     params := parseClientParams(r)
-    remapMatch(params)
+    provenance := p.provenanceMode(params)
+    warnings, trace := &warningList{}, &evalTrace{}
+    ctx := withTrace(withWarnings(withPriority(r.Context(), p.requestPriority(r)), warnings), trace)
+    merged, err := p.evaluate(ctx, params, upstream+path, true)
+    if err != nil {
+        p.writeEvalError(w, err)
+        return
+    }
 
-    // Extract _plugin label value from params
-    requestedPlugin := params.Get("query")
-    if matches := pluginLabelRegex.FindStringSubmatch(requestedPlugin); len(matches) > 1 {
-        requestedPlugin = matches[1]
+    reportSeries(ctx, len(merged))
+    p.writeResult(w, "matrix", merged, provenance, warnings.list(), trace.report())
+    if DebugMode.Load() {
+        log.Printf("[DEBUG] handleQueryRange written to requester: %d series returned", len(merged))
     }
+}
 
+// evaluate is the engine room shared by handleQuery, handleQueryRange and
+// background jobs. It takes the raw client params, works out which timeframe,
+// command and plugin were asked for, fetches the windows, builds the
+// synthetics and hands back the merged series ready for writeJSON.
+//
+// isRange picks between the instant (vector) and range (matrix) flavours.
+// Cancelling ctx stops any outstanding upstream fetches.
+//
+// The cheap checks come first - parameters, the tenant's timeframes and the
+// authorization hook - so a query that's going nowhere costs no quota and
+// never waits for a slot. Only then do we charge the caller's quota and
+// queue for a slot in the pool belonging to the request's priority class,
+// so batch work can't crowd out dashboards.
+func (p *ChronoProxy) evaluate(ctx context.Context, params url.Values, endpoint string, isRange bool) ([]model.Series, error) {
+    evalStart := p.clock.Now()
+    remapMatch(params)
+    asWritten := params.Get("query")
+    stale := &staleWindows{}
+    ctx = withStaleWindows(ctx, stale)
+
+    requestedPlugin := extractPlugin(params)
+    pluginArgs, err := extractPluginArgs(params)
+    if err != nil {
+        return nil, err
+    }
+    counters, err := p.extractCounterMode(params)
+    if err != nil {
+        return nil, err
+    }
+    downsampling, err := p.extractDownsample(params)
+    if err != nil {
+        return nil, err
+    }
+    windowMode, err := p.extractWindowMode(params)
+    if err != nil {
+        return nil, err
+    }
+    // A query Prometheus' parser can't read stops here (see promql.go)
+    tfFilter, err := extractTimeframeFilter(params.Get("query"))
+    if err != nil {
+        return nil, err
+    }
     requestedTf, command := extractSelectors(params)
-    
-    if DebugMode {
-        log.Printf("Selectors are(TF:'%s', command: '%s')", requestedTf, command)
+    auditFrom(ctx).query(auditQuery{Query: asWritten, Timeframe: requestedTf, Command: command, Plugin: requestedPlugin})
+    tenant := tenantFrom(ctx)
+    if err := tenant.checkTimeframe(requestedTf); err != nil {
+        return nil, err
+    }
+    // Your own rules, if you have any (see authz.go)
+    if err := p.authorizeQuery(ctx, endpoint, asWritten, requestedTf, command, requestedPlugin); err != nil {
+        return nil, err
+    }
+    strict, err := p.strictMode(params)
+    if err != nil {
+        return nil, err
+    }
+    padLookbehind, err := p.padLookbehindMode(params)
+    if err != nil {
+        return nil, err
+    }
+    maxStaleness, err := p.maxStaleness(params)
+    if err != nil {
+        return nil, err
+    }
+
+    // Past the checks: now it costs something
+    quota := quotaFrom(ctx)
+    if quota != nil {
+        if err := quota.admit(p.clock.Now()); err != nil {
+            return nil, err
+        }
+    }
+    budget := p.newBudget()
+    ctx = withBudget(ctx, budget)
+    queueStart := p.clock.Now()
+    release, err := p.scheduler.acquire(ctx, priorityFrom(ctx))
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+    queued := p.since(queueStart)
+    ctx = p.withRetryDeadline(ctx)
+
+    // _command="TRACE" says what happened along the way (see evaltrace.go)
+    trace := traceFrom(ctx)
+    if command == traceCommand {
+        trace.on()
+        trace.add(traceStage{Stage: "queued"}, queued)
+        trace.add(traceSelectors(asWritten), 0)
+        defer func() { trace.finish(p.since(evalStart)) }()
+    }
+
+    if DebugMode.Load() {
+        log.Printf("Selectors are(TF:'%s', command: '%s', plugin: '%s')", requestedTf, command, requestedPlugin)
+    }
+
+    wins, err := p.extractOffsets(params)
+    if err != nil {
+        return nil, err
+    }
+    average, stderr := averageAggregation, standardErrorAggregation
+    if wins != nil {
+        average, stderr = averageOver(len(wins) - 1), standardErrorOver(len(wins) - 1)
+    } else {
+        var off []disabledTimeframe
+        wins, off = p.enabledWindows(p.windows())
+        for _, tf := range off {
+            // Only worth a warning if the answer would have used it
+            if requestedTf == "" || isSyntheticTimeframe(requestedTf) || requestedTf == tf.Name {
+                warningsFrom(ctx).add(tf.warning())
+            }
+        }
+        if len(off) > 0 && len(wins) > 1 {
+            average, stderr = averageOver(len(wins) - 1), standardErrorOver(len(wins) - 1)
+        }
+        // A timeframe we don't know might be an ad-hoc one, e.g. "3days"
+        if requestedTf != "" && !isSyntheticTimeframe(requestedTf) && !isRawTf(requestedTf, p.timeframes) {
+            if win, ok := adHocWindow(requestedTf); ok {
+                win.loc = p.location
+                wins = []window{win}
+            }
+        }
+    }
+    pair, err := p.extractCompare(params, wins)
+    if err != nil {
+        return nil, err
+    }
+    if pair != nil && (requestedTf != "" || tfFilter != nil) {
+        return nil, &badQueryError{msg: compareLabel + " and chrono_timeframe can't be used together"}
+    }
+    // chrono_timeframe=~"7days|14days" needs those two and nothing else
+    rawWindows := tfFilter != nil && requestedTf == "" && command != "DONT_REMOVE_UNUSED_HISTORICS" && tfFilter.rawOnly()
+    if rawWindows {
+        wins = tfFilter.windows(wins)
     }
+    p.countTimeframeUsage(requestedTf, pair)
 
     stripLabelFromParam(params, "query", "chrono_timeframe")
+    stripLabelFromParam(params, "query", "_command")
     stripLabelFromParam(params, "query", "command")
-    stripLabelFromParam(params, "query", "_plugin")
-    
-    if params.Get("step") == "" {
-        params.Set("step", "60")
+    stripLabelFromParam(params, "query", pluginLabelName)
+    stripLabelFromParam(params, "match[]", pluginLabelName)
+    stripLabelFromParam(params, "query", pluginArgsLabelName)
+    stripLabelFromParam(params, "match[]", pluginArgsLabelName)
+    virtual, err := p.expandVirtualMetrics(params)
+    if err != nil {
+        return nil, err
+    }
+    // Metrics that don't average get raw windows only (see nosynthetics.go)
+    noSynthMetric, noSynth := p.noSynthetics(params.Get("query"))
+    // ...and some average better transformed first (see transforms.go)
+    transform := p.valueTransformFor(params.Get("query"))
+    capabilitiesFrom(ctx).adaptParams(params)
+    base, _, _ := strings.Cut(endpoint, "/api/v1/")
+    metric, metricType := p.queryMetric(ctx, params, base)
+    rated := p.applyCounterMode(ctx, params, base, counters)
+    // Percentages of something that only goes up say more about uptime
+    // than about the metric (see metrictypes.go)
+    rawCounter := !rated && isMonotonic(metric, metricType)
+
+    var fetch windowFetcher = fetchWindowsInstant
+    if strict {
+        fetch = strictly(fetchWindowsInstant)
+    }
+    if isRange {
+        fetch = fetchWindowsRange
+        if strict {
+            fetch = strictly(fetchWindowsRange)
+        }
+        if params.Get("step") == "" {
+            params.Set("step", "60")
+        }
+        // rate()s at each window's first steps read from before its start (see lookbehind.go)
+        if padLookbehind {
+            if lookbehind, err := queryLookbehind(params.Get("query")); err != nil {
+                warningsFrom(ctx).add(fmt.Sprintf("%s: couldn't read the query's ranges (%v); windows were fetched unpadded", padLookbehindParam, err))
+            } else {
+                step, _ := parsePromDuration(params.Get("step"))
+                fetch = paddedLookbehind(fetch, lookbehind, step)
+            }
+        }
+        // An exporter that stopped looks a lot like a flat line (see staleness.go)
+        if maxStaleness > 0 {
+            fetch = staleCurrent(fetch, maxStaleness)
+        }
     }
-
-    // Pre-allocate merged slice with reasonable capacity
-    initialCap := 100
-    if command == "DONT_REMOVE_UNUSED_HISTORICS" {
-        initialCap *= len(p.timeframes)
+    // Synthetics bucket by the query's step (see aggregations.go)
+    grid := queryGrid(params, isRange, p.clock.Now())
+    // Past windows as offset modifiers rather than shifted times (see offsetmode.go)
+    if windowMode == windowModeOffset {
+        if pair != nil {
+            pair = offsetWindows(ctx, pair, params.Get("query"))
+        } else {
+            wins = offsetWindows(ctx, wins, params.Get("query"))
+        }
+    }
+    if trace.enabled() {
+        fetched := wins
+        if pair != nil {
+            fetched = pair
+        }
+        names := make([]string, len(fetched))
+        for i, win := range fetched {
+            names[i] = win.name
+        }
+        trace.add(traceParams(params, map[string]string{
+            "timeframe":   requestedTf,
+            "command":     command,
+            "plugin":      requestedPlugin,
+            "window_mode": windowMode,
+            "strict":      strconv.FormatBool(strict),
+            "windows":     strings.Join(names, ","),
+        }), p.since(evalStart)-queued)
     }
-    merged := make([]map[string]interface{}, 0, initialCap)
+
+    var merged []model.Series
 
     // Optimize for specific timeframe request
-    if requestedTf != "" && requestedTf != "lastMonthAverage" && 
-       requestedTf != "compareAgainstLast28" && requestedTf != "percentCompareAgainstLast28" {
+    if pair != nil {
+        // Just the two windows being compared (see compare.go)
+        all, err := fetch(ctx, p, pair, params, endpoint, command)
+        if err != nil {
+            return nil, err
+        }
+        merged = buildWindowDiff(dedupeSeries(all), pair[0].name, pair[1].name, command, isRange)
+    } else if requestedTf != "" && !isSyntheticTimeframe(requestedTf) {
         // Handle single timeframe request efficiently
-        for i, tf := range p.timeframes {
-            if tf == requestedTf {
-                effProxy := &ChronoProxy{
-                    offsets:    []int64{p.offsets[i]},
-                    timeframes: []string{tf},
-                    client:     p.client,
+        for _, win := range wins {
+            if win.name == requestedTf {
+                if merged, err = fetch(ctx, p, []window{win}, params, endpoint, command); err != nil {
+                    return nil, err
                 }
-                merged = fetchWindowsRange(effProxy, params, upstream+path, command)
                 break
             }
         }
+    } else if rawWindows {
+        // Just the windows a chrono_timeframe regex picked (see promql.go)
+        all, err := fetch(ctx, p, wins, params, endpoint, command)
+        if err != nil {
+            return nil, err
+        }
+        merged = dedupeSeries(all)
+    } else if noSynth != nil && requestedTf != "" && command != "DONT_REMOVE_UNUSED_HISTORICS" {
+        // A synthetic of something synthetics are off for - nothing to fetch
+        warningsFrom(ctx).add(noSynth.warning(noSynthMetric))
     } else {
         // Handle full data fetch cases
-        all := fetchWindowsRange(p, params, upstream+path, command)
+        all, err := fetch(ctx, p, wins, params, endpoint, command)
+        if err != nil {
+            return nil, err
+        }
+        _, synth := p.startSpan(ctx, "chronotheus.synthesize", spanKindInternal)
+        synthStart := p.clock.Now()
         if command == "DONT_REMOVE_UNUSED_HISTORICS" {
             merged = dedupeSeries(all)
+        } else if requestedTf == "" && noSynth != nil {
+            // Raw windows only, and say why
+            merged = dedupeSeries(all)
+            warningsFrom(ctx).add(noSynth.warning(noSynthMetric))
         } else if requestedTf == "" {
             // Case 1: No timeframe specified - return everything with synthetics
             merged = dedupeSeries(all)
-            avg := buildLastMonthAverage(merged, true)
+            history := transform.apply(merged)
+            avg := transform.undo(buildLastMonthAggregate(history, isRange, grid, average), average)
             curM, avgM := indexBySignature(merged, avg)
             
             // Pre-allocate final slice
             finalCap := len(merged) + len(avg) + len(curM)*2
-            result := make([]map[string]interface{}, len(merged), finalCap)
+            result := make([]model.Series, len(merged), finalCap)
             copy(result, merged)
             
             result = append(result, avg...)
-            result = append(result, appendCompare(nil, curM, avgM, "", true)...)
-            result = append(result, appendPercent(nil, curM, avgM, "", true)...)
+            result = append(result, appendCompare(nil, curM, avgM, "", isRange)...)
+            result = append(result, transform.undo(buildLastMonthAggregate(history, isRange, grid, stderr), stderr)...)
+            if rawCounter {
+                warningsFrom(ctx).add(rawCounterWarning(metric))
+            } else {
+                result = append(result, appendPercent(nil, curM, avgM, "", isRange)...)
+            }
+            for _, agg := range p.aggregationsFor(virtual) {
+                result = append(result, transform.undo(buildLastMonthAggregate(history, isRange, grid, agg), agg)...)
+            }
             merged = result
         } else {
             // Case 3: Synthetic timeframes
             merged = dedupeSeries(all)
-            avg := buildLastMonthAverage(merged, true)
+            history := transform.apply(merged)
+            avg := transform.undo(buildLastMonthAggregate(history, isRange, grid, average), average)
             curM, avgM := indexBySignature(merged, avg)
             
             switch requestedTf {
             case "lastMonthAverage":
                 merged = avg
             case "compareAgainstLast28":
-                merged = appendCompare(nil, curM, avgM, "", true)
+                merged = appendCompare(nil, curM, avgM, "", isRange)
             case "percentCompareAgainstLast28":
-                merged = appendPercent(nil, curM, avgM, "", true)
+                if rawCounter {
+                    warningsFrom(ctx).add(rawCounterWarning(metric))
+                    merged = nil
+                } else {
+                    merged = appendPercent(nil, curM, avgM, "", isRange)
+                }
+            case standardErrorName:
+                merged = transform.undo(buildLastMonthAggregate(history, isRange, grid, stderr), stderr)
+            case seasonalBaselineName:
+                merged = transform.undo(buildSeasonalBaseline(history, windowsByName(wins), p.location, isRange, grid), average)
+            case forecastNextWeekName:
+                if len(weeklyWindows(wins)) == 0 {
+                    warningsFrom(ctx).add(forecastNextWeekName + " needs a past window a whole number of weeks back")
+                }
+                merged = transform.undo(buildForecastNextWeek(history, wins, isRange, grid), average)
+            case dataGapsName:
+                merged = buildDataGaps(merged, wins, isRange, grid)
+            default:
+                if agg, ok := aggregationByName(requestedTf); ok {
+                    merged = transform.undo(buildLastMonthAggregate(history, isRange, grid, agg), agg)
+                }
+                for _, agg := range p.bands {
+                    if agg.name == requestedTf {
+                        merged = transform.undo(buildLastMonthAggregate(history, isRange, grid, agg), agg)
+                    }
+                }
+                if q, ok := histogramQuantileFor(requestedTf); ok {
+                    merged = buildHistogramQuantile(merged, isRange, grid, requestedTf, q)
+                }
             }
         }
+        monotoniseBuckets(merged)
+        if metricType != "" {
+            labelMetricType(merged, metricType)
+        }
+        synth.set("chrono.series", strconv.Itoa(len(merged)))
+        synth.finish()
+        trace.add(traceStage{Stage: "synthesize", Series: seriesCount(len(merged))}, p.since(synthStart))
     }
 
     // Filter by requested timeframe if specified
     if requestedTf != "" && command != "DONT_REMOVE_UNUSED_HISTORICS" {
         merged = filterByTimeframe(merged, requestedTf)
+    } else if requestedTf == "" && pair == nil && virtual != nil && len(virtual.Timeframes) > 0 && command != "DONT_REMOVE_UNUSED_HISTORICS" {
+        // A virtual metric's own default set (see virtualmetrics.go)
+        merged = keepTimeframes(merged, virtual.Timeframes)
+    }
+    if tfFilter != nil && command != "DONT_REMOVE_UNUSED_HISTORICS" {
+        merged = tfFilter.keep(merged)
     }
 
+    if command == auditShiftCommand {
+        merged = p.auditShift(merged, wins, isRange)
+    }
+
+    merged = tenant.visible(merged)
+    sortSeries(merged)
+
     // Process through plugins before writing
-    if plugin.GlobalPluginManager != nil {
-        var err error
-        merged, err = plugin.GlobalPluginManager.ProcessPlugins(merged, requestedPlugin)
+    if requestedPlugin != "" {
+        stages, err := pluginChain(requestedPlugin)
         if err != nil {
-            log.Printf("[ERROR] Plugin processing error in handleQuery: %v", err)
+            return nil, err
+        }
+        for _, name := range stages {
+            if !tenant.allowsPlugin(name) {
+                return nil, &badQueryError{msg: fmt.Sprintf("tenant %q can't use plugin %q", tenant.config.Name, name)}
+            }
         }
+        merged = p.runPlugins(ctx, merged, stages, pluginArgs, pastOffsets(wins))
     }
 
-    writeJSON(w, "matrix", merged)
-    if DebugMode {
-        log.Printf("[DEBUG] handleQueryRange written to requester: %d series returned", len(merged))
+    // Thin long ranges out last, after everything's been worked out (see downsample.go)
+    if isRange {
+        if interval, auto := p.downsampleInterval(downsampling, params); interval > 0 {
+            downsample(merged, synthGrid{originMs: parseTimeMs(params.Get("start"), p.clock.Now()), stepMs: interval.Milliseconds()}, downsampling.fn)
+            if auto {
+                warningsFrom(ctx).add(fmt.Sprintf("downsampled to %s (%s) to stay under max_points_per_series", interval, downsampling.fn))
+            }
+        }
+    }
+
+    // Synthetics and all, the answer has to fit too (see limits.go)
+    if err := budget.check(merged); err != nil {
+        return nil, err
     }
+    if quota != nil {
+        quota.addSamples(countSamples(merged), p.clock.Now())
+    }
+    auditFrom(ctx).series(len(merged))
+    p.markStale(ctx, merged, stale)
+    return merged, nil
+}
+
+// pastOffsets is how far back each of wins but current was fetched from.
+func pastOffsets(wins []window) map[string]time.Duration {
+    offsets := make(map[string]time.Duration, len(wins))
+    for _, win := range wins {
+        if win.name != "current" {
+            offsets[win.name] = time.Duration(win.offset) * time.Second
+        }
+    }
+    return offsets
+}
+
+// maxPluginStages is the longest _plugin="a|b|c" pipeline we'll run.
+const maxPluginStages = 8
+
+// pluginChain splits _plugin="smooth|prediction" into its stages.
+func pluginChain(requested string) ([]string, error) {
+    stages := strings.Split(requested, "|")
+    if len(stages) > maxPluginStages {
+        return nil, &badQueryError{msg: fmt.Sprintf("%s: at most %d plugins can be chained, got %d", pluginLabelName, maxPluginStages, len(stages))}
+    }
+    for i, stage := range stages {
+        stages[i] = strings.TrimSpace(stage)
+        if stages[i] == "" {
+            return nil, &badQueryError{msg: fmt.Sprintf("%s=%q has an empty stage", pluginLabelName, requested)}
+        }
+    }
+    return stages, nil
+}
+
+// runPlugins pipes merged through each stage in turn, every stage getting
+// the same args (see pluginargs.go). When a stage fails the pipeline stops
+// there: the client gets what the stages before it produced, and a warning
+// naming the plugin that broke. offsets are the past windows, for plugins
+// that want them apart (see internal/plugin/windows.go).
+func (p *ChronoProxy) runPlugins(ctx context.Context, merged []model.Series, stages []string, args map[string]string, offsets map[string]time.Duration) []model.Series {
+    for i, name := range stages {
+        _, sp := p.startSpan(ctx, "chronotheus.plugin", spanKindInternal)
+        sp.set("chrono.plugin", name)
+        start := p.clock.Now()
+        out, err := p.plugins.ProcessPluginsWithWindows(merged, name, args, offsets)
+        sp.fail(err)
+        sp.finish()
+        st := traceStage{Stage: "plugin", Plugin: name, Series: seriesCount(len(out))}
+        if err != nil {
+            st.Error = err.Error()
+        }
+        traceFrom(ctx).add(st, p.since(start))
+        // Unknown plugin names come straight from the client - don't let
+        // them mint new metric series.
+        if !errors.Is(err, plugin.ErrNotFound) {
+            p.pluginRuns.observe(p.since(start).Seconds(), name)
+        }
+        if err != nil {
+            log.Printf("[ERROR] Plugin processing error in evaluate (stage %d of %d): %v", i+1, len(stages), err)
+            if !errors.Is(err, plugin.ErrNotFound) {
+                p.pluginErrors.inc(name)
+            }
+            msg := fmt.Sprintf("plugin %q (stage %d of %d) failed: %v", name, i+1, len(stages), err)
+            if i > 0 {
+                msg += fmt.Sprintf("; returning the output of %s", strings.Join(stages[:i], "|"))
+            } else {
+                msg += "; returning unprocessed series"
+            }
+            warningsFrom(ctx).add(msg)
+            return merged
+        }
+        merged = out
+    }
+    return merged
 }
 
 // handleLabels is our menu board! 🎯
@@ -276,17 +588,19 @@ func (p *ChronoProxy) handleQueryRange(w http.ResponseWriter, r *http.Request, u
 // 3. Sends back the complete menu of options
 func (p *ChronoProxy) handleLabels(w http.ResponseWriter, r *http.Request, upstream, path string) {
 
-	if DebugMode {
+	if DebugMode.Load() {
 		log.Printf("[DEBUG] handleLabels: %s %s", r.Method, r.URL.Path)
 	}
 
     params := parseClientParams(r)
     stripLabelFromParam(params, "match", "chrono_timeframe")
     stripLabelFromParam(params, "match", "command")
+    stripLabelFromParam(params, "match", pluginLabelName)
+    stripLabelFromParam(params, "match", pluginArgsLabelName)
     remapMatch(params)
 
     u := upstream + path + "?" + buildQueryString(params)
-    resp, err := p.client.Get(u)
+    resp, err := p.getUpstream(r.Context(), u)
     if err != nil {
         http.Error(w, `{"status":"error","error":"Upstream request failed"}`, http.StatusBadGateway)
         return
@@ -314,17 +628,16 @@ func (p *ChronoProxy) handleLabels(w http.ResponseWriter, r *http.Request, upstr
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(out)
-	if DebugMode {
+	if DebugMode.Load() {
 		log.Printf("[DEBUG] handleLabels written to requester")
 	}
 }
 
-// Cache for label values with TTL
+// Cache for label values with TTL, keyed by labelValuesKey
 var (
     labelValuesCache    = make(map[string]labelValuesCacheEntry)
     labelValuesCacheMux sync.RWMutex
     pluginLabelName     = "_plugin"  // Constant for plugin label name
-    pluginLabelRegex    = regexp.MustCompile(`_plugin="([^"]+)"`) // Added pluginLabelRegex
 )
 
 type labelValuesCacheEntry struct {
@@ -334,6 +647,24 @@ type labelValuesCacheEntry struct {
 
 const labelValuesCacheTTL = 5 * time.Minute
 
+// labelValuesKey names one label's values as one upstream shows them to one
+// tenant for one set of match[] selectors, so nobody is served values
+// fetched for somebody else. Upstreams that see the client's own
+// credentials get a key per client, like the stale cache (see stale.go).
+func labelValuesKey(ctx context.Context, upstream, label string, matches []string) string {
+    if u := upstreamFrom(ctx); u != nil {
+        upstream = u.name
+    }
+    sorted := append([]string(nil), matches...)
+    sort.Strings(sorted)
+    key := upstream + "\x00" + tenantFrom(ctx).name() + "\x00" + label + "\x00" + strings.Join(sorted, "\x00")
+    if u := upstreamFrom(ctx); u != nil && u.auth != nil && u.auth.PassAuthorization {
+        sum := sha256.Sum256([]byte(clientAuthorizationFrom(ctx)))
+        key += "\x00" + hex.EncodeToString(sum[:8])
+    }
+    return key
+}
+
 // handleLabelValues is like a vending machine for label values! 
 // You put in a label name, it gives you all the possible values.
 //
@@ -345,37 +676,32 @@ const labelValuesCacheTTL = 5 * time.Minute
 //
 // Pro tip: This is how Grafana knows what values to show in dropdowns! 
 func (p *ChronoProxy) handleLabelValues(w http.ResponseWriter, r *http.Request, upstream, path, label string) {
-    if DebugMode {
+    if DebugMode.Load() {
         log.Printf("[DEBUG] handleLabelValues: %s %s", r.Method, r.URL.Path)
     }
 
-    switch label {
-    case "chrono_timeframe":
-        writeJSONRaw(w, map[string]interface{}{
-            "status": "success",
-            "data":   append(proxyTimeframes(),
-                "lastMonthAverage", "compareAgainstLast28", "percentCompareAgainstLast28"),
-        })
-        return
-    case "_command":
+    // chrono_timeframe, _command and _plugin are ours (see labelvalues.go)
+    if values, ok := p.chronoLabelValues(label); ok {
         writeJSONRaw(w, map[string]interface{}{
             "status": "success",
-            "data":   []string{"", "DONT_REMOVE_UNUSED_HISTORICS"},
-        })
-        return
-    case pluginLabelName:
-        // Return list of loaded plugin IDs
-        writeJSONRaw(w, map[string]interface{}{
-            "status": "success",
-            "data":   plugin.LoadedPlugins,
+            "data":   values,
         })
         return
     }
 
+    params := parseClientParams(r)
+    stripLabelFromParam(params, "match", "chrono_timeframe")
+    stripLabelFromParam(params, "match", "command")
+    stripLabelFromParam(params, "match", pluginLabelName)
+    stripLabelFromParam(params, "match", pluginArgsLabelName)
+    remapMatch(params)
+
     // Check cache first
+    key := labelValuesKey(r.Context(), upstream, label, params["match[]"])
     labelValuesCacheMux.RLock()
-    if entry, ok := labelValuesCache[label]; ok && time.Since(entry.timestamp) < labelValuesCacheTTL {
+    if entry, ok := labelValuesCache[key]; ok && p.since(entry.timestamp) < labelValuesCacheTTL {
         labelValuesCacheMux.RUnlock()
+        p.cacheLookups.inc("label_values", "hit")
         writeJSONRaw(w, map[string]interface{}{
             "status": "success",
             "data":   entry.data,
@@ -383,14 +709,10 @@ func (p *ChronoProxy) handleLabelValues(w http.ResponseWriter, r *http.Request,
         return
     }
     labelValuesCacheMux.RUnlock()
-
-    params := parseClientParams(r)
-    stripLabelFromParam(params, "match", "chrono_timeframe")
-    stripLabelFromParam(params, "match", "command")
-    remapMatch(params)
+    p.cacheLookups.inc("label_values", "miss")
 
     u := upstream + path + "?" + buildQueryString(params)
-    resp, err := p.client.Get(u)
+    resp, err := p.getUpstream(r.Context(), u)
     if err != nil {
         http.Error(w, `{"status":"error","error":"Upstream request failed"}`, http.StatusBadGateway)
         return
@@ -407,16 +729,16 @@ func (p *ChronoProxy) handleLabelValues(w http.ResponseWriter, r *http.Request,
     // Update cache
     if data, ok := result["data"].([]interface{}); ok {
         labelValuesCacheMux.Lock()
-        labelValuesCache[label] = labelValuesCacheEntry{
+        labelValuesCache[key] = labelValuesCacheEntry{
             data:      data,
-            timestamp: time.Now(),
+            timestamp: p.clock.Now(),
         }
         labelValuesCacheMux.Unlock()
     }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(result)
-    if DebugMode {
+    if DebugMode.Load() {
         log.Printf("[DEBUG] handleLabelValues written to requester")
     }
 }
@@ -424,13 +746,39 @@ func (p *ChronoProxy) handleLabelValues(w http.ResponseWriter, r *http.Request,
 var (
     timeframeRegex = regexp.MustCompile(`^chrono_timeframe="([^"]+)"$`)
     commandRegex   = regexp.MustCompile(`^_command="([^"]+)"$`)
+    pluginRegex    = regexp.MustCompile(`^_plugin="([^"]+)"$`)
 )
 
+// extractPlugin finds which plugin (if any) the client asked for, either as
+// its own match[] entry (which gets removed) or inline in the query, e.g.
+// rate(node_cpu_seconds_total{_plugin="prediction"}[5m]).
+// Returns "" when no plugin was requested.
+func extractPlugin(vals url.Values) string {
+    if vs, ok := vals["match[]"]; ok {
+        for i, m := range vs {
+            if matches := pluginRegex.FindStringSubmatch(m); matches != nil {
+                vals["match[]"] = append(vs[:i], vs[i+1:]...)
+                if DebugMode.Load() {
+                    log.Printf("[DEBUG] Found plugin in match[]: %s", matches[1])
+                }
+                return matches[1]
+            }
+        }
+    }
+    if plugin, ok := inlineMatcher(vals.Get("query"), pluginLabelName); ok {
+        if DebugMode.Load() {
+            log.Printf("[DEBUG] Found inline plugin: %s", plugin)
+        }
+        return plugin
+    }
+    return ""
+}
+
 // extractSelectors efficiently extracts both chrono_timeframe & _command from match[] or inline
 func extractSelectors(vals url.Values) (string, string) {
     tf, cmd := "", ""
     
-    if DebugMode {
+    if DebugMode.Load() {
         log.Printf("[DEBUG] extractSelectors checking match[] values: %v", vals["match[]"])
     }
 
@@ -439,7 +787,7 @@ func extractSelectors(vals url.Values) (string, string) {
             if matches := timeframeRegex.FindStringSubmatch(m); matches != nil {
                 tf = matches[1]
                 vals["match[]"] = append(vs[:i], vs[i+1:]...)
-                if DebugMode {
+                if DebugMode.Load() {
                     log.Printf("[DEBUG] Found timeframe in match[]: %s", tf)
                 }
                 break
@@ -449,7 +797,7 @@ func extractSelectors(vals url.Values) (string, string) {
             if matches := commandRegex.FindStringSubmatch(m); matches != nil {
                 cmd = matches[1]
                 vals["match[]"] = append(vals["match[]"][:i], vals["match[]"][i+1:]...)
-                if DebugMode {
+                if DebugMode.Load() {
                     log.Printf("[DEBUG] Found command in match[]: %s", cmd)
                 }
                 break
@@ -459,7 +807,7 @@ func extractSelectors(vals url.Values) (string, string) {
 
     // Try inline detection if nothing found in match[]
     if tf == "" || cmd == "" {
-        if DebugMode {
+        if DebugMode.Load() {
             log.Printf("[DEBUG] Checking inline selectors in query: %s", vals.Get("query"))
         }
         tf2, cmd2 := detectSelectors(vals)
@@ -471,7 +819,7 @@ func extractSelectors(vals url.Values) (string, string) {
         }
     }
 
-    if DebugMode {
+    if DebugMode.Load() {
         log.Printf("[DEBUG] Final selector values - timeframe: '%s', command: '%s'", tf, cmd)
     }
 
@@ -58,7 +58,7 @@ func TestHandleQuery(t *testing.T) {
 
     for _, tt := range tests {
         t.Run(tt.name, func(t *testing.T) {
-            DebugMode = tt.debugMode
+            DebugMode.Store(tt.debugMode)
             p := NewChronoProxy()
 
             // Build request
@@ -0,0 +1,194 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/heatmap.go
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// GET/POST .../api/v1/chrono/heatmap - where over the day did things look
+// odd, and how odd? 🌡️
+//
+// Takes the same query, start, end and step as query_range, works out
+// percentCompareAgainstLast28 for every series, and counts the points
+// into a grid: time buckets of interval (default 1h) across, deviation
+// buckets down. The answer is a Prometheus matrix shaped like a classic
+// histogram - one series per deviation bucket, labelled le with its upper
+// bound (+Inf last), counts cumulative, a point at the start of every time
+// bucket - which is what Grafana's heatmap panel reads with "Y buckets: le".
+//
+//   buckets=-50,-10,10,50     deviation bounds, percent (default below)
+//   deviation=absolute        compareAgainstLast28 instead of the percent
+//   interval=15m              time bucket width
+//
+// A point whose baseline is zero counts as no deviation, as it does in
+// percentCompareAgainstLast28.
+
+const (
+	heatmapPath            = "/api/v1/chrono/heatmap"
+	heatmapDefaultInterval = time.Hour
+	heatmapMaxBuckets      = 100
+	heatmapMaxCells        = 100000 // time buckets × deviation buckets
+)
+
+// heatmapDefaultBounds are the percent deviation buckets when the request
+// doesn't bring its own.
+var heatmapDefaultBounds = []float64{-100, -50, -25, -10, -5, 5, 10, 25, 50, 100}
+
+// handleHeatmap answers .../api/v1/chrono/heatmap.
+func (p *ChronoProxy) handleHeatmap(w http.ResponseWriter, r *http.Request, upstream string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	params := parseClientParams(r)
+	if params.Get("query") == "" {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "query is required")
+		return
+	}
+	bounds, err := heatmapBounds(params.Get("buckets"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	interval := heatmapDefaultInterval
+	if raw := params.Get("interval"); raw != "" {
+		if interval, err = parseOffset(raw); err != nil || interval < time.Minute {
+			writeJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("interval %q should be a duration of a minute or more", raw))
+			return
+		}
+	}
+	tf := "percentCompareAgainstLast28"
+	switch params.Get("deviation") {
+	case "", "percent":
+	case "absolute":
+		tf = "compareAgainstLast28"
+	default:
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "deviation should be percent or absolute")
+		return
+	}
+	startMs := parseTimeMs(params.Get("start"), p.clock.Now())
+	endMs := parseTimeMs(params.Get("end"), p.clock.Now())
+	if endMs < startMs {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "end is before start")
+		return
+	}
+	if cells := ((endMs-startMs)/interval.Milliseconds() + 1) * int64(len(bounds)+1); cells > heatmapMaxCells {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("%d cells is over the %d limit, widen interval or narrow the range", cells, heatmapMaxCells))
+		return
+	}
+	for _, k := range []string{"buckets", "deviation", "interval"} {
+		params.Del(k)
+	}
+	params["match[]"] = append(params["match[]"], `chrono_timeframe="`+tf+`"`)
+
+	warnings := &warningList{}
+	ctx := withWarnings(withPriority(r.Context(), p.requestPriority(r)), warnings)
+	series, err := p.evaluate(ctx, params, upstream+"/api/v1/query_range", true)
+	if err != nil {
+		p.writeEvalError(w, err)
+		return
+	}
+	reportSeries(ctx, len(series))
+
+	out := map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": "matrix",
+			"result":     model.Matrix(buildHeatmap(series, bounds, startMs, endMs, interval.Milliseconds())),
+		},
+	}
+	if list := warnings.list(); len(list) > 0 {
+		out["warnings"] = list
+	}
+	writeJSONRaw(w, out)
+}
+
+// heatmapBounds reads buckets=..., sorted, without duplicates.
+func heatmapBounds(raw string) ([]float64, error) {
+	if raw == "" {
+		return heatmapDefaultBounds, nil
+	}
+	seen := make(map[float64]bool)
+	var bounds []float64
+	for _, part := range strings.Split(raw, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(b) {
+			return nil, fmt.Errorf("bucket bound %q isn't a number", part)
+		}
+		if math.IsInf(b, 1) || seen[b] {
+			continue // +Inf is always there
+		}
+		seen[b] = true
+		bounds = append(bounds, b)
+	}
+	if len(bounds) > heatmapMaxBuckets {
+		return nil, fmt.Errorf("at most %d bucket bounds, got %d", heatmapMaxBuckets, len(bounds))
+	}
+	sort.Float64s(bounds)
+	return bounds, nil
+}
+
+// buildHeatmap counts every point of series into time buckets of width
+// intervalMs from startMs, and deviation buckets by bounds, returning one
+// cumulative series per bound plus +Inf.
+func buildHeatmap(series []model.Series, bounds []float64, startMs, endMs, intervalMs int64) []model.Series {
+	columns := int((endMs-startMs)/intervalMs) + 1
+	counts := make([][]float64, len(bounds)+1) // [bucket][column]
+	for i := range counts {
+		counts[i] = make([]float64, columns)
+	}
+	for _, s := range series {
+		for _, pt := range s.Points {
+			if pt.T < startMs || pt.T > endMs || math.IsNaN(pt.V) || math.IsInf(pt.V, 0) {
+				continue
+			}
+			col := int((pt.T - startMs) / intervalMs)
+			counts[sort.SearchFloat64s(bounds, pt.V)][col]++
+		}
+	}
+
+	out := make([]model.Series, len(counts))
+	for i := range counts {
+		le := math.Inf(1)
+		if i < len(bounds) {
+			le = bounds[i]
+		}
+		pts := make([]model.Point, columns)
+		for col := range pts {
+			v := counts[i][col]
+			if i > 0 {
+				v += out[i-1].Points[col].V
+			}
+			pts[col] = model.Point{T: startMs + int64(col)*intervalMs, V: v}
+		}
+		out[i] = model.Series{
+			Labels: map[string]string{"le": model.FormatValue(le)},
+			Points: pts,
+		}
+	}
+	return out
+}
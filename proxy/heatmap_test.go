@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestHeatmap(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	const end = 1699999980
+	for _, days := range []int64{0, 7, 14, 21, 28} {
+		at := end - days*86400
+		first, last := 10, 10
+		if days == 0 {
+			first, last = 12, 20 // 20% then 100% over the baseline
+		}
+		fake.Serve("/api/v1/query_range", at, []byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[%d,"%d"],[%d,"%d"]]}]}}`, at-3600, first, at, last)))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxyWithConfig(DefaultConfig)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+heatmapPath+"?"+query, nil))
+		return w
+	}
+	w := get(fmt.Sprintf("query=up&start=%d&end=%d&step=3600&interval=1h&buckets=50,0", end-3600, end))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data struct {
+			ResultType string       `json:"resultType"`
+			Result     model.Matrix `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data.ResultType != "matrix" || len(resp.Data.Result) != 3 {
+		t.Fatalf("want three buckets, got %s", w.Body.String())
+	}
+	want := map[string][]float64{"0": {0, 0}, "50": {1, 0}, "+Inf": {1, 1}}
+	for i, le := range []string{"0", "50", "+Inf"} {
+		s := resp.Data.Result[i]
+		if s.Labels["le"] != le || len(s.Points) != 2 {
+			t.Errorf("bucket %d = %+v, want le=%s with two points", i, s, le)
+			continue
+		}
+		for col, v := range want[le] {
+			if s.Points[col].V != v || s.Points[col].T != (end-3600+int64(col)*3600)*1000 {
+				t.Errorf("le=%s column %d = %+v, want %v", le, col, s.Points[col], v)
+			}
+		}
+	}
+
+	for _, bad := range []string{"start=1&end=2", "query=up&buckets=a", "query=up&interval=10s", "query=up&deviation=sideways", "query=up&start=0&end=1700000000&interval=1m"} {
+		if w := get(bad); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", bad, w.Code)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/histograms.go
+package proxy
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Histogram buckets - a set, not a pile of unrelated series 📊
+//
+// A classic histogram is one series per bucket, each counting everything
+// up to its le, so a bigger le never has a smaller count. histogram_quantile
+// relies on that. Every synthetic is worked out bucket by bucket, and that
+// can break it: if 14days is missing its +Inf bucket (a scrape that lost
+// half the buckets, a renamed bucket layout), +Inf averages over one window
+// fewer than le="1" and ends up below it. The quantile over that is
+// nonsense.
+//
+// So after the synthetics are built, anything that looks like a bucket set
+// - series the same apart from a numeric le, +Inf among them - is made
+// cumulative again: at each timestamp a bucket gets at least the value of
+// the bucket below it. Nothing needs to know the metric's type for this;
+// sum by (le) (rate(x_bucket[5m])) gets it too. Synthetics that aren't
+// counts (compare, percent, stddev) are left alone, and so are the windows
+// fetched from upstream, which are whatever Prometheus said they were.
+//
+// Buckets are also sorted by le as numbers, so 2.5 comes before 10.
+
+// notCumulative are the synthetics that aren't counts, so aren't buckets
+// even when they carry le.
+var notCumulative = map[string]bool{
+	"compareAgainstLast28":        true,
+	"percentCompareAgainstLast28": true,
+	"lastMonthStddev":             true,
+	standardErrorName:             true,
+}
+
+// bucketBound is s's le, if s looks like a histogram bucket.
+func bucketBound(s model.Series) (float64, bool) {
+	raw, ok := s.Labels["le"]
+	if !ok {
+		return 0, false
+	}
+	le, err := strconv.ParseFloat(raw, 64)
+	return le, err == nil
+}
+
+// monotoniseBuckets makes each synthetic bucket set cumulative again.
+func monotoniseBuckets(seriesList []model.Series) {
+	type bucket struct {
+		le float64
+		s  model.Series
+	}
+	sets := make(map[string][]bucket)
+	for _, s := range seriesList {
+		tf := s.Labels["chrono_timeframe"]
+		if !isSyntheticTimeframe(tf) || notCumulative[tf] {
+			continue
+		}
+		le, ok := bucketBound(s)
+		if !ok {
+			continue
+		}
+		rest := copyMetric(s.Labels)
+		delete(rest, "le")
+		key := signature(rest) + "|" + tf
+		sets[key] = append(sets[key], bucket{le, s})
+	}
+	for _, set := range sets {
+		sort.Slice(set, func(i, j int) bool { return set[i].le < set[j].le })
+		if len(set) < 2 || !math.IsInf(set[len(set)-1].le, 1) {
+			continue // no +Inf bucket: probably not a histogram at all
+		}
+		below := make(map[int64]float64)
+		for _, b := range set {
+			for i, pt := range b.s.Points {
+				if prev, ok := below[pt.T]; ok && !math.IsNaN(pt.V) && pt.V < prev {
+					b.s.Points[i].V = prev
+				}
+				below[pt.T] = b.s.Points[i].V
+			}
+		}
+	}
+}
+
+// Quantile baselines - "what's a normal p99?" without the PromQL 🎯
+//
+// chrono_timeframe="lastMonthHistogramP99" adds up the past windows'
+// buckets step by step, as if the last month had been one histogram,
+// and answers histogram_quantile(0.99, ...) over that: one series per
+// bucket set, le gone, in the buckets' unit. The digits after P are the
+// quantile's: P50 is 0.5, P999 is 0.999.
+//
+// Buckets are counters, so rate them first (chrono_counter="rate", or
+// rate(x_bucket[5m]) in the query) - otherwise each window's distribution
+// is everything since its process started, which is rarely what you meant.
+
+const histogramQuantilePrefix = "lastMonthHistogramP"
+
+// histogramQuantileFor is the quantile a lastMonthHistogramP... timeframe
+// asks for.
+func histogramQuantileFor(tf string) (float64, bool) {
+	digits, ok := strings.CutPrefix(tf, histogramQuantilePrefix)
+	if !ok || digits == "" || len(digits) > 6 {
+		return 0, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	q, err := strconv.ParseFloat("0."+digits, 64)
+	return q, err == nil && q > 0
+}
+
+// buildHistogramQuantile merges the past windows' bucket sets, a cell of
+// grid at a time, and takes quantile q over them, calling the result tf.
+func buildHistogramQuantile(seriesList []model.Series, isRange bool, grid synthGrid, tf string, q float64) []model.Series {
+	type set struct {
+		metric map[string]string
+		byStep map[int64]map[float64]float64 // cell -> le -> count
+	}
+	sets := make(map[string]*set)
+	for _, s := range seriesList {
+		if s.Labels["chrono_timeframe"] == "current" {
+			continue
+		}
+		le, ok := bucketBound(s)
+		if !ok {
+			continue
+		}
+		rest := copyMetric(s.Labels)
+		delete(rest, "le")
+		delete(rest, "chrono_timeframe")
+		delete(rest, "_command")
+		sig := signature(rest)
+		st, ok := sets[sig]
+		if !ok {
+			st = &set{metric: rest, byStep: make(map[int64]map[float64]float64)}
+			sets[sig] = st
+		}
+		for _, pt := range s.Points {
+			if math.IsNaN(pt.V) {
+				continue
+			}
+			at := grid.bucket(pt.T)
+			if st.byStep[at] == nil {
+				st.byStep[at] = make(map[float64]float64)
+			}
+			st.byStep[at][le] += pt.V
+		}
+	}
+
+	var out []model.Series
+	for _, st := range sets {
+		pts := make([]model.Point, 0, len(st.byStep))
+		for m, counts := range st.byStep {
+			if v := bucketQuantile(q, counts); !math.IsNaN(v) {
+				pts = append(pts, model.Point{T: m, V: v})
+			}
+		}
+		if len(pts) == 0 {
+			continue
+		}
+		sort.Slice(pts, func(i, j int) bool { return pts[i].T < pts[j].T })
+		if !isRange {
+			pts = pts[len(pts)-1:]
+		}
+		delete(st.metric, "__name__") // it's a duration (or whatever le is), not a count
+		st.metric["chrono_timeframe"] = tf
+		out = append(out, model.Series{Labels: st.metric, Points: pts})
+	}
+	return out
+}
+
+// bucketQuantile is histogram_quantile over one set of cumulative counts
+// keyed by le, interpolating linearly inside the bucket the rank lands
+// in. NaN without a +Inf bucket or any observations.
+func bucketQuantile(q float64, counts map[float64]float64) float64 {
+	les := make([]float64, 0, len(counts))
+	for le := range counts {
+		les = append(les, le)
+	}
+	sort.Float64s(les)
+	if len(les) < 2 || !math.IsInf(les[len(les)-1], 1) {
+		return math.NaN()
+	}
+	cum := make([]float64, len(les))
+	for i, le := range les {
+		cum[i] = counts[le]
+		if i > 0 && cum[i] < cum[i-1] {
+			cum[i] = cum[i-1] // same repair as monotoniseBuckets
+		}
+	}
+	total := cum[len(cum)-1]
+	if total <= 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	b := sort.SearchFloat64s(cum, rank)
+	switch {
+	case b == len(les)-1:
+		return les[len(les)-2] // in +Inf: the highest finite bound is all we know
+	case b == 0 && les[0] <= 0:
+		return les[0]
+	}
+	start, below := 0.0, 0.0
+	if b > 0 {
+		start, below = les[b-1], cum[b-1]
+	}
+	return start + (les[b]-start)*(rank-below)/(cum[b]-below)
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"math"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestBucketSetsStayCumulative(t *testing.T) {
+	bucket := func(tf, le string, vals ...float64) model.Series {
+		s := model.Series{Labels: map[string]string{"__name__": "latency_bucket", "chrono_timeframe": tf, "le": le}}
+		for i, v := range vals {
+			s.Points = append(s.Points, model.Point{T: int64(i) * 60000, V: v})
+		}
+		return s
+	}
+	series := []model.Series{
+		bucket("lastMonthAverage", "+Inf", 10, 4),
+		bucket("lastMonthAverage", "10", 9, 6),
+		bucket("lastMonthAverage", "2.5", 7, 5),
+		bucket("lastMonthAverage", "0.5", 2, 1),
+		bucket("compareAgainstLast28", "+Inf", -3, 0),
+		bucket("compareAgainstLast28", "1", 2, 0),
+		bucket("current", "+Inf", 1, 1),
+		bucket("current", "1", 5, 5),
+	}
+	noInf := []model.Series{bucket("lastMonthMax", "1", 5), bucket("lastMonthMax", "2", 3)}
+	series = append(series, noInf...)
+
+	monotoniseBuckets(series)
+	sortSeries(series)
+
+	var got [][]float64
+	var les []string
+	for _, s := range series {
+		if s.Labels["chrono_timeframe"] != "lastMonthAverage" {
+			continue
+		}
+		les = append(les, s.Labels["le"])
+		var vals []float64
+		for _, pt := range s.Points {
+			vals = append(vals, pt.V)
+		}
+		got = append(got, vals)
+	}
+	if len(les) != 4 || les[0] != "0.5" || les[1] != "2.5" || les[2] != "10" || les[3] != "+Inf" {
+		t.Errorf("buckets should be in le order, got %v", les)
+	}
+	want := [][]float64{{2, 1}, {7, 5}, {9, 6}, {10, 6}}
+	for i := range want {
+		if len(got) <= i || got[i][0] != want[i][0] || got[i][1] != want[i][1] {
+			t.Errorf("lastMonthAverage = %v, want %v", got, want)
+			break
+		}
+	}
+
+	for _, s := range series {
+		switch tf := s.Labels["chrono_timeframe"]; {
+		case tf == "compareAgainstLast28" && s.Labels["le"] == "+Inf" && s.Points[0].V != -3:
+			t.Error("differences aren't counts and should be left alone")
+		case tf == "current" && s.Labels["le"] == "+Inf" && s.Points[0].V != 1:
+			t.Error("fetched windows should be left as they came")
+		case tf == "lastMonthMax" && s.Labels["le"] == "2" && s.Points[0].V != 3:
+			t.Error("without a +Inf bucket it's not a histogram")
+		}
+	}
+}
+
+func TestHistogramQuantileBaseline(t *testing.T) {
+	for tf, want := range map[string]float64{"lastMonthHistogramP99": 0.99, "lastMonthHistogramP5": 0.5, "lastMonthHistogramP999": 0.999} {
+		if q, ok := histogramQuantileFor(tf); !ok || q != want {
+			t.Errorf("histogramQuantileFor(%q) = %v, %v; want %v", tf, q, ok, want)
+		}
+	}
+	for _, tf := range []string{"lastMonthHistogramP", "lastMonthHistogramP0", "lastMonthHistogramPx", "lastMonthP95"} {
+		if _, ok := histogramQuantileFor(tf); ok {
+			t.Errorf("histogramQuantileFor(%q) should not parse", tf)
+		}
+	}
+	if !isSyntheticTimeframe("lastMonthHistogramP99") {
+		t.Error("quantile baselines are synthetic")
+	}
+
+	bucket := func(tf, le string, v float64) model.Series {
+		return model.Series{
+			Labels: map[string]string{"__name__": "latency_bucket", "job": "api", "chrono_timeframe": tf, "le": le},
+			Points: []model.Point{{T: 60000, V: v}},
+		}
+	}
+	// Two weeks of 10 observations each: merged, 20 with 10 up to 0.1,
+	// 18 up to 1 and all 20 below +Inf
+	series := []model.Series{
+		bucket("current", "0.1", 0), bucket("current", "1", 0), bucket("current", "+Inf", 100),
+		bucket("7days", "0.1", 6), bucket("7days", "1", 9), bucket("7days", "+Inf", 10),
+		bucket("14days", "0.1", 4), bucket("14days", "1", 9), bucket("14days", "+Inf", 10),
+	}
+	got := buildHistogramQuantile(series, false, minuteGrid, "lastMonthHistogramP5", 0.5)
+	if len(got) != 1 || len(got[0].Points) != 1 {
+		t.Fatalf("want one series with one point, got %+v", got)
+	}
+	if l := got[0].Labels; l["chrono_timeframe"] != "lastMonthHistogramP5" || l["job"] != "api" || l["le"] != "" || l["__name__"] != "" {
+		t.Errorf("labels = %v", l)
+	}
+	if v := got[0].Points[0].V; v != 0.1 {
+		t.Errorf("median = %v, want 0.1", v)
+	}
+	// rank 13 lands 3 of 8 into (0.1, 1]
+	if v := buildHistogramQuantile(series, false, minuteGrid, "x", 0.65)[0].Points[0].V; math.Abs(v-(0.1+0.9*3/8)) > 1e-9 {
+		t.Errorf("p65 = %v", v)
+	}
+	// rank 19.8 is in +Inf: the highest finite bound
+	if v := buildHistogramQuantile(series, false, minuteGrid, "x", 0.99)[0].Points[0].V; v != 1 {
+		t.Errorf("p99 = %v, want 1", v)
+	}
+	if got := buildHistogramQuantile(series[3:6], false, minuteGrid, "x", 0.5); len(got) != 1 {
+		t.Errorf("one window is still a baseline, got %+v", got)
+	}
+	if got := buildHistogramQuantile([]model.Series{bucket("7days", "1", 3)}, false, minuteGrid, "x", 0.5); len(got) != 0 {
+		t.Errorf("no +Inf bucket, no quantile, got %+v", got)
+	}
+}
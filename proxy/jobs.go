@@ -0,0 +1,388 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/jobs.go
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Asynchronous chrono jobs!
+// Some queries are just too big to answer inside a single HTTP timeout -
+// 30 days of data across five windows takes a while, and Grafana (or your
+// load balancer) will happily give up before we're done.
+//
+// So instead of making the client wait, they can drop the query off at the
+// front desk and come back for it later:
+//
+//   POST   .../api/v1/chrono/jobs              → start a job, get an ID back
+//   GET    .../api/v1/chrono/jobs/{id}         → how's it going?
+//   GET    .../api/v1/chrono/jobs/{id}/result  → the finished Prometheus response
+//   GET    .../api/v1/chrono/jobs/{id}/stream  → progress as newline-delimited JSON
+//   DELETE .../api/v1/chrono/jobs/{id}         → never mind, cancel it
+//
+// Jobs take exactly the same params as query/query_range. If both start and
+// end are present it's treated as a range query, otherwise as an instant one.
+// A job runs as the tenant and identity that submitted it, and only that
+// tenant can see it - everybody else gets a 404.
+
+const jobsPath = "/api/v1/chrono/jobs"
+
+type jobState string
+
+const (
+	jobRunning   jobState = "running"
+	jobDone      jobState = "done"
+	jobFailed    jobState = "failed"
+	jobCancelled jobState = "cancelled"
+)
+
+// chronoJob is one query ticking away in the background.
+type chronoJob struct {
+	mu         sync.Mutex
+	id         string
+	query      string
+	resultType string
+	state      jobState
+	err        string
+	created    time.Time
+	finished   time.Time
+	done       int // windows fetched so far
+	total      int // windows we expect to fetch
+	result     []model.Series
+	warnings   *warningList // things that went wrong without failing the job
+	trace      *evalTrace   // filled in for _command="TRACE" (see evaltrace.go)
+	provenance string       // provenance mode for the result (see provenance.go)
+	tenant     string       // who submitted it, "" for no tenant (see tenants.go)
+	cancel     context.CancelFunc
+	changed    chan struct{} // closed and replaced whenever something happens
+}
+
+// jobStatus is the JSON shape we hand back when someone asks about a job.
+type jobStatus struct {
+	ID         string    `json:"id"`
+	State      jobState  `json:"state"`
+	Query      string    `json:"query"`
+	ResultType string    `json:"resultType"`
+	Progress   float64   `json:"progress"`
+	Done       int       `json:"windowsDone"`
+	Total      int       `json:"windowsTotal"`
+	Error      string    `json:"error,omitempty"`
+	Created    time.Time `json:"created"`
+	Finished   time.Time `json:"finished,omitempty"`
+}
+
+func (j *chronoJob) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := jobStatus{
+		ID:         j.id,
+		State:      j.state,
+		Query:      j.query,
+		ResultType: j.resultType,
+		Done:       j.done,
+		Total:      j.total,
+		Error:      j.err,
+		Created:    j.created,
+		Finished:   j.finished,
+	}
+	if j.total > 0 {
+		st.Progress = float64(j.done) / float64(j.total)
+	}
+	if j.state == jobDone {
+		st.Progress = 1
+	}
+	return st
+}
+
+// update applies fn under the lock and wakes up anybody streaming progress.
+func (j *chronoJob) update(fn func()) {
+	j.mu.Lock()
+	fn()
+	close(j.changed)
+	j.changed = make(chan struct{})
+	j.mu.Unlock()
+}
+
+// watch returns a channel that is closed the next time the job changes.
+func (j *chronoJob) watch() <-chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.changed
+}
+
+func (j *chronoJob) finishedAt() (time.Time, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finished, j.state != jobRunning
+}
+
+// jobStore is the cloakroom - it hangs on to jobs until their ticket expires.
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*chronoJob
+	ttl  time.Duration
+	max  int
+	now  func() time.Time
+	wg   sync.WaitGroup // running jobs, so shutdown can wait for them
+}
+
+func newJobStore(ttl time.Duration, max int) *jobStore {
+	return &jobStore{jobs: make(map[string]*chronoJob), ttl: ttl, max: max, now: time.Now}
+}
+
+// add registers a job, sweeping out expired ones first.
+// Returns an error if we're already juggling too many running jobs.
+func (s *jobStore) add(j *chronoJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := 0
+	for id, existing := range s.jobs {
+		if at, finished := existing.finishedAt(); finished {
+			if s.now().Sub(at) > s.ttl {
+				delete(s.jobs, id)
+			}
+			continue
+		}
+		running++
+	}
+	if s.max > 0 && running >= s.max {
+		return &saturatedError{
+			reason: reasonJobLimit,
+			msg:    fmt.Sprintf("too many running jobs (max %d)", s.max),
+		}
+	}
+	s.jobs[j.id] = j
+	return nil
+}
+
+func (s *jobStore) get(id string) *chronoJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id]
+}
+
+// len counts the jobs held, running or waiting to be collected.
+func (s *jobStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs)
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// progressKey lets the window fetchers tell whoever's interested how far
+// along they are, without caring whether that's a job or nobody at all.
+type progressKey struct{}
+
+type progressFunc func(done, total int)
+
+func withProgress(ctx context.Context, fn progressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func reportProgress(ctx context.Context, done, total int) {
+	if fn, ok := ctx.Value(progressKey{}).(progressFunc); ok {
+		fn(done, total)
+	}
+}
+
+// handleJobs is the front desk for everything under /api/v1/chrono/jobs.
+func (p *ChronoProxy) handleJobs(w http.ResponseWriter, r *http.Request, upstream, suffix string) {
+	if DebugMode.Load() {
+		log.Printf("[DEBUG] handleJobs: %s %s", r.Method, r.URL.Path)
+	}
+
+	rest := strings.Trim(strings.TrimPrefix(suffix, jobsPath), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, `{"status":"error","error":"Jobs must be submitted with POST"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		p.startJob(w, r, upstream)
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	job := p.jobs.get(id)
+	if job == nil || job.tenant != tenantFrom(r.Context()).name() {
+		http.Error(w, `{"status":"error","error":"Job not found"}`, http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		job.cancel()
+		writeJSONRaw(w, map[string]interface{}{"status": "success", "data": job.status()})
+	case action == "":
+		writeJSONRaw(w, map[string]interface{}{"status": "success", "data": job.status()})
+	case action == "result":
+		p.writeJobResult(w, job)
+	case action == "stream":
+		streamJob(w, r, job)
+	default:
+		http.Error(w, `{"status":"error","error":"Unknown job action"}`, http.StatusNotFound)
+	}
+}
+
+// startJob kicks off evaluation in the background and answers straight away
+// with 202 Accepted and the job's ticket number.
+func (p *ChronoProxy) startJob(w http.ResponseWriter, r *http.Request, upstream string) {
+	params := parseClientParams(r)
+	provenance := p.provenanceMode(params)
+
+	// Refused now rather than as a failed job later; evaluate checks again
+	tenant := tenantFrom(r.Context())
+	tf, _ := detectSelectors(params)
+	if err := tenant.checkTimeframe(tf); err != nil {
+		p.writeEvalError(w, err)
+		return
+	}
+
+	isRange := params.Get("start") != "" && params.Get("end") != ""
+	endpoint, resultType := upstream+"/api/v1/query", "vector"
+	if isRange {
+		endpoint, resultType = upstream+"/api/v1/query_range", "matrix"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.JobTimeout)
+	job := &chronoJob{
+		id:         newJobID(),
+		query:      params.Get("query"),
+		resultType: resultType,
+		provenance: provenance,
+		tenant:     tenant.name(),
+		state:      jobRunning,
+		created:    p.clock.Now(),
+		cancel:     cancel,
+		changed:    make(chan struct{}),
+		warnings:   &warningList{},
+		trace:      &evalTrace{},
+	}
+	if err := p.jobs.add(job); err != nil {
+		cancel()
+		p.writeEvalError(w, err)
+		return
+	}
+
+	ctx = withUpstream(ctx, upstreamFrom(r.Context()))
+	ctx = withTenant(ctx, tenant)
+	ctx = withIdentity(ctx, identityFrom(r.Context()))
+	ctx = withCapabilities(ctx, capabilitiesFrom(r.Context()))
+	ctx = withClientAuthorization(ctx, clientAuthorizationFrom(r.Context()))
+	ctx = withMirror(ctx, mirrorFrom(r.Context()))
+	ctx = withQuota(ctx, quotaFrom(r.Context()))
+	ctx = withSpan(ctx, spanFrom(r.Context())) // the job's windows show up in the submitting request's trace
+	ctx = withTrace(withWarnings(ctx, job.warnings), job.trace)
+	ctx = withPriority(ctx, priorityBatch)
+	ctx = withQueueWait(ctx, 0) // we've handed out a ticket - wait our turn
+	ctx = withProgress(ctx, func(done, total int) {
+		job.update(func() { job.done, job.total = done, total })
+	})
+
+	p.jobs.wg.Add(1)
+	go func() {
+		defer p.jobs.wg.Done()
+		defer cancel()
+		merged, err := p.evaluate(ctx, params, endpoint, isRange)
+		job.update(func() {
+			job.finished = p.clock.Now()
+			switch {
+			case ctx.Err() == context.Canceled:
+				job.state = jobCancelled
+				job.err = "job cancelled"
+			case ctx.Err() != nil:
+				job.state = jobFailed
+				job.err = ctx.Err().Error()
+			case err != nil:
+				job.state = jobFailed
+				job.err = err.Error()
+			default:
+				job.state = jobDone
+				job.result = merged
+			}
+		})
+		if DebugMode.Load() {
+			log.Printf("[DEBUG] job %s finished: %s (%d series)", job.id, job.status().State, len(merged))
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+job.id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": job.status()})
+}
+
+// writeJobResult returns the finished result in the usual Prometheus shape,
+// or a 409 if the job isn't finished (or never will be).
+func (p *ChronoProxy) writeJobResult(w http.ResponseWriter, job *chronoJob) {
+	st := job.status()
+	switch st.State {
+	case jobDone:
+		job.mu.Lock()
+		result := job.result
+		job.mu.Unlock()
+		p.writeResult(w, st.ResultType, result, job.provenance, job.warnings.list(), job.trace.report())
+	case jobRunning:
+		http.Error(w, `{"status":"error","error":"Job still running"}`, http.StatusConflict)
+	default:
+		writeJSONError(w, http.StatusConflict, "execution", st.Error)
+	}
+}
+
+// streamJob emits one JSON status line every time the job moves along,
+// finishing once it's done, failed or cancelled (or the client wanders off).
+func streamJob(w http.ResponseWriter, r *http.Request, job *chronoJob) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	for {
+		changed := job.watch()
+		st := job.status()
+		enc.Encode(st)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if st.State != jobRunning {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
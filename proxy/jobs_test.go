@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobLifecycle(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"a":"1"},"value":[100,"5"]}]}}`))
+	}))
+	defer upstream.Close()
+
+	p := NewChronoProxy()
+
+	req := httptest.NewRequest("POST", "/x_1"+jobsPath, strings.NewReader("query=test_metric"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	p.handleJobs(w, req, upstream.URL, jobsPath)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("submit: got %d; want 202", w.Code)
+	}
+	var submitted struct {
+		Data jobStatus `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil {
+		t.Fatalf("decode submit: %v", err)
+	}
+	if submitted.Data.ID == "" || submitted.Data.ResultType != "vector" {
+		t.Fatalf("unexpected submit response: %+v", submitted.Data)
+	}
+
+	// The stream endpoint only returns once the job has finished
+	w = httptest.NewRecorder()
+	p.handleJobs(w, httptest.NewRequest("GET", "/", nil), upstream.URL, jobsPath+"/"+submitted.Data.ID+"/stream")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	var last jobStatus
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if last.State != jobDone || last.Done != 5 || last.Total != 5 {
+		t.Fatalf("final stream status = %+v; want done with 5/5 windows", last)
+	}
+
+	w = httptest.NewRecorder()
+	p.handleJobs(w, httptest.NewRequest("GET", "/", nil), upstream.URL, jobsPath+"/"+submitted.Data.ID+"/result")
+	if w.Code != http.StatusOK {
+		t.Fatalf("result: got %d; want 200", w.Code)
+	}
+	var result struct {
+		Data struct {
+			ResultType string                   `json:"resultType"`
+			Result     []map[string]interface{} `json:"result"`
+		} `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&result)
+	// 5 windows + avg + compare + percent
+	if result.Data.ResultType != "vector" || len(result.Data.Result) != 9 {
+		t.Errorf("result = %s with %d series; want vector with 9", result.Data.ResultType, len(result.Data.Result))
+	}
+}
+
+func TestJobNotFound(t *testing.T) {
+	p := NewChronoProxy()
+	w := httptest.NewRecorder()
+	p.handleJobs(w, httptest.NewRequest("GET", "/", nil), "http://unused", jobsPath+"/nope")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d; want 404", w.Code)
+	}
+}
+
+func TestJobStoreLimitsRunningJobs(t *testing.T) {
+	s := newJobStore(time.Minute, 1)
+	if err := s.add(&chronoJob{id: "a", state: jobRunning}); err != nil {
+		t.Fatalf("first add: %v", err)
+	}
+	if err := s.add(&chronoJob{id: "b", state: jobRunning}); err == nil {
+		t.Error("expected second running job to be rejected")
+	}
+}
@@ -0,0 +1,279 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/kubernetes.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kubernetes service discovery - Prometheus servers come and go in a
+// cluster, so let the cluster tell us where they are:
+//
+//   kubernetes_sd:
+//     - role: service                        # or "pod"
+//       namespace: monitoring                # empty = every namespace we can see
+//       label_selector: app=prometheus
+//       port: web                            # port name or number, default: the first one
+//
+// Every match becomes an upstream named <name>.<namespace> (plus an
+// optional name_prefix), so /prometheus-k8s.monitoring/api/v1/query just
+// works. We talk to the API server with plain HTTP and the pod's service
+// account - no client library, just a list call every refresh_interval.
+// The service account needs get/list on services (or pods).
+
+const (
+	serviceAccountDir  = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultK8sRefresh  = 30 * time.Second
+	kubernetesRolePod  = "pod"
+	kubernetesRoleSvc  = "service"
+	kubernetesSDSource = "kubernetes_sd"
+)
+
+// KubernetesSDConfig is one kubernetes_sd block in the config file.
+type KubernetesSDConfig struct {
+	Role            string            `yaml:"role,omitempty"`             // "service" (default) or "pod"
+	Namespace       string            `yaml:"namespace,omitempty"`        // Only look here ("" = all namespaces)
+	LabelSelector   string            `yaml:"label_selector,omitempty"`   // Standard selector, e.g. app=prometheus,tier!=canary
+	Port            string            `yaml:"port,omitempty"`             // Port name or number ("" = first port)
+	Scheme          string            `yaml:"scheme,omitempty"`           // http (default) or https for the discovered upstreams
+	NamePrefix      string            `yaml:"name_prefix,omitempty"`      // Stuck on the front of every discovered name
+	RefreshInterval time.Duration     `yaml:"refresh_interval,omitempty"` // How often to re-list (default 30s)
+	TLS             UpstreamTLSConfig `yaml:"tls,omitempty"`              // TLS for the discovered upstreams
+
+	APIServer       string `yaml:"api_server,omitempty"`        // Default: in-cluster, from KUBERNETES_SERVICE_HOST/PORT
+	BearerTokenFile string `yaml:"bearer_token_file,omitempty"` // Default: the pod's service account token
+	CAFile          string `yaml:"ca_file,omitempty"`           // Default: the pod's service account CA
+}
+
+// validate catches bad blocks at config load time.
+func (c KubernetesSDConfig) validate() error {
+	switch c.Role {
+	case "", kubernetesRoleSvc, kubernetesRolePod:
+	default:
+		return fmt.Errorf("role must be %q or %q, got %q", kubernetesRoleSvc, kubernetesRolePod, c.Role)
+	}
+	switch c.Scheme {
+	case "", "http", "https":
+	default:
+		return fmt.Errorf("scheme must be http or https, got %q", c.Scheme)
+	}
+	if c.APIServer != "" {
+		if u, err := url.Parse(c.APIServer); err != nil || u.Host == "" {
+			return fmt.Errorf("api_server %q is not a url", c.APIServer)
+		}
+	}
+	if !c.TLS.isZero() {
+		if _, err := buildTLSConfig(c.TLS); err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+	}
+	return nil
+}
+
+// kubernetesDiscoverer lists services or pods from the API server.
+type kubernetesDiscoverer struct {
+	cfg       KubernetesSDConfig
+	name      string
+	apiServer string
+	api       *http.Client // Talks to the API server
+	upstreams *http.Client // Talks to what we find, nil = shared client
+}
+
+func newKubernetesDiscoverer(config Config, c KubernetesSDConfig, index int) (*kubernetesDiscoverer, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if c.Role == "" {
+		c.Role = kubernetesRoleSvc
+	}
+	if c.Scheme == "" {
+		c.Scheme = "http"
+	}
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = defaultK8sRefresh
+	}
+	if c.BearerTokenFile == "" {
+		c.BearerTokenFile = serviceAccountDir + "/token"
+	}
+
+	apiServer := strings.TrimSuffix(c.APIServer, "/")
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running inside a cluster - set api_server")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+
+	caFile := c.CAFile
+	if caFile == "" {
+		if _, err := os.Stat(serviceAccountDir + "/ca.crt"); err == nil {
+			caFile = serviceAccountDir + "/ca.crt"
+		}
+	}
+	tc, err := buildTLSConfig(UpstreamTLSConfig{CAFile: caFile})
+	if err != nil {
+		return nil, err
+	}
+	upstreams, err := newTLSClient(config, c.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubernetesDiscoverer{
+		cfg:       c,
+		name:      fmt.Sprintf("%s[%d]", kubernetesSDSource, index),
+		apiServer: apiServer,
+		api:       newHTTPClient(config, tc),
+		upstreams: upstreams,
+	}, nil
+}
+
+func (d *kubernetesDiscoverer) source() string          { return d.name }
+func (d *kubernetesDiscoverer) interval() time.Duration { return d.cfg.RefreshInterval }
+func (d *kubernetesDiscoverer) client() *http.Client    { return d.upstreams }
+
+// The slivers of the Kubernetes API we actually read.
+type k8sList struct {
+	Items []k8sObject `json:"items"`
+}
+
+type k8sObject struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Ports []struct { // Services
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+		Containers []struct { // Pods
+			Ports []struct {
+				Name          string `json:"name"`
+				ContainerPort int    `json:"containerPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// listURL builds e.g. /api/v1/namespaces/monitoring/services?labelSelector=app%3Dprometheus
+func (d *kubernetesDiscoverer) listURL() string {
+	path := "/api/v1/"
+	if d.cfg.Namespace != "" {
+		path += "namespaces/" + url.PathEscape(d.cfg.Namespace) + "/"
+	}
+	path += d.cfg.Role + "s"
+	if d.cfg.LabelSelector != "" {
+		path += "?labelSelector=" + url.QueryEscape(d.cfg.LabelSelector)
+	}
+	return d.apiServer + path
+}
+
+func (d *kubernetesDiscoverer) discover(ctx context.Context) ([]UpstreamConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.listURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Re-read every time: projected service account tokens get rotated.
+	if token, err := os.ReadFile(d.cfg.BearerTokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading bearer token: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.api.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("listing %ss: %w", d.cfg.Role, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing %ss: API server said %s", d.cfg.Role, resp.Status)
+	}
+	var list k8sList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("decoding %s list: %w", d.cfg.Role, err)
+	}
+
+	out := make([]UpstreamConfig, 0, len(list.Items))
+	for _, item := range list.Items {
+		host, port, ok := d.address(item)
+		if !ok {
+			continue
+		}
+		out = append(out, UpstreamConfig{
+			Name: d.cfg.NamePrefix + item.Metadata.Name + "." + item.Metadata.Namespace,
+			URL:  d.cfg.Scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)),
+		})
+	}
+	return out, nil
+}
+
+// address works out where to reach an item. Pods that aren't running yet
+// (or have no IP) and items without a matching port are skipped.
+func (d *kubernetesDiscoverer) address(item k8sObject) (string, int, bool) {
+	type namedPort struct {
+		name   string
+		number int
+	}
+	var ports []namedPort
+	var host string
+
+	if d.cfg.Role == kubernetesRolePod {
+		if item.Status.Phase != "Running" || item.Status.PodIP == "" {
+			return "", 0, false
+		}
+		host = item.Status.PodIP
+		for _, c := range item.Spec.Containers {
+			for _, cp := range c.Ports {
+				ports = append(ports, namedPort{cp.Name, cp.ContainerPort})
+			}
+		}
+	} else {
+		host = item.Metadata.Name + "." + item.Metadata.Namespace + ".svc"
+		for _, sp := range item.Spec.Ports {
+			ports = append(ports, namedPort{sp.Name, sp.Port})
+		}
+	}
+
+	for _, np := range ports {
+		if d.cfg.Port == "" || d.cfg.Port == np.name || d.cfg.Port == strconv.Itoa(np.number) {
+			return host, np.number, true
+		}
+	}
+	// A numeric port that no container declares is still a perfectly
+	// good place to knock - declaring container ports is optional.
+	if n, err := strconv.Atoi(d.cfg.Port); err == nil && d.cfg.Role == kubernetesRolePod {
+		return host, n, true
+	}
+	return "", 0, false
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+const k8sServices = `{"items":[
+  {"metadata":{"name":"prom-a","namespace":"monitoring"},"spec":{"ports":[{"name":"grpc","port":10901},{"name":"web","port":9090}]}},
+  {"metadata":{"name":"prom-b","namespace":"monitoring"},"spec":{"ports":[{"name":"web","port":9091}]}},
+  {"metadata":{"name":"no-web","namespace":"monitoring"},"spec":{"ports":[{"name":"grpc","port":10901}]}}
+]}`
+
+func TestKubernetesDiscoverySyncsRegistry(t *testing.T) {
+	var body atomic.Value
+	body.Store(k8sServices)
+	var gotPath, gotAuth string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuth = r.URL.RequestURI(), r.Header.Get("Authorization")
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer api.Close()
+
+	token := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(token, []byte("s3cret\n"), 0o600)
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "k8s-prom-b.monitoring", URL: "http://static:9090"}}
+	config.KubernetesSD = []KubernetesSDConfig{{
+		Namespace:       "monitoring",
+		LabelSelector:   "app=prometheus",
+		Port:            "web",
+		NamePrefix:      "k8s-",
+		APIServer:       api.URL,
+		BearerTokenFile: token,
+	}}
+	p := NewChronoProxyWithConfig(config)
+	ds := p.discoverers()
+	if len(ds) != 1 {
+		t.Fatalf("got %d discoverers", len(ds))
+	}
+
+	p.refresh(context.Background(), ds[0])
+	if gotPath != "/api/v1/namespaces/monitoring/services?labelSelector=app%3Dprometheus" || gotAuth != "Bearer s3cret" {
+		t.Errorf("asked %s with %q", gotPath, gotAuth)
+	}
+	if u, ok := p.upstreams.get("k8s-prom-a.monitoring"); !ok || u.base != "http://prom-a.monitoring.svc:9090" {
+		t.Errorf("prom-a = %+v, %v", u, ok)
+	}
+	if u, _ := p.upstreams.get("k8s-prom-b.monitoring"); u.base != "http://static:9090" {
+		t.Errorf("discovery must not override the config file, got %s", u.base)
+	}
+	if _, ok := p.upstreams.get("k8s-no-web.monitoring"); ok {
+		t.Error("services without the wanted port should be skipped")
+	}
+
+	// prom-a goes away; a broken API response keeps what we had.
+	body.Store(`{"items":[]}`)
+	p.refresh(context.Background(), ds[0])
+	if got := p.upstreams.names(); !reflect.DeepEqual(got, []string{"k8s-prom-b.monitoring"}) {
+		t.Errorf("after removal names = %v", got)
+	}
+	body.Store(k8sServices)
+	p.refresh(context.Background(), ds[0])
+	body.Store(`not json`)
+	p.refresh(context.Background(), ds[0])
+	if _, ok := p.upstreams.get("k8s-prom-a.monitoring"); !ok {
+		t.Error("a failed refresh should keep the last known upstreams")
+	}
+}
+
+func TestKubernetesPodAddresses(t *testing.T) {
+	d := &kubernetesDiscoverer{cfg: KubernetesSDConfig{Role: kubernetesRolePod, Port: "9090"}}
+	var pod k8sObject
+	pod.Status.Phase, pod.Status.PodIP = "Pending", "10.0.0.7"
+	if _, _, ok := d.address(pod); ok {
+		t.Error("pending pods should be skipped")
+	}
+	pod.Status.Phase = "Running"
+	if host, port, ok := d.address(pod); !ok || host != "10.0.0.7" || port != 9090 {
+		t.Errorf("got %s:%d %v; want an undeclared numeric port to still work", host, port, ok)
+	}
+}
+
+func TestKubernetesSDValidation(t *testing.T) {
+	for _, c := range []KubernetesSDConfig{{Role: "node"}, {Scheme: "ftp"}, {APIServer: "::nope"}} {
+		config := DefaultConfig
+		config.KubernetesSD = []KubernetesSDConfig{c}
+		if err := config.Validate(); err == nil {
+			t.Errorf("%+v: expected a validation error", c)
+		}
+	}
+}
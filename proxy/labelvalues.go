@@ -0,0 +1,181 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/labelvalues.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// POST .../api/v1/chrono/label-values - every dropdown in one go.
+//
+// A Grafana dashboard with a dozen variables makes a dozen label-values
+// calls, one after the other, each a round trip through us. This asks for
+// all of them at once:
+//
+//   {"labels": ["job", "instance", "chrono_timeframe"],
+//    "match": ["up{env=\"prod\"}"], "start": "1700000000", "end": "1700003600"}
+//
+// and answers {"status": "success", "data": {"job": [...], ...}}. match,
+// start and end are optional and mean what they do for label values.
+// Chrono labels (chrono_timeframe, _command, _plugin) are answered by us;
+// the rest are fetched from the upstream side by side. A label the upstream
+// couldn't answer is left out of data and explained in warnings, so one bad
+// label doesn't cost you the other eleven.
+
+const (
+	labelValuesPath       = "/api/v1/chrono/label-values"
+	maxBulkLabels         = 100 // labels one request may ask for
+	bulkLabelConcurrency  = 8   // upstream label-values calls in flight per request
+	maxBulkLabelsBodySize = 1 << 20
+)
+
+// bulkLabelValuesRequest is what the client POSTs.
+type bulkLabelValuesRequest struct {
+	Labels []string `json:"labels"`
+	Match  []string `json:"match"`
+	Start  string   `json:"start"`
+	End    string   `json:"end"`
+}
+
+// chronoLabelValues answers label values for the labels that are ours
+// rather than the upstream's. ok is false for everything else.
+func (p *ChronoProxy) chronoLabelValues(label string) (values []string, ok bool) {
+	switch label {
+	case "chrono_timeframe":
+		return append(proxyTimeframes(), syntheticTimeframes()...), true
+	case "_command":
+		return []string{"", "DONT_REMOVE_UNUSED_HISTORICS", auditShiftCommand, traceCommand}, true
+	case pluginLabelName:
+		return p.plugins.Loaded(), true
+	}
+	return nil, false
+}
+
+// handleBulkLabelValues answers POST .../api/v1/chrono/label-values.
+func (p *ChronoProxy) handleBulkLabelValues(w http.ResponseWriter, r *http.Request, upstream string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	var req bulkLabelValuesRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBulkLabelsBodySize)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "invalid request body: "+err.Error())
+		return
+	}
+	if len(req.Labels) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "labels is empty")
+		return
+	}
+	if len(req.Labels) > maxBulkLabels {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", fmt.Sprintf("at most %d labels per request, got %d", maxBulkLabels, len(req.Labels)))
+		return
+	}
+
+	params := url.Values{}
+	if len(req.Match) > 0 {
+		params["match[]"] = append([]string(nil), req.Match...)
+		stripLabelFromParam(params, "match[]", "chrono_timeframe")
+		stripLabelFromParam(params, "match[]", "_command")
+		stripLabelFromParam(params, "match[]", pluginLabelName)
+		stripLabelFromParam(params, "match[]", pluginArgsLabelName)
+	}
+	if req.Start != "" {
+		params.Set("start", req.Start)
+	}
+	if req.End != "" {
+		params.Set("end", req.End)
+	}
+
+	var labels []string
+	seen := make(map[string]bool, len(req.Labels))
+	for _, label := range req.Labels {
+		if !seen[label] {
+			seen[label] = true
+			labels = append(labels, label)
+		}
+	}
+
+	values := make([][]string, len(labels))
+	errs := make([]error, len(labels))
+	slots := make(chan struct{}, bulkLabelConcurrency)
+	var wg sync.WaitGroup
+	for i, label := range labels {
+		if vs, ok := p.chronoLabelValues(label); ok {
+			values[i] = vs
+			continue
+		}
+		wg.Add(1)
+		go func(i int, label string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			values[i], errs[i] = p.fetchLabelValues(r.Context(), upstream, label, params)
+		}(i, label)
+	}
+	wg.Wait()
+
+	data := make(map[string][]string, len(labels))
+	var warnings []string
+	for i, label := range labels {
+		if errs[i] != nil {
+			warnings = append(warnings, fmt.Sprintf("label %q: %v", label, errs[i]))
+			continue
+		}
+		data[label] = values[i]
+	}
+
+	out := map[string]interface{}{"status": "success", "data": data}
+	if len(warnings) > 0 {
+		out["warnings"] = warnings
+	}
+	writeJSONRaw(w, out)
+}
+
+// fetchLabelValues asks the upstream for one label's values.
+func (p *ChronoProxy) fetchLabelValues(ctx context.Context, upstream, label string, params url.Values) ([]string, error) {
+	u := upstream + "/api/v1/label/" + url.PathEscape(label) + "/values"
+	if len(params) > 0 {
+		u += "?" + buildQueryString(params)
+	}
+	resp, err := p.getUpstream(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Status string   `json:"status"`
+		Data   []string `json:"data"`
+		Error  string   `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 10*1024*1024)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid response from upstream: %w", err)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("upstream answered %s: %s", resp.Status, result.Error)
+	}
+	if result.Data == nil {
+		result.Data = []string{}
+	}
+	return result.Data, nil
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestBulkLabelValues(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/label/job/values", 0, []byte(`{"status":"success","data":["api","db"]}`))
+	fake.Serve("/api/v1/label/instance/values", 0, []byte(`{"status":"success","data":["a:9100"]}`))
+	fake.Serve("/api/v1/label/broken/values", 0, []byte(`{"status":"error","error":"too many series"}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxyWithConfig(DefaultConfig)
+
+	body := `{"labels":["job","instance","chrono_timeframe","broken","job"],"match":["up{env=\"prod\",chrono_timeframe=\"7days\"}"],"start":"1700000000"}`
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", prefix+"/api/v1/chrono/label-values", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("code = %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Status   string              `json:"status"`
+		Data     map[string][]string `json:"data"`
+		Warnings []string            `json:"warnings"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(resp.Data["job"], ",") != "api,db" || strings.Join(resp.Data["instance"], ",") != "a:9100" {
+		t.Errorf("upstream labels = %v", resp.Data)
+	}
+	if tfs := resp.Data["chrono_timeframe"]; len(tfs) == 0 || tfs[0] != "current" {
+		t.Errorf("chrono_timeframe = %v", tfs)
+	}
+	if _, ok := resp.Data["broken"]; ok || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "too many series") {
+		t.Errorf("broken label: data=%v warnings=%v", resp.Data, resp.Warnings)
+	}
+
+	reqs := fake.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("got %d upstream calls, want 3 (job once, instance, broken)", len(reqs))
+	}
+	for _, req := range reqs {
+		if got := req.Params.Get("match[]"); got != `up{env="prod"}` || req.Params.Get("start") != "1700000000" {
+			t.Errorf("%s got match[]=%q start=%q", req.Path, got, req.Params.Get("start"))
+		}
+	}
+}
+
+func TestBulkLabelValuesRejectsBadRequests(t *testing.T) {
+	p := NewChronoProxyWithConfig(DefaultConfig)
+	cases := []struct {
+		method, body string
+		code         int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", "not json", http.StatusBadRequest},
+		{"POST", `{"labels":[]}`, http.StatusBadRequest},
+		{"POST", `{"labels":[` + strings.Repeat(`"x",`, maxBulkLabels) + `"x"]}`, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(tc.method, "/prom_9090/api/v1/chrono/label-values", strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Errorf("%s %q: code = %d, want %d", tc.method, tc.body, w.Code, tc.code)
+		}
+	}
+}
+
+func TestLabelValuesCacheIsolation(t *testing.T) {
+	a, b := fixtures.NewFakePrometheus(), fixtures.NewFakePrometheus()
+	defer a.Close()
+	defer b.Close()
+	a.Serve("/api/v1/label/team/values", 0, []byte(`{"status":"success","data":["payments"]}`))
+	b.Serve("/api/v1/label/team/values", 0, []byte(`{"status":"success","data":["ads"]}`))
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "a", URL: a.URL}, {Name: "b", URL: b.URL}}
+	config.Tenants = []TenantConfig{{Name: "one", Upstreams: []string{"a"}}, {Name: "two", Upstreams: []string{"a"}}}
+	p := NewChronoProxyWithConfig(config)
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Body.String()
+	}
+
+	if body := get("/a/api/v1/label/team/values"); !strings.Contains(body, "payments") {
+		t.Fatalf("a: %s", body)
+	}
+	if body := get("/b/api/v1/label/team/values"); !strings.Contains(body, "ads") {
+		t.Errorf("b was served a's cached values: %s", body)
+	}
+
+	get("/a/api/v1/label/team/values")
+	get(`/a/api/v1/label/team/values?match[]=up{env="prod"}`)
+	get("/t/one/a/api/v1/label/team/values")
+	get("/t/two/a/api/v1/label/team/values")
+	get("/t/two/a/api/v1/label/team/values")
+	// No tenant, a match[], and two tenants: four different answers
+	if n := len(a.Requests()); n != 4 {
+		t.Errorf("a was asked %d times, want 4", n)
+	}
+}
@@ -0,0 +1,191 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/limits.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Response limits - stop a runaway query before it takes the proxy with it 🧯
+//
+// Every series a query fetches is held five times over (one per window)
+// and then synthetics are built on top, so one high-cardinality query can
+// run Chronotheus out of memory long before anyone sees an answer. Three
+// limits, each off (0) unless set, put a ceiling on one query:
+//
+//   max_response_series   series, all windows together
+//   max_response_samples  samples (points), all windows together
+//   max_response_bytes    bytes read from upstream responses, all windows together
+//
+// They're checked as the windows come in - a range window is abandoned
+// mid-stream, as soon as it tips the total over - and the series and
+// sample limits once more on the finished answer, synthetics and all.
+// Note that what's fetched counts, before downsampling thins it out.
+//
+// A query over a limit gets 422 with errorType "execution", the way
+// Prometheus answers a query that would load too many samples, naming the
+// limit so whoever runs the dashboard knows which knob it was. Hits are
+// counted in chronotheus_response_limit_hits_total{limit}.
+
+// limitError is a query that went over one of the response limits.
+type limitError struct {
+	limit string // The config key
+	max   int64
+	what  string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("query would need more than %d %s (%s)", e.max, e.what, e.limit)
+}
+
+// responseBudget is what one evaluation has used so far. A nil
+// *responseBudget (no limits set) allows everything.
+type responseBudget struct {
+	maxSeries, maxSamples, maxBytes int64
+	series, samples, bytes          int64 // atomic
+	hits                            *counterVec
+}
+
+// newBudget returns nil when no limit is set.
+func (p *ChronoProxy) newBudget() *responseBudget {
+	c := p.config
+	if c.MaxResponseSeries == 0 && c.MaxResponseSamples == 0 && c.MaxResponseBytes == 0 {
+		return nil
+	}
+	return &responseBudget{
+		maxSeries:  int64(c.MaxResponseSeries),
+		maxSamples: c.MaxResponseSamples,
+		maxBytes:   c.MaxResponseBytes,
+		hits:       p.responseLimits,
+	}
+}
+
+type budgetKey struct{}
+
+func withBudget(ctx context.Context, b *responseBudget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, b)
+}
+
+// budgetFrom returns the budget set by withBudget, or nil.
+func budgetFrom(ctx context.Context) *responseBudget {
+	b, _ := ctx.Value(budgetKey{}).(*responseBudget)
+	return b
+}
+
+// fits says whether series and samples more than have been charged so far
+// would still be within the limits, without charging them.
+func (b *responseBudget) fits(series, samples int64) error {
+	if b == nil {
+		return nil
+	}
+	if b.maxSeries > 0 && atomic.LoadInt64(&b.series)+series > b.maxSeries {
+		return b.hit("max_response_series", b.maxSeries, "series")
+	}
+	if b.maxSamples > 0 && atomic.LoadInt64(&b.samples)+samples > b.maxSamples {
+		return b.hit("max_response_samples", b.maxSamples, "samples")
+	}
+	return nil
+}
+
+// charge adds a window's series to what's been used.
+func (b *responseBudget) charge(series []model.Series) error {
+	if b == nil {
+		return nil
+	}
+	if err := b.fits(int64(len(series)), countSamples(series)); err != nil {
+		return err
+	}
+	atomic.AddInt64(&b.series, int64(len(series)))
+	atomic.AddInt64(&b.samples, countSamples(series))
+	return nil
+}
+
+// check holds the finished answer to the series and sample limits.
+func (b *responseBudget) check(series []model.Series) error {
+	if b == nil {
+		return nil
+	}
+	if b.maxSeries > 0 && int64(len(series)) > b.maxSeries {
+		return b.hit("max_response_series", b.maxSeries, "series")
+	}
+	if b.maxSamples > 0 && countSamples(series) > b.maxSamples {
+		return b.hit("max_response_samples", b.maxSamples, "samples")
+	}
+	return nil
+}
+
+func (b *responseBudget) hit(limit string, max int64, what string) error {
+	b.hits.inc(limit)
+	return &limitError{limit: limit, max: max, what: what}
+}
+
+// fresh is a budget with b's limits and nothing spent yet, for a fetch
+// several requests share (see coalesce.go). Nil stays nil.
+func (b *responseBudget) fresh() *responseBudget {
+	if b == nil {
+		return nil
+	}
+	return &responseBudget{maxSeries: b.maxSeries, maxSamples: b.maxSamples, maxBytes: b.maxBytes, hits: b.hits}
+}
+
+// spentBytes is how much has been read against max_response_bytes.
+func (b *responseBudget) spentBytes() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.bytes)
+}
+
+// chargeBytes counts n bytes that were read on our behalf by a shared
+// fetch, failing when that takes us over max_response_bytes.
+func (b *responseBudget) chargeBytes(n int64) error {
+	if b == nil || b.maxBytes == 0 {
+		return nil
+	}
+	if atomic.AddInt64(&b.bytes, n) > b.maxBytes {
+		return b.hit("max_response_bytes", b.maxBytes, "bytes of upstream responses")
+	}
+	return nil
+}
+
+// reader counts what's read from r against max_response_bytes, failing
+// the read that goes over.
+func (b *responseBudget) reader(r io.Reader) io.Reader {
+	if b == nil || b.maxBytes == 0 {
+		return r
+	}
+	return &budgetReader{r: r, b: b}
+}
+
+type budgetReader struct {
+	r io.Reader
+	b *responseBudget
+}
+
+func (br *budgetReader) Read(buf []byte) (int, error) {
+	n, err := br.r.Read(buf)
+	if atomic.AddInt64(&br.b.bytes, int64(n)) > br.b.maxBytes {
+		return n, br.b.hit("max_response_bytes", br.b.maxBytes, "bytes of upstream responses")
+	}
+	return n, err
+}
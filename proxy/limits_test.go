@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestResponseLimits(t *testing.T) {
+	const now = 1700000000
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for _, back := range []int64{0, 7, 14, 21, 28} {
+		fake.Serve("/api/v1/query", now-back*86400, []byte(`{"status":"success","data":{"resultType":"vector","result":[`+
+			`{"metric":{"__name__":"up","job":"a"},"value":[1700000000,"1"]},{"metric":{"__name__":"up","job":"b"},"value":[1700000000,"2"]}]}}`))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	query := func(config Config, q string) *httptest.ResponseRecorder {
+		t.Helper()
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+q, nil))
+		return w
+	}
+
+	for name, tc := range map[string]struct {
+		set   func(*Config)
+		query string
+		want  string
+	}{
+		"fetched series":      {func(c *Config) { c.MaxResponseSeries = 9 }, "up", "more than 9 series (max_response_series)"},
+		"synthetic series":    {func(c *Config) { c.MaxResponseSeries = 10 }, "up", "more than 10 series (max_response_series)"},
+		"samples":             {func(c *Config) { c.MaxResponseSamples = 1 }, `up{chrono_timeframe="current"}`, "more than 1 samples (max_response_samples)"},
+		"upstream bytes":      {func(c *Config) { c.MaxResponseBytes = 100 }, "up", "more than 100 bytes of upstream responses (max_response_bytes)"},
+		"within every limit":  {func(c *Config) { c.MaxResponseSeries, c.MaxResponseSamples, c.MaxResponseBytes = 100, 100, 10000 }, "up", ""},
+		"one window is small": {func(c *Config) { c.MaxResponseSeries = 2 }, `up{chrono_timeframe="current"}`, ""},
+	} {
+		config := DefaultConfig
+		tc.set(&config)
+		w := query(config, tc.query)
+		if tc.want == "" {
+			if w.Code != 200 {
+				t.Errorf("%s: %d %s", name, w.Code, w.Body)
+			}
+			continue
+		}
+		if w.Code != 422 || !strings.Contains(w.Body.String(), `"errorType":"execution"`) || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	config := DefaultConfig
+	config.MaxResponseSamples = -1
+	if err := config.Validate(); err == nil {
+		t.Error("negative max_response_samples should be rejected")
+	}
+}
+
+func TestResponseLimitStopsRangeStream(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	body := `{"status":"success","data":{"resultType":"matrix","result":[` +
+		`{"metric":{"job":"a"},"values":[[60,"1"],[120,"2"]]},{"metric":{"job":"b"},"values":[[60,"1"],[120,"2"]]}]}}`
+	fake.Serve("/api/v1/query_range", 0, []byte(body))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.MaxResponseSamples = 3
+	p := NewChronoProxyWithConfig(config)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query_range?start=60&end=120&step=60&query=up{chrono_timeframe="current"}`, nil))
+	if w.Code != 422 || !strings.Contains(w.Body.String(), "max_response_samples") {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `chronotheus_response_limit_hits_total{limit="max_response_samples"} 1`) {
+		t.Errorf("hit not counted:\n%s", w.Body)
+	}
+	if strings.Contains(w.Body.String(), `chronotheus_upstream_errors_total{`) {
+		t.Errorf("a limit hit counted as an upstream error:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,163 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/lint.go
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// POST .../api/v1/chrono/lint - catch it before the panel ships 🧹
+//
+// Takes the same query, start, end and step a query or query_range would
+// (form or JSON) and, instead of running it, says what looks wrong:
+//
+//   {"status": "success", "data": {"findings": [
+//     {"code": "chrono_label_matcher", "severity": "error",
+//      "message": "...", "position": 3}
+//   ]}}
+//
+// An empty list means nothing was spotted, not that the query is right -
+// this is a handful of patterns that keep turning up in dashboards, not a
+// PromQL parser. position is the byte offset in the query, where there is
+// one. Severity "error" means the query won't do what it says; "warning"
+// means it probably won't.
+
+const lintPath = "/api/v1/chrono/lint"
+
+// lintFinding is one thing the linter didn't like.
+type lintFinding struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"` // "error" or "warning"
+	Message  string `json:"message"`
+	Position int    `json:"position,omitempty"`
+}
+
+var (
+	// lintSelectorRegex finds a {...} selector and, if it has one, the
+	// [...] range after it.
+	lintSelectorRegex = regexp.MustCompile(`\{[^}]*\}(\s*\[[^\]]*\])?`)
+	// lintChronoLabelRegex finds chrono labels inside a selector.
+	lintChronoLabelRegex = regexp.MustCompile(`(chrono_[a-z_]+|_command|_plugin)\s*(=~|!=|!~|=)\s*"([^"]*)"`)
+)
+
+// handleLint answers .../api/v1/chrono/lint.
+func (p *ChronoProxy) handleLint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	params := parseClientParams(r)
+	query := params.Get("query")
+	if query == "" {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "query is required")
+		return
+	}
+	findings := p.lintQuery(query)
+	findings = append(findings, lintRange(params.Get("start"), params.Get("end"), params.Get("step"))...)
+	if findings == nil {
+		findings = []lintFinding{}
+	}
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"findings": findings},
+	})
+}
+
+// lintQuery looks at every selector's chrono labels.
+func (p *ChronoProxy) lintQuery(query string) []lintFinding {
+	var findings []lintFinding
+	for _, sel := range lintSelectorRegex.FindAllStringSubmatchIndex(query, -1) {
+		inRange := sel[2] >= 0
+		for _, m := range lintChronoLabelRegex.FindAllStringSubmatchIndex(query[sel[0]:sel[1]], -1) {
+			at := sel[0] + m[0]
+			label, op, value := query[sel[0]+m[2]:sel[0]+m[3]], query[sel[0]+m[4]:sel[0]+m[5]], query[sel[0]+m[6]:sel[0]+m[7]]
+			if op != "=" && label != "chrono_timeframe" {
+				findings = append(findings, lintFinding{
+					Code:     "chrono_label_matcher",
+					Severity: "error",
+					Message:  fmt.Sprintf("%s%s%q: only %s=\"...\" is understood (chrono_timeframe takes any matcher); anything else goes to the upstream, where no series has the label, so nothing comes back", label, op, value, label),
+					Position: at,
+				})
+				continue
+			}
+			if inRange {
+				findings = append(findings, lintFinding{
+					Code:     "chrono_label_in_range_selector",
+					Severity: "warning",
+					Message:  fmt.Sprintf("%s inside a range selector still applies to the whole query, not just this selector; put it in match[], or use chrono_counter for rates across windows", label),
+					Position: at,
+				})
+			}
+			if label == "chrono_timeframe" && (op == "=~" || op == "!~") {
+				// Picks from a plain query's series (see promql.go)
+				if _, err := regexp.Compile(value); err != nil {
+					findings = append(findings, lintFinding{
+						Code:     "bad_timeframe_regex",
+						Severity: "error",
+						Message:  fmt.Sprintf("chrono_timeframe%s%q: %v", op, value, err),
+						Position: at,
+					})
+				}
+			}
+			if label == "chrono_timeframe" && op == "=" && !p.knownTimeframe(value) {
+				findings = append(findings, lintFinding{
+					Code:     "unknown_timeframe",
+					Severity: "error",
+					Message:  fmt.Sprintf("chrono_timeframe %q isn't a window or synthetic we know; see /api/v1/chrono/timeframes", value),
+					Position: at,
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// knownTimeframe says whether chrono_timeframe=tf would find anything:
+// a configured window, a synthetic, or an ad-hoc window like 3days.
+func (p *ChronoProxy) knownTimeframe(tf string) bool {
+	if isSyntheticTimeframe(tf) || isRawTf(tf, p.timeframes) {
+		return true
+	}
+	_, ok := adHocWindow(tf)
+	return ok
+}
+
+// lintRange checks a range query has a usable step.
+func lintRange(start, end, step string) []lintFinding {
+	if start == "" && end == "" {
+		return nil // an instant query
+	}
+	if strings.TrimSpace(step) == "" {
+		return []lintFinding{{
+			Code:     "missing_step",
+			Severity: "error",
+			Message:  "start and end without a step; query_range needs one, and synthetics are bucketed on it",
+		}}
+	}
+	if d, err := parsePromDuration(step); err != nil || d <= 0 {
+		return []lintFinding{{
+			Code:     "bad_step",
+			Severity: "error",
+			Message:  fmt.Sprintf("step %q should be a positive duration or number of seconds", step),
+		}}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	p := NewChronoProxy()
+	lint := func(body string) (int, []lintFinding) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/localhost_9090/api/v1/chrono/lint", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		p.ServeHTTP(w, r)
+		var resp struct {
+			Data struct {
+				Findings []lintFinding `json:"findings"`
+			} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data.Findings
+	}
+	codes := func(fs []lintFinding) string {
+		var out []string
+		for _, f := range fs {
+			out = append(out, f.Code)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if code, fs := lint(`{"query": "up{chrono_timeframe=\"7days\"}"}`); code != http.StatusOK || fs == nil || len(fs) != 0 {
+		t.Errorf("clean query: %d %+v", code, fs)
+	}
+	_, fs := lint(`{"query": "rate(http_requests_total{chrono_timeframe=\"7days\"}[5m])"}`)
+	if codes(fs) != "chrono_label_in_range_selector" || fs[0].Position != 25 {
+		t.Errorf("range selector: %+v", fs)
+	}
+	if _, fs := lint(`{"query": "up{chrono_counter=~\"rate|increase\"}"}`); codes(fs) != "chrono_label_matcher" || fs[0].Severity != "error" {
+		t.Errorf("regex matcher: %+v", fs)
+	}
+	if _, fs := lint(`{"query": "up{chrono_timeframe=~\"7days|14days\"}"}`); len(fs) != 0 {
+		t.Errorf("timeframe regex: %+v", fs)
+	}
+	if _, fs := lint(`{"query": "up{chrono_timeframe=~\"7days|(\"}"}`); codes(fs) != "bad_timeframe_regex" {
+		t.Errorf("broken timeframe regex: %+v", fs)
+	}
+	if _, fs := lint(`{"query": "up{chrono_timeframe=\"lastWeek\"}", "start": "1700000000", "end": "1700003600"}`); codes(fs) != "unknown_timeframe,missing_step" {
+		t.Errorf("unknown timeframe and no step: %+v", fs)
+	}
+	if _, fs := lint(`{"query": "up{chrono_timeframe=\"3days\"}", "start": "1700000000", "end": "1700003600", "step": "1m"}`); len(fs) != 0 {
+		t.Errorf("ad-hoc window with a step: %+v", fs)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/localhost_9090/api/v1/chrono/lint?query=up", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d", w.Code)
+	}
+}
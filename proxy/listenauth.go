@@ -0,0 +1,225 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/listenauth.go
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Who goes there? Authentication for Chronotheus itself.
+//
+// Out of the box anybody who can reach the listen address can query every
+// upstream we can reach - an open relay with extra steps. listen_auth
+// closes the door:
+//
+//   listen_auth:
+//     bearer_tokens: [s3cret-grafana-token]
+//     basic_users:
+//       grafana: sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8
+//     client_cert_subjects: [grafana.internal]
+//
+//   listen_tls:
+//     cert_file: /etc/chronotheus/server.pem
+//     key_file: /etc/chronotheus/server-key.pem
+//     client_ca_file: /etc/chronotheus/clients-ca.pem
+//
+// Any one of them gets you in: a listed bearer token, a basic auth user
+// (password in plain text or as sha256:<hex>), or a client certificate
+// signed by client_ca_file - optionally only for the listed common names.
+// Everybody else gets a 401, /metrics and the admin endpoints included;
+// Prometheus scrape configs can send credentials too.
+//
+// Credentials meant for us are taken off the request before anything is
+// forwarded upstream, unless the upstream asked for pass_authorization.
+
+// ListenAuthConfig says who may use the proxy. Empty means everybody,
+// unless listen_tls has a client_ca_file - then any certificate it trusts.
+type ListenAuthConfig struct {
+	BearerTokens       []string          `yaml:"bearer_tokens,omitempty"`        // Tokens accepted as Authorization: Bearer <token>
+	BasicUsers         map[string]string `yaml:"basic_users,omitempty"`          // User → password, plain or sha256:<hex>
+	ClientCertSubjects []string          `yaml:"client_cert_subjects,omitempty"` // Common names allowed in with a client certificate (empty = any cert listen_tls trusts)
+}
+
+// isZero tells us whether anybody is being kept out at all.
+func (c ListenAuthConfig) isZero() bool {
+	return len(c.BearerTokens) == 0 && len(c.BasicUsers) == 0 && len(c.ClientCertSubjects) == 0
+}
+
+// ListenTLSConfig serves the proxy over https, optionally asking clients
+// for certificates.
+type ListenTLSConfig struct {
+	CertFile     string `yaml:"cert_file,omitempty"`      // Server certificate
+	KeyFile      string `yaml:"key_file,omitempty"`       // Server key
+	ClientCAFile string `yaml:"client_ca_file,omitempty"` // PEM bundle client certificates must chain to (enables mTLS)
+}
+
+// Enabled says whether we should be listening with TLS.
+func (c ListenTLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// ServerTLSConfig loads the certificates for serving over https. Client
+// certificates are verified when offered but not required - requiring
+// them is listen_auth's job, so other credentials can still get in.
+func ServerTLSConfig(c ListenTLSConfig) (*tls.Config, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("client_ca_file %s contains no usable certificates", c.ClientCAFile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
+}
+
+// validateListenAuth catches credentials that could never match.
+func validateListenAuth(auth ListenAuthConfig, tlsConfig ListenTLSConfig) error {
+	for _, token := range auth.BearerTokens {
+		if strings.TrimSpace(token) == "" {
+			return fmt.Errorf("listen_auth: bearer_tokens can't be empty")
+		}
+	}
+	for user, password := range auth.BasicUsers {
+		if user == "" || strings.Contains(user, ":") {
+			return fmt.Errorf("listen_auth: basic user %q must be non-empty with no ':'", user)
+		}
+		if hash, ok := strings.CutPrefix(password, hashPrefix); ok {
+			if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("listen_auth: basic user %q: %s needs 64 hex digits", user, hashPrefix)
+			}
+		}
+	}
+	if len(auth.ClientCertSubjects) > 0 && tlsConfig.ClientCAFile == "" {
+		return fmt.Errorf("listen_auth: client_cert_subjects needs listen_tls.client_ca_file")
+	}
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return fmt.Errorf("listen_tls: cert_file and key_file must be set together")
+	}
+	if tlsConfig.ClientCAFile != "" && tlsConfig.CertFile == "" {
+		return fmt.Errorf("listen_tls: client_ca_file needs cert_file and key_file")
+	}
+	return nil
+}
+
+// hashPrefix marks a basic auth password stored as its sha256.
+const hashPrefix = "sha256:"
+
+// redacted hides tokens and passwords, keeping user names and subjects.
+func (c ListenAuthConfig) redacted() ListenAuthConfig {
+	if c.BearerTokens != nil {
+		tokens := make([]string, len(c.BearerTokens))
+		for i, token := range c.BearerTokens {
+			tokens[i] = redactAPIKey(token)
+		}
+		c.BearerTokens = tokens
+	}
+	if c.BasicUsers != nil {
+		users := make(map[string]string, len(c.BasicUsers))
+		for user := range c.BasicUsers {
+			users[user] = "xxxxx"
+		}
+		c.BasicUsers = users
+	}
+	return c
+}
+
+// authenticate works out who's asking. ok is false when listen_auth is on
+// and nothing the client sent gets them in.
+func (p *ChronoProxy) authenticate(r *http.Request) (identity string, ok bool) {
+	auth := p.config.ListenAuth
+	if auth.isZero() && p.config.ListenTLS.ClientCAFile == "" {
+		return "", true
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if len(auth.ClientCertSubjects) == 0 || slices.Contains(auth.ClientCertSubjects, cn) {
+			return "cert:" + cn, true
+		}
+	}
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		for _, want := range auth.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+				return "token:" + redactAPIKey(want), true
+			}
+		}
+	}
+	if user, password, found := r.BasicAuth(); found {
+		if want, known := auth.BasicUsers[user]; known && passwordMatches(password, want) {
+			return "user:" + user, true
+		}
+	}
+	return "", false
+}
+
+// passwordMatches compares against a plain or sha256:<hex> password.
+func passwordMatches(password, want string) bool {
+	if hash, ok := strings.CutPrefix(want, hashPrefix); ok {
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(hash))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// writeUnauthorized is the 401, with a hint about what we'd accept.
+func (p *ChronoProxy) writeUnauthorized(w http.ResponseWriter) {
+	if len(p.config.ListenAuth.BasicUsers) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chronotheus"`)
+	} else if len(p.config.ListenAuth.BearerTokens) > 0 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chronotheus"`)
+	}
+	writeJSONError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+}
+
+// identityKey carries who listen_auth let in: "user:<name>", "cert:<cn>",
+// "token:<hash>", or "" when nobody's checking.
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func identityFrom(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
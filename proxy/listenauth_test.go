@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestListenAuthenticate(t *testing.T) {
+	config := DefaultConfig
+	config.ListenAuth = ListenAuthConfig{
+		BearerTokens: []string{"grafana-token"},
+		BasicUsers: map[string]string{
+			"plain":  "hunter2",
+			"hashed": "sha256:5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", // "password"
+		},
+		ClientCertSubjects: []string{"grafana.internal"},
+	}
+	config.ListenTLS.ClientCAFile = "/unused-here"
+	p := NewChronoProxyWithConfig(config)
+
+	withCert := func(cn string) func(*http.Request) {
+		return func(r *http.Request) {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+	}
+	cases := []struct {
+		name     string
+		setup    func(*http.Request)
+		identity string
+		ok       bool
+	}{
+		{"nothing", func(r *http.Request) {}, "", false},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer grafana-token") }, "token:" + redactAPIKey("grafana-token"), true},
+		{"wrong bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, "", false},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("plain", "hunter2") }, "user:plain", true},
+		{"hashed basic", func(r *http.Request) { r.SetBasicAuth("hashed", "password") }, "user:hashed", true},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("hashed", "hunter2") }, "", false},
+		{"cert", withCert("grafana.internal"), "cert:grafana.internal", true},
+		{"cert not listed", withCert("intruder"), "", false},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/prom_9090/api/v1/query", nil)
+		tc.setup(r)
+		identity, ok := p.authenticate(r)
+		if identity != tc.identity || ok != tc.ok {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tc.name, identity, ok, tc.identity, tc.ok)
+		}
+	}
+
+	if identity, ok := NewChronoProxyWithConfig(DefaultConfig).authenticate(httptest.NewRequest("GET", "/", nil)); !ok || identity != "" {
+		t.Errorf("with no listen_auth everybody should get in, got (%q, %v)", identity, ok)
+	}
+}
+
+func TestListenAuthRejectsAndStripsCredentials(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+
+	config := DefaultConfig
+	config.ListenAuth = ListenAuthConfig{BearerTokens: []string{"ours"}}
+	config.Upstreams = []UpstreamConfig{
+		{Name: "plain", URL: fake.URL},
+		{Name: "passing", URL: fake.URL, Auth: UpstreamAuthConfig{PassAuthorization: true}},
+	}
+	p := NewChronoProxyWithConfig(config)
+
+	for _, path := range []string{"/plain/api/v1/status/buildinfo", "/metrics", "/api/v1/chrono/admin/config"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="chronotheus"` {
+			t.Errorf("%s without a token: code=%d headers=%v", path, w.Code, w.Header())
+		}
+	}
+	if n := len(fake.Requests()); n != 0 {
+		t.Fatalf("unauthenticated requests reached the upstream %d times", n)
+	}
+
+	for _, name := range []string{"plain", "passing"} {
+		r := httptest.NewRequest("GET", "/"+name+"/api/v1/status/buildinfo", nil)
+		r.Header.Set("Authorization", "Bearer ours")
+		p.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d upstream requests, want 2", len(reqs))
+	}
+	if got := reqs[0].Header.Get("Authorization"); got != "" {
+		t.Errorf("our token leaked upstream: %q", got)
+	}
+	if got := reqs[1].Header.Get("Authorization"); got != "Bearer ours" {
+		t.Errorf("pass_authorization upstream got %q", got)
+	}
+}
+
+func TestValidateListenAuth(t *testing.T) {
+	cases := []struct {
+		name string
+		auth ListenAuthConfig
+		tls  ListenTLSConfig
+		ok   bool
+	}{
+		{"empty", ListenAuthConfig{}, ListenTLSConfig{}, true},
+		{"blank token", ListenAuthConfig{BearerTokens: []string{" "}}, ListenTLSConfig{}, false},
+		{"colon in user", ListenAuthConfig{BasicUsers: map[string]string{"a:b": "x"}}, ListenTLSConfig{}, false},
+		{"short hash", ListenAuthConfig{BasicUsers: map[string]string{"a": "sha256:abc"}}, ListenTLSConfig{}, false},
+		{"subjects without ca", ListenAuthConfig{ClientCertSubjects: []string{"x"}}, ListenTLSConfig{}, false},
+		{"cert without key", ListenAuthConfig{}, ListenTLSConfig{CertFile: "/c"}, false},
+		{"ca without cert", ListenAuthConfig{}, ListenTLSConfig{ClientCAFile: "/ca"}, false},
+		{"mtls", ListenAuthConfig{ClientCertSubjects: []string{"x"}}, ListenTLSConfig{CertFile: "/c", KeyFile: "/k", ClientCAFile: "/ca"}, true},
+	}
+	for _, tc := range cases {
+		if err := validateListenAuth(tc.auth, tc.tls); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
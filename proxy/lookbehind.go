@@ -0,0 +1,125 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/lookbehind.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Lookbehind padding - giving a window's first steps their history back 🪜
+//
+// Each past window is the same query over a shifted start..end, and
+// rate(x[5m]) at a window's first step reads the five minutes before its
+// start. Prometheus itself fetches those, but an upstream that splits or
+// caches ranges - a query frontend cutting at day boundaries, a
+// downsampled store picking resolution from the range asked for - may
+// answer the edge from a piece that doesn't hold them, and the first
+// steps of every window come out low or missing.
+//
+// With pad_lookbehind (or chrono_pad_lookbehind=true on one request) a range
+// query's windows are fetched from start minus the query's lookbehind,
+// rounded up to whole steps so the steps land where they would have, and
+// the lead-in is thrown away before anything else sees it. The lookbehind
+// is read off the query: the longest [range] (or Prometheus's 5m lookback
+// for plain selectors), plus every subquery's range, plus the furthest
+// offset. That's an upper bound - nested subqueries get more than they
+// need - but too much only costs some points that are dropped anyway.
+//
+// A query whose ranges can't be read is fetched unpadded, with a warning.
+
+const padLookbehindParam = "chrono_pad_lookbehind"
+
+// promLookbackDelta is how far back Prometheus looks for a plain
+// selector's latest sample, unless its --query.lookback-delta says
+// otherwise.
+const promLookbackDelta = 5 * time.Minute
+
+// padLookbehindMode says whether this request's windows are padded, taking
+// chrono_pad_lookbehind out of params.
+func (p *ChronoProxy) padLookbehindMode(params url.Values) (bool, error) {
+	raw := params.Get(padLookbehindParam)
+	params.Del(padLookbehindParam)
+	if raw == "" {
+		return p.config.PadLookbehind, nil
+	}
+	pad, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, &badQueryError{msg: fmt.Sprintf("%s should be true or false, got %q", padLookbehindParam, raw)}
+	}
+	return pad, nil
+}
+
+// queryLookbehind is how far before a step query can read, at most.
+func queryLookbehind(q string) (time.Duration, error) {
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return 0, err
+	}
+	longest, subqueries, offset := promLookbackDelta, time.Duration(0), time.Duration(0)
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			longest = max(longest, n.Range)
+		case *parser.SubqueryExpr:
+			subqueries += n.Range
+			offset = max(offset, n.OriginalOffset)
+		case *parser.VectorSelector:
+			offset = max(offset, n.OriginalOffset)
+		}
+		return nil
+	})
+	return longest + subqueries + offset, nil
+}
+
+// paddedLookbehind wraps a range fetch so every window is asked for from
+// lookbehind (in whole steps) before start, and answered from start.
+func paddedLookbehind(fetch windowFetcher, lookbehind, step time.Duration) windowFetcher {
+	if step > 0 {
+		lookbehind = (lookbehind + step - 1) / step * step
+	}
+	return func(ctx context.Context, p *ChronoProxy, wins []window, params url.Values, endpoint, command string) ([]model.Series, error) {
+		from := parseTimeMs(params.Get("start"), p.clock.Now())
+		q := maps.Clone(params)
+		q.Set("start", model.FormatTimestamp(from-lookbehind.Milliseconds()))
+		all, err := fetch(ctx, p, wins, q, endpoint, command)
+		if err != nil {
+			return nil, err
+		}
+		out := all[:0]
+		for _, s := range all {
+			pts := s.Points
+			for len(pts) > 0 && pts[0].T < from {
+				pts = pts[1:]
+			}
+			if len(pts) > 0 {
+				s.Points = pts
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestQueryLookbehind(t *testing.T) {
+	cases := []struct {
+		q    string
+		want time.Duration
+	}{
+		{`up`, 5 * time.Minute},
+		{`rate(http_requests_total{path="[1d]"}[10m])`, 10 * time.Minute},
+		{`sum(rate(a[1m])) / sum(rate(b[30m] offset 1h))`, 90 * time.Minute},
+		{`max_over_time(rate(a[5m])[1h:1m])`, 65 * time.Minute},
+		{`a offset -1h # [1w]`, 5 * time.Minute},
+	}
+	for _, tc := range cases {
+		if got, err := queryLookbehind(tc.q); err != nil || got != tc.want {
+			t.Errorf("queryLookbehind(%s) = %v, %v; want %v", tc.q, got, err, tc.want)
+		}
+	}
+	for _, bad := range []string{`rate(a[5x])`, `rate(a[5m`, `a{b="`} {
+		if _, err := queryLookbehind(bad); err == nil {
+			t.Errorf("queryLookbehind(%s) should fail", bad)
+		}
+	}
+}
+
+func TestPadLookbehind(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	var values []string
+	for ts := 1699999400; ts <= 1700000540; ts += 60 {
+		values = append(values, `[`+model.FormatValue(float64(ts))+`,"1"]`)
+	}
+	fake.Serve("/api/v1/query_range", 0, []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[`+strings.Join(values, ",")+`]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	w := httptest.NewRecorder()
+	q := url.QueryEscape(`rate(up{chrono_timeframe="current"}[390s])`)
+	NewChronoProxy().ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query_range?start=1700000000&end=1700000540&step=60&chrono_pad_lookbehind=true&query="+q, nil))
+	var resp struct {
+		Data struct {
+			Result []struct {
+				Values [][2]interface{} `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Data.Result) != 1 {
+		t.Fatalf("bad response %q: %v", w.Body.String(), err)
+	}
+	if vs := resp.Data.Result[0].Values; len(vs) != 10 || vs[0][0] != 1700000000.0 {
+		t.Errorf("lead-in not dropped: %v", vs)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("%d requests", len(reqs))
+	}
+	// 390s rounds up to seven 60s steps
+	if got := reqs[0].Params.Get("start"); got != "1699999580" {
+		t.Errorf("upstream start = %s; want 1699999580", got)
+	}
+	if reqs[0].Params.Get(padLookbehindParam) != "" {
+		t.Errorf("%s leaked upstream", padLookbehindParam)
+	}
+
+	w = httptest.NewRecorder()
+	NewChronoProxy().ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query_range?start=1700000000&end=1700000540&step=60&chrono_pad_lookbehind=maybe&query=up", nil))
+	if w.Code != 400 {
+		t.Errorf("bad flag: status %d; want 400", w.Code)
+	}
+}
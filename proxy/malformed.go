@@ -0,0 +1,75 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/malformed.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Malformed samples - what to do when an upstream sends us rubbish 🗑️
+//
+// Upstream bodies are decoded with json.Number (see model.DecodeJSON), so a
+// timestamp or value arrives exactly as written and is converted in one
+// place, model.ParsePoint. A sample that still isn't [<number>, <value>] -
+// a null, a string timestamp, "twelve" - can't be used, and
+// malformed_samples decides what happens next:
+//
+//   - warn (the default): drop it and say how many were dropped, per
+//     window, in the response's warnings
+//   - skip: drop it quietly, as Chronotheus always used to
+//   - reject: fail the whole window, just like an upstream that didn't
+//     answer - stale failover and the window-failure warnings take it
+//     from there
+//
+// Whichever it is, -debug logs the count.
+
+// Malformed sample policies.
+const (
+	malformedWarn   = "warn"
+	malformedSkip   = "skip"
+	malformedReject = "reject"
+)
+
+func validMalformedSamples(mode string) bool {
+	switch mode {
+	case "", malformedWarn, malformedSkip, malformedReject:
+		return true
+	}
+	return false
+}
+
+// checkSamples applies malformed_samples to a window that had to drop n
+// samples. A non-nil error means the window is rejected.
+func (p *ChronoProxy) checkSamples(ctx context.Context, tf string, n int) error {
+	if n == 0 {
+		return nil
+	}
+	if DebugMode.Load() {
+		log.Printf("[DEBUG] %d malformed samples in the %s window", n, tf)
+	}
+	switch p.config.MalformedSamples {
+	case malformedSkip:
+		return nil
+	case malformedReject:
+		return &upstreamError{errType: "bad_data", msg: fmt.Sprintf("%d malformed samples", n)}
+	}
+	warningsFrom(ctx).add(fmt.Sprintf("%d malformed samples from upstream dropped in the %s window", n, tf))
+	return nil
+}
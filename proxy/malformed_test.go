@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestMalformedSamples(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 1700000000, []byte(`{"status":"success","data":{"resultType":"vector","result":[`+
+		`{"metric":{"job":"a"},"value":[1700000000.001,"9007199254740993"]},`+
+		`{"metric":{"job":"b"},"value":["1700000000","1"]},`+
+		`{"metric":{"job":"c"},"value":[1700000000,null]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	query := func(mode string) (series []string, warnings string) {
+		t.Helper()
+		config := DefaultConfig
+		config.MalformedSamples = mode
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000&query=up{chrono_timeframe="current"}`, nil))
+		var resp struct {
+			Data struct {
+				Result []struct {
+					Metric map[string]string `json:"metric"`
+					Value  [2]json.Number    `json:"value"`
+				} `json:"result"`
+			} `json:"data"`
+			Warnings []string `json:"warnings"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		for _, r := range resp.Data.Result {
+			series = append(series, r.Metric["job"]+"@"+r.Value[0].String())
+		}
+		return series, strings.Join(resp.Warnings, "\n")
+	}
+
+	if series, warnings := query(""); len(series) != 1 || series[0] != "a@1700000000.001" || !strings.Contains(warnings, "2 malformed samples") {
+		t.Errorf("warn: %v %q", series, warnings)
+	}
+	if series, warnings := query(malformedSkip); len(series) != 1 || warnings != "" {
+		t.Errorf("skip: %v %q", series, warnings)
+	}
+	if series, warnings := query(malformedReject); len(series) != 0 || !strings.Contains(warnings, "malformed") {
+		t.Errorf("reject: %v %q", series, warnings)
+	}
+
+	config := DefaultConfig
+	config.MalformedSamples = "ignore"
+	if err := config.Validate(); err == nil {
+		t.Error("malformed_samples: ignore should be rejected")
+	}
+}
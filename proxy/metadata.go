@@ -0,0 +1,119 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/metadata.go
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Metric metadata - the little descriptions Grafana's metric explorer shows
+// under each metric name.
+//
+// Our synthetic series don't get names of their own - lastMonthAverage and
+// friends are the same metric with a different chrono_timeframe - so there's
+// nothing for upstream to describe them with. Instead we pass the upstream
+// answer through and tack a sentence onto every help text saying what the
+// chrono_timeframe values mean. Two endpoints carry help texts:
+//
+//   - /api/v1/metadata: metric name -> [{type, help, unit}]
+//   - /api/v1/targets/metadata: [{target, metric, type, help, unit}]
+//
+// Plain /api/v1/targets has no help texts, so it passes through untouched.
+// Anything that isn't a successful JSON answer goes back exactly as it came.
+
+const (
+	metadataPath        = "/api/v1/metadata"
+	targetsMetadataPath = "/api/v1/targets/metadata"
+)
+
+// chronoHelp is what every help text gets on the end.
+const chronoHelp = " [Chronotheus: chrono_timeframe=current|7days|14days|21days|28days selects a week back in time;" +
+	" lastMonthAverage is the mean of the four past weeks" +
+	" (lastMonthMin/Max/Median/P90/P95/Stddev summarise them other ways);" +
+	" bandUpper/bandLower are that mean plus/minus a few standard deviations;" +
+	" seasonalBaseline averages past values for the same weekday and time of day;" +
+	" forecastNextWeek repeats the latest of those values as a forecast;" +
+	" compareAgainstLast28 and percentCompareAgainstLast28 are current minus that average, absolute and in percent;" +
+	" lastMonthStandardError is how far that average can be trusted]"
+
+// augmentHelp adds chronoHelp to one metadata entry, once - a Chronotheus
+// in front of a Chronotheus shouldn't say it twice.
+func augmentHelp(entry map[string]interface{}) {
+	help, _ := entry["help"].(string)
+	if !strings.Contains(help, chronoHelp) {
+		entry["help"] = help + chronoHelp
+	}
+}
+
+// handleMetadata serves both metadata endpoints.
+func (p *ChronoProxy) handleMetadata(w http.ResponseWriter, r *http.Request, upstream, path string) {
+	if DebugMode.Load() {
+		log.Printf("[DEBUG] handleMetadata: %s %s", r.Method, r.URL.Path)
+	}
+
+	params := parseClientParams(r)
+	stripLabelFromParam(params, "match_target", "chrono_timeframe")
+	stripLabelFromParam(params, "match_target", "_command")
+	stripLabelFromParam(params, "match_target", pluginLabelName)
+	stripLabelFromParam(params, "match_target", pluginArgsLabelName)
+
+	u := upstream + path + "?" + buildQueryString(params)
+	resp, err := p.getUpstream(r.Context(), u)
+	if err != nil {
+		http.Error(w, `{"status":"error","error":"Upstream request failed"}`, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+	if err != nil {
+		http.Error(w, `{"status":"error","error":"Upstream request failed"}`, http.StatusBadGateway)
+		return
+	}
+
+	var out map[string]interface{}
+	if resp.StatusCode != http.StatusOK || model.DecodeJSON(body, &out) != nil || out["status"] != "success" {
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+
+	switch data := out["data"].(type) {
+	case map[string]interface{}: // /api/v1/metadata
+		for _, entries := range data {
+			list, _ := entries.([]interface{})
+			for _, e := range list {
+				if entry, ok := e.(map[string]interface{}); ok {
+					augmentHelp(entry)
+				}
+			}
+		}
+	case []interface{}: // /api/v1/targets/metadata
+		for _, e := range data {
+			if entry, ok := e.(map[string]interface{}); ok {
+				augmentHelp(entry)
+			}
+		}
+	}
+	writeJSONRaw(w, out)
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestMetadataHelpIsAugmented(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve(metadataPath, 0, []byte(`{"status":"success","data":{"up":[{"type":"gauge","help":"Target is up.","unit":""}]}}`))
+	fake.Serve(targetsMetadataPath, 0, []byte(`{"status":"success","data":[{"target":{"job":"node"},"metric":"up","type":"gauge","help":"Target is up.","unit":""}]}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxy()
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+metadataPath+"?metric=up", nil))
+	var md struct {
+		Data map[string][]struct{ Type, Help string }
+	}
+	json.Unmarshal(w.Body.Bytes(), &md)
+	if got := md.Data["up"]; len(got) != 1 || got[0].Type != "gauge" || got[0].Help != "Target is up."+chronoHelp {
+		t.Errorf("metadata = %s", w.Body)
+	}
+	if reqs := fake.Requests(); reqs[len(reqs)-1].Params.Get("metric") != "up" {
+		t.Errorf("params not passed through: %v", reqs[len(reqs)-1].Params)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+targetsMetadataPath+`?match_target={job="node",chrono_timeframe="7days"}`, nil))
+	var tm struct {
+		Data []struct {
+			Target map[string]string
+			Help   string
+		}
+	}
+	json.Unmarshal(w.Body.Bytes(), &tm)
+	if len(tm.Data) != 1 || tm.Data[0].Target["job"] != "node" || tm.Data[0].Help != "Target is up."+chronoHelp {
+		t.Errorf("targets metadata = %s", w.Body)
+	}
+	if sent := fake.Requests()[len(fake.Requests())-1].Params.Get("match_target"); strings.Contains(sent, "chrono_timeframe") {
+		t.Errorf("chrono_timeframe leaked upstream: %s", sent)
+	}
+}
+
+func TestMetadataErrorsPassThrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"nope"}`))
+	}))
+	defer upstream.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(upstream.URL, "http://"), ":", "_", 1)
+
+	w := httptest.NewRecorder()
+	NewChronoProxy().ServeHTTP(w, httptest.NewRequest("GET", prefix+metadataPath, nil))
+	if w.Code != http.StatusBadRequest || w.Body.String() != `{"status":"error","errorType":"bad_data","error":"nope"}` {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,236 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/metrics.go
+package proxy
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A tiny, dependency-free metrics kit.
+// We're a Prometheus proxy, so it would be a bit embarrassing not to be able
+// to describe ourselves in histograms. These are deliberately minimal -
+// just enough to count things and bucket durations, keyed by label values.
+
+// latencyBuckets are upper bounds in seconds, from "fast LAN" to "go make a coffee".
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// HistogramSnapshot is a point-in-time copy of a histogram.
+// Counts are cumulative, Prometheus-style: Counts[i] is the number of
+// observations <= Buckets[i].
+type HistogramSnapshot struct {
+	Labels  map[string]string
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snap := HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Sum:     h.sum,
+		Count:   h.count,
+	}
+	var running uint64
+	for i, c := range h.counts {
+		running += c
+		snap.Counts[i] = running
+	}
+	return snap
+}
+
+// histogramVec is a family of histograms split by label values,
+// e.g. one per (upstream, phase) pair.
+type histogramVec struct {
+	mu      sync.Mutex
+	labels  []string
+	buckets []float64
+	series  map[string]*histogram
+	values  map[string][]string
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+		values:  make(map[string][]string),
+	}
+}
+
+// observe records v against the given label values (in the order the
+// labels were declared).
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	h, ok := v.series[key]
+	if !ok {
+		h = newHistogram(v.buckets)
+		v.series[key] = h
+		v.values[key] = append([]string(nil), labelValues...)
+	}
+	v.mu.Unlock()
+	h.observe(value)
+}
+
+// snapshot copies every histogram in the family, sorted by label values.
+func (v *histogramVec) snapshot() []HistogramSnapshot {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hs := make([]*histogram, len(keys))
+	vals := make([][]string, len(keys))
+	for i, k := range keys {
+		hs[i], vals[i] = v.series[k], v.values[k]
+	}
+	v.mu.Unlock()
+
+	out := make([]HistogramSnapshot, len(keys))
+	for i, h := range hs {
+		snap := h.snapshot()
+		snap.Labels = make(map[string]string, len(v.labels))
+		for j, name := range v.labels {
+			snap.Labels[name] = vals[i][j]
+		}
+		out[i] = snap
+	}
+	return out
+}
+
+// CounterSnapshot is a point-in-time copy of one counter in a counterVec.
+type CounterSnapshot struct {
+	Labels map[string]string
+	Value  uint64
+}
+
+// counterVec is a family of counters split by label values - the
+// histogramVec's simpler cousin, for things that just need counting.
+type counterVec struct {
+	mu     sync.Mutex
+	labels []string
+	counts map[string]uint64
+	values map[string][]string
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{
+		labels: labels,
+		counts: make(map[string]uint64),
+		values: make(map[string][]string),
+	}
+}
+
+// inc adds one to the counter for the given label values.
+func (v *counterVec) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.values[key]; !ok {
+		v.values[key] = append([]string(nil), labelValues...)
+	}
+	v.counts[key]++
+}
+
+// snapshot copies every counter in the family, sorted by label values.
+func (v *counterVec) snapshot() []CounterSnapshot {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.counts))
+	for k := range v.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]CounterSnapshot, len(keys))
+	for i, k := range keys {
+		labels := make(map[string]string, len(v.labels))
+		for j, name := range v.labels {
+			labels[name] = v.values[k][j]
+		}
+		out[i] = CounterSnapshot{Labels: labels, Value: v.counts[k]}
+	}
+	return out
+}
+
+// restore adds previously snapshotted counts back in - used by LoadState.
+// Snapshots missing one of our labels are from some other shape of the
+// family and get skipped.
+func (v *counterVec) restore(snaps []CounterSnapshot) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, s := range snaps {
+		values := make([]string, len(v.labels))
+		ok := true
+		for i, name := range v.labels {
+			if values[i], ok = s.Labels[name]; !ok {
+				break
+			}
+		}
+		if !ok || len(s.Labels) != len(v.labels) {
+			continue
+		}
+		key := strings.Join(values, "\xff")
+		if _, seen := v.values[key]; !seen {
+			v.values[key] = values
+		}
+		v.counts[key] += s.Value
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
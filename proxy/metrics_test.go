@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestHistogramCumulativeBuckets(t *testing.T) {
+	h := newHistogram([]float64{1, 5, 10})
+	for _, v := range []float64{0.5, 1, 3, 7, 100} {
+		h.observe(v)
+	}
+	snap := h.snapshot()
+	want := []uint64{2, 3, 4}
+	for i := range want {
+		if snap.Counts[i] != want[i] {
+			t.Errorf("bucket le=%v count=%d; want %d", snap.Buckets[i], snap.Counts[i], want[i])
+		}
+	}
+	if snap.Count != 5 || snap.Sum != 111.5 {
+		t.Errorf("count=%d sum=%v; want 5 and 111.5", snap.Count, snap.Sum)
+	}
+}
+
+func TestFetchBodyRecordsUpstreamPhases(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	p := NewChronoProxy()
+	if _, err := p.fetchBody(context.Background(), upstream.URL, time.Second, 0); err != nil {
+		t.Fatalf("fetchBody: %v", err)
+	}
+
+	seen := map[string]uint64{}
+	for _, snap := range p.UpstreamPhaseTimings() {
+		seen[snap.Labels["phase"]] = snap.Count
+	}
+	for _, phase := range []string{phaseConnect, phaseTTFB, phaseTotal} {
+		if seen[phase] != 1 {
+			t.Errorf("phase %s observed %d times; want 1 (all: %v)", phase, seen[phase], seen)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	p := NewChronoProxyWithPlugins(DefaultConfig, newPluginProxy(t).plugins)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	get(prefix + `/api/v1/query?query=up{_plugin="tagger"}&time=1700000000`)
+	get(prefix + `/api/v1/query?query=up{_plugin="no-such-plugin"}&time=1700000000`)
+	// The label values cache is package-wide, but keyed by upstream: this
+	// fake's address starts from a miss.
+	label := "/api/v1/label/metrics_test/values"
+	fake.Serve(label, 0, []byte(`{"status":"success","data":["api"]}`))
+	get(prefix + label)
+	get(prefix + label)
+	p.fetchBody(context.Background(), broken.URL, time.Second, 0)
+
+	w := get("/metrics")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	brokenHost := strings.TrimPrefix(broken.URL, "http://")
+	for _, want := range []string{
+		"# TYPE chronotheus_requests_total counter\nchronotheus_requests_total 4\n",
+		`chronotheus_window_fetch_duration_seconds_count{timeframe="28days"} 2`,
+		`chronotheus_window_fetch_duration_seconds_bucket{timeframe="current",le="+Inf"} 2`,
+		`chronotheus_window_series_count{timeframe="7days"} 2`,
+		`chronotheus_window_response_bytes_count{timeframe="current"} 2`,
+		`chronotheus_request_duration_seconds_count{endpoint="/api/v1/query"} 2`,
+		`chronotheus_request_duration_seconds_count{endpoint="/api/v1/label/:name/values"} 2`,
+		`chronotheus_upstream_errors_total{kind="status_5xx",upstream="` + brokenHost + `"} 1`,
+		`chronotheus_cache_requests_total{cache="label_values",result="hit"} 1`,
+		`chronotheus_cache_requests_total{cache="label_values",result="miss"} 1`,
+		`chronotheus_plugin_duration_seconds_count{plugin="tagger"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "no-such-plugin") {
+		t.Error("unknown plugin names must not become label values")
+	}
+}
+
+func TestFormatLabelsEscapes(t *testing.T) {
+	got := formatLabels(map[string]string{"b": "x\"y", "a": "back\\slash\nline"}, "le", "0.5")
+	want := `{a="back\\slash\nline",b="x\"y",le="0.5"}`
+	if got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
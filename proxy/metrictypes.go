@@ -0,0 +1,161 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/metrictypes.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Metric types - knowing a counter from a gauge from a histogram 🔬
+//
+// Prometheus knows what kind of thing each metric is (/api/v1/metadata),
+// and some synthetics only make sense for some kinds. With metric_types:
+// true, a query that's a plain selector gets its metric looked up, and:
+//
+//   - every synthetic series carries chrono_metric_type="counter" (or
+//     gauge, histogram, summary...), so dashboards can tell;
+//   - a counter that's still raw (not rated, see counters.go) gets no
+//     percentCompareAgainstLast28. "12% more requests since the process
+//     started" is just how long it's been up. There's a warning instead.
+//
+// (Histogram buckets don't need any of this - see histograms.go.)
+//
+// Metadata is keyed by family, so http_duration_seconds_bucket is looked up
+// as http_duration_seconds when the full name isn't known. Answers are
+// remembered for metricTypeTTL per upstream, so Grafana refreshing a
+// dashboard doesn't mean a metadata call per panel.
+
+const (
+	metricTypeLabel = "chrono_metric_type"
+	metricTypeTTL   = 10 * time.Minute
+)
+
+// familySuffixes are what a histogram or summary adds to its family name.
+var familySuffixes = []string{"_bucket", "_sum", "_count", "_total"}
+
+// metricTypes remembers what /api/v1/metadata said, per upstream and metric.
+type metricTypes struct {
+	mu      sync.Mutex
+	entries map[string]metricTypeEntry
+}
+
+type metricTypeEntry struct {
+	typ string // "" when the upstream didn't know
+	at  time.Time
+}
+
+func newMetricTypes() *metricTypes {
+	return &metricTypes{entries: make(map[string]metricTypeEntry)}
+}
+
+// len is how many metrics' types are remembered.
+func (m *metricTypes) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// metricType is name's type on the upstream at base, "" when it can't say.
+func (p *ChronoProxy) metricType(ctx context.Context, base, name string) string {
+	key := base + "|" + name
+	now := p.clock.Now()
+	p.mtypes.mu.Lock()
+	entry, ok := p.mtypes.entries[key]
+	p.mtypes.mu.Unlock()
+	if ok && now.Sub(entry.at) <= metricTypeTTL {
+		return entry.typ
+	}
+
+	typ := p.fetchMetricType(ctx, base, name)
+	for _, suffix := range familySuffixes {
+		if family, trimmed := strings.CutSuffix(name, suffix); typ == "" && trimmed {
+			typ = p.fetchMetricType(ctx, base, family)
+		}
+	}
+	p.mtypes.mu.Lock()
+	p.mtypes.entries[key] = metricTypeEntry{typ: typ, at: now}
+	p.mtypes.mu.Unlock()
+	return typ
+}
+
+// fetchMetricType asks the upstream's metadata API for name's type, ""
+// when it can't say.
+func (p *ChronoProxy) fetchMetricType(ctx context.Context, base, name string) string {
+	q := url.Values{"metric": {name}, "limit": {"1"}}
+	body, err := p.fetchBody(ctx, base+metadataPath+"?"+q.Encode(), p.config.MinUpstreamTimeout, 1024*1024)
+	if err != nil {
+		return ""
+	}
+	var resp struct {
+		Data map[string][]struct {
+			Type string `json:"type"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &resp) != nil || len(resp.Data[name]) == 0 {
+		return ""
+	}
+	return resp.Data[name][0].Type
+}
+
+// isMonotonic says whether a series called name, of a family of type typ,
+// only ever goes up: counters, and the buckets, sums and counts of
+// histograms and summaries.
+func isMonotonic(name, typ string) bool {
+	switch typ {
+	case "counter":
+		return true
+	case "histogram", "summary":
+		return strings.HasSuffix(name, "_bucket") || strings.HasSuffix(name, "_sum") || strings.HasSuffix(name, "_count")
+	}
+	return false
+}
+
+// queryMetric is the metric a plain-selector query asks for and its type,
+// or "" for both when metric_types is off or the query is anything fancier.
+func (p *ChronoProxy) queryMetric(ctx context.Context, params url.Values, base string) (name, typ string) {
+	if !p.config.MetricTypes {
+		return "", ""
+	}
+	m := bareSelectorRegex.FindStringSubmatch(params.Get("query"))
+	if m == nil {
+		return "", ""
+	}
+	return m[1], p.metricType(ctx, base, m[1])
+}
+
+// rawCounterWarning is what a query for a raw counter's percentages gets.
+func rawCounterWarning(name string) string {
+	return fmt.Sprintf("%s is a counter, so percentCompareAgainstLast28 was left out; rate it first (%s=\"rate\")", name, counterLabel)
+}
+
+// labelMetricType tags every synthetic series in seriesList with typ.
+func labelMetricType(seriesList []model.Series, typ string) {
+	for _, s := range seriesList {
+		if isSyntheticTimeframe(s.Labels["chrono_timeframe"]) {
+			s.Labels[metricTypeLabel] = typ
+		}
+	}
+}
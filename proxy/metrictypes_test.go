@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestMetricTypesShapeSynthetics(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve(metadataPath, 0, []byte(`{"status":"success","data":{"requests_total":[{"type":"counter","help":"","unit":""}],"latency_seconds":[{"type":"histogram","help":"","unit":""}]}}`))
+	vector := func(samples ...string) []byte {
+		return []byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"vector","result":[%s]}}`, strings.Join(samples, ",")))
+	}
+	sample := func(at int64, name, le, v string) string {
+		metric := fmt.Sprintf(`{"__name__":%q`, name)
+		if le != "" {
+			metric += fmt.Sprintf(`,"le":%q`, le)
+		}
+		return fmt.Sprintf(`{"metric":%s},"value":[%d,%q]}`, metric, at, v)
+	}
+	const now = 1700000000
+	for _, days := range []int64{0, 7, 14, 21, 28} {
+		at := now - days*86400
+		samples := []string{sample(at, "requests_total", "", fmt.Sprint(1000-days))}
+		switch days {
+		case 7:
+			samples = append(samples, sample(at, "latency_seconds_bucket", "1", "8"), sample(at, "latency_seconds_bucket", "+Inf", "8"))
+		case 14:
+			// The +Inf bucket went missing this week
+			samples = append(samples, sample(at, "latency_seconds_bucket", "1", "8"))
+		}
+		fake.Serve("/api/v1/query", at, vector(samples...))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.MetricTypes = true
+	p := NewChronoProxyWithConfig(config)
+
+	type response struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []interface{}     `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	query := func(q string) response {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+fmt.Sprintf("/api/v1/query?time=%d&query=", now)+url.QueryEscape(q), nil))
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%q: %v: %s", q, err, w.Body.String())
+		}
+		return resp
+	}
+
+	resp := query(`requests_total`)
+	byTf := map[string]map[string]string{}
+	for _, s := range resp.Data.Result {
+		byTf[s.Metric["chrono_timeframe"]] = s.Metric
+	}
+	if _, ok := byTf["percentCompareAgainstLast28"]; ok {
+		t.Error("a raw counter shouldn't get percentages")
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "requests_total is a counter") {
+		t.Errorf("warnings = %q", resp.Warnings)
+	}
+	if byTf["lastMonthAverage"][metricTypeLabel] != "counter" || byTf["compareAgainstLast28"][metricTypeLabel] != "counter" {
+		t.Errorf("synthetics should be labelled: %v", byTf)
+	}
+	if _, ok := byTf["current"][metricTypeLabel]; ok {
+		t.Error("fetched windows should be left as they came")
+	}
+
+	resp = query(`latency_seconds_bucket{chrono_timeframe="lastMonthAverage"}`)
+	buckets := map[string]interface{}{}
+	for _, s := range resp.Data.Result {
+		buckets[s.Metric["le"]] = s.Value[1]
+		if s.Metric[metricTypeLabel] != "histogram" {
+			t.Errorf("bucket labels = %v", s.Metric)
+		}
+	}
+	// le="1" averages to 4, +Inf to 2 on its own - which no histogram can be
+	if buckets["1"] != "4" || buckets["+Inf"] != "4" {
+		t.Errorf("buckets should stay cumulative: %v", buckets)
+	}
+}
@@ -0,0 +1,309 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/mirror.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Request mirroring - try the new storage on real traffic before trusting it.
+//
+//   upstreams:
+//     - name: prod
+//       url: http://prometheus:9090
+//       mirror:
+//         url: http://mimir-query-frontend:8080/prometheus
+//         percent: 10
+//
+// A sampled query's window fetches are replayed against the mirror in the
+// background, decoded the same way, and compared series by series. The
+// client only ever sees the primary's answer - the mirror can be slow,
+// broken or wrong without anybody noticing except /metrics
+// (chronotheus_mirror_comparisons_total) and /api/v1/chrono/admin/mirror,
+// which lists the most recent mismatches.
+//
+// Mirroring is best effort: if too many replays are already in flight we
+// skip rather than queue, so a struggling mirror can't eat the proxy.
+
+// MirrorConfig is the mirror block of a named upstream.
+type MirrorConfig struct {
+	URL       string            `yaml:"url"`                 // Secondary backend, same API as the primary
+	Percent   float64           `yaml:"percent"`             // Share of queries to mirror, 0-100
+	Tolerance float64           `yaml:"tolerance,omitempty"` // Relative difference still counted as equal (default 1e-9)
+	TLS       UpstreamTLSConfig `yaml:"tls,omitempty"`       // TLS for the mirror
+}
+
+const (
+	mirrorConcurrency = 16 // Replays in flight before we start skipping
+	mirrorHistory     = 50 // Mismatches kept for /api/v1/chrono/admin/mirror
+	defaultTolerance  = 1e-9
+
+	mirrorMatch    = "match"
+	mirrorMismatch = "mismatch"
+	mirrorError    = "error"
+	mirrorSkipped  = "skipped"
+)
+
+// validate catches bad mirror blocks at config load time.
+func (c MirrorConfig) validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("mirror percent must be between 0 and 100, got %v", c.Percent)
+	}
+	if c.Tolerance < 0 {
+		return fmt.Errorf("mirror tolerance can't be negative")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("mirror url %q must be an http(s) url", c.URL)
+	}
+	if !c.TLS.isZero() {
+		if _, err := buildTLSConfig(c.TLS); err != nil {
+			return fmt.Errorf("mirror tls: %w", err)
+		}
+	}
+	return nil
+}
+
+// mirror is a resolved mirror block, hung off its primary upstream.
+type mirror struct {
+	upstream  *upstream // Where replays go (name is "<primary>~mirror")
+	percent   float64
+	tolerance float64
+}
+
+func newMirror(config Config, primary string, c MirrorConfig) (*mirror, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	client, err := newTLSClient(config, c.TLS)
+	if err != nil {
+		return nil, err
+	}
+	tolerance := c.Tolerance
+	if tolerance == 0 {
+		tolerance = defaultTolerance
+	}
+	return &mirror{
+		upstream: &upstream{
+			name:   primary + "~mirror",
+			base:   strings.TrimSuffix(c.URL, "/"),
+			client: client,
+		},
+		percent:   c.Percent,
+		tolerance: tolerance,
+	}, nil
+}
+
+// sample decides whether this request gets mirrored.
+func (m *mirror) sample() bool {
+	return m != nil && rand.Float64()*100 < m.percent
+}
+
+// mirrorRun is the per-request mirroring decision: replay fetches made
+// against from (the primary base picked for this request) on m.
+type mirrorRun struct {
+	primary string
+	from    string
+	m       *mirror
+}
+
+type mirrorKey struct{}
+
+func withMirror(ctx context.Context, run *mirrorRun) context.Context {
+	return context.WithValue(ctx, mirrorKey{}, run)
+}
+
+func mirrorFrom(ctx context.Context) *mirrorRun {
+	run, _ := ctx.Value(mirrorKey{}).(*mirrorRun)
+	return run
+}
+
+// MirrorDelta is one mismatch between a primary and its mirror.
+type MirrorDelta struct {
+	Time      time.Time `json:"time"`
+	Upstream  string    `json:"upstream"`
+	Timeframe string    `json:"timeframe"`
+	Query     string    `json:"query"`
+	Error     string    `json:"error,omitempty"`   // The mirror fetch failed
+	Missing   int       `json:"missing"`           // Series only the primary returned
+	Extra     int       `json:"extra"`             // Series only the mirror returned
+	Differing int       `json:"differing"`         // Series both returned, with different points
+	Example   string    `json:"example,omitempty"` // One offending series, to start digging
+}
+
+// mirrorLog keeps the most recent mismatches, oldest first.
+type mirrorLog struct {
+	mu     sync.Mutex
+	deltas []MirrorDelta
+}
+
+func (l *mirrorLog) add(d MirrorDelta) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deltas = append(l.deltas, d)
+	if len(l.deltas) > mirrorHistory {
+		l.deltas = l.deltas[len(l.deltas)-mirrorHistory:]
+	}
+}
+
+func (l *mirrorLog) snapshot() []MirrorDelta {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]MirrorDelta(nil), l.deltas...)
+}
+
+// mirrorWindow replays one window fetch on the mirror, if this request is
+// being mirrored, and compares the result with what the primary gave us.
+// decode must turn a body into series exactly the way the primary's was.
+// It never blocks the caller.
+func (p *ChronoProxy) mirrorWindow(ctx context.Context, u, tf string, timeout time.Duration, primary []model.Series, decode func(context.Context, io.Reader) ([]model.Series, error)) {
+	run := mirrorFrom(ctx)
+	if run == nil || !strings.HasPrefix(u, run.from) {
+		return
+	}
+	select {
+	case p.mirrorSlots <- struct{}{}:
+	default:
+		p.mirrorComparisons.inc(run.primary, mirrorSkipped)
+		return
+	}
+
+	// The pipeline carries on with primary while we wait; compare a copy.
+	want := make([]model.Series, len(primary))
+	for i, s := range primary {
+		want[i] = s.Clone()
+	}
+	target := run.m.upstream.base + strings.TrimPrefix(u, run.from)
+	// The client may well be gone by the time the mirror answers; that's fine.
+	mctx := withUpstream(context.WithoutCancel(ctx), run.m.upstream)
+	go func() {
+		defer func() { <-p.mirrorSlots }()
+		var got []model.Series
+		err := p.fetchStream(mctx, target, timeout, 0, func(r io.Reader) (err error) {
+			got, err = decode(mctx, r)
+			return err
+		})
+
+		delta := MirrorDelta{Time: p.clock.Now(), Upstream: run.primary, Timeframe: tf, Query: queryOf(u)}
+		if err != nil {
+			delta.Error = err.Error()
+			p.mirrorComparisons.inc(run.primary, mirrorError)
+			p.mirrorDeltas.add(delta)
+			return
+		}
+		if compareSeries(want, got, run.m.tolerance, &delta) {
+			p.mirrorComparisons.inc(run.primary, mirrorMatch)
+			return
+		}
+		p.mirrorComparisons.inc(run.primary, mirrorMismatch)
+		p.mirrorDeltas.add(delta)
+		if DebugMode.Load() {
+			log.Printf("[DEBUG] mirror mismatch on %s (%s): %+v", run.primary, tf, delta)
+		}
+	}()
+}
+
+// queryOf pulls the PromQL out of an upstream url, for humans reading deltas.
+func queryOf(u string) string {
+	if parsed, err := url.Parse(u); err == nil {
+		if q := parsed.Query().Get("query"); q != "" {
+			return q
+		}
+	}
+	return u
+}
+
+// compareSeries matches series by their labels and fills in the counts on
+// delta. It reports whether the two sides agree completely.
+func compareSeries(primary, mirrored []model.Series, tolerance float64, delta *MirrorDelta) bool {
+	want := make(map[string]model.Series, len(primary))
+	for _, s := range primary {
+		want[signature(s.Labels)] = s
+	}
+	note := func(sig string) {
+		if delta.Example == "" {
+			delta.Example = sig
+		}
+	}
+	for _, s := range mirrored {
+		sig := signature(s.Labels)
+		p, ok := want[sig]
+		if !ok {
+			delta.Extra++
+			note(sig)
+			continue
+		}
+		delete(want, sig)
+		if !samePoints(p.Points, s.Points, tolerance) {
+			delta.Differing++
+			note(sig)
+		}
+	}
+	for sig := range want {
+		delta.Missing++
+		note(sig)
+	}
+	return delta.Missing == 0 && delta.Extra == 0 && delta.Differing == 0
+}
+
+func samePoints(a, b []model.Point, tolerance float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].T != b[i].T || !closeEnough(a[i].V, b[i].V, tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// closeEnough compares relatively, so big counters and tiny ratios get the
+// same treatment. NaN matches NaN - both sides agreeing there's no number
+// is agreement.
+func closeEnough(a, b, tolerance float64) bool {
+	if a == b || (math.IsNaN(a) && math.IsNaN(b)) {
+		return true
+	}
+	scale := math.Max(math.Abs(a), math.Abs(b))
+	return math.Abs(a-b) <= tolerance*scale
+}
+
+// handleAdminMirror lists recent mirror mismatches, oldest first.
+func (p *ChronoProxy) handleAdminMirror(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data":   p.mirrorDeltas.snapshot(),
+	})
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestMirrorRecordsDeltasWithoutTouchingResponse(t *testing.T) {
+	vector := func(v string) []byte {
+		return []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"` + v + `"]}]}}`)
+	}
+	primary := fixtures.NewFakePrometheus()
+	defer primary.Close()
+	primary.Serve("/api/v1/query", 1700000000, vector("1"))
+	shadow := fixtures.NewFakePrometheus()
+	defer shadow.Close()
+	shadow.Serve("/api/v1/query", 1700000000, vector("2"))
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{
+		Name:   "prod",
+		URL:    primary.URL,
+		Mirror: &MirrorConfig{URL: shadow.URL, Percent: 100},
+	}}
+	p := NewChronoProxyWithConfig(config)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", `/prod/api/v1/query?query=up{chrono_timeframe="current"}&time=1700000000`, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"1"`) || strings.Contains(w.Body.String(), `"2"`) {
+		t.Fatalf("client should only see the primary: %d %s", w.Code, w.Body)
+	}
+
+	// Replays happen in the background.
+	deadline := time.Now().Add(2 * time.Second)
+	for len(p.mirrorDeltas.snapshot()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/admin/mirror", nil))
+	var got struct{ Data []MirrorDelta }
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if len(got.Data) != 1 {
+		t.Fatalf("want one delta, got %s", w.Body)
+	}
+	d := got.Data[0]
+	if d.Upstream != "prod" || d.Timeframe != "current" || d.Query != "up" || d.Differing != 1 || d.Missing != 0 || d.Extra != 0 {
+		t.Errorf("delta = %+v", d)
+	}
+	if snaps := p.mirrorComparisons.snapshot(); len(snaps) != 1 || snaps[0].Labels["result"] != mirrorMismatch {
+		t.Errorf("comparisons = %v", snaps)
+	}
+}
+
+func TestCompareSeries(t *testing.T) {
+	series := func(job string, v float64) model.Series {
+		return model.Series{Labels: map[string]string{"job": job}, Points: []model.Point{{T: 60, V: v}}}
+	}
+	var d MirrorDelta
+	if !compareSeries([]model.Series{series("a", 1e12), series("b", math.NaN())},
+		[]model.Series{series("b", math.NaN()), series("a", 1e12+1)}, 1e-9, &d) {
+		t.Errorf("order, NaNs and tiny relative differences should match: %+v", d)
+	}
+
+	d = MirrorDelta{}
+	if compareSeries([]model.Series{series("a", 1), series("b", 1)}, []model.Series{series("b", 1.5), series("c", 1)}, 1e-9, &d) {
+		t.Error("expected a mismatch")
+	}
+	if d.Missing != 1 || d.Extra != 1 || d.Differing != 1 {
+		t.Errorf("delta = %+v", d)
+	}
+}
+
+func TestMirrorConfigValidation(t *testing.T) {
+	for _, m := range []MirrorConfig{{URL: "http://x:1", Percent: 101}, {URL: "mimir:8080", Percent: 5}, {URL: "http://x:1", Tolerance: -1}} {
+		if err := validateUpstreams([]UpstreamConfig{{Name: "p", URL: "http://p:9090", Mirror: &m}}); err == nil {
+			t.Errorf("%+v: expected an error", m)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/nosynthetics.go
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// No synthetics - some metrics don't average 🚫
+//
+// up was 1 four weeks running, so lastMonthAverage is 1 - fine. But up was
+// 0 for an hour one Tuesday, and now there's a 0.75 on the dashboard that
+// nobody can explain. Booleans, enums and state codes don't have a "usual
+// value". Mark them:
+//
+//   no_synthetics:
+//     - match: up|probe_success
+//       reason: up/down, averaging it across weeks means nothing
+//     - match: kube_.*_status_phase
+//
+// match is a regex over the whole metric name. A query touching a matched
+// metric anywhere gets the raw windows only - no averages, compares,
+// aggregations or bands - and a warning saying why. Asking for a synthetic
+// by name gets nothing but the warning. Comparing two windows with
+// chrono_compare still works: that's raw data side by side.
+
+// NoSyntheticsRule marks metrics synthetics are never built for.
+type NoSyntheticsRule struct {
+	Match  string `yaml:"match"`            // Regex over the whole metric name
+	Reason string `yaml:"reason,omitempty"` // Goes in the warning
+}
+
+// noSynthRule is a NoSyntheticsRule ready to use.
+type noSynthRule struct {
+	re     *regexp.Regexp
+	reason string
+}
+
+// compileNoSynthetics anchors and compiles every rule.
+func compileNoSynthetics(rules []NoSyntheticsRule) ([]noSynthRule, error) {
+	out := make([]noSynthRule, 0, len(rules))
+	for i, r := range rules {
+		if r.Match == "" {
+			return nil, fmt.Errorf("no_synthetics[%d]: match is required", i)
+		}
+		re, err := regexp.Compile("^(?:" + r.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("no_synthetics[%d]: %w", i, err)
+		}
+		out = append(out, noSynthRule{re: re, reason: r.Reason})
+	}
+	return out, nil
+}
+
+var (
+	// Things in a query that aren't metric names, cleared out before
+	// looking for the ones that are.
+	querySelectorRegex = regexp.MustCompile(`\{[^}]*\}|\[[^\]]*\]`)
+	queryGroupingRegex = regexp.MustCompile(`\b(by|without|on|ignoring|group_left|group_right)\s*\([^)]*\)`)
+	queryStringRegex   = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`)
+	queryNameRegex     = regexp.MustCompile(`__name__\s*=\s*"([^"]*)"`)
+	queryIdentRegex    = regexp.MustCompile(`[a-zA-Z_:][a-zA-Z0-9_:]*`)
+
+	promqlKeywords = map[string]bool{
+		"and": true, "or": true, "unless": true, "bool": true, "offset": true,
+		"by": true, "without": true, "on": true, "ignoring": true,
+		"group_left": true, "group_right": true, "inf": true, "nan": true,
+	}
+)
+
+// queryMetricNames is every metric name a query mentions: bare names, and
+// __name__="..." matchers. Function names, keywords and labels don't count.
+func queryMetricNames(query string) []string {
+	var names []string
+	for _, m := range queryNameRegex.FindAllStringSubmatch(query, -1) {
+		names = append(names, m[1])
+	}
+	q := queryStringRegex.ReplaceAllString(querySelectorRegex.ReplaceAllString(query, " "), " ")
+	q = queryGroupingRegex.ReplaceAllString(q, " ")
+	for _, loc := range queryIdentRegex.FindAllStringIndex(q, -1) {
+		word := q[loc[0]:loc[1]]
+		if loc[0] > 0 && strings.ContainsAny(q[loc[0]-1:loc[0]], "0123456789.") {
+			continue // the unit of a duration or a number, like 5m or 1e3
+		}
+		if promqlKeywords[strings.ToLower(word)] || strings.HasPrefix(strings.TrimLeft(q[loc[1]:], " \t\n"), "(") {
+			continue
+		}
+		names = append(names, word)
+	}
+	return names
+}
+
+// noSynthetics is the first metric in query a no_synthetics rule matches,
+// and that rule, or "" when there isn't one.
+func (p *ChronoProxy) noSynthetics(query string) (string, *noSynthRule) {
+	if len(p.noSynth) == 0 {
+		return "", nil
+	}
+	for _, name := range queryMetricNames(query) {
+		for i := range p.noSynth {
+			if p.noSynth[i].re.MatchString(name) {
+				return name, &p.noSynth[i]
+			}
+		}
+	}
+	return "", nil
+}
+
+// warning explains why metric got raw windows only.
+func (r *noSynthRule) warning(metric string) string {
+	reason := r.reason
+	if reason == "" {
+		reason = "no_synthetics is set for it"
+	}
+	return fmt.Sprintf("no synthetics for %s (%s): only raw windows are returned", metric, reason)
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestQueryMetricNames(t *testing.T) {
+	for q, want := range map[string][]string{
+		`up`: {"up"},
+		`sum by (job) (rate(http_requests_total{code=~"5.."}[5m])) / on (job) group_left sum(up offset 1d)`: {"http_requests_total", "up"},
+		`{__name__="probe_success", job="x"} and bool 1e3`:                                                  {"probe_success"},
+		`label_replace(node_load1, "dst", "$1", "src", "(.*)")`:                                             {"node_load1"},
+	} {
+		if got := queryMetricNames(q); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", q, got, want)
+		}
+	}
+}
+
+func TestNoSynthetics(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	config := DefaultConfig
+	config.NoSynthetics = []NoSyntheticsRule{{Match: "up|probe_.*", Reason: "it's up or down"}}
+	p := NewChronoProxyWithConfig(config)
+
+	query := func(q string) (timeframes []string, warnings []string) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(q), nil))
+		var resp struct {
+			Data struct {
+				Result []struct {
+					Metric map[string]string `json:"metric"`
+				} `json:"result"`
+			} `json:"data"`
+			Warnings []string `json:"warnings"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("bad response %q: %v", w.Body.String(), err)
+		}
+		for _, r := range resp.Data.Result {
+			timeframes = append(timeframes, r.Metric["chrono_timeframe"])
+		}
+		return timeframes, resp.Warnings
+	}
+
+	tfs, warnings := query("up")
+	if strings.Join(tfs, ",") != "current,7days,14days,21days,28days" {
+		t.Errorf("want raw windows only, got %q", tfs)
+	}
+	if len(warnings) != 1 || warnings[0] != "no synthetics for up (it's up or down): only raw windows are returned" {
+		t.Errorf("warnings = %q", warnings)
+	}
+	if tfs, warnings := query(`up{chrono_timeframe="lastMonthAverage"}`); len(tfs) != 0 || len(warnings) != 1 {
+		t.Errorf("asking for a synthetic: %q %q", tfs, warnings)
+	}
+	if tfs, _ := query(`up{chrono_timeframe="7days"}`); strings.Join(tfs, ",") != "7days" {
+		t.Errorf("a raw window still works: %q", tfs)
+	}
+	if tfs, warnings := query("node_load1"); len(tfs) <= 5 || warnings != nil {
+		t.Errorf("other metrics keep their synthetics: %q %q", tfs, warnings)
+	}
+
+	config.NoSynthetics = []NoSyntheticsRule{{Match: "("}}
+	if config.Validate() == nil {
+		t.Error("a bad regex should fail validation")
+	}
+}
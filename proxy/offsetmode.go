@@ -0,0 +1,126 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/offsetmode.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Offset mode - let Prometheus do the time travel ⏪
+//
+// By default a past window is the same query asked at an earlier time:
+// time (or start and end) moved back by the offset, and the answer's
+// timestamps moved forward again. With window_mode: offset - or
+// chrono_window_mode="offset" on one query - the time stays where it is
+// and the query gets PromQL offset modifiers instead:
+//
+//   sum(rate(http_requests_total{job="api"}[5m]))
+//     7days → sum(rate(http_requests_total{job="api"}[5m] offset 604800s))
+//
+// Every selector gets one, after its range; one that already has an offset
+// gets the window's added to it. The answer comes back on today's
+// timestamps, so nothing is shifted. Steps line up with current's exactly,
+// and the query upstream logs show is one anybody can paste into the
+// Prometheus UI - it's printed back by Prometheus' own parser, so it's in
+// Prometheus' canonical form. Offsets are fixed durations, so with a
+// timezone set a window spanning a clock change is an hour off the
+// calendar one.
+//
+// A query the parser can't read is fetched the usual way, with a warning.
+
+const (
+	windowModeLabel  = "chrono_window_mode"
+	windowModeShift  = "shift"
+	windowModeOffset = "offset"
+)
+
+var windowModeRegex = regexp.MustCompile(`chrono_window_mode="([^"]*)"`)
+
+// validateWindowMode checks window_mode.
+func validateWindowMode(mode string) error {
+	switch mode {
+	case "", windowModeShift, windowModeOffset:
+		return nil
+	}
+	return fmt.Errorf("window_mode must be shift or offset, got %q", mode)
+}
+
+// extractWindowMode finds chrono_window_mode in the query, stripping it
+// out, falling back to window_mode.
+func (p *ChronoProxy) extractWindowMode(params url.Values) (string, error) {
+	m := windowModeRegex.FindStringSubmatch(params.Get("query"))
+	stripLabelFromParam(params, "query", windowModeLabel)
+	if m == nil {
+		if p.config.WindowMode == "" {
+			return windowModeShift, nil
+		}
+		return p.config.WindowMode, nil
+	}
+	if err := validateWindowMode(m[1]); err != nil || m[1] == "" {
+		return "", &badQueryError{msg: fmt.Sprintf("%s: want shift or offset, got %q", windowModeLabel, m[1])}
+	}
+	return m[1], nil
+}
+
+// offsetWindows marks every past window in wins to be fetched with offset
+// modifiers, or leaves them be, with a warning, when query can't be
+// rewritten.
+func offsetWindows(ctx context.Context, wins []window, query string) []window {
+	if _, err := withOffset(query, time.Hour); err != nil {
+		warningsFrom(ctx).add(fmt.Sprintf("%s: couldn't add offsets to the query (%v); windows were shifted in time instead", windowModeLabel, err))
+		return wins
+	}
+	out := make([]window, len(wins))
+	for i, win := range wins {
+		out[i] = win
+		out[i].viaOffset = win.offset != 0
+	}
+	return out
+}
+
+// offsetWindow sets q up to fetch win with offset modifiers, and returns
+// the window to decode its answer as: already in the present, so there's
+// nothing to shift.
+func offsetWindow(q url.Values, win window) window {
+	if rewritten, err := withOffset(q.Get("query"), time.Duration(win.offset)*time.Second); err == nil {
+		q.Set("query", rewritten)
+	}
+	return window{name: win.name}
+}
+
+// withOffset adds offset d to every selector in query, printed back the
+// way Prometheus prints it (see promql.go).
+func withOffset(query string, d time.Duration) (string, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return "", err
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			vs.OriginalOffset += d
+		}
+		return nil
+	})
+	return expr.String(), nil
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestWithOffset(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{`up`, `up offset 1h`},
+		{`sum(rate(http_requests_total{job="api"}[5m]))`, `sum(rate(http_requests_total{job="api"}[5m] offset 1h))`},
+		{`sum by (job) (rate(a[5m])) / on (job) group_left sum without (x) (b)`, `sum by (job) (rate(a[5m] offset 1h)) / on (job) group_left () sum without (x) (b offset 1h)`},
+		{`a offset 1h + b offset -30m`, `a offset 2h + b offset 30m`},
+		{`rate(a[5m] @ end()) > 0.5`, `rate(a[5m] @ end() offset 1h) > 0.5`},
+		{`label_replace(up{x="}"}, "dst", "up", "src", "(.*)")`, `label_replace(up{x="}"} offset 1h, "dst", "up", "src", "(.*)")`},
+		{`max_over_time(rate(a[1m])[1h:5m]) > bool 1e3`, `max_over_time(rate(a[1m] offset 1h)[1h:5m]) > bool 1000`},
+		{"up # offset 1d\n", `up offset 1h`},
+		{`{__name__="up"}`, `{__name__="up"} offset 1h`},
+	}
+	for _, tc := range cases {
+		if got, err := withOffset(tc.in, time.Hour); err != nil || got != tc.want {
+			t.Errorf("withOffset(%s) = %s, %v; want %s", tc.in, got, err, tc.want)
+		}
+	}
+	if _, err := withOffset(`up{job=`, time.Hour); err == nil {
+		t.Error("an unreadable query should be an error")
+	}
+}
+
+func TestOffsetWindowMode(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxy()
+
+	w := httptest.NewRecorder()
+	q := url.QueryEscape(`rate(up{chrono_window_mode="offset"}[5m])`)
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+q, nil))
+	if w.Code != 200 {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	got := map[string]bool{}
+	for _, r := range fake.Requests() {
+		if r.Params.Get("time") != "1700000000" {
+			t.Errorf("time was moved: %v", r.Params)
+		}
+		got[r.Params.Get("query")] = true
+	}
+	for _, want := range []string{`rate(up[5m])`, `rate(up[5m] offset 1w)`, `rate(up[5m] offset 4w)`} {
+		if !got[want] {
+			t.Errorf("upstream never saw %s; saw %v", want, got)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(`up{chrono_window_mode="sideways"}`), nil))
+	if w.Code != 400 {
+		t.Errorf("bad mode: status %d; want 400", w.Code)
+	}
+
+	config := DefaultConfig
+	config.WindowMode = "rewind"
+	if config.Validate() == nil {
+		t.Error("window_mode rewind should fail validation")
+	}
+}
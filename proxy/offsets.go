@@ -0,0 +1,152 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/offsets.go
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ad-hoc windows - for when 7/14/21/28 days isn't the question.
+//
+// Two ways to ask, both inline in the query like chrono_timeframe:
+//
+//   up{chrono_offsets="1d,2d,3d"}   current plus one window per offset, with
+//                                   the synthetics built from those instead
+//                                   of the usual four weeks
+//   up{chrono_timeframe="3days"}    just the one window, three days back
+//
+// Offsets are Go durations with days and weeks thrown in: 1d, 36h, 2w,
+// 1d12h, 90m. Windows are named "<n>days" when they're whole days (so
+// chrono_offsets="1d" gives you chrono_timeframe="1days" - consistency
+// beats grammar) and by their duration otherwise ("36h", "1h30m").
+//
+// lastMonthAverage and friends keep their names with custom offsets - the
+// compares are built on them - but they're computed over the windows you
+// asked for. The average still divides by the number of windows.
+
+const offsetsLabel = "chrono_offsets"
+
+var (
+	offsetsRegex   = regexp.MustCompile(`chrono_offsets="([^"]*)"`)
+	dayWeekRegex   = regexp.MustCompile(`(\d+(?:\.\d+)?)([dw])`)
+	adHocDaysRegex = regexp.MustCompile(`^(\d+)days$`)
+)
+
+// badQueryError is a mistake in the request itself - answered with 400,
+// not 503.
+type badQueryError struct{ msg string }
+
+func (e *badQueryError) Error() string { return e.msg }
+
+// parseOffset reads a Go duration that may also use d (24h) and w (7d).
+func parseOffset(s string) (time.Duration, error) {
+	expanded := dayWeekRegex.ReplaceAllStringFunc(s, func(m string) string {
+		parts := dayWeekRegex.FindStringSubmatch(m)
+		n, _ := strconv.ParseFloat(parts[1], 64)
+		hours := n * 24
+		if parts[2] == "w" {
+			hours *= 7
+		}
+		return strconv.FormatFloat(hours, 'f', -1, 64) + "h"
+	})
+	d, err := time.ParseDuration(expanded)
+	if err != nil {
+		return 0, fmt.Errorf("bad offset %q: want a duration like 1d, 36h or 2w", s)
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("bad offset %q: must be at least a second back", s)
+	}
+	return d, nil
+}
+
+// offsetName is what a window shows up as in chrono_timeframe.
+func offsetName(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%ddays", d/(24*time.Hour))
+	}
+	return shortDuration(d)
+}
+
+// shortDuration is d.String() without the trailing zero units.
+func shortDuration(d time.Duration) string {
+	// time.Duration says 36h0m0s; we'd rather say 36h.
+	name := d.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+// adHocWindow turns a chrono_timeframe we don't know ("3days", "36h") into
+// a window, if it reads as an offset.
+func adHocWindow(tf string) (window, bool) {
+	spec := tf
+	if m := adHocDaysRegex.FindStringSubmatch(tf); m != nil {
+		spec = m[1] + "d"
+	}
+	d, err := parseOffset(spec)
+	if err != nil {
+		return window{}, false
+	}
+	return window{name: tf, offset: int64(d / time.Second)}, true
+}
+
+// extractOffsets finds chrono_offsets in the query and strips it out. No
+// label means nil windows - use the standard ones.
+func (p *ChronoProxy) extractOffsets(params url.Values) ([]window, error) {
+	m := offsetsRegex.FindStringSubmatch(params.Get("query"))
+	stripLabelFromParam(params, "query", offsetsLabel)
+	if m == nil {
+		return nil, nil
+	}
+	spec := m[1]
+
+	wins := []window{{name: "current", offset: 0, loc: p.location}}
+	seen := make(map[int64]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := parseOffset(part)
+		if err != nil {
+			return nil, &badQueryError{msg: err.Error()}
+		}
+		offset := int64(d / time.Second)
+		if seen[offset] {
+			continue
+		}
+		seen[offset] = true
+		wins = append(wins, window{name: offsetName(d), offset: offset, loc: p.location})
+	}
+	if len(wins) == 1 {
+		return nil, &badQueryError{msg: offsetsLabel + " needs at least one offset"}
+	}
+	if max := p.config.MaxCustomWindows; max > 0 && len(wins)-1 > max {
+		return nil, &badQueryError{msg: fmt.Sprintf("%s asks for %d windows, the limit is %d", offsetsLabel, len(wins)-1, max)}
+	}
+	return wins, nil
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestParseOffset(t *testing.T) {
+	for spec, want := range map[string]time.Duration{
+		"1d":    24 * time.Hour,
+		"2w":    14 * 24 * time.Hour,
+		"36h":   36 * time.Hour,
+		"1d12h": 36 * time.Hour,
+		"1.5d":  36 * time.Hour,
+		"90m":   90 * time.Minute,
+	} {
+		if got, err := parseOffset(spec); err != nil || got != want {
+			t.Errorf("parseOffset(%q) = %v, %v; want %v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"", "yesterday", "-1d", "10ms"} {
+		if _, err := parseOffset(spec); err == nil {
+			t.Errorf("parseOffset(%q) should fail", spec)
+		}
+	}
+	for d, want := range map[time.Duration]string{72 * time.Hour: "3days", 36 * time.Hour: "36h", 90 * time.Minute: "1h30m"} {
+		if got := offsetName(d); got != want {
+			t.Errorf("offsetName(%v) = %q; want %q", d, got, want)
+		}
+	}
+}
+
+func TestCustomOffsets(t *testing.T) {
+	const now = 1700000000
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for i, back := range []int64{0, 86400, 2 * 86400, 3 * 86400} {
+		fake.Serve("/api/v1/query", now-back, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[`+
+			model.FormatValue(float64(now-back))+`,"`+model.FormatValue(float64(i*3))+`"]}]}}`))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxy()
+	query := func(q string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+q, nil))
+		return w
+	}
+
+	body := query(`up{chrono_offsets="1d,2d"}`).Body.String()
+	for _, want := range []string{`"chrono_timeframe":"1days"`, `"chrono_timeframe":"2days"`, `"chrono_timeframe":"lastMonthAverage"},"value":[1700000000,"4.5"]`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in %s", want, body)
+		}
+	}
+	if strings.Contains(body, "7days") {
+		t.Errorf("standard windows shouldn't be fetched: %s", body)
+	}
+	if strings.Index(body, "1days") > strings.Index(body, "lastMonthAverage") {
+		t.Errorf("ad-hoc windows should sort before synthetics: %s", body)
+	}
+	for _, req := range fake.Requests() {
+		if strings.Contains(req.Params.Get("query"), "chrono_offsets") {
+			t.Errorf("chrono_offsets leaked upstream: %s", req.Params.Get("query"))
+		}
+	}
+
+	body = query(`up{chrono_timeframe="3days"}`).Body.String()
+	if !strings.Contains(body, `"chrono_timeframe":"3days"},"value":[1700000000,"9"]`) || strings.Contains(body, "current") {
+		t.Errorf("ad-hoc timeframe: %s", body)
+	}
+
+	if w := query(`up{chrono_offsets="1d,soon"}`); w.Code != 400 || !strings.Contains(w.Body.String(), `bad offset \"soon\"`) {
+		t.Errorf("bad offset: %d %s", w.Code, w.Body)
+	}
+}
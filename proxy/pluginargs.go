@@ -0,0 +1,92 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/pluginargs.go
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Plugin arguments - knobs for plugins, turned per query 🎛️
+//
+//   my_metric{_plugin="prediction", _plugin_args="horizon=30m,model=linear"}
+//
+// The arguments go to every stage of a _plugin="a|b" chain; plugins that
+// implement plugin.ArgsPlugin get them, the rest never know they were
+// there. Like _plugin, _plugin_args can also be its own match[] entry, and
+// never reaches the upstream.
+
+const (
+	pluginArgsLabelName = "_plugin_args"
+	maxPluginArgs       = 32
+)
+
+var (
+	pluginArgsLabelRegex = regexp.MustCompile(`_plugin_args="([^"]*)"`)
+	pluginArgsRegex      = regexp.MustCompile(`^_plugin_args="([^"]*)"$`)
+)
+
+// extractPluginArgs finds _plugin_args in match[] (removing that entry) or
+// inline in the query, and parses it. No _plugin_args means nil.
+func extractPluginArgs(vals url.Values) (map[string]string, error) {
+	raw, found := "", false
+	for i, m := range vals["match[]"] {
+		if matches := pluginArgsRegex.FindStringSubmatch(m); matches != nil {
+			vs := vals["match[]"]
+			vals["match[]"] = append(vs[:i], vs[i+1:]...)
+			raw, found = matches[1], true
+			break
+		}
+	}
+	if !found {
+		if matches := pluginArgsLabelRegex.FindStringSubmatch(vals.Get("query")); matches != nil {
+			raw, found = matches[1], true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return parsePluginArgs(raw)
+}
+
+// parsePluginArgs reads "horizon=30m,model=linear". Values may contain '='
+// but not ','.
+func parsePluginArgs(raw string) (map[string]string, error) {
+	args := make(map[string]string)
+	if strings.TrimSpace(raw) == "" {
+		return args, nil
+	}
+	pairs := strings.Split(raw, ",")
+	if len(pairs) > maxPluginArgs {
+		return nil, &badQueryError{msg: fmt.Sprintf("%s: at most %d arguments, got %d", pluginArgsLabelName, maxPluginArgs, len(pairs))}
+	}
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, &badQueryError{msg: fmt.Sprintf("%s: %q isn't key=value", pluginArgsLabelName, strings.TrimSpace(pair))}
+		}
+		if _, dup := args[k]; dup {
+			return nil, &badQueryError{msg: fmt.Sprintf("%s: %q given twice", pluginArgsLabelName, k)}
+		}
+		args[k] = strings.TrimSpace(v)
+	}
+	return args, nil
+}
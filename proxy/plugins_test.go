@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+	"github.com/andydixon/chronotheus/internal/plugin"
+)
+
+// tagPlugin stamps every series it sees, so we can tell it ran.
+type tagPlugin struct{}
+
+func (tagPlugin) Init() error           { return nil }
+func (tagPlugin) GetIdentifier() string { return "tagger" }
+func (tagPlugin) Handle(merged []model.Series) ([]model.Series, error) {
+	for _, s := range merged {
+		s.Labels["tagged"] = "yes"
+	}
+	return merged, nil
+}
+
+func newPluginProxy(t *testing.T) *ChronoProxy {
+	t.Helper()
+	plugins := plugin.NewManager("")
+	if err := plugins.Register(tagPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	return NewChronoProxyWithPlugins(DefaultConfig, plugins)
+}
+
+func TestExtractPlugin(t *testing.T) {
+	cases := []struct {
+		vals  url.Values
+		want  string
+		match []string
+	}{
+		{url.Values{"query": {`up{_plugin="prediction"}`}}, "prediction", nil},
+		{url.Values{"query": {`up`}, "match[]": {`up`, `_plugin="tagger"`}}, "tagger", []string{`up`}},
+		{url.Values{"query": {`rate(up[5m])`}}, "", nil},
+	}
+	for _, tc := range cases {
+		if got := extractPlugin(tc.vals); got != tc.want {
+			t.Errorf("extractPlugin(%v) = %q; want %q", tc.vals, got, tc.want)
+		}
+		if tc.match != nil && fmt.Sprint(tc.vals["match[]"]) != fmt.Sprint(tc.match) {
+			t.Errorf("match[] = %v; want %v", tc.vals["match[]"], tc.match)
+		}
+	}
+}
+
+func TestQueryRunsRequestedPlugin(t *testing.T) {
+	p := newPluginProxy(t)
+
+	set, _ := fixtures.Generate(fixtures.Spec{Name: "instant", Series: 1, Points: 1, Step: 60, End: 1700000000, Instant: true})
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.ServeSet(set)
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	for _, tc := range []struct {
+		query  string
+		tagged bool
+	}{
+		{`http_requests_total{_plugin="tagger",chrono_timeframe="current"}`, true},
+		{`http_requests_total{chrono_timeframe="current"}`, false},
+		{`http_requests_total{_plugin="nope",chrono_timeframe="current"}`, false},
+	} {
+		params := url.Values{"query": {tc.query}, "time": {"1700000000"}}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?"+params.Encode(), nil))
+
+		var resp struct {
+			Data struct {
+				Result []struct {
+					Metric map[string]string `json:"metric"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Data.Result) == 0 {
+			t.Fatalf("%s: bad response %s", tc.query, w.Body.String())
+		}
+		if got := resp.Data.Result[0].Metric["tagged"] == "yes"; got != tc.tagged {
+			t.Errorf("%s: tagged = %v; want %v", tc.query, got, tc.tagged)
+		}
+	}
+
+	for _, req := range fake.Requests() {
+		if strings.Contains(req.Params.Get("query"), "_plugin") {
+			t.Errorf("_plugin leaked upstream: %q", req.Params.Get("query"))
+		}
+	}
+}
+
+// weekPlugin keeps only the nearest past week, and says how far back it is.
+type weekPlugin struct{ tagPlugin }
+
+func (weekPlugin) GetIdentifier() string { return "weeks" }
+func (weekPlugin) HandleWindows(w plugin.Windows, args map[string]string) ([]model.Series, error) {
+	name := w.PastNames()[0]
+	for _, s := range w.Past[name] {
+		s.Labels["offset"] = w.Offsets[name].String()
+	}
+	return w.Past[name], nil
+}
+
+func TestPluginGetsWindowsApart(t *testing.T) {
+	plugins := plugin.NewManager("")
+	plugins.Register(weekPlugin{})
+	p := NewChronoProxyWithPlugins(DefaultConfig, plugins)
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(`up{_plugin="weeks"}`), nil))
+	var resp struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Data.Result) != 1 || resp.Data.Result[0].Metric["chrono_timeframe"] != "7days" || resp.Data.Result[0].Metric["offset"] != "168h0m0s" {
+		t.Errorf("got %s", w.Body.String())
+	}
+}
+
+func TestPluginLabelValues(t *testing.T) {
+	for _, tc := range []struct {
+		p    *ChronoProxy
+		want string
+	}{
+		{newPluginProxy(t), `["tagger"]`},
+		{NewChronoProxy(), `[]`},
+	} {
+		w := httptest.NewRecorder()
+		tc.p.ServeHTTP(w, httptest.NewRequest("GET", "/prometheus_9090/api/v1/label/_plugin/values", nil))
+		if !strings.Contains(w.Body.String(), `"data":`+tc.want) {
+			t.Errorf("got %s; want data %s", w.Body.String(), tc.want)
+		}
+	}
+}
+
+// stagePlugin appends its name to a "stages" label, or fails.
+type stagePlugin struct {
+	name string
+	fail bool
+}
+
+func (s stagePlugin) Init() error           { return nil }
+func (s stagePlugin) GetIdentifier() string { return s.name }
+func (s stagePlugin) Handle(merged []model.Series) ([]model.Series, error) {
+	if s.fail {
+		return nil, fmt.Errorf("%s is broken", s.name)
+	}
+	for _, series := range merged {
+		series.Labels["stages"] += s.name + ";"
+	}
+	return merged, nil
+}
+
+func TestPluginChain(t *testing.T) {
+	plugins := plugin.NewManager("")
+	for _, sp := range []stagePlugin{{name: "smooth"}, {name: "predict"}, {name: "broken", fail: true}} {
+		plugins.Register(sp)
+	}
+	p := NewChronoProxyWithPlugins(DefaultConfig, plugins)
+
+	set, _ := fixtures.Generate(fixtures.Spec{Name: "instant", Series: 1, Points: 1, Step: 60, End: 1700000000, Instant: true})
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.ServeSet(set)
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	for _, tc := range []struct {
+		chain, stages, warning string
+		code                   int
+	}{
+		{"smooth|predict", "smooth;predict;", "", 200},
+		{"predict | smooth", "predict;smooth;", "", 200},
+		{"smooth|broken|predict", "smooth;", `plugin "broken" (stage 2 of 3) failed: plugin broken error: broken is broken; returning the output of smooth`, 200},
+		{"missing|smooth", "", `plugin "missing" (stage 1 of 2) failed`, 200},
+		{"smooth||predict", "", "", 400},
+		{strings.Repeat("smooth|", maxPluginStages) + "smooth", "", "", 400},
+	} {
+		params := url.Values{"query": {`http_requests_total{_plugin="` + tc.chain + `",chrono_timeframe="current"}`}, "time": {"1700000000"}}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?"+params.Encode(), nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: code = %d, want %d (%s)", tc.chain, w.Code, tc.code, w.Body.String())
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var resp struct {
+			Data struct {
+				Result []struct {
+					Metric map[string]string `json:"metric"`
+				} `json:"result"`
+			} `json:"data"`
+			Warnings []string `json:"warnings"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Data.Result) == 0 {
+			t.Fatalf("%s: bad response %s", tc.chain, w.Body.String())
+		}
+		if got := resp.Data.Result[0].Metric["stages"]; got != tc.stages {
+			t.Errorf("%s: stages = %q, want %q", tc.chain, got, tc.stages)
+		}
+		if tc.warning == "" && len(resp.Warnings) != 0 {
+			t.Errorf("%s: unexpected warnings %q", tc.chain, resp.Warnings)
+		}
+		if tc.warning != "" && (len(resp.Warnings) != 1 || !strings.HasPrefix(resp.Warnings[0], tc.warning)) {
+			t.Errorf("%s: warnings = %q, want %q", tc.chain, resp.Warnings, tc.warning)
+		}
+	}
+}
+
+// argsPlugin copies its arguments onto every series as labels.
+type argsPlugin struct{}
+
+func (argsPlugin) Init() error           { return nil }
+func (argsPlugin) GetIdentifier() string { return "args" }
+func (argsPlugin) Handle(merged []model.Series) ([]model.Series, error) {
+	return merged, nil
+}
+func (argsPlugin) HandleWithArgs(merged []model.Series, args map[string]string) ([]model.Series, error) {
+	for _, s := range merged {
+		for k, v := range args {
+			s.Labels["arg_"+k] = v
+		}
+	}
+	return merged, nil
+}
+
+func TestPluginArgs(t *testing.T) {
+	plugins := plugin.NewManager("")
+	plugins.Register(argsPlugin{})
+	plugins.Register(tagPlugin{})
+	p := NewChronoProxyWithPlugins(DefaultConfig, plugins)
+
+	set, _ := fixtures.Generate(fixtures.Spec{Name: "instant", Series: 1, Points: 1, Step: 60, End: 1700000000, Instant: true})
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.ServeSet(set)
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	for _, tc := range []struct {
+		params url.Values
+		want   map[string]string
+		code   int
+	}{
+		{url.Values{"query": {`http_requests_total{_plugin="args",_plugin_args="horizon=30m, model=linear",chrono_timeframe="current"}`}}, map[string]string{"arg_horizon": "30m", "arg_model": "linear"}, 200},
+		{url.Values{"query": {`http_requests_total{_plugin="tagger|args",chrono_timeframe="current"}`}, "match[]": {`_plugin_args="q=a=b"`}}, map[string]string{"arg_q": "a=b", "tagged": "yes"}, 200},
+		{url.Values{"query": {`http_requests_total{_plugin="args",_plugin_args="horizon",chrono_timeframe="current"}`}}, nil, 400},
+		{url.Values{"query": {`http_requests_total{_plugin="args",_plugin_args="a=1,a=2",chrono_timeframe="current"}`}}, nil, 400},
+	} {
+		tc.params.Set("time", "1700000000")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?"+tc.params.Encode(), nil))
+		if w.Code != tc.code {
+			t.Errorf("%v: code = %d, want %d (%s)", tc.params, w.Code, tc.code, w.Body.String())
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var resp struct {
+			Data struct {
+				Result []struct {
+					Metric map[string]string `json:"metric"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Data.Result) == 0 {
+			t.Fatalf("%v: bad response %s", tc.params, w.Body.String())
+		}
+		for k, v := range tc.want {
+			if got := resp.Data.Result[0].Metric[k]; got != v {
+				t.Errorf("%v: %s = %q, want %q", tc.params, k, got, v)
+			}
+		}
+	}
+
+	for _, req := range fake.Requests() {
+		for _, v := range append(req.Params["match[]"], req.Params.Get("query")) {
+			if strings.Contains(v, "_plugin_args") {
+				t.Errorf("_plugin_args leaked upstream: %q", v)
+			}
+		}
+	}
+}
+
+func TestAdminPlugins(t *testing.T) {
+	p := newPluginProxy(t)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/chrono/admin/plugins", nil))
+	var resp struct {
+		Data struct {
+			Loaded  []string             `json:"loaded"`
+			Watcher plugin.WatcherHealth `json:"watcher"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 200 || fmt.Sprint(resp.Data.Loaded) != "[tagger]" || resp.Data.Watcher.Watching {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,50 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/precision.go
+package proxy
+
+import "github.com/andydixon/chronotheus/internal/model"
+
+// Value precision - how many digits go over the wire.
+//
+// Every value we answer with, fetched, synthetic or plugin-made, is printed
+// by model.FormatValue at full round-trip precision by default: a counter
+// at 9007199254740993 stays exact. That's a lot of digits for
+// percentCompareAgainstLast28 = 3.3333333333333335, though, and on a long
+// range query they add up. value_precision: N rounds every value to N
+// significant digits on the way out - after all the maths, so nothing is
+// computed from rounded numbers.
+
+// maxValuePrecision is as many significant digits as a float64 can hold.
+const maxValuePrecision = 17
+
+// roundSeries returns series with every value rounded to digits significant
+// digits. Points are copied - results may be shared (job results, for one).
+func roundSeries(series []model.Series, digits int) []model.Series {
+	if digits <= 0 {
+		return series
+	}
+	out := make([]model.Series, len(series))
+	for i, s := range series {
+		pts := make([]model.Point, len(s.Points))
+		for j, pt := range s.Points {
+			pts[j] = model.Point{T: pt.T, V: model.RoundSignificant(pt.V, digits)}
+		}
+		out[i] = model.Series{Labels: s.Labels, Points: pts}
+	}
+	return out
+}
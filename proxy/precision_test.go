@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestValuePrecision(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 1700000000, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"0.123456789"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	query := func(p *ChronoProxy) string {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000&query=up{chrono_timeframe="current"}`, nil))
+		return w.Body.String()
+	}
+
+	if body := query(NewChronoProxy()); !strings.Contains(body, `"0.123456789"`) {
+		t.Errorf("default should keep full precision: %s", body)
+	}
+	config := DefaultConfig
+	config.ValuePrecision = 3
+	if body := query(NewChronoProxyWithConfig(config)); !strings.Contains(body, `"0.123"`) {
+		t.Errorf("value_precision 3: %s", body)
+	}
+	config.ValuePrecision = 18
+	if err := config.Validate(); err == nil {
+		t.Error("expected value_precision 18 to fail validation")
+	}
+}
+
+func TestSubSecondTimestamps(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 1700000000, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000.125,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	w := httptest.NewRecorder()
+	NewChronoProxy().ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000.25&query=up{chrono_timeframe="current"}`, nil))
+	if body := w.Body.String(); !strings.Contains(body, `[1700000000.125,"1"]`) {
+		t.Errorf("milliseconds lost on the way back: %s", body)
+	}
+	reqs := fake.Requests()
+	if len(reqs) != 1 || reqs[0].Params.Get("time") != "1700000000.25" {
+		t.Errorf("upstream saw %+v", reqs)
+	}
+}
@@ -0,0 +1,136 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/priority.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Priority classes - the VIP lane and the freight lane!
+//
+// A live Grafana panel with a human staring at it should never sit behind
+// the nightly report generator chewing through 30 days of data. So every
+// chrono evaluation belongs to a class, and each class gets its own pool of
+// concurrency slots:
+//
+//   - interactive: the default, for dashboards and humans
+//   - batch:       reports, precompute jobs, anything that can wait its turn
+//
+// The class comes from:
+//  1. the API key header, looked up in Config.PriorityByAPIKey
+//  2. the priority header (X-Chrono-Priority by default), which can only
+//     ever ask for less - a key mapped to batch can't talk its way back
+//     into the interactive lane
+//  3. background jobs are always batch; everything else is interactive
+
+type priorityClass string
+
+const (
+	priorityInteractive priorityClass = "interactive"
+	priorityBatch       priorityClass = "batch"
+)
+
+// parsePriority turns whatever the client sent into a class we know about.
+func parsePriority(s string) (priorityClass, bool) {
+	switch priorityClass(strings.ToLower(strings.TrimSpace(s))) {
+	case priorityInteractive:
+		return priorityInteractive, true
+	case priorityBatch:
+		return priorityBatch, true
+	}
+	return "", false
+}
+
+// requestPriority works out which lane a request belongs in.
+func (p *ChronoProxy) requestPriority(r *http.Request) priorityClass {
+	class := priorityInteractive
+	if key := r.Header.Get(p.config.APIKeyHeader); key != "" {
+		if keyed, ok := parsePriority(p.config.PriorityByAPIKey[key]); ok {
+			class = keyed
+		}
+	}
+	if asked, ok := parsePriority(r.Header.Get(p.config.PriorityHeader)); ok && asked == priorityBatch {
+		class = priorityBatch
+	}
+	return class
+}
+
+// scheduler hands out concurrency slots, one pool per priority class.
+// A nil pool means "unlimited" for that class.
+type scheduler struct {
+	pools     map[priorityClass]chan struct{}
+	queueWait time.Duration // how long to queue for a slot before giving up (0 = until ctx ends)
+}
+
+func newScheduler(config Config) *scheduler {
+	s := &scheduler{pools: make(map[priorityClass]chan struct{}), queueWait: config.QueueWait}
+	if config.InteractiveConcurrency > 0 {
+		s.pools[priorityInteractive] = make(chan struct{}, config.InteractiveConcurrency)
+	}
+	if config.BatchConcurrency > 0 {
+		s.pools[priorityBatch] = make(chan struct{}, config.BatchConcurrency)
+	}
+	return s
+}
+
+// acquire waits for a slot in the class's pool. The returned func gives the
+// slot back; it must be called exactly once. If ctx ends first we give up,
+// and if the queue wait runs out first we give up with a *saturatedError
+// (which becomes a 429 - see backpressure.go).
+func (s *scheduler) acquire(ctx context.Context, class priorityClass) (func(), error) {
+	pool, ok := s.pools[class]
+	if !ok {
+		return func() {}, nil
+	}
+
+	var expired <-chan time.Time
+	if wait := queueWaitFrom(ctx, s.queueWait); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case pool <- struct{}{}:
+		return func() { <-pool }, nil
+	case <-expired:
+		return nil, &saturatedError{
+			reason: reasonConcurrencyLimit,
+			msg:    fmt.Sprintf("all %d %s slots are busy", cap(pool), class),
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// priorityKey carries the class through to evaluate().
+type priorityKey struct{}
+
+func withPriority(ctx context.Context, class priorityClass) context.Context {
+	return context.WithValue(ctx, priorityKey{}, class)
+}
+
+func priorityFrom(ctx context.Context) priorityClass {
+	if class, ok := ctx.Value(priorityKey{}).(priorityClass); ok {
+		return class
+	}
+	return priorityInteractive
+}
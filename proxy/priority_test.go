@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestPriority(t *testing.T) {
+	config := DefaultConfig
+	config.PriorityByAPIKey = map[string]string{"reports-key": "batch", "grafana-key": "interactive"}
+	p := NewChronoProxyWithConfig(config)
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    priorityClass
+	}{
+		{"default is interactive", nil, priorityInteractive},
+		{"explicit batch header", map[string]string{"X-Chrono-Priority": "Batch"}, priorityBatch},
+		{"api key mapped to batch", map[string]string{"X-Api-Key": "reports-key"}, priorityBatch},
+		{"header can't raise a batch key", map[string]string{"X-Api-Key": "reports-key", "X-Chrono-Priority": "interactive"}, priorityBatch},
+		{"header can lower an interactive key", map[string]string{"X-Api-Key": "grafana-key", "X-Chrono-Priority": "batch"}, priorityBatch},
+		{"interactive header on an unmapped key", map[string]string{"X-Api-Key": "other", "X-Chrono-Priority": "interactive"}, priorityInteractive},
+		{"unknown class ignored", map[string]string{"X-Chrono-Priority": "urgent"}, priorityInteractive},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			if got := p.requestPriority(req); got != tc.want {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSchedulerPoolsAreIndependent(t *testing.T) {
+	config := DefaultConfig
+	config.InteractiveConcurrency = 1
+	config.BatchConcurrency = 1
+	s := newScheduler(config)
+
+	releaseBatch, err := s.acquire(context.Background(), priorityBatch)
+	if err != nil {
+		t.Fatalf("acquire batch: %v", err)
+	}
+	defer releaseBatch()
+
+	// A saturated batch pool must not block interactive work
+	releaseInteractive, err := s.acquire(context.Background(), priorityInteractive)
+	if err != nil {
+		t.Fatalf("acquire interactive while batch is full: %v", err)
+	}
+	releaseInteractive()
+
+	// ...but a second batch request has to wait its turn
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquire(ctx, priorityBatch); err == nil {
+		t.Error("expected second batch acquire to time out")
+	}
+}
@@ -0,0 +1,219 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/promql.go
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Selector parsing - reading {...} like Prometheus does, because it's
+// Prometheus doing the reading 🔍
+//
+// Chrono labels used to be found and cut out with regexes, which was fine
+// right up until somebody wrote label_replace(x, "a", "}", ...), or
+// chrono_timeframe=~"7days|14days", or a matcher with a space before the
+// =. Now queries go through Prometheus' own PromQL parser, and every
+// vector selector in the tree is looked at: strings, comments, subqueries
+// and all are handled exactly the way the upstream will handle them.
+//
+// Taking a matcher out means printing the query back from the tree, which
+// is Prometheus' canonical form (matchers sorted, durations tidied) rather
+// than what the client typed. A query with nothing of ours in it goes
+// upstream untouched. A query the parser can't read is a 400 - the
+// upstream would say the same, and guessing would mean letting a
+// chrono_timeframe=~ filter silently match everything.
+//
+// A match[] entry can also be a bare matcher list, chrono_timeframe="7days"
+// with no braces; parseQuery reads those as one selector.
+
+// parsedQuery is a query and its tree.
+type parsedQuery struct {
+	expr parser.Expr
+	bare bool // read as {q}, see parseQuery
+}
+
+// parseQuery parses q, or q as one bare matcher list when it has no braces
+// at all. Errors are 400s.
+func parseQuery(q string) (*parsedQuery, error) {
+	pq := &parsedQuery{bare: !strings.Contains(q, "{") && strings.ContainsAny(q, "=~")}
+	if pq.bare {
+		q = "{" + q + "}"
+	}
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return nil, &badQueryError{msg: fmt.Sprintf("invalid query: %v", err)}
+	}
+	pq.expr = expr
+	return pq, nil
+}
+
+// selectors is every vector selector in the query, in order.
+func (pq *parsedQuery) selectors() []*parser.VectorSelector {
+	var out []*parser.VectorSelector
+	parser.Inspect(pq.expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			out = append(out, vs)
+		}
+		return nil
+	})
+	return out
+}
+
+// String prints the query back from its tree.
+func (pq *parsedQuery) String() string {
+	s := pq.expr.String()
+	if pq.bare {
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	}
+	return s
+}
+
+// removeMatchers is q without any matcher on label, printed back from the
+// tree when something was taken out and untouched otherwise. ok is false
+// when q couldn't be read.
+func removeMatchers(q, label string) (string, bool) {
+	pq, err := parseQuery(q)
+	if err != nil {
+		return q, false
+	}
+	removed := false
+	for _, vs := range pq.selectors() {
+		kept := vs.LabelMatchers[:0]
+		for _, m := range vs.LabelMatchers {
+			if m.Name == label {
+				removed = true
+				continue
+			}
+			kept = append(kept, m)
+		}
+		vs.LabelMatchers = kept
+	}
+	if !removed {
+		return q, true
+	}
+	return pq.String(), true
+}
+
+// inlineMatcher is the value of the first label="..." in query, with
+// found false when there isn't one or query can't be read.
+func inlineMatcher(query, label string) (value string, found bool) {
+	pq, err := parseQuery(query)
+	if err != nil {
+		return "", false
+	}
+	for _, vs := range pq.selectors() {
+		for _, m := range vs.LabelMatchers {
+			if m.Name == label && m.Type == labels.MatchEqual && m.Value != "" {
+				return m.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// selectorStrings is every selector in query as written, metric name
+// included, or nil if query can't be read.
+func selectorStrings(query string) []string {
+	pq, err := parseQuery(query)
+	if err != nil {
+		return nil
+	}
+	if pq.bare {
+		return []string{query}
+	}
+	var out []string
+	for _, vs := range pq.selectors() {
+		pos := vs.PositionRange()
+		out = append(out, query[pos.Start:pos.End])
+	}
+	return out
+}
+
+// timeframeFilter is chrono_timeframe matched with =~, != or !~ in the
+// query, nil when there isn't one. Those pick from what a plain query
+// would return, every one of them applying, as in Prometheus. When they
+// pick only raw windows, only those are fetched; otherwise everything is
+// built and the rest thrown away.
+type timeframeFilter []*labels.Matcher
+
+// extractTimeframeFilter reads query's chrono_timeframe filter. A query
+// that can't be read is a 400, never "no filter".
+func extractTimeframeFilter(query string) (timeframeFilter, error) {
+	pq, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	var f timeframeFilter
+	for _, vs := range pq.selectors() {
+		for _, m := range vs.LabelMatchers {
+			if m.Name == "chrono_timeframe" && m.Type != labels.MatchEqual {
+				f = append(f, m)
+			}
+		}
+	}
+	return f, nil
+}
+
+// match reports whether chrono_timeframe tf passes f.
+func (f timeframeFilter) match(tf string) bool {
+	for _, m := range f {
+		if !m.Matches(tf) {
+			return false
+		}
+	}
+	return true
+}
+
+// rawOnly reports whether f picks no synthetic at all, so there's nothing
+// to build and only the windows it names need fetching.
+func (f timeframeFilter) rawOnly() bool {
+	for _, tf := range syntheticTimeframes() {
+		if f.match(tf) {
+			return false
+		}
+	}
+	return true
+}
+
+// windows is the wins f picks.
+func (f timeframeFilter) windows(wins []window) []window {
+	var out []window
+	for _, win := range wins {
+		if f.match(win.name) {
+			out = append(out, win)
+		}
+	}
+	return out
+}
+
+// keep is series whose chrono_timeframe passes f.
+func (f timeframeFilter) keep(series []model.Series) []model.Series {
+	out := series[:0]
+	for _, s := range series {
+		if f.match(s.Labels["chrono_timeframe"]) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
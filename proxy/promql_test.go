@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestRemoveMatchers(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{`up{chrono_timeframe=~"7days|14days", job="a"}`, `up{job="a"}`},
+		{`up{job="a" , chrono_timeframe != "current"}`, `up{job="a"}`},
+		{`sum(rate(a{chrono_timeframe="7days"}[5m])) / sum(rate(b{x="}",chrono_timeframe="7days"}[5m]))`, `sum(rate(a[5m])) / sum(rate(b{x="}"}[5m]))`},
+		{`label_replace(up{chrono_timeframe="7days"}, "d", "{chrono_timeframe=\"x\"}", "s", "(.*)")`, `label_replace(up, "d", "{chrono_timeframe=\"x\"}", "s", "(.*)")`},
+		{`{"up", 'chrono_timeframe'='7days'}`, `{__name__="up"}`},
+		{`a="1",chrono_timeframe="7days"`, `a="1"`},                                                  // a bare match[] entry
+		{"up{job=\"a\"} # {chrono_timeframe=\"x\"}\n", "up{job=\"a\"} # {chrono_timeframe=\"x\"}\n"}, // a comment, left as it was
+		{`max_over_time(rate(a{chrono_timeframe="7days",job="a"}[5m])[1h:1m])`, `max_over_time(rate(a{job="a"}[5m])[1h:1m])`},
+		{`a{chrono_timeframe="7days"} + on (x) b{y="1",chrono_timeframe!="current"}`, `a + on (x) b{y="1"}`},
+	}
+	for _, tc := range cases {
+		got, ok := removeMatchers(tc.in, "chrono_timeframe")
+		if !ok || got != tc.want {
+			t.Errorf("removeMatchers(%s) = %s, %v; want %s", tc.in, got, ok, tc.want)
+		}
+	}
+	for _, bad := range []string{`{chrono_timeframe="`, `up{job}`, `rate(up{chrono_timeframe="7days"})`} {
+		if _, ok := removeMatchers(bad, "chrono_timeframe"); ok {
+			t.Errorf("removeMatchers(%s) should fail", bad)
+		}
+	}
+}
+
+func TestInlineMatcher(t *testing.T) {
+	if v, ok := inlineMatcher(`up{chrono_timeframe=~"x"} or up{ chrono_timeframe = "7days" }`, "chrono_timeframe"); !ok || v != "7days" {
+		t.Errorf("got %q, %v; want 7days", v, ok)
+	}
+	if _, ok := inlineMatcher(`label_replace(up, "d", "_plugin=\"x\"", "s", "")`, "_plugin"); ok {
+		t.Error("a string literal isn't a matcher")
+	}
+	if v, ok := inlineMatcher("up # {_command=\"dryRun\"}", "_command"); ok {
+		t.Errorf("a comment isn't a matcher, got %q", v)
+	}
+	if v, ok := inlineMatcher(`up{_command="dryRun"`, "_command"); ok {
+		t.Errorf("an unreadable query has no matchers, got %q", v)
+	}
+}
+
+func TestTimeframeRegexMatcher(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxy()
+
+	query := func(q string) (int, []string) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(q), nil))
+		var resp struct {
+			Data struct {
+				Result []struct {
+					Metric map[string]string `json:"metric"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var tfs []string
+		for _, r := range resp.Data.Result {
+			tfs = append(tfs, r.Metric["chrono_timeframe"])
+		}
+		return w.Code, tfs
+	}
+
+	if _, tfs := query(`up{chrono_timeframe=~"7days|14days"}`); strings.Join(tfs, ",") != "7days,14days" {
+		t.Errorf("=~ got %q", tfs)
+	}
+	if n := len(fake.Requests()); n != 2 {
+		t.Errorf("=~ on raw windows fetched %d windows; want 2", n)
+	}
+	if _, tfs := query(`up{chrono_timeframe!="current",chrono_timeframe!~"[0-9].*|.*[cC]ompare.*"}`); strings.Join(tfs, ",") != "lastMonthAverage,lastMonthStandardError" {
+		t.Errorf("!= got %q", tfs)
+	}
+	if _, tfs := query(`up{chrono_timeframe!~".*[cC]ompare.*|current"}`); strings.Join(tfs, ",") != "7days,14days,21days,28days,lastMonthAverage,lastMonthStandardError" {
+		t.Errorf("!~ got %q", tfs)
+	}
+	for _, r := range fake.Requests() {
+		if strings.Contains(r.Params.Get("query"), "chrono_timeframe") {
+			t.Errorf("leaked upstream: %s", r.Params.Get("query"))
+		}
+	}
+	if code, _ := query(`up{chrono_timeframe=~"("}`); code != 400 {
+		t.Errorf("bad regex: status %d; want 400", code)
+	}
+	// A query that can't be read is refused, not run with its filter dropped
+	before := len(fake.Requests())
+	if code, _ := query(`up{chrono_timeframe=~"7days"`); code != 400 {
+		t.Errorf("unreadable query: status %d; want 400", code)
+	}
+	if n := len(fake.Requests()) - before; n != 0 {
+		t.Errorf("unreadable query fetched %d windows; want none", n)
+	}
+}
@@ -0,0 +1,205 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/provenance.go
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Provenance - "where did this number come from?", answered in the response.
+//
+// Every chrono_timeframe is made the same way for every series, so what we
+// describe is the timeframe: which windows were fetched for it, how they
+// were combined, and which Chronotheus did the combining. Two flavours:
+//
+//   - meta: a chrono_meta object next to resultType/result, keyed by
+//     chrono_timeframe. Grafana and friends ignore fields they don't know,
+//     so nothing downstream breaks.
+//   - labels: chrono_computation, chrono_source_windows and
+//     chrono_proxy_version labels on the synthetic series themselves.
+//     Handy when the consumer only keeps labels, but every new proxy
+//     version makes new series, so think before pointing alerts at them.
+//
+// provenance in the config sets the default (off unless set); a request can
+// pick for itself with chrono_provenance=meta|labels|off.
+
+// Version is the running Chronotheus version, set by main.
+var Version = "dev"
+
+// Provenance modes.
+const (
+	provenanceOff    = "off"
+	provenanceMeta   = "meta"
+	provenanceLabels = "labels"
+)
+
+// provenanceParam is the per-request override. It never reaches upstream.
+const provenanceParam = "chrono_provenance"
+
+func validProvenance(mode string) bool {
+	switch mode {
+	case "", provenanceOff, provenanceMeta, provenanceLabels:
+		return true
+	}
+	return false
+}
+
+// provenanceMode works out what this request wants and removes the
+// parameter from params.
+func (p *ChronoProxy) provenanceMode(params url.Values) string {
+	mode := p.config.Provenance
+	if v := params.Get(provenanceParam); validProvenance(v) && v != "" {
+		mode = v
+	}
+	params.Del(provenanceParam)
+	return mode
+}
+
+// sourceWindow is one window a timeframe was built from.
+type sourceWindow struct {
+	Timeframe     string `json:"timeframe"`
+	OffsetSeconds int64  `json:"offset_seconds"`
+}
+
+// provenance describes how one chrono_timeframe was produced.
+type provenance struct {
+	Computation   string         `json:"computation"`
+	SourceWindows []sourceWindow `json:"source_windows"`
+	ProxyVersion  string         `json:"proxy_version"`
+}
+
+// provenanceFor describes timeframe tf.
+func (p *ChronoProxy) provenanceFor(tf string) provenance {
+	var current, past []sourceWindow
+	for _, win := range p.windows() {
+		sw := sourceWindow{Timeframe: win.name, OffsetSeconds: win.offset}
+		if win.name == tf {
+			return provenance{Computation: "fetched", SourceWindows: []sourceWindow{sw}, ProxyVersion: Version}
+		}
+		if win.offset == 0 {
+			current = append(current, sw)
+		} else {
+			past = append(past, sw)
+		}
+	}
+
+	out := provenance{SourceWindows: past, ProxyVersion: Version}
+	switch tf {
+	case averageAggregation.name:
+		out.Computation = fmt.Sprintf("sum/%d", len(past))
+	case seasonalBaselineName:
+		out.Computation = "seasonal_mean"
+	case forecastNextWeekName:
+		out.Computation = "seasonal_naive"
+	case dataGapsName:
+		out.Computation = "missing_windows"
+	case "compareAgainstLast28":
+		out.Computation = "current-" + averageAggregation.name
+		out.SourceWindows = append(current, past...)
+	case "percentCompareAgainstLast28":
+		out.Computation = "percent(current-" + averageAggregation.name + ")"
+		out.SourceWindows = append(current, past...)
+	case standardErrorName:
+		out.Computation = "stddev/sqrt(n)"
+	case bandUpperName:
+		out.Computation = fmt.Sprintf("mean+%gstddev", p.config.BandStddevs)
+	case bandLowerName:
+		out.Computation = fmt.Sprintf("mean-%gstddev", p.config.BandStddevs)
+	default:
+		if agg, ok := aggregationByName(tf); ok {
+			out.Computation = agg.key
+		} else if pair, err := p.comparePair(tf, p.windows()); err == nil {
+			out.Computation = "difference"
+			out.SourceWindows = []sourceWindow{
+				{Timeframe: pair[0].name, OffsetSeconds: pair[0].offset},
+				{Timeframe: pair[1].name, OffsetSeconds: pair[1].offset},
+			}
+		} else {
+			out.Computation = "unknown"
+		}
+	}
+	return out
+}
+
+// withProvenanceLabels returns series with provenance labels on the
+// synthetic ones. Labels are copied - results may be shared (job results
+// are served as often as they're asked for).
+func (p *ChronoProxy) withProvenanceLabels(series []model.Series) []model.Series {
+	out := make([]model.Series, len(series))
+	for i, s := range series {
+		tf := s.Labels["chrono_timeframe"]
+		if _, err := p.comparePair(tf, p.windows()); !isSyntheticTimeframe(tf) && err != nil {
+			out[i] = s
+			continue
+		}
+		prov := p.provenanceFor(tf)
+		names := make([]string, len(prov.SourceWindows))
+		for j, sw := range prov.SourceWindows {
+			names[j] = sw.Timeframe
+		}
+		labels := copyMetric(s.Labels)
+		labels["chrono_computation"] = prov.Computation
+		labels["chrono_source_windows"] = strings.Join(names, ",")
+		labels["chrono_proxy_version"] = prov.ProxyVersion
+		out[i] = model.Series{Labels: labels, Points: s.Points}
+	}
+	return out
+}
+
+// writeResult is writeJSON plus value_precision, whatever provenance mode
+// asks for, and any warnings picked up along the way.
+func (p *ChronoProxy) writeResult(w http.ResponseWriter, rt string, result []model.Series, mode string, warnings []string, trace *traceReport) {
+	result = roundSeries(result, p.config.ValuePrecision)
+	if mode == provenanceLabels {
+		result = p.withProvenanceLabels(result)
+	}
+	var encoded interface{} = model.Matrix(result)
+	if rt == "vector" {
+		encoded = model.Vector(result)
+	}
+	data := map[string]interface{}{
+		"resultType": rt,
+		"result":     encoded,
+	}
+	if mode == provenanceMeta {
+		meta := make(map[string]provenance)
+		for _, s := range result {
+			if tf := s.Labels["chrono_timeframe"]; tf != "" {
+				if _, done := meta[tf]; !done {
+					meta[tf] = p.provenanceFor(tf)
+				}
+			}
+		}
+		data["chrono_meta"] = meta
+	}
+	if trace != nil {
+		data["chrono_trace"] = trace // _command="TRACE" (see evaltrace.go)
+	}
+	body := map[string]interface{}{"status": "success", "data": data}
+	if len(warnings) > 0 {
+		body["warnings"] = warnings // e.g. stale windows (see stale.go)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestProvenance(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for _, at := range []int64{1700000000, 1700000000 - 7*86400} {
+		fake.Serve("/api/v1/query", at, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1,"1"]}]}}`))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxy()
+	query := func(extra string) string {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query=up"+extra, nil))
+		return w.Body.String()
+	}
+
+	if body := query(""); strings.Contains(body, "chrono_meta") || strings.Contains(body, "chrono_computation") {
+		t.Errorf("provenance should be off by default: %s", body)
+	}
+	for _, req := range fake.Requests() {
+		if req.Params.Has(provenanceParam) {
+			t.Errorf("%s leaked upstream: %v", provenanceParam, req.Params)
+		}
+	}
+
+	var resp struct {
+		Data struct {
+			Meta map[string]provenance `json:"chrono_meta"`
+		}
+	}
+	json.Unmarshal([]byte(query("&chrono_provenance=meta")), &resp)
+	avg := resp.Data.Meta["lastMonthAverage"]
+	if avg.Computation != "sum/4" || len(avg.SourceWindows) != 4 || avg.SourceWindows[0].Timeframe != "7days" || avg.ProxyVersion != Version {
+		t.Errorf("lastMonthAverage provenance = %+v", avg)
+	}
+	if cur := resp.Data.Meta["current"]; cur.Computation != "fetched" || len(cur.SourceWindows) != 1 {
+		t.Errorf("current provenance = %+v", cur)
+	}
+
+	body := query("&chrono_provenance=labels")
+	if !strings.Contains(body, `"chrono_computation":"current-lastMonthAverage","chrono_proxy_version":"dev","chrono_source_windows":"current,7days,14days,21days,28days"`) {
+		t.Errorf("compare labels missing: %s", body)
+	}
+	if strings.Contains(body, `"chrono_computation":"fetched"`) {
+		t.Errorf("fetched windows shouldn't get provenance labels: %s", body)
+	}
+}
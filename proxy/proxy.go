@@ -22,47 +22,280 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/andydixon/chronotheus/internal/plugin"
 )
 
 // Configuration options for ChronoProxy
+// The yaml tags are the keys you use in the -config file (see config.go).
 type Config struct {
-	MaxIdleConns        int           // Maximum number of idle connections (like spare time machines)
-	MaxIdleConnsPerHost int           // Max idle connections per destination (don't hog all the parking spots!)
-	IdleConnTimeout     time.Duration // How long before we shut down an idle connection (power saving!)
-	ClientTimeout       time.Duration // Maximum time for a complete operation (we can't wait forever!)
-	DialTimeout         time.Duration // How long to wait for initial connection (patience has limits!)
-	KeepAlive          time.Duration // Keep connections warm and ready (like keeping the engine running)
-	DisableCompression  bool         // Whether to compress data (squish those bytes!)
-	ForceAttemptHTTP2   bool         // Try to use HTTP/2 (the future is now!)
+	// Server basics - usually set with flags, but a config file works too
+	Listen     string `yaml:"listen"`      // Address to listen on (ip:port)
+	Debug      bool   `yaml:"debug"`       // Verbose debug logging
+	PluginPath string `yaml:"plugin_path"` // Directory watched for *.so plugins
+
+	// Out-of-process plugins - run as subprocesses, so a crash only takes out the plugin (see internal/plugin/process.go)
+	ProcessPlugins []plugin.ProcessConfig `yaml:"process_plugins"`
+
+	// Listening side - who may use the proxy, and over what (see listenauth.go)
+	ListenAuth ListenAuthConfig `yaml:"listen_auth"` // Bearer tokens, basic users, client certificate subjects
+	ListenTLS  ListenTLSConfig  `yaml:"listen_tls"`  // Serve https, optionally verifying client certificates
+
+	// Admin changes - PUT/DELETE on the admin endpoints, off unless asked for (see admin.go)
+	AdminWrites     bool     `yaml:"admin_writes"`     // Let chaos, timeframe switches and /-/reload change things at runtime; needs listen_auth
+	AdminIdentities []string `yaml:"admin_identities"` // listen_auth identities (user:ops, cert:prometheus) allowed on our own endpoints; required with tenants
+
+	MaxIdleConns        int           `yaml:"max_idle_conns"`          // Maximum number of idle connections (like spare time machines)
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"` // Max idle connections per destination (don't hog all the parking spots!)
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`       // How long before we shut down an idle connection (power saving!)
+	ClientTimeout       time.Duration `yaml:"client_timeout"`          // Maximum time for a complete operation (we can't wait forever!)
+	DialTimeout         time.Duration `yaml:"dial_timeout"`            // How long to wait for initial connection (patience has limits!)
+	KeepAlive           time.Duration `yaml:"keep_alive"`              // Keep connections warm and ready (like keeping the engine running)
+	DisableCompression  bool          `yaml:"disable_compression"`     // Whether to compress data (squish those bytes!)
+	ForceAttemptHTTP2   bool          `yaml:"force_attempt_http2"`     // Try to use HTTP/2 (the future is now!)
+	JobTimeout          time.Duration `yaml:"job_timeout"`             // How long a background job may run before we give up on it
+	JobResultTTL        time.Duration `yaml:"job_result_ttl"`          // How long finished job results hang around for collection
+	MaxRunningJobs      int           `yaml:"max_running_jobs"`        // Cap on concurrently running background jobs (0 = unlimited)
+
+	// Adaptive upstream timeouts - big ranges get more patience, instant queries fail fast
+	AdaptiveTimeout    bool          `yaml:"adaptive_timeout"`      // Scale per-window upstream timeouts with range and step
+	MinUpstreamTimeout time.Duration `yaml:"min_upstream_timeout"`  // Floor (and the whole budget for instant queries)
+	MaxUpstreamTimeout time.Duration `yaml:"max_upstream_timeout"`  // Ceiling, however huge the range
+	TimeoutPerRangeDay time.Duration `yaml:"timeout_per_range_day"` // Extra patience per day of requested range
+	TimeoutPer1kPoints time.Duration `yaml:"timeout_per_1k_points"` // Extra patience per 1000 points per series (range/step)
+
+	// Priority classes - interactive dashboards get their own lane, separate from batch work
+	InteractiveConcurrency int               `yaml:"interactive_concurrency"` // Concurrent interactive evaluations (0 = unlimited)
+	BatchConcurrency       int               `yaml:"batch_concurrency"`       // Concurrent batch evaluations (0 = unlimited)
+	PriorityHeader         string            `yaml:"priority_header"`         // Header clients use to pick a class ("interactive" or "batch")
+	APIKeyHeader           string            `yaml:"api_key_header"`          // Header carrying the client's API key
+	PriorityByAPIKey       map[string]string `yaml:"priority_by_api_key"`     // API key → priority class
+	QueueWait              time.Duration     `yaml:"queue_wait"`              // How long to queue for a slot before answering 429 (0 = until the request gives up)
+	RetryAfter             time.Duration     `yaml:"retry_after"`             // Retry-After sent with 429s
+
+	// Rate limits - per client and overall (see ratelimit.go)
+	RateLimitPerClient  float64  `yaml:"rate_limit_per_client"`  // Requests/s from one client IP (0 = unlimited)
+	RateLimitGlobal     float64  `yaml:"rate_limit_global"`      // Requests/s from all clients together (0 = unlimited)
+	RateLimitBurst      int      `yaml:"rate_limit_burst"`       // Bucket size for both (0 = one second's worth)
+	TrustForwardedFor   bool     `yaml:"trust_forwarded_for"`    // Key clients on X-Forwarded-For rather than the connection
+	TrustedProxies      []string `yaml:"trusted_proxies"`        // IPs/CIDRs of our own reverse proxies; X-Forwarded-* is believed from these (see trustedproxies.go)
+	MaxUpstreamInFlight int      `yaml:"max_upstream_in_flight"` // Window fetches running at once across all requests (0 = unlimited)
+	CoalesceFetches     bool     `yaml:"coalesce_fetches"`       // Identical window fetches running at once share one upstream request (see coalesce.go)
+
+	// Quotas - per tenant/API key query and sample budgets (see quota.go)
+	TenantHeader string        `yaml:"tenant_header"` // Header naming the caller's tenant
+	Quotas       []QuotaConfig `yaml:"quotas"`
+
+	// Tenants - several teams on one Chronotheus, kept apart (see tenants.go)
+	Tenants       []TenantConfig `yaml:"tenants"`
+	RequireTenant bool           `yaml:"require_tenant"` // Turn away requests that don't name a tenant
+
+	// Synthetic series - which extra aggregations plain queries get (see aggregations.go)
+	MaxCustomWindows      int      `yaml:"max_custom_windows"`     // Most offsets one chrono_offsets label may ask for (see offsets.go, 0 = unlimited)
+	Timezone              string   `yaml:"timezone"`               // IANA zone whole-day windows shift in, by calendar days ("" = plain seconds, see timezone.go)
+	SyntheticAggregations []string `yaml:"synthetic_aggregations"` // Any of min, max, median, p90, p95, stddev, band
+	BandStddevs           float64  `yaml:"band_stddevs"`           // Width of bandUpper/bandLower in standard deviations (see bands.go)
+
+	// Response limits - one query can't run the proxy out of memory (see limits.go)
+	MaxResponseSeries  int   `yaml:"max_response_series"`  // Series one query may fetch or return (0 = unlimited)
+	MaxResponseSamples int64 `yaml:"max_response_samples"` // Samples one query may fetch or return (0 = unlimited)
+	MaxResponseBytes   int64 `yaml:"max_response_bytes"`   // Bytes of upstream responses one query may read (0 = unlimited)
+
+	// Downsampling - fewer points for long ranges (see downsample.go)
+	MaxPointsPerSeries int    `yaml:"max_points_per_series"` // Range queries over this are downsampled automatically (0 = never)
+	DownsampleFunction string `yaml:"downsample_function"`   // avg, min or max
+
+	// Window fetching - how a past window is asked for (see offsetmode.go)
+	WindowMode    string `yaml:"window_mode"`    // shift (move the time back, the default) or offset (add offset modifiers to the query)
+	PadLookbehind bool   `yaml:"pad_lookbehind"` // Fetch range windows from before start by the query's lookbehind (see lookbehind.go)
+
+	// Current window staleness - a flat line or a stopped exporter? (see staleness.go)
+	MaxStaleness time.Duration `yaml:"max_staleness"` // Warn when a current series' newest sample is older than this at the end of the range (0 = off)
+
+	// Per-metric rules - what history goes through first, or whether synthetics are built at all
+	ValueTransforms []ValueTransformConfig `yaml:"value_transforms"` // History transformed before synthetics, per metric (see transforms.go)
+	NoSynthetics    []NoSyntheticsRule     `yaml:"no_synthetics"`    // Metrics that only ever get raw windows (see nosynthetics.go)
+
+	// Virtual metrics - named expressions queried as chrono:<name> (see virtualmetrics.go)
+	VirtualMetrics []VirtualMetricConfig `yaml:"virtual_metrics"`
+
+	// Per-dashboard metrics - attribute load to Grafana dashboards (see dashboards.go)
+	MaxDashboardSeries int `yaml:"max_dashboard_series"` // Distinct dashboard/panel pairs tracked before the rest count as "other"
+
+	// Output - how values are written (see precision.go)
+	ValuePrecision int `yaml:"value_precision"` // Significant digits per value (0 = full round-trip precision)
+
+	// Malformed samples - what to do with samples that aren't [<number>, <value>] (see malformed.go)
+	MalformedSamples string `yaml:"malformed_samples"` // "warn" (drop, and say so), "skip" (drop quietly) or "reject" (fail the window)
+
+	// Provenance - say how synthetic series were made (see provenance.go)
+	Provenance string `yaml:"provenance"` // "off", "meta" (chrono_meta section) or "labels"
+
+	// Tracing - OpenTelemetry spans per request (see tracing.go)
+	TracingEndpoint    string  `yaml:"tracing_endpoint"`     // OTLP/HTTP traces URL, e.g. http://otel-collector:4318/v1/traces ("" = off)
+	TracingServiceName string  `yaml:"tracing_service_name"` // service.name on every span
+	TracingSampleRatio float64 `yaml:"tracing_sample_ratio"` // Share of requests traced when the caller didn't send a traceparent (0-1)
+
+	// Upstream request logging - each upstream request as a curl command (see upstreamlog.go)
+	LogUpstreamRequests bool     `yaml:"log_upstream_requests"` // Log them all, not only with -debug or _command="TRACE"
+	ScrubParams         []string `yaml:"scrub_params"`          // Query parameters and headers masked in those logs, on top of the usual credentials
+
+	// Amplification - upstream requests per client request (see amplification.go)
+	AmplificationLogThreshold int `yaml:"amplification_log_threshold"` // Log requests that made at least this many upstream requests (0 = only with -debug)
+
+	// Audit log - who queried what, for compliance (see audit.go)
+	AuditLog     string `yaml:"audit_log"`     // File every request is appended to as a JSON line ("" = off)
+	AuditWebhook string `yaml:"audit_webhook"` // URL the same records are POSTed to in batches ("" = off)
+
+	// Authorization hook - your own per-request policy (see authz.go)
+	AuthorizationPlugin  string        `yaml:"authorization_plugin"`  // Go plugin (.so) exporting an Authorizer ("" = off)
+	AuthorizationWebhook string        `yaml:"authorization_webhook"` // URL asked, as JSON, about every request and query ("" = off)
+	AuthorizationTimeout time.Duration `yaml:"authorization_timeout"` // Longest the webhook may take to answer; no answer is a 503
+
+	// Diagnostics - profiles and a state dump for troubleshooting (see diagnostics.go)
+	DebugEndpoints bool `yaml:"debug_endpoints"` // Serve /-/debug/pprof/ and /-/debug/state, behind listen_auth like everything else
+
+	// Stale failover - serve the last good answer when an upstream is down (see stale.go)
+	StaleOnError      bool          `yaml:"stale_on_error"`      // Fall back to cached windows when a fetch fails outright
+	StaleMaxAge       time.Duration `yaml:"stale_max_age"`       // Oldest cached window we'll still serve (0 = any age)
+	StaleCacheEntries int           `yaml:"stale_cache_entries"` // Windows remembered, most recent first
+
+	// Failed windows - fail the whole query instead of warning (see failures.go)
+	StrictWindows bool `yaml:"strict_windows"` // chrono_strict=true|false overrides it per request
+
+	// Compression - gzip responses for clients that take it (see compression.go)
+	Compression         string `yaml:"compression"`           // "gzip" or "off"
+	CompressionMinBytes int    `yaml:"compression_min_bytes"` // Smaller responses go back as they are
+	CompressionLevel    int    `yaml:"compression_level"`     // 1 (fastest) to 9 (smallest), 0 = gzip's default
+
+	// Templating - default values for $variables (see templating.go)
+	TemplateVariables map[string]string `yaml:"template_variables"` // Used when a template request doesn't send var-<name>
+
+	// Retries - try a window again after a 5xx or a dropped connection (see retry.go)
+	FetchRetries    int           `yaml:"fetch_retries"`     // Extra tries per window fetch (0 = never retry)
+	RetryBackoff    time.Duration `yaml:"retry_backoff"`     // Wait before the first retry, doubling after each
+	RetryMaxBackoff time.Duration `yaml:"retry_max_backoff"` // Longest wait between tries
+	RetryDeadline   time.Duration `yaml:"retry_deadline"`    // No retry starts this long after the query did
+
+	// Warm starts - caches and counters that survive a restart (see state.go)
+	StateDir          string        `yaml:"state_dir"`           // Where state.json lives ("" = don't persist anything)
+	StateSaveInterval time.Duration `yaml:"state_save_interval"` // How often state is saved while running
+
+	// Capability probing - work out each upstream's flavour and adapt to it (see capabilities.go)
+	ProbeUpstreams bool          `yaml:"probe_upstreams"` // Probe each upstream on first contact
+	ProbeInterval  time.Duration `yaml:"probe_interval"`  // How long probe results are trusted (0 = forever)
+
+	// Shutdown - how long SIGTERM waits for in-flight queries and jobs (see shutdown.go)
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+
+	// Chaos mode - make upstream fetches misbehave on purpose, for resilience drills only (see chaos.go)
+	Chaos                bool          `yaml:"chaos"`                  // Allow fault injection at all (and its admin endpoint)
+	ChaosLatency         time.Duration `yaml:"chaos_latency"`          // Delay added to a delayed fetch
+	ChaosLatencyPercent  float64       `yaml:"chaos_latency_percent"`  // Share of fetches delayed (0-100)
+	ChaosErrorPercent    float64       `yaml:"chaos_error_percent"`    // Share of fetches failed outright (0-100)
+	ChaosTruncatePercent float64       `yaml:"chaos_truncate_percent"` // Share of fetches whose body is cut off halfway (0-100)
+
+	// Counters - rate counter metrics before averaging them (see counters.go)
+	CounterTransform string        `yaml:"counter_transform"` // "", "off", "rate" or "irate"; chrono_counter overrides it per query
+	CounterRange     time.Duration `yaml:"counter_range"`     // The [range] the rate is taken over
+	MetricTypes      bool          `yaml:"metric_types"`      // Look metrics up in /api/v1/metadata and fit synthetics to their type (see metrictypes.go)
+
+	// Upstreams - named Prometheus servers, reachable as /<name>/api/v1/...
+	Upstreams          []UpstreamConfig     `yaml:"upstreams"`
+	RestrictUpstreams  bool                 `yaml:"restrict_upstreams"`   // Only allow registered names, reject /host_port/ prefixes
+	UpstreamTLS        UpstreamTLSConfig    `yaml:"upstream_tls"`         // TLS settings for /https+host_port/ style upstreams
+	UpstreamAuth       UpstreamAuthConfig   `yaml:"upstream_auth"`        // Retired: Validate refuses it, credentials go in each upstream's auth block (see auth.go)
+	KubernetesSD       []KubernetesSDConfig `yaml:"kubernetes_sd"`        // Discover upstreams from the Kubernetes API (see kubernetes.go)
+	DNSRefreshInterval time.Duration        `yaml:"dns_refresh_interval"` // How often dnssrv+ upstreams are re-resolved (see dnssrv.go)
 }
 
 // Default configuration values
 // These are like the factory settings - good for most people, but you can change them!
 var DefaultConfig = Config{
+	Listen:     "0.0.0.0:8080",
+	PluginPath: "./plugins",
+
 	MaxIdleConns:        100,
 	MaxIdleConnsPerHost: 100,
 	IdleConnTimeout:     90 * time.Second,
 	ClientTimeout:       30 * time.Second,
 	DialTimeout:         5 * time.Second,
-	KeepAlive:          30 * time.Second,
+	KeepAlive:           30 * time.Second,
 	DisableCompression:  false,
 	ForceAttemptHTTP2:   true,
+	JobTimeout:          10 * time.Minute,
+	JobResultTTL:        15 * time.Minute,
+	MaxRunningJobs:      10,
+
+	AdaptiveTimeout:    true,
+	MinUpstreamTimeout: 5 * time.Second,
+	MaxUpstreamTimeout: 2 * time.Minute,
+	TimeoutPerRangeDay: 2 * time.Second,
+	TimeoutPer1kPoints: time.Second,
+
+	InteractiveConcurrency: 64,
+	BatchConcurrency:       4,
+	PriorityHeader:         "X-Chrono-Priority",
+	APIKeyHeader:           "X-Api-Key",
+	QueueWait:              2 * time.Second,
+	RetryAfter:             5 * time.Second,
+
+	CoalesceFetches: true,
+
+	TenantHeader: "X-Scope-OrgID",
+
+	BandStddevs:      2,
+	MaxCustomWindows: 10,
+
+	MaxDashboardSeries: 500,
+
+	TracingServiceName: "chronotheus",
+	TracingSampleRatio: 1,
+
+	StaleMaxAge:       time.Hour,
+	StaleCacheEntries: 1000,
+
+	Compression:         compressionGzip,
+	CompressionMinBytes: 1024,
+
+	RetryBackoff:    100 * time.Millisecond,
+	RetryMaxBackoff: 2 * time.Second,
+	RetryDeadline:   10 * time.Second,
+
+	StateSaveInterval: time.Minute,
+
+	ProbeInterval: time.Hour,
+
+	DrainTimeout: 10 * time.Second,
+
+	AuthorizationTimeout: 2 * time.Second,
+
+	CounterRange: 5 * time.Minute,
+
+	DNSRefreshInterval: 30 * time.Second,
 }
 
 // Metrics for monitoring proxy performance
 // These are our dashboard gauges - they tell us how well our time machine is running!
 type ProxyMetrics struct {
-	RequestCount      uint64    // Number of requests processed (our odometer!)
-	ErrorCount        uint64    // Number of errors encountered (oops counter!)
-	LastRequestTime   time.Time // When was our last adventure?
+	RequestCount     uint64    // Number of requests processed (our odometer!)
+	ErrorCount       uint64    // Number of errors encountered (oops counter!)
+	LastRequestTime  time.Time // When was our last adventure?
 	AverageLatency   float64   // How long requests typically take (are we getting slower?)
 	RequestsInFlight int64     // Current number of active requests (how busy are we?)
+
+	// The full distributions, for capacity planning - filled in by GetMetrics
+	RequestDurations []HistogramSnapshot // Request duration per endpoint
+	WindowFetches    []HistogramSnapshot // Fetch+decode time per timeframe window
+	WindowBytes      []HistogramSnapshot // Upstream response bytes per timeframe window
+	WindowSeries     []HistogramSnapshot // Series fetched per timeframe window
 }
 
-// ChronoProxy is our time-traveling traffic director! 
+// ChronoProxy is our time-traveling traffic director!
 // Think of it like a magical switchboard operator who can:
 // - Talk to Prometheus servers (client)
 // - Remember different time windows (timeframes)
@@ -70,19 +303,157 @@ type ProxyMetrics struct {
 //
 // It's the brain behind all our time-window magic!
 type ChronoProxy struct {
-	offsets    []int64       // How many seconds to look back (0 = now, 604800 = 7 days, etc)
-	timeframes []string      // Human-friendly names ("current", "7days", etc)
-	client     *http.Client  // Our phone line to Prometheus
-	config     Config        // Configuration options
-	metrics    ProxyMetrics  // Runtime metrics
-	metricsMux sync.RWMutex  // Protects metrics access
+	offsets    []int64           // How many seconds to look back (0 = now, 604800 = 7 days, etc)
+	timeframes []string          // Human-friendly names ("current", "7days", etc)
+	client     *http.Client      // Our phone line to Prometheus
+	tlsClient  *http.Client      // Phone line for /https+host_port/ upstreams when upstream_tls is set
+	config     Config            // Configuration options
+	metrics    ProxyMetrics      // Runtime metrics
+	metricsMux sync.RWMutex      // Protects metrics access
+	jobs       *jobStore         // Background queries waiting to be collected
+	caps       *capabilityCache  // What each upstream turned out to be (see capabilities.go)
+	scheduler  *scheduler        // Concurrency pools per priority class
+	quotas     *quotaManager     // Per tenant/API key budgets
+	tenants    *tenantSet        // Who a request is for (see tenants.go)
+	upstreams  *upstreamRegistry // Named upstreams from the config file
+	chaos      *chaos            // Fault injection, nil = off (see chaos.go)
+	disabled   *disabledWindows  // Past windows switched off at runtime (see disabled.go)
+	mtypes     *metricTypes      // Which metrics are counters, per upstream (see counters.go)
+
+	upstreamPhases    *histogramVec     // DNS/connect/TLS/TTFB timings per upstream host
+	windowFetches     *histogramVec     // Fetch+decode time per timeframe window
+	windowBytes       *histogramVec     // Upstream response bytes per timeframe window
+	windowSeries      *histogramVec     // Series fetched per timeframe window
+	requestDurations  *histogramVec     // Request duration per endpoint
+	upstreamErrors    *counterVec       // Failed upstream fetches per host and kind
+	cacheLookups      *counterVec       // Cache hits and misses per cache
+	pluginRuns        *histogramVec     // Time spent inside each plugin
+	pluginErrors      *counterVec       // Plugin runs that returned an error
+	rejections        *counterVec       // 429s per reason
+	timeframeRequests *counterVec       // Queries per requested chrono_timeframe (see usage.go)
+	amplification     *histogramVec     // Upstream requests per client request (see amplification.go)
+	responseLimits    *counterVec       // Queries stopped by a response limit, per limit (see limits.go)
+	stale             *staleCache       // Last good answer per window, nil = stale_on_error off
+	mirrorSlots       chan struct{}     // Mirror replays in flight (see mirror.go)
+	mirrorComparisons *counterVec       // Mirror outcomes per upstream
+	mirrorDeltas      *mirrorLog        // Recent mirror mismatches for /api/v1/chrono/admin/mirror
+	dashboards        *dashboardMetrics // Per-dashboard request accounting
+	plugins           *plugin.Manager   // Runs {_plugin="..."} post-processing, nil = no plugins
+	aggregations      []aggregation     // Extra synthetics added to plain queries (see aggregations.go)
+	bands             []aggregation     // bandUpper and bandLower, band_stddevs wide
+	noSynth           []noSynthRule     // Metrics synthetics are never built for (see nosynthetics.go)
+	transforms        []valueTransform  // What past samples go through first, per metric (see transforms.go)
+	clock             Clock             // What time is it? (see clock.go)
+	location          *time.Location    // Zone whole-day windows follow, nil = plain seconds (see timezone.go)
+	tracer            *tracer           // Span exporter, nil = tracing off (see tracing.go)
+	audit             *auditor          // Audit log writer, nil = auditing off (see audit.go)
+	clientLimit       *rateLimiter      // Per client IP request rate, nil = unlimited (see ratelimit.go)
+	globalLimit       *rateLimiter      // Overall request rate, nil = unlimited
+	trustedProxies    []*net.IPNet      // Where X-Forwarded-* is believed from (see trustedproxies.go)
+	upstreamSlots     chan struct{}     // Window fetches in flight, nil = unlimited
+	coalescer         *coalescer        // Identical window fetches in flight, nil = coalesce_fetches off (see coalesce.go)
+	inflight          *inflightRequests // Requests being answered, nil = debug_endpoints off (see diagnostics.go)
+	authorizer        authorizerSlot    // Asked about every request and query, empty = everything goes (see authz.go)
+	authzDecisions    *counterVec       // Authorizer answers: allow, deny or error
+}
+
+// window is one slice of history: the name that ends up in the
+// chrono_timeframe label and how many seconds back in time it sits. With a
+// timezone set, whole-day windows follow the calendar instead (see
+// timezone.go) - use back and forward rather than offset to move in time.
+type window struct {
+	name      string
+	offset    int64
+	loc       *time.Location // nil = plain seconds
+	viaOffset bool           // fetched with offset modifiers, not a shifted time (see offsetmode.go)
+}
+
+// windows pairs up our timeframes with their offsets, ready for fetching.
+func (p *ChronoProxy) windows() []window {
+	out := make([]window, len(p.offsets))
+	for i, offset := range p.offsets {
+		out[i] = window{name: p.timeframes[i], offset: offset, loc: p.location}
+	}
+	return out
 }
 
 // NewChronoProxyWithConfig creates a new proxy with custom configuration
 // It's like building a custom time machine to your exact specifications!
 // Want more connections? Different timeouts? This is your friend!
 func NewChronoProxyWithConfig(config Config) *ChronoProxy {
-	return &ChronoProxy{
+	return NewChronoProxyWithPlugins(config, nil)
+}
+
+// NewChronoProxyWithPlugins is NewChronoProxyWithConfig plus the plugin
+// manager that serves {_plugin="..."} requests. A nil manager means no
+// plugins - queries asking for one just get the unprocessed series.
+func NewChronoProxyWithPlugins(config Config, plugins *plugin.Manager) *ChronoProxy {
+	upstreams := newUpstreamRegistry()
+	for _, uc := range config.Upstreams {
+		if len(uc.Members) > 0 {
+			continue // after the upstreams they're made of
+		}
+		u, err := newUpstream(uc)
+		if err == nil {
+			u.client, err = newTLSClient(config, uc.TLS)
+		}
+		if err == nil && uc.Mirror != nil {
+			u.mirror, err = newMirror(config, uc.Name, *uc.Mirror)
+		}
+		if err != nil {
+			log.Printf("Skipping upstream %q: %v", uc.Name, err)
+			continue
+		}
+		upstreams.set(u)
+	}
+	for _, uc := range config.Upstreams {
+		if len(uc.Members) == 0 {
+			continue
+		}
+		u, err := newVirtualUpstream(uc, upstreams)
+		if err != nil {
+			log.Printf("Skipping upstream %q: %v", uc.Name, err)
+			continue
+		}
+		upstreams.set(u)
+	}
+
+	aggregations, err := aggregationsByKey(config.SyntheticAggregations, config.BandStddevs)
+	if err != nil {
+		log.Printf("Ignoring synthetic_aggregations: %v", err)
+	}
+
+	noSynth, err := compileNoSynthetics(config.NoSynthetics)
+	if err != nil {
+		log.Printf("Ignoring no_synthetics: %v", err)
+	}
+
+	transforms, err := compileValueTransforms(config.ValueTransforms)
+	if err != nil {
+		log.Printf("Ignoring value_transforms: %v", err)
+	}
+
+	tlsClient, err := newTLSClient(config, config.UpstreamTLS)
+	if err != nil {
+		log.Printf("Ignoring upstream_tls: %v", err)
+	}
+
+	location, err := loadTimezone(config.Timezone)
+	if err != nil {
+		log.Printf("Ignoring timezone: %v", err)
+	}
+
+	trusted, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		log.Printf("Ignoring %v", err)
+	}
+
+	audit, err := newAuditor(config)
+	if err != nil {
+		log.Printf("Ignoring %v", err)
+	}
+
+	p := &ChronoProxy{
 		offsets: []int64{
 			0,
 			7 * 24 * 3600,
@@ -91,22 +462,62 @@ func NewChronoProxyWithConfig(config Config) *ChronoProxy {
 			28 * 24 * 3600,
 		},
 		timeframes: []string{"current", "7days", "14days", "21days", "28days"},
-		client: &http.Client{
-			Timeout: config.ClientTimeout,
-			Transport: &http.Transport{
-				MaxIdleConns:        config.MaxIdleConns,
-				MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
-				IdleConnTimeout:     config.IdleConnTimeout,
-				DisableCompression:  config.DisableCompression,
-				ForceAttemptHTTP2:   config.ForceAttemptHTTP2,
-				DialContext: (&net.Dialer{
-					Timeout:   config.DialTimeout,
-					KeepAlive: config.KeepAlive,
-				}).DialContext,
-			},
-		},
-		config: config,
+		client:     newHTTPClient(config, nil),
+		tlsClient:  tlsClient,
+		config:     config,
+		jobs:       newJobStore(config.JobResultTTL, config.MaxRunningJobs),
+		caps:       newCapabilityCache(),
+		scheduler:  newScheduler(config),
+		quotas:     newQuotaManager(config),
+		tenants:    newTenantSet(config),
+		upstreams:  upstreams,
+		chaos:      newChaos(config),
+		disabled:   newDisabledWindows(),
+		mtypes:     newMetricTypes(),
+
+		upstreamPhases: newHistogramVec(latencyBuckets, "upstream", "phase"),
+		windowFetches:  newHistogramVec(latencyBuckets, "timeframe"),
+		windowBytes:    newHistogramVec(sizeBuckets, "timeframe"),
+		windowSeries:   newHistogramVec(seriesBuckets, "timeframe"),
+		upstreamErrors: newCounterVec("upstream", "kind"),
+		cacheLookups:   newCounterVec("cache", "result"),
+		pluginRuns:     newHistogramVec(latencyBuckets, "plugin"),
+		pluginErrors:   newCounterVec("plugin"),
+		rejections:     newCounterVec("reason"),
+
+		timeframeRequests: newCounterVec("timeframe"),
+		amplification:     newHistogramVec(amplificationBuckets, "endpoint"),
+		responseLimits:    newCounterVec("limit"),
+		requestDurations:  newHistogramVec(latencyBuckets, "endpoint"),
+		stale:             newStaleCache(config),
+		coalescer:         newCoalescer(config),
+		inflight:          newInflightRequests(config),
+		authzDecisions:    newCounterVec("decision"),
+
+		mirrorSlots:       make(chan struct{}, mirrorConcurrency),
+		mirrorComparisons: newCounterVec("upstream", "result"),
+		mirrorDeltas:      &mirrorLog{},
+		dashboards:        newDashboardMetrics(config.MaxDashboardSeries),
+
+		plugins:      plugins,
+		aggregations: aggregations,
+		noSynth:      noSynth,
+		transforms:   transforms,
+		bands:        bandAggregations(config.BandStddevs),
+		clock:        SystemClock{},
+		location:     location,
+		tracer:       newTracer(config),
+		audit:        audit,
+		clientLimit:  newRateLimiter(config.RateLimitPerClient, config.RateLimitBurst),
+		globalLimit:  newRateLimiter(config.RateLimitGlobal, config.RateLimitBurst),
+
+		trustedProxies: trusted,
+	}
+	if config.MaxUpstreamInFlight > 0 {
+		p.upstreamSlots = make(chan struct{}, config.MaxUpstreamInFlight)
 	}
+	p.authorizer.set(newAuthorizer(config))
+	return p
 }
 
 // NewChronoProxy creates a new proxy with default configuration
@@ -117,56 +528,176 @@ func NewChronoProxy() *ChronoProxy {
 var (
 	// Pre-compiled regex patterns
 	// These are like our universal translators - they help us understand incoming requests!
-	pathRegex     = regexp.MustCompile(`^/([^_/]+)_(\d+)(/.*)?$`)
+	pathRegex = regexp.MustCompile(`^/([^_/]+)_(\d+)(/.*)?$`)
 	// Looking for label values? This pattern spots those requests!
-	valuesRegex   = regexp.MustCompile(`^/api/v1/label/[^/]+/values$`)
+	valuesRegex = regexp.MustCompile(`^/api/v1/label/[^/]+/values$`)
 	// Need to split a path? This is our path-chopping tool!
-	pathSplitter  = regexp.MustCompile(`/`)
+	pathSplitter = regexp.MustCompile(`/`)
 )
 
-// ServeHTTP is Herr Traffik Direktor! 
+// ServeHTTP is Herr Traffik Direktor!
 // It looks at incoming requests and sends them to the right handler:
-// - /api/v1/query:        Want a snapshot? This way! 
-// - /api/v1/query_range:  Need a graph? Over here! 
-// - /api/v1/labels:       Looking for label options? Follow me! 
-// - /api/v1/label/.../values: Need specific values? Got you covered! 
-// - anything else:        Just passing through! 
+// - /api/v1/query:        Want a snapshot? This way!
+// - /api/v1/query_range:  Need a graph? Over here!
+// - /api/v1/labels:       Looking for label options? Follow me!
+// - /api/v1/label/.../values: Need specific values? Got you covered!
+// - /api/v1/metadata, /api/v1/targets/metadata: Descriptions, plus ours!
+// - /api/v1/status/tsdb, /flags, /runtimeinfo: Upstream's health, plus ours!
+// - /api/v1/chrono/jobs:  Too big to wait for? Take a ticket!
+// - /api/v1/chrono/timeframes: What's on the menu?
+// - /api/v1/chrono/admin/...: Peek behind the curtain (no upstream prefix)
+// - /api/v1/rules, /api/v1/alerts: Everybody's alerts at once (no upstream prefix)
+// - /metrics:             Our own vital signs, for Prometheus to scrape
+// - anything else:        Just passing through!
 //
 // Think of it like a helpful concierge who knows exactly where everything is!
 // Each request gets the VIP treatment - routed to exactly where it needs to go.
 //
 // Pro tip: Watch the debug logs to see it in action - it's quite chatty!
 func (p *ChronoProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+	start := p.clock.Now()
 	var err error
 
 	// Track requests in flight
 	atomic.AddInt64(&p.metrics.RequestsInFlight, 1)
 	defer atomic.AddInt64(&p.metrics.RequestsInFlight, -1)
-	
+
+	w, finish := p.compressWriter(w, r)
+	defer finish()
+
 	defer func() {
 		p.updateMetrics(start, err)
 	}()
 
-	m := pathRegex.FindStringSubmatch(r.URL.Path)
-	if m == nil {
-		err = fmt.Errorf("invalid target prefix")
+	identity, ok := p.authenticate(r)
+	if !ok {
+		p.writeUnauthorized(w)
+		return
+	}
+	authorization := r.Header.Get("Authorization")
+	if identity != "" && !strings.HasPrefix(identity, "cert:") {
+		r.Header = r.Header.Clone()
+		r.Header.Del("Authorization") // ours, not the upstream's (see listenauth.go)
+	}
+	r = r.WithContext(withClientAuthorization(withIdentity(r.Context(), identity), authorization))
+	defer p.trackInflight(r, identity)()
+	w, r, audited := p.startAudit(w, r, identity)
+	defer audited()
+	if err := p.authorizeRequest(r); err != nil {
+		p.writeEvalError(w, err)
+		return
+	}
+	if isOwnPath(r.URL.Path) {
+		if err := p.checkAdminIdentity(identity); err != nil {
+			p.writeEvalError(w, err)
+			return
+		}
+	}
+
+	if strings.HasPrefix(r.URL.Path, chronoAdminPrefix) {
+		p.handleChronoAdmin(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/"+adminPrefix+"/") {
+		p.handleLegacyAdmin(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, debugPathPrefix) {
+		p.handleDebug(w, r)
+		return
+	}
+	if r.URL.Path == metricsPath {
+		p.handleMetrics(w, r)
+		return
+	}
+
+	ctx, sp := p.startRequestSpan(r)
+	defer sp.finish()
+	r = r.WithContext(ctx)
+	if identity != "" {
+		sp.set("enduser.id", identity)
+	}
+
+	if t, path, err := p.tenants.forRequest(r); err != nil {
+		writeJSONError(w, http.StatusForbidden, "bad_data", err.Error())
+		return
+	} else if t != nil {
+		sp.set("chrono.tenant", t.config.Name)
+		auditFrom(r.Context()).set(func(rec *auditRecord) { rec.Tenant = t.config.Name })
+		r = r.WithContext(withTenant(r.Context(), t))
+		u := *r.URL
+		u.Path, u.RawPath = path, ""
+		r.URL = &u
+	}
+
+	if err := p.checkRateLimits(r); err != nil {
+		p.writeEvalError(w, err)
+		return
+	}
+
+	if dash := dashboardFromHeaders(r); dash != nil {
+		cw := &countingWriter{ResponseWriter: w}
+		w = cw
+		r = r.WithContext(withDashboard(r.Context(), dash))
+		defer func() {
+			p.dashboards.observe(dash, p.since(start).Seconds(), cw.n)
+		}()
+	}
+
+	if r.URL.Path == rulesPath || r.URL.Path == alertsPath {
+		p.handleAggregatedRules(w, r)
+		return
+	}
+
+	target, suffix, err := p.resolveUpstream(r.URL.Path)
+	if err != nil {
+		if _, unknown := err.(errUnknownUpstream); unknown {
+			writeJSONError(w, http.StatusForbidden, "bad_data", err.Error())
+			return
+		}
 		http.Error(w, `{"status":"error","error":"Invalid target prefix"}`, http.StatusBadRequest)
 		return
 	}
+	if t := tenantFrom(r.Context()); !t.allowsUpstream(target.name) {
+		writeJSONError(w, http.StatusForbidden, "bad_data", fmt.Sprintf("tenant %q can't use upstream %q", t.config.Name, target.name))
+		return
+	}
+	upstream, err := target.target(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "unavailable", err.Error())
+		return
+	}
+	sp.set("chrono.upstream", target.name)
+	auditFrom(r.Context()).set(func(rec *auditRecord) { rec.Upstream = target.name })
+	r = r.WithContext(withUpstream(r.Context(), target))
+	fanout := &amplification{}
+	r = r.WithContext(withAmplification(r.Context(), fanout))
+	defer p.recordAmplification(r, sp, target.name, suffix, fanout)
+	defer func() {
+		p.requestDurations.observe(p.since(start).Seconds(), endpointLabel(suffix))
+	}()
+	if caps := p.capabilitiesFor(r.Context(), target.name, upstream); caps != nil {
+		r = r.WithContext(withCapabilities(r.Context(), caps))
+	}
+	if q := p.quotas.forRequest(r); q != nil {
+		r = r.WithContext(withQuota(r.Context(), q))
+	}
+	if target.mirror.sample() {
+		r = r.WithContext(withMirror(r.Context(), &mirrorRun{primary: target.name, from: upstream, m: target.mirror}))
+	}
 
-	host, port, suffix := m[1], m[2], m[3]
-	if suffix == "" {
-		suffix = "/"
+	// Everything of ours lives under /api/v1/chrono/ and never goes upstream
+	if isChronoPath(suffix) {
+		p.handleChronoAPI(w, r, upstream, suffix)
+		return
 	}
-	upstream := fmt.Sprintf("http://%s:%s", host, port)
 
 	// Fast path for GET/POST methods
 	if r.Method != "GET" && r.Method != "POST" {
-		if DebugMode {
+		if DebugMode.Load() {
 			log.Printf("Unsupported method %s, forwarding to upstream", r.Method)
 		}
-		forward(w, r, p.client, upstream+suffix)
+		forward(w, r, p.clientFor(r.Context()), upstream+suffix)
 		return
 	}
 
@@ -181,6 +712,18 @@ func (p *ChronoProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/api/v1/labels":
 		p.handleLabels(w, r, upstream, suffix)
 		return
+	case metadataPath, targetsMetadataPath:
+		p.handleMetadata(w, r, upstream, suffix)
+		return
+	case exemplarsPath:
+		p.handleExemplars(w, r, upstream, suffix)
+		return
+	case tsdbStatusPath, flagsStatusPath, runtimeStatusPath:
+		p.handleStatus(w, r, upstream, suffix)
+		return
+	case remoteReadPath:
+		p.handleRemoteRead(w, r, upstream, suffix)
+		return
 	}
 
 	// Check for label values endpoint
@@ -192,10 +735,10 @@ func (p *ChronoProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if DebugMode {
+	if DebugMode.Load() {
 		log.Printf("Forwarding Unknown request: %s %s\n", r.Method, r.URL.Path)
 	}
-	forward(w, r, p.client, upstream+suffix)
+	forward(w, r, p.clientFor(r.Context()), upstream+suffix)
 }
 
 // GetMetrics returns current proxy metrics
@@ -203,8 +746,13 @@ func (p *ChronoProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // This function is like checking the gauges on your dashboard!
 func (p *ChronoProxy) GetMetrics() ProxyMetrics {
 	p.metricsMux.RLock()
-	defer p.metricsMux.RUnlock()
-	return p.metrics
+	m := p.metrics
+	p.metricsMux.RUnlock()
+	m.RequestDurations = p.requestDurations.snapshot()
+	m.WindowFetches = p.windowFetches.snapshot()
+	m.WindowBytes = p.windowBytes.snapshot()
+	m.WindowSeries = p.windowSeries.snapshot()
+	return m
 }
 
 // updateMetrics updates proxy metrics for monitoring
@@ -213,15 +761,15 @@ func (p *ChronoProxy) GetMetrics() ProxyMetrics {
 func (p *ChronoProxy) updateMetrics(start time.Time, err error) {
 	p.metricsMux.Lock()
 	defer p.metricsMux.Unlock()
-	
+
 	p.metrics.RequestCount++
-	p.metrics.LastRequestTime = time.Now()
-	
+	p.metrics.LastRequestTime = p.clock.Now()
+
 	if err != nil {
 		p.metrics.ErrorCount++
 	}
-	
-	latency := time.Since(start).Seconds()
+
+	latency := p.since(start).Seconds()
 	if p.metrics.RequestCount == 1 {
 		p.metrics.AverageLatency = latency
 	} else {
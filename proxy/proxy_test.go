@@ -91,7 +91,7 @@ func TestServeHTTP(t *testing.T) {
     for _, tt := range tests {
         t.Run(tt.name, func(t *testing.T) {
             // Setup
-            DebugMode = tt.debugMode
+            DebugMode.Store(tt.debugMode)
             p := NewChronoProxy()
             
             // Create test request
@@ -0,0 +1,292 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/quota.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Quotas - sharing is caring, but one team's 90-day heatmap shouldn't eat
+// everybody's upstream.
+//
+// Each quota names a group of tenants (the tenant_header, X-Scope-OrgID by
+// default) and/or API keys (the api_key_header), and caps how many chrono
+// queries they may run and how many samples they may get back, per hour
+// and per day:
+//
+//   quotas:
+//     - name: team-payments
+//       tenants: [payments]
+//       api_keys: [s3cr3t]
+//       queries_per_hour: 2000
+//       samples_per_day: 500000000
+//
+// Hours and days are clock hours and UTC days - usage resets on the hour
+// and at midnight rather than sliding, so "when can I go again?" has a
+// simple answer. A query is admitted as long as the group is under all its
+// limits; the samples it returns are counted afterwards, so the query that
+// crosses a sample limit still gets its answer and the next one is turned
+// away. Over-quota requests get a 429 with reason "quota_exceeded", a
+// message saying which limit was hit, and a Retry-After of when it resets.
+//
+// Requests matching no quota aren't limited. Usage lives in memory, so a
+// restart starts everybody afresh. GET /api/v1/chrono/admin/quotas shows
+// where each group stands (by name - keys never leave the config file).
+
+// QuotaConfig is one group's limits. A limit of 0 means "no limit".
+type QuotaConfig struct {
+	Name           string   `yaml:"name"`
+	Tenants        []string `yaml:"tenants,omitempty"`  // Values of tenant_header this quota covers
+	APIKeys        []string `yaml:"api_keys,omitempty"` // Values of api_key_header this quota covers
+	QueriesPerHour int64    `yaml:"queries_per_hour,omitempty"`
+	QueriesPerDay  int64    `yaml:"queries_per_day,omitempty"`
+	SamplesPerHour int64    `yaml:"samples_per_hour,omitempty"`
+	SamplesPerDay  int64    `yaml:"samples_per_day,omitempty"`
+}
+
+// validateQuotas checks names are set and unique, and that no tenant or key
+// belongs to two quotas - which one would it count against?
+func validateQuotas(quotas []QuotaConfig) error {
+	names := make(map[string]bool)
+	tenants := make(map[string]string)
+	keys := make(map[string]string)
+	for i, q := range quotas {
+		if q.Name == "" {
+			return fmt.Errorf("quotas[%d]: name is required", i)
+		}
+		if names[q.Name] {
+			return fmt.Errorf("quotas[%d]: duplicate name %q", i, q.Name)
+		}
+		names[q.Name] = true
+		if len(q.Tenants) == 0 && len(q.APIKeys) == 0 {
+			return fmt.Errorf("quota %q: needs at least one tenant or api key", q.Name)
+		}
+		if q.QueriesPerHour < 0 || q.QueriesPerDay < 0 || q.SamplesPerHour < 0 || q.SamplesPerDay < 0 {
+			return fmt.Errorf("quota %q: limits can't be negative", q.Name)
+		}
+		for _, t := range q.Tenants {
+			if other, dup := tenants[t]; dup {
+				return fmt.Errorf("quota %q: tenant %q is already in quota %q", q.Name, t, other)
+			}
+			tenants[t] = q.Name
+		}
+		for _, k := range q.APIKeys {
+			if other, dup := keys[k]; dup {
+				return fmt.Errorf("quota %q: an api key is already in quota %q", q.Name, other)
+			}
+			keys[k] = q.Name
+		}
+	}
+	return nil
+}
+
+// quota is one group's limits plus what it has used so far.
+type quota struct {
+	config QuotaConfig
+
+	mu          sync.Mutex
+	hour, day   time.Time // Start of the current windows
+	queriesHour int64
+	queriesDay  int64
+	samplesHour int64
+	samplesDay  int64
+}
+
+// roll starts new windows when the hour or day has moved on.
+// Callers hold q.mu.
+func (q *quota) roll(now time.Time) {
+	now = now.UTC()
+	if hour := now.Truncate(time.Hour); !hour.Equal(q.hour) {
+		q.hour, q.queriesHour, q.samplesHour = hour, 0, 0
+	}
+	if day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC); !day.Equal(q.day) {
+		q.day, q.queriesDay, q.samplesDay = day, 0, 0
+	}
+}
+
+// admit counts one query, or explains why it can't run.
+func (q *quota) admit(now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(now)
+
+	limits := []struct {
+		used, limit int64
+		what        string
+		resets      time.Time
+	}{
+		{q.queriesHour, q.config.QueriesPerHour, "queries per hour", q.hour.Add(time.Hour)},
+		{q.samplesHour, q.config.SamplesPerHour, "samples per hour", q.hour.Add(time.Hour)},
+		{q.queriesDay, q.config.QueriesPerDay, "queries per day", q.day.AddDate(0, 0, 1)},
+		{q.samplesDay, q.config.SamplesPerDay, "samples per day", q.day.AddDate(0, 0, 1)},
+	}
+	for _, l := range limits {
+		if l.limit > 0 && l.used >= l.limit {
+			wait := l.resets.Sub(now)
+			return &saturatedError{
+				reason: reasonQuotaExceeded,
+				msg: fmt.Sprintf("quota %q exceeded: %d of %d %s used, resets in %s",
+					q.config.Name, l.used, l.limit, l.what, wait.Round(time.Second)),
+				retryAfter: wait,
+			}
+		}
+	}
+	q.queriesHour++
+	q.queriesDay++
+	return nil
+}
+
+// addSamples counts samples handed back to the group.
+func (q *quota) addSamples(n int64, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(now)
+	q.samplesHour += n
+	q.samplesDay += n
+}
+
+// quotaWindowUsage is one window's worth of /api/v1/chrono/admin/quotas.
+type quotaWindowUsage struct {
+	Queries     int64     `json:"queries"`
+	QueryLimit  int64     `json:"query_limit"`
+	Samples     int64     `json:"samples"`
+	SampleLimit int64     `json:"sample_limit"`
+	ResetsAt    time.Time `json:"resets_at"`
+}
+
+// quotaUsage is one group's line in /api/v1/chrono/admin/quotas.
+type quotaUsage struct {
+	Name string           `json:"name"`
+	Hour quotaWindowUsage `json:"hour"`
+	Day  quotaWindowUsage `json:"day"`
+}
+
+func (q *quota) usage(now time.Time) quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll(now)
+	return quotaUsage{
+		Name: q.config.Name,
+		Hour: quotaWindowUsage{q.queriesHour, q.config.QueriesPerHour, q.samplesHour, q.config.SamplesPerHour, q.hour.Add(time.Hour)},
+		Day:  quotaWindowUsage{q.queriesDay, q.config.QueriesPerDay, q.samplesDay, q.config.SamplesPerDay, q.day.AddDate(0, 0, 1)},
+	}
+}
+
+// quotaManager finds the quota a request counts against.
+type quotaManager struct {
+	byTenant     map[string]*quota
+	byKey        map[string]*quota
+	all          []*quota
+	tenantHeader string
+	apiKeyHeader string
+	now          func() time.Time
+}
+
+func newQuotaManager(config Config) *quotaManager {
+	m := &quotaManager{
+		byTenant:     make(map[string]*quota),
+		byKey:        make(map[string]*quota),
+		tenantHeader: config.TenantHeader,
+		apiKeyHeader: config.APIKeyHeader,
+		now:          time.Now,
+	}
+	for _, qc := range config.Quotas {
+		q := &quota{config: qc}
+		m.all = append(m.all, q)
+		for _, t := range qc.Tenants {
+			m.byTenant[t] = q
+		}
+		for _, k := range qc.APIKeys {
+			m.byKey[k] = q
+		}
+	}
+	return m
+}
+
+// forRequest returns the request's quota, or nil if it has none. The
+// tenant wins if a request carries both, and a tenant named by path prefix
+// counts the same as one named by header (see tenants.go).
+func (m *quotaManager) forRequest(r *http.Request) *quota {
+	if t := tenantFrom(r.Context()); t != nil {
+		if q := m.byTenant[t.config.Name]; q != nil {
+			return q
+		}
+	} else if m.tenantHeader != "" {
+		if q := m.byTenant[r.Header.Get(m.tenantHeader)]; q != nil {
+			return q
+		}
+	}
+	if m.apiKeyHeader != "" {
+		if q := m.byKey[r.Header.Get(m.apiKeyHeader)]; q != nil {
+			return q
+		}
+	}
+	return nil
+}
+
+// snapshot lists every group's usage, sorted by name.
+func (m *quotaManager) snapshot() []quotaUsage {
+	now := m.now()
+	out := make([]quotaUsage, 0, len(m.all))
+	for _, q := range m.all {
+		out = append(out, q.usage(now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+type quotaKey struct{}
+
+// withQuota marks evaluations under ctx as counting against q.
+func withQuota(ctx context.Context, q *quota) context.Context {
+	return context.WithValue(ctx, quotaKey{}, q)
+}
+
+// quotaFrom returns the quota set by withQuota, or nil.
+func quotaFrom(ctx context.Context) *quota {
+	q, _ := ctx.Value(quotaKey{}).(*quota)
+	return q
+}
+
+// handleAdminQuotas shows every quota's usage.
+func (p *ChronoProxy) handleAdminQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data":   p.quotas.snapshot(),
+	})
+}
+
+// countSamples is how many points a response carries.
+func countSamples(series []model.Series) int64 {
+	var n int64
+	for _, s := range series {
+		n += int64(len(s.Points))
+	}
+	return n
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestQuotaLimitsAndResets(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 1700000000, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.Quotas = []QuotaConfig{{Name: "team-a", Tenants: []string{"a"}, APIKeys: []string{"key-a"}, QueriesPerHour: 2}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewChronoProxyWithConfig(config)
+	now := time.Date(2025, 3, 4, 10, 45, 0, 0, time.UTC)
+	p.SetClock(FixedClock(now))
+
+	query := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query=up", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	query("X-Scope-OrgID", "a")
+	query("X-Api-Key", "key-a") // same group, different door
+	w := query("X-Scope-OrgID", "a")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "900" || !strings.Contains(w.Body.String(), `"reason":"quota_exceeded"`) ||
+		!strings.Contains(w.Body.String(), `2 of 2 queries per hour`) {
+		t.Errorf("over quota: %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	if w := query("X-Scope-OrgID", "b"); w.Code != 200 {
+		t.Errorf("unlisted tenant limited: %d %s", w.Code, w.Body)
+	}
+
+	p.SetClock(FixedClock(now.Add(15 * time.Minute)))
+	if w := query("X-Scope-OrgID", "a"); w.Code != 200 {
+		t.Errorf("quota should reset on the hour: %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/admin/quotas", nil))
+	var usage struct{ Data []quotaUsage }
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	if len(usage.Data) != 1 || usage.Data[0].Hour.Queries != 1 || usage.Data[0].Day.Queries != 3 || usage.Data[0].Day.Samples != 3 {
+		t.Errorf("usage = %s", w.Body)
+	}
+	if strings.Contains(w.Body.String(), "key-a") {
+		t.Errorf("api key leaked: %s", w.Body)
+	}
+}
+
+func TestQuotaSampleLimit(t *testing.T) {
+	q := &quota{config: QuotaConfig{Name: "big", SamplesPerDay: 100}}
+	now := time.Date(2025, 3, 4, 23, 0, 0, 0, time.UTC)
+	if err := q.admit(now); err != nil {
+		t.Fatal(err)
+	}
+	q.addSamples(150, now) // the query that crosses the line still gets its answer...
+	if err := q.admit(now); err == nil || !strings.Contains(err.Error(), "samples per day") {
+		t.Errorf("expected samples per day error, got %v", err)
+	}
+	if err := q.admit(now.Add(time.Hour)); err != nil { // ...and midnight forgives
+		t.Errorf("new day: %v", err)
+	}
+}
+
+func TestValidateQuotas(t *testing.T) {
+	for _, quotas := range [][]QuotaConfig{
+		{{Tenants: []string{"a"}}},
+		{{Name: "x"}},
+		{{Name: "x", Tenants: []string{"a"}}, {Name: "y", Tenants: []string{"a"}}},
+		{{Name: "x", APIKeys: []string{"k"}, QueriesPerDay: -1}},
+	} {
+		if err := validateQuotas(quotas); err == nil {
+			t.Errorf("expected %+v to be rejected", quotas)
+		}
+	}
+}
+
+func TestRefusedQueriesCostNoQuota(t *testing.T) {
+	config := DefaultConfig
+	config.Quotas = []QuotaConfig{{Name: "team-a", APIKeys: []string{"key-a"}, QueriesPerHour: 10}}
+	p := NewChronoProxyWithConfig(config)
+	p.SetAuthorizer(authorizerFunc(func(_ context.Context, req AuthorizationRequest) (AuthorizationDecision, error) {
+		return AuthorizationDecision{Allow: req.Kind != "query", Reason: "no queries today"}, nil
+	}))
+
+	for q, want := range map[string]int{
+		"up":                                http.StatusForbidden,  // the hook says no
+		`up{chrono_timeframe="7days"`:       http.StatusBadRequest, // unreadable
+		`up{chrono_window_mode="sideways"}`: http.StatusBadRequest, // a setting we don't have
+	} {
+		r := httptest.NewRequest("GET", "/localhost_1/api/v1/query?time=1700000000&query="+url.QueryEscape(q), nil)
+		r.Header.Set("X-Api-Key", "key-a")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("%q: %d %s, want %d", q, w.Code, w.Body, want)
+		}
+	}
+	if usage := p.quotas.snapshot(); len(usage) != 1 || usage[0].Hour.Queries != 0 || usage[0].Day.Queries != 0 {
+		t.Errorf("refused queries were charged: %+v", usage)
+	}
+}
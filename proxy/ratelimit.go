@@ -0,0 +1,209 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/ratelimit.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limits - one enthusiastic dashboard shouldn't be able to flatten
+// Prometheus for everybody else.
+//
+// Every panel refresh is five upstream queries (one per window), so load
+// multiplies fast. Three knobs, all off by default:
+//
+//   rate_limit_per_client    requests per second from one client IP
+//   rate_limit_global        requests per second from everybody together
+//   max_upstream_in_flight   window fetches talking to upstreams at once
+//
+// The rates are token buckets, rate_limit_burst deep (defaulting to one
+// second's worth), checked when a request arrives - over the limit is a 429
+// with a Retry-After saying when the next token turns up. The in-flight
+// cap waits up to queue_wait for a free slot, like the priority pools, and
+// then gives up with a 503 and Retry-After: it's the upstreams that are
+// busy, not the client being greedy.
+//
+// Behind a load balancer every request comes from the balancer, so set
+// trusted_proxies to the balancers' addresses and clients are keyed on the
+// address they forwarded for (see trustedproxies.go). trust_forwarded_for
+// is the older, blunter tool: the first X-Forwarded-For address, from
+// anyone. Only use it if the balancer overwrites the header - clients can
+// send whatever they like.
+
+// Reasons for rate limit rejections (see backpressure.go).
+const (
+	reasonClientRateLimit = "client_rate_limit" // this client is sending too fast
+	reasonGlobalRateLimit = "global_rate_limit" // everybody together is sending too fast
+	reasonTenantRateLimit = "tenant_rate_limit" // this client's tenant is sending too fast (see tenants.go)
+	reasonUpstreamBusy    = "upstream_busy"     // max_upstream_in_flight fetches already running
+)
+
+// maxRateBuckets is how many clients we track before sweeping out the ones
+// that have been quiet long enough to be back at a full bucket.
+const maxRateBuckets = 10000
+
+// tokenBucket is one client's allowance.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets, one per key.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64 // bucket size
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns nil (no limit) when rate isn't positive.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: b, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from key's bucket. When there isn't one it says how
+// long until there will be. Safe to call on a nil limiter.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxRateBuckets {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that have refilled - they'd start full anyway.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP is who's asking: the connection's address, or the first
+// X-Forwarded-For entry when we've been told to trust it.
+func clientIP(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkRateLimits is the door check for one request: the global bucket and
+// the client's own. Nil means come on in.
+func (p *ChronoProxy) checkRateLimits(r *http.Request) error {
+	now := p.clock.Now()
+	if ok, wait := p.globalLimit.allow("", now); !ok {
+		return &saturatedError{
+			reason:     reasonGlobalRateLimit,
+			msg:        fmt.Sprintf("over the global rate limit of %g requests/s", p.config.RateLimitGlobal),
+			retryAfter: wait,
+		}
+	}
+	ip := p.clientAddress(r)
+	if ok, wait := p.clientLimit.allow(ip, now); !ok {
+		return &saturatedError{
+			reason:     reasonClientRateLimit,
+			msg:        fmt.Sprintf("%s is over the rate limit of %g requests/s", ip, p.config.RateLimitPerClient),
+			retryAfter: wait,
+		}
+	}
+	if t := tenantFrom(r.Context()); t != nil {
+		if ok, wait := t.limit.allow("", now); !ok {
+			return &saturatedError{
+				reason:     reasonTenantRateLimit,
+				msg:        fmt.Sprintf("tenant %q is over its rate limit of %g requests/s", t.config.Name, t.config.RateLimit),
+				retryAfter: wait,
+			}
+		}
+		if ok, wait := t.clientLimit.allow(ip, now); !ok {
+			return &saturatedError{
+				reason:     reasonTenantRateLimit,
+				msg:        fmt.Sprintf("%s is over tenant %q's per-client rate limit of %g requests/s", ip, t.config.Name, t.config.RateLimitPerClient),
+				retryAfter: wait,
+			}
+		}
+	}
+	return nil
+}
+
+// acquireUpstream waits for one of the max_upstream_in_flight slots, for as
+// long as queue_wait allows. The returned func gives the slot back.
+func (p *ChronoProxy) acquireUpstream(ctx context.Context) (func(), error) {
+	if p.upstreamSlots == nil {
+		return func() {}, nil
+	}
+	var expired <-chan time.Time
+	if wait := queueWaitFrom(ctx, p.config.QueueWait); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case p.upstreamSlots <- struct{}{}:
+		return func() { <-p.upstreamSlots }, nil
+	case <-expired:
+		return nil, &saturatedError{
+			reason: reasonUpstreamBusy,
+			msg:    fmt.Sprintf("all %d upstream slots are busy", cap(p.upstreamSlots)),
+			status: http.StatusServiceUnavailable,
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
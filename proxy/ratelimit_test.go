@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	l := newRateLimiter(2, 0) // burst defaults to one second's worth
+	now := time.Unix(1700000000, 0)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d refused inside the burst", i+1)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("third request: ok=%v wait=%v; want refused for 500ms", ok, wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("another client shouldn't share a's bucket")
+	}
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("a token should have turned up after 500ms")
+	}
+	if ok, _ := (*rateLimiter)(nil).allow("a", now); !ok {
+		t.Error("nil limiter should allow everything")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+	if got := clientIP(r, false); got != "10.0.0.1" {
+		t.Errorf("untrusted = %q", got)
+	}
+	if got := clientIP(r, true); got != "203.0.113.7" {
+		t.Errorf("trusted = %q", got)
+	}
+}
+
+func TestClientRateLimitGets429(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.RateLimitPerClient = 0.5
+	p := NewChronoProxyWithConfig(config)
+	p.SetClock(FixedClock(time.Unix(1700000000, 0)))
+	query := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", prefix+`/api/v1/query?query=up{chrono_timeframe="current"}`, nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := query("192.0.2.1:1000"); w.Code != 200 {
+		t.Fatalf("first request: %d %s", w.Code, w.Body.String())
+	}
+	w := query("192.0.2.1:1001")
+	var body struct{ Reason string }
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != 429 || w.Header().Get("Retry-After") != "2" || body.Reason != reasonClientRateLimit {
+		t.Errorf("second request: %d, Retry-After %q, %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+	if w := query("192.0.2.2:1000"); w.Code != 200 {
+		t.Errorf("other client: %d", w.Code)
+	}
+}
+
+func TestUpstreamBusyGets503(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.MaxUpstreamInFlight = 1
+	config.QueueWait = 10 * time.Millisecond
+	p := NewChronoProxyWithConfig(config)
+	p.upstreamSlots <- struct{}{} // somebody else is using it
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?query=up`, nil))
+	var body struct{ Reason string }
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" || body.Reason != reasonUpstreamBusy {
+		t.Errorf("got %d, Retry-After %q, %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+	if n := len(fake.Requests()); n != 0 {
+		t.Errorf("%d requests reached the upstream", n)
+	}
+
+	<-p.upstreamSlots
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?query=up`, nil))
+	if w.Code != 200 || len(p.upstreamSlots) != 0 {
+		t.Errorf("with a free slot: %d, %d slots still held", w.Code, len(p.upstreamSlots))
+	}
+}
@@ -0,0 +1,264 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/reload.go
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Hot reload - new config, same process, nobody's query gets dropped 🔄
+//
+// Send SIGHUP, or POST /-/reload (no upstream prefix, listen_auth applies),
+// and the config is read again - file, CHRONOTHEUS_* environment and flags,
+// exactly as at startup. If it doesn't validate, nothing changes and the
+// error is logged (and returned to the POST as a 400).
+//
+// If it does, a new ChronoProxy is built from it and swapped in. Requests
+// already running finish on the old one; everything after the swap gets the
+// new one. Upstreams, auth, tenants, limits, synthetics, timeouts, caches -
+// anything read from Config - take effect. What the old proxy had learned
+// comes along: counters and histograms, background jobs, probed
+// capabilities, metric types, runtime-disabled windows and discovered
+// upstreams. Quotas, rate limit buckets, concurrency pools, fetches and
+// requests in flight, the stale cache, the tracer, the audit log and the
+// authorization hook come along too as long as their settings didn't
+// change; when they did they start afresh.
+//
+// listen, listen_tls, plugin_path, process_plugins and state_dir are only
+// read at startup. Changing them is logged and otherwise ignored until the
+// next restart.
+
+const reloadPath = "/-/reload"
+
+// Reloader serves through the current ChronoProxy and swaps in a new one
+// when the config is reloaded.
+type Reloader struct {
+	load    func() (Config, error) // Reads the config the way startup did
+	current atomic.Pointer[ChronoProxy]
+
+	mu   sync.Mutex         // One reload at a time
+	ctx  context.Context    // Where background work runs, nil until Run
+	stop context.CancelFunc // Stops the current proxy's background work
+}
+
+// NewReloader serves through p, reading new config with load.
+func NewReloader(p *ChronoProxy, load func() (Config, error)) *Reloader {
+	rl := &Reloader{load: load}
+	rl.current.Store(p)
+	return rl
+}
+
+// Proxy is the ChronoProxy new requests go to.
+func (rl *Reloader) Proxy() *ChronoProxy {
+	return rl.current.Load()
+}
+
+func (rl *Reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := rl.current.Load()
+	if r.URL.Path == reloadPath {
+		identity, ok := p.authenticate(r)
+		if !ok {
+			p.writeUnauthorized(w)
+			return
+		}
+		if err := p.authorizeRequest(r.WithContext(withIdentity(r.Context(), identity))); err != nil {
+			p.writeEvalError(w, err)
+			return
+		}
+		if err := p.checkAdminIdentity(identity); err != nil {
+			p.writeEvalError(w, err)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+			return
+		}
+		// A reload is an admin change like any other (see admin.go); SIGHUP is the way in without one
+		if !p.adminWritable(r.Method) {
+			writeJSONError(w, http.StatusForbidden, "bad_data", "reloading over HTTP needs admin_writes (and listen_auth); send SIGHUP instead")
+			return
+		}
+		if err := rl.Reload(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+			return
+		}
+		writeJSONRaw(w, map[string]interface{}{"status": "success"})
+		return
+	}
+	p.ServeHTTP(w, r)
+}
+
+// Run keeps the current proxy's background work going - state saving,
+// discovery, trace and audit export - until ctx is done, restarting it
+// for each new proxy.
+func (rl *Reloader) Run(ctx context.Context) {
+	rl.mu.Lock()
+	rl.ctx = ctx
+	rl.startBackground(rl.current.Load())
+	rl.mu.Unlock()
+	<-ctx.Done()
+}
+
+// startBackground runs p's background work. Callers hold rl.mu.
+func (rl *Reloader) startBackground(p *ChronoProxy) {
+	if rl.ctx == nil {
+		return
+	}
+	if rl.stop != nil {
+		rl.stop()
+	}
+	var ctx context.Context
+	ctx, rl.stop = context.WithCancel(rl.ctx)
+	go p.PersistState(ctx)
+	go p.RunDiscovery(ctx)
+	go p.ExportTraces(ctx)
+	go p.ExportAudit(ctx)
+}
+
+// Reload reads the config again and, if it's valid, swaps in a proxy
+// built from it.
+func (rl *Reloader) Reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	config, err := rl.load()
+	if err != nil {
+		log.Printf("[ERROR] Reload failed, keeping the old config: %v", err)
+		return err
+	}
+	old := rl.current.Load()
+	for _, f := range restartOnly(old.config, config) {
+		log.Printf("Reload: %s only changes on restart, ignoring", f)
+	}
+	config.Listen, config.ListenTLS = old.config.Listen, old.config.ListenTLS
+	config.PluginPath, config.ProcessPlugins, config.StateDir = old.config.PluginPath, old.config.ProcessPlugins, old.config.StateDir
+
+	p := NewChronoProxyWithPlugins(config, old.plugins)
+	p.inherit(old)
+	DebugMode.Store(config.Debug)
+	rl.current.Store(p)
+	rl.startBackground(p)
+	old.closeIdleConnections()
+	if old.audit != p.audit {
+		old.audit.close() // its settings changed; the new proxy opened its own
+	}
+	log.Printf("🔄 Config reloaded")
+	return nil
+}
+
+// closeIdleConnections hangs up every phone line p owns: the default
+// client, the upstream_tls one and any upstream's own TLS client.
+func (p *ChronoProxy) closeIdleConnections() {
+	p.client.CloseIdleConnections()
+	if p.tlsClient != nil {
+		p.tlsClient.CloseIdleConnections()
+	}
+	for _, u := range p.upstreams.all() {
+		if u.client != nil {
+			u.client.CloseIdleConnections()
+		}
+	}
+}
+
+// restartOnly names the settings that changed between old and new but are
+// only read at startup.
+func restartOnly(old, new Config) []string {
+	var out []string
+	for _, f := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"listen", old.Listen, new.Listen},
+		{"listen_tls", old.ListenTLS, new.ListenTLS},
+		{"plugin_path", old.PluginPath, new.PluginPath},
+		{"process_plugins", old.ProcessPlugins, new.ProcessPlugins},
+		{"state_dir", old.StateDir, new.StateDir},
+	} {
+		if !reflect.DeepEqual(f.old, f.new) {
+			out = append(out, f.name)
+		}
+	}
+	return out
+}
+
+// inherit brings over what old had learned or is still using, so a reload
+// doesn't reset counters or forget running jobs.
+func (p *ChronoProxy) inherit(old *ChronoProxy) {
+	oc, nc := old.config, p.config
+
+	old.metricsMux.RLock()
+	p.metrics = old.metrics
+	old.metricsMux.RUnlock()
+	p.metrics.RequestsInFlight = 0 // still counted on old, where they'll finish
+
+	p.clock = old.clock
+	p.jobs, p.caps, p.disabled, p.mtypes = old.jobs, old.caps, old.disabled, old.mtypes
+	p.upstreamPhases, p.windowFetches, p.pluginRuns, p.amplification = old.upstreamPhases, old.windowFetches, old.pluginRuns, old.amplification
+	p.upstreamErrors, p.cacheLookups, p.pluginErrors, p.rejections = old.upstreamErrors, old.cacheLookups, old.pluginErrors, old.rejections
+	p.timeframeRequests, p.mirrorComparisons, p.mirrorDeltas = old.timeframeRequests, old.mirrorComparisons, old.mirrorDeltas
+	p.mirrorSlots, p.dashboards, p.responseLimits = old.mirrorSlots, old.dashboards, old.responseLimits
+	p.windowBytes, p.windowSeries, p.requestDurations = old.windowBytes, old.windowSeries, old.requestDurations
+
+	// Discovered upstreams stay until discovery runs again and says otherwise
+	for _, u := range old.upstreams.all() {
+		if _, taken := p.upstreams.get(u.name); u.source != "" && !taken {
+			p.upstreams.set(u)
+		}
+	}
+
+	if reflect.DeepEqual(oc.Quotas, nc.Quotas) && oc.TenantHeader == nc.TenantHeader && oc.APIKeyHeader == nc.APIKeyHeader {
+		p.quotas = old.quotas
+	}
+	if oc.RateLimitPerClient == nc.RateLimitPerClient && oc.RateLimitBurst == nc.RateLimitBurst {
+		p.clientLimit = old.clientLimit
+	}
+	if oc.RateLimitGlobal == nc.RateLimitGlobal && oc.RateLimitBurst == nc.RateLimitBurst {
+		p.globalLimit = old.globalLimit
+	}
+	if oc.InteractiveConcurrency == nc.InteractiveConcurrency && oc.BatchConcurrency == nc.BatchConcurrency && oc.QueueWait == nc.QueueWait {
+		p.scheduler = old.scheduler
+	}
+	if oc.MaxUpstreamInFlight == nc.MaxUpstreamInFlight {
+		p.upstreamSlots = old.upstreamSlots
+	}
+	if oc.CoalesceFetches == nc.CoalesceFetches {
+		p.coalescer = old.coalescer
+	}
+	if oc.DebugEndpoints == nc.DebugEndpoints {
+		p.inflight = old.inflight
+	}
+	if oc.StaleOnError == nc.StaleOnError && oc.StaleMaxAge == nc.StaleMaxAge && oc.StaleCacheEntries == nc.StaleCacheEntries {
+		p.stale = old.stale
+	}
+	if oc.TracingEndpoint == nc.TracingEndpoint && oc.TracingServiceName == nc.TracingServiceName && oc.TracingSampleRatio == nc.TracingSampleRatio {
+		p.tracer = old.tracer
+	}
+	p.authzDecisions = old.authzDecisions
+	if oc.AuthorizationPlugin == nc.AuthorizationPlugin && oc.AuthorizationWebhook == nc.AuthorizationWebhook && oc.AuthorizationTimeout == nc.AuthorizationTimeout {
+		p.authorizer.set(old.authorizer.get()) // including one set with SetAuthorizer
+	}
+	if oc.AuditLog == nc.AuditLog && oc.AuditWebhook == nc.AuditWebhook {
+		p.audit.close() // opened by the constructor, not needed after all
+		p.audit = old.audit
+	}
+}
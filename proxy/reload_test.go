@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "old", URL: "http://127.0.0.1:1"}}
+	config.RestrictUpstreams = true
+	config.ListenAuth.BearerTokens = []string{"s3cr3t"}
+	config.AdminWrites = true
+	next, loadErr := config, error(nil)
+
+	rl := NewReloader(NewChronoProxyWithConfig(config), func() (Config, error) { return next, loadErr })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.Run(ctx)
+
+	get := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer s3cr3t")
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, r)
+		return w
+	}
+	if w := get("GET", "/new/api/v1/chrono/timeframes"); w.Code != 403 {
+		t.Fatalf("before reload: %d %s", w.Code, w.Body)
+	}
+	first := rl.Proxy()
+	first.timeframeRequests.inc("7days")
+
+	next.Upstreams = []UpstreamConfig{{Name: "new", URL: "http://127.0.0.1:1"}}
+	next.Listen = "0.0.0.0:9999" // only at startup
+	if w := get("POST", reloadPath); w.Code != 200 {
+		t.Fatalf("reload: %d %s", w.Code, w.Body)
+	}
+	if w := get("GET", "/new/api/v1/chrono/timeframes"); w.Code != 200 {
+		t.Errorf("new upstream after reload: %d %s", w.Code, w.Body)
+	}
+	if w := get("GET", "/old/api/v1/chrono/timeframes"); w.Code != 403 {
+		t.Errorf("old upstream after reload: %d %s", w.Code, w.Body)
+	}
+	p := rl.Proxy()
+	if p == first || p.config.Listen != config.Listen {
+		t.Errorf("listen changed on reload: %q", p.config.Listen)
+	}
+	if snaps := p.timeframeRequests.snapshot(); len(snaps) != 1 || snaps[0].Value != 1 {
+		t.Errorf("counters lost on reload: %+v", snaps)
+	}
+	if p.GetMetrics().RequestCount == 0 {
+		t.Error("request count reset on reload")
+	}
+
+	loadErr = errors.New("parsing config: yaml: line 3: did not find expected key")
+	if w := get("POST", reloadPath); w.Code != 400 || !strings.Contains(w.Body.String(), "did not find expected key") {
+		t.Errorf("bad config: %d %s", w.Code, w.Body)
+	}
+	if rl.Proxy() != p {
+		t.Error("a failed reload swapped the proxy")
+	}
+
+	if w := get("GET", reloadPath); w.Code != 405 {
+		t.Errorf("GET reload: %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, httptest.NewRequest("POST", reloadPath, nil))
+	if w.Code != 401 {
+		t.Errorf("unauthenticated reload: %d", w.Code)
+	}
+}
+
+func TestReloadOverHTTPNeedsAdminWrites(t *testing.T) {
+	loads := 0
+	load := func() (Config, error) { loads++; return DefaultConfig, nil }
+	for name, config := range map[string]Config{
+		"defaults":          DefaultConfig,
+		"listen_auth only":  {ListenAuth: ListenAuthConfig{BearerTokens: []string{"s3cr3t"}}},
+		"admin_writes only": {AdminWrites: true},
+	} {
+		rl := NewReloader(NewChronoProxyWithConfig(config), load)
+		r := httptest.NewRequest("POST", reloadPath, nil)
+		r.Header.Set("Authorization", "Bearer s3cr3t")
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: %d %s, want 403", name, w.Code, w.Body)
+		}
+	}
+	if loads != 0 {
+		t.Errorf("config was reloaded %d times", loads)
+	}
+}
+
+func TestReloadHandsOverDebugAndAudit(t *testing.T) {
+	defer DebugMode.Store(DebugMode.Load())
+	dir := t.TempDir()
+	config := DefaultConfig
+	config.AuditLog = filepath.Join(dir, "a.log")
+	next := config
+	rl := NewReloader(NewChronoProxyWithConfig(config), func() (Config, error) { return next, nil })
+	first := rl.Proxy()
+
+	next.Debug = true
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !DebugMode.Load() {
+		t.Error("debug not switched on by reload")
+	}
+	if rl.Proxy().audit != first.audit {
+		t.Error("unchanged audit_log was reopened")
+	}
+
+	next.AuditLog = filepath.Join(dir, "b.log")
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.audit.file.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("old audit_log left open: %v", err)
+	}
+	if _, err := rl.Proxy().audit.file.Stat(); err != nil {
+		t.Errorf("new audit_log: %v", err)
+	}
+	rl.Proxy().audit.close()
+}
@@ -0,0 +1,197 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/remoteread.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andydixon/chronotheus/internal/model"
+	"github.com/andydixon/chronotheus/internal/remoteread"
+)
+
+// Remote read - another Prometheus asks, we answer in its own language 📡
+//
+// Point a Prometheus at us as a remote_read endpoint:
+//
+//   remote_read:
+//     - url: http://chronotheus:8080/prod/api/v1/read
+//       read_recent: true
+//
+// and every selector it evaluates can see the shifted windows and the
+// synthetics as if they were stored series - so recording rules and alerts
+// over lastMonthAverage work without going through the HTTP API at all.
+//
+// Each query in the ReadRequest becomes a query_range through the normal
+// pipeline (evaluate): its matchers are the selector, its time range the
+// range, its step hint the step (a minute when there isn't one). A
+// chrono_timeframe="..." equality matcher picks the timeframe like it
+// would in PromQL; any other matcher on chrono labels is applied to the
+// answer afterwards. Warnings have nowhere to go in the protocol, so they
+// don't.
+
+const (
+	remoteReadPath        = "/api/v1/read"
+	remoteReadMaxBody     = 8 * 1024 * 1024  // compressed ReadRequest
+	remoteReadMaxDecoded  = 32 * 1024 * 1024 // ...and once snappy's done with it
+	remoteReadDefaultStep = 60 * 1000        // ms, when the reader gives no hint
+	remoteReadMaxPoints   = 11000            // what query_range allows per series
+)
+
+// handleRemoteRead serves a remote_read ReadRequest against upstream.
+func (p *ChronoProxy) handleRemoteRead(w http.ResponseWriter, r *http.Request, upstream, path string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "remote read wants a POST")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, remoteReadMaxBody+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "reading body: "+err.Error())
+		return
+	}
+	if len(body) > remoteReadMaxBody {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "bad_data", "read request too large")
+		return
+	}
+	raw, err := remoteread.Decode(body, remoteReadMaxDecoded)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	req, err := remoteread.UnmarshalReadRequest(raw)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+
+	ctx := withWarnings(withPriority(r.Context(), p.requestPriority(r)), &warningList{})
+	resp := remoteread.ReadResponse{Results: make([]remoteread.QueryResult, len(req.Queries))}
+	for i, q := range req.Queries {
+		series, err := p.remoteReadQuery(ctx, q, upstream+"/api/v1/query_range")
+		if err != nil {
+			p.writeEvalError(w, err)
+			return
+		}
+		reportSeries(ctx, len(series))
+		resp.Results[i].Timeseries = toTimeSeries(series)
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(remoteread.Encode(resp.Marshal()))
+}
+
+// remoteReadQuery runs one remote read query as a query_range.
+func (p *ChronoProxy) remoteReadQuery(ctx context.Context, q remoteread.Query, endpoint string) ([]model.Series, error) {
+	var selector []string
+	var filters []remoteread.Matcher
+	for _, m := range q.Matchers {
+		if strings.HasPrefix(m.Name, "chrono_") && !(m.Name == "chrono_timeframe" && m.Type == remoteread.MatchEqual) {
+			filters = append(filters, m)
+			continue
+		}
+		selector = append(selector, m.Name+m.Type.String()+strconv.Quote(m.Value))
+	}
+	match, err := matchAll(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	step := q.Hints.StepMs
+	if step <= 0 {
+		step = remoteReadDefaultStep
+	}
+	if span := q.EndMs - q.StartMs; span/step > remoteReadMaxPoints {
+		step = span/remoteReadMaxPoints + 1
+	}
+	params := url.Values{
+		"query": {"{" + strings.Join(selector, ",") + "}"},
+		"start": {model.FormatTimestamp(q.StartMs)},
+		"end":   {model.FormatTimestamp(q.EndMs)},
+		"step":  {model.FormatTimestamp(step)},
+	}
+	series, err := p.evaluate(ctx, params, endpoint, true)
+	if err != nil {
+		return nil, err
+	}
+	out := series[:0]
+	for _, s := range series {
+		if match(s.Labels) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// matchAll compiles matchers into one test over a label set. Regexes are
+// anchored, as in PromQL; a missing label is the empty string.
+func matchAll(matchers []remoteread.Matcher) (func(map[string]string) bool, error) {
+	tests := make([]func(map[string]string) bool, 0, len(matchers))
+	for _, m := range matchers {
+		switch m.Type {
+		case remoteread.MatchEqual, remoteread.MatchNotEqual:
+			want := m.Type == remoteread.MatchEqual
+			tests = append(tests, func(l map[string]string) bool { return (l[m.Name] == m.Value) == want })
+		case remoteread.MatchRegexp, remoteread.MatchNotRegexp:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, &badQueryError{msg: fmt.Sprintf("matcher %s: %v", m.Name, err)}
+			}
+			want := m.Type == remoteread.MatchRegexp
+			tests = append(tests, func(l map[string]string) bool { return re.MatchString(l[m.Name]) == want })
+		default:
+			return nil, &badQueryError{msg: fmt.Sprintf("matcher %s: unknown type %d", m.Name, m.Type)}
+		}
+	}
+	return func(l map[string]string) bool {
+		for _, test := range tests {
+			if !test(l) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// toTimeSeries is model.Series in remote read's shape: labels sorted by
+// name, as Prometheus expects them.
+func toTimeSeries(series []model.Series) []remoteread.TimeSeries {
+	out := make([]remoteread.TimeSeries, 0, len(series))
+	for _, s := range series {
+		ts := remoteread.TimeSeries{
+			Labels:  make([]remoteread.Label, 0, len(s.Labels)),
+			Samples: make([]remoteread.Sample, 0, len(s.Points)),
+		}
+		for name, value := range s.Labels {
+			ts.Labels = append(ts.Labels, remoteread.Label{Name: name, Value: value})
+		}
+		sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+		for _, pt := range s.Points {
+			ts.Samples = append(ts.Samples, remoteread.Sample{Value: pt.V, Timestamp: pt.T})
+		}
+		out = append(out, ts)
+	}
+	return out
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/remoteread"
+)
+
+func TestRemoteRead(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	const end = 1699999980 // on a minute, where the synthetics bucket
+	for _, days := range []int64{0, 7, 14, 21, 28} {
+		at := end - days*86400
+		fake.Serve("/api/v1/query_range", at, []byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up","job":"api"},"values":[[%d,"%d"],[%d,"%d"]]}]}}`, at-60, days, at, days)))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxyWithConfig(DefaultConfig)
+
+	read := func(req remoteread.ReadRequest) (*httptest.ResponseRecorder, *remoteread.ReadResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("POST", prefix+remoteReadPath, bytes.NewReader(remoteread.Encode(req.Marshal()))))
+		if w.Code != http.StatusOK {
+			return w, nil
+		}
+		raw, err := remoteread.Decode(w.Body.Bytes(), 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := remoteread.UnmarshalReadResponse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w, resp
+	}
+
+	w, resp := read(remoteread.ReadRequest{Queries: []remoteread.Query{{
+		StartMs: (end - 60) * 1000,
+		EndMs:   end * 1000,
+		Matchers: []remoteread.Matcher{
+			{Type: remoteread.MatchEqual, Name: "__name__", Value: "up"},
+			{Type: remoteread.MatchRegexp, Name: "chrono_timeframe", Value: "current|lastMonthAverage"},
+		},
+		Hints: remoteread.Hints{StepMs: 30000},
+	}}})
+	if resp == nil {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Encoding") != "snappy" || w.Header().Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("headers = %v", w.Header())
+	}
+	if asked := fake.Requests()[0].Params; asked.Get("query") != `{__name__="up"}` || asked.Get("step") != "30" {
+		t.Errorf("upstream asked %v", asked)
+	}
+
+	if len(resp.Results) != 1 || len(resp.Results[0].Timeseries) != 2 {
+		t.Fatalf("want current and lastMonthAverage, got %+v", resp.Results)
+	}
+	got := map[string]float64{}
+	for _, ts := range resp.Results[0].Timeseries {
+		var tf string
+		for i, l := range ts.Labels {
+			if i > 0 && ts.Labels[i-1].Name >= l.Name {
+				t.Errorf("labels not sorted: %v", ts.Labels)
+			}
+			if l.Name == "chrono_timeframe" {
+				tf = l.Value
+			}
+		}
+		if len(ts.Samples) != 2 || ts.Samples[1].Timestamp != end*1000 {
+			t.Errorf("%s samples = %v", tf, ts.Samples)
+			continue
+		}
+		got[tf] = ts.Samples[1].Value
+	}
+	if got["current"] != 0 || got["lastMonthAverage"] != 17.5 {
+		t.Errorf("values = %v", got)
+	}
+
+	if w, _ := read(remoteread.ReadRequest{Queries: []remoteread.Query{{Matchers: []remoteread.Matcher{{Type: remoteread.MatchRegexp, Name: "chrono_timeframe", Value: "("}}}}}); w.Code != http.StatusBadRequest {
+		t.Errorf("bad regex: status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", prefix+remoteReadPath, strings.NewReader("not snappy")))
+	if body, _ := io.ReadAll(w.Body); w.Code != http.StatusBadRequest {
+		t.Errorf("garbage: status %d %s", w.Code, body)
+	}
+}
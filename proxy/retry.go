@@ -0,0 +1,137 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/retry.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"syscall"
+	"time"
+)
+
+// Retries - a blip shouldn't cost a whole week 🔁
+//
+// A Prometheus restarting behind a load balancer, or a connection reset
+// halfway through a big matrix, used to drop that window from the answer.
+// With fetch_retries set, a window fetch that fails like that is tried
+// again, up to fetch_retries more times, waiting retry_backoff before the
+// first retry and twice as long before each one after (never more than
+// retry_max_backoff), give or take some jitter so a fleet of windows
+// doesn't come back in lockstep.
+//
+// What counts as a blip: a connection refused or reset, a body cut short,
+// or a 5xx. A 4xx, a timeout or a cancelled request isn't retried - asking
+// again wouldn't change the answer, or nobody's waiting for it.
+//
+// retry_deadline caps the lot: no retry starts once the query has been
+// running that long, so a properly dead upstream costs a query a few
+// seconds, not fetch_retries × every window.
+
+// transientError is a fetch failure worth trying again.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+// transient marks err as worth a retry.
+func transient(err error) error {
+	return &transientError{err: err}
+}
+
+// isTransient says whether a failed fetch is worth trying again.
+func isTransient(err error) bool {
+	var te *transientError
+	return errors.As(err, &te)
+}
+
+// transportTransient says whether an error from the client (no response at
+// all) is a blip rather than a timeout or a cancellation.
+func transportTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var timeout interface{ Timeout() bool }
+	return !errors.As(err, &timeout) || !timeout.Timeout()
+}
+
+// readTransient says whether a body that couldn't be read was cut off
+// rather than just not making sense.
+func readTransient(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+type retryDeadlineKey struct{}
+
+// withRetryDeadline starts the query's retry clock.
+func (p *ChronoProxy) withRetryDeadline(ctx context.Context) context.Context {
+	if p.config.FetchRetries <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, retryDeadlineKey{}, time.Now().Add(p.config.RetryDeadline))
+}
+
+// retryDeadline is when the query stops starting retries. Fetches made
+// outside a query get a clock of their own.
+func (p *ChronoProxy) retryDeadline(ctx context.Context) time.Time {
+	if d, ok := ctx.Value(retryDeadlineKey{}).(time.Time); ok {
+		return d
+	}
+	return time.Now().Add(p.config.RetryDeadline)
+}
+
+// withRetries runs fetch, and runs it again after a transient failure for
+// as long as fetch_retries and the retry deadline allow.
+func (p *ChronoProxy) withRetries(ctx context.Context, fetch func() error) error {
+	err := fetch()
+	if err == nil || p.config.FetchRetries <= 0 {
+		return err
+	}
+	deadline := p.retryDeadline(ctx)
+	for attempt := 0; attempt < p.config.FetchRetries && isTransient(err); attempt++ {
+		wait := p.retryBackoff(attempt)
+		if time.Now().Add(wait).After(deadline) {
+			break
+		}
+		if sleepCtx(ctx, wait) != nil {
+			break
+		}
+		err = fetch()
+	}
+	return err
+}
+
+// retryBackoff is how long to wait before retry number attempt (from 0):
+// retry_backoff doubled attempt times, capped at retry_max_backoff, then
+// somewhere between half and all of that.
+func (p *ChronoProxy) retryBackoff(attempt int) time.Duration {
+	wait := p.config.RetryBackoff
+	for i := 0; i < attempt && wait < p.config.RetryMaxBackoff; i++ {
+		wait *= 2
+	}
+	if p.config.RetryMaxBackoff > 0 && wait > p.config.RetryMaxBackoff {
+		wait = p.config.RetryMaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
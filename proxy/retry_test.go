@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetriesTransientFailures(t *testing.T) {
+	var mu sync.Mutex
+	tries := make(map[string]int) // by time
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		at := r.URL.Query().Get("time")
+		mu.Lock()
+		tries[at]++
+		n := tries[at]
+		mu.Unlock()
+		switch {
+		case strings.Contains(r.URL.Query().Get("query"), "bad"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"nope"}`))
+		case n <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`upstream connect error`))
+		default:
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[` + at + `,"1"]}]}}`))
+		}
+	}))
+	defer up.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(up.URL, "http://"), ":", "_", 1)
+	query := func(config Config, q string) string {
+		mu.Lock()
+		tries = make(map[string]int)
+		mu.Unlock()
+		w := httptest.NewRecorder()
+		NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+q, nil))
+		return w.Body.String()
+	}
+
+	if body := query(DefaultConfig, "up"); !strings.Contains(body, "left out") {
+		t.Errorf("retries are off by default: %s", body)
+	}
+
+	config := DefaultConfig
+	config.FetchRetries = 2
+	config.RetryBackoff = time.Millisecond
+	if body := query(config, "up"); strings.Contains(body, "left out") || !strings.Contains(body, `"chrono_timeframe":"28days"`) {
+		t.Errorf("two 503s then success should be invisible: %s", body)
+	}
+	mu.Lock()
+	if n := tries["1700000000"]; n != 3 {
+		t.Errorf("current was tried %d times, want 3", n)
+	}
+	mu.Unlock()
+
+	query(config, "bad")
+	mu.Lock()
+	if n := tries["1700000000"]; n != 1 {
+		t.Errorf("a 4xx was tried %d times, want 1", n)
+	}
+	mu.Unlock()
+
+	config.FetchRetries = 1
+	if body := query(config, "up"); !strings.Contains(body, "window current left out") {
+		t.Errorf("one retry isn't enough for two 503s: %s", body)
+	}
+
+	config.FetchRetries = 5
+	config.RetryDeadline = 0
+	query(config, "up")
+	mu.Lock()
+	if n := tries["1700000000"]; n != 1 {
+		t.Errorf("past the retry deadline: tried %d times, want 1", n)
+	}
+	mu.Unlock()
+}
+
+func TestRetryBackoff(t *testing.T) {
+	config := DefaultConfig
+	config.RetryBackoff = 100 * time.Millisecond
+	config.RetryMaxBackoff = time.Second
+	p := NewChronoProxyWithConfig(config)
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if wait := p.retryBackoff(attempt); wait < max/2 || wait > max {
+				t.Errorf("attempt %d: waited %v, want %v-%v", attempt, wait, max/2, max)
+			}
+		}
+	}
+	if !isTransient(transient(&upstreamError{msg: "x"})) || !isUpstreamError(transient(&upstreamError{msg: "x"})) {
+		t.Error("transient should wrap, not hide, the error")
+	}
+}
@@ -0,0 +1,170 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/rules.go
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Rules and alerts - every Prometheus' alarm bells on one panel 🚨
+//
+// An alert list panel talks to one datasource, and every upstream has its
+// own rules. So /api/v1/rules and /api/v1/alerts *without* an upstream
+// prefix ask every registered upstream at once and stitch the answers
+// together, with an upstream="<name>" label on every rule and alert so you
+// can tell (and filter) them apart. An upstream that doesn't answer is left
+// out with a warning; it's only an error when none of them do.
+//
+// With a prefix (/prod/api/v1/rules) you get that one upstream's answer,
+// passed straight through as ever. Legacy /host_port/ upstreams aren't
+// registered anywhere, so they can't be part of the big picture.
+
+const (
+	rulesPath         = "/api/v1/rules"
+	alertsPath        = "/api/v1/alerts"
+	upstreamLabelName = "upstream"
+)
+
+// handleAggregatedRules serves rulesPath and alertsPath for all upstreams.
+func (p *ChronoProxy) handleAggregatedRules(w http.ResponseWriter, r *http.Request) {
+	key := "groups"
+	if r.URL.Path == alertsPath {
+		key = "alerts"
+	}
+	params := parseClientParams(r)
+	var ups []*upstream
+	tenant := tenantFrom(r.Context())
+	for _, u := range p.upstreams.all() {
+		if len(u.members) == 0 && tenant.allowsUpstream(u.name) { // a virtual one would only repeat its first member
+			ups = append(ups, u)
+		}
+	}
+	sort.Slice(ups, func(i, j int) bool { return ups[i].name < ups[j].name })
+
+	lists := make([][]interface{}, len(ups))
+	errs := make([]error, len(ups))
+	var wg sync.WaitGroup
+	for i, u := range ups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lists[i], errs[i] = p.fetchRuleList(r.Context(), u, r.URL.Path, params, key)
+		}()
+	}
+	wg.Wait()
+
+	merged := []interface{}{}
+	var warnings []string
+	for i, u := range ups {
+		if errs[i] != nil {
+			warnings = append(warnings, fmt.Sprintf("upstream %q: %v", u.name, errs[i]))
+			continue
+		}
+		for _, item := range lists[i] {
+			labelUpstream(item, key, u.name)
+		}
+		merged = append(merged, lists[i]...)
+	}
+	if len(ups) > 0 && len(warnings) == len(ups) {
+		writeJSONError(w, http.StatusBadGateway, "unavailable", "no upstream answered: "+strings.Join(warnings, "; "))
+		return
+	}
+
+	out := map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{key: merged},
+	}
+	if len(warnings) > 0 {
+		out["warnings"] = warnings
+	}
+	writeJSONRaw(w, out)
+}
+
+// fetchRuleList asks one upstream for path and returns data[key] - the
+// rule groups or the alerts - as it came.
+func (p *ChronoProxy) fetchRuleList(ctx context.Context, u *upstream, path string, params url.Values, key string) ([]interface{}, error) {
+	ctx = withUpstream(ctx, u)
+	base, err := u.target(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := p.fetchBody(ctx, base+path+"?"+buildQueryString(params), p.upstreamTimeout(params, false), 10*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Status string                   `json:"status"`
+		Error  string                   `json:"error"`
+		Data   map[string][]interface{} `json:"data"`
+	}
+	if err := model.DecodeJSON(body, &resp); err != nil {
+		return nil, fmt.Errorf("unexpected answer: %w", err)
+	}
+	if resp.Status != "success" {
+		if resp.Error == "" {
+			resp.Error = "status " + resp.Status
+		}
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Data[key], nil
+}
+
+// labelUpstream adds the upstream label to an alert, or to every rule in a
+// rule group and the alerts those rules are firing.
+func labelUpstream(item interface{}, key, name string) {
+	obj, ok := item.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if key == "alerts" {
+		setLabel(obj, name)
+		return
+	}
+	rules, _ := obj["rules"].([]interface{})
+	for _, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		setLabel(rule, name)
+		alerts, _ := rule["alerts"].([]interface{})
+		for _, a := range alerts {
+			if alert, ok := a.(map[string]interface{}); ok {
+				setLabel(alert, name)
+			}
+		}
+	}
+}
+
+func setLabel(obj map[string]interface{}, name string) {
+	labels, ok := obj["labels"].(map[string]interface{})
+	if !ok {
+		labels = map[string]interface{}{}
+		obj["labels"] = labels
+	}
+	labels[upstreamLabelName] = name
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestRulesAndAlertsAggregated(t *testing.T) {
+	east, west := fixtures.NewFakePrometheus(), fixtures.NewFakePrometheus()
+	defer east.Close()
+	defer west.Close()
+	east.Serve(rulesPath, 0, []byte(`{"status":"success","data":{"groups":[{"name":"node","rules":[{"name":"HighLoad","type":"alerting","labels":{"severity":"page"},"alerts":[{"labels":{"alertname":"HighLoad"},"state":"firing"}]}]}]}}`))
+	west.Serve(rulesPath, 0, []byte(`{"status":"error","error":"rules are switched off"}`))
+	east.Serve(alertsPath, 0, []byte(`{"status":"success","data":{"alerts":[{"labels":{"alertname":"HighLoad"},"state":"firing"}]}}`))
+	west.Serve(alertsPath, 0, []byte(`{"status":"success","data":{"alerts":[{"labels":{"alertname":"DiskFull"},"state":"pending"}]}}`))
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "east", URL: east.URL}, {Name: "west", URL: west.URL}}
+	p := NewChronoProxyWithConfig(config)
+
+	ask := func(path string, into interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", path, w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), into); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	var rules struct {
+		Data struct {
+			Groups []struct {
+				Rules []struct {
+					Labels map[string]string `json:"labels"`
+					Alerts []struct {
+						Labels map[string]string `json:"labels"`
+					} `json:"alerts"`
+				} `json:"rules"`
+			} `json:"groups"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	ask(rulesPath, &rules)
+	if len(rules.Data.Groups) != 1 || len(rules.Data.Groups[0].Rules) != 1 {
+		t.Fatalf("rules: %+v", rules)
+	}
+	rule := rules.Data.Groups[0].Rules[0]
+	if rule.Labels["upstream"] != "east" || rule.Labels["severity"] != "page" || rule.Alerts[0].Labels["upstream"] != "east" {
+		t.Errorf("rule labels = %v, alert labels = %v", rule.Labels, rule.Alerts[0].Labels)
+	}
+	if len(rules.Warnings) != 1 || !strings.Contains(rules.Warnings[0], "west") || !strings.Contains(rules.Warnings[0], "switched off") {
+		t.Errorf("warnings = %v", rules.Warnings)
+	}
+
+	var alerts struct {
+		Data struct {
+			Alerts []struct {
+				Labels map[string]string `json:"labels"`
+			} `json:"alerts"`
+		} `json:"data"`
+	}
+	ask(alertsPath, &alerts)
+	if len(alerts.Data.Alerts) != 2 || alerts.Data.Alerts[0].Labels["upstream"] != "east" || alerts.Data.Alerts[1].Labels["upstream"] != "west" {
+		t.Errorf("alerts = %+v", alerts.Data.Alerts)
+	}
+
+	west.Close()
+	east.Close()
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", alertsPath, nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("with every upstream down: status %d, want 502", w.Code)
+	}
+}
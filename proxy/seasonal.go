@@ -0,0 +1,140 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/seasonal.go
+package proxy
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// seasonalBaseline - "what does Tuesday 09:30 usually look like?"
+//
+// lastMonthAverage lines points up by where they sit in their window, which
+// is only the same weekday and time of day when every offset is a whole
+// number of weeks. The seasonal baseline doesn't assume that: each past
+// point is put back at the moment it was actually recorded, dropped into
+// its minute-of-the-week bucket (Monday 00:00 UTC onwards), and each
+// bucket is averaged over the values that landed in it. Every timestamp we
+// answer for then gets the baseline of its own bucket.
+//
+// Unlike lastMonthAverage it divides by how many values a bucket has, not
+// the number of windows - a week with no data isn't a week of zeroes.
+// Timestamps whose bucket saw nothing in the past are left out.
+//
+// With a timezone set the week runs Monday 00:00 to Sunday 23:59 on that
+// zone's wall clock, so 09:30 stays 09:30 either side of a clock change.
+
+const seasonalBaselineName = "seasonalBaseline"
+
+const minutesPerWeek = 7 * 24 * 60
+
+// minuteOfWeek buckets a Unix timestamp, with Monday 00:00 UTC as 0.
+func minuteOfWeek(t int64) int64 {
+	// The epoch was a Thursday - shift by three days so weeks start on Monday.
+	m := (t/60 + 3*24*60) % minutesPerWeek
+	if m < 0 {
+		m += minutesPerWeek
+	}
+	return m
+}
+
+// localMinuteOfWeek is minuteOfWeek for a Unix millisecond timestamp, on
+// loc's wall clock (UTC when loc is nil).
+func localMinuteOfWeek(ms int64, loc *time.Location) int64 {
+	if loc != nil {
+		_, off := time.UnixMilli(ms).In(loc).Zone()
+		ms += int64(off) * 1000
+	}
+	return minuteOfWeek(ms / 1000)
+}
+
+// buildSeasonalBaseline builds seasonalBaseline series from the past
+// windows in seriesList. wins maps each timeframe name to the window it was
+// fetched from, so points can be put back where they came from; loc is the
+// zone weeks are counted in.
+func buildSeasonalBaseline(seriesList []model.Series, wins map[string]window, loc *time.Location, isRange bool, grid synthGrid) []model.Series {
+	groups := make(map[string][]model.Series)
+	for _, s := range seriesList {
+		tf := s.Labels["chrono_timeframe"]
+		if _, past := wins[tf]; !past || tf == "current" {
+			continue
+		}
+		sig := signature(s.Labels)
+		groups[sig] = append(groups[sig], s)
+	}
+
+	var out []model.Series
+	for _, grp := range groups {
+		type bucket struct {
+			sum   float64
+			count int
+		}
+		buckets := make(map[int64]*bucket)
+		steps := make(map[int64]bool)
+		for _, s := range grp {
+			win := wins[s.Labels["chrono_timeframe"]]
+			for _, pt := range s.Points {
+				at := grid.bucket(pt.T)
+				steps[at] = true
+				mow := localMinuteOfWeek(win.back(at), loc)
+				b := buckets[mow]
+				if b == nil {
+					b = &bucket{}
+					buckets[mow] = b
+				}
+				b.sum += pt.V
+				b.count++
+			}
+		}
+
+		pts := make([]model.Point, 0, len(steps))
+		for m := range steps {
+			if b := buckets[localMinuteOfWeek(m, loc)]; b != nil {
+				pts = append(pts, model.Point{T: m, V: b.sum / float64(b.count)})
+			}
+		}
+		if len(pts) == 0 {
+			continue
+		}
+		sort.Slice(pts, func(i, j int) bool { return pts[i].T < pts[j].T })
+		if !isRange {
+			pts = pts[len(pts)-1:]
+		}
+
+		metric := copyMetric(grp[0].Labels)
+		delete(metric, "_command")
+		metric["chrono_timeframe"] = seasonalBaselineName
+		out = append(out, model.Series{Labels: metric, Points: pts})
+	}
+	if DebugMode.Load() {
+		log.Printf("buildSeasonalBaseline: %d series", len(out))
+	}
+	return out
+}
+
+// windowsByName indexes wins by timeframe name.
+func windowsByName(wins []window) map[string]window {
+	out := make(map[string]window, len(wins))
+	for _, win := range wins {
+		out[win.name] = win
+	}
+	return out
+}
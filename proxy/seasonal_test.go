@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestMinuteOfWeek(t *testing.T) {
+	// 2023-11-13 00:00 UTC was a Monday, 2023-11-19 23:59 UTC the Sunday after.
+	if got := minuteOfWeek(1699833600); got != 0 {
+		t.Errorf("Monday midnight = %d", got)
+	}
+	if got := minuteOfWeek(1699833600 + 7*86400 - 60); got != minutesPerWeek-1 {
+		t.Errorf("Sunday 23:59 = %d", got)
+	}
+}
+
+func TestSeasonalBaseline(t *testing.T) {
+	const monday = 1699833600
+	const day = 86400
+	series := func(tf string, pts ...model.Point) model.Series {
+		return model.Series{Labels: map[string]string{"__name__": "up", "chrono_timeframe": tf}, Points: pts}
+	}
+	wins := windowsByName([]window{{name: "current"}, {name: "7days", offset: 7 * day}, {name: "10days", offset: 10 * day}})
+	in := []model.Series{
+		series("current", model.Point{T: monday * 1000, V: 1}),
+		// Recorded a week earlier on a Monday: aligned at Monday.
+		series("7days", model.Point{T: monday * 1000, V: 10}, model.Point{T: (monday + 3*day) * 1000, V: 99}),
+		// Ten days back, so these were really recorded on a Friday (the 50)
+		// and a Monday (the 30), whatever time they're shifted to.
+		series("10days", model.Point{T: monday * 1000, V: 50}, model.Point{T: (monday + 3*day) * 1000, V: 30}),
+	}
+
+	out := buildSeasonalBaseline(in, wins, nil, true, minuteGrid)
+	if len(out) != 1 || out[0].Labels["chrono_timeframe"] != seasonalBaselineName {
+		t.Fatalf("got %+v", out)
+	}
+	want := map[int64]float64{
+		monday * 1000:           (10 + 30) / 2.0, // Both Mondays; the Friday 50 has no Friday to land on
+		(monday + 3*day) * 1000: 99,              // Thursday: only 7days
+	}
+	if len(out[0].Points) != len(want) {
+		t.Fatalf("points = %+v", out[0].Points)
+	}
+	for _, pt := range out[0].Points {
+		if want[pt.T] != pt.V {
+			t.Errorf("at %d: %v; want %v", pt.T, pt.V, want[pt.T])
+		}
+	}
+
+	if inst := buildSeasonalBaseline(in, wins, nil, false, minuteGrid); len(inst) != 1 || len(inst[0].Points) != 1 || inst[0].Points[0].T != (monday+3*day)*1000 {
+		t.Errorf("instant = %+v", inst)
+	}
+}
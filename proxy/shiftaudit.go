@@ -0,0 +1,87 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/shiftaudit.go
+package proxy
+
+import (
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Shift audit - "which Tuesday did that number actually come from?"
+//
+// _command="AUDIT_TIME_SHIFT" answers as usual, but every historical series
+// also says where its samples really sat before we moved them to the
+// present:
+//
+//   chrono_original_timestamp  instant queries: when the sample was recorded
+//   chrono_original_start      range queries: when the first sample was recorded
+//   chrono_original_end        range queries: when the last one was
+//   chrono_shift               how far the samples were moved, e.g. 168h -
+//                              "167h..168h" when a range straddles a clock change
+//
+// Times are RFC3339 on the timezone's wall clock (UTC without one), since
+// the whole point is checking you got the 09:00 you expected. Labels are
+// per series, so this is for looking at, not for alerting on.
+
+const auditShiftCommand = "AUDIT_TIME_SHIFT"
+
+// auditShift labels the historical series in series with their original
+// timestamps. wins are the windows the series were fetched from.
+func (p *ChronoProxy) auditShift(series []model.Series, wins []window, isRange bool) []model.Series {
+	byName := windowsByName(wins)
+	loc := p.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	stamp := func(ms int64) string {
+		return time.UnixMilli(ms).In(loc).Format(time.RFC3339Nano)
+	}
+
+	out := make([]model.Series, len(series))
+	for i, s := range series {
+		out[i] = s
+		win, fetched := byName[s.Labels["chrono_timeframe"]]
+		if !fetched || win.offset == 0 || len(s.Points) == 0 {
+			continue
+		}
+		first, last := s.Points[0].T, s.Points[len(s.Points)-1].T
+		origFirst, origLast := win.back(first), win.back(last)
+
+		labels := copyMetric(s.Labels)
+		if isRange {
+			labels["chrono_original_start"] = stamp(origFirst)
+			labels["chrono_original_end"] = stamp(origLast)
+		} else {
+			labels["chrono_original_timestamp"] = stamp(origLast)
+		}
+		shift := shiftName(last - origLast)
+		if firstShift := shiftName(first - origFirst); firstShift != shift {
+			shift = firstShift + ".." + shift
+		}
+		labels["chrono_shift"] = shift
+		out[i] = model.Series{Labels: labels, Points: s.Points}
+	}
+	return out
+}
+
+// shiftName writes a shift of ms milliseconds as a duration - "168h" reads
+// better than "7days" next to "167h".
+func shiftName(ms int64) string {
+	return shortDuration(time.Duration(ms) * time.Millisecond)
+}
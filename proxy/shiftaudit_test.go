@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestAuditTimeShift(t *testing.T) {
+	// A range either side of Europe/London's clock change on 2024-03-31;
+	// the week before it was all GMT.
+	const start, end = 1711800000, 1711972800 // 2024-03-30 12:00 GMT, 2024-04-01 13:00 BST
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query_range", 1711371600, []byte(`{"status":"success","data":{"resultType":"matrix","result":[`+
+		`{"metric":{"__name__":"up"},"values":[[1711195200,"1"],[1711371600,"2"]]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.Timezone = "Europe/London"
+	w := httptest.NewRecorder()
+	NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", prefix+
+		`/api/v1/query_range?start=1711800000&end=1711972800&step=3600&query=up{chrono_timeframe="7days",_command="AUDIT_TIME_SHIFT"}`, nil))
+
+	var resp struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+				Values [][2]interface{}  `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Data.Result) != 1 {
+		t.Fatalf("body: %s", w.Body.String())
+	}
+	got := resp.Data.Result[0]
+	for k, want := range map[string]string{
+		"chrono_original_start": "2024-03-23T12:00:00Z",
+		"chrono_original_end":   "2024-03-25T13:00:00Z",
+		"chrono_shift":          "168h..167h",
+	} {
+		if got.Metric[k] != want {
+			t.Errorf("%s = %q; want %q", k, got.Metric[k], want)
+		}
+	}
+	if got.Values[0][0] != float64(start) || got.Values[1][0] != float64(end) {
+		t.Errorf("values = %v", got.Values)
+	}
+	if _, ok := got.Metric["chrono_original_timestamp"]; ok {
+		t.Error("range series shouldn't carry chrono_original_timestamp")
+	}
+}
+
+func TestAuditTimeShiftLeavesCurrentAlone(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1699395200,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	w := httptest.NewRecorder()
+	NewChronoProxy().ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000&query=up{_command="AUDIT_TIME_SHIFT"}`, nil))
+	body := w.Body.String()
+	// 7days was asked for at 1699395200 and that's what it says.
+	if !strings.Contains(body, `"chrono_original_timestamp":"2023-11-07T22:13:20Z"`) || !strings.Contains(body, `"chrono_shift":"168h"`) {
+		t.Errorf("7days not audited: %s", body)
+	}
+	if strings.Count(body, "chrono_original_timestamp") != 4 {
+		t.Errorf("want exactly the four historical windows audited: %s", body)
+	}
+}
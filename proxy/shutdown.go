@@ -0,0 +1,64 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/shutdown.go
+package proxy
+
+import (
+	"context"
+	"log"
+)
+
+// Landing the time machine gently 🛬
+//
+// On SIGTERM/SIGINT main stops the listener first (http.Server.Shutdown
+// waits for requests already being answered), then calls Drain for the
+// background jobs, which aren't tied to any connection. Both share one
+// drain_timeout budget; whatever is still running when it runs out gets
+// cancelled rather than left to be killed mid-write.
+
+// Drain waits for running background jobs to finish, cancelling any that
+// are still going when ctx is done. It returns ctx.Err() if it had to.
+func (p *ChronoProxy) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.jobs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	n := p.jobs.cancelRunning()
+	log.Printf("Drain timed out, cancelled %d running jobs", n)
+	<-done // cancelled jobs wind down quickly
+	return ctx.Err()
+}
+
+// cancelRunning cancels every job that hasn't finished and says how many.
+func (s *jobStore) cancelRunning() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, j := range s.jobs {
+		if _, finished := j.finishedAt(); !finished {
+			j.cancel()
+			n++
+		}
+	}
+	return n
+}
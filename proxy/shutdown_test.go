@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForJobsThenCancels(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	p := NewChronoProxy()
+	submit := func() {
+		req := httptest.NewRequest("POST", "/x_1"+jobsPath, strings.NewReader("query=up"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		p.handleJobs(w, req, upstream.URL, jobsPath)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("submit: got %d", w.Code)
+		}
+	}
+
+	if err := p.Drain(context.Background()); err != nil {
+		t.Fatalf("nothing running: Drain = %v", err)
+	}
+
+	submit()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("stuck job: Drain = %v, want deadline exceeded", err)
+	}
+	for _, j := range p.jobs.jobs {
+		if st := j.status().State; st != jobCancelled {
+			t.Errorf("job left %s after drain, want cancelled", st)
+		}
+	}
+}
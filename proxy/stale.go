@@ -0,0 +1,300 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/stale.go
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Stale failover - yesterday's news beats no news during an outage 📰
+//
+// When an upstream falls over, every window fetch fails and dashboards go
+// blank right when people are staring at them. With stale_on_error on, we
+// remember the last good answer for each window of each query, and when a
+// fetch fails outright (couldn't connect, timed out, or got back something
+// that isn't Prometheus JSON) we serve that instead:
+//
+//   - its series carry chrono_stale="true", and so do synthetics built
+//     from it (lastMonthAverage is only stale if a past window was)
+//   - the response's warnings say which windows are stale and how old
+//   - the timestamps are the real ones - old data looks old
+//
+// An upstream that answers with a proper Prometheus error isn't down, so
+// that error stands. Copies older than stale_max_age aren't used, and only
+// the stale_cache_entries most recently fetched windows are kept, skipping
+// any too big to be worth holding on to.
+
+const (
+	staleLabel     = "chrono_stale"
+	maxStalePoints = 200000 // bigger windows aren't kept
+)
+
+// staleEntry is one window's last good answer.
+type staleEntry struct {
+	key     string
+	series  []model.Series
+	fetched time.Time
+}
+
+// staleCache is a small LRU of window answers.
+type staleCache struct {
+	mu      sync.Mutex
+	max     int
+	maxAge  time.Duration
+	order   *list.List // front = most recently stored
+	entries map[string]*list.Element
+}
+
+// newStaleCache returns nil when stale_on_error is off.
+func newStaleCache(config Config) *staleCache {
+	if !config.StaleOnError || config.StaleCacheEntries <= 0 {
+		return nil
+	}
+	return &staleCache{
+		max:     config.StaleCacheEntries,
+		maxAge:  config.StaleMaxAge,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// put remembers series as the latest answer for key. Safe on a nil cache.
+func (c *staleCache) put(key string, series []model.Series, now time.Time) {
+	if c == nil || len(series) == 0 {
+		return
+	}
+	points := 0
+	for _, s := range series {
+		points += len(s.Points)
+	}
+	if points > maxStalePoints {
+		return
+	}
+	kept := make([]model.Series, len(series))
+	for i, s := range series {
+		kept[i] = s.Clone() // the pipeline goes on to mutate the originals
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&staleEntry{key: key, series: kept, fetched: now})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*staleEntry).key)
+	}
+}
+
+// get returns a copy of key's last answer, if there is one young enough.
+func (c *staleCache) get(key string, now time.Time) ([]model.Series, time.Duration, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	entry := el.Value.(*staleEntry)
+	age := now.Sub(entry.fetched)
+	if c.maxAge > 0 && age > c.maxAge {
+		return nil, 0, false
+	}
+	out := make([]model.Series, len(entry.series))
+	for i, s := range entry.series {
+		out[i] = s.Clone()
+	}
+	return out, age, true
+}
+
+// len is how many answers are held. Safe on a nil cache.
+func (c *staleCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// staleKey names one window of one query, whatever time it was asked at.
+// Upstreams that see the client's own credentials get a key per client, so
+// nobody is served somebody else's answer.
+func staleKey(ctx context.Context, endpoint, tf string, params url.Values) string {
+	q := maps.Clone(params)
+	for _, k := range []string{"time", "start", "end"} {
+		delete(q, k)
+	}
+	key := endpoint + "\x00" + tf + "\x00" + q.Encode()
+	if u := upstreamFrom(ctx); u != nil && u.auth != nil && u.auth.PassAuthorization {
+		sum := sha256.Sum256([]byte(clientAuthorizationFrom(ctx)))
+		key += "\x00" + hex.EncodeToString(sum[:8])
+	}
+	return key
+}
+
+// staleFallback is what a failed window fetch turns into: the last good
+// answer when there is one, nil otherwise.
+func (p *ChronoProxy) staleFallback(ctx context.Context, key, tf string) []model.Series {
+	if p.stale == nil {
+		return nil
+	}
+	series, age, ok := p.stale.get(key, p.clock.Now())
+	if !ok {
+		p.cacheLookups.inc("stale_windows", "miss")
+		return nil
+	}
+	p.cacheLookups.inc("stale_windows", "hit")
+	staleWindowsFrom(ctx).add(tf, age)
+	return series
+}
+
+// windowFallback is what a failed window fetch turns into: the stale copy
+// if there is one, and otherwise nothing, recorded as a failure (see
+// failures.go). An upstream that answered with an error gets no stale copy.
+func (p *ChronoProxy) windowFallback(ctx context.Context, key, tf string, err error) []model.Series {
+	if !isUpstreamError(err) {
+		if series := p.staleFallback(ctx, key, tf); series != nil {
+			return series
+		}
+	}
+	windowFailed(ctx, tf, err)
+	return nil
+}
+
+// staleWindows collects which windows of one evaluation were served stale.
+type staleWindows struct {
+	mu   sync.Mutex
+	ages map[string]time.Duration
+}
+
+// add is safe to call on nil.
+func (s *staleWindows) add(tf string, age time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ages == nil {
+		s.ages = make(map[string]time.Duration)
+	}
+	s.ages[tf] = age
+}
+
+type staleWindowsKey struct{}
+
+func withStaleWindows(ctx context.Context, s *staleWindows) context.Context {
+	return context.WithValue(ctx, staleWindowsKey{}, s)
+}
+
+func staleWindowsFrom(ctx context.Context) *staleWindows {
+	s, _ := ctx.Value(staleWindowsKey{}).(*staleWindows)
+	return s
+}
+
+// markStale labels everything built from a stale window and says so in the
+// warnings. Series from fresh windows (and synthetics that only used fresh
+// ones) are left alone.
+func (p *ChronoProxy) markStale(ctx context.Context, series []model.Series, stale *staleWindows) {
+	stale.mu.Lock()
+	defer stale.mu.Unlock()
+	if len(stale.ages) == 0 {
+		return
+	}
+	isStale := func(tf string) bool {
+		if _, ok := stale.ages[tf]; ok {
+			return true
+		}
+		for _, src := range p.provenanceFor(tf).SourceWindows {
+			if _, ok := stale.ages[src.Timeframe]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range series {
+		if isStale(s.Labels["chrono_timeframe"]) {
+			s.Labels[staleLabel] = "true"
+		}
+	}
+
+	names := make([]string, 0, len(stale.ages))
+	for tf := range stale.ages {
+		names = append(names, tf)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, tf := range names {
+		parts[i] = fmt.Sprintf("%s (%s old)", tf, stale.ages[tf].Round(time.Second))
+	}
+	warningsFrom(ctx).add("upstream unavailable, serving cached data for " + strings.Join(parts, ", "))
+}
+
+// warningList collects messages for the response's "warnings", the way
+// Prometheus reports things that went wrong without failing the query.
+type warningList struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+// add is safe to call on nil.
+func (l *warningList) add(msg string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+// list is safe to call on nil.
+func (l *warningList) list() []string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+type warningsKey struct{}
+
+func withWarnings(ctx context.Context, l *warningList) context.Context {
+	return context.WithValue(ctx, warningsKey{}, l)
+}
+
+func warningsFrom(ctx context.Context) *warningList {
+	l, _ := ctx.Value(warningsKey{}).(*warningList)
+	return l
+}
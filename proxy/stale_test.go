@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestStaleFailover(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.StaleOnError = true
+	config.StaleMaxAge = 10 * time.Minute
+	p := NewChronoProxyWithConfig(config)
+	clock := FixedClock(time.Unix(1700000000, 0))
+	p.SetClock(clock)
+
+	type response struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+			} `json:"result"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	query := func() response {
+		w := httptest.NewRecorder()
+		q := url.QueryEscape(`up{chrono_timeframe="current"}`)
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?query="+q, nil))
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("bad response %q: %v", w.Body.String(), err)
+		}
+		return resp
+	}
+
+	if resp := query(); len(resp.Data.Result) != 1 || resp.Data.Result[0].Metric[staleLabel] != "" || resp.Warnings != nil {
+		t.Fatalf("healthy upstream: %+v", resp)
+	}
+
+	fake.Close() // outage
+	p.SetClock(FixedClock(time.Unix(1700000000+120, 0)))
+	resp := query()
+	if len(resp.Data.Result) != 1 || resp.Data.Result[0].Metric[staleLabel] != "true" {
+		t.Errorf("outage: want the cached series marked stale, got %+v", resp.Data.Result)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "current (2m0s old)") {
+		t.Errorf("warnings = %q", resp.Warnings)
+	}
+
+	p.SetClock(FixedClock(time.Unix(1700000000+3600, 0)))
+	if resp := query(); len(resp.Data.Result) != 0 || len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "window current left out") {
+		t.Errorf("past stale_max_age: want nothing but the failure, got %+v", resp)
+	}
+}
+
+func TestStaleCacheEvictsOldest(t *testing.T) {
+	config := DefaultConfig
+	config.StaleOnError = true
+	config.StaleCacheEntries = 2
+	c := newStaleCache(config)
+	now := time.Unix(1700000000, 0)
+	one := []model.Series{{Labels: map[string]string{"__name__": "up"}, Points: []model.Point{{T: 1, V: 1}}}}
+	c.put("a", one, now)
+	c.put("b", one, now)
+	c.put("c", one, now)
+	if _, _, ok := c.get("a", now); ok {
+		t.Error("a should have been evicted")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, _, ok := c.get(key, now); !ok {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+
+	got, _, _ := c.get("b", now)
+	got[0].Labels["mutated"] = "yes"
+	if again, _, _ := c.get("b", now); again[0].Labels["mutated"] != "" {
+		t.Error("callers must get their own copy")
+	}
+
+	if newStaleCache(DefaultConfig) != nil {
+		t.Error("stale_on_error is off by default")
+	}
+}
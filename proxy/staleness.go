@@ -0,0 +1,122 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/staleness.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Current window staleness - is it flat, or has it stopped? 🪦
+//
+// When an exporter stops reporting, its current series just ends, five
+// minutes of lookback after the last scrape. The past windows carry on
+// regardless, so lastMonthAverage is still there and the comparison
+// synthetics still draw something; on a dashboard it looks much like a
+// quiet metric.
+//
+// With max_staleness (or chrono_max_staleness=10m on one request) a range
+// query checks every current series' newest sample against the last step
+// of the range, capped at now. A series that hasn't had one for longer
+// than max_staleness gets a warning naming it, so "flat" and "gone" can be
+// told apart. Instant queries aren't checked: Prometheus stamps every
+// sample there with the evaluation time, however old it really is.
+
+const maxStalenessParam = "chrono_max_staleness"
+
+// maxStaleness is the threshold for this request (0 = don't check),
+// taking chrono_max_staleness out of params.
+func (p *ChronoProxy) maxStaleness(params url.Values) (time.Duration, error) {
+	raw := params.Get(maxStalenessParam)
+	params.Del(maxStalenessParam)
+	if raw == "" {
+		return p.config.MaxStaleness, nil
+	}
+	if raw == "0" {
+		return 0, nil
+	}
+	d, err := parsePromDuration(raw)
+	if err != nil || d < 0 {
+		return 0, &badQueryError{msg: fmt.Sprintf("%s should be a duration like 10m, got %q", maxStalenessParam, raw)}
+	}
+	return d, nil
+}
+
+// staleCurrent wraps a range fetch so current series whose newest sample
+// is older than maxAge at the range's last step are warned about.
+func staleCurrent(fetch windowFetcher, maxAge time.Duration) windowFetcher {
+	return func(ctx context.Context, p *ChronoProxy, wins []window, params url.Values, endpoint, command string) ([]model.Series, error) {
+		all, err := fetch(ctx, p, wins, params, endpoint, command)
+		if err != nil {
+			return nil, err
+		}
+		now := p.clock.Now()
+		if w := staleCurrentWarning(all, lastStep(params, now), maxAge); w != "" {
+			warningsFrom(ctx).add(w)
+		}
+		return all, nil
+	}
+}
+
+// lastStep is the Unix ms of the last step a range query evaluates at,
+// or now if the range runs past it.
+func lastStep(params url.Values, now time.Time) int64 {
+	start := parseTimeMs(params.Get("start"), now)
+	end := parseTimeMs(params.Get("end"), now)
+	if nowMs := now.UnixMilli(); end > nowMs {
+		end = nowMs
+	}
+	step, err := parsePromDuration(params.Get("step"))
+	if err != nil || step < time.Millisecond || end < start {
+		return end
+	}
+	return start + (end-start)/step.Milliseconds()*step.Milliseconds()
+}
+
+// staleCurrentWarning says which current series in all haven't had a
+// sample in the maxAge before at, or "" if none.
+func staleCurrentWarning(all []model.Series, at int64, maxAge time.Duration) string {
+	stale, oldest := 0, model.Series{}
+	var oldestAge int64
+	for _, s := range all {
+		if s.Labels["chrono_timeframe"] != "current" {
+			continue
+		}
+		last, ok := s.Last()
+		if !ok {
+			continue
+		}
+		if age := at - last.T; age > maxAge.Milliseconds() {
+			stale++
+			if age > oldestAge {
+				oldest, oldestAge = s, age
+			}
+		}
+	}
+	if stale == 0 {
+		return ""
+	}
+	labels := copyMetric(oldest.Labels)
+	delete(labels, "chrono_timeframe")
+	return fmt.Sprintf("%d current series stopped reporting more than %s before the end of the range (longest: %s, %s ago); comparisons against them compare against a stopped series, not a flat one",
+		stale, maxAge, formatLabels(labels), time.Duration(oldestAge)*time.Millisecond)
+}
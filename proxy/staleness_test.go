@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestStaleCurrentWarning(t *testing.T) {
+	all := []model.Series{
+		{Labels: map[string]string{"job": "flat", "chrono_timeframe": "current"}, Points: []model.Point{{T: 0, V: 1}, {T: 600000, V: 1}}},
+		{Labels: map[string]string{"job": "gone", "chrono_timeframe": "current"}, Points: []model.Point{{T: 0, V: 1}, {T: 60000, V: 1}}},
+		{Labels: map[string]string{"job": "gone", "chrono_timeframe": "7days"}, Points: []model.Point{{T: 600000, V: 1}}},
+	}
+	w := staleCurrentWarning(all, 600000, 5*time.Minute)
+	if !strings.HasPrefix(w, "1 current series") || !strings.Contains(w, `{job="gone"}, 9m0s ago`) {
+		t.Errorf("warning = %q", w)
+	}
+	if w := staleCurrentWarning(all, 600000, 10*time.Minute); w != "" {
+		t.Errorf("nothing is older than 10m, got %q", w)
+	}
+}
+
+func TestLastStep(t *testing.T) {
+	now := time.Unix(1700001000, 0)
+	for raw, want := range map[string]int64{
+		"start=1700000000&end=1700000590&step=60": 1700000540000,
+		"start=1700000000&end=1700009999&step=60": 1700000960000,
+		"start=1700000000&end=1700000590":         1700000590000,
+	} {
+		params, _ := url.ParseQuery(raw)
+		if got := lastStep(params, now); got != want {
+			t.Errorf("lastStep(%s) = %d; want %d", raw, got, want)
+		}
+	}
+}
+
+func TestMaxStaleness(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query_range", 0, []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up","job":"node"},"values":[[1700000000,"1"],[1700000060,"1"]]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	get := func(extra string) (int, []string) {
+		w := httptest.NewRecorder()
+		q := url.QueryEscape(`up{chrono_timeframe="current"}`)
+		NewChronoProxy().ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query_range?start=1700000000&end=1700000600&step=60&query="+q+extra, nil))
+		var resp struct {
+			Warnings []string `json:"warnings"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Warnings
+	}
+	if code, warnings := get(""); code != 200 || len(warnings) != 0 {
+		t.Errorf("off by default: %d %v", code, warnings)
+	}
+	code, warnings := get("&" + maxStalenessParam + "=5m")
+	if code != 200 || len(warnings) != 1 || !strings.Contains(warnings[0], `{__name__="up",job="node"}, 9m0s ago`) {
+		t.Errorf("stale series: %d %v", code, warnings)
+	}
+	if code, warnings := get("&" + maxStalenessParam + "=10m"); code != 200 || len(warnings) != 0 {
+		t.Errorf("within 10m: %d %v", code, warnings)
+	}
+	for _, req := range fake.Requests() {
+		if req.Params.Get(maxStalenessParam) != "" {
+			t.Errorf("%s leaked upstream", maxStalenessParam)
+		}
+	}
+	if code, _ := get("&" + maxStalenessParam + "=soon"); code != 400 {
+		t.Errorf("bad duration: status %d; want 400", code)
+	}
+}
@@ -0,0 +1,208 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/state.go
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Warm starts - a restarted Chronotheus shouldn't wake up with amnesia.
+// With state_dir set we keep a small JSON file there holding:
+//
+//   - the label values cache (entries still inside their TTL come back, so
+//     Grafana's dropdowns don't all stampede a recovering upstream at once)
+//   - request/error totals and the average latency
+//   - upstream error, cache, rejection and plugin error counters
+//
+// Histograms start from scratch - they're cheap to refill and Prometheus
+// copes with resets anyway. The file is rewritten every state_save_interval
+// and once more on shutdown; a missing or unreadable file just means a cold
+// start, never a failed one.
+
+const (
+	stateFileName = "state.json"
+	stateVersion  = 2 // 2: label values are keyed per upstream, tenant and match[]
+)
+
+// savedState is what goes on disk. Bump stateVersion when it changes shape.
+type savedState struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+
+	Requests        uint64    `json:"requests"`
+	Errors          uint64    `json:"errors"`
+	LastRequestTime time.Time `json:"last_request_time"`
+	AverageLatency  float64   `json:"average_latency"`
+
+	Counters    map[string][]CounterSnapshot `json:"counters"`
+	LabelValues map[string]savedLabelValues  `json:"label_values"`
+}
+
+type savedLabelValues struct {
+	Data     []interface{} `json:"data"`
+	CachedAt time.Time     `json:"cached_at"`
+}
+
+// persistedCounters names the counter families that survive a restart.
+// The names are the on-disk keys, so don't rename them casually.
+func (p *ChronoProxy) persistedCounters() map[string]*counterVec {
+	return map[string]*counterVec{
+		"upstream_errors":    p.upstreamErrors,
+		"cache_lookups":      p.cacheLookups,
+		"rejections":         p.rejections,
+		"plugin_errors":      p.pluginErrors,
+		"timeframe_requests": p.timeframeRequests,
+	}
+}
+
+func (p *ChronoProxy) statePath() string {
+	return filepath.Join(p.config.StateDir, stateFileName)
+}
+
+// SaveState writes the current state to state_dir. It writes to a temp file
+// and renames it into place, so a crash mid-save leaves the old file intact.
+// Without a state_dir it does nothing.
+func (p *ChronoProxy) SaveState() error {
+	if p.config.StateDir == "" {
+		return nil
+	}
+	m := p.GetMetrics()
+	st := savedState{
+		Version:         stateVersion,
+		SavedAt:         p.clock.Now(),
+		Requests:        m.RequestCount,
+		Errors:          m.ErrorCount,
+		LastRequestTime: m.LastRequestTime,
+		AverageLatency:  m.AverageLatency,
+		Counters:        make(map[string][]CounterSnapshot),
+		LabelValues:     make(map[string]savedLabelValues),
+	}
+	for name, vec := range p.persistedCounters() {
+		st.Counters[name] = vec.snapshot()
+	}
+	labelValuesCacheMux.RLock()
+	for label, entry := range labelValuesCache {
+		st.LabelValues[label] = savedLabelValues{Data: entry.data, CachedAt: entry.timestamp}
+	}
+	labelValuesCacheMux.RUnlock()
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("encoding state: %w", err)
+	}
+	if err := os.MkdirAll(p.config.StateDir, 0o755); err != nil {
+		return fmt.Errorf("creating state dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(p.config.StateDir, stateFileName+".*")
+	if err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("saving state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), p.statePath()); err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	return nil
+}
+
+// LoadState restores whatever SaveState left behind. Call it before serving
+// traffic - counters are added to, not replaced. A missing file is a normal
+// first start and not an error.
+func (p *ChronoProxy) LoadState() error {
+	if p.config.StateDir == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading state: %w", err)
+	}
+	var st savedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("parsing state %s: %w", p.statePath(), err)
+	}
+	if st.Version != stateVersion {
+		return fmt.Errorf("state %s has version %d, want %d - starting cold", p.statePath(), st.Version, stateVersion)
+	}
+
+	p.metricsMux.Lock()
+	p.metrics.RequestCount += st.Requests
+	p.metrics.ErrorCount += st.Errors
+	if st.LastRequestTime.After(p.metrics.LastRequestTime) {
+		p.metrics.LastRequestTime = st.LastRequestTime
+	}
+	p.metrics.AverageLatency = st.AverageLatency
+	p.metricsMux.Unlock()
+
+	vecs := p.persistedCounters()
+	for name, snaps := range st.Counters {
+		if vec, ok := vecs[name]; ok {
+			vec.restore(snaps)
+		}
+	}
+
+	// Stale cache entries would only be thrown away on first use, so
+	// don't bother bringing them back.
+	labelValuesCacheMux.Lock()
+	for label, saved := range st.LabelValues {
+		if p.since(saved.CachedAt) >= labelValuesCacheTTL {
+			continue
+		}
+		if entry, ok := labelValuesCache[label]; ok && !entry.timestamp.Before(saved.CachedAt) {
+			continue
+		}
+		labelValuesCache[label] = labelValuesCacheEntry{data: saved.Data, timestamp: saved.CachedAt}
+	}
+	labelValuesCacheMux.Unlock()
+	return nil
+}
+
+// PersistState saves state every state_save_interval until ctx is done.
+// Run it in its own goroutine, and call SaveState once more after the
+// server has stopped so the last few minutes aren't lost.
+func (p *ChronoProxy) PersistState(ctx context.Context) {
+	if p.config.StateDir == "" || p.config.StateSaveInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.config.StateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.SaveState(); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+		}
+	}
+}
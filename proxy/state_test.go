@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig
+	config.StateDir = dir
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	before := NewChronoProxyWithConfig(config)
+	before.SetClock(FixedClock(now))
+	before.updateMetrics(now, nil)
+	before.updateMetrics(now, os.ErrClosed)
+	before.upstreamErrors.inc("prom:9090", "status_5xx")
+	before.pluginErrors.inc("prediction")
+	labelValuesCacheMux.Lock()
+	labelValuesCache["state_test_fresh"] = labelValuesCacheEntry{data: []interface{}{"a"}, timestamp: now.Add(-time.Minute)}
+	labelValuesCache["state_test_stale"] = labelValuesCacheEntry{data: []interface{}{"b"}, timestamp: now.Add(-time.Hour)}
+	labelValuesCacheMux.Unlock()
+	if err := before.SaveState(); err != nil {
+		t.Fatalf("SaveState: %v", err)
+	}
+
+	labelValuesCacheMux.Lock()
+	delete(labelValuesCache, "state_test_fresh")
+	delete(labelValuesCache, "state_test_stale")
+	labelValuesCacheMux.Unlock()
+
+	after := NewChronoProxyWithConfig(config)
+	after.SetClock(FixedClock(now.Add(time.Minute)))
+	if err := after.LoadState(); err != nil {
+		t.Fatalf("LoadState: %v", err)
+	}
+	if m := after.GetMetrics(); m.RequestCount != 2 || m.ErrorCount != 1 {
+		t.Errorf("requests=%d errors=%d; want 2 and 1", m.RequestCount, m.ErrorCount)
+	}
+	if got := after.upstreamErrors.snapshot(); !reflect.DeepEqual(got, before.upstreamErrors.snapshot()) {
+		t.Errorf("upstream errors = %v", got)
+	}
+	if got := after.pluginErrors.snapshot(); len(got) != 1 || got[0].Labels["plugin"] != "prediction" || got[0].Value != 1 {
+		t.Errorf("plugin errors = %v", got)
+	}
+
+	labelValuesCacheMux.Lock()
+	defer labelValuesCacheMux.Unlock()
+	if entry, ok := labelValuesCache["state_test_fresh"]; !ok || !reflect.DeepEqual(entry.data, []interface{}{"a"}) {
+		t.Errorf("fresh cache entry not restored: %v", entry)
+	}
+	if _, ok := labelValuesCache["state_test_stale"]; ok {
+		t.Error("expired cache entry should not come back")
+	}
+	delete(labelValuesCache, "state_test_fresh")
+}
+
+func TestLoadStateColdStarts(t *testing.T) {
+	config := DefaultConfig
+	config.StateDir = t.TempDir()
+	if err := NewChronoProxyWithConfig(config).LoadState(); err != nil {
+		t.Errorf("missing state file should be a plain cold start, got %v", err)
+	}
+
+	os.WriteFile(filepath.Join(config.StateDir, stateFileName), []byte(`{"version":99}`), 0o644)
+	p := NewChronoProxyWithConfig(config)
+	if err := p.LoadState(); err == nil {
+		t.Error("expected an error for a state file from another version")
+	}
+	if m := p.GetMetrics(); m.RequestCount != 0 {
+		t.Errorf("nothing should be restored from a mismatched file, got %d requests", m.RequestCount)
+	}
+}
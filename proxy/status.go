@@ -0,0 +1,126 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/status.go
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Status pages - the upstream's vital signs, with ours stapled on 🩺
+//
+// Prometheus status dashboards read /api/v1/status/tsdb, /flags and
+// /runtimeinfo. Pointed at Chronotheus they'd otherwise get whatever the
+// upstream says and nothing about the proxy in between, so we pass the
+// upstream's answer through and add a little about ourselves:
+//
+//   - tsdb and runtimeinfo get a "chronotheus" object in data: loaded
+//     plugins, entries in each cache, background jobs held
+//   - flags is a flat map of strings, so we add "chronotheus.*" flags
+//     instead of an object that would upset its readers
+//
+// An upstream error goes back untouched, so it's still clear whose it was.
+
+const (
+	tsdbStatusPath    = "/api/v1/status/tsdb"
+	flagsStatusPath   = "/api/v1/status/flags"
+	runtimeStatusPath = "/api/v1/status/runtimeinfo"
+)
+
+// chronoStatus is what we add about ourselves.
+type chronoStatus struct {
+	Plugins   []string       `json:"plugins"`
+	Caches    map[string]int `json:"caches"` // entries held per cache
+	Jobs      int            `json:"jobs"`
+	Upstreams []string       `json:"upstreams"` // registered names
+}
+
+func (p *ChronoProxy) chronoStatus() chronoStatus {
+	labelValuesCacheMux.RLock()
+	labelValues := len(labelValuesCache)
+	labelValuesCacheMux.RUnlock()
+	return chronoStatus{
+		Plugins: p.plugins.Loaded(),
+		Caches: map[string]int{
+			"label_values":  labelValues,
+			"stale_windows": p.stale.len(),
+			"capabilities":  len(p.caps.snapshot()),
+		},
+		Jobs:      p.jobs.len(),
+		Upstreams: p.upstreams.names(),
+	}
+}
+
+// flags turns chronoStatus into Prometheus-style flag strings.
+func (s chronoStatus) flags() map[string]string {
+	out := map[string]string{
+		"chronotheus.plugins":   strings.Join(s.Plugins, ","),
+		"chronotheus.jobs":      strconv.Itoa(s.Jobs),
+		"chronotheus.upstreams": strings.Join(s.Upstreams, ","),
+	}
+	for name, n := range s.Caches {
+		out["chronotheus.cache."+name] = strconv.Itoa(n)
+	}
+	return out
+}
+
+// handleStatus serves the three status endpoints.
+func (p *ChronoProxy) handleStatus(w http.ResponseWriter, r *http.Request, upstream, path string) {
+	if DebugMode.Load() {
+		log.Printf("[DEBUG] handleStatus: %s %s", r.Method, r.URL.Path)
+	}
+
+	resp, err := p.getUpstream(r.Context(), upstream+path+"?"+buildQueryString(parseClientParams(r)))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "unavailable", "upstream request failed: "+err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "unavailable", "upstream request failed: "+err.Error())
+		return
+	}
+
+	var out map[string]interface{}
+	var data map[string]interface{}
+	if resp.StatusCode == http.StatusOK && model.DecodeJSON(body, &out) == nil && out["status"] == "success" {
+		data, _ = out["data"].(map[string]interface{})
+	}
+	if data == nil {
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		return
+	}
+
+	status := p.chronoStatus()
+	if path == flagsStatusPath {
+		for k, v := range status.flags() {
+			data[k] = v
+		}
+	} else {
+		data["chronotheus"] = status
+	}
+	writeJSONRaw(w, out)
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestStatusEndpointsAugmented(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve(tsdbStatusPath, 0, []byte(`{"status":"success","data":{"headStats":{"numSeries":42}}}`))
+	fake.Serve(flagsStatusPath, 0, []byte(`{"status":"success","data":{"storage.tsdb.retention.time":"15d"}}`))
+	fake.Serve(runtimeStatusPath, 0, []byte(`{"status":"error","errorType":"internal","error":"nope"}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxyWithConfig(DefaultConfig)
+
+	ask := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+path, nil))
+		return w
+	}
+
+	var tsdb struct {
+		Data struct {
+			HeadStats   map[string]int `json:"headStats"`
+			Chronotheus chronoStatus   `json:"chronotheus"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(ask(tsdbStatusPath).Body.Bytes(), &tsdb); err != nil {
+		t.Fatal(err)
+	}
+	if tsdb.Data.HeadStats["numSeries"] != 42 {
+		t.Errorf("upstream data lost: %+v", tsdb.Data)
+	}
+	if _, ok := tsdb.Data.Chronotheus.Caches["label_values"]; !ok || tsdb.Data.Chronotheus.Plugins == nil {
+		t.Errorf("chronotheus status = %+v", tsdb.Data.Chronotheus)
+	}
+
+	var flags struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(ask(flagsStatusPath).Body.Bytes(), &flags); err != nil {
+		t.Fatal(err)
+	}
+	if flags.Data["storage.tsdb.retention.time"] != "15d" || flags.Data["chronotheus.cache.stale_windows"] != "0" {
+		t.Errorf("flags = %v", flags.Data)
+	}
+
+	if w := ask(runtimeStatusPath); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "chronotheus") {
+		t.Errorf("an upstream error should pass through untouched: %d %s", w.Code, w.Body.String())
+	}
+}
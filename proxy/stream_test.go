@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestDecodeRangeStreamSkipsUnknownKeys(t *testing.T) {
+	body := `{"warnings":["a",{"b":[1,2]}],"data":{"extra":{"x":[[]]},"resultType":"matrix",` +
+		`"result":[{"values":[[60,"1"],["bad","2"],[120,"3"]],"metric":{"job":"api"}}]},"status":"success"}`
+	got, skipped, err := decodeRange([]byte(body), window{name: "7days", offset: 10}, "cmd")
+	if err != nil || skipped != 1 {
+		t.Fatal(skipped, err)
+	}
+	if len(got) != 1 || len(got[0].Points) != 2 || got[0].Points[1] != (model.Point{T: 130000, V: 3}) {
+		t.Fatalf("got %+v", got)
+	}
+	if l := got[0].Labels; l["job"] != "api" || l["chrono_timeframe"] != "7days" || l["_command"] != "cmd" {
+		t.Errorf("labels = %v", l)
+	}
+
+	for _, body := range []string{`null`, `{"data":null}`, `{"data":{"result":null}}`} {
+		if got, _, err := decodeRange([]byte(body), window{name: "current"}, ""); err != nil || len(got) != 0 {
+			t.Errorf("%s: got %v, %v; want nothing", body, got, err)
+		}
+	}
+	for _, body := range []string{`[]`, `{"data":{"result":{}}}`, `{"data":{"result":[{"values":`} {
+		if _, _, err := decodeRange([]byte(body), window{name: "current"}, ""); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
+
+// Series should come out while the body is still arriving - that's the
+// whole point of streaming.
+func TestDecodeRangeStreamIsIncremental(t *testing.T) {
+	pr, pw := io.Pipe()
+	emitted := make(chan model.Series)
+	done := make(chan error, 1)
+	go func() {
+		_, err := decodeRangeStream(pr, window{name: "current"}, "", func(s model.Series) error { emitted <- s; return nil })
+		done <- err
+	}()
+
+	io.WriteString(pw, `{"status":"success","data":{"resultType":"matrix","result":[`)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			io.WriteString(pw, ",")
+		}
+		fmt.Fprintf(pw, `{"metric":{"i":"%d"},"values":[[60,"%d"]]}`, i, i)
+		// The next write blocks until this series has been handed over.
+		if s := <-emitted; s.Labels["i"] != fmt.Sprint(i) {
+			t.Fatalf("series %d came out as %v", i, s.Labels)
+		}
+	}
+	io.WriteString(pw, strings.Repeat(" ", 10)+`]}}`)
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
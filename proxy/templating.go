@@ -0,0 +1,232 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/templating.go
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET/POST .../api/v1/chrono/template/query and .../template/query_range -
+// Grafana's $variables, without Grafana 🧩
+//
+// Scripts and report builders that lift queries out of dashboard JSON get
+// rate(http_requests_total{env="$env"}[$__rate_interval]) and would have to
+// reimplement Grafana's templating to run it. These take the query as it
+// sits in the dashboard, fill the variables in, and then carry on exactly
+// like query and query_range.
+//
+// Values come the way Grafana puts them in dashboard URLs, var-<name>=...
+// (repeat it for several values), falling back to template_variables in
+// the config. $name, ${name} and [[name]] all work, and so does
+// ${name:format} with the formats below. One value goes in as it is;
+// several become a regex alternation, (a|b), ready for =~. $__all, or
+// All, means .*.
+//
+//   raw      as is, several joined with commas
+//   regex    (a|b), regex-escaped - the default for several values
+//   pipe     a|b
+//   csv      a,b
+//
+// $__interval (and $__interval_ms) is the step, $__range (and $__range_s,
+// $__range_ms) is end - start, and $__rate_interval is what Grafana makes
+// of the step with its default 15s scrape interval. Send var-__interval=5m
+// to say otherwise. A variable with no value is a 400, not a query with a
+// hole in it. expand_only=true hands back the expanded query instead of
+// running it.
+
+const templatePath = "/api/v1/chrono/template/"
+
+// templateScrapeInterval is Grafana's default scrape interval, which
+// $__rate_interval is worked out from.
+const templateScrapeInterval = 15 * time.Second
+
+// templateVarRegex finds ${name}, ${name:format}, [[name]], [[name:format]]
+// and $name.
+var templateVarRegex = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)(?::([a-z]+))?\}|\[\[([a-zA-Z_][a-zA-Z0-9_]*)(?::([a-z]+))?\]\]|\$([a-zA-Z_][a-zA-Z0-9_]*)`)
+
+// handleTemplate answers .../api/v1/chrono/template/query(_range).
+func (p *ChronoProxy) handleTemplate(w http.ResponseWriter, r *http.Request, upstream, suffix string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	var isRange bool
+	switch strings.TrimPrefix(suffix, templatePath) {
+	case "query":
+	case "query_range":
+		isRange = true
+	default:
+		writeJSONError(w, http.StatusNotFound, "not_found", "template endpoints are "+templatePath+"query and "+templatePath+"query_range")
+		return
+	}
+
+	params := parseClientParams(r)
+	if params.Get("query") == "" {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", "query is required")
+		return
+	}
+	vars := p.templateVars(params, isRange)
+	expanded, err := expandTemplate(params.Get("query"), vars)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	expandOnly, _ := strconv.ParseBool(params.Get("expand_only"))
+	for k := range params {
+		if strings.HasPrefix(k, "var-") {
+			params.Del(k)
+		}
+	}
+	params.Del("expand_only")
+	params.Set("query", expanded)
+
+	if expandOnly {
+		writeJSONRaw(w, map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"query": expanded},
+		})
+		return
+	}
+
+	resultType, endpoint := "vector", "/api/v1/query"
+	if isRange {
+		resultType, endpoint = "matrix", "/api/v1/query_range"
+	}
+	provenance := p.provenanceMode(params)
+	warnings, trace := &warningList{}, &evalTrace{}
+	ctx := withTrace(withWarnings(withPriority(r.Context(), p.requestPriority(r)), warnings), trace)
+	merged, err := p.evaluate(ctx, params, upstream+endpoint, isRange)
+	if err != nil {
+		p.writeEvalError(w, err)
+		return
+	}
+	reportSeries(ctx, len(merged))
+	p.writeResult(w, resultType, merged, provenance, warnings.list(), trace.report())
+}
+
+// templateVars gathers every variable's values: the built-ins, then the
+// config's template_variables, then the request's var-<name>, later ones
+// winning.
+func (p *ChronoProxy) templateVars(params url.Values, isRange bool) map[string][]string {
+	vars := make(map[string][]string)
+	now := p.clock.Now()
+	if isRange {
+		if step, err := parsePromDuration(params.Get("step")); err == nil && step > 0 {
+			setIntervalVars(vars, step)
+		}
+	}
+	if params.Get("start") != "" && params.Get("end") != "" {
+		if d := parseTimeMs(params.Get("end"), now) - parseTimeMs(params.Get("start"), now); d >= 0 {
+			vars["__range_ms"] = []string{strconv.FormatInt(d, 10)}
+			vars["__range_s"] = []string{strconv.FormatInt(d/1000, 10)}
+			vars["__range"] = []string{promDuration(time.Duration(d) * time.Millisecond)}
+		}
+	}
+	for name, v := range p.config.TemplateVariables {
+		vars[name] = []string{v}
+	}
+	for k, v := range params {
+		if name := strings.TrimPrefix(k, "var-"); name != k && name != "" {
+			vars[name] = v
+			if name == "__interval" {
+				if d, err := parsePromDuration(v[0]); err == nil && d > 0 {
+					setIntervalVars(vars, d)
+				}
+			}
+		}
+	}
+	return vars
+}
+
+// setIntervalVars fills in $__interval and the variables made from it.
+func setIntervalVars(vars map[string][]string, interval time.Duration) {
+	rate := interval + templateScrapeInterval
+	if min := 4 * templateScrapeInterval; rate < min {
+		rate = min
+	}
+	vars["__interval"] = []string{promDuration(interval)}
+	vars["__interval_ms"] = []string{strconv.FormatInt(interval.Milliseconds(), 10)}
+	vars["__rate_interval"] = []string{promDuration(rate)}
+}
+
+// promDuration writes d the way PromQL reads it: whole seconds where it
+// can, milliseconds otherwise.
+func promDuration(d time.Duration) string {
+	if d%time.Second == 0 {
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	}
+	return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+}
+
+// expandTemplate fills every variable in query from vars.
+func expandTemplate(query string, vars map[string][]string) (string, error) {
+	var err error
+	expanded := templateVarRegex.ReplaceAllStringFunc(query, func(m string) string {
+		if err != nil {
+			return m
+		}
+		parts := templateVarRegex.FindStringSubmatch(m)
+		name, format := parts[1]+parts[3]+parts[5], parts[2]+parts[4] // whichever spelling matched
+		values, ok := vars[name]
+		if !ok || len(values) == 0 {
+			err = fmt.Errorf("no value for template variable $%s; send var-%s=...", name, name)
+			return m
+		}
+		var out string
+		out, err = formatTemplateValues(values, format)
+		return out
+	})
+	return expanded, err
+}
+
+// formatTemplateValues renders a variable's values in format ("" for
+// Grafana's Prometheus default).
+func formatTemplateValues(values []string, format string) (string, error) {
+	for _, v := range values {
+		if v == "$__all" || v == "All" {
+			return ".*", nil
+		}
+	}
+	switch format {
+	case "":
+		if len(values) == 1 {
+			return values[0], nil
+		}
+		fallthrough
+	case "regex":
+		escaped := make([]string, len(values))
+		for i, v := range values {
+			escaped[i] = regexp.QuoteMeta(v)
+		}
+		if len(escaped) == 1 {
+			return escaped[0], nil
+		}
+		return "(" + strings.Join(escaped, "|") + ")", nil
+	case "pipe":
+		return strings.Join(values, "|"), nil
+	case "csv", "raw":
+		return strings.Join(values, ","), nil
+	}
+	return "", fmt.Errorf("unknown template variable format %q; use raw, regex, pipe or csv", format)
+}
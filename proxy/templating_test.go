@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	vars := map[string][]string{
+		"env":      {"prod"},
+		"instance": {"a:9090", "b.example:9090"},
+		"job":      {"$__all"},
+	}
+	for in, want := range map[string]string{
+		`up{env="$env"}`:                   `up{env="prod"}`,
+		`up{env="${env}",x="[[env]]"}`:     `up{env="prod",x="prod"}`,
+		`up{instance=~"$instance"}`:        `up{instance=~"(a:9090|b\.example:9090)"}`,
+		`up{instance=~"${instance:pipe}"}`: `up{instance=~"a:9090|b.example:9090"}`,
+		`up{instance=~"${instance:csv}"}`:  `up{instance=~"a:9090,b.example:9090"}`,
+		`up{job=~"$job"}`:                  `up{job=~".*"}`,
+	} {
+		if got, err := expandTemplate(in, vars); err != nil || got != want {
+			t.Errorf("%s = %s, %v; want %s", in, got, err, want)
+		}
+	}
+	if _, err := expandTemplate(`up{env="$nope"}`, vars); err == nil || !strings.Contains(err.Error(), "var-nope") {
+		t.Errorf("unknown variable: %v", err)
+	}
+	if _, err := expandTemplate(`up{env="${env:json}"}`, vars); err == nil {
+		t.Error("unknown format should fail")
+	}
+}
+
+func TestTemplateEndpoint(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	config := DefaultConfig
+	config.TemplateVariables = map[string]string{"env": "staging"}
+	p := NewChronoProxyWithConfig(config)
+
+	expand := func(path, query, extra string) (int, string) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/chrono/template/"+path+"?expand_only=true&query="+url.QueryEscape(query)+extra, nil))
+		var resp struct {
+			Data struct {
+				Query string `json:"query"`
+			} `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data.Query
+	}
+
+	q := `sum(rate(http_requests_total{env="$env"}[$__rate_interval])) / $__range_s`
+	if code, got := expand("query_range", q, "&start=1700000000&end=1700003600&step=120"); code != http.StatusOK || got != `sum(rate(http_requests_total{env="staging"}[135s])) / 3600` {
+		t.Errorf("range: %d %s", code, got)
+	}
+	if _, got := expand("query", q, "&start=1700000000&end=1700003600&var-env=prod&var-__interval=5m"); got != `sum(rate(http_requests_total{env="prod"}[315s])) / 3600` {
+		t.Errorf("request values should win: %s", got)
+	}
+	if code, _ := expand("query", `up{env="$region"}`, ""); code != http.StatusBadRequest {
+		t.Errorf("missing variable: status %d", code)
+	}
+	if code, _ := expand("labels", "up", ""); code != http.StatusNotFound {
+		t.Errorf("unknown template endpoint: status %d", code)
+	}
+
+	fake.Serve("/api/v1/query", 0, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","env":"prod"},"value":[1700000000,"1"]}]}}`))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/chrono/template/query?time=1700000000&var-env=prod&query="+url.QueryEscape(`up{env="$env",chrono_timeframe="current"}`), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"chrono_timeframe":"current"`) {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	reqs := fake.Requests()
+	if len(reqs) == 0 || !strings.Contains(reqs[len(reqs)-1].Params.Get("query"), `env="prod"`) || reqs[len(reqs)-1].Params.Get("var-env") != "" {
+		t.Errorf("upstream got %+v", reqs)
+	}
+}
@@ -0,0 +1,235 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/tenants.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Tenants - one Chronotheus, several teams, no peeking 🏢
+//
+// Each tenant gets its own corner: the upstreams it may talk to, its own
+// rate limits, the timeframes it's shown and the plugins it may run:
+//
+//   tenants:
+//     - name: payments
+//       upstreams: [payments-prod, payments-staging]
+//       rate_limit: 50
+//       rate_limit_per_client: 5
+//       timeframes: [current, 7days, lastMonthAverage, compareAgainstLast28]
+//       plugins: [smooth]
+//
+// A request says which tenant it's for with the tenant_header
+// (X-Scope-OrgID by default, the same header Mimir and Loki use) or a path
+// prefix, /t/payments/payments-prod/api/v1/query. If it does both they have
+// to agree. Unknown tenants, upstreams outside the tenant's list, and legacy
+// /host_port/ prefixes get a 403; a timeframe or plugin outside its lists is
+// a 400. With no timeframes list a tenant sees them all, likewise plugins.
+// Ask for everything and the series it isn't allowed are quietly left out.
+//
+// The tenant's limits apply on top of the global ones, and quotas (see
+// quota.go) name tenants the same way. Requests that don't name a tenant
+// carry on as before, unless require_tenant is set.
+
+// TenantConfig is one tenant as it appears in the config file.
+type TenantConfig struct {
+	Name               string   `yaml:"name"`                            // tenant_header value, and the /t/<name>/ path prefix
+	Upstreams          []string `yaml:"upstreams"`                       // Registered upstreams it may use
+	RateLimit          float64  `yaml:"rate_limit,omitempty"`            // Requests/s from the whole tenant (0 = unlimited)
+	RateLimitPerClient float64  `yaml:"rate_limit_per_client,omitempty"` // Requests/s from each of its clients (0 = unlimited)
+	Timeframes         []string `yaml:"timeframes,omitempty"`            // chrono_timeframe values it's shown (empty = all)
+	Plugins            []string `yaml:"plugins,omitempty"`               // Plugins it may run (empty = all)
+}
+
+// tenantPathPrefix names the tenant in the path instead of a header.
+const tenantPathPrefix = "/t/"
+
+// validateTenants checks names are usable and unique, and that every tenant
+// has somewhere to go.
+func validateTenants(tenants []TenantConfig) error {
+	seen := make(map[string]bool, len(tenants))
+	for i, t := range tenants {
+		if !upstreamNameRegex.MatchString(t.Name) {
+			return fmt.Errorf("tenants[%d]: name %q must be a single path segment of letters, digits, '.', '-' or '_'", i, t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("tenant %q: defined more than once", t.Name)
+		}
+		seen[t.Name] = true
+		if len(t.Upstreams) == 0 {
+			return fmt.Errorf("tenant %q: needs at least one upstream", t.Name)
+		}
+		if t.RateLimit < 0 || t.RateLimitPerClient < 0 {
+			return fmt.Errorf("tenant %q: rate limits can't be negative", t.Name)
+		}
+	}
+	return nil
+}
+
+// tenant is one tenant's lists and buckets.
+type tenant struct {
+	config      TenantConfig
+	upstreams   map[string]bool
+	timeframes  map[string]bool // nil = all
+	plugins     map[string]bool // nil = all
+	limit       *rateLimiter    // The whole tenant, nil = unlimited
+	clientLimit *rateLimiter    // Per client address, nil = unlimited
+}
+
+func newTenant(c TenantConfig, burst int) *tenant {
+	set := func(names []string) map[string]bool {
+		if len(names) == 0 {
+			return nil
+		}
+		m := make(map[string]bool, len(names))
+		for _, n := range names {
+			m[n] = true
+		}
+		return m
+	}
+	return &tenant{
+		config:      c,
+		upstreams:   set(c.Upstreams),
+		timeframes:  set(c.Timeframes),
+		plugins:     set(c.Plugins),
+		limit:       newRateLimiter(c.RateLimit, burst),
+		clientLimit: newRateLimiter(c.RateLimitPerClient, burst),
+	}
+}
+
+// allowsUpstream says whether t may use the named upstream. A nil tenant
+// may use anything.
+func (t *tenant) allowsUpstream(name string) bool {
+	return t == nil || t.upstreams[name]
+}
+
+// allowsTimeframe says whether t is shown tf.
+func (t *tenant) allowsTimeframe(tf string) bool {
+	return t == nil || t.timeframes == nil || t.timeframes[tf]
+}
+
+// checkTimeframe is a 400 for a chrono_timeframe t isn't shown, nil when
+// tf is fine (or empty, which means all of them).
+func (t *tenant) checkTimeframe(tf string) error {
+	if tf != "" && !t.allowsTimeframe(tf) {
+		return &badQueryError{msg: fmt.Sprintf("tenant %q can't use chrono_timeframe=%q", t.config.Name, tf)}
+	}
+	return nil
+}
+
+// name is t's name, "" for no tenant.
+func (t *tenant) name() string {
+	if t == nil {
+		return ""
+	}
+	return t.config.Name
+}
+
+// allowsPlugin says whether t may run the named plugin.
+func (t *tenant) allowsPlugin(name string) bool {
+	return t == nil || t.plugins == nil || t.plugins[name]
+}
+
+// visible is series without the timeframes t isn't shown.
+func (t *tenant) visible(series []model.Series) []model.Series {
+	if t == nil || t.timeframes == nil {
+		return series
+	}
+	out := series[:0]
+	for _, s := range series {
+		if tf, ok := s.Labels["chrono_timeframe"]; !ok || t.timeframes[tf] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// tenantSet finds the tenant a request is for.
+type tenantSet struct {
+	byName  map[string]*tenant
+	header  string
+	require bool
+}
+
+func newTenantSet(config Config) *tenantSet {
+	s := &tenantSet{
+		byName:  make(map[string]*tenant, len(config.Tenants)),
+		header:  config.TenantHeader,
+		require: config.RequireTenant,
+	}
+	for _, tc := range config.Tenants {
+		s.byName[tc.Name] = newTenant(tc, config.RateLimitBurst)
+	}
+	return s
+}
+
+// errTenant is what clients get when the tenant they named won't do.
+type errTenant struct{ msg string }
+
+func (e errTenant) Error() string { return e.msg }
+
+// forRequest returns r's tenant, or nil if it didn't name one, and the path
+// with any /t/<name> prefix taken off.
+func (s *tenantSet) forRequest(r *http.Request) (*tenant, string, error) {
+	path := r.URL.Path
+	if len(s.byName) == 0 {
+		return nil, path, nil
+	}
+	var t *tenant
+	if rest, ok := strings.CutPrefix(path, tenantPathPrefix); ok {
+		name, suffix, _ := strings.Cut(rest, "/")
+		if t = s.byName[name]; t == nil {
+			return nil, "", errTenant{fmt.Sprintf("unknown tenant %q", name)}
+		}
+		path = "/" + suffix
+	}
+	if s.header != "" {
+		if name := r.Header.Get(s.header); name != "" {
+			ht := s.byName[name]
+			if ht == nil {
+				return nil, "", errTenant{fmt.Sprintf("unknown tenant %q", name)}
+			}
+			if t != nil && t != ht {
+				return nil, "", errTenant{fmt.Sprintf("%s says tenant %q but the path says %q", s.header, name, t.config.Name)}
+			}
+			t = ht
+		}
+	}
+	if t == nil && s.require {
+		return nil, "", errTenant{fmt.Sprintf("no tenant: send %s or use a %s<tenant>/ prefix", s.header, tenantPathPrefix)}
+	}
+	return t, path, nil
+}
+
+type tenantKey struct{}
+
+// withTenant marks requests under ctx as belonging to t.
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// tenantFrom returns the tenant set by withTenant, or nil.
+func tenantFrom(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantKey{}).(*tenant)
+	return t
+}
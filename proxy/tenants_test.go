@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestTenants(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for _, ts := range []int64{1700000000, 1700000000 - 7*86400, 1700000000 - 14*86400} {
+		fake.Serve("/api/v1/query", ts, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	}
+	legacy := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "pay", URL: fake.URL}, {Name: "ads", URL: fake.URL}}
+	config.Tenants = []TenantConfig{
+		{Name: "payments", Upstreams: []string{"pay"}, Timeframes: []string{"current", "7days"}, Plugins: []string{"smooth"}, RateLimit: 1, RateLimitPerClient: 100},
+		{Name: "ads", Upstreams: []string{"ads"}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewChronoProxyWithConfig(config)
+
+	query := func(path, tenant, q string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path+"/api/v1/query?time=1700000000&query="+q, nil)
+		if tenant != "" {
+			r.Header.Set("X-Scope-OrgID", tenant)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	w := query("/t/payments/pay", "", "up")
+	if w.Code != 200 {
+		t.Fatalf("path tenant: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Data struct {
+			Result []struct{ Metric map[string]string }
+		}
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	for _, s := range resp.Data.Result {
+		if tf := s.Metric["chrono_timeframe"]; tf != "current" && tf != "7days" {
+			t.Errorf("payments was shown %q", tf)
+		}
+	}
+	if len(resp.Data.Result) != 2 {
+		t.Errorf("want current and 7days, got %s", w.Body)
+	}
+
+	// One request a second for the whole of payments
+	if w := query("/pay", "payments", "up"); w.Code != 429 || !strings.Contains(w.Body.String(), `"reason":"tenant_rate_limit"`) {
+		t.Errorf("tenant rate limit: %d %s", w.Code, w.Body)
+	}
+
+	for _, c := range []struct {
+		name, path, tenant, q string
+		code                  int
+	}{
+		{"other tenant's upstream", "/pay", "ads", "up", 403},
+		{"legacy prefix", legacy, "ads", "up", 403},
+		{"unknown tenant", "/ads", "marketing", "up", 403},
+		{"unknown path tenant", "/t/marketing/ads", "", "up", 403},
+		{"header and path disagree", "/t/ads/ads", "payments", "up", 403},
+		{"no tenant", "/ads", "", "up", 200},
+		{"everything allowed", "/t/ads/ads", "ads", `up{chrono_timeframe="28days"}`, 200},
+	} {
+		if w := query(c.path, c.tenant, c.q); w.Code != c.code {
+			t.Errorf("%s: got %d, want %d: %s", c.name, w.Code, c.code, w.Body)
+		}
+	}
+
+	p = NewChronoProxyWithConfig(config) // fresh buckets
+	for q, want := range map[string]string{
+		`up{chrono_timeframe="28days"}`: `can't use chrono_timeframe=\"28days\"`,
+		`up{_plugin="scale"}`:           `can't use plugin \"scale\"`,
+	} {
+		if w := query("/pay", "payments", q); w.Code != 400 || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: %d %s", q, w.Code, w.Body)
+		}
+		p = NewChronoProxyWithConfig(config)
+	}
+}
+
+func TestRequireTenant(t *testing.T) {
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "prom", URL: "http://127.0.0.1:1"}}
+	config.Tenants = []TenantConfig{{Name: "payments", Upstreams: []string{"prom"}}}
+	config.RequireTenant = true
+	p := NewChronoProxyWithConfig(config)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/prom/api/v1/query?query=up", nil))
+	if w.Code != 403 || !strings.Contains(w.Body.String(), "no tenant") {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestValidateTenants(t *testing.T) {
+	for _, tenants := range [][]TenantConfig{
+		{{Name: "", Upstreams: []string{"prom"}}},
+		{{Name: "a/b", Upstreams: []string{"prom"}}},
+		{{Name: "a", Upstreams: []string{"prom"}}, {Name: "a", Upstreams: []string{"prom"}}},
+		{{Name: "a"}},
+		{{Name: "a", Upstreams: []string{"prom"}, RateLimit: -1}},
+	} {
+		if err := validateTenants(tenants); err == nil {
+			t.Errorf("%+v should be rejected", tenants)
+		}
+	}
+}
+
+func TestTenantJobs(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for _, ts := range []int64{1700000000, 1700000000 - 7*86400, 1700000000 - 14*86400} {
+		fake.Serve("/api/v1/query", ts, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"1"]}]}}`))
+	}
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "pay", URL: fake.URL}}
+	config.Tenants = []TenantConfig{
+		{Name: "payments", Upstreams: []string{"pay"}, Timeframes: []string{"current", "7days"}},
+		{Name: "snoops", Upstreams: []string{"pay"}},
+	}
+	p := NewChronoProxyWithConfig(config)
+
+	submit := func(tenant, q string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/t/"+tenant+"/pay"+jobsPath+"?time=1700000000&query="+q, nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := submit("payments", `up{chrono_timeframe="28days"}`); w.Code != 400 || !strings.Contains(w.Body.String(), "can't use chrono_timeframe") {
+		t.Errorf("restricted timeframe: %d %s, want 400", w.Code, w.Body)
+	}
+
+	w := submit("payments", "up")
+	if w.Code != 202 {
+		t.Fatalf("submit: %d %s", w.Code, w.Body)
+	}
+	var submitted struct {
+		Data jobStatus `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &submitted)
+	p.jobs.wg.Wait()
+
+	job := p.jobs.get(submitted.Data.ID)
+	if job == nil || job.tenant != "payments" {
+		t.Fatalf("job = %+v, want one owned by payments", job)
+	}
+	for _, s := range job.result {
+		if tf := s.Labels["chrono_timeframe"]; tf != "current" && tf != "7days" {
+			t.Errorf("payments' job was shown %q", tf)
+		}
+	}
+	if len(job.result) != 2 {
+		t.Errorf("job result = %+v, want current and 7days", job.result)
+	}
+
+	for _, tenant := range []string{"snoops", ""} {
+		path := "/pay" + jobsPath + "/" + submitted.Data.ID
+		if tenant != "" {
+			path = "/t/" + tenant + path
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 404 {
+			t.Errorf("tenant %q asking for payments' job: %d, want 404", tenant, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/t/payments/pay"+jobsPath+"/"+submitted.Data.ID, nil))
+	if w.Code != 200 {
+		t.Errorf("payments asking for its own job: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestTenantsCantReadOwnEndpoints(t *testing.T) {
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "pay", URL: "http://127.0.0.1:1"}, {Name: "ads", URL: "http://127.0.0.1:1"}}
+	config.Tenants = []TenantConfig{{Name: "payments", Upstreams: []string{"pay"}}, {Name: "ads", Upstreams: []string{"ads"}}}
+	config.Quotas = []QuotaConfig{{Name: "ads-quota", Tenants: []string{"ads"}, QueriesPerHour: 100}}
+	config.ListenAuth.BasicUsers = map[string]string{"alice": "a", "ops": "o"}
+	get := func(p *ChronoProxy, user, password, tenant, path string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.SetBasicAuth(user, password)
+		if tenant != "" {
+			r.Header.Set("X-Scope-OrgID", tenant)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Until admin_identities says who's in charge, nobody is
+	p := NewChronoProxyWithConfig(config)
+	if code := get(p, "ops", "o", "", chronoAdminPrefix+"quotas"); code != http.StatusForbidden {
+		t.Errorf("quotas without admin_identities: %d, want 403", code)
+	}
+
+	config.AdminIdentities = []string{"user:ops"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	p = NewChronoProxyWithConfig(config)
+	for _, path := range []string{chronoAdminPrefix + "quotas", "/" + adminPrefix + "/quotas", chronoAdminPrefix + "config", metricsPath, debugPathPrefix + "state"} {
+		for _, tenant := range []string{"payments", ""} {
+			if code := get(p, "alice", "a", tenant, path); code != http.StatusForbidden {
+				t.Errorf("payments' alice (tenant %q) on %s: %d, want 403", tenant, path, code)
+			}
+		}
+	}
+	if code := get(p, "ops", "o", "", chronoAdminPrefix+"quotas"); code != http.StatusOK {
+		t.Errorf("ops on quotas: %d, want 200", code)
+	}
+}
@@ -0,0 +1,134 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/timeframes.go
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// GET .../api/v1/chrono/timeframes - the menu, so UIs and scripts don't
+// have to hard-code "current, 7days, 14days..." and hope.
+//
+//   raw        the windows we fetch: name, offset, and whether whole days
+//              follow the calendar in a timezone or are plain seconds
+//   synthetic  everything we compute from them: name, what it is, how it's
+//              computed (as in provenance.go), and whether plain queries
+//              get it without asking
+//
+// Lives under the upstream prefix like the rest of the chrono API, though
+// the upstream never hears about it.
+
+const timeframesPath = "/api/v1/chrono/timeframes"
+
+// Window alignments.
+const (
+	alignFixed    = "fixed"    // offset seconds back, exactly
+	alignCalendar = "calendar" // the same wall-clock time, whole days back in timezone
+)
+
+// syntheticDescriptions says what each synthetic is, in words.
+var syntheticDescriptions = map[string]string{
+	averageAggregation.name:       "Mean of the past windows, step by step (a missing window counts as zero)",
+	"lastMonthMin":                "Lowest value across the past windows",
+	"lastMonthMax":                "Highest value across the past windows",
+	"lastMonthMedian":             "Median of the past windows",
+	"lastMonthP90":                "90th percentile of the past windows, interpolated like quantile_over_time",
+	"lastMonthP95":                "95th percentile of the past windows, interpolated like quantile_over_time",
+	"lastMonthStddev":             "Population standard deviation of the past windows",
+	bandUpperName:                 "Mean of the past windows plus %g standard deviations (band_stddevs)",
+	bandLowerName:                 "Mean of the past windows minus %g standard deviations (band_stddevs)",
+	seasonalBaselineName:          "Mean of past values recorded at the same weekday and time of day",
+	forecastNextWeekName:          "Seasonal naive forecast: the most recent value at the same weekday and time of day",
+	dataGapsName:                  "How many past windows had no data at a step where others did (dips in lastMonthAverage that are outages)",
+	"compareAgainstLast28":        "current minus lastMonthAverage",
+	"percentCompareAgainstLast28": "current minus lastMonthAverage, as a percentage of lastMonthAverage",
+	standardErrorName:             "Standard error of lastMonthAverage; a compare within a couple of these is noise",
+}
+
+type rawTimeframe struct {
+	Name          string `json:"name"`
+	OffsetSeconds int64  `json:"offset_seconds"`
+	Alignment     string `json:"alignment"`
+	Timezone      string `json:"timezone,omitempty"`
+	Disabled      bool   `json:"disabled,omitempty"` // switched off for now (see disabled.go)
+}
+
+type syntheticTimeframe struct {
+	Name          string         `json:"name"`
+	Description   string         `json:"description"`
+	Computation   string         `json:"computation"`
+	SourceWindows []sourceWindow `json:"source_windows"`
+	Default       bool           `json:"default"` // included in queries without a chrono_timeframe
+}
+
+// describeTimeframes describes every raw and synthetic timeframe this proxy offers.
+func (p *ChronoProxy) describeTimeframes() ([]rawTimeframe, []syntheticTimeframe) {
+	var raw []rawTimeframe
+	for _, win := range p.windows() {
+		rt := rawTimeframe{Name: win.name, OffsetSeconds: win.offset, Alignment: alignFixed}
+		_, rt.Disabled = p.disabled.get(win.name)
+		if win.calendarDays() > 0 {
+			rt.Alignment = alignCalendar
+			rt.Timezone = win.loc.String()
+		}
+		raw = append(raw, rt)
+	}
+
+	defaults := map[string]bool{
+		averageAggregation.name:       true,
+		"compareAgainstLast28":        true,
+		"percentCompareAgainstLast28": true,
+		standardErrorName:             true,
+	}
+	for _, agg := range p.aggregations {
+		defaults[agg.name] = true
+	}
+	var synthetic []syntheticTimeframe
+	for _, name := range syntheticTimeframes() {
+		prov := p.provenanceFor(name)
+		desc := syntheticDescriptions[name]
+		if name == bandUpperName || name == bandLowerName {
+			desc = fmt.Sprintf(desc, p.config.BandStddevs)
+		}
+		synthetic = append(synthetic, syntheticTimeframe{
+			Name:          name,
+			Description:   desc,
+			Computation:   prov.Computation,
+			SourceWindows: prov.SourceWindows,
+			Default:       defaults[name],
+		})
+	}
+	return raw, synthetic
+}
+
+// handleTimeframes answers GET .../api/v1/chrono/timeframes.
+func (p *ChronoProxy) handleTimeframes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	raw, synthetic := p.describeTimeframes()
+	writeJSONRaw(w, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"raw":       raw,
+			"synthetic": synthetic,
+		},
+	})
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTimeframesEndpoint(t *testing.T) {
+	config := DefaultConfig
+	config.Timezone = "Europe/London"
+	config.SyntheticAggregations = []string{"p95"}
+	w := httptest.NewRecorder()
+	NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", "/localhost_9090/api/v1/chrono/timeframes", nil))
+
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			Raw       []rawTimeframe       `json:"raw"`
+			Synthetic []syntheticTimeframe `json:"synthetic"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Status != "success" {
+		t.Fatalf("body = %s", w.Body.String())
+	}
+	if len(resp.Data.Raw) != 5 || resp.Data.Raw[0] != (rawTimeframe{Name: "current", Alignment: alignFixed}) {
+		t.Errorf("raw = %+v", resp.Data.Raw)
+	}
+	if week := resp.Data.Raw[1]; week.Name != "7days" || week.OffsetSeconds != 604800 || week.Alignment != alignCalendar || week.Timezone != "Europe/London" {
+		t.Errorf("7days = %+v", week)
+	}
+
+	byName := map[string]syntheticTimeframe{}
+	for _, s := range resp.Data.Synthetic {
+		if s.Description == "" {
+			t.Errorf("%s has no description", s.Name)
+		}
+		byName[s.Name] = s
+	}
+	if len(byName) != len(syntheticTimeframes()) {
+		t.Errorf("got %d synthetics; want %d", len(byName), len(syntheticTimeframes()))
+	}
+	if avg := byName["lastMonthAverage"]; !avg.Default || avg.Computation != "sum/4" || len(avg.SourceWindows) != 4 {
+		t.Errorf("lastMonthAverage = %+v", avg)
+	}
+	if !byName["lastMonthP95"].Default || byName["lastMonthMin"].Default {
+		t.Error("only configured synthetic_aggregations should be default")
+	}
+
+	w = httptest.NewRecorder()
+	NewChronoProxy().ServeHTTP(w, httptest.NewRequest("POST", "/localhost_9090/api/v1/chrono/timeframes", nil))
+	if w.Code != 405 {
+		t.Errorf("POST: status %d", w.Code)
+	}
+}
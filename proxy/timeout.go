@@ -0,0 +1,136 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/timeout.go
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Adaptive timeouts!
+// One fixed 30 second timeout is wrong in both directions: a 30-day range
+// query legitimately needs longer than that, while a 5-minute instant query
+// that hasn't answered in 30 seconds is never going to. So we size the
+// patience to the job:
+//
+//   timeout = MinUpstreamTimeout
+//           + TimeoutPerRangeDay × days in the range
+//           + TimeoutPer1kPoints × (range / step) / 1000
+//
+// clamped to [MinUpstreamTimeout, MaxUpstreamTimeout]. Instant queries just
+// get the minimum. The budget applies to each window fetch separately.
+
+// upstreamTimeout works out how long a single window fetch may take.
+func (p *ChronoProxy) upstreamTimeout(params url.Values, isRange bool) time.Duration {
+	c := p.config
+	if !c.AdaptiveTimeout {
+		return c.ClientTimeout
+	}
+
+	timeout := c.MinUpstreamTimeout
+	if isRange {
+		now := p.clock.Now()
+		span := parseTime(params.Get("end"), now) - parseTime(params.Get("start"), now)
+		if span < 0 {
+			span = 0
+		}
+		step := int64(60)
+		if d, err := parsePromDuration(params.Get("step")); err == nil && d >= time.Second {
+			step = int64(d / time.Second)
+		}
+		points := span / step
+
+		timeout += time.Duration(float64(c.TimeoutPerRangeDay) * float64(span) / 86400)
+		timeout += time.Duration(float64(c.TimeoutPer1kPoints) * float64(points) / 1000)
+	}
+
+	if timeout < c.MinUpstreamTimeout {
+		timeout = c.MinUpstreamTimeout
+	}
+	if c.MaxUpstreamTimeout > 0 && timeout > c.MaxUpstreamTimeout {
+		timeout = c.MaxUpstreamTimeout
+	}
+	return timeout
+}
+
+// clientTimeout is the hard stop on the shared http.Client. With adaptive
+// timeouts on, the per-request contexts do the real work, so the client
+// itself must be at least as patient as the largest budget we might hand out.
+func clientTimeout(c Config) time.Duration {
+	if c.AdaptiveTimeout && c.MaxUpstreamTimeout > c.ClientTimeout {
+		return c.MaxUpstreamTimeout
+	}
+	return c.ClientTimeout
+}
+
+// promDurationUnits are the suffixes Prometheus understands in durations.
+var promDurationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// parsePromDuration speaks both dialects Prometheus accepts for step and
+// friends: plain (possibly fractional) seconds like "60" or "0.5", and
+// duration strings like "5m", "1h30m" or "2w".
+func parsePromDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f < 0 {
+			return 0, fmt.Errorf("negative duration %q", s)
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %w", s, err)
+		}
+		rest = rest[i:]
+
+		j := 0
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') {
+			j++
+		}
+		unit, ok := promDurationUnits[rest[:j]]
+		if !ok {
+			return 0, fmt.Errorf("invalid unit %q in duration %q", rest[:j], s)
+		}
+		total += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+	return total, nil
+}
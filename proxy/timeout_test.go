@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParsePromDuration(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"60", time.Minute, true},
+		{"0.5", 500 * time.Millisecond, true},
+		{"15s", 15 * time.Second, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"2d", 48 * time.Hour, true},
+		{"1w", 7 * 24 * time.Hour, true},
+		{"250ms", 250 * time.Millisecond, true},
+		{"", 0, false},
+		{"5x", 0, false},
+		{"m5", 0, false},
+	}
+	for _, tc := range cases {
+		got, err := parsePromDuration(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("parsePromDuration(%q) err = %v; want ok=%v", tc.in, err, tc.ok)
+			continue
+		}
+		if tc.ok && got != tc.want {
+			t.Errorf("parsePromDuration(%q) = %v; want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestUpstreamTimeoutScalesWithRange(t *testing.T) {
+	p := NewChronoProxy()
+
+	if got := p.upstreamTimeout(url.Values{}, false); got != DefaultConfig.MinUpstreamTimeout {
+		t.Errorf("instant timeout = %v; want %v", got, DefaultConfig.MinUpstreamTimeout)
+	}
+
+	short := url.Values{"start": {"1600000000"}, "end": {"1600000300"}, "step": {"15"}}
+	long := url.Values{"start": {"1600000000"}, "end": {"1602592000"}, "step": {"60"}} // 30 days
+	shortT := p.upstreamTimeout(short, true)
+	longT := p.upstreamTimeout(long, true)
+
+	if shortT >= DefaultConfig.ClientTimeout {
+		t.Errorf("5 minute range timeout = %v; want well under %v", shortT, DefaultConfig.ClientTimeout)
+	}
+	if longT <= DefaultConfig.ClientTimeout {
+		t.Errorf("30 day range timeout = %v; want more than %v", longT, DefaultConfig.ClientTimeout)
+	}
+	if longT > DefaultConfig.MaxUpstreamTimeout {
+		t.Errorf("30 day range timeout = %v; want capped at %v", longT, DefaultConfig.MaxUpstreamTimeout)
+	}
+}
+
+func TestUpstreamTimeoutDisabled(t *testing.T) {
+	config := DefaultConfig
+	config.AdaptiveTimeout = false
+	p := NewChronoProxyWithConfig(config)
+	long := url.Values{"start": {"1600000000"}, "end": {"1602592000"}}
+	if got := p.upstreamTimeout(long, true); got != config.ClientTimeout {
+		t.Errorf("got %v; want fixed %v", got, config.ClientTimeout)
+	}
+}
@@ -0,0 +1,73 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/timezone.go
+package proxy
+
+import (
+	"time"
+	_ "time/tzdata" // so timezone works on hosts without a zoneinfo database
+)
+
+// Calendar-aware shifting - because "same time last week" is a wall clock
+// thing, not a 604800-second thing.
+//
+// Out of the box a window is exactly offset seconds back. Twice a year that
+// puts last week's 09:00 at this week's 08:00 or 10:00, and every compare
+// across the clock change lights up for no reason at all. Set timezone to an
+// IANA name (Europe/London, America/New_York) and windows that are a whole
+// number of days back are shifted by calendar days in that zone instead:
+// Tuesday 09:00 lines up with the Tuesday 09:00 a week earlier, whatever the
+// clocks did in between. Windows that aren't whole days (36h, 90m) are
+// still plain durations - there's no calendar to follow for those.
+//
+// The shift is worked out per timestamp, so a range that straddles the
+// change gets each of its points put in the right place.
+
+// loadTimezone turns the timezone setting into a location. "" means none -
+// plain seconds, as before.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// calendarDays is how many calendar days back w sits, or 0 when it should be
+// shifted by plain seconds.
+func (w window) calendarDays() int {
+	if w.loc == nil || w.offset <= 0 || w.offset%(24*3600) != 0 {
+		return 0
+	}
+	return int(w.offset / (24 * 3600))
+}
+
+// back is the moment to ask upstream about, for a request at ms (Unix
+// milliseconds).
+func (w window) back(ms int64) int64 {
+	if days := w.calendarDays(); days > 0 {
+		return time.UnixMilli(ms).In(w.loc).AddDate(0, 0, -days).UnixMilli()
+	}
+	return ms - w.offset*1000
+}
+
+// forward moves a sample recorded at ms up to where it belongs in the present.
+func (w window) forward(ms int64) int64 {
+	if days := w.calendarDays(); days > 0 {
+		return time.UnixMilli(ms).In(w.loc).AddDate(0, 0, days).UnixMilli()
+	}
+	return ms + w.offset*1000
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+// Europe/London went from GMT to BST at 01:00 UTC on 2024-03-31.
+const (
+	tuesdayAfterBST  = 1712044800 // 2024-04-02 09:00 BST
+	tuesdayBeforeBST = 1711443600 // 2024-03-26 09:00 GMT
+)
+
+func TestCalendarWindows(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	week := window{name: "7days", offset: 7 * 24 * 3600, loc: london}
+	if got := week.back(tuesdayAfterBST * 1000); got != tuesdayBeforeBST*1000 {
+		t.Errorf("back = %d; want %d", got, tuesdayBeforeBST*1000)
+	}
+	if got := week.forward(tuesdayBeforeBST * 1000); got != tuesdayAfterBST*1000 {
+		t.Errorf("forward = %d; want %d", got, tuesdayAfterBST*1000)
+	}
+
+	// No zone, or not whole days: plain seconds.
+	plain := window{name: "7days", offset: 7 * 24 * 3600}
+	if got := plain.back(tuesdayAfterBST * 1000); got != (tuesdayAfterBST-7*24*3600)*1000 {
+		t.Errorf("plain back = %d", got)
+	}
+	hours := window{name: "36h", offset: 36 * 3600, loc: london}
+	if got := hours.back(tuesdayAfterBST * 1000); got != (tuesdayAfterBST-36*3600)*1000 {
+		t.Errorf("36h back = %d", got)
+	}
+}
+
+func TestTimezoneShiftsUpstreamTimes(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	fake.Serve("/api/v1/query", tuesdayBeforeBST, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1711443600,"7"]}]}}`))
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.Timezone = "Europe/London"
+	w := httptest.NewRecorder()
+	NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", prefix+`/api/v1/query?time=1712044800&query=up{chrono_timeframe="7days"}`, nil))
+
+	reqs := fake.Requests()
+	if len(reqs) != 1 || reqs[0].Params.Get("time") != "1711443600" {
+		t.Fatalf("upstream saw %+v", reqs)
+	}
+	if body := w.Body.String(); !strings.Contains(body, `[1712044800,"7"]`) {
+		t.Errorf("sample not shifted back to 09:00: %s", body)
+	}
+
+	config.Timezone = "Mars/Olympus_Mons"
+	if err := config.Validate(); err == nil {
+		t.Error("expected an unknown timezone to fail validation")
+	}
+}
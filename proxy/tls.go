@@ -0,0 +1,125 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/tls.go
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// TLS for upstreams - because not every Prometheus lives on plain http://
+//
+// There are two ways to reach an https upstream:
+//
+//  1. A named upstream with an https:// url, optionally with its own tls block:
+//
+//     upstreams:
+//       - name: secure
+//         url: https://prometheus.internal:9443
+//         tls:
+//           ca_file: /etc/chronotheus/internal-ca.pem
+//           cert_file: /etc/chronotheus/client.pem
+//           key_file: /etc/chronotheus/client-key.pem
+//
+//  2. The legacy path style with a scheme marker: /https+prometheus_9443/api/v1/query
+//     These use the top-level upstream_tls block (or system defaults).
+
+// UpstreamTLSConfig describes how we talk TLS to an upstream.
+type UpstreamTLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`              // PEM bundle to trust instead of the system roots
+	CertFile           string `yaml:"cert_file,omitempty"`            // Client certificate for mTLS
+	KeyFile            string `yaml:"key_file,omitempty"`             // Client key for mTLS
+	ServerName         string `yaml:"server_name,omitempty"`          // Override the name we verify the certificate against
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"` // Don't verify at all (testing only, please!)
+}
+
+// isZero tells us whether there's anything to configure at all.
+func (c UpstreamTLSConfig) isZero() bool {
+	return c == UpstreamTLSConfig{}
+}
+
+// buildTLSConfig loads certificates and CA bundles from disk.
+func buildTLSConfig(c UpstreamTLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s contains no usable certificates", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
+
+// newHTTPClient builds an upstream client from our connection settings.
+// tlsConfig may be nil, in which case Go's defaults apply.
+func newHTTPClient(config Config, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout: clientTimeout(config),
+		Transport: &http.Transport{
+			MaxIdleConns:        config.MaxIdleConns,
+			MaxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+			IdleConnTimeout:     config.IdleConnTimeout,
+			DisableCompression:  config.DisableCompression,
+			ForceAttemptHTTP2:   config.ForceAttemptHTTP2,
+			TLSClientConfig:     tlsConfig,
+			DialContext: (&net.Dialer{
+				Timeout:   config.DialTimeout,
+				KeepAlive: config.KeepAlive,
+			}).DialContext,
+		},
+	}
+}
+
+// newTLSClient is newHTTPClient for a tls block; an empty block means the
+// plain shared client will do just fine, so we return nil.
+func newTLSClient(config Config, c UpstreamTLSConfig) (*http.Client, error) {
+	if c.isZero() {
+		return nil, nil
+	}
+	tc, err := buildTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPClient(config, tc), nil
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeServerCA dumps the test server's certificate as a PEM CA bundle.
+func writeServerCA(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNamedHTTPSUpstreamWithCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"success","data":["up"]}`))
+	}))
+	defer srv.Close()
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{
+		Name: "secure",
+		URL:  srv.URL,
+		TLS:  UpstreamTLSConfig{CAFile: writeServerCA(t, srv)},
+	}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	p := NewChronoProxyWithConfig(config)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/secure/api/v1/status/buildinfo", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200 (body %s)", w.Code, w.Body.String())
+	}
+}
+
+func TestHTTPSUpstreamWithoutTrustFails(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "secure", URL: srv.URL}}
+	p := NewChronoProxyWithConfig(config)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/secure/api/v1/status/buildinfo", nil))
+	if w.Code == http.StatusOK {
+		t.Fatal("expected a self-signed upstream to be rejected without a ca_file")
+	}
+}
+
+func TestHTTPSMarkerPrefix(t *testing.T) {
+	config := DefaultConfig
+	config.UpstreamTLS = UpstreamTLSConfig{InsecureSkipVerify: true}
+	p := NewChronoProxyWithConfig(config)
+
+	u, suffix, err := p.resolveUpstream("/https+prometheus_9443/api/v1/query")
+	if err != nil {
+		t.Fatalf("resolveUpstream: %v", err)
+	}
+	if u.base != "https://prometheus:9443" || suffix != "/api/v1/query" {
+		t.Errorf("got (%q,%q)", u.base, suffix)
+	}
+	if u.client == nil || u.client == p.client {
+		t.Error("expected the upstream_tls client for an https+ prefix")
+	}
+}
+
+func TestBuildTLSConfigErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  UpstreamTLSConfig
+	}{
+		{"missing ca", UpstreamTLSConfig{CAFile: "/nonexistent/ca.pem"}},
+		{"cert without key", UpstreamTLSConfig{CertFile: "client.pem"}},
+		{"key without cert", UpstreamTLSConfig{KeyFile: "client-key.pem"}},
+	}
+	for _, tc := range cases {
+		if _, err := buildTLSConfig(tc.cfg); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a cert"), 0o600)
+	if _, err := buildTLSConfig(UpstreamTLSConfig{CAFile: empty}); err == nil {
+		t.Error("expected ca_file without certificates to be rejected")
+	}
+}
@@ -0,0 +1,394 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/tracing.go
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Tracing - follow one slow panel all the way down the rabbit hole!
+//
+// The histograms say *that* things are slow; a trace says which window of
+// which request was slow, and whether it was Prometheus or us. With
+// tracing_endpoint set, every proxied request becomes an OpenTelemetry
+// trace, shipped as OTLP/HTTP JSON to any collector (usually
+// http://<collector>:4318/v1/traces):
+//
+//   chronotheus.request      the whole request (server span)
+//   └ chronotheus.window     one per timeframe window: chrono.timeframe, chrono.offset_seconds
+//     └ GET /api/v1/...      the upstream call (client span)
+//   chronotheus.synthesize   averages, compares and friends
+//   chronotheus.plugin       a {_plugin="..."} run
+//
+// Upstream calls carry a W3C traceparent header, so a Prometheus with
+// tracing turned on hangs its own spans underneath ours. An incoming
+// traceparent (Grafana sends one) is honoured too: we join that trace and
+// respect its sampled flag. Requests without one are sampled at
+// tracing_sample_ratio.
+//
+// No SDK - spans are simple enough to build ourselves, and the JSON flavour
+// of OTLP is just HTTP. Spans queue up and go out in batches; if the
+// collector can't keep up they're dropped (and counted), never waited for.
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	traceQueueSize    = 4096
+	traceBatchSize    = 512
+	traceFlushEvery   = 5 * time.Second
+	traceparentHeader = "traceparent"
+)
+
+type (
+	traceID [16]byte
+	spanID  [8]byte
+)
+
+// span is one timed piece of work. A nil *span is a span nobody is
+// recording - every method is safe to call on it.
+type span struct {
+	tracer  *tracer
+	clock   Clock
+	traceID traceID
+	id      spanID
+	parent  spanID
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	err     string
+}
+
+// set adds an attribute.
+func (s *span) set(key, value string) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// fail marks the span as errored.
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// finish ends the span and queues it for export.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = s.clock.Now()
+	s.tracer.record(s)
+}
+
+// traceparent is the W3C header naming s as the parent.
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.id[:]) + "-01"
+}
+
+type spanKey struct{}
+
+func withSpan(ctx context.Context, s *span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// tracer collects finished spans and ships them to the collector.
+type tracer struct {
+	endpoint string
+	service  string
+	ratio    float64
+	client   *http.Client
+	queue    chan *span
+	dropped  uint64 // spans thrown away because the queue was full
+}
+
+// newTracer returns nil when tracing is off.
+func newTracer(config Config) *tracer {
+	if config.TracingEndpoint == "" {
+		return nil
+	}
+	return &tracer{
+		endpoint: config.TracingEndpoint,
+		service:  config.TracingServiceName,
+		ratio:    config.TracingSampleRatio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, traceQueueSize),
+	}
+}
+
+func (t *tracer) record(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// droppedSpans is safe to call on a nil tracer.
+func (t *tracer) droppedSpans() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// startSpan starts a child of the span in ctx. Nothing is recorded (and
+// the span is nil) unless ctx is already part of a sampled trace.
+func (p *ChronoProxy) startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	parent := spanFrom(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := p.newSpan(parent.traceID, parent.id, name, kind)
+	return withSpan(ctx, s), s
+}
+
+// startRequestSpan starts the server span for r, joining the caller's trace
+// if it sent a traceparent.
+func (p *ChronoProxy) startRequestSpan(r *http.Request) (context.Context, *span) {
+	ctx := r.Context()
+	if p.tracer == nil {
+		return ctx, nil
+	}
+	tid, parent, sampled, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+	if !ok {
+		if mathrand.Float64() >= p.tracer.ratio {
+			return ctx, nil
+		}
+		rand.Read(tid[:])
+		sampled = true
+	}
+	if !sampled {
+		return ctx, nil
+	}
+	s := p.newSpan(tid, parent, "chronotheus.request", spanKindServer)
+	s.set("http.request.method", r.Method)
+	s.set("url.path", r.URL.Path)
+	// As the client saw it, through any trusted proxies (see trustedproxies.go)
+	scheme, host := p.requestOrigin(r)
+	s.set("url.scheme", scheme)
+	s.set("server.address", host)
+	s.set("client.address", p.clientAddress(r))
+	return withSpan(ctx, s), s
+}
+
+func (p *ChronoProxy) newSpan(tid traceID, parent spanID, name string, kind int) *span {
+	s := &span{
+		tracer:  p.tracer,
+		clock:   p.clock,
+		traceID: tid,
+		parent:  parent,
+		name:    name,
+		kind:    kind,
+		start:   p.clock.Now(),
+		attrs:   make(map[string]string),
+	}
+	rand.Read(s.id[:])
+	return s
+}
+
+// parseTraceparent reads a W3C traceparent: 00-<trace id>-<parent id>-<flags>.
+func parseTraceparent(h string) (tid traceID, parent spanID, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceID{}, spanID{}, false, false
+	}
+	if hex.DecodedLen(len(parts[1])) != len(tid) || hex.DecodedLen(len(parts[2])) != len(parent) || len(parts[3]) != 2 {
+		return traceID{}, spanID{}, false, false
+	}
+	if _, err := hex.Decode(tid[:], []byte(parts[1])); err != nil || tid == (traceID{}) {
+		return traceID{}, spanID{}, false, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil || parent == (spanID{}) {
+		return traceID{}, spanID{}, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID{}, spanID{}, false, false
+	}
+	return tid, parent, flags&1 == 1, true
+}
+
+// ExportTraces ships finished spans to tracing_endpoint until ctx is done,
+// then sends whatever is left. Run it in its own goroutine; it returns
+// straight away when tracing is off.
+func (p *ChronoProxy) ExportTraces(ctx context.Context) {
+	t := p.tracer
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(traceFlushEvery)
+	defer ticker.Stop()
+
+	var batch []*span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			log.Printf("[ERROR] exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case <-ctx.Done():
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					send()
+					return
+				}
+			}
+		}
+	}
+}
+
+// OTLP/HTTP JSON, just the parts we fill in.
+type (
+	otlpExport struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string            `json:"key"`
+		Value map[string]string `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 2 = error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+// otlpPayload turns spans into one OTLP export request.
+func (t *tracer) otlpPayload(spans []*span) otlpExport {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != (spanID{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, stringAttribute(k, v))
+		}
+		if s.err != "" {
+			o.Status = &otlpStatus{Code: 2, Message: s.err}
+		}
+		out[i] = o
+	}
+	return otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			stringAttribute("service.name", t.service),
+			stringAttribute("service.version", Version),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "chronotheus", Version: Version},
+			Spans: out,
+		}},
+	}}}
+}
+
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(t.otlpPayload(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// startWindowSpan starts the span for fetching one timeframe window.
+func (p *ChronoProxy) startWindowSpan(ctx context.Context, win window) (context.Context, *span) {
+	ctx, s := p.startSpan(ctx, "chronotheus.window", spanKindInternal)
+	s.set("chrono.timeframe", win.name)
+	s.set("chrono.offset_seconds", strconv.FormatInt(win.offset, 10))
+	return ctx, s
+}
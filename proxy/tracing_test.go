@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tid, parent, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || !sampled || tid[0] != 0x4b || parent[7] != 0xb7 {
+		t.Errorf("got %x %x %v %v", tid, parent, sampled, ok)
+	}
+	if _, _, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); !ok || sampled {
+		t.Error("flags 00 should parse as not sampled")
+	}
+	for _, bad := range []string{"", "00-abc-def-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e4736-zzf067aa0ba902b7-01"} {
+		if _, _, _, ok := parseTraceparent(bad); ok {
+			t.Errorf("parseTraceparent(%q) should fail", bad)
+		}
+	}
+}
+
+func TestTracingSpansAndPropagation(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		export otlpExport
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if err := json.Unmarshal(body, &export); err != nil {
+			t.Errorf("collector got %s: %v", body, err)
+		}
+	}))
+	defer collector.Close()
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.TracingEndpoint = collector.URL + "/v1/traces"
+	p := NewChronoProxyWithConfig(config)
+	req := httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000&query=up{chrono_timeframe="current"}`, nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	// A cancelled context means: send what's queued and stop.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.ExportTraces(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(export.ResourceSpans) != 1 || len(export.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("export = %+v", export)
+	}
+	byName := map[string]otlpSpan{}
+	for _, s := range export.ResourceSpans[0].ScopeSpans[0].Spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%s is in trace %s", s.Name, s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+	request, window, upstream := byName["chronotheus.request"], byName["chronotheus.window"], byName["GET /api/v1/query"]
+	if request.ParentSpanID != "00f067aa0ba902b7" || request.Kind != spanKindServer {
+		t.Errorf("request span = %+v", request)
+	}
+	if window.ParentSpanID != request.SpanID || upstream.ParentSpanID != window.SpanID || upstream.Kind != spanKindClient {
+		t.Errorf("spans not nested: %+v", byName)
+	}
+
+	reqs := fake.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("upstream saw %d requests", len(reqs))
+	}
+	if got, want := reqs[0].Header.Get("traceparent"), "00-4bf92f3577b34da6a3ce929d0e0e4736-"+upstream.SpanID+"-01"; got != want {
+		t.Errorf("upstream traceparent = %q; want %q", got, want)
+	}
+}
+
+func TestTracingHonoursUnsampledCallers(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+
+	config := DefaultConfig
+	config.TracingEndpoint = "http://127.0.0.1:1/v1/traces"
+	p := NewChronoProxyWithConfig(config)
+	req := httptest.NewRequest("GET", prefix+`/api/v1/query?time=1700000000&query=up{chrono_timeframe="current"}`, nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	p.ServeHTTP(httptest.NewRecorder(), req)
+
+	if n := len(p.tracer.queue); n != 0 {
+		t.Errorf("%d spans recorded for an unsampled trace", n)
+	}
+	if reqs := fake.Requests(); len(reqs) != 1 || reqs[0].Header.Get("traceparent") != "" {
+		t.Errorf("unsampled trace shouldn't be propagated by us: %+v", reqs)
+	}
+}
@@ -0,0 +1,174 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/transforms.go
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Value transforms - baselines from better-behaved numbers 🪄
+//
+// Latency is skewed: one 30s timeout in a week of 20ms requests drags
+// lastMonthAverage way up, and the current week looks great by comparison.
+// Averaged in log space the outlier barely registers. So per metric:
+//
+//   value_transforms:
+//     - match: http_request_duration_seconds.*
+//       transform: log
+//     - match: queue_depth
+//       transform: clamp
+//       max: 10000
+//     - match: balance_delta
+//       transform: abs
+//
+// The past windows' samples are transformed before any synthetic is
+// worked out from them:
+//
+//   log     log(1 + x), and the synthetics turned back with e^x - 1, so a
+//           baseline is still in the metric's units (lastMonthAverage
+//           becomes a geometric mean, near enough, and the bands
+//           multiplicative). lastMonthStddev and lastMonthStandardError
+//           stay in log space.
+//   clamp   anything outside min..max pulled back to the edge
+//   abs     the absolute value
+//
+// The windows themselves, current included, go back to the client as they
+// came. match is a regex over the whole metric name, like no_synthetics;
+// the first rule matching a metric the query mentions wins. Histogram
+// quantile baselines count buckets, so they're left alone.
+
+// ValueTransformConfig is one metric pattern and what its history gets.
+type ValueTransformConfig struct {
+	Match     string   `yaml:"match"`         // Regex over the whole metric name
+	Transform string   `yaml:"transform"`     // log, clamp or abs
+	Min       *float64 `yaml:"min,omitempty"` // clamp's floor
+	Max       *float64 `yaml:"max,omitempty"` // clamp's ceiling
+}
+
+// valueTransform is a ValueTransformConfig ready to use.
+type valueTransform struct {
+	re       *regexp.Regexp
+	kind     string
+	min, max float64
+}
+
+// compileValueTransforms checks and compiles every rule.
+func compileValueTransforms(cfgs []ValueTransformConfig) ([]valueTransform, error) {
+	out := make([]valueTransform, 0, len(cfgs))
+	for i, c := range cfgs {
+		if c.Match == "" {
+			return nil, fmt.Errorf("value_transforms[%d]: match is required", i)
+		}
+		re, err := regexp.Compile("^(?:" + c.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("value_transforms[%d]: %w", i, err)
+		}
+		t := valueTransform{re: re, kind: c.Transform, min: math.Inf(-1), max: math.Inf(1)}
+		switch c.Transform {
+		case "log", "abs":
+			if c.Min != nil || c.Max != nil {
+				return nil, fmt.Errorf("value_transforms[%d]: min and max are only for clamp", i)
+			}
+		case "clamp":
+			if c.Min == nil && c.Max == nil {
+				return nil, fmt.Errorf("value_transforms[%d]: clamp needs min, max or both", i)
+			}
+			if c.Min != nil {
+				t.min = *c.Min
+			}
+			if c.Max != nil {
+				t.max = *c.Max
+			}
+			if t.min > t.max {
+				return nil, fmt.Errorf("value_transforms[%d]: min %v is above max %v", i, t.min, t.max)
+			}
+		default:
+			return nil, fmt.Errorf("value_transforms[%d]: transform must be log, clamp or abs, got %q", i, c.Transform)
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// valueTransformFor is the first rule matching a metric query mentions,
+// nil when none does.
+func (p *ChronoProxy) valueTransformFor(query string) *valueTransform {
+	if len(p.transforms) == 0 {
+		return nil
+	}
+	for _, name := range queryMetricNames(query) {
+		for i := range p.transforms {
+			if p.transforms[i].re.MatchString(name) {
+				return &p.transforms[i]
+			}
+		}
+	}
+	return nil
+}
+
+// apply is series with the past windows' values transformed, for building
+// synthetics from. series itself isn't touched. Safe on nil.
+func (t *valueTransform) apply(series []model.Series) []model.Series {
+	if t == nil {
+		return series
+	}
+	out := make([]model.Series, len(series))
+	for i, s := range series {
+		out[i] = s
+		if s.Labels["chrono_timeframe"] == "current" {
+			continue
+		}
+		pts := make([]model.Point, 0, len(s.Points))
+		for _, pt := range s.Points {
+			if v := t.forward(pt.V); !math.IsNaN(v) || math.IsNaN(pt.V) {
+				pts = append(pts, model.Point{T: pt.T, V: v})
+			}
+		}
+		out[i].Points = pts
+	}
+	return out
+}
+
+func (t *valueTransform) forward(v float64) float64 {
+	switch t.kind {
+	case "log":
+		return math.Log1p(v) // NaN below -1
+	case "abs":
+		return math.Abs(v)
+	}
+	return math.Max(t.min, math.Min(t.max, v))
+}
+
+// undo turns synthetics built from apply's output back into the metric's
+// units, in place, and returns them. Only log has anything to undo, and
+// not for a spread. Safe on nil.
+func (t *valueTransform) undo(series []model.Series, agg aggregation) []model.Series {
+	if t == nil || t.kind != "log" || agg.key == "stddev" || agg.key == "stderr" {
+		return series
+	}
+	for _, s := range series {
+		for j := range s.Points {
+			s.Points[j].V = math.Expm1(s.Points[j].V)
+		}
+	}
+	return series
+}
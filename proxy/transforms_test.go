@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+	"gopkg.in/yaml.v2"
+)
+
+func TestValueTransforms(t *testing.T) {
+	var cfgs []ValueTransformConfig
+	if err := yaml.Unmarshal([]byte(`
+- match: latency_.*
+  transform: log
+- match: depth
+  transform: clamp
+  max: 10
+`), &cfgs); err != nil {
+		t.Fatal(err)
+	}
+	transforms, err := compileValueTransforms(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &ChronoProxy{transforms: transforms}
+	if p.valueTransformFor(`rate(latency_seconds_sum[5m])`) != &p.transforms[0] || p.valueTransformFor("depth") != &p.transforms[1] || p.valueTransformFor("other") != nil {
+		t.Fatal("wrong rule picked")
+	}
+
+	in := []model.Series{
+		{Labels: map[string]string{"chrono_timeframe": "current"}, Points: []model.Point{{T: 0, V: 100}}},
+		{Labels: map[string]string{"chrono_timeframe": "7days"}, Points: []model.Point{{T: 0, V: 100}}},
+		{Labels: map[string]string{"chrono_timeframe": "14days"}, Points: []model.Point{{T: 0, V: 0}}},
+	}
+	clamped := p.transforms[1].apply(in)
+	if clamped[0].Points[0].V != 100 || clamped[1].Points[0].V != 10 || in[1].Points[0].V != 100 {
+		t.Errorf("clamp should leave current and the input alone: %+v", clamped)
+	}
+	log := &p.transforms[0]
+	avg := log.undo(buildLastMonthAggregate(log.apply(in), false, minuteGrid, averageOver(2)), averageOver(2))
+	if want := math.Sqrt(101) - 1; math.Abs(avg[0].Points[0].V-want) > 1e-9 {
+		t.Errorf("log-space average = %v, want %v", avg[0].Points[0].V, want)
+	}
+
+	for _, bad := range []string{"- {match: x, transform: sqrt}", "- {match: x, transform: clamp}", "- {match: x, transform: log, min: 1}", "- {match: x, transform: clamp, min: 2, max: 1}"} {
+		var c []ValueTransformConfig
+		yaml.Unmarshal([]byte(bad), &c)
+		if _, err := compileValueTransforms(c); err == nil {
+			t.Errorf("%s should be rejected", bad)
+		}
+	}
+}
+
+func TestValueTransformsInQueries(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for i, at := range []int64{1700000000, 1700000000 - 7*86400, 1700000000 - 14*86400, 1700000000 - 21*86400, 1700000000 - 28*86400} {
+		v := []string{"5", "3", "3", "3", "1000"}[i]
+		fake.Serve("/api/v1/query", at, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"queue_depth"},"value":[`+model.FormatValue(float64(at))+`,"`+v+`"]}]}}`))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	max := 5.0
+	config := DefaultConfig
+	config.ValueTransforms = []ValueTransformConfig{{Match: "queue_depth", Transform: "clamp", Max: &max}}
+	w := httptest.NewRecorder()
+	NewChronoProxyWithConfig(config).ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape("queue_depth"), nil))
+	body := w.Body.String()
+	// (3+3+3+5)/4, with the 1000 clamped to 5 - but the 28days window itself comes back as it was
+	if !strings.Contains(body, `"chrono_timeframe":"lastMonthAverage"},"value":[1700000000,"3.5"]`) || !strings.Contains(body, `"1000"`) {
+		t.Errorf("got %s", body)
+	}
+}
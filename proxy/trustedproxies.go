@@ -0,0 +1,145 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/trustedproxies.go
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Trusted proxies - who's really asking, behind nginx, an ALB and a CDN 🕵️
+//
+// Behind a reverse proxy every connection comes from the proxy, so the rate
+// limiter sees one very busy client. trust_forwarded_for fixes that by
+// believing the first X-Forwarded-For entry, which is fine when the one
+// balancer in front overwrites the header, and wrong as soon as a client
+// can add its own entries or there's more than one hop.
+//
+// trusted_proxies lists the addresses (single IPs or CIDRs) of the hops we
+// run ourselves. A request whose connection comes from one of them is read
+// the way the proxies wrote it: X-Forwarded-For from the right, skipping
+// trusted hops, and the first address that isn't one is the client. A
+// client can prepend whatever it likes; it can't get past the hop that
+// appended its real address. The same requests also get their
+// X-Forwarded-Proto and X-Forwarded-Host believed, for the scheme and host
+// recorded on request spans.
+//
+// Connections from anywhere else are taken at face value, headers and all
+// ignored, and trust_forwarded_for only applies when trusted_proxies is
+// empty.
+
+// parseTrustedProxies reads trusted_proxies: IPs and CIDRs.
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted_proxies: %q is neither an IP nor a CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %w", err)
+		}
+		out = append(out, cidr)
+	}
+	return out, nil
+}
+
+// trustedProxy says whether addr is one of trusted_proxies.
+func (p *ChronoProxy) trustedProxy(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range p.trustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// viaTrustedProxy says whether r's connection comes from a trusted proxy.
+func (p *ChronoProxy) viaTrustedProxy(r *http.Request) bool {
+	return len(p.trustedProxies) > 0 && p.trustedProxy(clientIP(r, false))
+}
+
+// clientAddress is who's asking, going by trusted_proxies when set and
+// trust_forwarded_for when not.
+func (p *ChronoProxy) clientAddress(r *http.Request) string {
+	if len(p.trustedProxies) == 0 {
+		return clientIP(r, p.config.TrustForwardedFor)
+	}
+	peer := clientIP(r, false)
+	if !p.trustedProxy(peer) {
+		return peer
+	}
+	var hops []string
+	for _, xff := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(xff, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !p.trustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0] // trusted all the way down - the furthest one
+	}
+	return peer
+}
+
+// requestOrigin is the scheme and host r was sent to, as the client saw
+// them.
+func (p *ChronoProxy) requestOrigin(r *http.Request) (scheme, host string) {
+	scheme, host = "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p.viaTrustedProxy(r) {
+		if proto := firstForwarded(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fh := firstForwarded(r.Header.Get("X-Forwarded-Host")); fh != "" {
+			host = fh
+		}
+	}
+	return scheme, host
+}
+
+// firstForwarded is the first of a comma-separated X-Forwarded-* value -
+// the hop nearest the client.
+func firstForwarded(v string) string {
+	first, _, _ := strings.Cut(v, ",")
+	return strings.ToLower(strings.TrimSpace(first))
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientAddress(t *testing.T) {
+	config := DefaultConfig
+	config.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	p := NewChronoProxyWithConfig(config)
+
+	cases := []struct{ remote, xff, want string }{
+		{"10.0.0.1:5000", "203.0.113.7", "203.0.113.7"},
+		{"10.0.0.1:5000", "6.6.6.6, 203.0.113.7, 192.0.2.1", "203.0.113.7"}, // spoofed entry on the left
+		{"198.51.100.9:5000", "203.0.113.7", "198.51.100.9"},                // not ours: header ignored
+		{"10.0.0.1:5000", "", "10.0.0.1"},
+		{"10.0.0.1:5000", "10.1.1.1, 10.2.2.2", "10.1.1.1"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := p.clientAddress(r); got != tc.want {
+			t.Errorf("%s via %q = %s; want %s", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://chrono.internal/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "grafana.example.com, chrono.internal")
+	if scheme, host := p.requestOrigin(r); scheme != "https" || host != "grafana.example.com" {
+		t.Errorf("origin via trusted proxy = %s://%s", scheme, host)
+	}
+	r.RemoteAddr = "198.51.100.9:5000"
+	if scheme, host := p.requestOrigin(r); scheme != "http" || host != "chrono.internal" {
+		t.Errorf("origin from a stranger = %s://%s", scheme, host)
+	}
+	r.TLS = &tls.ConnectionState{}
+	if scheme, _ := p.requestOrigin(r); scheme != "https" {
+		t.Errorf("TLS connection scheme = %s", scheme)
+	}
+
+	config.TrustedProxies = []string{"10.0.0.0/33"}
+	if config.Validate() == nil {
+		t.Error("a bad CIDR should fail validation")
+	}
+}
+
+func TestRateLimitBehindTrustedProxy(t *testing.T) {
+	config := DefaultConfig
+	config.TrustedProxies = []string{"10.0.0.1"}
+	config.RateLimitPerClient = 1
+	config.RateLimitBurst = 1
+	p := NewChronoProxyWithConfig(config)
+
+	from := func(xff string) error {
+		r := httptest.NewRequest("GET", "/prom/api/v1/query", nil)
+		r.RemoteAddr = "10.0.0.1:5000"
+		r.Header.Set("X-Forwarded-For", xff)
+		return p.checkRateLimits(r)
+	}
+	if err := from("203.0.113.7"); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if err := from("203.0.113.8"); err != nil {
+		t.Errorf("a second client behind the same balancer was limited: %v", err)
+	}
+	if err := from("203.0.113.7"); err == nil {
+		t.Error("the first client's second request should be limited")
+	}
+}
@@ -0,0 +1,125 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/upstream_trace.go
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Upstream stopwatch!
+// When chrono queries get slow the first question is always "is Prometheus
+// slow, or is the network to Prometheus slow?". httptrace lets us time each
+// phase of every upstream request separately:
+//
+//   - dns:     resolving the upstream's hostname
+//   - connect: TCP handshake
+//   - tls:     TLS handshake (https upstreams only)
+//   - ttfb:    from sending the request to the first response byte -
+//              this is mostly Prometheus thinking
+//   - total:   the whole fetch, body and all
+//
+// Reused keep-alive connections skip dns/connect/tls entirely, which is
+// exactly what you want to see in the histograms.
+
+// Phase names used as the "phase" label.
+const (
+	phaseDNS     = "dns"
+	phaseConnect = "connect"
+	phaseTLS     = "tls"
+	phaseTTFB    = "ttfb"
+	phaseTotal   = "total"
+)
+
+// UpstreamPhaseTimings returns a snapshot of the per-upstream, per-phase
+// latency histograms (labels: upstream, phase).
+func (p *ChronoProxy) UpstreamPhaseTimings() []HistogramSnapshot {
+	return p.upstreamPhases.snapshot()
+}
+
+// traceUpstream wires an httptrace.ClientTrace into req. Call the returned
+// func once the body has been read (or the request failed) to record the
+// total.
+func (p *ChronoProxy) traceUpstream(req *http.Request) (*http.Request, func()) {
+	host := req.URL.Host
+	start := p.clock.Now()
+
+	var (
+		mu                               sync.Mutex
+		dnsStart, connectStart, tlsStart time.Time
+		wrote                            time.Time
+	)
+	record := func(phase string, since time.Time) {
+		if !since.IsZero() {
+			p.upstreamPhases.observe(p.since(since).Seconds(), host, phase)
+		}
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = p.clock.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			record(phaseDNS, dnsStart)
+			mu.Unlock()
+		},
+		ConnectStart: func(_, _ string) {
+			mu.Lock()
+			connectStart = p.clock.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			mu.Lock()
+			if err == nil {
+				record(phaseConnect, connectStart)
+			}
+			mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = p.clock.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			if err == nil {
+				record(phaseTLS, tlsStart)
+			}
+			mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			wrote = p.clock.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			record(phaseTTFB, wrote)
+			mu.Unlock()
+		},
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return req, func() { record(phaseTotal, start) }
+}
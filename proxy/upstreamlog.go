@@ -0,0 +1,122 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/upstreamlog.go
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Upstream request logging - "what exactly did you send them?" 📮
+//
+// With -debug, for a request with _command="TRACE", or for everything with
+// log_upstream_requests: true, each request to an upstream is logged as a
+// curl command - the final URL, upstream params and all, and the headers
+// it went with - so the upstream's owner can run exactly the same thing:
+//
+//   [UPSTREAM] curl -s 'http://prom:9090/api/v1/query?query=up&time=1699395200' -H 'Authorization: REDACTED'
+//
+// Credentials are masked on the way out: a URL's password, and any query
+// parameter or header named in scrub_params or in alwaysScrubbed (matched
+// case-insensitively). The value becomes REDACTED, so it's still clear the
+// parameter was sent. Retries are logged once per attempt.
+
+// alwaysScrubbed are masked whatever scrub_params says.
+var alwaysScrubbed = []string{
+	"authorization", "proxy-authorization", "cookie",
+	"password", "passwd", "secret", "client_secret", "token", "access_token", "api_key", "apikey",
+}
+
+const scrubbedValue = "REDACTED"
+
+// logsUpstream says whether requests made for ctx are logged.
+func (p *ChronoProxy) logsUpstream(ctx context.Context) bool {
+	return DebugMode.Load() || p.config.LogUpstreamRequests || traceFrom(ctx).enabled()
+}
+
+// logUpstreamRequest logs req as a curl command, when anything asked for it.
+func (p *ChronoProxy) logUpstreamRequest(ctx context.Context, req *http.Request) {
+	if p.logsUpstream(ctx) {
+		log.Printf("[UPSTREAM] %s", p.curlCommand(req))
+	}
+}
+
+// scrubbed says whether name's value is kept out of logs.
+func (p *ChronoProxy) scrubbed(name string) bool {
+	for _, list := range [][]string{alwaysScrubbed, p.config.ScrubParams} {
+		for _, s := range list {
+			if strings.EqualFold(s, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scrubURL is raw with its password and sensitive parameters masked.
+func (p *ChronoProxy) scrubURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if u.User != nil {
+		if _, has := u.User.Password(); has {
+			u.User = url.UserPassword(u.User.Username(), scrubbedValue)
+		}
+	}
+	q := u.Query()
+	for name, vs := range q {
+		if p.scrubbed(name) {
+			for i := range vs {
+				vs[i] = scrubbedValue
+			}
+		}
+	}
+	if len(q) > 0 {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// curlCommand is req as a curl command line, scrubbed.
+func (p *ChronoProxy) curlCommand(req *http.Request) string {
+	parts := []string{"curl -s", shellQuote(p.scrubURL(req.URL.String()))}
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range req.Header[name] {
+			if p.scrubbed(name) {
+				v = scrubbedValue
+			}
+			parts = append(parts, "-H", shellQuote(name+": "+v))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// shellQuote single-quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
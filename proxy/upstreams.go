@@ -0,0 +1,312 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/upstreams.go
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The upstream registry - our address book of Prometheus servers!
+//
+// Originally every request picked its own destination with a /host_port/
+// prefix. Handy, but it means anybody who can reach Chronotheus can make it
+// talk to anything Chronotheus can reach (hello SSRF 👋). So now upstreams
+// can be registered by name in the config file:
+//
+//   upstreams:
+//     - name: prod
+//       url: http://prometheus.prod.svc:9090
+//
+// and reached as /prod/api/v1/query. With restrict_upstreams: true, the old
+// /host_port/ style is switched off entirely and only registered names work.
+
+// UpstreamConfig is one named upstream as it appears in the config file.
+type UpstreamConfig struct {
+	Name   string             `yaml:"name"`             // Path prefix clients use, e.g. "prod" for /prod/api/v1/query
+	URL    string             `yaml:"url"`              // Where that name actually points, e.g. http://prometheus:9090
+	TLS    UpstreamTLSConfig  `yaml:"tls,omitempty"`    // CA bundle, client cert, skip-verify for https upstreams
+	Mirror *MirrorConfig      `yaml:"mirror,omitempty"` // Replay a share of queries elsewhere and compare (see mirror.go)
+	Auth   UpstreamAuthConfig `yaml:"auth,omitempty"`   // Credentials to send upstream (see auth.go)
+
+	Members []string          `yaml:"members,omitempty"` // Instead of a URL: fan queries out to these upstreams (see fanout.go)
+	Flavor  string            `yaml:"flavor,omitempty"`  // prometheus, thanos, mimir or victoriametrics, instead of probing (see capabilities.go)
+	Params  map[string]string `yaml:"params,omitempty"`  // Added to every window fetch unless the client set them, e.g. dedup: "true"
+}
+
+// upstream is a resolved destination ready to be talked to.
+type upstream struct {
+	name   string              // Registered name, or the raw host_port for legacy prefixes
+	base   string              // Base URL without trailing slash, e.g. http://prometheus:9090
+	client *http.Client        // Dedicated client when the upstream has its own TLS setup, nil otherwise
+	source string              // Which discovery source registered it, "" for the config file
+	pool   *srvPool            // Targets behind a dnssrv+ url, nil for a plain one (see dnssrv.go)
+	mirror *mirror             // Where sampled queries are replayed, nil = nowhere (see mirror.go)
+	auth   *UpstreamAuthConfig // Credentials to send, nil = none (see auth.go)
+
+	members []*upstream // What a virtual upstream fans out to, nil for a real one (see fanout.go)
+	flavor  string      // Configured flavour, "" = probe or pass through (see capabilities.go)
+	params  url.Values  // Added to window fetches that don't set them
+}
+
+// upstreamNameRegex keeps names to a single, boring path segment.
+var upstreamNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.\-_]*$`)
+
+// upstreamRegistry holds the named upstreams. It's safe for concurrent use
+// because discovery may add and remove names while requests are in flight.
+type upstreamRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]*upstream
+}
+
+func newUpstreamRegistry() *upstreamRegistry {
+	return &upstreamRegistry{byName: make(map[string]*upstream)}
+}
+
+// newUpstream checks a config entry and turns it into something usable.
+func newUpstream(c UpstreamConfig) (*upstream, error) {
+	u, err := newUpstreamTarget(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Flavor != "" {
+		if _, ok := configuredCapabilities[c.Flavor]; !ok {
+			return nil, fmt.Errorf("upstream %q: flavor must be one of prometheus, thanos, mimir or victoriametrics, got %q", c.Name, c.Flavor)
+		}
+	}
+	if len(c.Members) > 0 && (c.Flavor != "" || len(c.Params) > 0) {
+		return nil, fmt.Errorf("upstream %q: a virtual upstream has no flavor or params of its own, set them on the members", c.Name)
+	}
+	u.flavor = c.Flavor
+	for name, value := range c.Params {
+		if name == "" {
+			return nil, fmt.Errorf("upstream %q: params: empty parameter name", c.Name)
+		}
+		if u.params == nil {
+			u.params = make(url.Values, len(c.Params))
+		}
+		u.params.Set(name, value)
+	}
+	return u, nil
+}
+
+// newUpstreamTarget works out where c points.
+func newUpstreamTarget(c UpstreamConfig) (*upstream, error) {
+	if !upstreamNameRegex.MatchString(c.Name) {
+		return nil, fmt.Errorf("upstream %q: name must be a single path segment of letters, digits, '.', '-' or '_'", c.Name)
+	}
+	if c.Name == adminPrefix || c.Name == "api" || "/"+c.Name+"/" == tenantPathPrefix || "/"+c.Name == metricsPath {
+		return nil, fmt.Errorf("upstream %q: name is reserved for Chronotheus' own endpoints", c.Name)
+	}
+	if len(c.Members) > 0 {
+		if c.URL != "" {
+			return nil, fmt.Errorf("upstream %q: url and members can't be used together", c.Name)
+		}
+		return &upstream{name: c.Name}, nil
+	}
+	if strings.HasPrefix(c.URL, srvMarker) {
+		pool, err := newSRVPool(c.URL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", c.Name, err)
+		}
+		return &upstream{name: c.Name, base: c.URL, pool: pool, auth: authFor(c.Auth)}, nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: invalid url: %w", c.Name, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("upstream %q: url scheme must be http or https, got %q", c.Name, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream %q: url has no host", c.Name)
+	}
+	return &upstream{name: c.Name, base: strings.TrimSuffix(u.String(), "/"), auth: authFor(c.Auth)}, nil
+}
+
+// validateUpstreams makes sure every entry is sane and no name is used twice.
+func validateUpstreams(cfgs []UpstreamConfig) error {
+	seen := make(map[string]bool, len(cfgs))
+	for _, c := range cfgs {
+		if _, err := newUpstream(c); err != nil {
+			return err
+		}
+		if !c.TLS.isZero() {
+			if _, err := buildTLSConfig(c.TLS); err != nil {
+				return fmt.Errorf("upstream %q: %w", c.Name, err)
+			}
+		}
+		if err := c.Auth.validate(); err != nil {
+			return fmt.Errorf("upstream %q: auth: %w", c.Name, err)
+		}
+		if c.Mirror != nil {
+			if err := c.Mirror.validate(); err != nil {
+				return fmt.Errorf("upstream %q: %w", c.Name, err)
+			}
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("upstream %q: defined more than once", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return validateMembers(cfgs)
+}
+
+func (r *upstreamRegistry) set(u *upstream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byName[u.name] = u
+}
+
+// sync makes the set of upstreams owned by a discovery source exactly ups:
+// new names are added, vanished ones removed, moved ones updated. Names
+// owned by somebody else (the config file, another source) are left alone -
+// first come, first served. Returns what changed, for the logs.
+func (r *upstreamRegistry) sync(source string, ups []*upstream) (added, removed []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	want := make(map[string]*upstream, len(ups))
+	for _, u := range ups {
+		u.source = source
+		want[u.name] = u
+	}
+	for name, u := range r.byName {
+		if _, ok := want[name]; u.source == source && !ok {
+			delete(r.byName, name)
+			removed = append(removed, name)
+		}
+	}
+	for name, u := range want {
+		existing, ok := r.byName[name]
+		if ok && existing.source != source {
+			continue
+		}
+		if !ok {
+			added = append(added, name)
+		}
+		r.byName[name] = u
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func (r *upstreamRegistry) get(name string) (*upstream, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, ok := r.byName[name]
+	return u, ok
+}
+
+// all lists every registered upstream, in no particular order.
+func (r *upstreamRegistry) all() []*upstream {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*upstream, 0, len(r.byName))
+	for _, u := range r.byName {
+		out = append(out, u)
+	}
+	return out
+}
+
+// names lists everything registered, sorted so output is stable.
+func (r *upstreamRegistry) names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// errUnknownUpstream is what clients get when they ask for somewhere we
+// don't know about (or aren't allowed to go).
+type errUnknownUpstream struct{ prefix string }
+
+func (e errUnknownUpstream) Error() string {
+	return fmt.Sprintf("unknown upstream %q", e.prefix)
+}
+
+// resolveUpstream splits a request path into "who to talk to" and "what to
+// ask them". Registered names always win; legacy /host_port/ prefixes are
+// only accepted when restrict_upstreams is off. A legacy prefix can ask for
+// TLS with a scheme marker: /https+host_port/. The client picks the host, so
+// it never gets our credentials.
+func (p *ChronoProxy) resolveUpstream(path string) (*upstream, string, error) {
+	trimmed := strings.TrimPrefix(path, "/")
+	prefix, suffix, _ := strings.Cut(trimmed, "/")
+	suffix = "/" + suffix
+
+	if u, ok := p.upstreams.get(prefix); ok {
+		return u, suffix, nil
+	}
+
+	if p.config.RestrictUpstreams {
+		return nil, "", errUnknownUpstream{prefix}
+	}
+
+	m := pathRegex.FindStringSubmatch(path)
+	if m == nil {
+		return nil, "", fmt.Errorf("invalid target prefix")
+	}
+	host, port, suffix := m[1], m[2], m[3]
+	if suffix == "" {
+		suffix = "/"
+	}
+	scheme := "http"
+	if h, ok := strings.CutPrefix(host, httpsMarker); ok {
+		scheme, host = "https", h
+	}
+	return &upstream{
+		name:   host + "_" + port,
+		base:   fmt.Sprintf("%s://%s:%s", scheme, host, port),
+		client: p.tlsClient,
+	}, suffix, nil
+}
+
+// httpsMarker on a legacy path prefix switches the upstream to https.
+const httpsMarker = "https+"
+
+// upstreamKey carries the resolved upstream along with the request.
+type upstreamKey struct{}
+
+func withUpstream(ctx context.Context, u *upstream) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, u)
+}
+
+func upstreamFrom(ctx context.Context) *upstream {
+	u, _ := ctx.Value(upstreamKey{}).(*upstream)
+	return u
+}
+
+// clientFor picks the right phone line for whoever this request is talking to.
+func (p *ChronoProxy) clientFor(ctx context.Context) *http.Client {
+	if u := upstreamFrom(ctx); u != nil && u.client != nil {
+		return u.client
+	}
+	return p.client
+}
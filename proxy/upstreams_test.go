@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveUpstream(t *testing.T) {
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "prod", URL: "https://prom.example.com:9090/"}}
+	p := NewChronoProxyWithConfig(config)
+
+	u, suffix, err := p.resolveUpstream("/prod/api/v1/query")
+	if err != nil {
+		t.Fatalf("registered name: %v", err)
+	}
+	if u.base != "https://prom.example.com:9090" || suffix != "/api/v1/query" {
+		t.Errorf("got (%q,%q)", u.base, suffix)
+	}
+
+	u, suffix, err = p.resolveUpstream("/prometheus_9090/api/v1/labels")
+	if err != nil {
+		t.Fatalf("legacy prefix: %v", err)
+	}
+	if u.base != "http://prometheus:9090" || suffix != "/api/v1/labels" {
+		t.Errorf("got (%q,%q)", u.base, suffix)
+	}
+}
+
+func TestRestrictUpstreamsRejectsArbitraryHosts(t *testing.T) {
+	config := DefaultConfig
+	config.Upstreams = []UpstreamConfig{{Name: "prod", URL: "http://prom:9090"}}
+	config.RestrictUpstreams = true
+	p := NewChronoProxyWithConfig(config)
+
+	if _, _, err := p.resolveUpstream("/169.254.169.254_80/latest/meta-data"); err == nil {
+		t.Fatal("expected arbitrary host:port to be rejected")
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/internal-host_8080/api/v1/query", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("ServeHTTP status = %d; want 403", w.Code)
+	}
+}
+
+func TestValidateUpstreams(t *testing.T) {
+	cases := []struct {
+		name string
+		cfgs []UpstreamConfig
+		ok   bool
+	}{
+		{"valid", []UpstreamConfig{{Name: "prod", URL: "http://prom:9090"}}, true},
+		{"bad scheme", []UpstreamConfig{{Name: "prod", URL: "file:///etc/passwd"}}, false},
+		{"slash in name", []UpstreamConfig{{Name: "a/b", URL: "http://prom:9090"}}, false},
+		{"duplicate", []UpstreamConfig{{Name: "a", URL: "http://x"}, {Name: "a", URL: "http://y"}}, false},
+		{"virtual", []UpstreamConfig{{Name: "a", URL: "http://x"}, {Name: "b", URL: "http://y"}, {Name: "ab", Members: []string{"a", "b"}}}, true},
+		{"unknown member", []UpstreamConfig{{Name: "a", URL: "http://x"}, {Name: "ab", Members: []string{"a", "b"}}}, false},
+		{"virtual member", []UpstreamConfig{{Name: "a", URL: "http://x"}, {Name: "v", Members: []string{"a"}}, {Name: "w", Members: []string{"v"}}}, false},
+		{"flavor", []UpstreamConfig{{Name: "a", URL: "http://x", Flavor: "thanos", Params: map[string]string{"dedup": "true"}}}, true},
+		{"unknown flavor", []UpstreamConfig{{Name: "a", URL: "http://x", Flavor: "cortex"}}, false},
+		{"virtual flavor", []UpstreamConfig{{Name: "a", URL: "http://x"}, {Name: "v", Members: []string{"a"}, Flavor: "thanos"}}, false},
+		{"url and members", []UpstreamConfig{{Name: "a", URL: "http://x"}, {Name: "v", URL: "http://y", Members: []string{"a"}}}, false},
+	}
+	for _, tc := range cases {
+		if err := validateUpstreams(tc.cfgs); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v; want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/usage.go
+package proxy
+
+// Timeframe usage - is anybody actually looking at 21days?
+//
+// Every query without a chrono_timeframe costs a fetch per window, so a
+// window nobody looks at is pure overhead. chronotheus_timeframe_requests_total
+// counts what queries ask for, by chrono_timeframe value:
+//
+//   current, 7days, lastMonthP95...   that window or synthetic, by name
+//   all                               no chrono_timeframe - everything
+//   compare                           a chrono_compare pair (see compare.go)
+//   adhoc                             an ad-hoc window like 3days (see offsets.go)
+//   other                             anything we didn't recognise
+//
+// Only names we know get their own label value, so a client can't blow up
+// the series count by inventing timeframes. The counts survive restarts
+// with state_dir, since "unused" only means something over weeks.
+
+// Usage buckets that aren't a timeframe name.
+const (
+	usageAll     = "all"
+	usageCompare = "compare"
+	usageAdHoc   = "adhoc"
+	usageOther   = "other"
+)
+
+// countTimeframeUsage records what one query asked for.
+func (p *ChronoProxy) countTimeframeUsage(requested string, pair []window) {
+	p.timeframeRequests.inc(p.usageBucket(requested, pair))
+}
+
+// usageBucket is the label value for requested.
+func (p *ChronoProxy) usageBucket(requested string, pair []window) string {
+	switch {
+	case pair != nil:
+		return usageCompare
+	case requested == "":
+		return usageAll
+	case isSyntheticTimeframe(requested) || isRawTf(requested, p.timeframes):
+		return requested
+	}
+	if _, ok := adHocWindow(requested); ok {
+		return usageAdHoc
+	}
+	return usageOther
+}
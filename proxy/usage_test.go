@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+)
+
+func TestTimeframeUsageCounted(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	p := NewChronoProxyWithConfig(DefaultConfig)
+
+	for _, q := range []string{
+		`up`,
+		`up{chrono_timeframe="7days"}`,
+		`up{chrono_timeframe="7days"}`,
+		`up{chrono_timeframe="lastMonthP95"}`,
+		`up{chrono_timeframe="3days"}`,
+		`up{chrono_timeframe="made-up-nonsense"}`,
+		`up{chrono_compare="current-7days"}`,
+	} {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", prefix+"/api/v1/query?query="+q, nil))
+	}
+
+	got := make(map[string]uint64)
+	for _, snap := range p.timeframeRequests.snapshot() {
+		got[snap.Labels["timeframe"]] = snap.Value
+	}
+	want := map[string]uint64{"all": 1, "7days": 2, "lastMonthP95": 1, "adhoc": 1, "other": 1, "compare": 1}
+	for tf, n := range want {
+		if got[tf] != n {
+			t.Errorf("timeframe %q counted %d times, want %d (all: %v)", tf, got[tf], n, got)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("unexpected label values: %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `chronotheus_timeframe_requests_total{timeframe="7days"} 2`) {
+		t.Errorf("/metrics is missing the usage counter:\n%s", w.Body.String())
+	}
+}
@@ -20,9 +20,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -31,6 +34,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
 )
 
 // ─── PARAMS & STRIPPING ─────────────────────────────────────────────────────────
@@ -56,7 +61,7 @@ func parseClientParams(r *http.Request) url.Values {
 		}
 		if strings.Contains(ct, "application/json") {
 			var m map[string]interface{}
-			if err := json.Unmarshal(body, &m); err != nil {
+			if err := model.DecodeJSON(body, &m); err != nil {
 				return vals
 			}
 			for k, v := range m {
@@ -98,27 +103,18 @@ func parseClientParams(r *http.Request) url.Values {
 // Returns whatever it finds, empty strings if nothing found.
 // Pro tip: This is why your timeframes work even in complex queries!
 func detectSelectors(vals url.Values) (string, string) {
-	tf, cmd := "", ""
 	query := vals.Get("query")
 
-	// Detect chrono_timeframe in inline labels
-	if re := regexp.MustCompile(`chrono_timeframe="([^"]+)"`); re.MatchString(query) {
-		if matches := re.FindStringSubmatch(query); len(matches) > 1 {
-			tf = matches[1]
-			if DebugMode {
-				log.Printf("[DEBUG] Found inline timeframe: %s", tf)
-			}
-		}
+	// Detect chrono_timeframe in inline labels (see promql.go)
+	tf, _ := inlineMatcher(query, "chrono_timeframe")
+	if tf != "" && DebugMode.Load() {
+		log.Printf("[DEBUG] Found inline timeframe: %s", tf)
 	}
 
 	// Detect _command in inline labels
-	if re := regexp.MustCompile(`_command="([^"]+)"`); re.MatchString(query) {
-		if matches := re.FindStringSubmatch(query); len(matches) > 1 {
-			cmd = matches[1]
-			if DebugMode {
-				log.Printf("[DEBUG] Found inline command: %s", cmd)
-			}
-		}
+	cmd, _ := inlineMatcher(query, "_command")
+	if cmd != "" && DebugMode.Load() {
+		log.Printf("[DEBUG] Found inline command: %s", cmd)
 	}
 
 	return tf, cmd
@@ -131,6 +127,7 @@ func detectSelectors(vals url.Values) (string, string) {
 //   metric{label="value",chrono_timeframe="7days"} 
 // Into:
 //   metric{label="value"}
+// And chrono_timeframe=~"7days|14days" goes the same way.
 //
 // It's like those people who clean up after a parade - nobody sees them work,
 // but everything would be a mess without them!
@@ -138,16 +135,40 @@ func stripLabelFromParam(vals url.Values, key, label string) {
 	re := regexp.MustCompile(`,?` + regexp.QuoteMeta(label) + `="[^"]*"`)
 	if vs, ok := vals[key]; ok {
 		for i, s := range vs {
-			s = re.ReplaceAllString(s, "")
-			s = regexp.MustCompile(`,+`).ReplaceAllString(s, ",")
-			s = regexp.MustCompile(`{\\s*,+`).ReplaceAllString(s, "{")
-			s = regexp.MustCompile(`,+\\s*}`).ReplaceAllString(s, "}")
+			// Matchers the selector parser finds go cleanly, whatever
+			// their operator (see promql.go)
+			s, _ = removeMatchers(s, label)
+			if !re.MatchString(s) {
+				vs[i] = s
+				continue
+			}
+			// Whatever it couldn't read still mustn't reach the upstream.
+			// Keep going until nothing changes - otherwise
+			// chrono_timeframechrono_timeframe="x"="y" strips down to a
+			// brand new chrono_timeframe="y" and sneaks past us.
+			for {
+				next := re.ReplaceAllString(s, "")
+				if next == s {
+					break
+				}
+				s = next
+			}
+			s = multiCommaRegex.ReplaceAllString(s, ",")
+			s = leadingCommaRegex.ReplaceAllString(s, "{")
+			s = trailingCommaRegex.ReplaceAllString(s, "}")
 			vs[i] = s
 		}
 		vals[key] = vs
 	}
 }
 
+// Comma tidy-up after a label has been cut out of a selector.
+var (
+	multiCommaRegex    = regexp.MustCompile(`,+`)
+	leadingCommaRegex  = regexp.MustCompile(`{\s*,+`)
+	trailingCommaRegex = regexp.MustCompile(`,+\s*}`)
+)
+
 // remapMatch is our traffic 'acktchuuuuallly' equivalent!
 // It makes sure we use match[] instead of match because Prometheus 
 // gets grumpy if we don't. (Yes, the [] matters. A lot.) - #squareBracketLivesMatter
@@ -238,7 +259,12 @@ func forward(w http.ResponseWriter, r *http.Request, client *http.Client, urlStr
                 req.Header.Add(k, v)
             }
         }
+        if err := authorize(req); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
         
+        amplificationFrom(ctx).add()
         resp, err := client.Do(req)
         if err != nil {
             http.Error(w, err.Error(), http.StatusBadGateway)
@@ -269,57 +295,119 @@ func forward(w http.ResponseWriter, r *http.Request, client *http.Client, urlStr
  // each showing what happened at different points in time!
 //
 // Pro tip: This is what makes comparing data across time possible!
-func fetchWindowsInstant(p *ChronoProxy, params url.Values, endpoint, command string) []map[string]interface{} {
+//
+// A window that fails to fetch is left out, with a warning (see
+// failures.go). The only error returned is a *saturatedError, when there
+// was no upstream slot to fetch with at all (see ratelimit.go) - a
+// half-empty answer would look like real data.
+func fetchWindowsInstant(ctx context.Context, p *ChronoProxy, wins []window, params url.Values, endpoint, command string) ([]model.Series, error) {
 	// Pre-allocate slice with estimated capacity
-	all := make([]map[string]interface{}, 0, len(p.offsets)*10)
-	
-	for i, offset := range p.offsets {
-		tf := p.timeframes[i]
-		base := parseTime(params.Get("time"))
-		params.Set("time", strconv.FormatInt(base-offset, 10))
+	all := make([]model.Series, 0, len(wins)*10)
+	timeout := p.upstreamTimeout(params, false)
+	base := parseTimeMs(params.Get("time"), p.clock.Now())
+	answers := windowAnswers{}
+
+	for i, win := range wins {
+		tf := win.name
+		// Each window shifts from the original time - not from whatever the
+		// previous window left behind.
+		q := maps.Clone(params)
+		as := win // what the answer is decoded as
+		if win.viaOffset {
+			as = offsetWindow(q, win)
+		} else {
+			q.Set("time", model.FormatTimestamp(win.back(base)))
+		}
 
-		u := endpoint + "?" + buildQueryString(params)
-		resp, err := p.client.Get(u)
-		if err != nil {
+		u := endpoint + "?" + buildQueryString(q)
+		key := sameFetch(ctx, u, as, command)
+		if series, ok := answers.reuse(key, tf); ok {
+			traceReuse(ctx, tf, p.scrubURL(u), series)
+			reportProgress(ctx, i+1, len(wins))
+			if err := budgetFrom(ctx).charge(series); err != nil {
+				return nil, err
+			}
+			p.stale.put(staleKey(ctx, endpoint, tf, params), series, p.clock.Now())
+			all = append(all, series...)
 			continue
 		}
-		body, err := io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
-		resp.Body.Close()
+		wctx, sp := p.startWindowSpan(ctx, win)
+		start := p.clock.Now()
+		decode := func(ctx context.Context, r io.Reader) ([]model.Series, error) {
+			body, err := io.ReadAll(r)
+			p.windowBytes.observe(float64(len(body)), tf)
+			if err != nil {
+				return nil, err
+			}
+			series, skipped, err := decodeInstant(body, as, command)
+			if err == nil {
+				err = p.checkSamples(ctx, tf, skipped)
+			}
+			return series, err
+		}
+		series, err := p.coalescer.do(wctx, fetchKey(wctx, u, as, command), func(ctx context.Context) ([]model.Series, error) {
+			return p.fetchSeries(ctx, u, timeout, 10*1024*1024, decode)
+		})
+		sp.fail(err)
+		sp.finish()
+		p.windowFetches.observe(p.since(start).Seconds(), tf)
+		if err == nil {
+			p.windowSeries.observe(float64(len(series)), tf)
+		}
+		traceFetch(ctx, tf, p.scrubURL(u), series, err, p.since(start))
+		reportProgress(ctx, i+1, len(wins))
+		if err == nil {
+			err = budgetFrom(ctx).charge(series)
+		}
+		var sat *saturatedError
+		var limit *limitError
+		if errors.As(err, &sat) || errors.As(err, &limit) {
+			return nil, err
+		}
 		if err != nil {
+			all = append(all, p.windowFallback(ctx, staleKey(ctx, endpoint, tf, params), tf, err)...)
 			continue
 		}
+		answers[key] = series
+		p.stale.put(staleKey(ctx, endpoint, tf, params), series, p.clock.Now())
+		p.mirrorWindow(ctx, u, tf, timeout, series, decode)
+		all = append(all, series...)
+	}
+	return all, nil
+}
 
-		var jr instantRes
-		if err := json.Unmarshal(body, &jr); err != nil {
+// decodeInstant turns an upstream vector response into chrono series:
+// timestamps shifted forward to the present, labels tagged with the
+// window's timeframe (and command).
+// Upstream bodies are untrusted - samples that don't look like
+// [<number>, <value>] are skipped rather than allowed to panic, and
+// counted so malformed_samples can have its say (see malformed.go).
+//
+// This is one of the two places the JSON turns into model.Series (writeJSON
+// is the other); everything in between gets to use real types.
+func decodeInstant(body []byte, win window, command string) ([]model.Series, int, error) {
+	var jr instantRes
+	if err := model.DecodeJSON(body, &jr); err != nil {
+		return nil, 0, err
+	}
+	if jr.Status == "error" {
+		return nil, 0, &upstreamError{errType: jr.ErrorType, msg: jr.Error}
+	}
+	out := make([]model.Series, 0, len(jr.Data.Result))
+	skipped := 0
+	for _, s := range jr.Data.Result {
+		pt, ok := model.ParsePoint(s.Value)
+		if !ok {
+			skipped++
 			continue
 		}
-		for _, s := range jr.Data.Result {
-			tsf := s.Value[0].(float64)
-			ts := int64(tsf) + offset
-			val := fmt.Sprintf("%v", s.Value[1])
-
-			m := copyMetric(s.Metric)
-			m["chrono_timeframe"] = tf
-			if command != "" {
-				m["_command"] = command
-			}
-
-			all = append(all, map[string]interface{}{
-				"metric": m,
-				"value":  []interface{}{ts, val},
-			})
-		}
+		pt.T = win.forward(pt.T)
+		out = append(out, model.Series{
+			Labels: tagLabels(s.Metric, win.name, command),
+			Points: []model.Point{pt},
+		})
 	}
-	return all
-}
-
-type rangeRes struct {
-	Data struct {
-		Result []struct {
-			Metric map[string]interface{} `json:"metric"`
-			Values [][2]interface{}       `json:"values"`
-		} `json:"result"`
-	} `json:"data"`
+	return out, skipped, nil
 }
 
 // fetchWindowsRange is like fetchWindowsInstant's big brother!
@@ -331,64 +419,361 @@ type rangeRes struct {
  // 2. Fetches all the data points
  // 3. Shifts everything back to present time
  // 4. Labels everything properly
-func fetchWindowsRange(p *ChronoProxy, params url.Values, endpoint, command string) []map[string]interface{} {
-	var all []map[string]interface{}
-	for i, offset := range p.offsets {
+func fetchWindowsRange(ctx context.Context, p *ChronoProxy, wins []window, params url.Values, endpoint, command string) ([]model.Series, error) {
+	var all []model.Series
+	timeout := p.upstreamTimeout(params, true)
+	now := p.clock.Now()
+	baseStart := parseTimeMs(params.Get("start"), now)
+	baseEnd := parseTimeMs(params.Get("end"), now)
+	answers := windowAnswers{}
+	for i, win := range wins {
+		tf, offset := win.name, win.offset
 		
-		if DebugMode {
+		if DebugMode.Load() {
 			log.Printf("fetchWindowsRange: %d offset %d", i, offset)
 		}
 
-		tf := p.timeframes[i]
-		start := parseTime(params.Get("start")) - offset
-		end := parseTime(params.Get("end")) - offset
-		params.Set("start", strconv.FormatInt(start, 10))
-		params.Set("end",   strconv.FormatInt(end,   10))
+		q := maps.Clone(params)
+		as := win // what the answer is decoded as
+		if win.viaOffset {
+			as = offsetWindow(q, win)
+		} else {
+			q.Set("start", model.FormatTimestamp(win.back(baseStart)))
+			q.Set("end",   model.FormatTimestamp(win.back(baseEnd)))
+		}
 
-		u := endpoint + "?" + buildQueryString(params)
-		resp, err := p.client.Get(u)
+		u := endpoint + "?" + buildQueryString(q)
+		key := sameFetch(ctx, u, as, command)
+		if series, ok := answers.reuse(key, tf); ok {
+			traceReuse(ctx, tf, p.scrubURL(u), series)
+			reportProgress(ctx, i+1, len(wins))
+			if err := budgetFrom(ctx).charge(series); err != nil {
+				return nil, err
+			}
+			p.stale.put(staleKey(ctx, endpoint, tf, params), series, p.clock.Now())
+			all = append(all, series...)
+			continue
+		}
+		// Range bodies can be enormous, so we never hold one in memory:
+		// series are decoded one at a time straight off the wire. A window
+		// that turns out to be broken halfway through is dropped whole,
+		// same as a failed fetch.
+		wctx, sp := p.startWindowSpan(ctx, win)
+		start := p.clock.Now()
+		decode := func(ctx context.Context, body io.Reader) (out []model.Series, err error) {
+			counted := &countingReader{r: body}
+			defer func() { p.windowBytes.observe(float64(counted.n), tf) }()
+			var samples int64
+			skipped, err := decodeRangeStream(counted, as, command, func(s model.Series) error {
+				// Give up on a runaway window as soon as it's too big (see limits.go)
+				samples += int64(len(s.Points))
+				if err := budgetFrom(ctx).fits(int64(len(out)+1), samples); err != nil {
+					return err
+				}
+				out = append(out, s)
+				return nil
+			})
+			if err == nil {
+				err = p.checkSamples(ctx, tf, skipped)
+			}
+			return out, err
+		}
+		series, err := p.coalescer.do(wctx, fetchKey(wctx, u, as, command), func(ctx context.Context) ([]model.Series, error) {
+			return p.fetchSeries(ctx, u, timeout, 0, decode)
+		})
+		sp.fail(err)
+		sp.finish()
+		p.windowFetches.observe(p.since(start).Seconds(), tf)
+		if err == nil {
+			p.windowSeries.observe(float64(len(series)), tf)
+		}
+		traceFetch(ctx, tf, p.scrubURL(u), series, err, p.since(start))
+		reportProgress(ctx, i+1, len(wins))
+		if err == nil {
+			err = budgetFrom(ctx).charge(series)
+		}
+		var sat *saturatedError
+		var limit *limitError
+		if errors.As(err, &sat) || errors.As(err, &limit) {
+			return nil, err
+		}
 		if err != nil {
+			all = append(all, p.windowFallback(ctx, staleKey(ctx, endpoint, tf, params), tf, err)...)
 			continue
 		}
-		body, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
+		answers[key] = series
+		p.stale.put(staleKey(ctx, endpoint, tf, params), series, p.clock.Now())
+		p.mirrorWindow(ctx, u, tf, timeout, series, decode)
 
-		if DebugMode {
-			log.Printf("fetchWindowsRange offset- Got Data: %s", u)
+		if DebugMode.Load() {
+			log.Printf("fetchWindowsRange offset- Got Data: %s", p.scrubURL(u))
 		}
 
-		var jr rangeRes
-		if err := json.Unmarshal(body, &jr); err != nil {
-			continue
+		all = append(all, series...)
+
+		if DebugMode.Load() {
+			log.Printf("fetchWindowsRange offset loop timeshifted")
+		}   
+
+	}
+	if DebugMode.Load() {
+		log.Printf("fetchWindowsRange offset loop completed (total %d): ", len(all))
+	}
+	return all, nil
+}
+
+// decodeRange is decodeInstant for matrix responses.
+func decodeRange(body []byte, win window, command string) ([]model.Series, int, error) {
+	var out []model.Series
+	skipped, err := decodeRangeStream(bytes.NewReader(body), win, command, func(s model.Series) error {
+		out = append(out, s)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, skipped, nil
+}
+
+// decodeRangeStream is the streaming heart of decodeRange. Instead of
+// unmarshalling the whole response in one go it walks the JSON tokens down
+// to data.result and decodes one series at a time, handing each to emit as
+// soon as it's ready. Memory stays at roughly one series, however many
+// thousands the matrix holds. An error from emit stops the walk there.
+//
+// Keys we don't care about (warnings, ...) are skipped, in whatever order
+// they turn up. A {"status": "error"} answer is an *upstreamError. Numbers
+// stay json.Number until model.ParsePoint; the count of samples it
+// couldn't make sense of is returned.
+func decodeRangeStream(r io.Reader, win window, command string, emit func(model.Series) error) (int, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var status, errType, errMsg string
+	skipped := 0
+	err := walkObject(dec, func(key string) error {
+		switch key {
+		case "status":
+			return dec.Decode(&status)
+		case "errorType":
+			return dec.Decode(&errType)
+		case "error":
+			return dec.Decode(&errMsg)
+		case "data":
+		default:
+			return skipValue(dec)
 		}
-		for _, s := range jr.Data.Result {
-			shifted := make([]interface{}, len(s.Values))
-			for j, pair := range s.Values {
-				tsf := pair[0].(float64)
-				ts := int64(tsf) + offset
-				val := fmt.Sprintf("%v", pair[1])
-				shifted[j] = []interface{}{ts, val}
+		return walkObject(dec, func(key string) error {
+			if key != "result" {
+				return skipValue(dec)
 			}
-			m := copyMetric(s.Metric)
-			m["chrono_timeframe"] = tf
-			if command != "" {
-				m["_command"] = command
-			}
-			all = append(all, map[string]interface{}{
-				"metric": m,
-				"values": shifted,
+			return walkArray(dec, func() error {
+				var s rangeSeries
+				if err := dec.Decode(&s); err != nil {
+					return err
+				}
+				shifted := make([]model.Point, 0, len(s.Values))
+				for _, pair := range s.Values {
+					pt, ok := model.ParsePoint(pair)
+					if !ok {
+						skipped++
+						continue
+					}
+					pt.T = win.forward(pt.T)
+					shifted = append(shifted, pt)
+				}
+				return emit(model.Series{
+					Labels: tagLabels(s.Metric, win.name, command),
+					Points: shifted,
+				})
 			})
+		})
+	})
+	if err == nil && status == "error" {
+		err = &upstreamError{errType: errType, msg: errMsg}
+	}
+	return skipped, err
+}
+
+// rangeSeries is one entry of a matrix result.
+type rangeSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+// walkObject calls fn for every key of the object dec is sitting on; fn
+// must consume the value. A JSON null counts as an empty object, just like
+// json.Unmarshal would treat it.
+func walkObject(dec *json.Decoder, fn func(key string) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return fmt.Errorf("expected an object, got %v", tok)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
 		}
+		key, _ := tok.(string)
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token() // closing }
+	return err
+}
 
-		if DebugMode {
-			log.Printf("fetchWindowsRange offset loop timeshifted")
-		}   
+// walkArray calls fn once per element of the array dec is sitting on; fn
+// must consume the element. null is an empty array.
+func walkArray(dec *json.Decoder, fn func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("expected an array, got %v", tok)
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token() // closing ]
+	return err
+}
 
+// skipValue throws away the next value, however deeply nested.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
 	}
-	if DebugMode {
-		log.Printf("fetchWindowsRange offset loop completed (total %d): ", len(all))
+}
+
+// tagLabels copies an upstream label set and stamps it with the timeframe
+// (and command, if there is one) it was fetched for.
+func tagLabels(metric map[string]string, tf, command string) map[string]string {
+	m := copyMetric(metric)
+	m["chrono_timeframe"] = tf
+	if command != "" {
+		m["_command"] = command
 	}
-	return all
+	return m
+}
+
+// fetchBody is a context-aware stand-in for client.Get + io.ReadAll, so a
+// cancelled request (or a cancelled background job) stops hammering
+// Prometheus. Each call gets its own timeout (see upstreamTimeout) and the
+// body is capped at limit bytes (0 means no cap).
+//
+// Every fetch is also traced phase by phase (DNS, connect, TLS, first byte)
+// so we can tell a slow Prometheus from a slow network - see upstream_trace.go.
+func (p *ChronoProxy) fetchBody(ctx context.Context, u string, timeout time.Duration, limit int64) ([]byte, error) {
+	var body []byte
+	err := p.fetchStream(ctx, u, timeout, limit, func(r io.Reader) (err error) {
+		body, err = io.ReadAll(r)
+		return err
+	})
+	return body, err
+}
+
+// fetchStream is fetchBody for bodies too big to hold in memory: read gets
+// the (capped) response body while it's still streaming in. The timeout
+// covers the whole read, not just the headers.
+//
+// Failures are counted per upstream host for /metrics: "transport" when we
+// never got a response, "status_4xx"/"status_5xx" when Prometheus said no
+// (the body is still handed to read - it's usually a useful error), and
+// "response" when read couldn't make sense of what came back. Failures
+// worth another try come back as a transientError (see retry.go).
+func (p *ChronoProxy) fetchStream(ctx context.Context, u string, timeout time.Duration, limit int64, read func(io.Reader) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if err := authorize(req); err != nil {
+		return err
+	}
+	release, err := p.acquireUpstream(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	host := req.URL.Host
+	_, sp := p.startSpan(ctx, "GET "+req.URL.Path, spanKindClient)
+	defer sp.finish()
+	if sp != nil {
+		sp.set("server.address", host)
+		req.Header.Set(traceparentHeader, sp.traceparent())
+	}
+	amplificationFrom(ctx).add()
+	p.logUpstreamRequest(ctx, req)
+	req, finish := p.traceUpstream(req)
+	resp, err := p.chaos.do(p.clientFor(ctx), req)
+	defer finish()
+	if err != nil {
+		p.upstreamErrors.inc(host, "transport")
+		sp.fail(err)
+		if transportTransient(err) {
+			return transient(err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	sp.set("http.response.status_code", strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		sp.fail(fmt.Errorf("upstream answered %s", resp.Status))
+	}
+
+	switch {
+	case resp.StatusCode >= 500:
+		p.upstreamErrors.inc(host, "status_5xx")
+	case resp.StatusCode >= 400:
+		p.upstreamErrors.inc(host, "status_4xx")
+	}
+
+	var body io.Reader = budgetFrom(ctx).reader(resp.Body)
+	if limit > 0 {
+		body = io.LimitReader(body, limit)
+	}
+	if err := read(body); err != nil {
+		var over *limitError
+		if errors.As(err, &over) {
+			return err // not the upstream's fault
+		}
+		p.upstreamErrors.inc(host, "response")
+		sp.fail(err)
+		if resp.StatusCode >= 500 || readTransient(err) {
+			return transient(err)
+		}
+		return err
+	}
+	return nil
 }
 
 // ─── HELPERS ───────────────────────────────────────────────────────────────────
@@ -405,22 +790,35 @@ func containsString(arr []interface{}, s string) bool {
 	return false
 }
 
+// parseTimeMs is parseTime to the millisecond. Prometheus takes fractional
+// seconds ("1700000000.25") and RFC3339 with a fraction, so we do too, and
+// hand back Unix milliseconds - the unit model.Point keeps.
+func parseTimeMs(s string, now time.Time) int64 {
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return model.ParseTimestamp(f)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixMilli()
+	}
+	return now.UnixMilli()
+}
+
 // parseTime is our time wizard!
 // Give it:
 // - Unix timestamps (like "1621234567")
 // - RFC3339 strings (like "2023-05-22T12:34:56Z")
-// - Nothing (it'll use current time)
+// - Nothing (it'll use now, whatever the proxy's clock says that is)
 //
  // And it always gives you back Unix seconds!
 // No more time format headaches! 🎉
-func parseTime(s string) int64 {
+func parseTime(s string, now time.Time) int64 {
 	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
 		return i
 	}
 	if t, err := time.Parse(time.RFC3339, s); err == nil {
 		return t.Unix()
 	}
-	return time.Now().Unix()
+	return now.Unix()
 }
 
 // signature is our metric fingerprinter!
@@ -429,20 +827,13 @@ func parseTime(s string) int64 {
 //
 // Think of it like a fingerprint for your metrics - 
 // same metric = same signature, even if the timestamps are different!
-func signature(m map[string]interface{}) string {
+func signature(m map[string]string) string {
 	cp := copyMetric(m)
 	delete(cp, "chrono_timeframe")
 	delete(cp, "_command")
-	keys := make([]string, 0, len(cp))
-	for k := range cp {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	ord := map[string]interface{}{}
-	for _, k := range keys {
-		ord[k] = cp[k]
-	}
-	b, _ := json.Marshal(ord)
+	// encoding/json writes map keys sorted, so equal label sets always
+	// produce equal strings.
+	b, _ := json.Marshal(cp)
 	return string(b)
 }
 
@@ -451,8 +842,8 @@ func signature(m map[string]interface{}) string {
 // you need to modify it without changing the original.
 //
  // Pro tip: Go maps are reference types - this prevents accidents!
-func copyMetric(orig map[string]interface{}) map[string]interface{} {
-	dup := make(map[string]interface{}, len(orig))
+func copyMetric(orig map[string]string) map[string]string {
+	dup := make(map[string]string, len(orig))
 	for k, v := range orig {
 		dup[k] = v
 	}
@@ -466,19 +857,19 @@ func copyMetric(orig map[string]interface{}) map[string]interface{} {
 //
 // Think of it like cleaning up after a party - 
 // making sure there's only one of each cup left on the table.
-func dedupeSeries(all []map[string]interface{}) []map[string]interface{} {
+func dedupeSeries(all []model.Series) []model.Series {
 	if len(all) == 0 {
 		return all
 	}
 	
 	// Pre-allocate map with capacity
-	bySig := make(map[string][]map[string]interface{}, len(all))
+	bySig := make(map[string][]model.Series, len(all))
 	
 	// Pre-allocate output slice
-	out := make([]map[string]interface{}, 0, len(all))
+	out := make([]model.Series, 0, len(all))
 	
 	for _, s := range all {
-		sig := signature(s["metric"].(map[string]interface{}))
+		sig := signature(s.Labels)
 		bySig[sig] = append(bySig[sig], s)
 	}
 	
@@ -488,6 +879,65 @@ func dedupeSeries(all []map[string]interface{}) []map[string]interface{} {
 	return out
 }
 
+// sortSeries lines the output up the same way every time: raw timeframes
+// oldest-last, then any ad-hoc windows (see offsets.go), then the
+// synthetics, and within a timeframe by label set.
+// Map iteration order is random in Go, and Grafana (not to mention our
+// golden tests) deserves better than a shuffled legend on every refresh.
+func sortSeries(all []model.Series) {
+	rank := make(map[string]int)
+	for i, tf := range proxyTimeframes() {
+		rank[tf] = i + 1
+	}
+	adHoc := len(rank) + 1
+	for i, tf := range syntheticTimeframes() {
+		rank[tf] = adHoc + i + 1
+	}
+	sigs := make([]string, len(all))
+	tfs := make([]int, len(all))
+	les := make([]float64, len(all))
+	for i, s := range all {
+		r, ok := rank[s.Labels["chrono_timeframe"]]
+		if _, q := histogramQuantileFor(s.Labels["chrono_timeframe"]); !ok && q {
+			r = adHoc + len(rank) // after the named synthetics
+		} else if !ok {
+			r = adHoc
+		}
+		tfs[i], sigs[i] = r, signature(s.Labels)
+		// Histogram buckets go in le order, numerically (see histograms.go)
+		if le, ok := bucketBound(s); ok {
+			rest := copyMetric(s.Labels)
+			delete(rest, "le")
+			sigs[i], les[i] = signature(rest), le
+		}
+	}
+	sort.Sort(seriesSorter{all, tfs, sigs, les})
+}
+
+type seriesSorter struct {
+	series []model.Series
+	tfs    []int
+	sigs   []string
+	les    []float64
+}
+
+func (s seriesSorter) Len() int { return len(s.series) }
+func (s seriesSorter) Less(i, j int) bool {
+	if s.tfs[i] != s.tfs[j] {
+		return s.tfs[i] < s.tfs[j]
+	}
+	if s.sigs[i] != s.sigs[j] {
+		return s.sigs[i] < s.sigs[j]
+	}
+	return s.les[i] < s.les[j]
+}
+func (s seriesSorter) Swap(i, j int) {
+	s.series[i], s.series[j] = s.series[j], s.series[i]
+	s.tfs[i], s.tfs[j] = s.tfs[j], s.tfs[i]
+	s.sigs[i], s.sigs[j] = s.sigs[j], s.sigs[i]
+	s.les[i], s.les[j] = s.les[j], s.les[i]
+}
+
 // proxyTimeframes is our time window menu! This needs to be configurable in the future.
 // It lists all the timeframes we support for our metrics. We should share the data and 
 // have it as a key value pair thing so the second offset is combined with it.
@@ -512,96 +962,11 @@ func proxyTimeframes() []string {
 // - But now it's 1500 req/s
 // - You know something's up!
 //
-// Pro tip: This powers our trend detection and comparisons!
-func buildLastMonthAverage(
-		seriesList []map[string]interface{},
-		isRange bool,
-	) []map[string]interface{} {
-
-		if DebugMode {
-			log.Println("buildLastMonthAverage")
-		}
-
-		n := len(proxyTimeframes()) - 1
-		if n < 1 {
-			return nil
-		}
-		groups := make(map[string][]map[string]interface{})
-		for _, s := range seriesList {
-			m := s["metric"].(map[string]interface{})
-			if m["chrono_timeframe"] == "current" {
-				continue
-			}
-			base := copyMetric(m)
-			delete(base, "chrono_timeframe")
-			delete(base, "_command")
-			sig := signature(base)
-			groups[sig] = append(groups[sig], s)
-		}
-		var out []map[string]interface{}
-		for sig, grp := range groups {
-			sums := make(map[int64]float64)
-			for _, s := range grp {
-				var pts []interface{}
-				if isRange {
-					pts = s["values"].([]interface{})
-				} else {
-					pts = []interface{}{s["value"]}
-				}
-				for _, iv := range pts {
-					pair := iv.([]interface{})
-					// robust TS conversion
-					var tsF float64
-					switch t := pair[0].(type) {
-					case float64:
-						tsF = t
-					case int64:
-						tsF = float64(t)
-					case int:
-						tsF = float64(t)
-					case json.Number:
-						if f, err := t.Float64(); err == nil {
-							tsF = f
-						} else {
-							continue
-						}
-					default:
-						continue
-					}
-					minute := (int64(tsF) / 60) * 60
-					vStr := fmt.Sprintf("%v", pair[1])
-					v, err := strconv.ParseFloat(vStr, 64)
-					if err != nil {
-						continue
-					}
-					sums[minute] += v
-				}
-			}
-			var mins []int64
-			for m := range sums {
-				mins = append(mins, m)
-			}
-			sort.Slice(mins, func(i, j int) bool { return mins[i] < mins[j] })
-			var ptsOut []interface{}
-			for _, m := range mins {
-				avg := sums[m] / float64(n)
-				ptsOut = append(ptsOut, []interface{}{m, fmt.Sprintf("%g", avg)})
-			}
-			metric := make(map[string]interface{})
-			json.Unmarshal([]byte(sig), &metric)
-			metric["chrono_timeframe"] = "lastMonthAverage"
-			if isRange {
-				out = append(out, map[string]interface{}{"metric": metric, "values": ptsOut})
-			} else {
-				last := ptsOut[len(ptsOut)-1].([]interface{})
-				out = append(out, map[string]interface{}{"metric": metric, "value": last})
-			}
-		}
-		if DebugMode {
-			log.Printf("buildLastMonthAverage: %d series", len(out))
-		}
-		return out
-	}
+// Pro tip: This powers our trend detection and comparisons! Its cousins
+// (min, max, p95...) live in aggregations.go.
+func buildLastMonthAverage(seriesList []model.Series, isRange bool) []model.Series {
+	return buildLastMonthAggregate(seriesList, isRange, minuteGrid, averageAggregation)
+}
 
 // appendCompare is our difference detector!
 // Shows how current values differ from the monthly average.
@@ -614,107 +979,17 @@ func buildLastMonthAverage(
 //
 // Pro tip: Great for capacity planning and anomaly detection!
 func appendCompare(
-		base []map[string]interface{},
-		curMap, avgMap map[string]map[string]interface{},
+		base []model.Series,
+		curMap, avgMap map[string]model.Series,
 		command string,
 		isRange bool,
-	) []map[string]interface{} {
-		if DebugMode {
+	) []model.Series {
+		if DebugMode.Load() {
 			log.Println("appendCompare")
 		}
-		// base is the current series
-		out := base
-
-		for sig, c := range curMap {
-			a, ok := avgMap[sig]
-			if !ok {
-				continue
-			}
-
-			// prepare metric
-			orig := c["metric"].(map[string]interface{})
-			nm := copyMetric(orig)
-			nm["chrono_timeframe"] = "compareAgainstLast28"
-			if command != "" {
-				nm["_command"] = command
-			}
-
-			if !isRange {
-				// instant case
-				cv := c["value"].([]interface{})
-				av := a["value"].([]interface{})
-				vc, _ := strconv.ParseFloat(fmt.Sprintf("%v", cv[1]), 64)
-				va, _ := strconv.ParseFloat(fmt.Sprintf("%v", av[1]), 64)
-				diff := vc - va
-				out = append(out, map[string]interface{}{
-					"metric": nm,
-					"value":  []interface{}{cv[0], fmt.Sprintf("%g", diff)},
-				})
-			} else {
-				// range case: build lookup of average by timestamp
-				aVals := a["values"].([]interface{})
-				avgByTs := make(map[int64]float64, len(aVals))
-				for _, iv := range aVals {
-					pair := iv.([]interface{})
-					// robust timestamp decode
-					var tsF float64
-					switch t := pair[0].(type) {
-					case float64:
-						tsF = t
-					case int64:
-						tsF = float64(t)
-					case int:
-						tsF = float64(t)
-					case json.Number:
-						if f, err := t.Float64(); err == nil {
-							tsF = f
-						} else {
-							continue
-						}
-					default:
-						continue
-					}
-					ts := int64(tsF)
-					v, _ := strconv.ParseFloat(fmt.Sprintf("%v", pair[1]), 64)
-					avgByTs[ts] = v
-				}
-
-				// subtract average from current series point-by-point
-				cVals := c["values"].([]interface{})
-				var valsOut []interface{}
-				for _, iv := range cVals {
-					pair := iv.([]interface{})
-					var tsF float64
-					switch t := pair[0].(type) {
-					case float64:
-						tsF = t
-					case int64:
-						tsF = float64(t)
-					case int:
-						tsF = float64(t)
-					case json.Number:
-						if f, err := t.Float64(); err == nil {
-							tsF = f
-						} else {
-							continue
-						}
-					default:
-						continue
-					}
-					ts := int64(tsF)
-					vc, _ := strconv.ParseFloat(fmt.Sprintf("%v", pair[1]), 64)
-					va := avgByTs[ts] // zero if missing
-					diff := vc - va
-					valsOut = append(valsOut, []interface{}{ts, fmt.Sprintf("%g", diff)})
-				}
-
-				out = append(out, map[string]interface{}{
-					"metric": nm,
-					"values": valsOut,
-				})
-			}
-		}
-		if DebugMode {
+		out := appendSynthetic(base, curMap, avgMap, "compareAgainstLast28", command, isRange,
+			func(cur, avg float64) float64 { return cur - avg })
+		if DebugMode.Load() {
 			log.Printf("appendCompare: %d series", len(out))
 		}
 		return out
@@ -731,113 +1006,76 @@ func appendCompare(
 //
 // Pro tip: Perfect for relative comparisons across different scales!
 func appendPercent(
-		base []map[string]interface{},
-		curMap, avgMap map[string]map[string]interface{},
+		base []model.Series,
+		curMap, avgMap map[string]model.Series,
 		command string,
 		isRange bool,
-	) []map[string]interface{} {
+	) []model.Series {
 
-		if DebugMode {
+		if DebugMode.Load() {
 			log.Println("appendPercent")
 		}
 
-		out := base
+		out := appendSynthetic(base, curMap, avgMap, "percentCompareAgainstLast28", command, isRange,
+			func(cur, avg float64) float64 {
+				if avg == 0 {
+					return 0
+				}
+				return (cur - avg) / avg * 100
+			})
 
+		if DebugMode.Load() {
+			log.Printf("appendPercent: %d series", len(out))
+		}
+
+		return out
+	}
+
+// appendSynthetic does the legwork for appendCompare and appendPercent:
+// pair every current series with its average and combine the two with fn.
+//
+// Instant series compare their single points. Range series compare point by
+// point on timestamp - a current point with no average at that timestamp is
+// compared against zero.
+func appendSynthetic(
+		base []model.Series,
+		curMap, avgMap map[string]model.Series,
+		tf, command string,
+		isRange bool,
+		fn func(cur, avg float64) float64,
+	) []model.Series {
+		out := base
 		for sig, c := range curMap {
 			a, ok := avgMap[sig]
 			if !ok {
 				continue
 			}
 
-			orig := c["metric"].(map[string]interface{})
-			nm := copyMetric(orig)
-			nm["chrono_timeframe"] = "percentCompareAgainstLast28"
+			nm := copyMetric(c.Labels)
+			nm["chrono_timeframe"] = tf
 			if command != "" {
 				nm["_command"] = command
 			}
 
+			var pts []model.Point
 			if !isRange {
-				cv := c["value"].([]interface{})
-				av := a["value"].([]interface{})
-				vc, _ := strconv.ParseFloat(fmt.Sprintf("%v", cv[1]), 64)
-				va, _ := strconv.ParseFloat(fmt.Sprintf("%v", av[1]), 64)
-				pct := 0.0
-				if va != 0 {
-					pct = (vc - va) / va * 100
+				cv, ok1 := c.Last()
+				av, ok2 := a.Last()
+				if !ok1 || !ok2 {
+					continue
 				}
-				out = append(out, map[string]interface{}{
-					"metric": nm,
-					"value":  []interface{}{cv[0], fmt.Sprintf("%g", pct)},
-				})
+				pts = []model.Point{{T: cv.T, V: fn(cv.V, av.V)}}
 			} else {
-				aVals := a["values"].([]interface{})
-				avgByTs := make(map[int64]float64, len(aVals))
-				for _, iv := range aVals {
-					pair := iv.([]interface{})
-					var tsF float64
-					switch t := pair[0].(type) {
-					case float64:
-						tsF = t
-					case int64:
-						tsF = float64(t)
-					case int:
-						tsF = float64(t)
-					case json.Number:
-						if f, err := t.Float64(); err == nil {
-							tsF = f
-						} else {
-							continue
-						}
-					default:
-						continue
-					}
-					ts := int64(tsF)
-					v, _ := strconv.ParseFloat(fmt.Sprintf("%v", pair[1]), 64)
-					avgByTs[ts] = v
+				avgByTs := make(map[int64]float64, len(a.Points))
+				for _, pt := range a.Points {
+					avgByTs[pt.T] = pt.V
 				}
-
-				cVals := c["values"].([]interface{})
-				var valsOut []interface{}
-				for _, iv := range cVals {
-					pair := iv.([]interface{})
-					var tsF float64
-					switch t := pair[0].(type) {
-					case float64:
-						tsF = t
-					case int64:
-						tsF = float64(t)
-					case int:
-						tsF = float64(t)
-					case json.Number:
-						if f, err := t.Float64(); err == nil {
-							tsF = f
-						} else {
-							continue
-						}
-					default:
-						continue
-					}
-					ts := int64(tsF)
-					vc, _ := strconv.ParseFloat(fmt.Sprintf("%v", pair[1]), 64)
-					va := avgByTs[ts]
-					pct := 0.0
-					if va != 0 {
-						pct = (vc - va) / va * 100
-					}
-					valsOut = append(valsOut, []interface{}{ts, fmt.Sprintf("%g", pct)})
+				for _, pt := range c.Points {
+					pts = append(pts, model.Point{T: pt.T, V: fn(pt.V, avgByTs[pt.T])})
 				}
-
-				out = append(out, map[string]interface{}{
-					"metric": nm,
-					"values": valsOut,
-				})
 			}
+			out = append(out, model.Series{Labels: nm, Points: pts})
 		}
-
-		if DebugMode {
-			log.Printf("appendPercent: %d series", len(out))
-		}
-
 		return out
 	}
 
@@ -849,21 +1087,21 @@ func appendPercent(
 //
 // Pro tip: This is why you only see the data you asked for!
 func filterByTimeframe(
-		all []map[string]interface{},
+		all []model.Series,
 		tf string,
-	) []map[string]interface{} {
-		var out []map[string]interface{}
-		if DebugMode {
+	) []model.Series {
+		var out []model.Series
+		if DebugMode.Load() {
 			log.Printf("Filtering metrics - only returning '%s'", tf)
 		}
 		for _, s := range all {
-			if DebugMode {
-				log.Printf("Checking: '%s' matches '%s'",s["metric"].(map[string]interface{})["chrono_timeframe"], tf)
+			if DebugMode.Load() {
+				log.Printf("Checking: '%s' matches '%s'", s.Labels["chrono_timeframe"], tf)
 			}
-			if s["metric"].(map[string]interface{})["chrono_timeframe"] == tf {
+			if s.Labels["chrono_timeframe"] == tf {
 				out = append(out, s)
-				if DebugMode {
-					log.Printf("Matched: '%s' matches '%s'",s["metric"].(map[string]interface{})["chrono_timeframe"], tf)
+				if DebugMode.Load() {
+					log.Printf("Matched: '%s' matches '%s'", s.Labels["chrono_timeframe"], tf)
 				}
 			}
 		}
@@ -875,13 +1113,17 @@ func filterByTimeframe(
 // Because speaking the right language is important, and it has been an absolute pain in the arse at times.
 //
 // Pro tip: This is why Grafana can read our responses!
-func writeJSON(w http.ResponseWriter, rt string, result []map[string]interface{}) {
+func writeJSON(w http.ResponseWriter, rt string, result []model.Series) {
+	var encoded interface{} = model.Matrix(result)
+	if rt == "vector" {
+		encoded = model.Vector(result)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status": "success",
 		"data": map[string]interface{}{
 			"resultType": rt,
-			"result":     result,
+			"result":     encoded,
 		},
 	})
 }
@@ -894,30 +1136,41 @@ func writeJSONRaw(w http.ResponseWriter, v interface{}) {
 	json.NewEncoder(w).Encode(v)
 }
 
+// writeJSONError is writeJSONRaw's grumpy sibling.
+// It speaks the Prometheus error dialect (status/errorType/error) so Grafana
+// shows something useful instead of "unexpected end of JSON input".
+func writeJSONError(w http.ResponseWriter, code int, errType, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "error",
+		"errorType": errType,
+		"error":     msg,
+	})
+}
+
 // indexBySignature is our metric organiser!
 // Takes all your metrics and sorts them into two piles:
 // - Current values (what's happening now)
 // - Average values (what usually happens)
 // It makes it much easier to find things later!
 func indexBySignature(
-		all []map[string]interface{},
-		avgList []map[string]interface{},
-	) (map[string]map[string]interface{}, map[string]map[string]interface{}) {
+		all []model.Series,
+		avgList []model.Series,
+	) (map[string]model.Series, map[string]model.Series) {
 
-		curMap := make(map[string]map[string]interface{}, len(all))
-		avgMap := make(map[string]map[string]interface{}, len(avgList))
+		curMap := make(map[string]model.Series, len(all))
+		avgMap := make(map[string]model.Series, len(avgList))
 
 		// collect current series
 		for _, s := range all {
-			m := s["metric"].(map[string]interface{})
-			if tf, ok := m["chrono_timeframe"].(string); ok && tf == "current" {
-				curMap[signature(m)] = s
+			if s.Labels["chrono_timeframe"] == "current" {
+				curMap[signature(s.Labels)] = s
 			}
 		}
 		// collect average series
 		for _, s := range avgList {
-			m := s["metric"].(map[string]interface{})
-			avgMap[signature(m)] = s
+			avgMap[signature(s.Labels)] = s
 		}
 		return curMap, avgMap
 	}
@@ -928,14 +1181,14 @@ func indexBySignature(
 //
 // Pro tip: This is how we track which series were generated vs raw!
 func appendWithCommand(
-		base []map[string]interface{},
-		avgList []map[string]interface{},
+		base []model.Series,
+		avgList []model.Series,
 		command string,
-	) []map[string]interface{} {
+	) []model.Series {
 		out := base
 		for _, a := range avgList {
 			if command != "" {
-				a["metric"].(map[string]interface{})["_command"] = command
+				a.Labels["_command"] = command
 			}
 			out = append(out, a)
 		}
@@ -945,10 +1198,13 @@ func appendWithCommand(
 // instantRes helps us decode Prometheus instant query responses.
 // It's like a template for the JSON that Prometheus sends back!
 type instantRes struct {
-	Data struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
 		Result []struct {
-			Metric map[string]interface{} `json:"metric"`
-			Value  [2]interface{}         `json:"value"`
+			Metric map[string]string `json:"metric"`
+			Value  [2]interface{}     `json:"value"`
 		} `json:"result"`
 	} `json:"data"`
 }
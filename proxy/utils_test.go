@@ -2,14 +2,14 @@
 package proxy
 
 import (
-	"fmt"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
-	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/andydixon/chronotheus/internal/model"
 )
 
 // ─── parseTime ─────────────────────────────────────────────────────────────────
@@ -26,7 +26,7 @@ func TestParseTime(t *testing.T) {
 		{"bogus", now},
 	}
 	for _, tc := range cases {
-		got := parseTime(tc.in)
+		got := parseTime(tc.in, time.Unix(now, 0))
 		if tc.in == "" || tc.in == "bogus" {
 			// allow ±2s
 			if diff := got - now; diff < -2 || diff > 2 {
@@ -108,7 +108,7 @@ func TestDetectSelectors(t *testing.T) {
 // ─── signature ─────────────────────────────────────────────────────────────────
 
 func TestSignature_IgnoresSyntheticAndSorts(t *testing.T) {
-	m := map[string]interface{}{
+	m := map[string]string{
 		"b":                "two",
 		"a":                "one",
 		"chrono_timeframe": "7days",
@@ -124,10 +124,10 @@ func TestSignature_IgnoresSyntheticAndSorts(t *testing.T) {
 // ─── dedupeSeries ──────────────────────────────────────────────────────────────
 
 func TestDedupeSeries(t *testing.T) {
-	s1 := map[string]interface{}{"metric": map[string]interface{}{"a": "1"}}
-	s2 := map[string]interface{}{"metric": map[string]interface{}{"a": "1"}}
-	s3 := map[string]interface{}{"metric": map[string]interface{}{"a": "2"}}
-	in := []map[string]interface{}{s1, s2, s3}
+	s1 := model.Series{Labels: map[string]string{"a": "1"}}
+	s2 := model.Series{Labels: map[string]string{"a": "1"}}
+	s3 := model.Series{Labels: map[string]string{"a": "2"}}
+	in := []model.Series{s1, s2, s3}
 	out := dedupeSeries(in)
 	if len(out) != 3 {
 		t.Errorf("len=%d; want 3", len(out))
@@ -139,25 +139,24 @@ func TestDedupeSeries(t *testing.T) {
 func TestBuildLastMonthAverage_Vector(t *testing.T) {
 	// four historical slices, same signature, single point
 	tfs := proxyTimeframes()[1:] // skip "current"
-	var input []map[string]interface{}
+	var input []model.Series
 	for i, tf := range tfs {
-		val := fmt.Sprintf("%d", (i+1)*10)
-		input = append(input, map[string]interface{}{
-			"metric": map[string]interface{}{"a": "1", "chrono_timeframe": tf},
-			"value":  []interface{}{100, val},
+		input = append(input, model.Series{
+			Labels: map[string]string{"a": "1", "chrono_timeframe": tf},
+			Points: []model.Point{{T: 100000, V: float64((i + 1) * 10)}},
 		})
 	}
 	arr := buildLastMonthAverage(input, false)
 	if len(arr) != 1 {
 		t.Fatalf("got %d series; want 1", len(arr))
 	}
-	pt := arr[0]["value"].([]interface{})
-	if pt[0].(int64) != 100 {
-		t.Errorf("timestamp=%v; want 100", pt[0])
+	pt, _ := arr[0].Last()
+	if pt.T != 100000 {
+		t.Errorf("timestamp=%v; want 100000", pt.T)
 	}
 	// average of 10+20+30+40 = 25
-	if pt[1].(string) != "25" {
-		t.Errorf("value=%v; want 25", pt[1])
+	if pt.V != 25 {
+		t.Errorf("value=%v; want 25", pt.V)
 	}
 }
 
@@ -176,15 +175,15 @@ func TestContainsString(t *testing.T) {
 // ─── filterByTimeframe ──────────────────────────────────────────────────────────
 
 func TestFilterByTimeframe(t *testing.T) {
-	data := []map[string]interface{}{
-		{"metric": map[string]interface{}{"chrono_timeframe": "current"}, "v": 1},
-		{"metric": map[string]interface{}{"chrono_timeframe": "7days"}, "v": 2},
+	data := []model.Series{
+		{Labels: map[string]string{"chrono_timeframe": "current"}},
+		{Labels: map[string]string{"chrono_timeframe": "7days"}},
 	}
 	out := filterByTimeframe(data, "7days")
 	if len(out) != 1 {
 		t.Errorf("got %d; want 1", len(out))
 	}
-	m := out[0]["metric"].(map[string]interface{})
+	m := out[0].Labels
 	if m["chrono_timeframe"] != "7days" {
 		t.Errorf("got %v", m["chrono_timeframe"])
 	}
@@ -193,12 +192,12 @@ func TestFilterByTimeframe(t *testing.T) {
 // ─── indexBySignature ──────────────────────────────────────────────────────────
 
 func TestIndexBySignature(t *testing.T) {
-	all := []map[string]interface{}{
-		{"metric": map[string]interface{}{"a": "1", "chrono_timeframe": "current"}, "v": 1},
-		{"metric": map[string]interface{}{"a": "1", "chrono_timeframe": "7days"}, "v": 2},
+	all := []model.Series{
+		{Labels: map[string]string{"a": "1", "chrono_timeframe": "current"}},
+		{Labels: map[string]string{"a": "1", "chrono_timeframe": "7days"}},
 	}
-	avg := []map[string]interface{}{
-		{"metric": map[string]interface{}{"a": "1", "chrono_timeframe": "lastMonthAverage"}, "v": 3},
+	avg := []model.Series{
+		{Labels: map[string]string{"a": "1", "chrono_timeframe": "lastMonthAverage"}},
 	}
 	cur, a := indexBySignature(all, avg)
 	if len(cur) != 1 || len(a) != 1 {
@@ -301,15 +300,11 @@ func TestAppendCompare(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			curMap := map[string]map[string]interface{}{
-				"test": {
-					"value": []interface{}{float64(100), fmt.Sprintf("%v", tt.current)},
-				},
+			curMap := map[string]model.Series{
+				"test": {Points: []model.Point{{T: 100, V: tt.current}}},
 			}
-			avgMap := map[string]map[string]interface{}{
-				"test": {
-					"value": []interface{}{float64(100), fmt.Sprintf("%v", tt.average)},
-				},
+			avgMap := map[string]model.Series{
+				"test": {Points: []model.Point{{T: 100, V: tt.average}}},
 			}
 
 			result := appendCompare(nil, curMap, avgMap, "", tt.isRange)
@@ -318,9 +313,8 @@ func TestAppendCompare(t *testing.T) {
 				t.Fatalf("Expected 1 result, got %d", len(result))
 			}
 
-			val := result[0]["value"].([]interface{})
-			resultVal, _ := strconv.ParseFloat(val[1].(string), 64)
-			if resultVal != tt.expected {
+			val, _ := result[0].Last()
+			if resultVal := val.V; resultVal != tt.expected {
 				t.Errorf("Expected %v, got %v", tt.expected, resultVal)
 			}
 		})
@@ -353,15 +347,11 @@ func TestAppendPercent(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			curMap := map[string]map[string]interface{}{
-				"test": {
-					"value": []interface{}{float64(100), fmt.Sprintf("%v", tt.current)},
-				},
+			curMap := map[string]model.Series{
+				"test": {Points: []model.Point{{T: 100, V: tt.current}}},
 			}
-			avgMap := map[string]map[string]interface{}{
-				"test": {
-					"value": []interface{}{float64(100), fmt.Sprintf("%v", tt.average)},
-				},
+			avgMap := map[string]model.Series{
+				"test": {Points: []model.Point{{T: 100, V: tt.average}}},
 			}
 
 			result := appendPercent(nil, curMap, avgMap, "", tt.isRange)
@@ -370,9 +360,8 @@ func TestAppendPercent(t *testing.T) {
 				t.Fatalf("Expected 1 result, got %d", len(result))
 			}
 
-			val := result[0]["value"].([]interface{})
-			resultVal, _ := strconv.ParseFloat(val[1].(string), 64)
-			if resultVal != tt.expected {
+			val, _ := result[0].Last()
+			if resultVal := val.V; resultVal != tt.expected {
 				t.Errorf("Expected %v, got %v", tt.expected, resultVal)
 			}
 		})
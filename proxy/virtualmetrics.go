@@ -0,0 +1,188 @@
+// Chronotheus - Time-traveling Prometheus Metrics Proxy
+// Copyright (C) 2025 Andy Dixon <andy@andydixon.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// proxy/virtualmetrics.go
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+// Virtual metrics - the org's blessed comparisons, defined once 🏷️
+//
+// Every team ends up writing its own "checkout latency" PromQL, each a bit
+// different. Define it once in the config:
+//
+//   virtual_metrics:
+//     - name: checkout_latency
+//       expr: histogram_quantile(0.99, sum by (le) (rate(checkout_duration_seconds_bucket[5m])))
+//       timeframes: [current, lastMonthAverage, lastMonthP95]
+//
+// and chrono:checkout_latency in any query is that expression, in
+// brackets, with the usual windows and synthetics worked out around it.
+// chrono_timeframe and the other chrono labels still go on it
+// (chrono:checkout_latency{chrono_timeframe="7days"}); other matchers
+// can't, as there's no selector left to put them on.
+//
+// timeframes is what a query without a chrono_timeframe gets back; empty
+// means everything. Aggregations named there are worked out even when
+// synthetic_aggregations doesn't list them.
+
+const virtualMetricPrefix = "chrono:"
+
+// VirtualMetricConfig is one named expression.
+type VirtualMetricConfig struct {
+	Name       string   `yaml:"name"`
+	Expr       string   `yaml:"expr"`
+	Timeframes []string `yaml:"timeframes,omitempty"` // What plain queries return (empty = everything)
+}
+
+var (
+	// virtualMetricRegex finds chrono:<name>, and any {...} left on it once
+	// the chrono labels are stripped. Not inside a label value or another
+	// name, hence the character before it.
+	virtualMetricRegex = regexp.MustCompile(`(^|[^a-zA-Z0-9_:"])` + virtualMetricPrefix + `([a-zA-Z_][a-zA-Z0-9_:]*)(\{[^}]*\})?`)
+	virtualMetricName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_:]*$`)
+)
+
+// validateVirtualMetrics checks names are valid and unique, expressions are
+// set and don't lean on other virtual metrics, and timeframes are ones
+// plain queries can have.
+func validateVirtualMetrics(vms []VirtualMetricConfig) error {
+	names := make(map[string]bool)
+	for i, vm := range vms {
+		if !virtualMetricName.MatchString(vm.Name) {
+			return fmt.Errorf("virtual_metrics[%d]: name %q isn't a valid metric name", i, vm.Name)
+		}
+		if names[vm.Name] {
+			return fmt.Errorf("virtual_metrics[%d]: duplicate name %q", i, vm.Name)
+		}
+		names[vm.Name] = true
+		if strings.TrimSpace(vm.Expr) == "" {
+			return fmt.Errorf("virtual metric %q: expr is required", vm.Name)
+		}
+		if strings.Contains(vm.Expr, virtualMetricPrefix) {
+			return fmt.Errorf("virtual metric %q: expr can't use other virtual metrics", vm.Name)
+		}
+		for _, tf := range vm.Timeframes {
+			if !plainTimeframe(tf) {
+				return fmt.Errorf("virtual metric %q: %q isn't a timeframe plain queries can return", vm.Name, tf)
+			}
+		}
+	}
+	return nil
+}
+
+// plainTimeframe says whether a query without chrono_timeframe could ever
+// return tf: the windows, the average and its compares, and the optional
+// aggregations and bands.
+func plainTimeframe(tf string) bool {
+	switch tf {
+	case averageAggregation.name, "compareAgainstLast28", "percentCompareAgainstLast28", standardErrorName, bandUpperName, bandLowerName:
+		return true
+	}
+	if _, ok := aggregationByName(tf); ok {
+		return true
+	}
+	return isRawTf(tf, proxyTimeframes())
+}
+
+// expandVirtualMetrics swaps every chrono:<name> in the query for its
+// expression, returning the virtual metric used (nil when there's none).
+// The chrono labels must already be stripped.
+func (p *ChronoProxy) expandVirtualMetrics(params url.Values) (*VirtualMetricConfig, error) {
+	query := params.Get("query")
+	if !strings.Contains(query, virtualMetricPrefix) {
+		return nil, nil
+	}
+	var used *VirtualMetricConfig
+	var err error
+	expanded := virtualMetricRegex.ReplaceAllStringFunc(query, func(m string) string {
+		parts := virtualMetricRegex.FindStringSubmatch(m)
+		vm := p.virtualMetric(parts[2])
+		switch {
+		case err != nil:
+		case vm == nil:
+			err = &badQueryError{msg: fmt.Sprintf("unknown virtual metric %s%s", virtualMetricPrefix, parts[2])}
+		case strings.TrimSpace(strings.Trim(parts[3], "{}")) != "":
+			err = &badQueryError{msg: fmt.Sprintf("virtual metric %s%s takes no label matchers besides the chrono ones", virtualMetricPrefix, vm.Name)}
+		default:
+			if used == nil {
+				used = vm
+			}
+			return parts[1] + "(" + vm.Expr + ")"
+		}
+		return m
+	})
+	if err != nil {
+		return nil, err
+	}
+	params.Set("query", expanded)
+	return used, nil
+}
+
+// virtualMetric finds a virtual metric by name.
+func (p *ChronoProxy) virtualMetric(name string) *VirtualMetricConfig {
+	for i := range p.config.VirtualMetrics {
+		if p.config.VirtualMetrics[i].Name == name {
+			return &p.config.VirtualMetrics[i]
+		}
+	}
+	return nil
+}
+
+// aggregationsFor is what a plain query works out beyond the average: the
+// configured aggregations, plus any vm's timeframes name.
+func (p *ChronoProxy) aggregationsFor(vm *VirtualMetricConfig) []aggregation {
+	if vm == nil || len(vm.Timeframes) == 0 {
+		return p.aggregations
+	}
+	out := append([]aggregation(nil), p.aggregations...)
+	have := make(map[string]bool, len(out))
+	for _, a := range out {
+		have[a.name] = true
+	}
+	extra := append(append([]aggregation(nil), extraAggregations...), p.bands...)
+	for _, tf := range vm.Timeframes {
+		for _, a := range extra {
+			if a.name == tf && !have[tf] {
+				out = append(out, a)
+				have[tf] = true
+			}
+		}
+	}
+	return out
+}
+
+// keepTimeframes drops every series whose chrono_timeframe isn't in tfs.
+func keepTimeframes(all []model.Series, tfs []string) []model.Series {
+	keep := make(map[string]bool, len(tfs))
+	for _, tf := range tfs {
+		keep[tf] = true
+	}
+	out := all[:0]
+	for _, s := range all {
+		if keep[s.Labels["chrono_timeframe"]] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
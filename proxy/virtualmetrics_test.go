@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andydixon/chronotheus/internal/fixtures"
+	"github.com/andydixon/chronotheus/internal/model"
+)
+
+func TestVirtualMetricsValidation(t *testing.T) {
+	for name, vms := range map[string][]VirtualMetricConfig{
+		"bad name":       {{Name: "checkout latency", Expr: "up"}},
+		"duplicate":      {{Name: "a", Expr: "up"}, {Name: "a", Expr: "up"}},
+		"no expr":        {{Name: "a"}},
+		"nested":         {{Name: "a", Expr: "chrono:b * 2"}},
+		"asked-for only": {{Name: "a", Expr: "up", Timeframes: []string{"seasonalBaseline"}}},
+		"unknown window": {{Name: "a", Expr: "up", Timeframes: []string{"yesterday"}}},
+	} {
+		config := DefaultConfig
+		config.VirtualMetrics = vms
+		if err := config.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+	config := DefaultConfig
+	config.VirtualMetrics = []VirtualMetricConfig{{Name: "checkout:latency", Expr: "up", Timeframes: []string{"current", "lastMonthP95", "bandUpper"}}}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVirtualMetricQuery(t *testing.T) {
+	fake := fixtures.NewFakePrometheus()
+	defer fake.Close()
+	for i, at := range []int64{1700000000, 1700000000 - 7*86400, 1700000000 - 14*86400, 1700000000 - 21*86400, 1700000000 - 28*86400} {
+		fake.Serve("/api/v1/query", at, []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"shop"},"value":[`+
+			model.FormatValue(float64(at))+`,"`+model.FormatValue(float64(i+1))+`"]}]}}`))
+	}
+	prefix := "/" + strings.Replace(strings.TrimPrefix(fake.URL, "http://"), ":", "_", 1)
+	config := DefaultConfig
+	config.VirtualMetrics = []VirtualMetricConfig{{
+		Name:       "checkout_latency",
+		Expr:       `sum(rate(checkout_seconds_sum[5m]))`,
+		Timeframes: []string{"current", "lastMonthAverage", "lastMonthMax"},
+	}}
+	p := NewChronoProxyWithConfig(config)
+	query := func(q string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", prefix+"/api/v1/query?time=1700000000&query="+url.QueryEscape(q), nil))
+		return w
+	}
+
+	body := query("chrono:checkout_latency * 1000").Body.String()
+	if asked := fake.Requests()[0].Params.Get("query"); asked != `(sum(rate(checkout_seconds_sum[5m]))) * 1000` {
+		t.Errorf("upstream asked %q", asked)
+	}
+	for _, tf := range []string{"current", "lastMonthAverage", "lastMonthMax"} {
+		if !strings.Contains(body, `"chrono_timeframe":"`+tf+`"`) {
+			t.Errorf("%s missing: %s", tf, body)
+		}
+	}
+	if strings.Contains(body, "7days") || strings.Contains(body, "compareAgainstLast28") {
+		t.Errorf("only the configured timeframes should come back: %s", body)
+	}
+
+	body = query(`chrono:checkout_latency{chrono_timeframe="7days"}`).Body.String()
+	if !strings.Contains(body, `"chrono_timeframe":"7days"`) || strings.Contains(body, "current") {
+		t.Errorf("asking for a timeframe by name: %s", body)
+	}
+
+	for _, bad := range []string{"chrono:nope", `chrono:checkout_latency{job="shop"}`} {
+		if w := query(bad); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", bad, w.Code)
+		}
+	}
+	if w := query(`up{job="chrono:checkout_latency"}`); w.Code != http.StatusOK {
+		t.Errorf("label values aren't virtual metrics: status %d", w.Code)
+	}
+}